@@ -200,6 +200,24 @@ RETURN:
 
 }
 
+// CheckAccount 查询账号是否已被注册，供注册前的可用性检查使用
+func (*AuthService) CheckAccount(ctx context.Context, req *pb.CheckAccountReq) (*pb.CheckAccountRsp, error) {
+	account := req.GetAccount()
+	logger.Sugar().Debugf("RPC-CheckAccountReq { account:%s }", account)
+
+	user, err := db.GetUserByAccount(account)
+	if err != nil {
+		logger.Sugar().Errorln("fail to get user:", err)
+		return &pb.CheckAccountRsp{
+			Result: pb.AuthResult_SERVICE_ERROR,
+		}, nil
+	}
+	return &pb.CheckAccountRsp{
+		Result: pb.AuthResult_OK,
+		Exists: user != nil,
+	}, nil
+}
+
 func userBriefStr(user *db.User) string {
 	return "user" + strconv.FormatInt(user.ID, 10) + "[" + user.Account + "]"
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// conn 一条测试连接。读协程把收到的报文放入 frames，连接关闭后关闭 closed 并记录关闭原因，
+// 场景按需等待期望的报文或关闭码
+type conn struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+	frames  chan *pb.ResponseMessage
+	closed  chan struct{}
+	readErr error // closed 关闭后可读
+
+	userID      int64
+	jwt         string
+	resumeToken string
+	maxFrame    int64
+	heartbeat   time.Duration
+	lastSeq     atomic.Int64 // 收到的最大消息序号
+}
+
+// dialOptions 建立连接时的选项
+type dialOptions struct {
+	ignorePings bool // 不回复服务端的ping，模拟心跳丢失
+}
+
+// dial 建立连接并启动读协程
+func dial(cfg *config, opts dialOptions) (*conn, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify},
+		HandshakeTimeout: cfg.StepTimeout.Duration,
+	}
+	ws, _, err := dialer.Dial(cfg.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("建立连接失败: %w", err)
+	}
+	if opts.ignorePings {
+		ws.SetPingHandler(func(string) error { return nil })
+	}
+	c := &conn{
+		ws:      ws,
+		timeout: cfg.StepTimeout.Duration,
+		frames:  make(chan *pb.ResponseMessage, 1024),
+		closed:  make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *conn) read() {
+	defer close(c.closed)
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		rsp := &pb.ResponseMessage{}
+		if err := proto.Unmarshal(data, rsp); err != nil {
+			c.readErr = fmt.Errorf("响应反序列化失败: %w", err)
+			return
+		}
+		if seq := rsp.GetSeq(); seq > c.lastSeq.Load() {
+			c.lastSeq.Store(seq)
+		}
+		c.frames <- rsp
+	}
+}
+
+// close 以正常关闭码主动断开
+func (c *conn) close() {
+	frame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.ws.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second))
+	select {
+	case <-c.closed:
+	case <-time.After(c.timeout):
+	}
+	_ = c.ws.Close()
+}
+
+// send 发送请求，已登录时附带jwt
+func (c *conn) send(req *pb.RequestMessage) error {
+	if req.Jwt == "" {
+		req.Jwt = c.jwt
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.sendRaw(data)
+}
+
+// sendRaw 发送任意二进制帧
+func (c *conn) sendRaw(data []byte) error {
+	_ = c.ws.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// expect 等待 match 返回true的报文，期间收到的其他报文被忽略
+func (c *conn) expect(what string, match func(*pb.ResponseMessage) bool) (*pb.ResponseMessage, error) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case rsp := <-c.frames:
+			if match(rsp) {
+				return rsp, nil
+			}
+		case <-c.closed:
+			// 关闭前已收到的报文仍需检查
+			for {
+				select {
+				case rsp := <-c.frames:
+					if match(rsp) {
+						return rsp, nil
+					}
+				default:
+					return nil, fmt.Errorf("等待%s时连接已关闭: %v", what, c.readErr)
+				}
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("%v 内未收到%s", c.timeout, what)
+		}
+	}
+}
+
+// expectNone 在 quiet 内不应收到 match 返回true的报文
+func (c *conn) expectNone(what string, quiet time.Duration, match func(*pb.ResponseMessage) bool) error {
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case rsp := <-c.frames:
+			if match(rsp) {
+				return fmt.Errorf("不应收到%s: %v", what, rsp)
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// expectClose 等待服务端关闭连接，校验关闭码与关闭原因。reason 为空时不校验原因；
+// 原因可能带有 ;retry_after_ms= 等附加参数，只比较分号之前的部分。等待期间收到的报文被丢弃
+func (c *conn) expectClose(within time.Duration, code int, reason string) error {
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-c.frames:
+		case <-c.closed:
+			waiting = false
+		case <-timer.C:
+			return fmt.Errorf("%v 内连接未被关闭", within)
+		}
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(c.readErr, &closeErr) {
+		return fmt.Errorf("连接未收到关闭帧就断开: %v", c.readErr)
+	}
+	if closeErr.Code != code {
+		return fmt.Errorf("关闭码为 %d(%q)，期望 %d", closeErr.Code, closeErr.Text, code)
+	}
+	if got, _, _ := strings.Cut(closeErr.Text, ";"); reason != "" && got != reason {
+		return fmt.Errorf("关闭原因为 %q，期望 %q", closeErr.Text, reason)
+	}
+	return nil
+}
+
+// login 以账号密码或恢复令牌登录并等待登录结果，成功时记录用户ID、jwt与协商的参数
+func (c *conn) login(req *pb.LoginReq) (*pb.LoginRsp, error) {
+	if err := c.send(&pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: req}}); err != nil {
+		return nil, fmt.Errorf("发送登录请求失败: %w", err)
+	}
+	rsp, err := c.expect("登录结果", func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetLogin() != nil || rsp.GetRefused() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refused := rsp.GetRefused(); refused != nil {
+		return nil, fmt.Errorf("登录被拒绝: %v", refused.GetReason())
+	}
+	login := rsp.GetLogin()
+	if login.GetResult() == pb.LoginResult_LOGIN_OK {
+		c.userID, c.jwt, c.resumeToken = login.GetUserId(), login.GetJwt(), login.GetResumeToken()
+		c.maxFrame = login.GetCapabilities().GetMaxMessageBytes()
+		c.heartbeat = time.Duration(login.GetCapabilities().GetHeartbeatIntervalMs()) * time.Millisecond
+	}
+	return login, nil
+}
+
+// mustLogin 登录并要求结果为 LOGIN_OK
+func (c *conn) mustLogin(req *pb.LoginReq) error {
+	login, err := c.login(req)
+	if err != nil {
+		return err
+	}
+	if login.GetResult() != pb.LoginResult_LOGIN_OK {
+		return fmt.Errorf("登录结果为 %v，期望 LOGIN_OK", login.GetResult())
+	}
+	return nil
+}
+
+// post 向用户发送一条文本消息
+func (c *conn) post(toID int64, messageID string) error {
+	return c.send(&pb.RequestMessage{
+		Payload: &pb.RequestMessage_Post{
+			Post: &pb.Post{
+				ToId:      toID,
+				Msg:       "conformance " + messageID,
+				MsgType:   "text",
+				MessageId: messageID,
+			},
+		},
+	})
+}
+
+// expectPost 等待指定消息ID的消息
+func (c *conn) expectPost(messageID string) (*pb.ResponseMessage, error) {
+	return c.expect("消息 "+messageID, func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetPost().GetMessageId() == messageID
+	})
+}
+
+// expectRefused 等待指定原因的拒绝响应
+func (c *conn) expectRefused(reason pb.RefusedReason) (*pb.Refused, error) {
+	rsp, err := c.expect("拒绝响应", func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetRefused() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if got := rsp.GetRefused().GetReason(); got != reason {
+		return nil, fmt.Errorf("拒绝原因为 %v，期望 %v", got, reason)
+	}
+	return rsp.GetRefused(), nil
+}
+
+// signup 注册账号并返回注册结果
+func (c *conn) signup(account string, password string) (pb.SignupResult, error) {
+	err := c.send(&pb.RequestMessage{
+		Payload: &pb.RequestMessage_Signup{
+			Signup: &pb.SignupReq{Account: account, Password: password, UserName: account},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("发送注册请求失败: %w", err)
+	}
+	rsp, err := c.expect("注册结果", func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetSignup() != nil || rsp.GetRefused() != nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if refused := rsp.GetRefused(); refused != nil {
+		return 0, fmt.Errorf("注册被拒绝: %v", refused.GetReason())
+	}
+	return rsp.GetSignup().GetResult(), nil
+}
+
+// roundTrip 以时间同步确认连接可用，时间同步不受限流约束
+func (c *conn) roundTrip() error {
+	clientTs := time.Now().UnixNano()
+	err := c.send(&pb.RequestMessage{
+		Payload: &pb.RequestMessage_TimeSync{TimeSync: &pb.TimeSyncReq{ClientTs: clientTs}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.expect("时间同步响应", func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetTimeSync().GetClientTs() == clientTs
+	})
+	return err
+}
@@ -0,0 +1,153 @@
+// conformance 协议一致性测试：作为普通客户端连接任意部署，按顺序执行注册、登录、设备冲突、多设备、离线投递、
+// 确认与补发、限流、登出、非法帧、超大帧、心跳丢失等场景，逐一校验响应码与关闭码，输出JSON或JUnit报告。
+//
+// 用法:
+//
+//	conformance -config staging.json [-report junit] [-out report.xml] [-run 'login|logout']
+//
+// 配置文件见 config 类型，测试账号按环境注入；管理接口令牌从 ADMIN_TOKEN 读取。
+// 每次运行使用随机的账号名与设备ID，场景结束时通过管理接口注销本次注册的账号，可在共享环境中重复执行
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// duration 配置文件中形如 "10s" 的时长
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// account 预先开通的测试账号
+type account struct {
+	Account  string `json:"account"`
+	Password string `json:"password"`
+}
+
+// config 目标环境的配置
+type config struct {
+	URL                string    `json:"url"`                  // WebSocket地址，如 wss://staging.example.com/ws
+	AdminURL           string    `json:"admin_url"`            // 管理接口地址，为空时不清理注册的账号
+	InsecureSkipVerify bool      `json:"insecure_skip_verify"` // 不校验服务端证书，用于自签名的测试环境
+	Signup             bool      `json:"signup"`               // 允许注册新账号；为false时只使用 accounts，数量不足的场景被跳过
+	AccountPrefix      string    `json:"account_prefix"`       // 注册账号名的前缀，便于识别与批量清理
+	Password           string    `json:"password"`             // 注册账号使用的密码
+	Accounts           []account `json:"accounts"`             // 预先开通的账号，优先使用，不会被注销
+	StepTimeout        duration  `json:"step_timeout"`         // 等待单个响应的时间
+	HeartbeatTimeout   duration  `json:"heartbeat_timeout"`    // 心跳丢失场景等待断开的时间，为0时按协商的心跳间隔估算
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{
+		Signup:        true,
+		AccountPrefix: "conformance-",
+		StepTimeout:   duration{10 * time.Second},
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析配置失败: %w", err)
+	}
+	if cfg.URL == "" {
+		return nil, errors.New("配置缺少 url")
+	}
+	if cfg.Signup && cfg.Password == "" {
+		return nil, errors.New("允许注册时配置需要 password")
+	}
+	return cfg, nil
+}
+
+// randomID 随机标识，用于账号名、设备ID与消息ID，保证重复执行互不干扰
+func randomID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func main() {
+	configPath := flag.String("config", "", "目标环境的配置文件")
+	format := flag.String("report", "json", "报告格式: json 或 junit")
+	out := flag.String("out", "", "报告输出文件，为空时输出到标准输出")
+	filter := flag.String("run", "", "只执行名称匹配该正则的场景")
+	flag.Parse()
+
+	if *format != "json" && *format != "junit" {
+		fail(fmt.Errorf("不支持的报告格式: %s", *format))
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fail(err)
+	}
+	var match *regexp.Regexp
+	if *filter != "" {
+		if match, err = regexp.Compile(*filter); err != nil {
+			fail(fmt.Errorf("-run 不是合法的正则: %w", err))
+		}
+	}
+
+	rep := &report{Target: cfg.URL, StartedAt: time.Now()}
+	for _, s := range scenarios {
+		if match != nil && !match.MatchString(s.name) {
+			continue
+		}
+		result := runScenario(cfg, s)
+		fmt.Fprintf(os.Stderr, "%-20s %-7s %6dms %s\n", result.Name, result.Status, result.DurationMs, result.Message)
+		rep.Scenarios = append(rep.Scenarios, result)
+	}
+	rep.DurationMs = time.Since(rep.StartedAt).Milliseconds()
+
+	if err := writeReport(rep, *format, *out); err != nil {
+		fail(fmt.Errorf("写入报告失败: %w", err))
+	}
+	passed, failed, skipped := rep.counts()
+	fmt.Fprintf(os.Stderr, "通过 %d，失败 %d，跳过 %d\n", passed, failed, skipped)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeReport 按格式写入报告，out 为空时写到标准输出
+func writeReport(rep *report, format string, out string) error {
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if format == "junit" {
+		return rep.writeJUnit(w)
+	}
+	return rep.writeJSON(w)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+// 场景结果
+const (
+	statusPassed  = "passed"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// result 一个场景的执行结果
+type result struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	DurationMs int64    `json:"duration_ms"`
+	Message    string   `json:"message,omitempty"`  // 失败或跳过的原因
+	Warnings   []string `json:"warnings,omitempty"` // 不影响结果的问题，如清理失败
+}
+
+// report 一次运行的报告
+type report struct {
+	Target     string    `json:"target"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Scenarios  []result  `json:"scenarios"`
+}
+
+func (r *report) counts() (passed, failed, skipped int) {
+	for _, s := range r.Scenarios {
+		switch s.Status {
+		case statusPassed:
+			passed++
+		case statusFailed:
+			failed++
+		default:
+			skipped++
+		}
+	}
+	return passed, failed, skipped
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// JUnit XML 的最小子集，CI 通常只读取这些字段
+type junitSuite struct {
+	XMLName   xml.Name    `xml:"testsuite"`
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func (r *report) writeJUnit(w io.Writer) error {
+	passed, failed, skipped := r.counts()
+	suite := junitSuite{
+		Name:      "conformance " + r.Target,
+		Tests:     passed + failed + skipped,
+		Failures:  failed,
+		Skipped:   skipped,
+		Time:      float64(r.DurationMs) / 1000,
+		Timestamp: r.StartedAt.UTC().Format(time.RFC3339),
+	}
+	for _, s := range r.Scenarios {
+		c := junitCase{Name: s.Name, ClassName: "conformance", Time: float64(s.DurationMs) / 1000}
+		switch s.Status {
+		case statusFailed:
+			c.Failure = &junitMessage{Message: s.Message}
+		case statusSkipped:
+			c.Skipped = &junitMessage{Message: s.Message}
+		}
+		for _, warning := range s.Warnings {
+			c.SystemOut += warning + "\n"
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
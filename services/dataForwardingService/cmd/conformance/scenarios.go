@@ -0,0 +1,555 @@
+package main
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// scenario 一个测试场景，按 scenarios 中的顺序执行
+type scenario struct {
+	name string
+	run  func(e *env) error
+}
+
+var scenarios = []scenario{
+	{"signup", scenarioSignup},
+	{"login", scenarioLogin},
+	{"duplicate_login", scenarioDuplicateLogin},
+	{"multi_device", scenarioMultiDevice},
+	{"offline_delivery", scenarioOfflineDelivery},
+	{"ack_replay", scenarioAckReplay},
+	{"rate_limit", scenarioRateLimit},
+	{"logout", scenarioLogout},
+	{"malformed_frames", scenarioMalformedFrames},
+	{"oversized_frame", scenarioOversizedFrame},
+	{"heartbeat_miss", scenarioHeartbeatMiss},
+}
+
+// skipError 场景的前提不满足，如账号不足，不计为失败
+type skipError struct {
+	reason string
+}
+
+func (e skipError) Error() string {
+	return e.reason
+}
+
+// testUser 场景使用的账号，userID 在第一次登录后填写
+type testUser struct {
+	account  string
+	password string
+	userID   int64
+	created  bool // 由本场景注册，结束时注销
+}
+
+// env 场景的执行环境：分配账号、建立连接，结束时关闭连接并注销本场景注册的账号
+type env struct {
+	cfg      *config
+	conns    []*conn
+	users    []*testUser
+	warnings []string
+}
+
+// runScenario 执行场景并清理，场景失败不影响清理
+func runScenario(cfg *config, s scenario) result {
+	start := time.Now()
+	e := &env{cfg: cfg}
+	err := s.run(e)
+	e.cleanup()
+	r := result{Name: s.name, Status: statusPassed, Warnings: e.warnings}
+	var skip skipError
+	switch {
+	case errors.As(err, &skip):
+		r.Status, r.Message = statusSkipped, skip.reason
+	case err != nil:
+		r.Status, r.Message = statusFailed, err.Error()
+	}
+	r.DurationMs = time.Since(start).Milliseconds()
+	return r
+}
+
+// dial 建立连接，场景结束时关闭
+func (e *env) dial(opts dialOptions) (*conn, error) {
+	c, err := dial(e.cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.conns = append(e.conns, c)
+	return c, nil
+}
+
+// accounts 取 n 个账号：配置中的预开通账号足够时使用它们，否则注册新账号
+func (e *env) accounts(n int) ([]*testUser, error) {
+	users := make([]*testUser, 0, n)
+	if len(e.cfg.Accounts) >= n {
+		for _, a := range e.cfg.Accounts[:n] {
+			users = append(users, &testUser{account: a.Account, password: a.Password})
+		}
+		return users, nil
+	}
+	if !e.cfg.Signup {
+		return nil, skipError{fmt.Sprintf("需要 %d 个账号，配置中只有 %d 个且不允许注册", n, len(e.cfg.Accounts))}
+	}
+	for range n {
+		u, err := e.signup()
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// signup 注册一个随机账号名的新账号
+func (e *env) signup() (*testUser, error) {
+	c, err := e.dial(dialOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	u := &testUser{account: e.cfg.AccountPrefix + randomID(), password: e.cfg.Password, created: true}
+	result, err := c.signup(u.account, u.password)
+	if err != nil {
+		return nil, err
+	}
+	if result != pb.SignupResult_SIGNUP_OK {
+		return nil, fmt.Errorf("注册结果为 %v，期望 SIGNUP_OK", result)
+	}
+	e.users = append(e.users, u)
+	return u, nil
+}
+
+// connect 以账号登录一个新设备
+func (e *env) connect(u *testUser, deviceID string, opts dialOptions) (*conn, error) {
+	c, err := e.dial(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.mustLogin(&pb.LoginReq{Account: u.account, Password: u.password, DeviceId: deviceID}); err != nil {
+		return nil, fmt.Errorf("账号 %s 登录失败: %w", u.account, err)
+	}
+	u.userID = c.userID
+	return c, nil
+}
+
+// resume 以恢复令牌重连，lastSeq 为之前收到的最大消息序号
+func (e *env) resume(prev *conn) (*conn, error) {
+	c, err := e.dial(dialOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.mustLogin(&pb.LoginReq{ResumeToken: prev.resumeToken, LastSeq: prev.lastSeq.Load()}); err != nil {
+		return nil, fmt.Errorf("恢复令牌登录失败: %w", err)
+	}
+	return c, nil
+}
+
+func (e *env) warnf(format string, args ...any) {
+	e.warnings = append(e.warnings, fmt.Sprintf(format, args...))
+}
+
+// cleanup 关闭连接并通过管理接口注销本场景注册的账号
+func (e *env) cleanup() {
+	for _, c := range e.conns {
+		c.close()
+	}
+	for _, u := range e.users {
+		if !u.created {
+			continue
+		}
+		if u.userID == 0 {
+			// 注册后未能登录，再试一次以取得用户ID
+			c, err := e.dial(dialOptions{})
+			if err == nil {
+				if err = c.mustLogin(&pb.LoginReq{Account: u.account, Password: u.password, DeviceId: "conformance-cleanup"}); err == nil {
+					u.userID = c.userID
+				}
+				c.close()
+			}
+			if u.userID == 0 {
+				e.warnf("账号 %s 无法登录，未能清理: %v", u.account, err)
+				continue
+			}
+		}
+		if err := e.deleteAccount(u.userID); err != nil {
+			e.warnf("注销账号 %s(%d) 失败: %v", u.account, u.userID, err)
+		}
+	}
+}
+
+// deleteAccount 调用管理接口注销账号
+func (e *env) deleteAccount(userID int64) error {
+	if e.cfg.AdminURL == "" {
+		return errors.New("未配置 admin_url")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.StepTimeout.Duration)
+	defer cancel()
+	target := e.cfg.AdminURL + "/admin/accounts/" + url.PathEscape(strconv.FormatInt(userID, 10))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("管理接口返回 %s", resp.Status)
+	}
+	return nil
+}
+
+func newDeviceID() string {
+	return "conformance-" + randomID()
+}
+
+// quiet 确认不会收到某类报文时等待的时间
+func (e *env) quiet() time.Duration {
+	return min(2*time.Second, e.cfg.StepTimeout.Duration)
+}
+
+// scenarioSignup 注册新账号，重复注册返回 ACCOUNT_EXIST，空账号返回 ACCOUNT_EMPTY
+func scenarioSignup(e *env) error {
+	if !e.cfg.Signup {
+		return skipError{"配置不允许注册新账号"}
+	}
+	u, err := e.signup()
+	if err != nil {
+		return err
+	}
+	c, err := e.dial(dialOptions{})
+	if err != nil {
+		return err
+	}
+	result, err := c.signup(u.account, u.password)
+	if err != nil {
+		return err
+	}
+	if result != pb.SignupResult_ACCOUNT_EXIST {
+		return fmt.Errorf("重复注册结果为 %v，期望 ACCOUNT_EXIST", result)
+	}
+	result, err = c.signup("", u.password)
+	if err != nil {
+		return err
+	}
+	if result != pb.SignupResult_ACCOUNT_EMPTY {
+		return fmt.Errorf("空账号注册结果为 %v，期望 ACCOUNT_EMPTY", result)
+	}
+	_, err = e.connect(u, newDeviceID(), dialOptions{})
+	return err
+}
+
+// scenarioLogin 未登录的业务请求被拒绝，密码错误返回 PASSWORD_ERROR，登录成功时返回用户ID、jwt、恢复令牌与服务端能力
+func scenarioLogin(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	u := users[0]
+	c, err := e.dial(dialOptions{})
+	if err != nil {
+		return err
+	}
+	if err := c.send(&pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{}}}); err != nil {
+		return err
+	}
+	if _, err := c.expectRefused(pb.RefusedReason_NOT_LOGGED_IN); err != nil {
+		return fmt.Errorf("未登录时发送回显: %w", err)
+	}
+	login, err := c.login(&pb.LoginReq{Account: u.account, Password: u.password + "-wrong", DeviceId: newDeviceID()})
+	if err != nil {
+		return err
+	}
+	if login.GetResult() != pb.LoginResult_PASSWORD_ERROR {
+		return fmt.Errorf("密码错误时登录结果为 %v，期望 PASSWORD_ERROR", login.GetResult())
+	}
+	if err := c.mustLogin(&pb.LoginReq{Account: u.account, Password: u.password, DeviceId: newDeviceID()}); err != nil {
+		return err
+	}
+	u.userID = c.userID
+	switch {
+	case c.userID <= 0:
+		return fmt.Errorf("登录结果的 user_id 为 %d", c.userID)
+	case c.jwt == "":
+		return errors.New("登录结果没有 jwt")
+	case c.resumeToken == "":
+		return errors.New("登录结果没有 resume_token")
+	case c.maxFrame <= 0:
+		return errors.New("登录结果没有 capabilities.max_message_bytes")
+	}
+	return c.roundTrip()
+}
+
+// scenarioDuplicateLogin 同一设备再次登录时旧连接以 1008 evicted_conflict 关闭，新连接可用
+func scenarioDuplicateLogin(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	deviceID := newDeviceID()
+	first, err := e.connect(users[0], deviceID, dialOptions{})
+	if err != nil {
+		return err
+	}
+	second, err := e.connect(users[0], deviceID, dialOptions{})
+	if err != nil {
+		return err
+	}
+	if err := first.expectClose(e.cfg.StepTimeout.Duration, websocket.ClosePolicyViolation, "evicted_conflict"); err != nil {
+		return fmt.Errorf("旧连接: %w", err)
+	}
+	return second.roundTrip()
+}
+
+// scenarioMultiDevice 同一用户的两个设备同时在线，都收到发给该用户的消息
+func scenarioMultiDevice(e *env) error {
+	users, err := e.accounts(2)
+	if err != nil {
+		return err
+	}
+	a, b := users[0], users[1]
+	a1, err := e.connect(a, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	a2, err := e.connect(a, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	b1, err := e.connect(b, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	messageID := randomID()
+	if err := b1.post(a.userID, messageID); err != nil {
+		return err
+	}
+	for i, c := range []*conn{a1, a2} {
+		rsp, err := c.expectPost(messageID)
+		if err != nil {
+			return fmt.Errorf("设备 %d: %w", i+1, err)
+		}
+		if rsp.GetSeq() <= 0 {
+			return fmt.Errorf("设备 %d 收到的消息没有序号", i+1)
+		}
+		if rsp.GetPost().GetFromId() != b.userID {
+			return fmt.Errorf("设备 %d 收到的消息 from_id 为 %d，期望 %d", i+1, rsp.GetPost().GetFromId(), b.userID)
+		}
+	}
+	return nil
+}
+
+// scenarioOfflineDelivery 接收者断线期间发给它的消息在以恢复令牌重连后补发
+func scenarioOfflineDelivery(e *env) error {
+	users, err := e.accounts(2)
+	if err != nil {
+		return err
+	}
+	a, b := users[0], users[1]
+	a1, err := e.connect(a, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	b1, err := e.connect(b, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	// 先收到一条消息，重连时才有已收到的序号
+	warmup := randomID()
+	if err := b1.post(a.userID, warmup); err != nil {
+		return err
+	}
+	if _, err := a1.expectPost(warmup); err != nil {
+		return err
+	}
+	a1.close()
+	missed := randomID()
+	if err := b1.post(a.userID, missed); err != nil {
+		return err
+	}
+	if err := b1.roundTrip(); err != nil {
+		return err
+	}
+	a2, err := e.resume(a1)
+	if err != nil {
+		return err
+	}
+	if _, err := a2.expectPost(missed); err != nil {
+		return fmt.Errorf("重连后: %w", err)
+	}
+	return nil
+}
+
+// scenarioAckReplay 确认收到的序号不产生响应；重连时只补发 last_seq 之后的消息，不重复投递已收到的
+func scenarioAckReplay(e *env) error {
+	users, err := e.accounts(2)
+	if err != nil {
+		return err
+	}
+	a, b := users[0], users[1]
+	a1, err := e.connect(a, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	b1, err := e.connect(b, newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	first, second := randomID(), randomID()
+	for _, id := range []string{first, second} {
+		if err := b1.post(a.userID, id); err != nil {
+			return err
+		}
+	}
+	firstRsp, err := a1.expectPost(first)
+	if err != nil {
+		return err
+	}
+	if _, err := a1.expectPost(second); err != nil {
+		return err
+	}
+	if err := a1.send(&pb.RequestMessage{Payload: &pb.RequestMessage_AckSeq{AckSeq: &pb.AckSeq{Seq: firstRsp.GetSeq()}}}); err != nil {
+		return err
+	}
+	if err := a1.expectNone("对确认的拒绝响应", e.quiet(), func(rsp *pb.ResponseMessage) bool { return rsp.GetRefused() != nil }); err != nil {
+		return err
+	}
+	// 声称只收到第一条，重连后应补发第二条且只补发第二条
+	a1.lastSeq.Store(firstRsp.GetSeq())
+	a1.close()
+	a2, err := e.resume(a1)
+	if err != nil {
+		return err
+	}
+	if _, err := a2.expectPost(second); err != nil {
+		return fmt.Errorf("重连后: %w", err)
+	}
+	return a2.expectNone("已确认的消息 "+first, e.quiet(), func(rsp *pb.ResponseMessage) bool {
+		return rsp.GetPost().GetMessageId() == first
+	})
+}
+
+// scenarioRateLimit 短时间内大量发送回显请求，超出突发上限后返回 RATE_LIMITED
+func scenarioRateLimit(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	c, err := e.connect(users[0], newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	const burst = 200
+	for range burst {
+		if err := c.send(&pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{}}}); err != nil {
+			return err
+		}
+	}
+	if _, err := c.expectRefused(pb.RefusedReason_RATE_LIMITED); err != nil {
+		return fmt.Errorf("连续发送 %d 个回显请求后: %w", burst, err)
+	}
+	return nil
+}
+
+// scenarioLogout 登出返回 LogoutAck，随后连接以 1000 peer_logout 关闭
+func scenarioLogout(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	c, err := e.connect(users[0], newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	if err := c.send(&pb.RequestMessage{Payload: &pb.RequestMessage_Logout{Logout: &pb.LogoutReq{}}}); err != nil {
+		return err
+	}
+	if _, err := c.expect("登出确认", func(rsp *pb.ResponseMessage) bool { return rsp.GetLogoutAck() != nil }); err != nil {
+		return err
+	}
+	return c.expectClose(e.cfg.StepTimeout.Duration, websocket.CloseNormalClosure, "peer_logout")
+}
+
+// scenarioMalformedFrames 无法解析的帧返回 INVALID_PAYLOAD(malformed) 且连接仍可用，连续多次后以 1002 protocol_error 关闭
+func scenarioMalformedFrames(e *env) error {
+	c, err := e.dial(dialOptions{})
+	if err != nil {
+		return err
+	}
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+	if err := c.sendRaw(garbage); err != nil {
+		return err
+	}
+	refused, err := c.expectRefused(pb.RefusedReason_INVALID_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	if refused.GetCategory() != "malformed" {
+		return fmt.Errorf("拒绝类别为 %q，期望 malformed", refused.GetCategory())
+	}
+	if err := c.roundTrip(); err != nil {
+		return fmt.Errorf("收到非法帧后连接不可用: %w", err)
+	}
+	for range 64 {
+		if err := c.sendRaw(garbage); err != nil {
+			break
+		}
+	}
+	return c.expectClose(e.cfg.StepTimeout.Duration, websocket.CloseProtocolError, "protocol_error")
+}
+
+// scenarioOversizedFrame 超过 max_message_bytes 的帧导致连接以 1009 关闭
+func scenarioOversizedFrame(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	c, err := e.connect(users[0], newDeviceID(), dialOptions{})
+	if err != nil {
+		return err
+	}
+	if c.maxFrame <= 0 {
+		return errors.New("登录结果没有 capabilities.max_message_bytes")
+	}
+	// 服务端读到超限的长度后即关闭，发送可能中途失败
+	_ = c.sendRaw(make([]byte, c.maxFrame+1))
+	return c.expectClose(e.cfg.StepTimeout.Duration, websocket.CloseMessageTooBig, "")
+}
+
+// scenarioHeartbeatMiss 请求最短的心跳间隔且不回复ping，连接以 1000 idle_timeout 关闭
+func scenarioHeartbeatMiss(e *env) error {
+	users, err := e.accounts(1)
+	if err != nil {
+		return err
+	}
+	c, err := e.dial(dialOptions{ignorePings: true})
+	if err != nil {
+		return err
+	}
+	u := users[0]
+	if err := c.mustLogin(&pb.LoginReq{Account: u.account, Password: u.password, DeviceId: newDeviceID(), HeartbeatIntervalMs: 1}); err != nil {
+		return err
+	}
+	u.userID = c.userID
+	wait := e.cfg.HeartbeatTimeout.Duration
+	if wait <= 0 {
+		if c.heartbeat <= 0 {
+			return errors.New("登录结果没有 capabilities.heartbeat_interval_ms")
+		}
+		// 服务端默认连续3个间隔无活动即断开，多留一个间隔与单步超时的余量
+		wait = 4*c.heartbeat + e.cfg.StepTimeout.Duration
+	}
+	return c.expectClose(wait, websocket.CloseNormalClosure, "idle_timeout")
+}
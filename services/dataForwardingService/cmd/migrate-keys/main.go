@@ -0,0 +1,51 @@
+// migrate-keys 键迁移工具：启用 REDIS_KEY_PREFIX 后，将redis中未加前缀的旧键在线改名为加前缀的新键，
+// 保留过期时间，可重复执行。
+//
+// 用法:
+//
+//	REDIS_KEY_PREFIX=prod migrate-keys [-batch 500] [-dry-run]
+//
+// redis 地址从 REDIS_ADDR 读取。应在所有容器以新前缀启动后尽快执行：
+// 在此之前写入新键的设备登记等状态会与旧键冲突，冲突的旧键保留不动并计入统计，可在确认后手动删除
+package main
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/redis/keys"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	batch := flag.Int("batch", 500, "每批SCAN并改名的键数")
+	dryRun := flag.Bool("dry-run", false, "只统计需要迁移的旧键，不改名")
+	timeout := flag.Duration("timeout", time.Hour, "整个迁移过程的超时")
+	flag.Parse()
+
+	if *batch <= 0 {
+		fail(fmt.Errorf("batch 必须大于0: %d", *batch))
+	}
+	if err := redisClient.InitRedis(); err != nil {
+		fail(err)
+	}
+	defer redisClient.Rdb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	fmt.Fprintf(os.Stderr, "迁移到前缀 %q\n", keys.Prefix())
+	stats, err := redisClient.MigrateKeys(ctx, *batch, *dryRun, func(s redisClient.MigrationStats) {
+		fmt.Fprintf(os.Stderr, "已扫描 %d，已改名 %d，冲突 %d\n", s.Scanned, s.Renamed, s.Conflicts)
+	})
+	if err != nil {
+		fail(fmt.Errorf("迁移失败(已完成部分可重复执行继续): %w", err))
+	}
+	fmt.Printf("扫描 %d，改名 %d，冲突 %d，已不存在 %d\n", stats.Scanned, stats.Renamed, stats.Conflicts, stats.Missing)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
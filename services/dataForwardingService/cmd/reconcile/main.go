@@ -0,0 +1,304 @@
+// reconcile 对账工具：比较连接审计记录、各容器的存活连接与redis中的设备登记和容器集合，
+// 报告两个方向的孤儿记录，并可通过管理接口删除没有对应存活连接的登记。
+//
+// 用法:
+//
+//	reconcile -window 1h -admin df-1=http://10.0.0.1:54343,df-2=http://10.0.0.2:54343 [-fix]
+//
+// 管理接口令牌从 ADMIN_TOKEN 读取，redis 地址从 REDIS_ADDR 读取。
+// 连接审计记录需在各容器开启 AUDIT_CONNECTIONS；未列出管理地址的存活容器无法确认存活连接，只做redis内部一致性检查
+package main
+
+import (
+	"context"
+	"data_forwarding_service/internal/audit"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/redis"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 对账发现的问题类型
+const (
+	kindMissingMember    = "missing_member"    // 设备登记指向的容器集合中没有该设备
+	kindStaleMember      = "stale_member"      // 容器集合中的设备没有指向该容器的登记
+	kindDeadContainer    = "dead_container"    // 设备登记指向已不存活的容器
+	kindGhost            = "ghost"             // 设备登记指向的容器上没有该设备的连接
+	kindUnregistered     = "unregistered"      // 容器上的存活连接没有指向该容器的登记
+	kindDisconnectedLast = "disconnected_last" // 窗口内最后一条审计记录为断开，登记却仍指向同一容器
+)
+
+// actionDisconnected 连接审计记录中表示断开的 Action
+const actionDisconnected = "disconnected"
+
+// finding 一条对账结果
+type finding struct {
+	Kind      string `json:"kind"`
+	DeviceKey string `json:"device_key"`
+	Container string `json:"container"`
+	Detail    string `json:"detail,omitempty"`
+	Fixed     bool   `json:"fixed,omitempty"`
+}
+
+// lastSeen 窗口内某设备最后一条连接审计记录
+type lastSeen struct {
+	action    string
+	container string
+	at        time.Time
+}
+
+func main() {
+	window := flag.Duration("window", time.Hour, "读取多长时间内的连接审计记录")
+	adminList := flag.String("admin", "", "各容器的管理接口地址，格式 容器ID=URL，逗号分隔")
+	fix := flag.Bool("fix", false, "通过管理接口删除没有对应存活连接的登记")
+	timeout := flag.Duration("timeout", time.Minute, "整个对账过程的超时")
+	flag.Parse()
+
+	admins, err := parseAdmins(*adminList)
+	if err != nil {
+		fail(err)
+	}
+	if err := redisClient.InitRedis(); err != nil {
+		fail(err)
+	}
+	defer redisClient.Rdb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	registrations, err := redisClient.ScanRegistrations(ctx)
+	if err != nil {
+		fail(fmt.Errorf("读取设备登记失败: %w", err))
+	}
+	members, err := redisClient.ScanContainerMembers(ctx)
+	if err != nil {
+		fail(fmt.Errorf("读取容器集合失败: %w", err))
+	}
+	alive, err := identity.ListContainers(ctx)
+	if err != nil {
+		fail(fmt.Errorf("读取存活容器失败: %w", err))
+	}
+	live := make(map[string]map[string]bool, len(admins))
+	for containerID, base := range admins {
+		keys, err := liveConnections(ctx, base)
+		if err != nil {
+			fail(fmt.Errorf("读取容器 %s 的连接列表失败: %w", containerID, err))
+		}
+		live[containerID] = keys
+	}
+	seen, err := readConnectionAudit(ctx, time.Now().Add(-*window))
+	if err != nil {
+		fail(fmt.Errorf("读取连接审计记录失败: %w", err))
+	}
+
+	findings := compare(registrations, members, alive, live, seen)
+	if *fix {
+		for i := range findings {
+			findings[i].Fixed = tryFix(ctx, admins, findings[i])
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	counts := make(map[string]int)
+	for _, f := range findings {
+		counts[f.Kind]++
+		_ = encoder.Encode(f)
+	}
+	fmt.Fprintf(os.Stderr, "登记 %d 条，存活容器 %d 个(已核对连接 %d 个)，窗口内审计设备 %d 个，发现问题 %d 条 %v\n",
+		len(registrations), len(alive), len(live), len(seen), len(findings), counts)
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// compare 比较各个来源，结果按设备排序
+func compare(registrations map[string]string, members map[string][]string, alive []string,
+	live map[string]map[string]bool, seen map[string]lastSeen) []finding {
+	var findings []finding
+	memberSets := make(map[string]map[string]bool, len(members))
+	for containerID, keys := range members {
+		set := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			set[key] = true
+			if registrations[key] != containerID {
+				findings = append(findings, finding{Kind: kindStaleMember, DeviceKey: key, Container: containerID,
+					Detail: "registered to " + orNothing(registrations[key])})
+			}
+		}
+		memberSets[containerID] = set
+	}
+
+	for key, containerID := range registrations {
+		if !memberSets[containerID][key] {
+			findings = append(findings, finding{Kind: kindMissingMember, DeviceKey: key, Container: containerID})
+		}
+		switch connections, checked := live[containerID]; {
+		case !slices.Contains(alive, containerID):
+			findings = append(findings, finding{Kind: kindDeadContainer, DeviceKey: key, Container: containerID})
+		case checked && !connections[key]:
+			findings = append(findings, finding{Kind: kindGhost, DeviceKey: key, Container: containerID})
+		}
+		if last, ok := seen[key]; ok && last.action == actionDisconnected && last.container == containerID {
+			findings = append(findings, finding{Kind: kindDisconnectedLast, DeviceKey: key, Container: containerID,
+				Detail: "disconnected at " + last.at.Format(time.RFC3339)})
+		}
+	}
+
+	for containerID, connections := range live {
+		for key := range connections {
+			if registrations[key] != containerID {
+				findings = append(findings, finding{Kind: kindUnregistered, DeviceKey: key, Container: containerID,
+					Detail: "registered to " + orNothing(registrations[key])})
+			}
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].DeviceKey != findings[j].DeviceKey {
+			return findings[i].DeviceKey < findings[j].DeviceKey
+		}
+		return findings[i].Kind < findings[j].Kind
+	})
+	return findings
+}
+
+func orNothing(containerID string) string {
+	if containerID == "" {
+		return "nothing"
+	}
+	return containerID
+}
+
+// tryFix 删除没有对应存活连接的登记与残留成员，优先由所属容器删除，所属容器已不存活时由任一容器代为删除。
+// 管理接口会在删除前重新确认设备不在线，对账快照过时时不会误删
+func tryFix(ctx context.Context, admins map[string]string, f finding) bool {
+	if f.Kind != kindGhost && f.Kind != kindStaleMember && f.Kind != kindDeadContainer {
+		return false
+	}
+	base, ok := admins[f.Container]
+	if !ok {
+		// 所属容器不可达时由任一容器代为删除，管理接口会拒绝删除存活容器的登记
+		for _, b := range admins {
+			base = b
+			break
+		}
+	}
+	if base == "" {
+		return false
+	}
+	userID, deviceID, valid := redisClient.SplitDeviceKey(f.DeviceKey)
+	if !valid {
+		return false
+	}
+	target := base + "/admin/registrations/" + url.PathEscape(userID) + "/" + url.PathEscape(deviceID) +
+		"?container=" + url.QueryEscape(f.Container)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return false
+	}
+	rsp, err := doAdmin(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "修复 %s 失败: %v\n", f.DeviceKey, err)
+		return false
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "修复 %s 被拒绝: %s\n", f.DeviceKey, rsp.Status)
+		return false
+	}
+	return true
+}
+
+// liveConnections 通过管理接口读取容器上已登录的连接，返回 DeviceKey 集合
+func liveConnections(ctx context.Context, base string) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/admin/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := doAdmin(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("管理接口返回 %s", rsp.Status)
+	}
+	var list []struct {
+		UserID   string `json:"user_id"`
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(list))
+	for _, c := range list {
+		if c.UserID != "" {
+			keys[redisClient.DeviceKey(c.UserID, c.DeviceID)] = true
+		}
+	}
+	return keys, nil
+}
+
+// readConnectionAudit 从新到旧读取连接审计记录直到窗口起点，返回每个设备最后一条记录
+func readConnectionAudit(ctx context.Context, since time.Time) (map[string]lastSeen, error) {
+	seen := make(map[string]lastSeen)
+	before := ""
+	for {
+		events, next, err := audit.Recent(ctx, before, 500)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if event.At.Before(since) {
+				return seen, nil
+			}
+			if event.Type != audit.TypeConnection || len(event.Users) == 0 {
+				continue
+			}
+			key := redisClient.DeviceKey(event.Users[0], event.Params["device_id"])
+			if _, ok := seen[key]; !ok {
+				seen[key] = lastSeen{action: event.Action, container: event.Params["container"], at: event.At}
+			}
+		}
+		if next == "" {
+			return seen, nil
+		}
+		before = next
+	}
+}
+
+// parseAdmins 解析 容器ID=URL 列表
+func parseAdmins(list string) (map[string]string, error) {
+	admins := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		containerID, base, ok := strings.Cut(item, "=")
+		if !ok || containerID == "" || base == "" {
+			return nil, fmt.Errorf("管理接口地址格式错误: %q", item)
+		}
+		admins[containerID] = strings.TrimSuffix(base, "/")
+	}
+	return admins, nil
+}
+
+func doAdmin(req *http.Request) (*http.Response, error) {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
@@ -1,3 +1,25 @@
 package config
 
+import "os"
+
 var DefaultNsServer = "localhost:9092"
+
+// CertFiles 公共WebSocket服务的TLS证书与私钥路径(环境变量 CERT_PATH、KEY_PATH)
+func CertFiles() (certFile string, keyFile string) {
+	certFile, keyFile = os.Getenv("CERT_PATH"), os.Getenv("KEY_PATH")
+	if certFile == "" {
+		certFile = "./certs/cert.pem"
+	}
+	if keyFile == "" {
+		keyFile = "./certs/key.pem"
+	}
+	return certFile, keyFile
+}
+
+// KafkaBrokers 消息队列地址列表(环境变量 KAFKA_BROKER，逗号分隔)
+func KafkaBrokers() string {
+	if broker := os.Getenv("KAFKA_BROKER"); broker != "" {
+		return broker
+	}
+	return DefaultNsServer
+}
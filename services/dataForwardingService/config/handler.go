@@ -0,0 +1,472 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandlerConfig 连接处理相关配置，启动时从环境变量加载
+type HandlerConfig struct {
+	MaxFrameBytes           int64          // 单帧最大字节数
+	ChunkSize               int            // 出站分片大小
+	ChunkThreshold          int            // 超过该大小的出站消息才会被分片
+	MaxTransferBytes        int            // 单次分片传输重组后的最大字节数
+	TopicPrefix             string         // 消息队列topic与消费组的前缀(环境/集群名)，为空时不加前缀
+	TopicMigration          bool           // 启用前缀的迁移期：仍向旧名称发布，同时订阅新旧名称；所有容器升级后关闭
+	RedisKeyPrefix          string         // redis键的前缀(环境/集群名)，为空时不加前缀；启用后用 migrate-keys 工具迁移旧键
+	MaxWireBytes            int            // 经消息队列收到的单条报文的最大字节数
+	DecodeMaxDepth          int            // 反序列化允许的最大嵌套层数
+	DecodeMaxEntries        int            // 单个消息中一个repeated或map字段的最大元素数，解码前检查
+	BatchMaxEntries         int            // 批量请求最多包含的条目数
+	BatchMaxBytes           int            // 批量请求序列化后的最大字节数
+	MaxUndecodableFrames    int            // 连续收到多少帧无法解析的报文后以协议错误断开，为0时不断开
+	UndecodablePreview      int            // 拒绝无法解析的报文时回显的开头字节数
+	MaxTransferChunks       int32          // 单次分片传输允许的最大分片数
+	MaxConcurrentTransfers  int            // 每个连接同时进行的分片传输数
+	ChunkTimeout            time.Duration  // 分片传输不活跃超时，超时后丢弃未完成的传输
+	MaxKeyBundleBytes       int            // 单个设备公钥包的最大字节数
+	MaxDevicesPerUser       int            // 每个用户最多保存公钥包的设备数
+	MaxEchoBytes            int            // 连通性自检回显内容的最大字节数
+	EchoRate                float64        // 连通性自检每秒允许的次数
+	EchoBurst               int            // 连通性自检允许的突发次数
+	ResumeTokenTTL          time.Duration  // 恢复令牌有效期
+	ConnectTokenMaxTTL      time.Duration  // 连接授权令牌允许的最长剩余有效期，超出的令牌被拒绝
+	JWKSURL                 string         // 身份提供方的 JWKS 地址，为空时不接受 Authorization: Bearer
+	JWKSRefresh             time.Duration  // JWKS 缓存刷新周期
+	JWTAudience             string         // JWT 的 aud 需包含该值，为空时不检查
+	JWTIssuer               string         // JWT 的 iss 需等于该值，为空时不检查
+	JWTUserClaim            string         // 存放用户ID的 JWT 字段
+	JWTClockSkew            time.Duration  // 校验 exp/nbf 时容忍的时钟偏差
+	ReauthLeadTime          time.Duration  // 会话到期前多久要求客户端提交新令牌，也是管理员要求重新认证时的默认宽限期
+	MessageTimeout          time.Duration  // 单条消息处理的超时时间，超时后取消其中的redis、RPC等调用
+	MaxInFlight             int            // 每个连接同时处理中的请求数上限
+	InFlightWait            time.Duration  // 并发名额已满时的最长等待时间
+	TapMaxDuration          time.Duration  // 旁路监听最长持续时间
+	RegistrationRetryWindow time.Duration  // redis登记失败时后台重试的最长时间
+	LoginDampWindow         time.Duration  // 登录抑制的滑动窗口，同一设备在窗口内登录超过 LoginDampMax 次时拒绝
+	LoginDampMax            int            // 同一设备在窗口内允许的登录次数，为0时不抑制
+	BulkCredit              int            // 连续发送多少个高优先级报文后必须让出一次给批量队列
+	TwoFactorTTL            time.Duration  // 二次验证挑战的有效期
+	TwoFactorMaxAttempts    int            // 同一挑战允许提交验证码的次数
+	AvailabilityPerMinute   int            // 每个IP每分钟允许的可用性检查次数
+	AvailabilityBurst       int            // 每个IP可用性检查的突发上限
+	AvailabilityCacheTTL    time.Duration  // 可用性检查结果在redis中的缓存时间
+	VagueEmailAvailability  bool           // 邮箱可用性不返回是否已注册，避免被用于探测邮箱
+	DeliveryDedupTTL        time.Duration  // 投递去重键的保留时间
+	TransitionHoldMax       int            // 设备登录切换期间每个设备暂存的投递条数上限
+	TransitionTTL           time.Duration  // 登录切换标记的最长保留时间，切换异常中断时由过期清除
+	BulkDeliveryWorkers     int            // 批量投递时并行投递本地连接的协程数
+	LogoutFlushTimeout      time.Duration  // 登出时等待发送队列清空的最长时间
+	ResidualPersistTimeout  time.Duration  // 连接关闭时把发送队列中未发出的带序号消息转存离线存储的最长时间
+	OfflineCompactInterval  time.Duration  // 离线存储压缩(物理删除已标记删除与过期的条目)的间隔，为0时不压缩
+	OfflineRetention        time.Duration  // redis离线存储中条目的保留时间，超过后不再回放并在压缩时删除
+	OfflineBackend          string         // 离线存储：redis 保存到redis stream，none 不保存，不在线的消息直接丢弃
+	ReceiptTTL              time.Duration  // 投递回执等待确认的最长时间，超过后发布过期回执
+	ReceiptSweepInterval    time.Duration  // 回执过期清理的间隔，为0时不清理
+	SendBufferSize          int            // 每个连接发送队列的默认容量
+	SendBufferClasses       map[string]int // {客户端类别: 发送队列容量}，登录时按客户端声明的类别覆盖默认容量
+	LimitWarningPercent     int            // 使用量达到容量的该百分比时推送一次软限制告警，为0时不告警
+	LimitWarningClasses     map[string]int // {限制名: 告警百分比}，覆盖 LimitWarningPercent，限制名为限流类别或 send_buffer
+	BulkBufferPercent       int            // 批量报文最多占用发送队列容量的百分比
+	ControlBufferMax        int            // 每个连接积压的控制报文上限，超过时视为客户端不再读取，以 slow_consumer 断开
+	SendQueueMaxWait        time.Duration  // 发送队列已满时入队最长等待时间，超时丢弃该报文，为0时一直等待
+	AuditMaxEntries         int            // 审计stream保留的记录数
+	AuditFailClosed         bool           // 关键管理操作的审计记录写入失败时拒绝执行
+	AuditConnections        bool           // 将连接的登录与断开写入审计记录，供对账工具使用
+	CanaryInterval          time.Duration  // 金丝雀自检间隔，为0时不启用
+	CanaryTimeout           time.Duration  // 单轮金丝雀自检的期限
+	CanaryFailureThreshold  int            // 金丝雀连续失败多少次后标记为不健康
+	HeartbeatInterval       time.Duration  // 默认心跳间隔，客户端未协商时使用
+	HeartbeatMin            time.Duration  // 客户端可协商的最短心跳间隔
+	HeartbeatMax            time.Duration  // 客户端可协商的最长心跳间隔
+	HeartbeatMissed         int            // 连续多少个心跳间隔没有收到任何报文时断开
+	LoginChallenge          bool           // 建立连接时下发登录挑战，需同时设置认证后端
+	LoginNonceTTL           time.Duration  // 登录挑战的有效期
+	LegacyPasswordLogin     bool           // 下发挑战后仍允许只凭密码登录，迁移完成后关闭
+	AuthFallback            bool           // 认证服务不可用时允许凭缓存的校验结果降级登录，还需配置 CREDENTIAL_CACHE_SECRET
+	AuthFallbackTTL         time.Duration  // 登录校验结果的缓存时间
+	AuthBreakerThreshold    int            // 认证服务连续失败多少次后熔断
+	AuthBreakerCooldown     time.Duration  // 熔断后多久放行一次试探请求
+	AccountBackend          string         // 账号后端：grpc 调用认证服务，memory 使用进程内的账号，仅用于测试
+	AuthRPCTimeout          time.Duration  // 单次调用认证服务的期限，为0时只受消息处理超时约束
+	AuthRPCRetries          int            // 登录校验在认证服务不可达时的重试次数
+	WireEnvelopeEmit        bool           // 经消息队列发布时使用 WireEnvelope 外层，所有容器都升级到能解析它的版本后再开启
+	ControlWorkers          int            // 处理踢下线、账号注销等控制命令的工作协程数
+	ControlQueueSize        int            // 控制命令队列长度，满时溢出到重试队列
+	ControlOverflowLimit    int            // 重试队列上限，超过后丢弃新的控制命令
+	ControlSignRequired     bool           // 拒绝未签名与旧格式签名的控制命令，发布控制命令的所有服务都配置 CONTROL_SECRET 并升级后开启
+	ControlMaxAge           time.Duration  // 控制命令签名的有效期，超过后视为过期或重放
+	EvictionRate            int            // 每秒最多执行的控制命令数，为0时不限制
+	IdleAfter               time.Duration  // 连接多久没有收到报文后进入空闲模式，写协程退出直到下一次发送，为0时不启用
+	WriteTimeout            time.Duration  // 单次写入的期限，超过后写入失败并断开连接，为0时不设期限
+	EphemeralTTL            time.Duration  // 正在输入、在线状态等临时事件在发送队列中的最长等待时间
+	SlowWriteThreshold      time.Duration  // 单次写入超过该耗时记为一次慢写
+	QualitySlowWrites       int            // 连续慢写多少次后判定连接劣化
+	QualityBacklogPercent   int            // 发送队列使用率不低于该百分比的持续时间超过 QualityBacklogFor 时判定连接劣化
+	QualityBacklogFor       time.Duration
+	QualityRecoverAfter     time.Duration // 症状消失多久后判定连接恢复
+	QualityCooldown         time.Duration // 同一连接两次连接质量通知的最小间隔
+	DefaultLocale           string        // 客户端未声明语言或翻译缺失时使用的语言
+	FaultInjection          bool          // 是否允许通过管理接口下发故障注入规则，仅用于测试环境
+	TopTalkersWindow        time.Duration // top-talkers 报告的统计窗口，按分钟分桶
+	SLOTarget               time.Duration // 投递延迟目标，/admin/slo 报告超出该值的比例
+	SLOWindow               time.Duration // /admin/slo 汇总的时间窗口
+	LogSampleEvery          int           // 高频日志每多少条输出1条，为1时全部输出；出错的总是输出
+	SizeSampleEvery         int           // 每多少帧采样1帧记录报文大小分布，为0时不采样
+	TCPKeepAlive            time.Duration // TCP保活探测周期，为0时使用系统默认值
+	TCPNoDelay              bool          // 是否关闭Nagle算法；应用层已批量发送时关闭 TCP_NODELAY 可以减少小包
+	SocketSendBuffer        int           // SO_SNDBUF 字节数，为0时使用系统默认值
+	SocketRecvBuffer        int           // SO_RCVBUF 字节数，为0时使用系统默认值
+	WSReadBufferSize        int           // WebSocket读缓冲区字节数，为0时使用默认值
+	WSWriteBufferSize       int           // WebSocket写缓冲区字节数，为0时使用默认值
+	ReactionTTL             time.Duration // 表情回应计数在最后一次变化后的保留时间
+	MaxReactionsPerMessage  int           // 单条消息的回应总数上限，避免热门消息的去重集合无限增长
+	MaxReactionEmojis       int           // 单条消息的不同表情数上限
+	MaxReactionQuery        int           // 单次查询表情回应的消息数上限
+	ThreadTTL               time.Duration // 话题回复计数在最后一条回复后的保留时间
+	ThreadActivityBatch     int           // 首条消息发送者离线时，每累计多少条新回复投递一次话题活动摘要
+	HistoryMaxEntries       int           // 每个会话在redis中保留的历史消息条数
+	HistoryTTL              time.Duration // 会话在最后一条消息后历史的保留时间
+	MaxHistoryPage          int           // 单次拉取会话历史的条数上限
+	ReplayCacheEntries      int           // 重放缓存为每个用户保留的最近消息条数
+	ReplayCacheAge          time.Duration // 重放缓存中消息的保留时间
+	ReplayCacheBytes        int           // 重放缓存的总字节数上限，为0时不缓存
+	MaxBlockedUsers         int           // 每个用户最多屏蔽的人数，为0时不限制
+	ReservedUserIDMax       int64         // 1 到该值之间的用户ID为系统保留，不能登录或作为发送者；负数ID总是保留
+	AbuseReportLimit        int           // 每个用户在 AbuseReportWindow 内最多举报的次数
+	AbuseReportWindow       time.Duration // 举报次数限制的滑动窗口
+	AbuseReportDedupTTL     time.Duration // 同一用户重复举报同一消息或用户时视为重复的时间
+	AbuseReportScanLimit    int           // 查找被举报消息时最多扫描的会话历史条数
+	AbuseReportMaxEntries   int           // 举报stream保留的证据包数
+	AbuseReportTopic        string        // 举报证据包发布到的topic，为空时写入redis stream
+	ClientMapCompactBelow   int           // 连接表存活条目低于历史峰值的百分之几时重建，为0时不重建
+	MaxFederationHops       int           // 投递信封最多跨区域转发的次数
+	ForwardConfirmTimeout   time.Duration // 转发到本区域其他容器的投递在该时间内未收到确认时转为离线保存，为0时不要求确认
+	ConsumerWorkers         int           // 消费者并行投递的工作协程数，同一用户的消息总由同一协程处理
+	ConsumerQueueSize       int           // 每个消费者工作协程的队列长度，队列满时暂停消费
+	RetryAfterBase          time.Duration // 服务端主动断开时建议客户端重连前等待的基准时间
+	RetryAfterJitter        time.Duration // 重连建议在基准时间上附加的随机抖动上限
+	AdmissionRate           int           // 每秒接受的新连接数，为0时不限制
+	AdmissionBurst          int           // 新连接准入的突发上限
+	AdmissionMaxWait        time.Duration // 超出速率的新连接最长排队时间，超过后拒绝
+	MemoryPressureEnabled   bool          // 内存接近上限时按类别断开连接
+	MemoryLimitBytes        int           // 内存上限，为0时依次取cgroup限制与 GOMEMLIMIT，都没有时不启用
+	MemoryPressureInterval  time.Duration // 检查内存用量的间隔，每次最多断开 MemoryPressureBatch 个连接
+	MemoryPressureBatch     int           // 每个检查间隔最多断开的连接数
+	MemoryAnonymousPct      int           // 内存用量达到上限的百分之几时断开未发送过报文的未登录连接
+	MemoryGuestPct          int           // 达到该百分比时再断开空闲的游客会话
+	MemoryAuthenticatedPct  int           // 达到该百分比时再按空闲时间从长到短断开已登录连接
+	MemoryGuestIdle         time.Duration // 游客会话空闲多久后可在内存压力下被断开
+	PublicURL               string        // 客户端直连本容器的WebSocket地址，为空时不参与 /connect-info 的选择
+	ConnectDefaultURL       string        // /connect-info 无可用容器或redis不可用时返回的默认地址
+	ConnectInfoRefresh      time.Duration // 上报本容器负载并刷新 /connect-info 快照的间隔
+	ConnectInfoMaxURLs      int           // /connect-info 最多返回的地址数，按负载从低到高排列
+	PipelineExperimentPct   int           // 按用户ID哈希分配到实验流水线的百分比，0-100
+	LargeGroupThreshold     int           // 成员数超过该值的群按 LargeGroupPolicies 扇出事件，为0时不限制
+	GroupSizeCacheTTL       time.Duration // 群成员数缓存的有效期，用于在查询成员列表之前判断是否为大群
+	ReactionRollupInterval  time.Duration // 大群中同一消息的表情回应合并后最多每隔多久发送一次
+	StorageMaxEntries       int           // 每个用户离线保存的消息条数上限，未在 StorageTierMaxEntries 中列出的等级使用该值，为0时不限制
+	StorageMaxBytes         int           // 每个用户离线保存的消息字节数上限，未在 StorageTierMaxBytes 中列出的等级使用该值，为0时不限制
+	ConnectionHistory       bool          // 在redis中记录每个用户最近的连接(时刻、容器、平台、断开原因)，供管理接口查询
+	ConnectionHistoryMax    int           // 每个用户保留的连接记录条数
+	ConnectionHistoryMaxAge time.Duration // 连接记录的保留时长，用户长期不连接时整个列表过期
+	ConnectionHistoryIP     bool          // 连接记录中保存来源IP，隐私合规不允许时关闭
+	NewDeviceNotify         bool          // 在从未登录过的设备上登录时通知该用户的其他设备
+	KnownDevicesMax         int           // 每个用户记住的设备数，超出时淘汰最近登录最早的设备，被淘汰的设备再次登录会重新通知
+	GeoIPEnabled            bool          // 解析连接来源IP的粗略位置，隐私合规不允许时关闭，关闭后不调用任何 GeoResolver
+	GeoIPDatabases          string        // 逗号分隔的 .mmdb 文件路径(如城市库与ASN库)，结果按顺序合并，为空时不加载
+	GeoIPReloadInterval     time.Duration // 检查数据库文件是否更新的间隔，文件变化后重新加载，为0时不检查
+	// 总是使用实验流水线的用户ID；PipelineDeny 中的用户总是使用现有流水线，优先于 PipelineAllow
+	PipelineAllow map[string]bool
+	PipelineDeny  map[string]bool
+	// {日志类别: 每多少条输出1条}，覆盖 LogSampleEvery，类别见 logsample 包
+	LogSampleRates map[string]int
+	// {事件类别: 扇出策略}，大群中的事件按此处理：drop 丢弃、digest 合并为周期摘要、rollup 按消息合并，未列出的照常投递
+	LargeGroupPolicies map[string]string
+	// {账号等级: 离线保存上限}，等级由 TierProvider 给出
+	StorageTierMaxEntries map[string]int
+	StorageTierMaxBytes   map[string]int
+}
+
+// Handler 当前生效的连接处理配置
+var Handler = LoadHandlerConfig()
+
+// LoadHandlerConfig 从环境变量读取配置，未设置时使用默认值
+func LoadHandlerConfig() *HandlerConfig {
+	cfg := &HandlerConfig{
+		MaxFrameBytes:           int64(GetEnvInt("MAX_FRAME_BYTES", 1<<20)),
+		ChunkSize:               GetEnvInt("CHUNK_SIZE", 256<<10),
+		ChunkThreshold:          GetEnvInt("CHUNK_THRESHOLD", 512<<10),
+		MaxTransferBytes:        GetEnvInt("MAX_TRANSFER_BYTES", 16<<20),
+		TopicPrefix:             GetEnvString("TOPIC_PREFIX", ""),
+		TopicMigration:          GetEnvBool("TOPIC_MIGRATION", false),
+		RedisKeyPrefix:          GetEnvString("REDIS_KEY_PREFIX", ""),
+		MaxWireBytes:            GetEnvInt("MAX_WIRE_BYTES", 8<<20),
+		DecodeMaxDepth:          GetEnvInt("DECODE_MAX_DEPTH", 32),
+		DecodeMaxEntries:        GetEnvInt("DECODE_MAX_ENTRIES", 10000),
+		BatchMaxEntries:         GetEnvInt("BATCH_MAX_ENTRIES", 20),
+		BatchMaxBytes:           GetEnvInt("BATCH_MAX_BYTES", 64*1024),
+		MaxUndecodableFrames:    GetEnvInt("MAX_UNDECODABLE_FRAMES", 5),
+		UndecodablePreview:      GetEnvInt("UNDECODABLE_PREVIEW", 16),
+		MaxTransferChunks:       int32(GetEnvInt("MAX_TRANSFER_CHUNKS", 1024)),
+		MaxConcurrentTransfers:  GetEnvInt("MAX_CONCURRENT_TRANSFERS", 4),
+		ChunkTimeout:            GetEnvDuration("CHUNK_TIMEOUT", 30*time.Second),
+		MaxKeyBundleBytes:       GetEnvInt("MAX_KEY_BUNDLE_BYTES", 64<<10),
+		MaxDevicesPerUser:       GetEnvInt("MAX_DEVICES_PER_USER", 10),
+		MaxEchoBytes:            GetEnvInt("MAX_ECHO_BYTES", 1024),
+		EchoRate:                float64(GetEnvInt("ECHO_RATE", 1)),
+		EchoBurst:               GetEnvInt("ECHO_BURST", 5),
+		ResumeTokenTTL:          GetEnvDuration("RESUME_TOKEN_TTL", 10*time.Minute),
+		ConnectTokenMaxTTL:      GetEnvDuration("CONNECT_TOKEN_MAX_TTL", 2*time.Minute),
+		JWKSURL:                 GetEnvString("JWKS_URL", ""),
+		JWKSRefresh:             GetEnvDuration("JWKS_REFRESH", 10*time.Minute),
+		JWTAudience:             GetEnvString("JWT_AUDIENCE", ""),
+		JWTIssuer:               GetEnvString("JWT_ISSUER", ""),
+		JWTUserClaim:            GetEnvString("JWT_USER_CLAIM", "sub"),
+		JWTClockSkew:            GetEnvDuration("JWT_CLOCK_SKEW", 30*time.Second),
+		ReauthLeadTime:          GetEnvDuration("REAUTH_LEAD_TIME", 2*time.Minute),
+		MessageTimeout:          GetEnvDuration("MESSAGE_TIMEOUT", 5*time.Second),
+		MaxInFlight:             GetEnvInt("MAX_IN_FLIGHT", 8),
+		InFlightWait:            GetEnvDuration("IN_FLIGHT_WAIT", 100*time.Millisecond),
+		TapMaxDuration:          GetEnvDuration("TAP_MAX_DURATION", 10*time.Minute),
+		RegistrationRetryWindow: GetEnvDuration("REGISTRATION_RETRY_WINDOW", 30*time.Second),
+		LoginDampWindow:         GetEnvDuration("LOGIN_DAMP_WINDOW", 10*time.Second),
+		LoginDampMax:            GetEnvInt("LOGIN_DAMP_MAX", 5),
+		BulkCredit:              GetEnvInt("BULK_CREDIT", 8),
+		TwoFactorTTL:            GetEnvDuration("TWO_FACTOR_TTL", 5*time.Minute),
+		TwoFactorMaxAttempts:    GetEnvInt("TWO_FACTOR_MAX_ATTEMPTS", 5),
+		AvailabilityPerMinute:   GetEnvInt("AVAILABILITY_PER_MINUTE", 10),
+		AvailabilityBurst:       GetEnvInt("AVAILABILITY_BURST", 5),
+		AvailabilityCacheTTL:    GetEnvDuration("AVAILABILITY_CACHE_TTL", 30*time.Second),
+		VagueEmailAvailability:  GetEnvBool("VAGUE_EMAIL_AVAILABILITY", true),
+		DeliveryDedupTTL:        GetEnvDuration("DELIVERY_DEDUP_TTL", 10*time.Minute),
+		TransitionHoldMax:       GetEnvInt("TRANSITION_HOLD_MAX", 64),
+		TransitionTTL:           GetEnvDuration("TRANSITION_TTL", 10*time.Second),
+		BulkDeliveryWorkers:     GetEnvInt("BULK_DELIVERY_WORKERS", 16),
+		LogoutFlushTimeout:      GetEnvDuration("LOGOUT_FLUSH_TIMEOUT", 2*time.Second),
+		ResidualPersistTimeout:  GetEnvDuration("RESIDUAL_PERSIST_TIMEOUT", 2*time.Second),
+		OfflineCompactInterval:  GetEnvDuration("OFFLINE_COMPACT_INTERVAL", 10*time.Minute),
+		OfflineRetention:        GetEnvDuration("OFFLINE_RETENTION", 7*24*time.Hour),
+		OfflineBackend:          GetEnvString("OFFLINE_BACKEND", "redis"),
+		ReceiptTTL:              GetEnvDuration("RECEIPT_TTL", 24*time.Hour),
+		ReceiptSweepInterval:    GetEnvDuration("RECEIPT_SWEEP_INTERVAL", 30*time.Second),
+		SendBufferSize:          GetEnvInt("SEND_BUFFER_SIZE", 256),
+		SendBufferClasses:       GetEnvIntMap("SEND_BUFFER_CLASSES"),
+		LimitWarningPercent:     GetEnvInt("LIMIT_WARNING_PERCENT", 80),
+		LimitWarningClasses:     GetEnvIntMap("LIMIT_WARNING_CLASSES"),
+		BulkBufferPercent:       GetEnvInt("BULK_BUFFER_PERCENT", 50),
+		ControlBufferMax:        GetEnvInt("CONTROL_BUFFER_MAX", 64),
+		SendQueueMaxWait:        GetEnvDuration("SEND_QUEUE_MAX_WAIT", 5*time.Second),
+		AuditMaxEntries:         GetEnvInt("AUDIT_MAX_ENTRIES", 10000),
+		AuditFailClosed:         GetEnvBool("AUDIT_FAIL_CLOSED", true),
+		AuditConnections:        GetEnvBool("AUDIT_CONNECTIONS", false),
+		CanaryInterval:          GetEnvDuration("CANARY_INTERVAL", 0),
+		CanaryTimeout:           GetEnvDuration("CANARY_TIMEOUT", 5*time.Second),
+		CanaryFailureThreshold:  GetEnvInt("CANARY_FAILURE_THRESHOLD", 3),
+		HeartbeatInterval:       GetEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second),
+		HeartbeatMin:            GetEnvDuration("HEARTBEAT_MIN", 15*time.Second),
+		HeartbeatMax:            GetEnvDuration("HEARTBEAT_MAX", 10*time.Minute),
+		HeartbeatMissed:         GetEnvInt("HEARTBEAT_MISSED", 3),
+		LoginChallenge:          GetEnvBool("LOGIN_CHALLENGE", false),
+		LoginNonceTTL:           GetEnvDuration("LOGIN_NONCE_TTL", time.Minute),
+		LegacyPasswordLogin:     GetEnvBool("LEGACY_PASSWORD_LOGIN", true),
+		AuthFallback:            GetEnvBool("AUTH_FALLBACK", false),
+		AuthFallbackTTL:         GetEnvDuration("AUTH_FALLBACK_TTL", time.Hour),
+		AuthBreakerThreshold:    GetEnvInt("AUTH_BREAKER_THRESHOLD", 5),
+		AuthBreakerCooldown:     GetEnvDuration("AUTH_BREAKER_COOLDOWN", 30*time.Second),
+		AccountBackend:          GetEnvString("ACCOUNT_BACKEND", "grpc"),
+		AuthRPCTimeout:          GetEnvDuration("AUTH_RPC_TIMEOUT", 3*time.Second),
+		AuthRPCRetries:          GetEnvInt("AUTH_RPC_RETRIES", 1),
+		WireEnvelopeEmit:        GetEnvBool("WIRE_ENVELOPE_EMIT", false),
+		ControlWorkers:          GetEnvInt("CONTROL_WORKERS", 4),
+		ControlQueueSize:        GetEnvInt("CONTROL_QUEUE_SIZE", 1024),
+		ControlOverflowLimit:    GetEnvInt("CONTROL_OVERFLOW_LIMIT", 100000),
+		ControlSignRequired:     GetEnvBool("CONTROL_SIGN_REQUIRED", false),
+		ControlMaxAge:           GetEnvDuration("CONTROL_MAX_AGE", 30*time.Second),
+		EvictionRate:            GetEnvInt("EVICTION_RATE", 200),
+		IdleAfter:               GetEnvDuration("IDLE_AFTER", 5*time.Minute),
+		WriteTimeout:            GetEnvDuration("WRITE_TIMEOUT", 10*time.Second),
+		EphemeralTTL:            GetEnvDuration("EPHEMERAL_TTL", 10*time.Second),
+		SlowWriteThreshold:      GetEnvDuration("SLOW_WRITE_THRESHOLD", 2*time.Second),
+		QualitySlowWrites:       GetEnvInt("QUALITY_SLOW_WRITES", 3),
+		QualityBacklogPercent:   GetEnvInt("QUALITY_BACKLOG_PERCENT", 80),
+		QualityBacklogFor:       GetEnvDuration("QUALITY_BACKLOG_FOR", 10*time.Second),
+		QualityRecoverAfter:     GetEnvDuration("QUALITY_RECOVER_AFTER", 30*time.Second),
+		QualityCooldown:         GetEnvDuration("QUALITY_COOLDOWN", time.Minute),
+		DefaultLocale:           GetEnvString("DEFAULT_LOCALE", "zh"),
+		FaultInjection:          GetEnvBool("FAULT_INJECTION", false),
+		TopTalkersWindow:        GetEnvDuration("TOP_TALKERS_WINDOW", 10*time.Minute),
+		SLOTarget:               GetEnvDuration("SLO_TARGET", 500*time.Millisecond),
+		SLOWindow:               GetEnvDuration("SLO_WINDOW", 5*time.Minute),
+		LogSampleEvery:          GetEnvInt("LOG_SAMPLE_EVERY", 1),
+		SizeSampleEvery:         GetEnvInt("SIZE_SAMPLE_EVERY", 1000),
+		LogSampleRates:          GetEnvIntMap("LOG_SAMPLE_RATES"),
+		TCPKeepAlive:            GetEnvDuration("TCP_KEEPALIVE", time.Minute),
+		TCPNoDelay:              GetEnvBool("TCP_NODELAY", true),
+		SocketSendBuffer:        GetEnvInt("SOCKET_SEND_BUFFER", 0),
+		SocketRecvBuffer:        GetEnvInt("SOCKET_RECV_BUFFER", 0),
+		WSReadBufferSize:        GetEnvInt("WS_READ_BUFFER_SIZE", 1024),
+		WSWriteBufferSize:       GetEnvInt("WS_WRITE_BUFFER_SIZE", 4096),
+		ReactionTTL:             GetEnvDuration("REACTION_TTL", 30*24*time.Hour),
+		MaxReactionsPerMessage:  GetEnvInt("MAX_REACTIONS_PER_MESSAGE", 10000),
+		MaxReactionEmojis:       GetEnvInt("MAX_REACTION_EMOJIS", 50),
+		MaxReactionQuery:        GetEnvInt("MAX_REACTION_QUERY", 100),
+		ThreadTTL:               GetEnvDuration("THREAD_TTL", 30*24*time.Hour),
+		ThreadActivityBatch:     GetEnvInt("THREAD_ACTIVITY_BATCH", 10),
+		HistoryMaxEntries:       GetEnvInt("HISTORY_MAX_ENTRIES", 1000),
+		HistoryTTL:              GetEnvDuration("HISTORY_TTL", 30*24*time.Hour),
+		MaxHistoryPage:          GetEnvInt("MAX_HISTORY_PAGE", 50),
+		ReplayCacheEntries:      GetEnvInt("REPLAY_CACHE_ENTRIES", 256),
+		ReplayCacheAge:          GetEnvDuration("REPLAY_CACHE_AGE", time.Minute),
+		ReplayCacheBytes:        GetEnvInt("REPLAY_CACHE_BYTES", 64<<20),
+		MaxBlockedUsers:         GetEnvInt("MAX_BLOCKED_USERS", 1000),
+		ReservedUserIDMax:       int64(GetEnvInt("RESERVED_USER_ID_MAX", 0)),
+		AbuseReportLimit:        GetEnvInt("ABUSE_REPORT_LIMIT", 20),
+		AbuseReportWindow:       GetEnvDuration("ABUSE_REPORT_WINDOW", 24*time.Hour),
+		AbuseReportDedupTTL:     GetEnvDuration("ABUSE_REPORT_DEDUP_TTL", 30*24*time.Hour),
+		AbuseReportScanLimit:    GetEnvInt("ABUSE_REPORT_SCAN_LIMIT", 1000),
+		AbuseReportMaxEntries:   GetEnvInt("ABUSE_REPORT_MAX_ENTRIES", 100000),
+		AbuseReportTopic:        GetEnvString("ABUSE_REPORT_TOPIC", ""),
+		ClientMapCompactBelow:   GetEnvInt("CLIENT_MAP_COMPACT_BELOW", 25),
+		MaxFederationHops:       GetEnvInt("MAX_FEDERATION_HOPS", 2),
+		ForwardConfirmTimeout:   GetEnvDuration("FORWARD_CONFIRM_TIMEOUT", 5*time.Second),
+		ConsumerWorkers:         GetEnvInt("CONSUMER_WORKERS", 8),
+		ConsumerQueueSize:       GetEnvInt("CONSUMER_QUEUE_SIZE", 256),
+		RetryAfterBase:          GetEnvDuration("RETRY_AFTER_BASE", time.Second),
+		RetryAfterJitter:        GetEnvDuration("RETRY_AFTER_JITTER", 10*time.Second),
+		AdmissionRate:           GetEnvInt("ADMISSION_RATE", 200),
+		AdmissionBurst:          GetEnvInt("ADMISSION_BURST", 100),
+		AdmissionMaxWait:        GetEnvDuration("ADMISSION_MAX_WAIT", 2*time.Second),
+		MemoryPressureEnabled:   GetEnvBool("MEMORY_PRESSURE_ENABLED", true),
+		MemoryLimitBytes:        GetEnvInt("MEMORY_LIMIT_BYTES", 0),
+		MemoryPressureInterval:  GetEnvDuration("MEMORY_PRESSURE_INTERVAL", 2*time.Second),
+		MemoryPressureBatch:     GetEnvInt("MEMORY_PRESSURE_BATCH", 200),
+		MemoryAnonymousPct:      GetEnvInt("MEMORY_ANONYMOUS_PCT", 80),
+		MemoryGuestPct:          GetEnvInt("MEMORY_GUEST_PCT", 85),
+		MemoryAuthenticatedPct:  GetEnvInt("MEMORY_AUTHENTICATED_PCT", 92),
+		MemoryGuestIdle:         GetEnvDuration("MEMORY_GUEST_IDLE", 30*time.Second),
+		PublicURL:               GetEnvString("PUBLIC_URL", ""),
+		ConnectDefaultURL:       GetEnvString("CONNECT_DEFAULT_URL", ""),
+		ConnectInfoRefresh:      GetEnvDuration("CONNECT_INFO_REFRESH", 5*time.Second),
+		ConnectInfoMaxURLs:      GetEnvInt("CONNECT_INFO_MAX_URLS", 3),
+		PipelineExperimentPct:   GetEnvInt("PIPELINE_EXPERIMENT_PERCENT", 0),
+		PipelineAllow:           GetEnvSet("PIPELINE_ALLOW"),
+		PipelineDeny:            GetEnvSet("PIPELINE_DENY"),
+		LargeGroupThreshold:     GetEnvInt("LARGE_GROUP_THRESHOLD", 1000),
+		GroupSizeCacheTTL:       GetEnvDuration("GROUP_SIZE_CACHE_TTL", time.Minute),
+		ReactionRollupInterval:  GetEnvDuration("REACTION_ROLLUP_INTERVAL", 3*time.Second),
+		LargeGroupPolicies:      GetEnvStringMap("LARGE_GROUP_POLICIES", "typing=drop,presence=digest,reactions=rollup"),
+		StorageMaxEntries:       GetEnvInt("STORAGE_MAX_ENTRIES", 10000),
+		StorageMaxBytes:         GetEnvInt("STORAGE_MAX_BYTES", 64<<20),
+		ConnectionHistory:       GetEnvBool("CONNECTION_HISTORY", true),
+		ConnectionHistoryMax:    GetEnvInt("CONNECTION_HISTORY_MAX", 100),
+		ConnectionHistoryMaxAge: GetEnvDuration("CONNECTION_HISTORY_MAX_AGE", 30*24*time.Hour),
+		ConnectionHistoryIP:     GetEnvBool("CONNECTION_HISTORY_IP", true),
+		NewDeviceNotify:         GetEnvBool("NEW_DEVICE_NOTIFY", true),
+		KnownDevicesMax:         GetEnvInt("KNOWN_DEVICES_MAX", 20),
+		GeoIPEnabled:            GetEnvBool("GEOIP_ENABLED", true),
+		GeoIPDatabases:          GetEnvString("GEOIP_DATABASES", ""),
+		GeoIPReloadInterval:     GetEnvDuration("GEOIP_RELOAD_INTERVAL", time.Minute),
+		StorageTierMaxEntries:   GetEnvIntMap("STORAGE_TIER_MAX_ENTRIES"),
+		StorageTierMaxBytes:     GetEnvIntMap("STORAGE_TIER_MAX_BYTES"),
+	}
+	return cfg
+}
+
+// GetEnvIntMap 读取形如 iot=32,desktop=1024 的环境变量，非法项被忽略
+func GetEnvIntMap(key string) map[string]int {
+	result := make(map[string]int)
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			recordInvalid(key, item)
+			continue
+		}
+		result[name] = n
+	}
+	return result
+}
+
+// GetEnvStringMap 读取形如 typing=drop,reactions=rollup 的环境变量，不存在时解析 def，非法项被忽略
+func GetEnvStringMap(key string, def string) map[string]string {
+	raw := GetEnvString(key, def)
+	result := make(map[string]string)
+	for _, item := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || name == "" || value == "" {
+			if strings.TrimSpace(item) != "" {
+				recordInvalid(key, item)
+			}
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// GetEnvSet 读取逗号分隔的列表环境变量，空白项被忽略
+func GetEnvSet(key string) map[string]bool {
+	result := make(map[string]bool)
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result[item] = true
+		}
+	}
+	return result
+}
+
+// GetEnvString 读取字符串环境变量，不存在时返回默认值
+func GetEnvString(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// GetEnvInt 读取整数环境变量，不存在或非法时返回默认值
+func GetEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		recordInvalid(key, v)
+		return def
+	}
+	return n
+}
+
+// GetEnvBool 读取布尔环境变量(true/false/1/0)，不存在或非法时返回默认值
+func GetEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		recordInvalid(key, v)
+		return def
+	}
+	return b
+}
+
+// GetEnvDuration 读取时长环境变量(如 30s)，不存在或非法时返回默认值
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		recordInvalid(key, v)
+		return def
+	}
+	return d
+}
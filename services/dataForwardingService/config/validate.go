@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+var (
+	invalidMu  sync.Mutex
+	invalidEnv []string // 无法解析、已回退到默认值的环境变量
+)
+
+// recordInvalid 记录无法解析的环境变量。读取时直接回退到默认值不会报错，由 Validate 统一报告
+func recordInvalid(key string, value string) {
+	invalidMu.Lock()
+	defer invalidMu.Unlock()
+	invalidEnv = append(invalidEnv, fmt.Sprintf("%s=%q", key, value))
+}
+
+// Validate 检查配置：无法解析的环境变量，以及互相矛盾或超出范围的取值
+func (c *HandlerConfig) Validate() []error {
+	var errs []error
+	invalidMu.Lock()
+	for _, item := range invalidEnv {
+		errs = append(errs, fmt.Errorf("环境变量无法解析，已使用默认值: %s", item))
+	}
+	invalidMu.Unlock()
+
+	if c.MaxFrameBytes <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_FRAME_BYTES 必须大于0"))
+	}
+	if c.ChunkSize <= 0 || c.ChunkSize > c.ChunkThreshold {
+		errs = append(errs, fmt.Errorf("CHUNK_SIZE(%d) 必须大于0且不超过 CHUNK_THRESHOLD(%d)", c.ChunkSize, c.ChunkThreshold))
+	}
+	if int64(c.BatchMaxBytes) > c.MaxFrameBytes {
+		errs = append(errs, fmt.Errorf("BATCH_MAX_BYTES(%d) 超过 MAX_FRAME_BYTES(%d)，批量请求无法送达", c.BatchMaxBytes, c.MaxFrameBytes))
+	}
+	if c.SendBufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("SEND_BUFFER_SIZE 必须大于0"))
+	}
+	if c.MaxInFlight <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_IN_FLIGHT 必须大于0"))
+	}
+	switch c.AccountBackend {
+	case "grpc", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("ACCOUNT_BACKEND 只能是 grpc 或 memory: %q", c.AccountBackend))
+	}
+	switch c.OfflineBackend {
+	case "redis", "none":
+	default:
+		errs = append(errs, fmt.Errorf("OFFLINE_BACKEND 只能是 redis 或 none: %q", c.OfflineBackend))
+	}
+	for name, value := range map[string]string{
+		"PUBLIC_URL":          c.PublicURL,
+		"CONNECT_DEFAULT_URL": c.ConnectDefaultURL,
+		"JWKS_URL":            c.JWKSURL,
+	} {
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s 不是合法的地址: %q", name, value))
+		}
+	}
+	return errs
+}
@@ -5,61 +5,91 @@ import (
 	"context"
 	"data_forwarding_service/config"
 	"data_forwarding_service/internal/consumer"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/lifecycle"
 	"data_forwarding_service/internal/publisher"
+	"data_forwarding_service/internal/topics"
 	"data_forwarding_service/internal/utils"
 	"errors"
+	"fmt"
 	"github.com/IBM/sarama"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 )
 
-// ConsumerRoutine 定义数据中转服务的消费者行为
-func ConsumerRoutine() {
-	sugar := logger.Sugar()
+// ConsumerComponent 数据中转服务的Kafka消费者组件：消费本容器的topic，启用多区域时同时消费本区域的联邦topic
+func ConsumerComponent() lifecycle.Component {
+	var groups []sarama.ConsumerGroup
+	return lifecycle.Component{
+		Name:      "consumer",
+		DependsOn: []string{"identity", "kafka_producer"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			sugar := logger.Sugar()
+			containerTopics := topics.ContainerSubscriptions(identity.ContainerID())
+			broker := config.KafkaBrokers()
 
-	topic := os.Getenv("HOSTNAME")
-	if topic == "" {
-		topic = "message-topic"
-	}
-	broker := os.Getenv("KAFKA_BROKER")
-	if broker == "" {
-		broker = config.DefaultNsServer
-	}
+			sugar.Infof("启动 Kafka 消费者, broker: %s, topic: %v", broker, containerTopics)
 
-	sugar.Infof("启动 Kafka 消费者, broker: %s, topic: %s", broker, topic)
+			saramaConfig := sarama.NewConfig()
+			saramaConfig.Version = sarama.V2_1_0_0
+			saramaConfig.Consumer.Return.Errors = true
+			saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
 
-	saramaConfig := sarama.NewConfig()
-	saramaConfig.Version = sarama.V2_1_0_0
-	saramaConfig.Consumer.Return.Errors = true
-	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+			groupID := topics.BuildConsumerGroup("message-consumer-group")
 
-	groupID := "message-consumer-group"
+			// 解析多个 Kafka broker 地址
+			brokerList := utils.SplitBrokers(broker)
+
+			// 等待 Kafka 启动并支持多个 broker
+			for _, brokerAddr := range brokerList {
+				if err := publisher.WaitForKafkaReady(brokerAddr, 30*time.Second); err != nil {
+					return fmt.Errorf("Kafka 启动超时: %w", err)
+				}
+			}
 
-	// 解析多个 Kafka broker 地址
-	brokerList := utils.SplitBrokers(broker)
+			group, err := startConsumerGroup(ctx, brokerList, saramaConfig, groupID, containerTopics, &consumer.KafkaConsumerGroupHandler{})
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
 
-	// 等待 Kafka 启动并支持多个 broker
-	for _, brokerAddr := range brokerList {
-		brokerErr := publisher.WaitForKafkaReady(brokerAddr, 30*time.Second)
-		if brokerErr != nil {
-			sugar.Fatalf("Kafka 启动超时: %v", brokerErr)
-		}
+			// 启用多区域时，本区域的所有容器共同消费联邦topic
+			if region := identity.Region(); region != "" {
+				federationTopics := topics.FederationSubscriptions(region)
+				sugar.Infof("启动联邦消费者, topic: %v", federationTopics)
+				group, err := startConsumerGroup(ctx, brokerList, saramaConfig, topics.BuildConsumerGroup("federation-consumer-group-"+region), federationTopics, &consumer.FederationConsumerGroupHandler{})
+				if err != nil {
+					return err
+				}
+				groups = append(groups, group)
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			var errs []error
+			for _, group := range groups {
+				errs = append(errs, group.Close())
+			}
+			return errors.Join(errs...)
+		},
 	}
+}
 
+// startConsumerGroup 创建消费组并在后台持续消费指定topic，直到消费组被关闭
+func startConsumerGroup(ctx context.Context, brokerList []string, saramaConfig *sarama.Config, groupID string, subscriptions []string, handler sarama.ConsumerGroupHandler) (sarama.ConsumerGroup, error) {
+	sugar := logger.Sugar()
+	for _, topic := range subscriptions {
+		if err := topics.Validate(topic); err != nil {
+			return nil, err
+		}
+	}
 	consumerGroup, err := sarama.NewConsumerGroup(brokerList, groupID, saramaConfig)
 	if err != nil {
-		sugar.Fatalf("创建 Kafka 消费组失败: %v", err)
+		return nil, fmt.Errorf("创建 Kafka 消费组失败: %w", err)
 	}
-	defer consumerGroup.Close()
-
-	ctx := context.Background()
-	handler := &consumer.KafkaConsumerGroupHandler{}
 
 	go func() {
 		for {
-			err := consumerGroup.Consume(ctx, []string{topic}, handler)
+			err := consumerGroup.Consume(ctx, subscriptions, handler)
 			if err != nil {
 				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
 					sugar.Warnf("Kafka 消费者组已关闭，退出消费循环")
@@ -69,12 +99,10 @@ func ConsumerRoutine() {
 				sugar.Errorf("Kafka 消费错误: %v", err)
 				time.Sleep(time.Second)
 			}
+			if ctx.Err() != nil {
+				return
+			}
 		}
 	}()
-
-	// 等待退出信号
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
-	sugar.Info("Kafka 消费者退出")
+	return consumerGroup, nil
 }
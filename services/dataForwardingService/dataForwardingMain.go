@@ -2,44 +2,112 @@ package main
 
 import (
 	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
 	"data_forwarding_service/internal/grpcClient"
 	"data_forwarding_service/internal/handlers"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/preflight"
 	"data_forwarding_service/internal/publisher"
 	"data_forwarding_service/internal/redis"
+	"encoding/json"
+	"flag"
+	"os"
 )
 
 func main() {
+	check := flag.Bool("check", false, "只运行启动自检，向标准输出打印JSON报告后退出，有失败项时返回1")
+	flag.Parse()
+	if *check {
+		os.Exit(runPreflight())
+	}
+
 	sugar := logger.Sugar()
 	defer logger.Sync()
 
 	sugar.Infoln("Betterfly2服务器启动中")
-
-	// 初始化 Kafka 生产者
-	err := publisher.InitKafkaProducer()
-	if err != nil {
-		sugar.Fatalln(err)
+	server := handlers.Default()
+	if config.Handler.AccountBackend == "memory" {
+		sugar.Warnln("使用进程内的账号后端，账号在重启后丢失，不应在生产环境使用")
+		server.SetAccountService(handlers.NewMemoryAccountService())
+	} else {
+		lifecycle.Register(lifecycle.Component{
+			Name: "auth_client",
+			Start: func(ctx context.Context, fail func(error)) error {
+				_, err := grpcClient.GetAuthClient()
+				return err
+			},
+			Stop: func(ctx context.Context) error {
+				grpcClient.CloseConn()
+				return nil
+			},
+		})
 	}
-	defer publisher.KafkaProducer.Close()
-
-	// 初始化 Redis 客户端
-	err = redisClient.InitRedis()
-	if err != nil {
-		sugar.Fatalln(err)
+	if config.Handler.OfflineBackend == "none" {
+		sugar.Warnln("未启用离线存储，不在线的消息将被丢弃")
+	} else {
+		server.SetOfflineStore(handlers.NewRedisOfflineStore())
 	}
-	defer redisClient.Rdb.Close()
-
-	go ConsumerRoutine()
+	lifecycle.Register(
+		lifecycle.Component{
+			Name: "kafka_producer",
+			Start: func(ctx context.Context, fail func(error)) error {
+				return publisher.InitKafkaProducer()
+			},
+			Stop: func(ctx context.Context) error {
+				return publisher.KafkaProducer.Close()
+			},
+		},
+		lifecycle.Component{
+			Name: "redis",
+			Start: func(ctx context.Context, fail func(error)) error {
+				return redisClient.InitRedis()
+			},
+			Stop: func(ctx context.Context) error {
+				return redisClient.Rdb.Close()
+			},
+		},
+		lifecycle.Component{
+			// 解析并登记容器ID，同名容器存活时拒绝启动
+			Name:      "identity",
+			DependsOn: []string{"redis"},
+			Start: func(ctx context.Context, fail func(error)) error {
+				return identity.Init()
+			},
+			Stop: func(ctx context.Context) error {
+				identity.Release()
+				return nil
+			},
+		},
+		ConsumerComponent(),
+		server.GeoIP(),
+		server.InternalServer(),
+		server.WebSocketServer(),
+		server.Canary(),
+		server.ConnectDirector(),
+		server.OfflineCompaction(),
+		server.ReceiptExpiry(),
+		server.MemoryPressure(),
+	)
 
-	// 初始化 gRPC 客户端
-	_, err = grpcClient.GetAuthClient()
-	if err != nil {
+	if err := lifecycle.Run(); err != nil {
 		sugar.Fatalln(err)
 	}
-	defer grpcClient.CloseConn()
+	sugar.Infoln("Betterfly2服务器已退出")
+}
 
-	sugar.Infoln("Betterfly2服务器启动完成")
-	err = handlers.StartWebSocketServer()
-	if err != nil {
-		sugar.Fatalln("启动 WebSocket 服务器失败: ", err)
+// runPreflight 部署流水线在启动前运行的自检，返回进程退出码
+func runPreflight() int {
+	report := preflight.Run(context.Background(), preflight.Startup)
+	if redisClient.Rdb != nil {
+		_ = redisClient.Rdb.Close()
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+	if !report.OK {
+		return 1
 	}
+	return 0
 }
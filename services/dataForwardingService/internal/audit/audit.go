@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/redis/keys"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// 事件类型，不同来源的审计记录写入同一个 Sink，按类型区分
+const (
+	TypeAdminAction  = "admin_action"  // 管理接口操作
+	TypeConnection   = "connection"    // 连接登录与断开，开启 AuditConnections 时记录，供对账工具使用
+	TypeAuthFallback = "auth_fallback" // 认证服务不可用时进入、退出降级登录模式，以及每次降级登录
+)
+
+// Event 一条审计记录
+type Event struct {
+	ID      string            `json:"id,omitempty"` // 写入后由 Sink 分配
+	Type    string            `json:"type"`
+	At      time.Time         `json:"at"`
+	Caller  string            `json:"caller"`
+	Action  string            `json:"action"`
+	Params  map[string]string `json:"params,omitempty"`
+	Users   []string          `json:"users,omitempty"` // 受影响的用户
+	Outcome string            `json:"outcome"`
+	Details map[string]any    `json:"details,omitempty"`
+}
+
+// Sink 审计记录的存储
+type Sink interface {
+	Write(ctx context.Context, event *Event) error
+	// Recent 从新到旧分页读取，before 为上一页最后一条的ID，返回下一页的起点(没有更多时为空)
+	Recent(ctx context.Context, before string, limit int) ([]*Event, string, error)
+}
+
+// sink 当前使用的存储，默认写入redis stream
+var sink Sink = redisStreamSink{stream: keys.AuditLogKey()}
+
+// SetSink 替换审计存储，需在启动服务之前调用
+func SetSink(s Sink) {
+	sink = s
+}
+
+// Record 写入一条审计记录
+func Record(ctx context.Context, event *Event) error {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	return sink.Write(ctx, event)
+}
+
+// Recent 分页读取最近的审计记录
+func Recent(ctx context.Context, before string, limit int) ([]*Event, string, error) {
+	return sink.Recent(ctx, before, limit)
+}
+
+// redisStreamSink 写入有界的redis stream，只保留最近 AuditMaxEntries 条
+type redisStreamSink struct {
+	stream string
+}
+
+func (s redisStreamSink) Write(ctx context.Context, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("审计记录序列化失败: %w", err)
+	}
+	id, err := redisClient.AppendAuditEvent(ctx, s.stream, data, int64(config.Handler.AuditMaxEntries))
+	if err != nil {
+		return fmt.Errorf("写入审计记录失败: %w", err)
+	}
+	event.ID = id
+	return nil
+}
+
+func (s redisStreamSink) Recent(ctx context.Context, before string, limit int) ([]*Event, string, error) {
+	messages, err := redisClient.ReadAuditEvents(ctx, s.stream, before, int64(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	events := make([]*Event, 0, len(messages))
+	for _, message := range messages {
+		raw, _ := message.Values["event"].(string)
+		event := &Event{}
+		if err := json.Unmarshal([]byte(raw), event); err != nil {
+			continue
+		}
+		event.ID = message.ID
+		events = append(events, event)
+	}
+	next := ""
+	if len(messages) == limit {
+		next = messages[len(messages)-1].ID
+	}
+	return events, next, nil
+}
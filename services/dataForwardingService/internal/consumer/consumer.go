@@ -1,12 +1,70 @@
 package consumer
 
 import (
+	pb "Betterfly2/proto/data_forwarding"
 	"Betterfly2/shared/logger"
 	"data_forwarding_service/internal/handlers"
+	"data_forwarding_service/internal/logsample"
 	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/proto"
 	"regexp"
+	"strconv"
+	"sync/atomic"
 )
 
+var (
+	kickPattern           = regexp.MustCompile(`^KICK ([a-z_]+) ([0-9a-zA-Z.:#_-]+)$`)
+	accountDeletedPattern = regexp.MustCompile(`^ACCOUNT DELETED ([0-9]+)$`)
+	logoutAllPattern      = regexp.MustCompile(`^LOGOUT ALL ([0-9]+)$`)
+)
+
+// submitDelivery 按接收者将投递信封交给工作协程池，批量信封拆分为每个接收者一份，
+// 保证同一用户的消息按到达顺序投递。信封中所有接收者都处理完后向转发方发回一次确认
+func submitDelivery(requestMsg *pb.RequestMessage) {
+	delivery := requestMsg.GetDelivery()
+	var remaining atomic.Int32
+	handle := func(message *pb.RequestMessage) func() {
+		return func() {
+			if err := handlers.InplaceHandleDelivery(message); err != nil {
+				logger.Sugar().Errorf("处理消息失败: %v", err)
+			}
+			if remaining.Add(-1) == 0 {
+				handlers.AckForward(delivery)
+			}
+		}
+	}
+	if delivery.GetAllLocal() {
+		// 全员广播与单个用户无关，固定交给同一个协程
+		remaining.Store(1)
+		pool.Submit("", handle(requestMsg))
+		return
+	}
+	if len(delivery.GetRecipients()) == 0 {
+		remaining.Store(1)
+		dispatch(delivery.GetUserId(), handle(requestMsg))
+		return
+	}
+	remaining.Store(int32(len(delivery.GetRecipients())))
+	for _, recipient := range delivery.GetRecipients() {
+		single := proto.Clone(delivery).(*pb.Delivery)
+		single.Recipients = nil
+		single.UserId = recipient.GetUserId()
+		single.Seq = recipient.GetSeq()
+		dispatch(recipient.GetUserId(), handle(&pb.RequestMessage{
+			Payload: &pb.RequestMessage_Delivery{Delivery: single},
+		}))
+	}
+}
+
+// dispatch 按接收者所用的投递流水线选择工作协程池
+func dispatch(userID string, task func()) {
+	if submit := handlers.PipelineDispatch(userID); submit != nil {
+		submit(userID, task)
+		return
+	}
+	pool.Submit(userID, task)
+}
+
 type KafkaConsumerGroupHandler struct{}
 
 func (h *KafkaConsumerGroupHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
@@ -17,9 +75,17 @@ func (h *KafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSes
 	sugar := logger.Sugar()
 
 	for msg := range claim.Messages() {
-		sugar.Infof("Kafka 收到消息: %s", string(msg.Value))
+		if logsample.Allow(logsample.Consume, nil) {
+			sugar.Infof("Kafka 收到消息: %s", msg.Value)
+		}
+		// 控制命令须带有效签名，拒绝的报文直接确认，不再重试
+		value, ok := handlers.VerifyControl(msg.Value)
+		if !ok {
+			session.MarkMessage(msg, "")
+			continue
+		}
 		// TODO: 或许有风险，需要改造
-		match, regErr := regexp.Match("DELETE USER [0-9a-zA-Z.:]+", msg.Value)
+		match, regErr := regexp.Match("^DELETE USER [0-9a-zA-Z.:#_-]+", value)
 		if regErr != nil {
 			sugar.Errorf("正则匹配失败：%v", regErr)
 			continue
@@ -27,33 +93,78 @@ func (h *KafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSes
 
 		// 收到关闭连接要求
 		if match {
-			re := regexp.MustCompile("DELETE USER ([0-9a-zA-Z.:]+)")
-			matches := re.FindAllStringSubmatch(string(msg.Value), -1)
+			re := regexp.MustCompile("DELETE USER ([0-9a-zA-Z.:#_-]+)")
+			matches := re.FindAllStringSubmatch(string(value), -1)
 			for _, match := range matches[0] {
 				sugar.Infof("info of match: %v", match)
 			}
-			if matches[0][1] != "" {
-				handlers.StopClient(matches[0][1])
+			if key := matches[0][1]; key != "" {
+				control.Submit(controlCommand{kind: "delete_user", target: key, run: func() {
+					handlers.StopClient(key, handlers.CloseEvictedConflict)
+				}})
 			}
 			continue
 		}
 
-		requestMsg, err := handlers.HandleRequestData(msg.Value)
-		if err != nil {
-			sugar.Errorf("处理消息失败: %v", err)
+		// 定向踢下线: KICK <原因> <用户ID#设备ID>
+		if matches := kickPattern.FindStringSubmatch(string(value)); matches != nil {
+			reason, key := handlers.CloseReason(matches[1]), matches[2]
+			kind := "kick_" + string(reason)
+			if !reason.Valid() {
+				// 未知原因不作为指标标签，避免上游任意取值导致标签基数失控
+				sugar.Warnf("踢下线命令的原因 %q 未定义，按管理员踢下线处理", matches[1])
+				reason, kind = handlers.CloseKickedAdmin, "kick_unknown"
+			}
+			control.Submit(controlCommand{kind: kind, target: key, run: func() {
+				handlers.TerminateSession(key, reason)
+			}})
+			session.MarkMessage(msg, "")
 			continue
 		}
 
-		if requestMsg.GetPost() == nil {
-			sugar.Errorln("消费者收到非Post报文")
+		// 账号注销: ACCOUNT DELETED <用户ID>
+		if matches := accountDeletedPattern.FindStringSubmatch(string(value)); matches != nil {
+			userID := matches[1]
+			control.Submit(controlCommand{kind: "account_deleted", target: userID, run: func() {
+				handlers.HandleAccountDeleted(userID)
+			}})
+			session.MarkMessage(msg, "")
 			continue
 		}
 
-		err = handlers.InplaceHandlePostMessage(requestMsg)
+		// 退出所有设备: LOGOUT ALL <用户ID>
+		if matches := logoutAllPattern.FindStringSubmatch(string(value)); matches != nil {
+			userID := matches[1]
+			control.Submit(controlCommand{kind: "logout_all", target: userID, run: func() {
+				handlers.HandleLogoutAll(userID)
+			}})
+			session.MarkMessage(msg, "")
+			continue
+		}
+
+		wire, err := handlers.DecodeWire(value)
 		if err != nil {
 			sugar.Errorf("处理消息失败: %v", err)
 			continue
 		}
+		requestMsg := wire.GetPayload()
+
+		switch {
+		case requestMsg.GetDelivery() != nil:
+			submitDelivery(requestMsg)
+		case requestMsg.GetForwardAck() != nil:
+			handlers.ConfirmForward(requestMsg.GetForwardAck())
+		case requestMsg.GetLoopbackProbe() != nil:
+			userID := strconv.FormatInt(requestMsg.GetLoopbackProbe().GetUserId(), 10)
+			pool.Submit(userID, func() {
+				if err := handlers.InplaceHandleLoopbackProbe(requestMsg); err != nil {
+					sugar.Errorf("处理消息失败: %v", err)
+				}
+			})
+		default:
+			sugar.Errorln("消费者收到无法处理的报文")
+			continue
+		}
 
 		session.MarkMessage(msg, "")
 	}
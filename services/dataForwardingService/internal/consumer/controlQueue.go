@@ -0,0 +1,134 @@
+package consumer
+
+import (
+	"Betterfly2/shared/logger"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"sync"
+	"time"
+)
+
+// controlCommand 踢下线、账号注销等控制命令，kind 与 target 相同的命令在执行前只保留一条
+type controlCommand struct {
+	kind   string
+	target string
+	run    func()
+}
+
+func (c controlCommand) key() string {
+	return c.kind + " " + c.target
+}
+
+// controlQueue 控制命令的独立工作协程池，与数据投递互不影响。
+// 入队从不阻塞消费者：队列满时溢出到重试队列，每秒回填；所有工作协程共享 EvictionRate 的总速率，
+// 上游异常时突发的大量踢下线命令只会积压，不会长时间占用连接关闭路径而拖慢投递
+type controlQueue struct {
+	mu       sync.Mutex
+	pending  map[string]bool // 已入队(含溢出)尚未开始执行的命令
+	overflow []controlCommand
+	queue    chan controlCommand
+	tokens   <-chan time.Time
+}
+
+// control 消费者处理控制命令使用的队列
+var control = newControlQueue(config.Handler.ControlWorkers, config.Handler.ControlQueueSize, config.Handler.EvictionRate)
+
+func newControlQueue(workers int, queueSize int, rate int) *controlQueue {
+	q := &controlQueue{
+		pending: make(map[string]bool),
+		queue:   make(chan controlCommand, max(queueSize, 1)),
+	}
+	if rate > 0 {
+		q.tokens = time.NewTicker(time.Second / time.Duration(rate)).C
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		go q.work()
+	}
+	go q.refill()
+	return q
+}
+
+// Submit 提交控制命令，已有相同命令待执行时合并
+func (q *controlQueue) Submit(cmd controlCommand) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[cmd.key()] {
+		metrics.Inc("control_coalesced_total", "kind", cmd.kind)
+		return
+	}
+	if len(q.overflow) == 0 {
+		select {
+		case q.queue <- cmd:
+			q.pending[cmd.key()] = true
+			q.updateBacklog()
+			return
+		default:
+		}
+	}
+	if len(q.overflow) >= config.Handler.ControlOverflowLimit {
+		metrics.Inc("control_dropped_total", "kind", cmd.kind)
+		logger.Sugar().Errorf("控制命令积压超过 %d 条，丢弃: %s", config.Handler.ControlOverflowLimit, cmd.key())
+		return
+	}
+	metrics.Inc("control_overflow_total", "kind", cmd.kind)
+	q.overflow = append(q.overflow, cmd)
+	q.pending[cmd.key()] = true
+	q.updateBacklog()
+}
+
+// refill 每秒将溢出的命令按顺序移回队列
+func (q *controlQueue) refill() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.mu.Lock()
+		moved := 0
+	fill:
+		for _, cmd := range q.overflow {
+			select {
+			case q.queue <- cmd:
+				moved++
+			default:
+				break fill
+			}
+		}
+		q.overflow = q.overflow[moved:]
+		if len(q.overflow) == 0 {
+			q.overflow = nil
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *controlQueue) work() {
+	for cmd := range q.queue {
+		if q.tokens != nil {
+			<-q.tokens
+		}
+		q.mu.Lock()
+		delete(q.pending, cmd.key())
+		q.updateBacklog()
+		q.mu.Unlock()
+		q.run(cmd)
+	}
+}
+
+// run 执行单个命令，panic只影响该命令
+func (q *controlQueue) run(cmd controlCommand) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.Inc("control_panic_total", "kind", cmd.kind)
+			logger.Sugar().Errorf("执行控制命令 %s 时panic: %v", cmd.key(), r)
+		}
+	}()
+	start := time.Now()
+	cmd.run()
+	metrics.Inc("control_processed_total", "kind", cmd.kind)
+	metrics.Observe("control_latency_ms", float64(time.Since(start).Milliseconds()), "kind", cmd.kind)
+}
+
+// updateBacklog 更新积压指标，需持有 q.mu
+func (q *controlQueue) updateBacklog() {
+	metrics.SetGauge("control_backlog", float64(len(q.pending)))
+	metrics.SetGauge("control_overflow", float64(len(q.overflow)))
+}
@@ -0,0 +1,99 @@
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// counterValue 读取计数器某个序列的当前值，series 形如 name{kind="x"}。计数器在进程内累计，断言时比较前后差值
+func counterValue(t *testing.T, series string) float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// blockWorker 提交一条阻塞唯一工作协程的命令，返回时该命令已开始执行，关闭返回的通道后放行
+func blockWorker(t *testing.T, q *controlQueue) chan struct{} {
+	t.Helper()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	q.Submit(controlCommand{kind: "test_block", target: t.Name(), run: func() {
+		close(started)
+		<-release
+	}})
+	waitDone(t, "阻塞命令开始执行", started)
+	return release
+}
+
+// 待执行的命令中已有相同命令时合并，只执行一次
+func TestControlQueueCoalescesDuplicates(t *testing.T) {
+	q := newControlQueue(1, 4, 0)
+	release := blockWorker(t, q)
+	coalesced := counterValue(t, `control_coalesced_total{kind="test_coalesce"}`)
+
+	var runs atomic.Int32
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		q.Submit(controlCommand{kind: "test_coalesce", target: "7#phone", run: func() { runs.Add(1) }})
+	}
+	q.Submit(controlCommand{kind: "test_coalesce", target: "end", run: func() { close(done) }})
+	close(release)
+	waitDone(t, "命令执行完", done)
+
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("重复的命令执行了 %d 次，期望合并为1次", n)
+	}
+	if n := counterValue(t, `control_coalesced_total{kind="test_coalesce"}`) - coalesced; n != 2 {
+		t.Fatalf("合并计数为 %g，期望 2", n)
+	}
+}
+
+// 队列满时溢出到重试队列并由回填执行，溢出也满时丢弃并计入 control_dropped_total
+func TestControlQueueOverflowAndDrop(t *testing.T) {
+	saved := *config.Handler
+	config.Handler.ControlOverflowLimit = 1
+	t.Cleanup(func() { *config.Handler = saved })
+	q := newControlQueue(1, 1, 0)
+	release := blockWorker(t, q)
+	overflowed := counterValue(t, `control_overflow_total{kind="test_overflow"}`)
+	dropped := counterValue(t, `control_dropped_total{kind="test_overflow"}`)
+
+	ran := make(map[string]chan struct{})
+	for _, target := range []string{"queued", "overflow", "dropped"} {
+		done := make(chan struct{})
+		ran[target] = done
+		q.Submit(controlCommand{kind: "test_overflow", target: target, run: func() { close(done) }})
+	}
+	if n := counterValue(t, `control_overflow_total{kind="test_overflow"}`) - overflowed; n != 1 {
+		t.Fatalf("溢出计数为 %g，期望 1", n)
+	}
+	if n := counterValue(t, `control_dropped_total{kind="test_overflow"}`) - dropped; n != 1 {
+		t.Fatalf("丢弃计数为 %g，期望 1", n)
+	}
+
+	close(release)
+	waitDone(t, "队列中的命令", ran["queued"])
+	waitDone(t, "回填的溢出命令", ran["overflow"])
+	select {
+	case <-ran["dropped"]:
+		t.Fatal("丢弃的命令仍被执行")
+	default:
+	}
+}
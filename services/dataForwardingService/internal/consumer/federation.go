@@ -0,0 +1,37 @@
+package consumer
+
+import (
+	"Betterfly2/shared/logger"
+	"data_forwarding_service/internal/handlers"
+	"github.com/IBM/sarama"
+)
+
+// FederationConsumerGroupHandler 消费本区域的联邦topic，同一区域的所有容器组成一个消费组，每条信封只由一个容器处理
+type FederationConsumerGroupHandler struct{}
+
+func (h *FederationConsumerGroupHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
+func (h *FederationConsumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
+
+// ConsumeClaim 实现samara的消费处理器协议
+func (h *FederationConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	sugar := logger.Sugar()
+
+	for msg := range claim.Messages() {
+		wire, err := handlers.DecodeWire(msg.Value)
+		if err != nil {
+			sugar.Errorf("联邦消息解析失败: %v", err)
+			session.MarkMessage(msg, "")
+			continue
+		}
+		if wire.GetPayload().GetDelivery() == nil {
+			sugar.Errorln("联邦消费者收到非投递信封的报文")
+			session.MarkMessage(msg, "")
+			continue
+		}
+		if err := handlers.InplaceHandleFederatedDelivery(wire); err != nil {
+			sugar.Errorf("处理联邦投递失败: %v", err)
+		}
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package consumer
+
+import (
+	"Betterfly2/shared/logger"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"hash/fnv"
+	"strconv"
+)
+
+// keyedPool 按key将任务哈希到固定的工作协程上：同一key的任务在同一协程中串行执行，保持顺序；
+// 不同key的任务并行执行。任务panic时在原协程内恢复后继续处理后续任务，不会把队列中的任务转移到其他协程而打乱顺序
+type keyedPool struct {
+	queues []chan func()
+}
+
+// pool 消费者转发消息使用的工作协程池，以接收者用户ID为key
+var pool = newKeyedPool(config.Handler.ConsumerWorkers, config.Handler.ConsumerQueueSize)
+
+func newKeyedPool(workers int, queueSize int) *keyedPool {
+	p := &keyedPool{queues: make([]chan func(), max(workers, 1))}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), max(queueSize, 1))
+		go p.work(i)
+	}
+	return p
+}
+
+// Submit 将任务放入key对应的工作协程队列，队列已满时阻塞，从而减缓消费速度
+func (p *keyedPool) Submit(key string, task func()) {
+	i := p.worker(key)
+	p.queues[i] <- task
+	metrics.SetGauge("consumer_worker_queue_depth", float64(len(p.queues[i])), "worker", strconv.Itoa(i))
+}
+
+// worker key对应的工作协程序号
+func (p *keyedPool) worker(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *keyedPool) work(i int) {
+	worker := strconv.Itoa(i)
+	for task := range p.queues[i] {
+		p.run(worker, task)
+		metrics.SetGauge("consumer_worker_queue_depth", float64(len(p.queues[i])), "worker", worker)
+	}
+}
+
+// run 执行单个任务，panic只影响该任务
+func (p *keyedPool) run(worker string, task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.Inc("consumer_worker_panic_total", "worker", worker)
+			logger.Sugar().Errorf("消费者工作协程 %s 处理消息时panic: %v", worker, r)
+		}
+	}()
+	task()
+}
@@ -0,0 +1,71 @@
+package consumer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitDone 等待通道关闭，超时则测试失败
+func waitDone(t *testing.T, what string, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待%s超时", what)
+	}
+}
+
+// 同一key的任务按提交顺序执行
+func TestKeyedPoolKeepsOrderPerKey(t *testing.T) {
+	p := newKeyedPool(4, 8)
+	const n = 100
+	var order []int
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		p.Submit("7", func() {
+			order = append(order, i)
+			if i == n-1 {
+				close(done)
+			}
+		})
+	}
+	waitDone(t, "任务执行完", done)
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("第 %d 个执行的任务是 %d，期望按提交顺序执行", i, got)
+		}
+	}
+}
+
+// 不同工作协程上的key并行执行：一个key的任务阻塞时，另一个key的任务照常完成
+func TestKeyedPoolRunsKeysConcurrently(t *testing.T) {
+	p := newKeyedPool(2, 8)
+	a, b := "0", ""
+	for i := 1; b == ""; i++ {
+		if key := strconv.Itoa(i); p.worker(key) != p.worker(a) {
+			b = key
+		}
+	}
+
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	p.Submit(a, func() {
+		<-release
+		close(blocked)
+	})
+	ran := make(chan struct{})
+	p.Submit(b, func() { close(ran) })
+	waitDone(t, "另一个key的任务", ran)
+	close(release)
+	waitDone(t, "阻塞的任务", blocked)
+}
+
+// 任务panic后该key的工作协程继续处理后续任务
+func TestKeyedPoolSurvivesPanic(t *testing.T) {
+	p := newKeyedPool(1, 8)
+	p.Submit("7", func() { panic("处理失败") })
+	done := make(chan struct{})
+	p.Submit("7", func() { close(done) })
+	waitDone(t, "panic之后的任务", done)
+}
@@ -0,0 +1,410 @@
+// Package geoip 只读的 MaxMind DB(.mmdb) 文件解析，只实现按IP查询所需的部分：元数据、二叉搜索树与数据区解码。
+// 格式见 https://maxmind.github.io/MaxMind-DB/ ，GeoLite2/GeoIP2 的城市、国家与ASN库均可使用
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker 元数据区之前的标记，取文件中最后一次出现的位置
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// ErrCorrupt 文件不是合法的 MaxMind DB 或已损坏
+var ErrCorrupt = errors.New("mmdb 文件格式错误")
+
+// Reader 加载到内存中的数据库，可并发查询
+type Reader struct {
+	tree       []byte
+	data       []byte // 数据区，指针相对于其起点
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // IPv6 树中 ::/96 对应的节点，IPv4 地址从这里开始查找
+
+	DatabaseType string // 如 GeoLite2-City、GeoLite2-ASN
+	BuildEpoch   uint64 // 数据库生成时刻(秒)
+}
+
+// Open 读取整个文件并解析元数据
+func Open(path string) (*Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(data)
+}
+
+// New 由文件内容创建 Reader，data 之后不能再修改
+func New(data []byte) (*Reader, error) {
+	i := bytes.LastIndex(data, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: 没有元数据标记", ErrCorrupt)
+	}
+	v, _, err := newDecoder(data[i+len(metadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 元数据: %v", ErrCorrupt, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: 元数据不是map", ErrCorrupt)
+	}
+	r := &Reader{
+		nodeCount:  uint(asUint(meta["node_count"])),
+		recordSize: uint(asUint(meta["record_size"])),
+		ipVersion:  uint(asUint(meta["ip_version"])),
+		BuildEpoch: asUint(meta["build_epoch"]),
+	}
+	r.DatabaseType, _ = meta["database_type"].(string)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: 不支持的 record_size %d", ErrCorrupt, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: 不支持的 ip_version %d", ErrCorrupt, r.ipVersion)
+	}
+	// 每个节点两条记录，搜索树之后是16字节的0，然后是数据区。先按节点数判断，避免乘法溢出
+	if r.nodeCount > uint(i)/(r.recordSize/4) {
+		return nil, fmt.Errorf("%w: 搜索树超出文件长度", ErrCorrupt)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: 搜索树超出文件长度", ErrCorrupt)
+	}
+	r.tree = data[:treeSize]
+	r.data = data[treeSize+16 : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// readNode 读取节点的左(bit为0)或右记录
+func (r *Reader) readNode(node uint, bit byte) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+uint(bit)*4:]))
+	}
+}
+
+// Lookup 查询IP对应的记录，数据库中没有该IP时返回false。记录的结构由数据库类型决定
+func (r *Reader) Lookup(ip netip.Addr) (map[string]any, bool, error) {
+	ip = ip.Unmap()
+	var addr []byte
+	node := uint(0)
+	switch {
+	case ip.Is4():
+		b := ip.As4()
+		addr = b[:]
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	case ip.Is6() && r.ipVersion == 6:
+		b := ip.As16()
+		addr = b[:]
+	default:
+		return nil, false, nil
+	}
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		node = r.readNode(node, (addr[i>>3]>>(7-uint(i&7)))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, false, nil
+	case node < r.nodeCount:
+		return nil, false, fmt.Errorf("%w: 搜索树比地址更深", ErrCorrupt)
+	case node < r.nodeCount+16:
+		return nil, false, fmt.Errorf("%w: 记录指向分隔区", ErrCorrupt)
+	}
+	offset := node - r.nodeCount - 16
+	v, _, err := newDecoder(r.data).decode(offset, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	record, ok := v.(map[string]any)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: 记录不是map", ErrCorrupt)
+	}
+	return record, true, nil
+}
+
+// Location 查询结果中与位置有关的字段，数据库中没有的字段为空
+type Location struct {
+	Country string // ISO 3166-1 国家代码
+	Region  string // 第一级行政区名称
+	City    string
+	ASN     uint32
+}
+
+// Location 查询IP的位置，名称优先使用 lang 语言，没有该语言时使用英文
+func (r *Reader) Location(ip netip.Addr, lang string) (Location, bool, error) {
+	record, ok, err := r.Lookup(ip)
+	if err != nil || !ok {
+		return Location{}, false, err
+	}
+	loc := Location{
+		Country: asString(path(record, "country", "iso_code")),
+		City:    name(path(record, "city"), lang),
+		ASN:     uint32(asUint(record["autonomous_system_number"])),
+	}
+	if loc.Country == "" {
+		loc.Country = asString(path(record, "registered_country", "iso_code"))
+	}
+	if subdivisions, _ := record["subdivisions"].([]any); len(subdivisions) > 0 {
+		loc.Region = name(subdivisions[0], lang)
+		if loc.Region == "" {
+			loc.Region = asString(path(subdivisions[0], "iso_code"))
+		}
+	}
+	return loc, true, nil
+}
+
+// path 依次取嵌套map中的字段
+func path(v any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// name 取 names 中指定语言的名称
+func name(v any, lang string) string {
+	if s := asString(path(v, "names", lang)); s != "" {
+		return s
+	}
+	return asString(path(v, "names", "en"))
+}
+
+func asString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func asUint(v any) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int32:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// 数据区的类型编号
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// maxDepth 嵌套层数上限，防止损坏的文件造成无限递归
+const maxDepth = 32
+
+// maxValues 一次解码的值个数上限。指针可以重复引用同一个map，损坏的文件能让解码量随嵌套层数指数增长
+const maxValues = 1 << 14
+
+// decoder 数据区解码，整数统一解码为 uint64(int32 除外)，uint128 保留原始字节
+type decoder struct {
+	buf    []byte
+	values int // 剩余可解码的值个数
+}
+
+func newDecoder(buf []byte) *decoder {
+	return &decoder{buf: buf, values: maxValues}
+}
+
+func (d *decoder) bytesAt(offset uint, n uint) ([]byte, error) {
+	if offset+n < offset || offset+n > uint(len(d.buf)) {
+		return nil, fmt.Errorf("%w: 偏移 %d 越界", ErrCorrupt, offset)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode 解码 offset 处的值，返回值与其后的偏移
+func (d *decoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("%w: 嵌套过深", ErrCorrupt)
+	}
+	if d.values--; d.values < 0 {
+		return nil, 0, fmt.Errorf("%w: 值过多", ErrCorrupt)
+	}
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		b, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map的键不是字符串", ErrCorrupt)
+			}
+			m[key], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		var list []any
+		for i := uint(0); i < size; i++ {
+			var v any
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, v)
+		}
+		return list, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	raw, err := d.bytesAt(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(raw), offset, nil
+	case typeBytes, typeUint128:
+		return bytes.Clone(raw), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double 长度为 %d", ErrCorrupt, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float 长度为 %d", ErrCorrupt, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: 整数长度为 %d", ErrCorrupt, size)
+		}
+		var n uint64
+		for _, x := range raw {
+			n = n<<8 | uint64(x)
+		}
+		if typ == typeInt32 {
+			return int32(uint32(n)), offset, nil
+		}
+		return n, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: 不支持的类型 %d", ErrCorrupt, typ)
+	}
+}
+
+// size 控制字节之后的长度，29-31 表示之后1-3个字节给出长度
+func (d *decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	b, err := d.bytesAt(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var v uint
+	for _, x := range b {
+		v = v<<8 | uint(x)
+	}
+	switch size {
+	case 29:
+		v += 29
+	case 30:
+		v += 285
+	default:
+		v += 65821
+	}
+	return v, offset + n, nil
+}
+
+// pointer 指针指向数据区中的另一个值，长度由控制字节的第4、5位决定
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	b, err := d.bytesAt(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	var p uint
+	if ss == 3 {
+		p = uint(binary.BigEndian.Uint32(b))
+	} else {
+		p = uint(ctrl & 0x7)
+		for _, x := range b {
+			p = p<<8 | uint(x)
+		}
+	}
+	p += [...]uint{0, 2048, 526336, 0}[ss]
+	return p, offset + ss + 1, nil
+}
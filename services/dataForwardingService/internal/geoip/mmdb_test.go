@@ -0,0 +1,395 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 测试用的最小 MaxMind DB 写入实现，按规范生成搜索树、数据区与元数据
+
+// pointerTo 数据区中已写入值的偏移，编码为指针
+type pointerTo uint
+
+type mmdbWriter struct {
+	data []byte
+}
+
+func (w *mmdbWriter) ctrl(typ int, size int) {
+	var first byte
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+	} else {
+		first = byte(typ) << 5
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		extra = []byte{byte(size - 29)}
+	default:
+		first |= 30
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	}
+	w.data = append(w.data, first)
+	w.data = append(w.data, ext...)
+	w.data = append(w.data, extra...)
+}
+
+// write 写入一个值并返回其偏移
+func (w *mmdbWriter) write(v any) uint {
+	offset := uint(len(w.data))
+	switch v := v.(type) {
+	case pointerTo:
+		w.data = append(w.data, byte(typePointer<<5)|byte(v>>8)&0x7, byte(v))
+	case string:
+		w.ctrl(typeString, len(v))
+		w.data = append(w.data, v...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		w.ctrl(typeUint32, len(b))
+		w.data = append(w.data, b...)
+	case uint64:
+		w.ctrl(typeUint64, 8)
+		w.data = binary.BigEndian.AppendUint64(w.data, v)
+	case uint16:
+		w.ctrl(typeUint16, 2)
+		w.data = binary.BigEndian.AppendUint16(w.data, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		w.ctrl(typeBool, size)
+	case []any:
+		w.ctrl(typeArray, len(v))
+		for _, item := range v {
+			w.write(item)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.ctrl(typeMap, len(v))
+		for _, k := range keys {
+			w.write(k)
+			w.write(v[k])
+		}
+	default:
+		panic("不支持的类型")
+	}
+	return offset
+}
+
+// trieNode 搜索树节点，记录为子节点下标(>=0)、空(-1)或数据偏移(-2-offset)
+type trieNode struct {
+	records [2]int
+}
+
+type fixtureEntry struct {
+	prefix netip.Prefix
+	record any
+}
+
+// buildMMDB 生成包含 entries 的数据库文件内容
+func buildMMDB(t testing.TB, ipVersion int, recordSize int, entries []fixtureEntry) []byte {
+	t.Helper()
+	w := &mmdbWriter{}
+	nodes := []trieNode{{records: [2]int{-1, -1}}}
+	for _, entry := range entries {
+		offset := w.write(entry.record)
+		addr := entry.prefix.Addr()
+		var bits []byte
+		if addr.Is4() {
+			b := addr.As4()
+			bits = b[:]
+			if ipVersion == 6 {
+				bits = append(make([]byte, 12), bits...)
+			}
+		} else {
+			b := addr.As16()
+			bits = b[:]
+		}
+		depth := entry.prefix.Bits() + (len(bits)*8 - addr.BitLen())
+		node := 0
+		for i := 0; i < depth; i++ {
+			bit := (bits[i>>3] >> (7 - uint(i&7))) & 1
+			if i == depth-1 {
+				nodes[node].records[bit] = -2 - int(offset)
+				break
+			}
+			next := nodes[node].records[bit]
+			if next < 0 {
+				next = len(nodes)
+				nodes = append(nodes, trieNode{records: [2]int{-1, -1}})
+				nodes[node].records[bit] = next
+			}
+			node = next
+		}
+	}
+
+	nodeCount := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r >= 0:
+			return uint32(r)
+		case r == -1:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + 16 + (-2 - r))
+		}
+	}
+	var tree []byte
+	for _, n := range nodes {
+		left, right := value(n.records[0]), value(n.records[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0xf)<<4|byte(right>>24&0xf), byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, left)
+			tree = binary.BigEndian.AppendUint32(tree, right)
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, w.data...)
+	file = append(file, metadataMarker...)
+	meta := &mmdbWriter{}
+	meta.write(map[string]any{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-City",
+		"build_epoch":   uint64(1700000000),
+		"languages":     []any{"en", "zh-CN"},
+	})
+	return append(file, meta.data...)
+}
+
+func fixtureEntries() []fixtureEntry {
+	country := map[string]any{"iso_code": "CN", "names": map[string]any{"en": "China"}}
+	return []fixtureEntry{
+		{netip.MustParsePrefix("1.2.3.0/24"), map[string]any{
+			"country": country,
+			"city":    map[string]any{"names": map[string]any{"en": "Hangzhou", "zh-CN": "杭州"}},
+			"subdivisions": []any{map[string]any{
+				"iso_code": "ZJ",
+				"names":    map[string]any{"en": "Zhejiang"},
+			}},
+			"is_anycast": false,
+		}},
+		{netip.MustParsePrefix("8.8.8.0/24"), map[string]any{
+			"autonomous_system_number": uint32(15169),
+			"registered_country":       map[string]any{"iso_code": "US"},
+		}},
+		// 二级行政区只有代码；国家通过指针引用第一条记录中的 country
+		{netip.MustParsePrefix("2001:db8::/32"), map[string]any{
+			"country":      pointerTo(countryOffset(country)),
+			"subdivisions": []any{map[string]any{"iso_code": "BJ"}},
+		}},
+	}
+}
+
+// countryOffset 第一条记录中 country 值在数据区的偏移。map 按键排序写入，city 在 country 之前
+func countryOffset(country map[string]any) uint {
+	w := &mmdbWriter{}
+	w.ctrl(typeMap, 4)
+	w.write("city")
+	w.write(map[string]any{"names": map[string]any{"en": "Hangzhou", "zh-CN": "杭州"}})
+	w.write("country")
+	return uint(len(w.data))
+}
+
+func TestLookupFixture(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		data := buildMMDB(t, 6, recordSize, fixtureEntries())
+		path := filepath.Join(t.TempDir(), "test.mmdb")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Open(path)
+		if err != nil {
+			t.Fatalf("record_size %d: 打开失败: %v", recordSize, err)
+		}
+		if r.DatabaseType != "Test-City" || r.BuildEpoch != 1700000000 {
+			t.Fatalf("record_size %d: 元数据不符: %q %d", recordSize, r.DatabaseType, r.BuildEpoch)
+		}
+
+		cases := []struct {
+			ip    string
+			lang  string
+			found bool
+			want  Location
+		}{
+			{"1.2.3.4", "zh-CN", true, Location{Country: "CN", Region: "Zhejiang", City: "杭州"}},
+			{"1.2.3.255", "fr", true, Location{Country: "CN", Region: "Zhejiang", City: "Hangzhou"}},
+			{"::ffff:1.2.3.4", "en", true, Location{Country: "CN", Region: "Zhejiang", City: "Hangzhou"}},
+			{"8.8.8.8", "en", true, Location{Country: "US", ASN: 15169}},
+			{"2001:db8::1", "en", true, Location{Country: "CN", Region: "BJ"}},
+			{"1.2.4.1", "en", false, Location{}},
+			{"9.9.9.9", "en", false, Location{}},
+			{"2001:db9::1", "en", false, Location{}},
+		}
+		for _, c := range cases {
+			loc, found, err := r.Location(netip.MustParseAddr(c.ip), c.lang)
+			if err != nil {
+				t.Fatalf("record_size %d: 查询 %s 失败: %v", recordSize, c.ip, err)
+			}
+			if found != c.found || loc != c.want {
+				t.Errorf("record_size %d: 查询 %s 得到 %+v %v，期望 %+v %v", recordSize, c.ip, loc, found, c.want, c.found)
+			}
+		}
+
+		record, _, err := r.Lookup(netip.MustParseAddr("1.2.3.4"))
+		if err != nil || record["is_anycast"] != false {
+			t.Errorf("record_size %d: bool 字段解码不符: %v %v", recordSize, record["is_anycast"], err)
+		}
+	}
+}
+
+func TestLookupIPv4Database(t *testing.T) {
+	var entries []fixtureEntry
+	for _, entry := range fixtureEntries() {
+		if entry.prefix.Addr().Is4() {
+			entries = append(entries, entry)
+		}
+	}
+	r, err := New(buildMMDB(t, 4, 24, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc, ok, err := r.Location(netip.MustParseAddr("8.8.8.8"), "en"); err != nil || !ok || loc.ASN != 15169 {
+		t.Fatalf("IPv4 库查询不符: %+v %v %v", loc, ok, err)
+	}
+	// IPv4 库不能查询 IPv6 地址
+	if _, ok, err := r.Lookup(netip.MustParseAddr("2001:db8::1")); err != nil || ok {
+		t.Fatalf("IPv4 库查询 IPv6 地址: %v %v", ok, err)
+	}
+}
+
+func TestNewRejectsCorrupt(t *testing.T) {
+	valid := buildMMDB(t, 6, 24, fixtureEntries())
+	marker := bytes.LastIndex(valid, metadataMarker)
+	// node_count 很大时 node_count*record_size 溢出为很小的值
+	overflow := &mmdbWriter{data: append(make([]byte, 64), metadataMarker...)}
+	overflow.write(map[string]any{
+		"node_count":  uint64(1 << 62),
+		"record_size": uint16(32),
+		"ip_version":  uint16(6),
+	})
+	cases := map[string][]byte{
+		"节点数溢出":  overflow.data,
+		"空文件":    nil,
+		"没有元数据":  valid[:marker],
+		"元数据被截断": valid[:len(valid)-3],
+		"搜索树超出":  append([]byte{}, valid[marker:]...),
+	}
+	for name, data := range cases {
+		if _, err := New(data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: 期望 ErrCorrupt，实际为 %v", name, err)
+		}
+	}
+}
+
+// fuzzSeeds 模糊测试的初始语料：各种 record_size 的合法文件及其截断
+func fuzzSeeds(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			var entries []fixtureEntry
+			for _, entry := range fixtureEntries() {
+				if ipVersion == 6 || entry.prefix.Addr().Is4() {
+					entries = append(entries, entry)
+				}
+			}
+			data := buildMMDB(f, ipVersion, recordSize, entries)
+			seeds = append(seeds, data, data[len(data)/2:])
+		}
+	}
+	return seeds
+}
+
+var fuzzAddrs = []netip.Addr{
+	netip.MustParseAddr("1.2.3.4"),
+	netip.MustParseAddr("8.8.8.8"),
+	netip.MustParseAddr("0.0.0.0"),
+	netip.MustParseAddr("255.255.255.255"),
+	netip.MustParseAddr("2001:db8::1"),
+	netip.MustParseAddr("::"),
+	netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+}
+
+// 任意文件内容都不能让 New 或之后的查询崩溃，错误都应为 ErrCorrupt
+func FuzzNew(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := New(data)
+		if err != nil {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("错误不是 ErrCorrupt: %v", err)
+			}
+			return
+		}
+		for _, addr := range fuzzAddrs {
+			if _, _, err := r.Location(addr, "en"); err != nil && !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("查询 %s 的错误不是 ErrCorrupt: %v", addr, err)
+			}
+		}
+	})
+}
+
+// 合法文件中查询任意地址都不能出错，找到的记录与按前缀判断的结果一致
+func FuzzLookup(f *testing.F) {
+	r, err := New(buildMMDB(f, 6, 28, fixtureEntries()))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, addr := range fuzzAddrs {
+		b := addr.As16()
+		f.Add(b[:])
+	}
+	f.Add([]byte{1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4})
+	entries := fixtureEntries()
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		addr, ok := netip.AddrFromSlice(raw)
+		if !ok {
+			return
+		}
+		_, found, err := r.Lookup(addr)
+		if err != nil {
+			t.Fatalf("查询 %s 失败: %v", addr, err)
+		}
+		// IPv6 库中 ::/96 与 IPv4 共用同一棵子树
+		target := addr.Unmap()
+		if target.Is6() && netip.MustParsePrefix("::/96").Contains(target) {
+			b := target.As16()
+			target = netip.AddrFrom4([4]byte(b[12:]))
+		}
+		want := false
+		for _, entry := range entries {
+			want = want || entry.prefix.Contains(target)
+		}
+		if found != want {
+			t.Fatalf("查询 %s 得到 %v，期望 %v", addr, found, want)
+		}
+	})
+}
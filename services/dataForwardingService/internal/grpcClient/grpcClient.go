@@ -12,37 +12,55 @@ import (
 )
 
 var (
-	client  pb.AuthServiceClient
-	conn    *grpc.ClientConn
-	once    sync.Once
-	initErr error
+	mu          sync.Mutex
+	client      pb.AuthServiceClient
+	conn        *grpc.ClientConn
+	initialized bool
+	initErr     error
 )
 
 // GetAuthClient 单例获取 AuthServiceClient
 func GetAuthClient() (pb.AuthServiceClient, error) {
-	once.Do(func() {
-		authRPCAddr := os.Getenv("AUTH_RPC_ADDR")
-		if authRPCAddr == "" {
-			authRPCAddr = "localhost:50051"
-		}
-		conn, initErr = grpc.Dial(
-			authRPCAddr,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock(),
-			grpc.WithTimeout(5*time.Second),
-		)
-		if initErr != nil {
-			logger.Sugar().Errorf("gRPC 连接失败: %v", initErr)
-			return
-		}
-		client = pb.NewAuthServiceClient(conn)
-	})
-	return client, initErr
+	mu.Lock()
+	defer mu.Unlock()
+	if initialized {
+		return client, initErr
+	}
+	initialized = true
+	authRPCAddr := os.Getenv("AUTH_RPC_ADDR")
+	if authRPCAddr == "" {
+		authRPCAddr = "localhost:50051"
+	}
+	conn, initErr = grpc.Dial(
+		authRPCAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithTimeout(5*time.Second),
+	)
+	if initErr != nil {
+		logger.Sugar().Errorf("gRPC 连接失败: %v", initErr)
+		return nil, initErr
+	}
+	client = pb.NewAuthServiceClient(conn)
+	return client, nil
 }
 
 // CloseConn 关闭AuthServiceClient
 func CloseConn() {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Reset 关闭并丢弃当前的客户端，下次 GetAuthClient 按当时的 AUTH_RPC_ADDR 重新连接。
+// 测试在每次指向新的认证服务前调用
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
 	if conn != nil {
 		conn.Close()
 	}
+	client, conn, initialized, initErr = nil, nil, false, nil
 }
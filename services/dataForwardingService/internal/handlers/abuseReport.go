@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/rand"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// abuseCategories 可选的举报类别
+var abuseCategories = map[string]bool{
+	"spam":       true,
+	"harassment": true,
+	"violence":   true,
+	"sexual":     true,
+	"fraud":      true,
+	"other":      true,
+}
+
+const (
+	maxAbuseMessages = 20      // 单次举报引用的消息数上限
+	maxAbuseText     = 4 << 10 // 举报说明与单条明文声明的字节数上限
+)
+
+// newReportID 生成举报ID
+func newReportID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleReportAbuse 举报用户或其消息：从消息存储中取出被举报消息的快照，连同举报者与被举报者信息写入举报存储，返回举报ID。
+// 每个用户在 AbuseReportWindow 内最多举报 AbuseReportLimit 次；AbuseReportDedupTTL 内重复举报同一消息时返回之前的举报ID
+func handleReportAbuse(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	req := message.GetReportAbuse()
+	if !abuseCategories[req.GetCategory()] {
+		rsp := refused(pb.RefusedReason_INVALID_PAYLOAD)
+		rsp.GetRefused().Field = "category"
+		return rsp, nil
+	}
+	if req.GetTargetUserId() == fromID {
+		rsp := refused(pb.RefusedReason_INVALID_PAYLOAD)
+		rsp.GetRefused().Field = "target_user_id"
+		return rsp, nil
+	}
+	conv := conversation{IsGroup: req.GetIsGroup(), ToID: req.GetToId()}
+	if len(req.GetMessageIds()) > 0 {
+		if _, err := client.server.participants(ctx, conv, fromID); err != nil {
+			return nil, fmt.Errorf("查询会话参与者失败: %w", err)
+		}
+	}
+
+	cfg := config.Handler
+	wait, err := redisClient.RecordAbuseReport(ctx, client.userID, cfg.AbuseReportWindow, cfg.AbuseReportLimit)
+	if err != nil {
+		return nil, fmt.Errorf("记录举报次数失败: %w", err)
+	}
+	if wait > 0 {
+		metrics.Inc("abuse_reports_total", "result", "rate_limited")
+		rsp := refused(pb.RefusedReason_RATE_LIMITED)
+		rsp.GetRefused().RetryAfterMs = wait.Milliseconds()
+		return rsp, nil
+	}
+
+	reportID, err := newReportID()
+	if err != nil {
+		return nil, err
+	}
+	// 举报消息时按消息去重，只举报用户时按用户去重
+	subjects := []string{"user:" + strconv.FormatInt(req.GetTargetUserId(), 10)}
+	if len(req.GetMessageIds()) > 0 {
+		subjects = subjects[:0]
+		for _, messageID := range req.GetMessageIds() {
+			subjects = append(subjects, conv.key(fromID)+":"+messageID)
+		}
+	}
+	claimed, previous, err := redisClient.ClaimAbuseSubjects(ctx, client.userID, subjects, reportID, cfg.AbuseReportDedupTTL)
+	if err != nil {
+		return nil, fmt.Errorf("举报去重失败: %w", err)
+	}
+	if len(claimed) == 0 {
+		metrics.Inc("abuse_reports_total", "result", "duplicate")
+		return abuseReportAck(previous, true), nil
+	}
+
+	report := &pb.AbuseReport{
+		ReportId:         reportID,
+		ReporterId:       fromID,
+		ReporterDeviceId: client.deviceID,
+		TargetUserId:     req.GetTargetUserId(),
+		IsGroup:          req.GetIsGroup(),
+		ToId:             req.GetToId(),
+		Category:         req.GetCategory(),
+		Text:             req.GetText(),
+		ReportedAt:       time.Now().UnixMilli(),
+		ContainerId:      identity.ContainerID(),
+	}
+	if len(req.GetMessageIds()) > 0 {
+		var messageIDs []string
+		for i, messageID := range req.GetMessageIds() {
+			if slices.Contains(claimed, subjects[i]) {
+				messageIDs = append(messageIDs, messageID)
+			}
+		}
+		report.Messages, err = client.server.snapshotReported(ctx, conv.key(fromID), messageIDs, client.deviceID, req.GetPlaintextClaims())
+	}
+	if err == nil {
+		err = writeAbuseReport(ctx, report)
+	}
+	if err != nil {
+		// 撤销去重登记，客户端重试时不会被当作重复举报
+		if releaseErr := redisClient.ReleaseAbuseSubjects(ctx, client.userID, claimed); releaseErr != nil {
+			ctxLogger(ctx).Warnf("撤销举报 %s 的去重登记失败: %v", reportID, releaseErr)
+		}
+		metrics.Inc("abuse_reports_total", "result", "error")
+		return nil, err
+	}
+	metrics.Inc("abuse_reports_total", "result", "accepted")
+	ctxLogger(ctx).Infof("收到举报 %s，被举报用户 %d，类别 %s，消息 %d 条", reportID, req.GetTargetUserId(), req.GetCategory(), len(report.Messages))
+	return abuseReportAck(reportID, false), nil
+}
+
+func abuseReportAck(reportID string, duplicate bool) *pb.ResponseMessage {
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_AbuseReportAck{
+			AbuseReportAck: &pb.AbuseReportAck{ReportId: reportID, Duplicate: duplicate},
+		},
+	}
+}
+
+// snapshotReported 在会话最近 AbuseReportScanLimit 条历史中查找被举报的消息，找不到的标记为未保留。
+// 加密消息只保留发给举报设备的密文，并附上举报者声明的明文；明文消息忽略明文声明
+func (s *Server) snapshotReported(ctx context.Context, conv string, messageIDs []string, deviceID string, claims []*pb.PlaintextClaim) ([]*pb.ReportedMessage, error) {
+	pending := make(map[string]*pb.ReportedMessage, len(messageIDs))
+	reported := make([]*pb.ReportedMessage, 0, len(messageIDs))
+	for _, messageID := range messageIDs {
+		r := &pb.ReportedMessage{MessageId: messageID}
+		pending[messageID] = r
+		reported = append(reported, r)
+	}
+	if s.messages == nil {
+		return reported, nil
+	}
+	var before int64
+	for scanned := 0; scanned < config.Handler.AbuseReportScanLimit && len(pending) > 0; {
+		page, err := s.messages.FetchConversation(ctx, conv, before, config.Handler.MaxHistoryPage)
+		if err != nil {
+			return nil, fmt.Errorf("读取会话历史失败: %w", err)
+		}
+		for _, stored := range page {
+			id := storedMessageID(stored.Message)
+			r, ok := pending[id]
+			if !ok {
+				continue
+			}
+			delete(pending, id)
+			snapshot := proto.Clone(stored.Message).(*pb.ResponseMessage)
+			if encrypted := snapshot.GetEncrypted(); encrypted != nil {
+				encrypted.Ciphertexts = deviceCiphertexts(encrypted.GetCiphertexts(), deviceID)
+				r.PlaintextClaim = plaintextClaim(claims, id)
+			}
+			r.Retained, r.ConvSeq, r.ServerTs, r.Message = true, stored.ConvSeq, stored.ServerTs, snapshot
+		}
+		scanned += len(page)
+		if len(page) < config.Handler.MaxHistoryPage {
+			break
+		}
+		before = page[len(page)-1].Position
+		if before == 0 {
+			before = page[len(page)-1].ConvSeq
+		}
+	}
+	metrics.Add("abuse_report_messages_total", float64(len(reported)-len(pending)), "retained", "true")
+	metrics.Add("abuse_report_messages_total", float64(len(pending)), "retained", "false")
+	return reported, nil
+}
+
+// storedMessageID 历史消息的客户端消息ID
+func storedMessageID(message *pb.ResponseMessage) string {
+	if post := message.GetPost(); post != nil {
+		return post.GetMessageId()
+	}
+	return message.GetEncrypted().GetMessageId()
+}
+
+func plaintextClaim(claims []*pb.PlaintextClaim, messageID string) string {
+	for _, claim := range claims {
+		if claim.GetMessageId() == messageID {
+			return claim.GetPlaintext()
+		}
+	}
+	return ""
+}
+
+// writeAbuseReport 写入举报存储：配置了 AbuseReportTopic 时发布到消息队列，否则写入redis stream
+func writeAbuseReport(ctx context.Context, report *pb.AbuseReport) error {
+	// 举报由审核系统消费，按 AbuseReport 的契约写入，不包装 WireEnvelope
+	data, err := proto.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("举报序列化失败: %w", err)
+	}
+	if topic := config.Handler.AbuseReportTopic; topic != "" {
+		if err := publishMessage(ctx, data, topic); err != nil {
+			return fmt.Errorf("发布举报失败: %w", err)
+		}
+		return nil
+	}
+	if _, err := redisClient.AppendAbuseReport(ctx, data, int64(config.Handler.AbuseReportMaxEntries)); err != nil {
+		return fmt.Errorf("写入举报失败: %w", err)
+	}
+	return nil
+}
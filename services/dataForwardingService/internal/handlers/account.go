@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/topics"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// kickEverywhere 让用户所有在线设备断开：本容器的直接终止，其他容器的通过控制消息通知，关闭前都会下发 SessionTerminated。
+// except 非空时保留该连接，返回被断开的会话数
+func (s *Server) kickEverywhere(ctx context.Context, userID string, reason CloseReason, except *Client) (int, error) {
+	devices, err := redisClient.GetUserDevices(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	containerID := identity.ContainerID()
+	kicked := 0
+	for deviceID, target := range devices {
+		if target == containerID {
+			continue
+		}
+		command := fmt.Sprintf("KICK %s %s", reason, redisClient.DeviceKey(userID, deviceID))
+		if err := publishMessage(ctx, signControl(target, command), topics.BuildContainerTopic(target)); err != nil {
+			return kicked, fmt.Errorf("通知容器 %s 断开连接失败: %w", target, err)
+		}
+		kicked++
+	}
+	// 本容器以本地连接表为准，包括尚未完成redis登记的降级连接
+	for _, client := range s.clients.UserClients(userID) {
+		if client == except {
+			continue
+		}
+		terminateSession(client, reason)
+		kicked++
+	}
+	return kicked, nil
+}
+
+// DeleteAccount 账号注销后断开其所有连接并清理保存的状态。各步骤均可重复执行，
+// 上游重复投递或部分失败后重试都是安全的
+func (s *Server) DeleteAccount(ctx context.Context, userID string) error {
+	if _, err := s.kickEverywhere(ctx, userID, CloseAccountDeleted, nil); err != nil {
+		return err
+	}
+	if err := redisClient.PurgeUserState(ctx, userID); err != nil {
+		return fmt.Errorf("清理用户状态失败: %w", err)
+	}
+	// 不直接删除离线队列：其他容器可能正在向其追加，重复执行时多追加的标记无害
+	if err := s.tombstoneOffline(ctx, userID, Tombstone{Kind: TombstonePurgeUser, At: time.Now()}); err != nil {
+		return fmt.Errorf("标记离线消息作废失败: %w", err)
+	}
+	return nil
+}
+
+// DeleteAccount 在默认实例上执行账号注销处理。
+//
+// Deprecated: 使用 Default().DeleteAccount
+func DeleteAccount(ctx context.Context, userID string) error {
+	return defaultServer.DeleteAccount(ctx, userID)
+}
+
+// HandleAccountDeleted 处理账号注销控制消息，失败时按退避重试。控制消息按容器订阅，由默认实例处理
+func HandleAccountDeleted(userID string) {
+	defaultServer.handleAccountDeleted(userID)
+}
+
+func (s *Server) handleAccountDeleted(userID string) {
+	sugar := logger.Sugar()
+	backoff := time.Second
+	for attempt := 1; attempt <= 5; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+		err := s.DeleteAccount(ctx, userID)
+		cancel()
+		if err == nil {
+			metrics.Inc("account_deleted_total")
+			s.publishEvent(AccountDeleted{
+				UserID: userID,
+				At:     time.Now(),
+			})
+			sugar.Infof("用户 %s 注销处理完成", userID)
+			return
+		}
+		sugar.Warnf("用户 %s 注销处理第 %d 次失败: %v", userID, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	metrics.Inc("account_delete_failed_total")
+	sugar.Errorf("用户 %s 注销处理失败，已放弃", userID)
+}
+
+// handleAdminDeleteAccount DELETE /admin/accounts/{userID} 同步执行账号注销处理
+func (s *Server) handleAdminDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	if userID == "" {
+		http.Error(w, "missing user id", http.StatusBadRequest)
+		return
+	}
+	if err := s.DeleteAccount(r.Context(), userID); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	s.publishEvent(AccountDeleted{
+		UserID: userID,
+		At:     time.Now(),
+	})
+	writeJSON(w, http.StatusOK, map[string]string{"user_id": userID})
+}
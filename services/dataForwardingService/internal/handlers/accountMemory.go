@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"sync"
+)
+
+// memoryUserIDBase 内存账号后端分配的第一个用户ID
+const memoryUserIDBase = 10000
+
+// MemoryAccountService 保存在进程内的账号后端，用于集成测试与不依赖认证服务的内存模式。
+// 结果是确定的：用户ID按注册顺序从 memoryUserIDBase 起分配，令牌由用户ID推导，重启后全部丢失
+type MemoryAccountService struct {
+	mu       sync.Mutex
+	accounts map[string]*memoryAccount // {账号: 账号信息}
+	byID     map[int64]*memoryAccount
+	nextID   int64
+}
+
+type memoryAccount struct {
+	userID   int64
+	userName string
+	password [sha256.Size]byte
+}
+
+// NewMemoryAccountService 创建内存账号后端，accounts 按顺序预先注册
+func NewMemoryAccountService(accounts ...NewAccount) *MemoryAccountService {
+	s := &MemoryAccountService{
+		accounts: make(map[string]*memoryAccount),
+		byID:     make(map[int64]*memoryAccount),
+		nextID:   memoryUserIDBase,
+	}
+	for _, account := range accounts {
+		_, _ = s.CreateAccount(context.Background(), account)
+	}
+	return s
+}
+
+// memoryToken 内存后端签发的令牌，只在内存后端内有效
+func memoryToken(userID int64) string {
+	sum := sha256.Sum256([]byte("memory-account\x00" + strconv.FormatInt(userID, 10)))
+	return strconv.FormatInt(userID, 10) + "." + hex.EncodeToString(sum[:8])
+}
+
+func (s *MemoryAccountService) VerifyCredentials(ctx context.Context, creds Credentials) (*VerifiedAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[creds.Account]
+	if !ok {
+		return &VerifiedAccount{Result: pb.LoginResult_ACCOUNT_NOT_EXIST}, nil
+	}
+	if creds.JWT != "" {
+		if subtle.ConstantTimeCompare([]byte(creds.JWT), []byte(memoryToken(account.userID))) != 1 {
+			return &VerifiedAccount{Result: pb.LoginResult_JWT_ERROR}, nil
+		}
+	} else {
+		password := sha256.Sum256([]byte(creds.Password))
+		if subtle.ConstantTimeCompare(password[:], account.password[:]) != 1 {
+			return &VerifiedAccount{Result: pb.LoginResult_PASSWORD_ERROR}, nil
+		}
+	}
+	return &VerifiedAccount{
+		Result: pb.LoginResult_LOGIN_OK,
+		UserID: account.userID,
+		JWT:    memoryToken(account.userID),
+	}, nil
+}
+
+func (s *MemoryAccountService) CreateAccount(ctx context.Context, account NewAccount) (pb.SignupResult, error) {
+	switch {
+	case account.Account == "":
+		return pb.SignupResult_ACCOUNT_EMPTY, nil
+	case account.Password == "":
+		return pb.SignupResult_PASSWORD_EMPTY, nil
+	case len(account.Account) > maxUsernameLen:
+		return pb.SignupResult_ACCOUNT_TOO_LONG, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[account.Account]; ok {
+		return pb.SignupResult_ACCOUNT_EXIST, nil
+	}
+	created := &memoryAccount{
+		userID:   s.nextID,
+		userName: account.UserName,
+		password: sha256.Sum256([]byte(account.Password)),
+	}
+	s.nextID++
+	s.accounts[account.Account] = created
+	s.byID[created.userID] = created
+	return pb.SignupResult_SIGNUP_OK, nil
+}
+
+func (s *MemoryAccountService) GetUserProfile(ctx context.Context, userID int64) (*UserProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.byID[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &UserProfile{UserID: account.userID, UserName: account.userName}, nil
+}
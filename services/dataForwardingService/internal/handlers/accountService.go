@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	auth "Betterfly2/proto/server_rpc/auth"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/grpcClient"
+	"data_forwarding_service/internal/logsample"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrAccountServiceUnavailable 账号后端暂不可用(熔断或连接失败)，开启 AuthFallback 时登录据此进入降级模式
+var ErrAccountServiceUnavailable = errors.New("账号后端暂不可用")
+
+// Credentials 登录提交的凭据，JWT 非空时按令牌登录，不需要密码
+type Credentials struct {
+	Account  string
+	Password string
+	JWT      string
+}
+
+// VerifiedAccount 凭据校验结果。Result 为 LOGIN_OK 或需要二次验证时 UserID 与 JWT 有效
+type VerifiedAccount struct {
+	Result            pb.LoginResult
+	UserID            int64
+	JWT               string
+	TwoFactorRequired bool // 凭据正确但需要二次验证，令牌在验证通过后才下发
+}
+
+// NewAccount 注册提交的账号信息
+type NewAccount struct {
+	Account  string
+	Password string
+	UserName string
+}
+
+// UserProfile 用户的公开资料
+type UserProfile struct {
+	UserID   int64
+	UserName string
+}
+
+// AccountService 登录与注册使用的账号后端。超时、重试与熔断由实现自行处理，处理函数只关心结果；
+// 暂不可用时返回包装了 ErrAccountServiceUnavailable 的错误。GetUserProfile 在用户不存在时返回nil
+type AccountService interface {
+	VerifyCredentials(ctx context.Context, creds Credentials) (*VerifiedAccount, error)
+	CreateAccount(ctx context.Context, account NewAccount) (pb.SignupResult, error)
+	GetUserProfile(ctx context.Context, userID int64) (*UserProfile, error)
+}
+
+// SetAccountService 替换账号后端，默认通过gRPC调用认证服务，需在服务启动之前调用
+func (s *Server) SetAccountService(accounts AccountService) {
+	s.accounts = accounts
+}
+
+// SetAccountService 替换默认实例的账号后端。
+//
+// Deprecated: 使用 Default().SetAccountService
+func SetAccountService(s AccountService) {
+	defaultServer.SetAccountService(s)
+}
+
+// authRPCAccounts 通过gRPC调用认证服务。每次调用带 AuthRPCTimeout 期限；
+// 登录校验在认证服务不可达时重试 AuthRPCRetries 次，注册不是幂等的，不重试；
+// 连续失败后由 authBreaker 熔断，熔断期间直接返回 ErrAccountServiceUnavailable
+type authRPCAccounts struct{}
+
+func (authRPCAccounts) VerifyCredentials(ctx context.Context, creds Credentials) (*VerifiedAccount, error) {
+	req := &auth.LoginReq{Account: creds.Account}
+	if creds.JWT == "" {
+		// 没有jwt代表账户密码登录
+		req.Password = creds.Password
+	} else {
+		req.Jwt = creds.JWT
+	}
+	var rsp *auth.LoginRsp
+	err := callAuthService(ctx, config.Handler.AuthRPCRetries, func(ctx context.Context, rpcClient auth.AuthServiceClient) error {
+		var err error
+		rsp, err = rpcClient.Login(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if logsample.Allow(logsample.Login, nil) {
+		ctxLogger(ctx).Infof("authServiceRsp: %v", rsp)
+	}
+	result := &VerifiedAccount{Result: pb.LoginResult_LOGIN_SVR_ERROR}
+	switch rsp.GetResult() {
+	case auth.AuthResult_OK:
+		result.Result = pb.LoginResult_LOGIN_OK
+		result.UserID = rsp.GetUserId()
+		result.JWT = rsp.GetJwt()
+	case auth.AuthResult_ACCOUNT_NOT_EXIST:
+		result.Result = pb.LoginResult_ACCOUNT_NOT_EXIST
+	case auth.AuthResult_PASSWORD_ERROR:
+		result.Result = pb.LoginResult_PASSWORD_ERROR
+	case auth.AuthResult_JWT_ERROR:
+		result.Result = pb.LoginResult_JWT_ERROR
+	case auth.AuthResult_TWO_FACTOR_REQUIRED:
+		result.TwoFactorRequired = true
+		result.UserID = rsp.GetUserId()
+		result.JWT = rsp.GetJwt()
+	}
+	return result, nil
+}
+
+func (authRPCAccounts) CreateAccount(ctx context.Context, account NewAccount) (pb.SignupResult, error) {
+	req := &auth.SignupReq{
+		Account:  account.Account,
+		Password: account.Password,
+		UserName: account.UserName,
+	}
+	var rsp *auth.SignupRsp
+	err := callAuthService(ctx, 0, func(ctx context.Context, rpcClient auth.AuthServiceClient) error {
+		var err error
+		rsp, err = rpcClient.Signup(ctx, req)
+		return err
+	})
+	if err != nil {
+		return pb.SignupResult_SIGNUP_SVR_ERROR, err
+	}
+	if logsample.Allow(logsample.Login, nil) {
+		ctxLogger(ctx).Infof("authServiceRsp: %v", rsp)
+	}
+	switch rsp.GetResult() {
+	case auth.AuthResult_OK:
+		return pb.SignupResult_SIGNUP_OK, nil
+	case auth.AuthResult_ACCOUNT_EXIST:
+		return pb.SignupResult_ACCOUNT_EXIST, nil
+	case auth.AuthResult_ACCOUNT_EMPTY:
+		return pb.SignupResult_ACCOUNT_EMPTY, nil
+	case auth.AuthResult_PASSWORD_EMPTY:
+		return pb.SignupResult_PASSWORD_EMPTY, nil
+	case auth.AuthResult_ACCOUNT_TOO_LONG:
+		return pb.SignupResult_ACCOUNT_TOO_LONG, nil
+	}
+	return pb.SignupResult_SIGNUP_SVR_ERROR, nil
+}
+
+// GetUserProfile 认证服务没有用户资料接口
+func (authRPCAccounts) GetUserProfile(ctx context.Context, userID int64) (*UserProfile, error) {
+	return nil, ErrLookupUnsupported
+}
+
+// callAuthService 带期限、重试与熔断调用认证服务。熔断器断开或调用失败后断开时返回 ErrAccountServiceUnavailable
+func callAuthService(ctx context.Context, retries int, call func(ctx context.Context, rpcClient auth.AuthServiceClient) error) error {
+	if !authBreaker.Allow() {
+		return ErrAccountServiceUnavailable
+	}
+	rpcClient, err := grpcClient.GetAuthClient()
+	if err != nil {
+		authBreaker.Record(err)
+		return fmt.Errorf("%w: %v", ErrAccountServiceUnavailable, err)
+	}
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := config.Handler.AuthRPCTimeout; timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err = call(callCtx, rpcClient)
+		cancel()
+		if err == nil || attempt >= retries || !retryableAuthError(err) || ctx.Err() != nil {
+			break
+		}
+		ctxLogger(ctx).Warnf("调用认证服务失败，第 %d 次重试: %v", attempt+1, err)
+	}
+	authBreaker.Record(err)
+	if err != nil && authBreaker.Open() {
+		return fmt.Errorf("%w: %v", ErrAccountServiceUnavailable, err)
+	}
+	return err
+}
+
+// retryableAuthError 认证服务不可达或超时时可以重试，其他错误重试也不会成功
+func retryableAuthError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/preflight"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// newInternalMux 内部管理服务器的路由：管理接口、指标与pprof，只能监听在内部地址上
+func (s *Server) newInternalMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	s.registerAdminRoutes(mux)
+	mux.HandleFunc("/metrics", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WritePrometheus(w)
+	}))
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/debug/pprof/", adminOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", adminOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", adminOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", adminOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", adminOnly(pprof.Trace))
+	return mux
+}
+
+// registerAdminRoutes 注册管理接口，涉及连接的接口只作用于实例 s 的连接表
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/drain", adminOnly(audited("drain", true, s.handleAdminDrain)))
+	mux.HandleFunc("/admin/tap/{userID}", adminOnly(audited("tap", true, s.handleAdminTap)))
+	mux.HandleFunc("/admin/connections", adminOnly(audited("list_connections", false, s.handleAdminConnections)))
+	mux.HandleFunc("DELETE /admin/accounts/{userID}", adminOnly(audited("delete_account", true, s.handleAdminDeleteAccount)))
+	mux.HandleFunc("POST /admin/broadcast", adminOnly(audited("broadcast", true, s.handleAdminBroadcast)))
+	mux.HandleFunc("GET /admin/audit", adminOnly(audited("read_audit", false, handleAdminAudit)))
+	mux.HandleFunc("GET /admin/top-talkers", adminOnly(audited("top_talkers", false, handleAdminTopTalkers)))
+	mux.HandleFunc("GET /admin/size-report", adminOnly(audited("size_report", false, handleAdminSizeReport)))
+	mux.HandleFunc("GET /admin/slo", adminOnly(audited("read_slo", false, handleAdminSLO)))
+	mux.HandleFunc("GET /admin/storage", adminOnly(audited("read_storage", false, handleAdminStorage)))
+	mux.HandleFunc("GET /admin/users/{userID}/connections", adminOnly(audited("read_connection_history", false, handleAdminConnectionHistory)))
+	mux.HandleFunc("POST /admin/reauth", adminOnly(audited("require_reauth", true, s.handleAdminReauth)))
+	mux.HandleFunc("DELETE /admin/registrations/{userID}/{deviceID}", adminOnly(audited("remove_registration", true, s.handleAdminRemoveRegistration)))
+	mux.HandleFunc("GET /admin/pipeline/{userID}", adminOnly(audited("read_pipeline", false, s.handleAdminPipeline)))
+	mux.HandleFunc("PUT /admin/pipeline/{userID}", adminOnly(audited("pin_pipeline", true, s.handleAdminPipeline)))
+	mux.HandleFunc("DELETE /admin/pipeline/{userID}", adminOnly(audited("unpin_pipeline", true, s.handleAdminPipeline)))
+	if config.Handler.FaultInjection {
+		mux.HandleFunc("/admin/faults", adminOnly(audited("faults", true, handleAdminFaults)))
+	}
+}
+
+// adminOnly 配置了 ADMIN_TOKEN 时校验管理令牌；未配置时只依靠内部地址隔离
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			next(w, r)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminIdentity 调用方身份，只记录令牌摘要，不记录令牌本身
+func adminIdentity(r *http.Request) string {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if given == "" {
+		return "anonymous@" + r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(given))
+	return "token:" + hex.EncodeToString(sum[:4]) + "@" + r.RemoteAddr
+}
+
+// handleReadyz 就绪检查，排空中或金丝雀自检不健康时返回503，供负载均衡与告警使用
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("detail") {
+		// 详情包含依赖地址等信息，与其他管理接口一样需要令牌
+		adminOnly(s.handleReadyzDetail)(w, r)
+		return
+	}
+	switch {
+	case s.isDraining():
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+	case !CanaryHealthy():
+		http.Error(w, "canary unhealthy", http.StatusServiceUnavailable)
+	default:
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+// handleReadyzDetail 就绪状态及各依赖的检查结果，依赖检查与 --check 启动自检相同
+func (s *Server) handleReadyzDetail(w http.ResponseWriter, r *http.Request) {
+	report := preflight.Run(r.Context(), preflight.Live)
+	draining, canary := s.isDraining(), CanaryHealthy()
+	status := http.StatusOK
+	if draining || !canary || !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{
+		"draining":       draining,
+		"canary_healthy": canary,
+		"dependencies":   report,
+	})
+}
+
+// connectionInfo 连接列表中的一项
+type connectionInfo struct {
+	Key        string         `json:"key"`
+	ConnID     string         `json:"conn_id"`
+	UserID     string         `json:"user_id,omitempty"`
+	DeviceID   string         `json:"device_id,omitempty"`
+	RemoteAddr string         `json:"remote_addr"`
+	LaneDepths map[string]int `json:"lane_depths"`
+	Class      string         `json:"client_class,omitempty"`
+	BufferSize int            `json:"buffer_size"`
+	HighWater  map[string]int `json:"buffer_high_water"`
+	Quality    string         `json:"quality"`
+	Reason     string         `json:"quality_reason,omitempty"`
+	Location   *GeoLocation   `json:"location,omitempty"`
+}
+
+// handleAdminConnections 列出本容器的所有连接及其发送队列积压
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	all := s.clients.All()
+	list := make([]connectionInfo, 0, len(all))
+	for _, client := range all {
+		size, highWater := client.buffer.stats()
+		quality, reason := client.quality.state()
+		key, userID, deviceID := s.clients.Identity(client)
+		list = append(list, connectionInfo{
+			Key:        key,
+			ConnID:     client.connID,
+			UserID:     userID,
+			DeviceID:   deviceID,
+			RemoteAddr: client.conn.RemoteAddr().String(),
+			LaneDepths: client.laneDepths(),
+			Class:      client.declared().class,
+			BufferSize: size,
+			HighWater:  highWater,
+			Quality:    quality,
+			Reason:     reason,
+			Location:   client.location.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// writeJSON 输出JSON响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
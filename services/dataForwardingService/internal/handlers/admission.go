@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// admission 新连接的准入限流，平滑大量客户端同时重连对登录路径的冲击，AdmissionRate 为0时不限流
+var admission = newTokenBucket(float64(config.Handler.AdmissionRate), config.Handler.AdmissionBurst)
+
+// admit 超出速率的升级请求最多等待 AdmissionMaxWait 后放行，仍排不上时拒绝并返回带抖动的 Retry-After
+func admit(w http.ResponseWriter, r *http.Request) bool {
+	if config.Handler.AdmissionRate <= 0 || isCanaryRequest(r) {
+		return true
+	}
+	wait, ok := admission.Reserve(config.Handler.AdmissionMaxWait)
+	if !ok {
+		metrics.Inc("admission_total", "result", "refused")
+		retry := retryAfter()
+		w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+		http.Error(w, "too many connections, retry later", http.StatusServiceUnavailable)
+		return false
+	}
+	if wait <= 0 {
+		metrics.Inc("admission_total", "result", "admitted")
+		return true
+	}
+	metrics.Inc("admission_total", "result", "delayed")
+	metrics.Observe("admission_wait_ms", float64(wait.Milliseconds()))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// retryAfter 建议客户端重连前等待的时间：基准时间加上每个连接独立的随机抖动，避免同时重连
+func retryAfter() time.Duration {
+	delay := config.Handler.RetryAfterBase
+	if jitter := config.Handler.RetryAfterJitter; jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+// closeText 关闭帧中的原因文本，需要客户端重连的原因附带 retry_after_ms，格式如 server_drain;retry_after_ms=3200
+func closeText(reason CloseReason) string {
+	if !reason.expectsReconnect() {
+		return string(reason)
+	}
+	return fmt.Sprintf("%s;retry_after_ms=%d", reason, retryAfter().Milliseconds())
+}
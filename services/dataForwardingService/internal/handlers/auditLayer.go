@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/audit"
+	"data_forwarding_service/internal/metrics"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxAuditBody 审计记录中保存的请求体长度上限
+const maxAuditBody = 4 << 10
+
+type auditCtxKey struct{}
+
+// auditDetails 处理函数补充到审计记录中的信息
+type auditDetails struct {
+	mu     sync.Mutex
+	fields map[string]any
+	users  []string
+}
+
+// annotateAudit 为当前管理请求的审计记录补充信息，不在审计层内调用时忽略
+func annotateAudit(r *http.Request, key string, value any) {
+	if d, ok := r.Context().Value(auditCtxKey{}).(*auditDetails); ok {
+		d.mu.Lock()
+		d.fields[key] = value
+		d.mu.Unlock()
+	}
+}
+
+// auditUsers 为当前管理请求的审计记录补充受影响的用户
+func auditUsers(r *http.Request, userIDs ...string) {
+	if d, ok := r.Context().Value(auditCtxKey{}).(*auditDetails); ok {
+		d.mu.Lock()
+		d.users = append(d.users, userIDs...)
+		d.mu.Unlock()
+	}
+}
+
+// audited 管理接口的审计层，记录调用方、操作、参数、受影响用户与结果。
+// critical 的操作(GET除外)在执行前先写入一条 started 记录，配置 AuditFailClosed 时写入失败则拒绝执行
+func audited(action string, critical bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+		event := &audit.Event{
+			Type:   audit.TypeAdminAction,
+			Caller: adminIdentity(r),
+			Action: action,
+			Params: auditParams(r, body),
+			Users:  auditAffectedUsers(r, body),
+		}
+		details := &auditDetails{fields: make(map[string]any)}
+		r = r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, details))
+
+		if critical && r.Method != http.MethodGet {
+			event.Outcome = "started"
+			if err := audit.Record(r.Context(), event); err != nil {
+				metrics.Inc("audit_write_errors_total", "action", action)
+				ctxLogger(r.Context()).Errorf("写入审计记录失败: %v", err)
+				if config.Handler.AuditFailClosed {
+					http.Error(w, "audit unavailable", http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		details.mu.Lock()
+		event.Users = append(event.Users, details.users...)
+		event.Details = details.fields
+		details.mu.Unlock()
+		event.ID = ""
+		event.At = time.Time{}
+		event.Outcome = "ok"
+		if recorder.status >= http.StatusBadRequest {
+			event.Outcome = "failed:" + strconv.Itoa(recorder.status)
+		}
+		// 操作已执行，结果记录写入失败只能记日志；请求上下文可能已结束，使用独立的超时
+		ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+		defer cancel()
+		if err := audit.Record(ctx, event); err != nil {
+			metrics.Inc("audit_write_errors_total", "action", action)
+			ctxLogger(r.Context()).Errorf("写入审计记录失败: %v", err)
+		}
+	}
+}
+
+// auditParams 请求参数：方法、路径、查询串与截断后的请求体
+func auditParams(r *http.Request, body []byte) map[string]string {
+	params := map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}
+	if r.URL.RawQuery != "" {
+		params["query"] = r.URL.RawQuery
+	}
+	if len(body) > 0 {
+		params["body"] = string(body[:min(len(body), maxAuditBody)])
+	}
+	return params
+}
+
+// auditAffectedUsers 从路径参数与请求体中的 user_ids 提取受影响的用户
+func auditAffectedUsers(r *http.Request, body []byte) []string {
+	var users []string
+	if userID := r.PathValue("userID"); userID != "" {
+		users = append(users, userID)
+	}
+	var req struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if json.Unmarshal(body, &req) == nil {
+		users = append(users, req.UserIDs...)
+	}
+	return users
+}
+
+// handleAdminAudit 分页查看最近的审计记录，before 为上一页返回的 next
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	events, next, err := audit.Recent(r.Context(), r.URL.Query().Get("before"), limit)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": events,
+		"next":    next,
+	})
+}
+
+// statusRecorder 记录响应状态码，需支持 Hijack 以便旁路监听升级为WebSocket
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("底层连接不支持 Hijack")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/audit"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authBreaker 认证服务的熔断器：连续失败 AuthBreakerThreshold 次后断开，冷却 AuthBreakerCooldown 后放行一次试探请求，
+// 试探成功即恢复。断开期间开启 AuthFallback 时进入降级登录模式
+var authBreaker = &circuitBreaker{}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // 为零值时熔断器闭合
+	probing  bool      // 冷却结束后已放行一次试探请求，等待其结果
+}
+
+// Allow 是否可以调用认证服务
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < config.Handler.AuthBreakerCooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Open 熔断器是否处于断开状态
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+// Record 记录一次调用结果，err 为nil表示认证服务可用(即使登录结果为失败)
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	wasOpen := !b.openedAt.IsZero()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.openedAt = time.Time{}
+	} else {
+		b.failures++
+		if wasOpen || b.failures >= config.Handler.AuthBreakerThreshold {
+			// 试探失败时重新计算冷却时间
+			b.openedAt = time.Now()
+		}
+	}
+	isOpen := !b.openedAt.IsZero()
+	b.mu.Unlock()
+
+	if wasOpen != isOpen {
+		onAuthBreakerChange(isOpen, err)
+	}
+}
+
+// onAuthBreakerChange 熔断器状态变化时记录日志、指标与审计
+func onAuthBreakerChange(open bool, cause error) {
+	action := "auth_degraded_exit"
+	if open {
+		action = "auth_degraded_enter"
+		metrics.SetGauge("auth_circuit_open", 1)
+		ctxLogger(context.Background()).Errorf("认证服务连续失败，熔断器断开(降级登录: %v): %v", authFallbackEnabled(), cause)
+	} else {
+		metrics.SetGauge("auth_circuit_open", 0)
+		ctxLogger(context.Background()).Infoln("认证服务恢复，熔断器闭合，退出降级登录模式")
+	}
+	recordAuthAudit(&audit.Event{Action: action, Outcome: "ok"})
+}
+
+// credentialCacheSecret 登录校验缓存的摘要密钥，未配置时不启用降级登录
+var credentialCacheSecret = []byte(os.Getenv("CREDENTIAL_CACHE_SECRET"))
+
+// authFallbackEnabled 是否启用降级登录，默认关闭
+func authFallbackEnabled() bool {
+	return config.Handler.AuthFallback && len(credentialCacheSecret) > 0
+}
+
+// accountDigest 账号在缓存中的键，避免在redis中出现明文账号
+func accountDigest(account string) string {
+	mac := hmac.New(sha256.New, credentialCacheSecret)
+	mac.Write([]byte("account\x00" + account))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// credentialDigest 加盐的凭据摘要，只用于比对，不能还原密码
+func credentialDigest(salt []byte, account string, password string) []byte {
+	mac := hmac.New(sha256.New, credentialCacheSecret)
+	mac.Write(salt)
+	mac.Write([]byte(account + "\x00" + password))
+	return mac.Sum(nil)
+}
+
+// cacheVerifiedCredential 账号密码登录成功后缓存校验结果，失败只记录日志
+func cacheVerifiedCredential(ctx context.Context, account string, password string, userID int64) {
+	if !authFallbackEnabled() || password == "" {
+		return
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return
+	}
+	err := redisClient.StoreVerifiedCredential(ctx, accountDigest(account), map[string]string{
+		"salt":    hex.EncodeToString(salt),
+		"digest":  hex.EncodeToString(credentialDigest(salt, account, password)),
+		"user_id": strconv.FormatInt(userID, 10),
+	}, config.Handler.AuthFallbackTTL)
+	if err != nil {
+		ctxLogger(ctx).Warnf("缓存登录校验结果失败: %v", err)
+	}
+}
+
+// fallbackLogin 认证服务不可用时凭缓存的校验结果登录。只接受账号密码登录，命中时不签发jwt并标记为降级，
+// 未命中时返回 TEMPORARILY_UNAVAILABLE
+func fallbackLogin(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, int64) {
+	login := message.GetLogin()
+	unavailable := refused(pb.RefusedReason_TEMPORARILY_UNAVAILABLE)
+	if !authFallbackEnabled() || message.GetJwt() != "" || login.GetPassword() == "" {
+		metrics.Inc("login_auth_fallback_total", "result", "unsupported")
+		return unavailable, -1
+	}
+	fields, err := redisClient.GetVerifiedCredential(ctx, accountDigest(login.GetAccount()))
+	if err != nil || fields == nil {
+		metrics.Inc("login_auth_fallback_total", "result", "miss")
+		return unavailable, -1
+	}
+	salt, _ := hex.DecodeString(fields["salt"])
+	want, _ := hex.DecodeString(fields["digest"])
+	userID, parseErr := strconv.ParseInt(fields["user_id"], 10, 64)
+	got := credentialDigest(salt, login.GetAccount(), login.GetPassword())
+	if parseErr != nil || subtle.ConstantTimeCompare(got, want) != 1 {
+		// 密码与缓存不符时无法区分是密码错误还是密码已修改，按不可用处理
+		metrics.Inc("login_auth_fallback_total", "result", "mismatch")
+		return unavailable, -1
+	}
+
+	metrics.Inc("login_auth_fallback_total", "result", "hit")
+	ctxLogger(ctx).Warnf("认证服务不可用，凭缓存的校验结果降级登录: user_id=%d", userID)
+	recordAuthAudit(&audit.Event{
+		Action:  "auth_fallback_login",
+		Users:   []string{strconv.FormatInt(userID, 10)},
+		Outcome: "ok",
+	})
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Login{
+			Login: &pb.LoginRsp{
+				Result:       pb.LoginResult_LOGIN_OK,
+				UserId:       userID,
+				AuthDegraded: true,
+			},
+		},
+	}, userID
+}
+
+// recordAuthAudit 写入认证降级相关的审计记录
+func recordAuthAudit(event *audit.Event) {
+	event.Type = audit.TypeAuthFallback
+	event.Caller = identity.ContainerID()
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	if err := audit.Record(ctx, event); err != nil {
+		metrics.Inc("audit_write_errors_total", "action", event.Action)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	auth "Betterfly2/proto/server_rpc/auth"
+	"context"
+	"crypto/rand"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/grpcClient"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrLookupUnsupported 账号后端不支持该项查询
+var ErrLookupUnsupported = errors.New("账号后端不支持该查询")
+
+// AccountDirectory 注册前查询账号名/邮箱是否已被占用的账号后端
+type AccountDirectory interface {
+	UsernameTaken(ctx context.Context, username string) (bool, error)
+	EmailTaken(ctx context.Context, email string) (bool, error)
+}
+
+// SetAccountDirectory 替换用户名与邮箱的查询后端，默认通过认证服务查询，需在服务启动之前调用
+func (s *Server) SetAccountDirectory(d AccountDirectory) {
+	s.directory = d
+}
+
+// SetAccountDirectory 替换默认实例的查询后端。
+//
+// Deprecated: 使用 Default().SetAccountDirectory
+func SetAccountDirectory(d AccountDirectory) {
+	defaultServer.SetAccountDirectory(d)
+}
+
+const (
+	maxUsernameLen       = 50 // 与数据库中账号字段长度一致
+	maxSuggestions       = 3
+	maxSuggestionAttempt = 8
+)
+
+// handleCheckAvailability 注册前检查账号名/邮箱是否可用。
+// 账号名返回是否被占用及推荐候选；邮箱默认只校验格式，不透露是否已注册
+func handleCheckAvailability(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	req := message.GetCheckAvailability()
+	rsp := &pb.CheckAvailabilityRsp{}
+
+	if username := req.GetUsername(); username != "" {
+		rsp.Username = client.server.usernameAvailability(ctx, username)
+		if rsp.Username == pb.Availability_TAKEN {
+			rsp.Suggestions = client.server.suggestUsernames(ctx, username)
+		}
+	}
+	if email := req.GetEmail(); email != "" {
+		rsp.Email = client.server.emailAvailability(ctx, email)
+	}
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_CheckAvailability{
+			CheckAvailability: rsp,
+		},
+	}, nil
+}
+
+// usernameAvailability 检查账号名格式及是否被占用，查询失败时返回未知
+func (s *Server) usernameAvailability(ctx context.Context, username string) pb.Availability {
+	if !validUsername(username) {
+		return pb.Availability_INVALID
+	}
+	taken, err := cachedLookup(ctx, "username", username, s.directory.UsernameTaken)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询账号名可用性失败: %v", err)
+		return pb.Availability_AVAILABILITY_UNKNOWN
+	}
+	if taken {
+		return pb.Availability_TAKEN
+	}
+	return pb.Availability_AVAILABLE
+}
+
+// emailAvailability 检查邮箱格式，开启 VagueEmailAvailability 时格式合法即返回未知
+func (s *Server) emailAvailability(ctx context.Context, email string) pb.Availability {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return pb.Availability_INVALID
+	}
+	if config.Handler.VagueEmailAvailability {
+		return pb.Availability_AVAILABILITY_UNKNOWN
+	}
+	taken, err := cachedLookup(ctx, "email", strings.ToLower(email), s.directory.EmailTaken)
+	if err != nil {
+		if !errors.Is(err, ErrLookupUnsupported) {
+			ctxLogger(ctx).Warnf("查询邮箱可用性失败: %v", err)
+		}
+		return pb.Availability_AVAILABILITY_UNKNOWN
+	}
+	if taken {
+		return pb.Availability_TAKEN
+	}
+	return pb.Availability_AVAILABLE
+}
+
+// cachedLookup 先查redis缓存，未命中再查询账号后端并缓存结果，吸收短时间内的重复检查
+func cachedLookup(ctx context.Context, kind string, value string, lookup func(context.Context, string) (bool, error)) (bool, error) {
+	taken, ok, err := redisClient.GetAvailability(ctx, kind, value)
+	if err != nil {
+		ctxLogger(ctx).Warnf("读取可用性缓存失败: %v", err)
+	} else if ok {
+		metrics.Inc("availability_lookup_total", "kind", kind, "source", "cache")
+		return taken, nil
+	}
+	taken, err = lookup(ctx, value)
+	if err != nil {
+		return false, err
+	}
+	metrics.Inc("availability_lookup_total", "kind", kind, "source", "backend")
+	if err := redisClient.CacheAvailability(ctx, kind, value, taken, config.Handler.AvailabilityCacheTTL); err != nil {
+		ctxLogger(ctx).Warnf("缓存可用性结果失败: %v", err)
+	}
+	return taken, nil
+}
+
+// suggestUsernames 为已被占用的账号名生成若干可用的候选
+func (s *Server) suggestUsernames(ctx context.Context, username string) []string {
+	var suggestions []string
+	seen := make(map[string]bool)
+	for i := 0; i < maxSuggestionAttempt && len(suggestions) < maxSuggestions; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			break
+		}
+		suffix := n.String()
+		base := username
+		if len(base)+len(suffix) > maxUsernameLen {
+			base = base[:maxUsernameLen-len(suffix)]
+		}
+		candidate := base + suffix
+		if seen[candidate] || !validUsername(candidate) {
+			continue
+		}
+		seen[candidate] = true
+		if s.usernameAvailability(ctx, candidate) == pb.Availability_AVAILABLE {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+// validUsername 账号名不能为空、不能超长、必须是合法UTF-8且不能包含空白或控制字符
+func validUsername(username string) bool {
+	if username == "" || len(username) > maxUsernameLen || !utf8.ValidString(username) {
+		return false
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// authDirectory 通过认证服务查询账号是否存在，认证服务没有邮箱信息
+type authDirectory struct{}
+
+func (authDirectory) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	rpcClient, err := grpcClient.GetAuthClient()
+	if err != nil {
+		return false, err
+	}
+	rsp, err := rpcClient.CheckAccount(ctx, &auth.CheckAccountReq{
+		Account: username,
+	})
+	if err != nil {
+		return false, err
+	}
+	if rsp.GetResult() != auth.AuthResult_OK {
+		return false, fmt.Errorf("认证服务返回 %s", rsp.GetResult())
+	}
+	return rsp.GetExists(), nil
+}
+
+func (authDirectory) EmailTaken(ctx context.Context, email string) (bool, error) {
+	return false, ErrLookupUnsupported
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+)
+
+// processBatch 按顺序处理批量请求中的每一条。每条都经过完整的中间件链，限流按条计算，
+// 结果合并为一个 BatchResponse 发送；处理函数自行发出的响应(如登录结果)照常单独发送。
+// 某条要求关闭连接(如登出)时其后的条目不再处理并返回该错误，读协程在批量响应入队之后才关闭连接，
+// 登出时由 flushAndClose 保证之前的响应先发出
+func processBatch(client *Client, batch *pb.BatchRequest, size int) error {
+	if err := checkBatchLimits(batch, size); err != nil {
+		metrics.Inc("batch_rejected_total", "reason", decodeErrorReason(err))
+		client.log().Warnf("拒绝批量请求: %v", err)
+		if err := client.Enqueue(batchRefused()); err != nil {
+			client.log().Errorf("发送拒绝响应失败: %v", err)
+		}
+		return nil
+	}
+
+	ctx := withLogger(client.ctx, client.log())
+	results := make([]*pb.BatchResult, 0, len(batch.GetEntries()))
+	var closeErr error
+	for _, entry := range batch.GetEntries() {
+		result := &pb.BatchResult{RequestId: entry.GetRequestId()}
+		results = append(results, result)
+		request := entry.GetRequest()
+		switch {
+		case closeErr != nil:
+			result.Outcome = pb.BatchOutcome_BATCH_SKIPPED
+			continue
+		case request == nil || request.GetBatch() != nil:
+			result.Outcome = pb.BatchOutcome_BATCH_REFUSED
+			result.Response = refused(pb.RefusedReason_INVALID_PAYLOAD)
+			result.Response.GetRefused().Field = "request"
+			continue
+		}
+
+		rsp, err := client.server.chain(ctx, client, request)
+		if rsp != nil {
+			result.Response = localize(rsp, client.declared().locale)
+		}
+		switch {
+		case errors.Is(err, ErrCloseConnection):
+			closeErr = err
+		case err != nil:
+			client.log().Errorf("批量请求第 %d 条处理错误: %v", len(results), err)
+			result.Outcome = pb.BatchOutcome_BATCH_FAILED
+		case rsp.GetRefused() != nil:
+			result.Outcome = pb.BatchOutcome_BATCH_REFUSED
+		}
+	}
+	metrics.Inc("batch_requests_total")
+	metrics.Add("batch_entries_total", float64(len(results)))
+
+	err := client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Batch{
+			Batch: &pb.BatchResponse{Results: results},
+		},
+	}, WithPriority(PriorityInteractive))
+	if err != nil {
+		client.log().Errorf("发送批量响应失败: %v", err)
+	}
+	return closeErr
+}
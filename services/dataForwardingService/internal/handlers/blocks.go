@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"cmp"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// 屏蔽与免打扰是两种不同的设置：
+//   - 屏蔽针对用户，是硬性的投递过滤，在 DeliverToUser/DeliverToUsers 中按 DeliveryOptions.Sender 执行，
+//     被屏蔽者的消息与事件不会到达屏蔽者的任何设备，也不会离线保存；群聊中只跳过屏蔽者本人
+//   - 免打扰针对会话，只是提醒偏好：消息照常投递，只在交给推送与离线存储计未读时生效
+
+// blockedRecipient 接收者是否屏蔽了发送者。查询失败时按未屏蔽处理，与去重失败时继续投递一致
+func blockedRecipient(ctx context.Context, recipient string, sender string) bool {
+	if sender == "" || sender == recipient {
+		return false
+	}
+	blocked, err := redisClient.IsBlocked(ctx, recipient, sender)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询用户 %s 的屏蔽列表失败，继续投递: %v", recipient, err)
+		return false
+	}
+	return blocked
+}
+
+// conversationMuted 接收者是否对会话设置了免打扰且尚未到期。查询失败时按未免打扰处理
+func conversationMuted(ctx context.Context, userID string, conv string) bool {
+	if conv == "" {
+		return false
+	}
+	until, ok, err := redisClient.GetMute(ctx, userID, conv)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询用户 %s 的免打扰设置失败: %v", userID, err)
+		return false
+	}
+	return ok && (until == 0 || until > time.Now().UnixMilli())
+}
+
+// handleSetBlock 屏蔽或取消屏蔽用户，返回屏蔽后的列表。屏蔽人数超过 MaxBlockedUsers 时拒绝
+func handleSetBlock(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	req := message.GetSetBlock()
+	target := strconv.FormatInt(req.GetUserId(), 10)
+	if target == client.userID {
+		return refused(pb.RefusedReason_INVALID_PAYLOAD), nil
+	}
+	if !req.GetBlocked() {
+		if err := redisClient.RemoveBlock(ctx, client.userID, target); err != nil {
+			return nil, fmt.Errorf("取消屏蔽失败: %w", err)
+		}
+		metrics.Inc("block_total", "action", "unblock")
+		return handleGetBlocks(ctx, client, message)
+	}
+	count, err := redisClient.AddBlock(ctx, client.userID, target)
+	if err != nil {
+		return nil, fmt.Errorf("屏蔽用户失败: %w", err)
+	}
+	if limit := config.Handler.MaxBlockedUsers; limit > 0 && count > int64(limit) {
+		// 先加后查避免并发设置时越过上限，超出时撤销本次屏蔽
+		if err := redisClient.RemoveBlock(ctx, client.userID, target); err != nil {
+			ctxLogger(ctx).Warnf("撤销超出上限的屏蔽失败: %v", err)
+		}
+		metrics.Inc("block_total", "action", "limited")
+		return refused(pb.RefusedReason_LIMIT_EXCEEDED), nil
+	}
+	metrics.Inc("block_total", "action", "block")
+	return handleGetBlocks(ctx, client, message)
+}
+
+// handleGetBlocks 返回自己屏蔽的用户，按用户ID排序
+func handleGetBlocks(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	members, err := redisClient.GetBlocks(ctx, client.userID)
+	if err != nil {
+		return nil, fmt.Errorf("查询屏蔽列表失败: %w", err)
+	}
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		if id, err := strconv.ParseInt(member, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_BlockList{
+			BlockList: &pb.BlockList{UserIds: ids},
+		},
+	}, nil
+}
+
+// handleSetMute 为会话设置或取消免打扰，返回设置后的列表。截止时刻已过的设置视为取消
+func handleSetMute(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	req := message.GetSetMute()
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	conv := conversation{IsGroup: req.GetIsGroup(), ToID: req.GetToId()}
+	until := req.GetUntilMs()
+	if req.GetMuted() && (until == 0 || until > time.Now().UnixMilli()) {
+		err = redisClient.SetMute(ctx, client.userID, conv.key(fromID), until)
+	} else {
+		err = redisClient.ClearMutes(ctx, client.userID, conv.key(fromID))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("设置免打扰失败: %w", err)
+	}
+	return handleGetMutes(ctx, client, message)
+}
+
+// handleGetMutes 返回自己设置了免打扰且尚未到期的会话，顺带清理已到期的设置
+func handleGetMutes(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	mutes, err := redisClient.GetMutes(ctx, client.userID)
+	if err != nil {
+		return nil, fmt.Errorf("查询免打扰设置失败: %w", err)
+	}
+	now := time.Now().UnixMilli()
+	list := &pb.MuteList{}
+	var expired []string
+	for key, until := range mutes {
+		conv, ok := parseConversationKey(key, fromID)
+		if !ok || (until != 0 && until <= now) {
+			expired = append(expired, key)
+			continue
+		}
+		list.Conversations = append(list.Conversations, &pb.MutedConversation{
+			IsGroup: conv.IsGroup,
+			ToId:    conv.ToID,
+			UntilMs: until,
+		})
+	}
+	if err := redisClient.ClearMutes(ctx, client.userID, expired...); err != nil {
+		ctxLogger(ctx).Warnf("清理到期的免打扰设置失败: %v", err)
+	}
+	slices.SortFunc(list.Conversations, func(a, b *pb.MutedConversation) int {
+		if a.GetIsGroup() != b.GetIsGroup() {
+			if a.GetIsGroup() {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.GetToId(), b.GetToId())
+	})
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_MuteList{
+			MuteList: list,
+		},
+	}, nil
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"crypto/rand"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/topics"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 广播受众
+const (
+	audienceAll           = "all"             // 集群内所有已登录用户
+	audienceUserIDs       = "user_ids"        // 指定用户
+	audienceLoggedInSince = "logged_in_since" // 本容器中在指定时刻之后登录的用户
+)
+
+// broadcastRequest 管理员广播请求，message_text 与 locale_map 中的文本可以使用 text/template 语法，
+// 可用变量为 .Vars(请求中的 vars)与 .Now(服务端当前时间)。locale_map 为 {语言: 文本}，服务端按接收连接的语言选取；
+// 也可以只给出 message_key，使用翻译表中的文本，vars 作为参数
+type broadcastRequest struct {
+	Audience      string            `json:"audience"`
+	UserIDs       []string          `json:"user_ids"`
+	LoggedInSince int64             `json:"logged_in_since"` // 毫秒时间戳
+	MessageText   string            `json:"message_text"`
+	LocaleMap     map[string]string `json:"locale_map"`
+	MessageKey    string            `json:"message_key"`
+	Vars          map[string]string `json:"vars"`
+	Priority      string            `json:"priority"` // control、interactive、bulk，默认 interactive
+	Receipt       *ReceiptRequest   `json:"receipt"`  // 仅 user_ids 受众支持，见 DeliveryOptions.Receipt
+}
+
+// broadcastResult 广播结果统计，全员广播时其他容器的投递结果不在统计之内
+type broadcastResult struct {
+	NoticeID   string `json:"notice_id"`
+	Targeted   int    `json:"targeted"`
+	Delivered  int    `json:"delivered"`
+	Dropped    int    `json:"dropped"`
+	Containers int    `json:"containers,omitempty"` // 全员广播转发到的其他容器数
+}
+
+// handleAdminBroadcast 向指定受众发送系统通知
+func (s *Server) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req broadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	priority, ok := parsePriority(req.Priority)
+	if !ok {
+		http.Error(w, "invalid priority", http.StatusBadRequest)
+		return
+	}
+	notice, err := buildSystemNotice(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message := &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_SystemNotice{
+			SystemNotice: notice,
+		},
+	}
+
+	result := broadcastResult{NoticeID: notice.GetNoticeId()}
+	switch req.Audience {
+	case audienceAll:
+		err = s.broadcastAll(r, message, priority, &result)
+	case audienceUserIDs:
+		if len(req.UserIDs) == 0 {
+			http.Error(w, "missing user_ids", http.StatusBadRequest)
+			return
+		}
+		outcomes := s.DeliverToUsers(r.Context(), req.UserIDs, message, DeliveryOptions{
+			Priority: priority,
+			DedupKey: "notice:" + notice.GetNoticeId(),
+			Receipt:  req.Receipt,
+		})
+		result.Targeted = len(outcomes)
+		for _, outcome := range outcomes {
+			if outcome.Result == DeliveryDropped {
+				result.Dropped++
+			} else {
+				result.Delivered++
+			}
+		}
+	case audienceLoggedInSince:
+		var userIDs []string
+		seen := make(map[string]bool)
+		for _, client := range s.clients.All() {
+			if at := client.loginAt.Load(); at > 0 && at >= req.LoggedInSince {
+				if userID, _ := client.identity(); !seen[userID] {
+					seen[userID] = true
+					userIDs = append(userIDs, userID)
+				}
+			}
+		}
+		result.Targeted = len(userIDs)
+		result.Delivered, result.Dropped = s.deliverToLocalUsers(userIDs, message, priority)
+	default:
+		http.Error(w, "invalid audience", http.StatusBadRequest)
+		return
+	}
+
+	annotateAudit(r, "notice_id", result.NoticeID)
+	annotateAudit(r, "targeted", result.Targeted)
+	annotateAudit(r, "delivered", result.Delivered)
+	annotateAudit(r, "dropped", result.Dropped)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error(), "result": result})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// broadcastAll 本容器直接投递给所有已登录用户，其他存活容器通过投递信封各自投递
+func (s *Server) broadcastAll(r *http.Request, message *pb.ResponseMessage, priority Priority, result *broadcastResult) error {
+	userIDs := s.clients.Users()
+	result.Targeted = len(userIDs)
+	result.Delivered, result.Dropped = s.deliverToLocalUsers(userIDs, message, priority)
+
+	containers, err := identity.ListContainers(r.Context())
+	if err != nil {
+		return fmt.Errorf("查询存活容器失败: %w", err)
+	}
+	data, err := EncodeWire(nil, &pb.RequestMessage{
+		Payload: &pb.RequestMessage_Delivery{
+			Delivery: &pb.Delivery{
+				Message:  message,
+				Priority: int32(priority),
+				AllLocal: true,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("投递信封序列化失败: %w", err)
+	}
+	var failed []string
+	for _, target := range containers {
+		if target == identity.ContainerID() {
+			continue
+		}
+		if err := publishMessage(r.Context(), data, topics.BuildContainerTopic(target)); err != nil {
+			failed = append(failed, target)
+			continue
+		}
+		result.Containers++
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("转发到容器 %s 失败", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// buildSystemNotice 渲染通知模板并生成通知ID
+func buildSystemNotice(req *broadcastRequest) (*pb.SystemNotice, error) {
+	if req.MessageText == "" && len(req.LocaleMap) == 0 && req.MessageKey == "" {
+		return nil, fmt.Errorf("missing message_text")
+	}
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+	data := struct {
+		Vars map[string]string
+		Now  time.Time
+	}{req.Vars, time.Now()}
+
+	render := func(name string, text string) (string, error) {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", fmt.Errorf("template %s: %w", name, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("template %s: %w", name, err)
+		}
+		return b.String(), nil
+	}
+	text, err := render("message_text", req.MessageText)
+	if err != nil {
+		return nil, err
+	}
+	localized := make(map[string]string, len(req.LocaleMap))
+	for locale, raw := range req.LocaleMap {
+		if localized[locale], err = render(locale, raw); err != nil {
+			return nil, err
+		}
+	}
+	notice := &pb.SystemNotice{
+		NoticeId:  hex.EncodeToString(idBytes),
+		Text:      text,
+		Localized: localized,
+	}
+	if req.MessageKey != "" {
+		notice.Message = systemText(req.MessageKey, req.Vars)
+	}
+	return notice, nil
+}
+
+// parsePriority 解析管理接口中的优先级名称，为空时取交互优先级
+func parsePriority(name string) (Priority, bool) {
+	if name == "" {
+		return PriorityInteractive, true
+	}
+	for p := Priority(0); p < priorityCount; p++ {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
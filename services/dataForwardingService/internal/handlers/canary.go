@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// canaryHeader 金丝雀连接握手时携带的请求头，值为本进程启动时随机生成的密钥
+const canaryHeader = "X-Canary"
+
+var (
+	canarySecret    = newCanarySecret()
+	canaryUnhealthy atomic.Bool // 连续失败次数达到阈值后置为true，/readyz 据此返回不可用
+)
+
+func newCanarySecret() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isCanaryRequest 握手请求是否来自本进程的金丝雀。
+// 金丝雀连接不计入业务指标与事件，也不受限流约束
+func isCanaryRequest(r *http.Request) bool {
+	given := r.Header.Get(canaryHeader)
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(canarySecret)) == 1
+}
+
+// CanaryHealthy 金丝雀自检是否健康，未启用金丝雀时总是健康
+func CanaryHealthy() bool {
+	return !canaryUnhealthy.Load()
+}
+
+// runCanary 每隔 CanaryInterval 通过公共端口建立一条真实连接走一遍登录、回显、自检链路，
+// 连续失败 CanaryFailureThreshold 次后标记为不健康，任一次成功即恢复
+func (s *Server) runCanary(ctx context.Context, addr net.Addr) {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		logger.Sugar().Errorf("金丝雀无法解析监听地址 %v: %v", addr, err)
+		return
+	}
+	target := "wss://" + net.JoinHostPort("127.0.0.1", port) + "/ws"
+	sugar := logger.Sugar().With("canary", target)
+	metrics.SetGauge("canary_unhealthy", 0)
+
+	ticker := time.NewTicker(config.Handler.CanaryInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.isDraining() {
+			// 排空中不接受新连接，此时的失败不代表故障
+			continue
+		}
+		start := time.Now()
+		err := canaryRound(ctx, target)
+		metrics.Observe("canary_latency_ms", float64(time.Since(start).Milliseconds()), "step", "total")
+		if err != nil {
+			failures++
+			metrics.Inc("canary_total", "result", "failure")
+			sugar.Warnf("金丝雀自检失败(连续 %d 次): %v", failures, err)
+		} else {
+			failures = 0
+			metrics.Inc("canary_total", "result", "success")
+		}
+
+		unhealthy := failures >= config.Handler.CanaryFailureThreshold
+		if canaryUnhealthy.Swap(unhealthy) != unhealthy {
+			if unhealthy {
+				sugar.Errorf("金丝雀连续 %d 次自检失败，标记为不健康", failures)
+			} else {
+				sugar.Infoln("金丝雀自检恢复正常")
+			}
+		}
+		if unhealthy {
+			metrics.SetGauge("canary_unhealthy", 1)
+		} else {
+			metrics.SetGauge("canary_unhealthy", 0)
+		}
+	}
+}
+
+// canaryRound 执行一轮自检。配置了 CANARY_ACCOUNT 时以服务账号登录并依次发送回显与链路自检，
+// 否则以游客身份只校验时间同步
+func canaryRound(ctx context.Context, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.Handler.CanaryTimeout)
+	defer cancel()
+
+	dialer := websocket.Dialer{
+		// 连接的是本机监听地址，证书签发的域名与之不符
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+		HandshakeTimeout: config.Handler.CanaryTimeout,
+	}
+	start := time.Now()
+	conn, _, err := dialer.DialContext(ctx, target, http.Header{canaryHeader: {canarySecret}})
+	if err != nil {
+		return fmt.Errorf("建立连接失败: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	_ = conn.SetWriteDeadline(deadline)
+	observeCanaryStep("connect", start)
+	canary := &canaryConn{conn: conn}
+
+	account := os.Getenv("CANARY_ACCOUNT")
+	if account == "" {
+		clientTs := time.Now().UnixMilli()
+		return canary.step("time_sync", &pb.RequestMessage{
+			Payload: &pb.RequestMessage_TimeSync{TimeSync: &pb.TimeSyncReq{ClientTs: clientTs}},
+		}, func(rsp *pb.ResponseMessage) (bool, error) {
+			return rsp.GetTimeSync().GetClientTs() == clientTs, nil
+		})
+	}
+
+	err = canary.step("login", &pb.RequestMessage{
+		Payload: &pb.RequestMessage_Login{
+			Login: &pb.LoginReq{
+				Account:  account,
+				Password: os.Getenv("CANARY_PASSWORD"),
+				DeviceId: canaryDeviceID(),
+			},
+		},
+	}, func(rsp *pb.ResponseMessage) (bool, error) {
+		login := rsp.GetLogin()
+		if login == nil {
+			return false, nil
+		}
+		if login.GetResult() != pb.LoginResult_LOGIN_OK {
+			return false, fmt.Errorf("登录结果为 %v", login.GetResult())
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	nonce := []byte(newConnID())
+	err = canary.step("echo", &pb.RequestMessage{
+		Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: nonce}},
+	}, func(rsp *pb.ResponseMessage) (bool, error) {
+		echo := rsp.GetEcho()
+		return echo != nil && !echo.GetLoopback() && bytes.Equal(echo.GetBody(), nonce), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = canary.step("loopback", &pb.RequestMessage{
+		Payload: &pb.RequestMessage_LoopbackProbe{LoopbackProbe: &pb.LoopbackProbe{Body: nonce}},
+	}, func(rsp *pb.ResponseMessage) (bool, error) {
+		echo := rsp.GetEcho()
+		return echo != nil && echo.GetLoopback() && bytes.Equal(echo.GetBody(), nonce), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return canary.step("logout", &pb.RequestMessage{
+		Payload: &pb.RequestMessage_Logout{Logout: &pb.LogoutReq{}},
+	}, func(rsp *pb.ResponseMessage) (bool, error) {
+		return rsp.GetLogoutAck() != nil, nil
+	})
+}
+
+// canaryDeviceID 金丝雀的设备ID，每个容器一个，避免多个容器的金丝雀互相挤下线
+func canaryDeviceID() string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, identity.ContainerID())
+	id = "canary-" + id
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	return id
+}
+
+// canaryConn 金丝雀使用的客户端连接
+type canaryConn struct {
+	conn *websocket.Conn
+}
+
+// step 发送请求并读取响应，直到 match 认定收到了期望的响应；期间收到的其他报文被忽略
+func (c *canaryConn) step(name string, req *pb.RequestMessage, match func(*pb.ResponseMessage) (bool, error)) error {
+	start := time.Now()
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("%s: 序列化失败: %w", name, err)
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return fmt.Errorf("%s: 发送失败: %w", name, err)
+	}
+	for {
+		_, p, err := c.conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("%s: 未在期限内收到响应: %w", name, err)
+		}
+		rsp := &pb.ResponseMessage{}
+		if err := proto.Unmarshal(p, rsp); err != nil {
+			return fmt.Errorf("%s: 响应反序列化失败: %w", name, err)
+		}
+		if refused := rsp.GetRefused(); refused != nil {
+			return fmt.Errorf("%s: 请求被拒绝: %v", name, refused.GetReason())
+		}
+		ok, err := match(rsp)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if ok {
+			observeCanaryStep(name, start)
+			return nil
+		}
+	}
+}
+
+func observeCanaryStep(step string, start time.Time) {
+	metrics.Observe("canary_latency_ms", float64(time.Since(start).Milliseconds()), "step", step)
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+)
+
+// supportedProtocolVersions 服务端支持的协议版本
+var supportedProtocolVersions = []uint32{1}
+
+// serverCapabilities 根据当前生效的配置生成登录响应中的服务端能力，调整配置后客户端下次连接即可感知
+func serverCapabilities() *pb.ServerCapabilities {
+	cfg := config.Handler
+	return &pb.ServerCapabilities{
+		MaxMessageBytes:     cfg.MaxFrameBytes,
+		HeartbeatIntervalMs: cfg.HeartbeatInterval.Milliseconds(),
+		ProtocolVersions:    supportedProtocolVersions,
+		ChunkedTransfer:     true,
+		ContainerId:         identity.ContainerID(),
+	}
+}
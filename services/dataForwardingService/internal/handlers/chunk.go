@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"crypto/rand"
+	"data_forwarding_service/config"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// chunkTransfer 单次分片传输的重组缓冲
+type chunkTransfer struct {
+	total    int32
+	received int32
+	size     int
+	parts    [][]byte
+	got      []bool
+	timer    *time.Timer
+}
+
+// chunkAssembler 每个连接独立持有的分片重组器
+type chunkAssembler struct {
+	mu        sync.Mutex
+	transfers map[string]*chunkTransfer
+}
+
+func newChunkAssembler() *chunkAssembler {
+	return &chunkAssembler{
+		transfers: make(map[string]*chunkTransfer),
+	}
+}
+
+// Add 加入一个分片，传输完成时返回拼接后的完整数据，未完成时返回nil
+func (a *chunkAssembler) Add(chunk *pb.Chunk) ([]byte, error) {
+	cfg := config.Handler
+	id := chunk.GetTransferId()
+	total := chunk.GetTotal()
+	index := chunk.GetIndex()
+	if id == "" {
+		return nil, errors.New("分片缺少传输ID")
+	}
+	if total <= 0 || total > cfg.MaxTransferChunks || index < 0 || index >= total {
+		return nil, fmt.Errorf("分片序号非法: %d/%d", index, total)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.transfers[id]
+	if !ok {
+		if len(a.transfers) >= cfg.MaxConcurrentTransfers {
+			return nil, fmt.Errorf("同时进行的分片传输超过上限 %d", cfg.MaxConcurrentTransfers)
+		}
+		t = &chunkTransfer{
+			total: total,
+			parts: make([][]byte, total),
+			got:   make([]bool, total),
+		}
+		t.timer = time.AfterFunc(cfg.ChunkTimeout, func() {
+			a.expire(id, t)
+		})
+		a.transfers[id] = t
+	} else if t.total != total {
+		a.discardLocked(id)
+		return nil, fmt.Errorf("传输 %s 分片总数不一致: %d != %d", id, total, t.total)
+	}
+
+	if t.got[index] {
+		// 重复分片直接忽略
+		return nil, nil
+	}
+	t.size += len(chunk.GetData())
+	if t.size > cfg.MaxTransferBytes {
+		a.discardLocked(id)
+		return nil, fmt.Errorf("传输 %s 超过最大大小 %d 字节", id, cfg.MaxTransferBytes)
+	}
+	t.parts[index] = chunk.GetData()
+	t.got[index] = true
+	t.received++
+
+	if t.received < t.total {
+		t.timer.Reset(cfg.ChunkTimeout)
+		return nil, nil
+	}
+
+	t.timer.Stop()
+	delete(a.transfers, id)
+	data := make([]byte, 0, t.size)
+	for _, part := range t.parts {
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+// expire 不活跃超时后丢弃未完成的传输
+func (a *chunkAssembler) expire(id string, t *chunkTransfer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cur, ok := a.transfers[id]; ok && cur == t {
+		delete(a.transfers, id)
+		logger.Sugar().Warnf("分片传输 %s 超时，已接收 %d/%d，丢弃", id, t.received, t.total)
+	}
+}
+
+func (a *chunkAssembler) discardLocked(id string) {
+	if t, ok := a.transfers[id]; ok {
+		t.timer.Stop()
+		delete(a.transfers, id)
+	}
+}
+
+// Close 连接关闭时丢弃所有未完成的传输
+func (a *chunkAssembler) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id := range a.transfers {
+		a.discardLocked(id)
+	}
+}
+
+// newTransferID 生成随机传输ID
+func newTransferID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SplitIntoChunks 将数据按size切分为分片
+func SplitIntoChunks(data []byte, size int) []*pb.Chunk {
+	if size <= 0 {
+		size = len(data)
+	}
+	id := newTransferID()
+	total := (len(data) + size - 1) / size
+	chunks := make([]*pb.Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, &pb.Chunk{
+			TransferId: id,
+			Index:      int32(i),
+			Total:      int32(total),
+			Data:       data[i*size : end],
+		})
+	}
+	return chunks
+}
+
+// SendLargeMessage 向默认实例中的用户发送可能分片的消息。
+//
+// Deprecated: 使用 Default().SendLargeMessage
+func SendLargeMessage(userID string, env *Envelope) error {
+	return defaultServer.SendLargeMessage(userID, env)
+}
+
+// SendLargeMessage 外部发送消息接口，超过阈值且客户端支持分片时拆分为多个Chunk，以批量优先级发送
+func (s *Server) SendLargeMessage(userID string, env *Envelope) error {
+	userClients := s.clients.UserClients(userID)
+	if len(userClients) == 0 {
+		return fmt.Errorf("客户端%v不存在", userID)
+	}
+	frame, err := s.prepareOutbound(userID, env)
+	if err != nil || frame == nil {
+		return err
+	}
+
+	cfg := config.Handler
+	// 按连接语言缓存切分结果，同一语言的连接共用
+	chunkFrames := make(map[string][][]byte)
+	for _, client := range userClients {
+		if !client.subscribedTo(frame.message) {
+			continue
+		}
+		message := frame.bytesFor(client)
+		profile := client.declared()
+		if len(message) <= cfg.ChunkThreshold || !profile.chunking {
+			_ = client.Enqueue(frame.message, withEncoded(message), WithPriority(env.Priority), WithTTL(frame.ttl), withTiming(frame.timing))
+			continue
+		}
+		chunks, ok := chunkFrames[profile.locale]
+		if !ok {
+			chunks, err = buildChunkFrames(message, cfg.ChunkSize)
+			if err != nil {
+				return err
+			}
+			chunkFrames[profile.locale] = chunks
+		}
+		for i, chunk := range chunks {
+			opts := []EnqueueOption{withEncoded(chunk), WithPriority(PriorityBulk)}
+			if i == len(chunks)-1 {
+				// 最后一片写出时客户端才能重组出完整消息
+				opts = append(opts, withTiming(frame.timing))
+			}
+			if err := client.Enqueue(nil, opts...); err != nil {
+				// 缺少任何一片都无法重组，剩余分片不再发送
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// buildChunkFrames 将消息切分并序列化为多个Chunk响应帧
+func buildChunkFrames(message []byte, size int) ([][]byte, error) {
+	chunks := SplitIntoChunks(message, size)
+	frames := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		rsp := &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_Chunk{
+				Chunk: chunk,
+			},
+		}
+		rspBytes, err := proto.Marshal(rsp)
+		if err != nil {
+			return nil, fmt.Errorf("分片序列化失败: %w", err)
+		}
+		frames = append(frames, rspBytes)
+	}
+	return frames, nil
+}
+
+// handleChunk 处理入站分片，重组完成后作为一条完整消息重新走一遍中间件链
+func handleChunk(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	data, err := client.transfers.Add(message.GetChunk())
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	requestMsg, err := HandleRequestData(data)
+	if err != nil {
+		return nil, fmt.Errorf("分片重组后数据非法: %w", err)
+	}
+	if requestMsg.GetChunk() != nil {
+		return nil, errors.New("分片内不允许嵌套分片")
+	}
+	return client.server.chain(ctx, client, requestMsg)
+}
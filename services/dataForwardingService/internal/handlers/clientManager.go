@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"maps"
+	"sync"
+)
+
+var (
+	// ErrKeyOccupied 目标键已被另一个仍存活的连接占用
+	ErrKeyOccupied = errors.New("连接键已被占用")
+	// ErrClientClosed 连接已关闭，不能再加入
+	ErrClientClosed = errors.New("连接已关闭")
+)
+
+// clientMapMinPeak 历史峰值低于该值的 map 不压缩，重建小 map 得不偿失
+const clientMapMinPeak = 1024
+
+// ClientManager 管理本容器的所有连接，同一把锁同时保护 pending、clients 与 userDevices，
+// 任意时刻每个连接恰好对应一个键。未登录连接单独保存在 pending 中，扫描器建连即断开的抖动不会触及已登录连接的登记表
+type ClientManager struct {
+	mu          sync.Mutex
+	pending     map[string]*Client            // {ip:port: 客户端}，尚未登录的连接
+	clients     map[string]*Client            // {用户ID#设备ID: 客户端}
+	userDevices map[string]map[string]*Client // {用户ID: {设备ID: 客户端}}
+
+	pendingPeak int // pending 自上次重建以来的最大条目数
+	clientsPeak int
+}
+
+func NewClientManager() *ClientManager {
+	return &ClientManager{
+		pending:     make(map[string]*Client),
+		clients:     make(map[string]*Client),
+		userDevices: make(map[string]map[string]*Client),
+	}
+}
+
+// compactMap 存活条目低于历史峰值的 ClientMapCompactBelow% 时按当前大小重建 map 并重置峰值。
+// Go 的 map 删除条目后不会收缩，大量连接建立又断开后桶数组仍保持峰值大小；低占用时重建的代价很小，在锁内完成
+func compactMap[V any](name string, m map[string]V, peak *int) map[string]V {
+	below := config.Handler.ClientMapCompactBelow
+	if below <= 0 || *peak < clientMapMinPeak || len(m)*100 >= *peak*below {
+		return m
+	}
+	rebuilt := make(map[string]V, len(m))
+	maps.Copy(rebuilt, m)
+	*peak = len(m)
+	metrics.Inc("client_map_compactions_total", "map", name)
+	return rebuilt
+}
+
+// addLocked 保存连接，调用方需持有 mu
+func (m *ClientManager) addLocked(key string, client *Client) {
+	client.key = key
+	if client.userID == "" {
+		m.pending[key] = client
+		m.pendingPeak = max(m.pendingPeak, len(m.pending))
+		return
+	}
+	m.clients[key] = client
+	m.clientsPeak = max(m.clientsPeak, len(m.clients))
+	devices, ok := m.userDevices[client.userID]
+	if !ok {
+		devices = make(map[string]*Client)
+		m.userDevices[client.userID] = devices
+	}
+	devices[client.deviceID] = client
+}
+
+// removeLocked 删除连接，只删除仍指向该client的条目，避免误删同设备的新连接，调用方需持有 mu
+func (m *ClientManager) removeLocked(client *Client) {
+	if client.userID == "" {
+		if cur, ok := m.pending[client.key]; ok && cur == client {
+			delete(m.pending, client.key)
+			m.pending = compactMap("pending", m.pending, &m.pendingPeak)
+		}
+		return
+	}
+	if cur, ok := m.clients[client.key]; ok && cur == client {
+		delete(m.clients, client.key)
+		m.clients = compactMap("clients", m.clients, &m.clientsPeak)
+	}
+	if devices, ok := m.userDevices[client.userID]; ok {
+		if cur, ok := devices[client.deviceID]; ok && cur == client {
+			delete(devices, client.deviceID)
+		}
+		if len(devices) == 0 {
+			delete(m.userDevices, client.userID)
+		}
+	}
+}
+
+// Add 以未登录的临时键保存新连接
+func (m *ClientManager) Add(key string, client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addLocked(key, client)
+}
+
+// Remove 删除连接并标记为已关闭，之后的 Rename 会失败。
+// 返回该连接删除前是否仍是其设备的登记连接(已被新连接替换时为false)
+func (m *ClientManager) Remove(client *Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	registered := client.userID != "" && m.userDevices[client.userID][client.deviceID] == client
+	m.removeLocked(client)
+	client.removed = true
+	return registered
+}
+
+// Rename 在同一把锁内将连接从 oldKey 换到 newKey(用户ID#设备ID)，并填充连接的用户与设备。
+// newKey 已被另一个连接占用时返回该连接与 ErrKeyOccupied，由调用方踢下线后重试
+func (m *ClientManager) Rename(oldKey string, newKey string, client *Client) (*Client, error) {
+	userID, deviceID, ok := redisClient.SplitDeviceKey(newKey)
+	if !ok {
+		return nil, errors.New("连接键格式错误: " + newKey)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client.removed {
+		return nil, ErrClientClosed
+	}
+	if cur, ok := m.clients[newKey]; ok && cur != client {
+		return cur, ErrKeyOccupied
+	}
+	if client.key == oldKey {
+		m.removeLocked(client)
+	}
+	client.userID = userID
+	client.deviceID = deviceID
+	m.addLocked(newKey, client)
+	return nil, nil
+}
+
+// Identity 在锁内复制连接当前的键、用户与设备。Rename 在同一把锁内修改它们，不持有锁的调用方应通过它读取
+func (m *ClientManager) Identity(client *Client) (key string, userID string, deviceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return client.key, client.userID, client.deviceID
+}
+
+// identity 经连接表的锁读取连接当前的用户与设备，供读协程以外的写协程、投递方与管理接口使用
+func (c *Client) identity() (userID string, deviceID string) {
+	_, userID, deviceID = c.server.clients.Identity(c)
+	return userID, deviceID
+}
+
+// UserClients 获取用户在本容器的所有设备连接
+func (m *ClientManager) UserClients(userID string) []*Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := m.userDevices[userID]
+	result := make([]*Client, 0, len(devices))
+	for _, client := range devices {
+		result = append(result, client)
+	}
+	return result
+}
+
+// DeviceClient 获取用户某设备在本容器的连接
+func (m *ClientManager) DeviceClient(userID string, deviceID string) (*Client, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.userDevices[userID][deviceID]
+	return client, ok
+}
+
+// All 获取所有连接(含未登录)的快照
+func (m *ClientManager) All() []*Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*Client, 0, len(m.pending)+len(m.clients))
+	for _, client := range m.pending {
+		result = append(result, client)
+	}
+	for _, client := range m.clients {
+		result = append(result, client)
+	}
+	return result
+}
+
+// Users 本容器所有已登录用户的ID
+func (m *ClientManager) Users() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]string, 0, len(m.userDevices))
+	for userID := range m.userDevices {
+		result = append(result, userID)
+	}
+	return result
+}
+
+// Len 当前连接数(含未登录)
+func (m *ClientManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.pending) + len(m.clients)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// scanStorm 模拟扫描器：n 个连接以未登录的临时键加入后立即断开
+func scanStorm(m *ClientManager, n int) {
+	for i := 0; i < n; i++ {
+		client := &Client{}
+		m.Add("10.0.0.1:"+strconv.Itoa(i), client)
+		m.Remove(client)
+	}
+}
+
+// 扫描风暴之后 pending 按当前大小重建，已登录连接的登记表不受影响
+func TestClientMapCompactsAfterScanStorm(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ClientMapCompactBelow = 25 })
+	m := NewClientManager()
+	stay := &Client{}
+	m.Add("10.0.0.2:1", stay)
+	clients := reflect.ValueOf(m.clients).UnsafePointer()
+
+	// 峰值只有1，逐个加入又删除不触发重建
+	scanStorm(m, 4*clientMapMinPeak)
+	if m.pendingPeak > 2 {
+		t.Fatalf("逐个断开时峰值为 %d", m.pendingPeak)
+	}
+
+	// 同时在线的连接达到峰值后断开，存活条目低于峰值的25%时重建
+	storm := make([]*Client, 4*clientMapMinPeak)
+	for i := range storm {
+		storm[i] = &Client{}
+		m.Add("10.0.0.3:"+strconv.Itoa(i), storm[i])
+	}
+	before := reflect.ValueOf(m.pending).UnsafePointer()
+	for _, client := range storm {
+		m.Remove(client)
+	}
+	if reflect.ValueOf(m.pending).UnsafePointer() == before {
+		t.Fatal("扫描风暴之后 pending 没有重建")
+	}
+	if m.pendingPeak > clientMapMinPeak {
+		t.Fatalf("重建后峰值为 %d，没有按当前大小重置", m.pendingPeak)
+	}
+	if m.Len() != 1 || m.All()[0] != stay {
+		t.Fatalf("重建丢失了仍在线的连接: %d", m.Len())
+	}
+	if reflect.ValueOf(m.clients).UnsafePointer() != clients {
+		t.Fatal("未登录连接的抖动重建了已登录连接的登记表")
+	}
+}
+
+// 扫描风暴之后连接表常驻的内存：不重建时 map 保持峰值大小，重建后回到与存活连接数相称的大小
+func BenchmarkClientMapAfterScanStorm(b *testing.B) {
+	const (
+		storm = 100000
+		live  = 100
+	)
+	for _, c := range []struct {
+		name  string
+		below int
+	}{
+		{"no-compaction", 0},
+		{"compaction", 25},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			saved := *config.Handler
+			config.Handler.ClientMapCompactBelow = c.below
+			b.Cleanup(func() { *config.Handler = saved })
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				m := NewClientManager()
+				clients := make([]*Client, storm)
+				for j := range clients {
+					clients[j] = &Client{}
+					m.Add("10.0.0.1:"+strconv.Itoa(j), clients[j])
+				}
+				for j := live; j < storm; j++ {
+					m.Remove(clients[j])
+				}
+				// 只保留仍在线的连接，断开的连接可以被回收
+				clients = append([]*Client(nil), clients[:live]...)
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "retained-bytes")
+				runtime.KeepAlive(m)
+				runtime.KeepAlive(clients)
+			}
+		})
+	}
+}
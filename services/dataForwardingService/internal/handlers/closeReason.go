@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// CloseReason 连接断开原因
+type CloseReason string
+
+const (
+	ClosePeerClosed          CloseReason = "peer_closed"         // 客户端主动关闭
+	ClosePeerLogout          CloseReason = "peer_logout"         // 客户端登出
+	CloseReadError           CloseReason = "read_error"          // 读取失败
+	CloseWriteError          CloseReason = "write_error"         // 写入失败
+	CloseEvictedConflict     CloseReason = "evicted_conflict"    // 同一设备在别处登录被顶下线
+	CloseKickedAdmin         CloseReason = "kicked_admin"        // 管理员踢下线
+	CloseIdleTimeout         CloseReason = "idle_timeout"        // 空闲超时
+	CloseSlowConsumer        CloseReason = "slow_consumer"       // 客户端接收过慢
+	CloseAuthTimeout         CloseReason = "auth_timeout"        // 未在规定时间内登录
+	CloseServerDrain         CloseReason = "server_drain"        // 容器排空
+	CloseRegistrationFailed  CloseReason = "registration_failed" // 降级登录后未能在时限内完成redis登记
+	CloseAccountDeleted      CloseReason = "account_deleted"     // 账号已注销
+	CloseLoggedOutEverywhere CloseReason = "logout_all"          // 用户退出所有设备或修改了密码
+	CloseFaultInjected       CloseReason = "fault_injected"      // 故障注入模拟的断线，不发送关闭帧
+	CloseProtocolError       CloseReason = "protocol_error"      // 客户端多次发送与协商编码不符或无法解析的帧
+	CloseSessionExpired      CloseReason = "session_expired"     // 登录所用的访问令牌已过期，需取得新令牌后重连
+	CloseMemoryPressure      CloseReason = "memory_pressure"     // 容器内存接近上限，按类别断开部分连接
+)
+
+// Valid 是否为上面定义的断开原因，校验控制命令等外部传入的原因
+func (r CloseReason) Valid() bool {
+	switch r {
+	case ClosePeerClosed, ClosePeerLogout, CloseReadError, CloseWriteError, CloseEvictedConflict, CloseKickedAdmin,
+		CloseIdleTimeout, CloseSlowConsumer, CloseAuthTimeout, CloseServerDrain, CloseRegistrationFailed,
+		CloseAccountDeleted, CloseLoggedOutEverywhere, CloseFaultInjected, CloseProtocolError, CloseSessionExpired,
+		CloseMemoryPressure:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeCode 返回服务端主动关闭时发给客户端的关闭码，客户端侧或传输错误导致的断开不发送关闭帧
+func (r CloseReason) closeCode() (int, bool) {
+	switch r {
+	case CloseEvictedConflict, CloseKickedAdmin, CloseAccountDeleted, CloseLoggedOutEverywhere, CloseSessionExpired:
+		return websocket.ClosePolicyViolation, true
+	case CloseIdleTimeout, CloseAuthTimeout, ClosePeerLogout:
+		return websocket.CloseNormalClosure, true
+	case CloseProtocolError:
+		return websocket.CloseProtocolError, true
+	case CloseSlowConsumer, CloseRegistrationFailed, CloseMemoryPressure:
+		return websocket.CloseTryAgainLater, true
+	case CloseServerDrain:
+		return websocket.CloseGoingAway, true
+	default:
+		return 0, false
+	}
+}
+
+// expectsReconnect 服务端原因导致的断开，客户端应在退避后重连
+func (r CloseReason) expectsReconnect() bool {
+	switch r {
+	case CloseSlowConsumer, CloseRegistrationFailed, CloseServerDrain, CloseMemoryPressure:
+		return true
+	default:
+		return false
+	}
+}
+
+// detachClient 从本地连接表移除连接。只有仍登记在本地的连接才需要注销redis，已被新连接替换的不能误删新登记。
+// 同一设备的新连接可能在移除之后、注销之前写入登记，redis中的登记只记录容器，无法区分新旧连接，
+// 因此注销之后再检查一次：新连接写入登记之前已开始登录切换，保存到连接表之后才结束切换，
+// 看到二者之一时说明注销可能删除了新连接的登记，重新写入
+func detachClient(client *Client) {
+	s := client.server
+	if !s.clients.Remove(client) {
+		return
+	}
+	// 连接上下文可能已取消，注销使用独立的超时
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	containerID := identity.ContainerID()
+	if err := redisClient.UnregisterConnection(ctx, client.userID, client.deviceID, containerID); err != nil {
+		client.log().Warnf("注销 Redis 失败: %v", err)
+		return
+	}
+	if client.userID == "" {
+		return
+	}
+	_, replaced := s.clients.DeviceClient(client.userID, client.deviceID)
+	if replaced || s.inTransition(client.userID, client.deviceID) {
+		metrics.Inc("registration_restored_total")
+		if err := redisClient.RegisterConnection(ctx, client.userID, client.deviceID, containerID); err != nil {
+			client.log().Warnf("恢复新连接的 Redis 登记失败: %v", err)
+		}
+	}
+}
+
+// Close 统一的连接清理入口：关闭socket、取消连接上下文(写协程据此停止写入)并从连接表移除。
+// 所有断开路径(外部踢下线、冲突驱逐、排空、读写出错)都调用它，可并发重复调用，只有第一次生效，
+// 读协程退出时还会再调用一次，此时若已由其他路径关闭则不会覆盖原因
+func (c *Client) Close(reason CloseReason) {
+	c.closeOnce.Do(func() {
+		sugar := c.log()
+		c.closeReason = reason
+
+		if code, ok := reason.closeCode(); ok {
+			frame := websocket.FormatCloseMessage(code, closeText(reason))
+			_ = c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second))
+		}
+		c.conn.Close()
+		c.cancel()
+
+		detachClient(c)
+		key, userID, deviceID := c.server.clients.Identity(c)
+
+		if !c.synthetic {
+			c.server.publishEvent(ClientDisconnected{
+				ConnID:     c.connID,
+				RemoteAddr: c.conn.RemoteAddr().String(),
+				UserID:     userID,
+				DeviceID:   deviceID,
+				Reason:     reason,
+				At:         time.Now(),
+			})
+			metrics.Inc("disconnect_total", "reason", string(reason))
+		}
+		sugar.Infof("(%v, %v)连接已关闭，原因: %s", key, c.conn.RemoteAddr(), reason)
+	})
+}
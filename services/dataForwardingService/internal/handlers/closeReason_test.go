@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/redis"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 所有断开路径并发执行：管理员踢下线、同设备重新登录的冲突驱逐、排空、客户端挂断与直接 Close。
+// 旧连接只清理一次，不会误删新连接的登记。需在 -race 下运行
+func TestConcurrentTeardownPaths(t *testing.T) {
+	withRedis(t)
+	// 每轮同一设备登录两次，关闭登录抑制
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.LoginDampMax = 0 })
+	userID := strconv.Itoa(memoryUserIDBase)
+	deviceKey := redisClient.DeviceKey(userID, "phone")
+	login := &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: "alice", Password: "pw", DeviceId: "phone"}}}
+	isLogin := func(rsp *pb.ResponseMessage) bool { return rsp.GetLogin() != nil }
+
+	for round := 0; round < 10; round++ {
+		s := NewServer()
+		s.SetAccountService(NewMemoryAccountService(NewAccount{Account: "alice", Password: "pw"}))
+		sub := s.Subscribe("test", 64)
+		old := dialServer(t, s)
+		sendRequest(t, old, login)
+		if rsp := readUntil(t, old, isLogin).GetLogin(); rsp.GetResult() != pb.LoginResult_LOGIN_OK {
+			t.Fatalf("登录失败: %v", rsp)
+		}
+		client, ok := s.clients.DeviceClient(userID, "phone")
+		if !ok {
+			t.Fatal("登录后连接未登记")
+		}
+		replacement := dialServer(t, s)
+
+		var wg sync.WaitGroup
+		paths := []func(){
+			func() { s.StopClient(deviceKey, CloseKickedAdmin) },
+			func() { s.StopClient(userID, CloseKickedAdmin) },
+			func() { client.Close(CloseEvictedConflict) },
+			func() { client.Close(CloseReadError) },
+			func() { old.Close() },
+			func() { sendRequest(t, replacement, login) },
+		}
+		if round%2 == 1 {
+			paths = append(paths, func() { s.StartDrain(context.Background(), time.Millisecond, "") })
+		}
+		for _, path := range paths {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path()
+			}()
+		}
+		wg.Wait()
+		waitFor(t, "旧连接退出", func() bool {
+			select {
+			case <-client.writerDone:
+				return true
+			default:
+				return false
+			}
+		})
+
+		disconnects := 0
+		for len(sub.C) > 0 {
+			if e, ok := (<-sub.C).(ClientDisconnected); ok && e.ConnID == client.connID {
+				disconnects++
+			}
+		}
+		if disconnects != 1 {
+			t.Fatalf("第 %d 轮: 旧连接发布了 %d 次断开事件", round, disconnects)
+		}
+		if current, ok := s.clients.DeviceClient(userID, "phone"); ok && current == client {
+			t.Fatalf("第 %d 轮: 旧连接仍在连接表中", round)
+		}
+
+		// 未排空时新连接登录成功，其登记不能被旧连接的清理删除。
+		// 新连接先于踢下线完成登记时会被一并踢掉，此时不再检查
+		if round%2 == 0 {
+			if rsp := readUntil(t, replacement, isLogin).GetLogin(); rsp.GetResult() != pb.LoginResult_LOGIN_OK {
+				t.Fatalf("第 %d 轮: 新连接登录失败: %v", round, rsp)
+			}
+			if _, ok := s.clients.DeviceClient(userID, "phone"); !ok {
+				replacement.Close()
+				continue
+			}
+			devices, err := redisClient.GetUserDevices(context.Background(), userID)
+			if _, registered := devices["phone"]; err != nil || !registered {
+				t.Fatalf("第 %d 轮: 新连接的redis登记被删除: %v %v", round, devices, err)
+			}
+		}
+		replacement.Close()
+		waitFor(t, "连接表清空", func() bool { return s.clients.Len() == 0 })
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"crypto/rand"
+	"data_forwarding_service/internal/logsample"
+	"encoding/hex"
+	"go.uber.org/zap"
+)
+
+// newConnID 生成短随机连接ID，用于在日志中区分会话
+func newConnID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// log 连接专属日志，带有 conn_id、remote_addr、container，登录后追加 user_id、device_id
+func (c *Client) log() *zap.SugaredLogger {
+	if l := c.sugar.Load(); l != nil {
+		return l
+	}
+	return logger.Sugar()
+}
+
+// bindUserLogger 登录成功后为连接日志追加用户字段
+func (c *Client) bindUserLogger(userID string, deviceID string) {
+	c.sugar.Store(c.log().With("user_id", userID, "device_id", deviceID))
+}
+
+// logLoginResult 按采样输出登录、注册的处理结果。响应只在日志确实输出时才转成字符串
+func logLoginResult(sugar *zap.SugaredLogger, rsp *pb.ResponseMessage, err error) {
+	if logsample.Allow(logsample.Login, err) {
+		sugar.Infof("rsp: %v", rsp)
+	}
+}
+
+type loggerCtxKey struct{}
+
+// withLogger 将连接日志放入 ctx，供拿不到 Client 的下游函数使用
+func withLogger(ctx context.Context, l *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, l)
+}
+
+// ctxLogger 取出 ctx 中的连接日志，没有时返回全局日志
+func ctxLogger(ctx context.Context) *zap.SugaredLogger {
+	if l, ok := ctx.Value(loggerCtxKey{}).(*zap.SugaredLogger); ok {
+		return l
+	}
+	return logger.Sugar()
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"testing"
+)
+
+// discardClient 日志按线上的控制台格式编码后丢弃的连接，基准测试包含格式化与编码的开销
+func discardClient() *Client {
+	encoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	core := zapcore.NewCore(encoder, zapcore.AddSync(io.Discard), zapcore.DebugLevel)
+	client := &Client{}
+	client.sugar.Store(zap.New(core).Sugar())
+	return client
+}
+
+// samplingRates 基准测试对比的采样率：全部输出与每100条输出1条
+var samplingRates = []struct {
+	name  string
+	every int
+}{
+	{"all", 1},
+	{"1in100", 100},
+}
+
+// 每条报文经过 LoggingMiddleware 的开销
+func BenchmarkMessageLogging(b *testing.B) {
+	client := discardClient()
+	handler := LoggingMiddleware(func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		return nil, nil
+	})
+	message := &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "hello"}}}
+	for _, rate := range samplingRates {
+		b.Run(rate.name, func(b *testing.B) {
+			withSampling(b, rate.every)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = handler(context.Background(), client, message)
+			}
+		})
+	}
+}
+
+// 每次登录输出处理结果的开销，响应转成字符串是主要的分配来源
+func BenchmarkLoginLogging(b *testing.B) {
+	sugar := discardClient().log()
+	rsp := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Login{Login: &pb.LoginRsp{
+		Result:      pb.LoginResult_LOGIN_OK,
+		UserId:      10001,
+		ResumeToken: "0123456789abcdef0123456789abcdef",
+	}}}
+	for _, rate := range samplingRates {
+		b.Run(rate.name, func(b *testing.B) {
+			withSampling(b, rate.every)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logLoginResult(sugar, rsp, nil)
+			}
+		})
+	}
+}
+
+func withSampling(b *testing.B, every int) {
+	saved := *config.Handler
+	config.Handler.LogSampleEvery = every
+	config.Handler.LogSampleRates = nil
+	b.Cleanup(func() { *config.Handler = saved })
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// connectInfo /connect-info 的响应。客户端在首次连接与每次重连前请求，按顺序尝试 urls
+type connectInfo struct {
+	URLs                []string `json:"urls"`
+	HeartbeatIntervalMs int64    `json:"heartbeat_interval_ms"`
+	ProtocolVersions    []uint32 `json:"protocol_versions"`
+	Degraded            bool     `json:"degraded,omitempty"` // 未能读取各容器负载，返回的是默认地址
+}
+
+// connectSnapshot 定期刷新的 /connect-info 快照，请求时直接返回，不访问redis
+var connectSnapshot atomic.Pointer[connectInfo]
+
+// defaultConnectInfo 无可用容器或redis不可用时的响应
+func defaultConnectInfo() *connectInfo {
+	info := &connectInfo{
+		HeartbeatIntervalMs: config.Handler.HeartbeatInterval.Milliseconds(),
+		ProtocolVersions:    supportedProtocolVersions,
+		Degraded:            true,
+	}
+	if url := config.Handler.ConnectDefaultURL; url != "" {
+		info.URLs = []string{url}
+	}
+	return info
+}
+
+// pickConnectURLs 按连接数从低到高选出未排空容器的地址，连接数相同的容器随机排列以分散新连接
+func pickConnectURLs(loads []redisClient.ContainerLoad, limit int) []string {
+	candidates := make([]redisClient.ContainerLoad, 0, len(loads))
+	for _, load := range loads {
+		if load.Draining || load.URL == "" {
+			continue
+		}
+		candidates = append(candidates, load)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Connections < candidates[j].Connections
+	})
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	urls := make([]string, len(candidates))
+	for i, load := range candidates {
+		urls[i] = load.URL
+	}
+	return urls
+}
+
+// refreshConnectInfo 上报本容器负载并重新生成快照，redis出错时退回默认地址
+func (s *Server) refreshConnectInfo(ctx context.Context) {
+	cfg := config.Handler
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectInfoRefresh)
+	defer cancel()
+	if cfg.PublicURL != "" {
+		if err := redisClient.ReportContainerLoad(ctx, identity.ContainerID(), cfg.PublicURL, s.clients.Len(), 3*cfg.ConnectInfoRefresh); err != nil {
+			logger.Sugar().Warnf("上报容器负载失败: %v", err)
+		}
+	}
+	loads, err := redisClient.ListContainerLoads(ctx)
+	if err != nil {
+		metrics.Inc("connect_info_refresh_total", "result", "error")
+		logger.Sugar().Warnf("读取容器负载失败，/connect-info 退回默认地址: %v", err)
+		connectSnapshot.Store(defaultConnectInfo())
+		return
+	}
+	urls := pickConnectURLs(loads, cfg.ConnectInfoMaxURLs)
+	if len(urls) == 0 {
+		metrics.Inc("connect_info_refresh_total", "result", "empty")
+		connectSnapshot.Store(defaultConnectInfo())
+		return
+	}
+	metrics.Inc("connect_info_refresh_total", "result", "ok")
+	connectSnapshot.Store(&connectInfo{
+		URLs:                urls,
+		HeartbeatIntervalMs: cfg.HeartbeatInterval.Milliseconds(),
+		ProtocolVersions:    supportedProtocolVersions,
+	})
+}
+
+// handleConnectInfo GET /connect-info，公共端口上无需认证
+func handleConnectInfo(w http.ResponseWriter, r *http.Request) {
+	info := connectSnapshot.Load()
+	if info == nil {
+		info = defaultConnectInfo()
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(config.Handler.ConnectInfoRefresh/time.Second)))
+	writeJSON(w, http.StatusOK, info)
+}
+
+// ConnectDirector 定期上报本容器负载并刷新 /connect-info 快照的组件。
+//
+// Deprecated: 使用 Default().ConnectDirector
+func ConnectDirector() lifecycle.Component {
+	return defaultServer.ConnectDirector()
+}
+
+// ConnectDirector 定期上报本容器负载并刷新 /connect-info 快照
+func (s *Server) ConnectDirector() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name:      "connect_director",
+		DependsOn: []string{"identity", "websocket_server"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			s.refreshConnectInfo(ctx)
+			go func() {
+				ticker := time.NewTicker(config.Handler.ConnectInfoRefresh)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						s.refreshConnectInfo(ctx)
+					}
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
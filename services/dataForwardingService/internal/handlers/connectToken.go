@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectClaims 连接授权令牌内容。令牌由已完成HTTP认证的API后端签发，放在 /ws 的 auth_token 参数中，
+// 连接升级后直接进入登录状态，不再走带内登录
+type connectClaims struct {
+	UserID    string `json:"u"`
+	DeviceID  string `json:"d"`
+	TokenID   string `json:"j"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// connectSecret 与API后端共享的签名密钥，未配置时不接受连接授权令牌
+var connectSecret = []byte(os.Getenv("CONNECT_TOKEN_SECRET"))
+
+func signConnectPayload(payload string) string {
+	mac := hmac.New(sha256.New, connectSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueConnectToken 签发一次性连接授权令牌，格式为 base64(claims).base64(HMAC-SHA256)，供API后端生成连接地址
+func IssueConnectToken(userID string, deviceID string, ttl time.Duration) (string, error) {
+	if len(connectSecret) == 0 {
+		return "", errors.New("未配置 CONNECT_TOKEN_SECRET")
+	}
+	idBytes := make([]byte, 12)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(connectClaims{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		TokenID:   hex.EncodeToString(idBytes),
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + signConnectPayload(payload), nil
+}
+
+// parseConnectToken 校验签名、有效期与设备ID，并在redis中占用令牌ID，同一令牌只能使用一次
+func parseConnectToken(ctx context.Context, token string) (*connectClaims, error) {
+	if len(connectSecret) == 0 {
+		return nil, errors.New("未启用连接授权令牌")
+	}
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("连接授权令牌格式错误")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signConnectPayload(payload))) {
+		return nil, errors.New("连接授权令牌签名错误")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	claims := &connectClaims{}
+	if err := json.Unmarshal(raw, claims); err != nil {
+		return nil, err
+	}
+	if _, err := strconv.ParseInt(claims.UserID, 10, 64); err != nil || claims.TokenID == "" {
+		return nil, errors.New("连接授权令牌内容错误")
+	}
+	if claims.DeviceID, ok = normalizeDeviceID(claims.DeviceID); !ok {
+		return nil, errors.New("连接授权令牌设备ID非法")
+	}
+	remaining := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if remaining <= 0 {
+		return nil, errors.New("连接授权令牌已过期")
+	}
+	if remaining > config.Handler.ConnectTokenMaxTTL {
+		// 一次性标记只保留 ConnectTokenMaxTTL，有效期更长的令牌在标记过期后可以重放
+		return nil, errors.New("连接授权令牌有效期过长")
+	}
+	claimed, err := redisClient.ClaimConnectToken(ctx, claims.TokenID, remaining)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errors.New("连接授权令牌已被使用")
+	}
+	return claims, nil
+}
+
+// connectAuth 升级请求携带的身份，连接建立后直接完成登录
+type connectAuth struct {
+	method    string // auth_token 或 bearer
+	userID    string
+	deviceID  string
+	expiresAt time.Time // 会话过期时刻，到期后关闭连接；为零值时不过期
+}
+
+// authorizeConnect 升级前校验 auth_token 参数或 Authorization: Bearer 头。都未携带时返回nil，走带内登录；
+// 令牌无效、过期或已被使用时返回401，返回值 ok 为false
+func authorizeConnect(w http.ResponseWriter, r *http.Request) (auth *connectAuth, ok bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.Handler.MessageTimeout)
+	defer cancel()
+	var err error
+	method := "auth_token"
+	if token := r.URL.Query().Get("auth_token"); token != "" {
+		var claims *connectClaims
+		if claims, err = parseConnectToken(ctx, token); err == nil {
+			auth = &connectAuth{method: method, userID: claims.UserID, deviceID: claims.DeviceID}
+		}
+	} else if token := bearerToken(r); token != "" {
+		method = "bearer"
+		auth, err = parseBearer(ctx, token, r.URL.Query().Get("device_id"))
+	} else {
+		return nil, true
+	}
+	if err != nil {
+		metrics.Inc("connect_auth_total", "method", method, "result", "rejected")
+		ctxLogger(ctx).Warnf("连接授权校验失败: %v", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	metrics.Inc("connect_auth_total", "method", method, "result", "accepted")
+	return auth, true
+}
+
+// parseBearer 校验身份提供方签发的 JWT，设备ID取自 device_id 查询参数
+func parseBearer(ctx context.Context, token string, deviceID string) (*connectAuth, error) {
+	if config.Handler.JWKSURL == "" {
+		return nil, errors.New("未启用 JWT 认证")
+	}
+	deviceID, ok := normalizeDeviceID(deviceID)
+	if !ok {
+		return nil, errors.New("设备ID非法")
+	}
+	userID, expiresAt, err := verifyJWT(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return &connectAuth{method: "bearer", userID: userID, deviceID: deviceID, expiresAt: expiresAt}, nil
+}
+
+// loginPreauthorized 连接建立后以升级请求中的身份完成登录，仍执行冲突处理与redis登记；登录能力取自连接地址的查询参数
+func loginPreauthorized(client *Client, auth *connectAuth, query url.Values) bool {
+	ctx, cancel := context.WithTimeout(client.ctx, config.Handler.MessageTimeout)
+	defer cancel()
+	ctx = withLogger(ctx, client.log())
+	userID, _ := strconv.ParseInt(auth.userID, 10, 64)
+	heartbeatMs, _ := strconv.ParseInt(query.Get("heartbeat_ms"), 10, 64)
+	rsp := &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Login{
+			Login: &pb.LoginRsp{
+				Result: pb.LoginResult_LOGIN_OK,
+				UserId: userID,
+			},
+		},
+	}
+	ok := completeLogin(ctx, client, rsp, userID, auth.deviceID, "", clientCaps{
+		Chunking:          query.Get("chunking") == "true",
+		Class:             query.Get("class"),
+		HeartbeatMs:       heartbeatMs,
+		AdaptiveHeartbeat: query.Get("adaptive_heartbeat") == "true",
+		Locale:            query.Get("locale"),
+	})
+	if ok && !auth.expiresAt.IsZero() {
+		watchSessionExpiry(client, auth.expiresAt)
+	}
+	return ok
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// recordConnections 订阅连接事件，登录时写入连接记录，断开时补填断开时刻与原因。
+// 只记录登录过的连接；账号注销断开的连接不再写入，避免在状态清理之后重新建出记录
+func recordConnections(sub *Subscription) {
+	cfg := config.Handler
+	for event := range sub.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.MessageTimeout)
+		var err error
+		switch e := event.(type) {
+		case ClientLoggedIn:
+			record := redisClient.ConnectionRecord{
+				ConnID:      e.ConnID,
+				DeviceID:    e.DeviceID,
+				Container:   identity.ContainerID(),
+				Platform:    e.Platform,
+				ConnectedAt: e.At.UnixMilli(),
+			}
+			if cfg.ConnectionHistoryIP {
+				record.RemoteIP = hostOf(e.RemoteAddr)
+			}
+			err = redisClient.AppendConnection(ctx, e.UserID, record, cfg.ConnectionHistoryMax, cfg.ConnectionHistoryMaxAge)
+		case ClientDisconnected:
+			if e.UserID == "" || e.Reason == CloseAccountDeleted {
+				break
+			}
+			var found bool
+			found, err = redisClient.CloseConnection(ctx, e.UserID, e.ConnID, e.At, string(e.Reason))
+			if err == nil && !found {
+				// 登录时的记录未能写入或已被裁剪，单独记下这次断开
+				record := redisClient.ConnectionRecord{
+					ConnID:         e.ConnID,
+					DeviceID:       e.DeviceID,
+					Container:      identity.ContainerID(),
+					DisconnectedAt: e.At.UnixMilli(),
+					CloseReason:    string(e.Reason),
+				}
+				if cfg.ConnectionHistoryIP {
+					record.RemoteIP = hostOf(e.RemoteAddr)
+				}
+				err = redisClient.AppendConnection(ctx, e.UserID, record, cfg.ConnectionHistoryMax, cfg.ConnectionHistoryMaxAge)
+			}
+		}
+		cancel()
+		if err != nil {
+			metrics.Inc("connection_history_errors_total")
+		}
+	}
+}
+
+// hostOf 去掉地址中的端口
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// handleAdminConnectionHistory GET /admin/users/{userID}/connections?offset=&limit= 从新到旧分页返回用户的连接记录，
+// next 为下一页的 offset，为0表示没有更多
+func handleAdminConnectionHistory(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	if userID == "" {
+		http.Error(w, "missing user id", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	records, next, err := redisClient.ConnectionHistory(r.Context(), userID, offset, limit)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"user_id":     userID,
+		"connections": records,
+		"next":        next,
+	})
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedControlPrefix 带签名的控制消息格式：SIGNED2 <签名时刻(毫秒)> <目标容器ID> <签名> <控制命令>，
+// 签名为集群共享密钥对 "<签名时刻>\n<目标容器ID>\n<控制命令>" 计算的 HMAC-SHA256。
+// 签名绑定目标容器，截获的控制消息不能重放给其他容器
+const signedControlPrefix = "SIGNED2 "
+
+// legacySignedControlPrefix 旧格式 SIGNED <签名时刻> <签名> <控制命令>，签名不含目标容器。
+// 只在 ControlSignRequired 关闭的迁移期接受，与未签名的控制命令相同
+const legacySignedControlPrefix = "SIGNED "
+
+// controlCommandPrefixes 经容器topic下发的文本控制命令
+var controlCommandPrefixes = []string{"DELETE USER ", "KICK ", "ACCOUNT DELETED ", "LOGOUT ALL "}
+
+// controlKeys 控制消息的签名密钥。CONTROL_SECRET 用于签名与校验，CONTROL_SECRET_ALT 只用于校验，供轮换使用：
+// 先在所有容器上把新密钥配置为 ALT，再交换两者，最后去掉 ALT。
+// 也可以通过 CONTROL_SECRET_FILE 挂载密钥文件，第一行为签名密钥，第二行(可选)为 ALT
+type controlKeys struct {
+	sign []byte
+	alt  []byte
+}
+
+var controlSecrets = loadControlKeys()
+
+func loadControlKeys() controlKeys {
+	keys := controlKeys{
+		sign: []byte(os.Getenv("CONTROL_SECRET")),
+		alt:  []byte(os.Getenv("CONTROL_SECRET_ALT")),
+	}
+	if path := os.Getenv("CONTROL_SECRET_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Sugar().Errorf("读取控制消息密钥文件 %s 失败: %v", path, err)
+			return keys
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		keys.sign = []byte(strings.TrimSpace(lines[0]))
+		if len(lines) > 1 {
+			keys.alt = []byte(strings.TrimSpace(lines[1]))
+		}
+	}
+	if len(keys.sign) == 0 {
+		logger.Sugar().Warnf("未配置 CONTROL_SECRET，控制消息不签名")
+	}
+	return keys
+}
+
+func controlMAC(secret []byte, ts string, target string, command []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(target))
+	mac.Write([]byte{'\n'})
+	mac.Write(command)
+	return mac.Sum(nil)
+}
+
+// legacyControlMAC 旧格式的签名，不含目标容器
+func legacyControlMAC(secret []byte, ts string, command []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'\n'})
+	mac.Write(command)
+	return mac.Sum(nil)
+}
+
+// signControl 为发往 target 容器的控制命令签名，未配置密钥时原样返回
+func signControl(target string, command string) []byte {
+	if len(controlSecrets.sign) == 0 {
+		return []byte(command)
+	}
+	ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	sig := base64.RawURLEncoding.EncodeToString(controlMAC(controlSecrets.sign, ts, target, []byte(command)))
+	return []byte(signedControlPrefix + ts + " " + target + " " + sig + " " + command)
+}
+
+// seenControl 有效期内已接受的签名，拒绝原样重放的控制消息
+var seenControl = struct {
+	sync.Mutex
+	sigs  map[string]time.Time // {签名: 过期时刻}
+	order *list.List           // seenSig，按过期时刻升序，从头部清理
+}{sigs: make(map[string]time.Time), order: list.New()}
+
+type seenSig struct {
+	sig     string
+	expires time.Time
+}
+
+// VerifyControl 消费者收到报文后先行校验：带签名的控制消息校验目标容器、签名、时效与重放，通过后返回其中的控制命令；
+// 未签名或旧格式签名的控制命令在 ControlSignRequired 开启时拒绝；其他报文原样返回。返回false时应丢弃报文
+func VerifyControl(data []byte) ([]byte, bool) {
+	if bytes.HasPrefix(data, []byte(legacySignedControlPrefix)) {
+		return verifyLegacyControl(data)
+	}
+	if !bytes.HasPrefix(data, []byte(signedControlPrefix)) {
+		if isControlCommand(data) && len(controlSecrets.sign) > 0 {
+			if config.Handler.ControlSignRequired {
+				rejectControl("unsigned", data)
+				return nil, false
+			}
+			// 迁移期：其他服务尚未签名
+			metrics.Inc("control_unsigned_total")
+		}
+		return data, true
+	}
+	parts := bytes.SplitN(data[len(signedControlPrefix):], []byte{' '}, 4)
+	if len(parts) != 4 {
+		rejectControl("malformed", data)
+		return nil, false
+	}
+	ts, target, sig, command := string(parts[0]), string(parts[1]), string(parts[2]), parts[3]
+	signedAt, err := strconv.ParseInt(ts, 10, 64)
+	given, decodeErr := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || decodeErr != nil {
+		rejectControl("malformed", data)
+		return nil, false
+	}
+	if target != identity.ContainerID() {
+		rejectControl("wrong_target", command)
+		return nil, false
+	}
+	if !controlSignatureValid(func(secret []byte) []byte { return controlMAC(secret, ts, target, command) }, given) {
+		rejectControl("bad_signature", command)
+		return nil, false
+	}
+	return acceptControl(signedAt, sig, command)
+}
+
+// verifyLegacyControl 校验旧格式的签名。旧签名可以被重放给其他容器，因此只在迁移期接受
+func verifyLegacyControl(data []byte) ([]byte, bool) {
+	parts := bytes.SplitN(data[len(legacySignedControlPrefix):], []byte{' '}, 3)
+	if len(parts) != 3 {
+		rejectControl("malformed", data)
+		return nil, false
+	}
+	ts, sig, command := string(parts[0]), string(parts[1]), parts[2]
+	if config.Handler.ControlSignRequired {
+		rejectControl("legacy_signature", command)
+		return nil, false
+	}
+	signedAt, err := strconv.ParseInt(ts, 10, 64)
+	given, decodeErr := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || decodeErr != nil {
+		rejectControl("malformed", data)
+		return nil, false
+	}
+	if !controlSignatureValid(func(secret []byte) []byte { return legacyControlMAC(secret, ts, command) }, given) {
+		rejectControl("bad_signature", command)
+		return nil, false
+	}
+	metrics.Inc("control_legacy_signed_total")
+	return acceptControl(signedAt, sig, command)
+}
+
+// acceptControl 签名有效后检查时效与重放
+func acceptControl(signedAt int64, sig string, command []byte) ([]byte, bool) {
+	maxAge := config.Handler.ControlMaxAge
+	age := time.Since(time.UnixMilli(signedAt))
+	if age > maxAge || age < -maxAge {
+		rejectControl("stale", command)
+		return nil, false
+	}
+	if !markControlSeen(sig, time.UnixMilli(signedAt).Add(maxAge)) {
+		rejectControl("replayed", command)
+		return nil, false
+	}
+	return command, true
+}
+
+// controlSignatureValid 签名与签名密钥或轮换中的 ALT 密钥之一相符
+func controlSignatureValid(mac func(secret []byte) []byte, given []byte) bool {
+	for _, secret := range [][]byte{controlSecrets.sign, controlSecrets.alt} {
+		if len(secret) > 0 && hmac.Equal(mac(secret), given) {
+			return true
+		}
+	}
+	return false
+}
+
+// markControlSeen 记录签名，已记录过时返回false；顺带从头部清理过期的记录，每次只处理已过期的部分
+func markControlSeen(sig string, expires time.Time) bool {
+	now := time.Now()
+	seenControl.Lock()
+	defer seenControl.Unlock()
+	if _, ok := seenControl.sigs[sig]; ok {
+		return false
+	}
+	for front := seenControl.order.Front(); front != nil && now.After(front.Value.(seenSig).expires); front = seenControl.order.Front() {
+		delete(seenControl.sigs, front.Value.(seenSig).sig)
+		seenControl.order.Remove(front)
+	}
+	// 签名时刻大致递增，从尾部向前找插入位置
+	at := seenControl.order.Back()
+	for at != nil && at.Value.(seenSig).expires.After(expires) {
+		at = at.Prev()
+	}
+	if at == nil {
+		seenControl.order.PushFront(seenSig{sig: sig, expires: expires})
+	} else {
+		seenControl.order.InsertAfter(seenSig{sig: sig, expires: expires}, at)
+	}
+	seenControl.sigs[sig] = expires
+	return true
+}
+
+func isControlCommand(data []byte) bool {
+	for _, prefix := range controlCommandPrefixes {
+		if bytes.HasPrefix(data, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectControl 记录被拒绝的控制消息，日志中只保留开头部分
+func rejectControl(reason string, data []byte) {
+	metrics.Inc("control_rejected_total", "reason", reason)
+	preview := data
+	if len(preview) > 64 {
+		preview = preview[:64]
+	}
+	logger.Sugar().Warnf("拒绝控制消息(%s): %q", reason, preview)
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func withControlSecrets(t *testing.T, keys controlKeys) {
+	t.Helper()
+	saved := controlSecrets
+	controlSecrets = keys
+	t.Cleanup(func() { controlSecrets = saved })
+}
+
+func TestVerifyControlBindsTargetContainer(t *testing.T) {
+	withControlSecrets(t, controlKeys{sign: []byte("secret")})
+	self := identity.ContainerID()
+
+	command, ok := VerifyControl(signControl(self, "DELETE USER 1:a"))
+	if !ok || string(command) != "DELETE USER 1:a" {
+		t.Fatalf("发往本容器的控制消息被拒绝: %q %v", command, ok)
+	}
+	// 截获发往其他容器的控制消息后转发到本容器
+	if _, ok := VerifyControl(signControl("other-container", "DELETE USER 1:b")); ok {
+		t.Fatal("接受了发往其他容器的控制消息")
+	}
+	// 改写目标容器后签名不再相符
+	forged := bytes.Replace(signControl("other-container", "DELETE USER 1:c"), []byte(" other-container "), []byte(" "+self+" "), 1)
+	if _, ok := VerifyControl(forged); ok {
+		t.Fatal("接受了改写目标容器的控制消息")
+	}
+}
+
+func TestVerifyControlReplayAndRotation(t *testing.T) {
+	withControlSecrets(t, controlKeys{sign: []byte("old")})
+	signed := signControl(identity.ContainerID(), "KICK logout 1:a")
+	retired := signControl(identity.ContainerID(), "KICK logout 1:c")
+
+	// 轮换中：新密钥签名，旧密钥作为 ALT 仍可校验
+	controlSecrets = controlKeys{sign: []byte("new"), alt: []byte("old")}
+	if _, ok := VerifyControl(signed); !ok {
+		t.Fatal("轮换期间旧密钥签名的控制消息被拒绝")
+	}
+	if _, ok := VerifyControl(signed); ok {
+		t.Fatal("接受了重放的控制消息")
+	}
+	controlSecrets = controlKeys{sign: []byte("new")}
+	if _, ok := VerifyControl(signControl(identity.ContainerID(), "KICK logout 1:b")); !ok {
+		t.Fatal("新密钥签名的控制消息被拒绝")
+	}
+	if _, ok := VerifyControl(retired); ok {
+		t.Fatal("去掉 ALT 后接受了旧密钥签名的控制消息")
+	}
+}
+
+func TestVerifyControlLegacyFormat(t *testing.T) {
+	withControlSecrets(t, controlKeys{sign: []byte("secret")})
+	saved := config.Handler.ControlSignRequired
+	t.Cleanup(func() { config.Handler.ControlSignRequired = saved })
+
+	legacy := func(command string) []byte {
+		ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		sig := legacyControlMAC(controlSecrets.sign, ts, []byte(command))
+		return []byte(legacySignedControlPrefix + ts + " " + base64.RawURLEncoding.EncodeToString(sig) + " " + command)
+	}
+	config.Handler.ControlSignRequired = false
+	if _, ok := VerifyControl(legacy("DELETE USER 1:a")); !ok {
+		t.Fatal("迁移期拒绝了旧格式签名")
+	}
+	config.Handler.ControlSignRequired = true
+	if _, ok := VerifyControl(legacy("DELETE USER 1:b")); ok {
+		t.Fatal("ControlSignRequired 开启后接受了旧格式签名")
+	}
+}
+
+// 过期的签名按过期时刻从头部清理，乱序到达的签名也不会提前或漏掉清理
+func TestMarkControlSeenDropsExpired(t *testing.T) {
+	seenControl.Lock()
+	savedSigs, savedOrder := seenControl.sigs, seenControl.order
+	seenControl.sigs, seenControl.order = make(map[string]time.Time), list.New()
+	seenControl.Unlock()
+	t.Cleanup(func() {
+		seenControl.Lock()
+		seenControl.sigs, seenControl.order = savedSigs, savedOrder
+		seenControl.Unlock()
+	})
+
+	now := time.Now()
+	for i, offset := range []time.Duration{-time.Second, time.Minute, -2 * time.Second, 2 * time.Minute, 30 * time.Second} {
+		if !markControlSeen(strconv.Itoa(i), now.Add(offset)) {
+			t.Fatalf("签名 %d 首次出现被拒绝", i)
+		}
+	}
+	if markControlSeen("1", now.Add(time.Minute)) {
+		t.Fatal("有效期内重放的签名被接受")
+	}
+	markControlSeen("new", now.Add(time.Hour))
+	if _, ok := seenControl.sigs["0"]; ok {
+		t.Fatal("过期的签名没有被清理")
+	}
+	if _, ok := seenControl.sigs["2"]; ok {
+		t.Fatal("乱序到达的过期签名没有被清理")
+	}
+	var last time.Time
+	for e := seenControl.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(seenSig)
+		if entry.expires.Before(last) {
+			t.Fatalf("记录没有按过期时刻排列: %s", entry.sig)
+		}
+		last = entry.expires
+	}
+	if len(seenControl.sigs) != 4 || seenControl.order.Len() != 4 {
+		t.Fatalf("剩余 %d/%d 条记录，期望 4", len(seenControl.sigs), seenControl.order.Len())
+	}
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 解码前检查失败的原因，作为指标标签与错误分类
+var (
+	ErrPayloadTooLarge = errors.New("报文过大")
+	ErrTooManyEntries  = errors.New("repeated字段元素过多")
+	ErrTooDeep         = errors.New("嵌套层数过多")
+	ErrMalformed       = errors.New("报文格式错误")
+
+	// errBatchLimit 批量请求超出条目数或大小上限，与 ErrTooManyEntries/ErrPayloadTooLarge 一起包装，
+	// 拒绝响应与解码后检查时一致
+	errBatchLimit = errors.New("批量请求超限")
+)
+
+// decodeOptions 反序列化选项，嵌套层数与预检查一致
+func decodeOptions() proto.UnmarshalOptions {
+	return proto.UnmarshalOptions{RecursionLimit: config.Handler.DecodeMaxDepth}
+}
+
+// maxRequestBytes 单条请求解码前允许的最大字节数，分片重组后的请求可能超过单帧大小
+func maxRequestBytes() int {
+	return max(int(config.Handler.MaxFrameBytes), config.Handler.MaxTransferBytes)
+}
+
+// decodeMessage 先做不分配内存的预检查再反序列化，超出限制的输入在分配任何元素之前就被拒绝
+func decodeMessage(data []byte, msg proto.Message, maxBytes int) error {
+	if err := checkDecodeLimits(data, msg.ProtoReflect().Descriptor(), maxBytes); err != nil {
+		metrics.Inc("decode_rejected_total", "reason", decodeErrorReason(err))
+		return err
+	}
+	if err := decodeOptions().Unmarshal(data, msg); err != nil {
+		metrics.Inc("decode_rejected_total", "reason", "unmarshal")
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+// decodeErrorReason 预检查错误的分类名
+func decodeErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrPayloadTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrTooManyEntries):
+		return "too_many_entries"
+	case errors.Is(err, ErrTooDeep):
+		return "too_deep"
+	default:
+		return "malformed"
+	}
+}
+
+// checkDecodeLimits 按消息描述符遍历线格式：总大小、嵌套层数以及每个消息中单个repeated字段的元素数都不能超过上限。
+// 只读取标签与长度，不分配内存，代价与输入长度成正比
+func checkDecodeLimits(data []byte, desc protoreflect.MessageDescriptor, maxBytes int) error {
+	if maxBytes > 0 && len(data) > maxBytes {
+		return fmt.Errorf("%w: %d > %d 字节", ErrPayloadTooLarge, len(data), maxBytes)
+	}
+	return scanMessage(data, desc, 1)
+}
+
+func scanMessage(data []byte, desc protoreflect.MessageDescriptor, depth int) error {
+	cfg := config.Handler
+	if depth > cfg.DecodeMaxDepth {
+		return fmt.Errorf("%w: 超过 %d 层", ErrTooDeep, cfg.DecodeMaxDepth)
+	}
+	var counts map[protowire.Number]int
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+		}
+		data = data[n:]
+		var fd protoreflect.FieldDescriptor
+		if desc != nil {
+			fd = desc.Fields().ByNumber(num)
+		}
+
+		entries := 1
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+			}
+			data = data[n:]
+			switch {
+			case fd == nil:
+			case fd.Message() != nil:
+				if fd.Message().FullName() == batchRequestName && len(value) > cfg.BatchMaxBytes {
+					return fmt.Errorf("%w: %w: %d > %d 字节", ErrPayloadTooLarge, errBatchLimit, len(value), cfg.BatchMaxBytes)
+				}
+				if err := scanMessage(value, fd.Message(), depth+1); err != nil {
+					return err
+				}
+			case fd.IsList():
+				// packed 编码的标量，每个元素至少占1字节
+				entries = packedCount(value, fd.Kind())
+			}
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+			}
+			data = data[n:]
+		}
+
+		if fd != nil && (fd.IsList() || fd.IsMap()) {
+			if counts == nil {
+				counts = make(map[protowire.Number]int)
+			}
+			counts[num] += entries
+			if fd.Message() != nil && fd.Message().FullName() == batchEntryName {
+				// 批量请求的条目在解码时就逐条分配，按批量上限而不是通用上限提前拒绝
+				if counts[num] > cfg.BatchMaxEntries {
+					return fmt.Errorf("%w: %w: %d > %d 条", ErrTooManyEntries, errBatchLimit, counts[num], cfg.BatchMaxEntries)
+				}
+			} else if counts[num] > cfg.DecodeMaxEntries {
+				return fmt.Errorf("%w: 字段 %s 超过 %d 个", ErrTooManyEntries, fd.Name(), cfg.DecodeMaxEntries)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	batchRequestName = (&pb.BatchRequest{}).ProtoReflect().Descriptor().FullName()
+	batchEntryName   = (&pb.BatchEntry{}).ProtoReflect().Descriptor().FullName()
+)
+
+// checkBatchLimits 批量请求的条目数与总大小，在处理任何条目之前检查，超出时整批拒绝。
+// 解码前的预检查已按同样的上限拒绝，这里覆盖不经过预检查的来源
+func checkBatchLimits(batch *pb.BatchRequest, size int) error {
+	cfg := config.Handler
+	if n := len(batch.GetEntries()); n > cfg.BatchMaxEntries {
+		return fmt.Errorf("%w: 批量请求 %d > %d 条", ErrTooManyEntries, n, cfg.BatchMaxEntries)
+	}
+	if size > cfg.BatchMaxBytes {
+		return fmt.Errorf("%w: 批量请求 %d > %d 字节", ErrPayloadTooLarge, size, cfg.BatchMaxBytes)
+	}
+	return nil
+}
+
+// packedCount packed 编码中的元素个数
+func packedCount(value []byte, kind protoreflect.Kind) int {
+	switch kind {
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		return len(value) / 4
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		return len(value) / 8
+	default:
+		count := 0
+		for _, b := range value {
+			if b < 0x80 {
+				count++
+			}
+		}
+		return count
+	}
+}
+
+// batchRefused 批量请求超限的拒绝响应
+func batchRefused() *pb.ResponseMessage {
+	rsp := refused(pb.RefusedReason_LIMIT_EXCEEDED)
+	rsp.GetRefused().Field = "entries"
+	return rsp
+}
+
+// undecodableResponse 无法解析的报文的拒绝响应，回显开头若干字节与原因分类，客户端据此发现自身的序列化问题。
+// 批量请求超限时与解码后检查的拒绝一致
+func undecodableResponse(data []byte, err error) *pb.ResponseMessage {
+	if errors.Is(err, errBatchLimit) {
+		return batchRefused()
+	}
+	preview := data
+	if n := config.Handler.UndecodablePreview; len(preview) > n {
+		preview = preview[:max(n, 0)]
+	}
+	rsp := refused(pb.RefusedReason_INVALID_PAYLOAD)
+	rsp.GetRefused().Preview = hex.EncodeToString(preview)
+	rsp.GetRefused().Category = decodeErrorReason(err)
+	return rsp
+}
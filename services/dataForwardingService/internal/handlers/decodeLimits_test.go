@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"runtime"
+	"testing"
+)
+
+// nestedBatch 批量请求逐层嵌套 depth 层
+func nestedBatch(depth int) *pb.RequestMessage {
+	req := &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{}}}
+	for i := 0; i < depth; i++ {
+		req = &pb.RequestMessage{Payload: &pb.RequestMessage_Batch{Batch: &pb.BatchRequest{
+			Entries: []*pb.BatchEntry{{Request: req}},
+		}}}
+	}
+	return req
+}
+
+// batchOf 包含 n 条回显请求的批量请求
+func batchOf(n int) *pb.RequestMessage {
+	entries := make([]*pb.BatchEntry, n)
+	for i := range entries {
+		entries[i] = &pb.BatchEntry{Request: &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{}}}}
+	}
+	return &pb.RequestMessage{Payload: &pb.RequestMessage_Batch{Batch: &pb.BatchRequest{Entries: entries}}}
+}
+
+func mustMarshal(t testing.TB, m proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeLimits(t *testing.T) {
+	cfg := config.Handler
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"批量请求恰好到上限", mustMarshal(t, batchOf(cfg.BatchMaxEntries)), nil},
+		{"批量请求条目过多", mustMarshal(t, batchOf(cfg.BatchMaxEntries+1)), errBatchLimit},
+		{"嵌套恰好到上限", mustMarshal(t, nestedBatch(cfg.DecodeMaxDepth/3-1)), nil},
+		{"嵌套过深", mustMarshal(t, nestedBatch(cfg.DecodeMaxDepth)), ErrTooDeep},
+		{"长度前缀越界", []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}, ErrMalformed},
+		{"截断的标签", []byte{0x80}, ErrMalformed},
+	}
+	for _, c := range cases {
+		_, err := HandleRequestData(c.data)
+		if c.want == nil && err != nil || c.want != nil && !errors.Is(err, c.want) {
+			t.Errorf("%s: 错误为 %v，期望 %v", c.name, err, c.want)
+		}
+	}
+
+	// 批量请求超限时的拒绝与解码后检查一致
+	_, err := HandleRequestData(mustMarshal(t, batchOf(cfg.BatchMaxEntries+1)))
+	if r := undecodableResponse(nil, err).GetRefused(); r.GetReason() != pb.RefusedReason_LIMIT_EXCEEDED || r.GetField() != "entries" {
+		t.Fatalf("批量请求超限的拒绝响应为 %v", r)
+	}
+}
+
+// 超出条目上限的输入在分配任何元素之前被拒绝，拒绝的代价与条目数无关。
+// 比较每次拒绝分配的字节数而不是分配次数，-race 下运行时偶尔多出的一两次小分配不影响结果
+func TestDecodeRejectsBeforeAllocating(t *testing.T) {
+	desc := (&pb.RequestMessage{}).ProtoReflect().Descriptor()
+	bytesPerRun := func(n int) uint64 {
+		const runs = 50
+		data := mustMarshal(t, batchOf(n))
+		reject := func() {
+			if err := checkDecodeLimits(data, desc, maxRequestBytes()); !errors.Is(err, ErrTooManyEntries) {
+				t.Fatalf("%d 条的批量请求未被拒绝: %v", n, err)
+			}
+		}
+		reject()
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			reject()
+		}
+		runtime.ReadMemStats(&after)
+		return (after.TotalAlloc - before.TotalAlloc) / runs
+	}
+	// 逐条解码5000条至少分配数十KB，容差远小于此
+	const tolerance = 1024
+	few, many := bytesPerRun(config.Handler.BatchMaxEntries+1), bytesPerRun(5000)
+	if many > few+tolerance {
+		t.Fatalf("拒绝 5000 条分配了 %d 字节，拒绝 %d 条只分配 %d 字节", many, config.Handler.BatchMaxEntries+1, few)
+	}
+	t.Logf("拒绝一次分配 %d / %d 字节", few, many)
+}
+
+// 任意字节都不能让解析崩溃，通过预检查的请求满足全部解码限制
+func FuzzHandleRequestData(f *testing.F) {
+	f.Add(mustMarshal(f, &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "hi"}}}))
+	f.Add(mustMarshal(f, batchOf(3)))
+	f.Add(mustMarshal(f, nestedBatch(4)))
+	f.Add(mustMarshal(f, &pb.RequestMessage{Payload: &pb.RequestMessage_Chunk{Chunk: &pb.Chunk{TransferId: "t", Total: 2, Data: []byte("ab")}}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := HandleRequestData(data)
+		if err != nil {
+			return
+		}
+		if len(data) > maxRequestBytes() {
+			t.Fatalf("%d 字节的请求通过了解码", len(data))
+		}
+		if batch := req.GetBatch(); batch != nil {
+			if err := checkBatchLimits(batch, len(data)); err != nil {
+				t.Fatalf("超限的批量请求通过了预检查: %v", err)
+			}
+		}
+	})
+}
+
+// 消息队列与会话历史的报文解析不崩溃，成功时总有内容
+func FuzzDecodeWire(f *testing.F) {
+	message := &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "hi"}}}
+	f.Add(mustMarshal(f, message))
+	f.Add(mustMarshal(f, &pb.WireEnvelope{Version: wireVersion, Payload: message}))
+	f.Add(mustMarshal(f, &pb.WireEnvelope{Version: wireVersion + 1, Stored: &pb.ResponseMessage{}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if wire, err := DecodeWire(data); err == nil && wire.GetPayload() == nil {
+			t.Fatal("解析成功但信封没有内容")
+		}
+		if stored, err := DecodeStored(data); err == nil && stored == nil {
+			t.Fatal("解析成功但没有会话历史报文")
+		}
+	})
+}
+
+// 任意分片序列不能让重组器崩溃，同时进行的传输数与重组后的大小不超过上限。
+// 每4字节描述一个分片：传输ID、序号、总数、数据长度
+func FuzzChunkAssembler(f *testing.F) {
+	f.Add([]byte{0, 0, 2, 3, 0, 1, 2, 3})
+	f.Add([]byte{0, 0, 1, 0, 1, 0xff, 1, 1, 2, 0, 0x7f, 1})
+	f.Add([]byte{0, 1, 3, 1, 0, 1, 2, 1, 1, 0, 1, 1, 2, 0, 1, 1, 3, 0, 1, 1, 4, 0, 1, 1})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		withConfig(t, func(cfg *config.HandlerConfig) {
+			cfg.MaxTransferChunks = 8
+			cfg.MaxTransferBytes = 64
+			cfg.MaxConcurrentTransfers = 2
+		})
+		a := newChunkAssembler()
+		defer a.Close()
+		for ; len(ops) >= 4; ops = ops[4:] {
+			chunk := &pb.Chunk{
+				TransferId: string(rune('a' + ops[0]%4)),
+				Index:      int32(int8(ops[1])),
+				Total:      int32(int8(ops[2])),
+				Data:       make([]byte, ops[3]%32),
+			}
+			data, err := a.Add(chunk)
+			if err == nil && data != nil && len(data) > config.Handler.MaxTransferBytes {
+				t.Fatalf("重组后 %d 字节超过上限", len(data))
+			}
+			a.mu.Lock()
+			n := len(a.transfers)
+			a.mu.Unlock()
+			if n > config.Handler.MaxConcurrentTransfers {
+				t.Fatalf("同时进行 %d 个传输", n)
+			}
+		}
+	})
+}
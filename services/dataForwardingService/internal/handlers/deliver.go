@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// DeliveryResult 一次投递的结果
+type DeliveryResult int
+
+const (
+	DeliveryDropped       DeliveryResult = iota // 接收者不在线且无法离线保存，或被去重/拦截器丢弃
+	DeliveredLocal                              // 已放入本容器连接的发送队列
+	DeliveryForwarded                           // 已转发到接收者所在的其他容器(可能同时有本地投递)
+	DeliveryStoredOffline                       // 接收者不在线，已离线保存
+	DeliveryBlocked                             // 接收者屏蔽了发送者
+)
+
+func (r DeliveryResult) String() string {
+	switch r {
+	case DeliveredLocal:
+		return "delivered_local"
+	case DeliveryForwarded:
+		return "forwarded"
+	case DeliveryStoredOffline:
+		return "stored_offline"
+	case DeliveryBlocked:
+		return "blocked"
+	default:
+		return "dropped"
+	}
+}
+
+// DeliveryOptions 投递选项
+type DeliveryOptions struct {
+	DeviceID  string          // 非空时只投递到该设备
+	Priority  Priority        // 接收方发送队列的优先级
+	ServerTs  int64           // 服务端收到原始请求的时刻，为0时取投递时刻
+	Seq       int64           // 已分配的消息序号，多次投递共享同一序号时由调用方通过 AllocateSequence 预先分配
+	Sequenced bool            // Seq 为0时是否为接收者分配消息序号
+	DedupKey  string          // 非空时同一接收者相同的key在 DeliveryDedupTTL 内只投递一次
+	Sender    string          // 消息或事件的发起用户，非空时跳过屏蔽了该用户的接收者
+	Receipt   *ReceiptRequest // 非空时在接收者确认收到或超时未确认后发布回执，隐含 Sequenced
+
+	Conversation string // 消息所属会话，随消息转发，供离线存储按会话索引
+	ConvSeq      int64  // 接收时通过 AllocateConversationSequence 分配的会话序号
+}
+
+// OfflineStore 接收者不在线时保存消息。需要撤回与账号注销时清理的实现应当只追加，
+// 并实现 OfflineTombstoner 与 OfflineCompactor，RedisOfflineStore 即是如此
+type OfflineStore interface {
+	Store(ctx context.Context, userID string, deviceID string, env *Envelope) error
+}
+
+// PushNotifier 接收者不在线时交给推送服务唤醒客户端
+type PushNotifier interface {
+	Notify(ctx context.Context, userID string, env *Envelope) error
+}
+
+// SetOfflineStore 设置离线消息存储，未设置时不在线的消息直接丢弃，需在服务启动之前调用
+func (s *Server) SetOfflineStore(store OfflineStore) {
+	s.offline = store
+}
+
+// SetPushNotifier 设置离线推送，需在服务启动之前调用
+func (s *Server) SetPushNotifier(n PushNotifier) {
+	s.push = n
+}
+
+// SetOfflineStore 设置默认实例的离线消息存储。
+//
+// Deprecated: 使用 Default().SetOfflineStore
+func SetOfflineStore(s OfflineStore) {
+	defaultServer.SetOfflineStore(s)
+}
+
+// SetPushNotifier 设置默认实例的离线推送。
+//
+// Deprecated: 使用 Default().SetPushNotifier
+func SetPushNotifier(n PushNotifier) {
+	defaultServer.SetPushNotifier(n)
+}
+
+// AllocateSequence 为接收者分配消息序号，分配失败时返回0(不带序号)
+func AllocateSequence(ctx context.Context, userID string) int64 {
+	seq, err := redisClient.NextSequence(ctx, userID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("分配消息序号失败: %v", err)
+		return 0
+	}
+	return seq
+}
+
+// AllocateConversationSequence 为会话分配消息序号，所有成员共享，分配失败时返回0(不带会话序号)
+func AllocateConversationSequence(ctx context.Context, conv string) int64 {
+	start := time.Now()
+	seq, err := redisClient.NextConversationSequence(ctx, conv)
+	// 热门群聊的分配会集中在同一个键上，记录耗时以观察争用
+	metrics.Observe("conv_seq_alloc_ms", float64(time.Since(start).Milliseconds()))
+	if err != nil {
+		ctxLogger(ctx).Warnf("分配会话 %s 的消息序号失败: %v", conv, err)
+		return 0
+	}
+	return seq
+}
+
+// DeliverToUser 服务内部向用户投递消息的唯一入口：实例连接表中的连接直接入队，其他容器的通过 Delivery 信封转发，
+// 不在线时离线保存并交给推送。去重、序号分配在这里完成，出站拦截器在最终入队前执行
+func (s *Server) DeliverToUser(ctx context.Context, userID string, message *pb.ResponseMessage, opts DeliveryOptions) (DeliveryResult, error) {
+	result, err := s.deliverToUser(ctx, userID, message, opts)
+	metrics.Inc("delivery_total", "result", result.String())
+	return result, err
+}
+
+// DeliverToUser 经默认实例投递消息。
+//
+// Deprecated: 使用 Default().DeliverToUser，处理函数中使用连接所属的实例
+func DeliverToUser(ctx context.Context, userID string, message *pb.ResponseMessage, opts DeliveryOptions) (DeliveryResult, error) {
+	return defaultServer.DeliverToUser(ctx, userID, message, opts)
+}
+
+func (s *Server) deliverToUser(ctx context.Context, userID string, message *pb.ResponseMessage, opts DeliveryOptions) (DeliveryResult, error) {
+	if message == nil {
+		return DeliveryDropped, errors.New("投递的消息为空")
+	}
+	message = withSenderType(message, senderTypeOf(opts.Sender))
+	if blockedRecipient(ctx, userID, opts.Sender) {
+		return DeliveryBlocked, nil
+	}
+	if opts.DedupKey != "" {
+		first, err := redisClient.ClaimDeliveryKey(ctx, userID, opts.DedupKey, config.Handler.DeliveryDedupTTL)
+		if err != nil {
+			ctxLogger(ctx).Warnf("投递去重失败，继续投递: %v", err)
+		} else if !first {
+			metrics.Inc("delivery_deduplicated_total")
+			return DeliveryDropped, nil
+		} else {
+			result, err := s.deliverClaimed(ctx, userID, message, opts)
+			if err != nil || result == DeliveryDropped {
+				releaseDeliveryKey(ctx, userID, opts.DedupKey)
+			}
+			return result, err
+		}
+	}
+	return s.deliverClaimed(ctx, userID, message, opts)
+}
+
+// releaseDeliveryKey 投递失败后释放去重键，调用方以同一key重试时不会被当作重复投递丢弃。
+// 投递可能因上下文超时失败，释放不沿用其取消
+func releaseDeliveryKey(ctx context.Context, userID string, dedupKey string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.Handler.MessageTimeout)
+	defer cancel()
+	if err := redisClient.ReleaseDeliveryKey(ctx, userID, dedupKey); err != nil {
+		ctxLogger(ctx).Warnf("释放投递去重键失败，重试将被去重: %v", err)
+	}
+}
+
+// deliverClaimed 去重之后的投递：本地入队、转发到其他容器或离线保存
+func (s *Server) deliverClaimed(ctx context.Context, userID string, message *pb.ResponseMessage, opts DeliveryOptions) (DeliveryResult, error) {
+	containerID := identity.ContainerID()
+	local := s.hasLocalRecipient(userID, opts.DeviceID)
+	remotes, err := remoteContainers(ctx, userID, opts.DeviceID, containerID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询用户 %s 所在容器失败: %v", userID, err)
+		if !local {
+			return DeliveryDropped, err
+		}
+	}
+
+	env := &Envelope{
+		Message:      message,
+		Priority:     opts.Priority,
+		ServerTs:     opts.ServerTs,
+		Seq:          opts.Seq,
+		Conversation: opts.Conversation,
+		ConvSeq:      opts.ConvSeq,
+	}
+	transitioning := s.inTransition(userID, opts.DeviceID)
+	online := local || transitioning || len(remotes) > 0
+	if env.Seq == 0 && (opts.Sequenced || opts.Receipt != nil) && (online || s.offline != nil) {
+		env.Seq = AllocateSequence(ctx, userID)
+	}
+	if opts.Receipt != nil {
+		// 先登记再投递，避免客户端确认早于登记
+		trackReceipts(ctx, map[string]int64{userID: env.Seq}, opts.Receipt)
+	}
+	if !online {
+		return s.storeOffline(ctx, userID, opts.DeviceID, env)
+	}
+
+	result := DeliveryDropped
+	switch {
+	case transitioning && s.holdForTransition(userID, opts.DeviceID, env):
+		result = DeliveredLocal
+	case local || transitioning:
+		if s.deliverLocal(userID, opts.DeviceID, env) {
+			result = DeliveredLocal
+		}
+	}
+	if len(remotes) == 0 {
+		return result, nil
+	}
+	delivery := &pb.Delivery{
+		UserId:       userID,
+		DeviceId:     opts.DeviceID,
+		Message:      message,
+		Priority:     int32(env.Priority),
+		ServerTs:     env.ServerTs,
+		Seq:          env.Seq,
+		Conversation: env.Conversation,
+		ConvSeq:      env.ConvSeq,
+	}
+	for _, target := range remotes {
+		if err := s.forwardDelivery(ctx, delivery, target); err != nil {
+			return result, err
+		}
+	}
+	return DeliveryForwarded, nil
+}
+
+// InplaceHandleDelivery 消费者收到其他容器转发的投递信封，投递给默认实例的连接。
+// 消息队列的订阅按容器划分，是进程级的，转发来的投递都由默认实例接收
+func InplaceHandleDelivery(message *pb.RequestMessage) error {
+	return defaultServer.handleDelivery(message)
+}
+
+// handleDelivery 将转发来的投递信封投递给实例的连接，接收者已离开时改为离线保存。
+// 批量信封中单个接收者失败不影响其余接收者
+func (s *Server) handleDelivery(message *pb.RequestMessage) error {
+	delivery := message.GetDelivery()
+	if delivery.GetMessage() == nil {
+		return errors.New("投递信封中没有消息")
+	}
+	priority := Priority(delivery.GetPriority())
+	if priority < 0 || priority >= priorityCount {
+		priority = PriorityInteractive
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+
+	if delivery.GetAllLocal() {
+		s.deliverToLocalUsers(s.clients.Users(), delivery.GetMessage(), priority)
+		return nil
+	}
+	if len(delivery.GetRecipients()) == 0 {
+		return s.receiveDelivery(ctx, delivery.GetUserId(), delivery.GetDeviceId(), &Envelope{
+			Message:      delivery.GetMessage(),
+			Priority:     priority,
+			ServerTs:     delivery.GetServerTs(),
+			Seq:          delivery.GetSeq(),
+			Conversation: delivery.GetConversation(),
+			ConvSeq:      delivery.GetConvSeq(),
+		})
+	}
+	var errs []error
+	for _, recipient := range delivery.GetRecipients() {
+		err := s.receiveDelivery(ctx, recipient.GetUserId(), "", &Envelope{
+			Message:      proto.Clone(delivery.GetMessage()).(*pb.ResponseMessage),
+			Priority:     priority,
+			ServerTs:     delivery.GetServerTs(),
+			Seq:          recipient.GetSeq(),
+			Conversation: delivery.GetConversation(),
+			ConvSeq:      delivery.GetConvSeq(),
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// receiveDelivery 将转发来的消息投递给实例的连接，接收者不在本实例时离线保存
+func (s *Server) receiveDelivery(ctx context.Context, userID string, deviceID string, env *Envelope) error {
+	env.Path, env.ReceivedAt = DeliveryPathForwarded, time.Now()
+	if s.holdForTransition(userID, deviceID, env) {
+		metrics.Inc("delivery_total", "result", DeliveredLocal.String())
+		return nil
+	}
+	if s.hasLocalRecipient(userID, deviceID) && s.deliverLocal(userID, deviceID, env) {
+		metrics.Inc("delivery_total", "result", DeliveredLocal.String())
+		return nil
+	}
+	result, err := s.storeOffline(ctx, userID, deviceID, env)
+	metrics.Inc("delivery_total", "result", result.String())
+	return err
+}
+
+// hasLocalRecipient 接收者(或其指定设备)是否在实例的连接表中
+func (s *Server) hasLocalRecipient(userID string, deviceID string) bool {
+	if deviceID != "" {
+		_, ok := s.clients.DeviceClient(userID, deviceID)
+		return ok
+	}
+	return len(s.clients.UserClients(userID)) > 0
+}
+
+// remoteContainers 查询接收者连接所在的其他容器，包括设备正在登录切换到的容器
+func remoteContainers(ctx context.Context, userID string, deviceID string, containerID string) ([]string, error) {
+	devices, err := redisClient.GetDeliveryDevices(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []string
+	seen := make(map[string]bool, len(devices))
+	for id, target := range devices {
+		if deviceID != "" && id != deviceID {
+			continue
+		}
+		if target != containerID && !seen[target] {
+			seen[target] = true
+			remotes = append(remotes, target)
+		}
+	}
+	return remotes, nil
+}
+
+// deliverLocal 经出站拦截器后放入实例中连接的发送队列，被拦截器否决或连接已不存在时返回false
+func (s *Server) deliverLocal(userID string, deviceID string, env *Envelope) bool {
+	var err error
+	if deviceID != "" {
+		err = s.SendToDevice(userID, deviceID, env)
+	} else {
+		err = s.SendLargeMessage(userID, env)
+	}
+	if err != nil {
+		logger.Sugar().Warnf("本地投递给 %s 失败: %v", redisClient.DeviceKey(userID, deviceID), err)
+		return false
+	}
+	replay.record(userID, deviceID, env)
+	return true
+}
+
+// storeOffline 接收者不在线时离线保存并交给推送。接收者对会话免打扰时不推送，并标记信封供离线存储不计未读
+func (s *Server) storeOffline(ctx context.Context, userID string, deviceID string, env *Envelope) (DeliveryResult, error) {
+	if conversationMuted(ctx, userID, env.Conversation) {
+		env.Muted = true
+		metrics.Inc("push_muted_total")
+	}
+	if s.push != nil && !env.Muted {
+		if err := s.push.Notify(ctx, userID, env); err != nil {
+			ctxLogger(ctx).Warnf("离线推送给用户 %s 失败: %v", userID, err)
+		}
+	}
+	if s.offline == nil {
+		ctxLogger(ctx).Warnf("%s 用户不在线", userID)
+		return DeliveryDropped, nil
+	}
+	if err := s.offline.Store(ctx, userID, deviceID, env); err != nil {
+		return DeliveryDropped, fmt.Errorf("离线保存失败: %w", err)
+	}
+	s.accountStorage(ctx, userID, env)
+	replay.record(userID, deviceID, env)
+	return DeliveryStoredOffline, nil
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// maxRecipientsPerDelivery 单个批量投递信封最多携带的接收者数，避免单条队列消息过大
+const maxRecipientsPerDelivery = 500
+
+// DeliveryOutcome 批量投递中单个接收者的结果
+type DeliveryOutcome struct {
+	Result DeliveryResult
+	Err    error
+}
+
+// DeliverToUsers 将同一条消息投递给多个用户。容器查询、序号分配与去重都通过redis管道批量完成，
+// 其他容器的接收者按容器合并为批量信封发布，本地接收者并行投递。
+// 单个接收者或单个容器失败不影响其余接收者，opts.DeviceID 在批量投递中不生效
+func (s *Server) DeliverToUsers(ctx context.Context, userIDs []string, message *pb.ResponseMessage, opts DeliveryOptions) map[string]DeliveryOutcome {
+	outcomes := make(map[string]DeliveryOutcome, len(userIDs))
+	defer func() {
+		for _, outcome := range outcomes {
+			metrics.Inc("delivery_total", "result", outcome.Result.String())
+		}
+	}()
+	if message == nil {
+		for _, userID := range userIDs {
+			outcomes[userID] = DeliveryOutcome{Result: DeliveryDropped, Err: errors.New("投递的消息为空")}
+		}
+		return outcomes
+	}
+	message = withSenderType(message, senderTypeOf(opts.Sender))
+
+	recipients := make([]string, 0, len(userIDs))
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			recipients = append(recipients, userID)
+		}
+	}
+	if opts.Sender != "" {
+		blocked, err := redisClient.BlockedBy(ctx, recipients, opts.Sender)
+		if err != nil {
+			ctxLogger(ctx).Warnf("批量查询屏蔽列表失败，继续投递: %v", err)
+		}
+		allowed := recipients[:0]
+		for _, userID := range recipients {
+			if blocked[userID] && userID != opts.Sender {
+				outcomes[userID] = DeliveryOutcome{Result: DeliveryBlocked}
+				continue
+			}
+			allowed = append(allowed, userID)
+		}
+		recipients = allowed
+	}
+	if opts.DedupKey != "" {
+		claimed, err := redisClient.ClaimDeliveryKeys(ctx, recipients, opts.DedupKey, config.Handler.DeliveryDedupTTL)
+		if err != nil {
+			ctxLogger(ctx).Warnf("批量投递去重失败，继续投递: %v", err)
+		} else {
+			first := recipients[:0]
+			for _, userID := range recipients {
+				if claimed[userID] {
+					first = append(first, userID)
+					continue
+				}
+				metrics.Inc("delivery_deduplicated_total")
+				outcomes[userID] = DeliveryOutcome{Result: DeliveryDropped}
+			}
+			recipients = first
+		}
+	}
+
+	containers, lookupErr := redisClient.GetUsersContainers(ctx, recipients)
+	if lookupErr != nil {
+		ctxLogger(ctx).Warnf("批量查询用户所在容器失败，只投递本地连接: %v", lookupErr)
+	}
+	containerID := identity.ContainerID()
+	var local, offline, sequenced []string
+	remote := make(map[string][]string)
+	for _, userID := range recipients {
+		isLocal := s.hasLocalRecipient(userID, "")
+		hasRemote := false
+		for _, target := range containers[userID] {
+			if target != containerID {
+				remote[target] = append(remote[target], userID)
+				hasRemote = true
+			}
+		}
+		switch {
+		case isLocal:
+			local = append(local, userID)
+		case !hasRemote && lookupErr != nil:
+			outcomes[userID] = DeliveryOutcome{Result: DeliveryDropped, Err: lookupErr}
+			continue
+		case !hasRemote:
+			offline = append(offline, userID)
+			if s.offline == nil {
+				continue
+			}
+		}
+		sequenced = append(sequenced, userID)
+	}
+
+	seqs := make(map[string]int64)
+	if opts.Seq != 0 {
+		for _, userID := range sequenced {
+			seqs[userID] = opts.Seq
+		}
+	} else if (opts.Sequenced || opts.Receipt != nil) && len(sequenced) > 0 {
+		allocated, err := redisClient.NextSequences(ctx, sequenced)
+		if err != nil {
+			ctxLogger(ctx).Warnf("批量分配消息序号失败: %v", err)
+		} else {
+			seqs = allocated
+		}
+	}
+	if opts.Receipt != nil {
+		trackReceipts(ctx, seqs, opts.Receipt)
+	}
+	envelopeFor := func(userID string) *Envelope {
+		// 出站拦截器会修改消息，每个接收者使用独立副本
+		return &Envelope{
+			Message:      proto.Clone(message).(*pb.ResponseMessage),
+			Priority:     opts.Priority,
+			ServerTs:     opts.ServerTs,
+			Seq:          seqs[userID],
+			Conversation: opts.Conversation,
+			ConvSeq:      opts.ConvSeq,
+		}
+	}
+
+	var mu sync.Mutex
+	fanOut(local, func(userID string) {
+		result := DeliveryDropped
+		if s.deliverLocal(userID, "", envelopeFor(userID)) {
+			result = DeliveredLocal
+		}
+		mu.Lock()
+		outcomes[userID] = DeliveryOutcome{Result: result}
+		mu.Unlock()
+	})
+	fanOut(offline, func(userID string) {
+		result, err := s.storeOffline(ctx, userID, "", envelopeFor(userID))
+		mu.Lock()
+		outcomes[userID] = DeliveryOutcome{Result: result, Err: err}
+		mu.Unlock()
+	})
+
+	for target, userIDs := range remote {
+		for start := 0; start < len(userIDs); start += maxRecipientsPerDelivery {
+			batch := userIDs[start:min(start+maxRecipientsPerDelivery, len(userIDs))]
+			err := s.publishDeliveryBatch(ctx, target, batch, seqs, message, opts)
+			for _, userID := range batch {
+				outcome := outcomes[userID]
+				if err != nil {
+					outcome.Err = errors.Join(outcome.Err, err)
+				} else {
+					// 只要有一个容器转发成功即视为已转发
+					outcome.Result = DeliveryForwarded
+				}
+				outcomes[userID] = outcome
+			}
+		}
+	}
+	return outcomes
+}
+
+// DeliverToUsers 经默认实例批量投递消息。
+//
+// Deprecated: 使用 Default().DeliverToUsers，处理函数中使用连接所属的实例
+func DeliverToUsers(ctx context.Context, userIDs []string, message *pb.ResponseMessage, opts DeliveryOptions) map[string]DeliveryOutcome {
+	return defaultServer.DeliverToUsers(ctx, userIDs, message, opts)
+}
+
+// publishDeliveryBatch 将一批接收者合并为一个投递信封发布到目标容器
+func (s *Server) publishDeliveryBatch(ctx context.Context, target string, userIDs []string, seqs map[string]int64, message *pb.ResponseMessage, opts DeliveryOptions) error {
+	recipients := make([]*pb.DeliveryRecipient, 0, len(userIDs))
+	for _, userID := range userIDs {
+		recipients = append(recipients, &pb.DeliveryRecipient{
+			UserId: userID,
+			Seq:    seqs[userID],
+		})
+	}
+	return s.forwardDelivery(ctx, &pb.Delivery{
+		Message:      message,
+		Priority:     int32(opts.Priority),
+		ServerTs:     opts.ServerTs,
+		Recipients:   recipients,
+		Conversation: opts.Conversation,
+		ConvSeq:      opts.ConvSeq,
+	}, target)
+}
+
+// fanOut 使用固定数量的协程并行处理，全部完成后返回
+func fanOut(items []string, fn func(string)) {
+	if len(items) == 0 {
+		return
+	}
+	workers := min(max(config.Handler.BulkDeliveryWorkers, 1), len(items))
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				fn(item)
+			}
+		}()
+	}
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// deliverToLocalUsers 只投递给实例中的连接，不查询redis也不转发，用于全员广播等各容器各自投递的场景
+func (s *Server) deliverToLocalUsers(userIDs []string, message *pb.ResponseMessage, priority Priority) (delivered int, dropped int) {
+	var mu sync.Mutex
+	fanOut(userIDs, func(userID string) {
+		ok := s.deliverLocal(userID, "", &Envelope{
+			Message:  proto.Clone(message).(*pb.ResponseMessage),
+			Priority: priority,
+		})
+		result := DeliveryDropped
+		if ok {
+			result = DeliveredLocal
+		}
+		metrics.Inc("delivery_total", "result", result.String())
+		mu.Lock()
+		defer mu.Unlock()
+		if ok {
+			delivered++
+		} else {
+			dropped++
+		}
+	})
+	return delivered, dropped
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/internal/redis"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// roundTrips 统计redis往返次数，一个管道计为一次
+type roundTrips struct {
+	n atomic.Int64
+}
+
+func (h *roundTrips) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.n.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// withRemoteRecipients 将 n 个用户登记在其他容器上，返回用户ID与往返计数
+func withRemoteRecipients(tb testing.TB, n int) ([]string, *roundTrips) {
+	tb.Helper()
+	withRedis(tb)
+	userIDs := make([]string, n)
+	for i := range userIDs {
+		userIDs[i] = strconv.Itoa(100000 + i)
+		if err := redisClient.RegisterConnection(context.Background(), userIDs[i], "phone", "remote-"+strconv.Itoa(i%4)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	counter := &roundTrips{}
+	redisClient.Rdb.AddHook(counter)
+	return userIDs, counter
+}
+
+var bulkNotice = &pb.ResponseMessage{Payload: &pb.ResponseMessage_Warn{Warn: &pb.Warn{WarningMessage: "系统维护通知"}}}
+
+// 批量投递的redis往返次数与接收者数量无关
+func TestDeliverToUsersRoundTripsIndependentOfRecipients(t *testing.T) {
+	var counts []int64
+	for _, n := range []int{10, 1000} {
+		userIDs, counter := withRemoteRecipients(t, n)
+		s := NewServer()
+		outcomes := s.DeliverToUsers(context.Background(), userIDs, bulkNotice, DeliveryOptions{Priority: PriorityControl, Sequenced: true})
+		if len(outcomes) != n {
+			t.Fatalf("%d 个接收者只返回了 %d 个结果", n, len(outcomes))
+		}
+		counts = append(counts, counter.n.Load())
+	}
+	if counts[0] != counts[1] {
+		t.Fatalf("10 与 1000 个接收者的redis往返次数分别为 %d 与 %d", counts[0], counts[1])
+	}
+}
+
+// 10000 个接收者的广播，对比逐个调用 DeliverToUser。消息队列未初始化，发布立即失败，只衡量redis往返与分组开销
+func BenchmarkDeliverToUsers(b *testing.B) {
+	const recipients = 10000
+	opts := DeliveryOptions{Priority: PriorityControl, Sequenced: true}
+	b.Run("bulk", func(b *testing.B) {
+		userIDs, counter := withRemoteRecipients(b, recipients)
+		s := NewServer()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.DeliverToUsers(context.Background(), userIDs, bulkNotice, opts)
+		}
+		b.ReportMetric(float64(counter.n.Load())/float64(b.N), "redis_round_trips/op")
+	})
+	b.Run("loop", func(b *testing.B) {
+		userIDs, counter := withRemoteRecipients(b, recipients)
+		s := NewServer()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, userID := range userIDs {
+				_, _ = s.DeliverToUser(context.Background(), userID, bulkNotice, opts)
+			}
+		}
+		b.ReportMetric(float64(counter.n.Load())/float64(b.N), "redis_round_trips/op")
+	})
+}
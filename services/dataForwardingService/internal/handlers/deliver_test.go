@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"errors"
+	"testing"
+)
+
+// flakyOffline 前 failures 次离线保存失败，之后成功
+type flakyOffline struct {
+	failures int
+	stored   int
+}
+
+func (f *flakyOffline) Store(ctx context.Context, userID string, deviceID string, env *Envelope) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("离线存储不可用")
+	}
+	f.stored++
+	return nil
+}
+
+// 投递失败后释放去重键：以同一key重试的投递照常完成，成功之后的重复投递仍被去重
+func TestDedupKeyReleasedOnFailedDelivery(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	offline := &flakyOffline{failures: 1}
+	s.SetOfflineStore(offline)
+	message := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte("x")}}}
+	opts := DeliveryOptions{DedupKey: "msg-1"}
+
+	result, err := s.DeliverToUser(context.Background(), "7", message, opts)
+	if err == nil || result != DeliveryDropped {
+		t.Fatalf("离线存储失败时期望投递失败，实际为 %v, %v", result, err)
+	}
+	result, err = s.DeliverToUser(context.Background(), "7", message, opts)
+	if err != nil || result != DeliveryStoredOffline {
+		t.Fatalf("失败后以同一key重试期望离线保存，实际为 %v, %v", result, err)
+	}
+	result, err = s.DeliverToUser(context.Background(), "7", message, opts)
+	if err != nil || result != DeliveryDropped {
+		t.Fatalf("成功后的重复投递期望被去重，实际为 %v, %v", result, err)
+	}
+	if offline.stored != 1 {
+		t.Fatalf("期望离线保存1次，实际为 %d", offline.stored)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/redis"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainStatus 排空状态
+type DrainStatus struct {
+	Draining       bool      `json:"draining"`
+	StartedAt      time.Time `json:"started_at,omitempty"`
+	Deadline       time.Time `json:"deadline,omitempty"`
+	TargetEndpoint string    `json:"target_endpoint,omitempty"`
+	Remaining      int       `json:"remaining_connections"`
+}
+
+// drainState 实例的排空状态
+type drainState struct {
+	mu     sync.Mutex
+	status DrainStatus
+	timer  *time.Timer
+}
+
+// isDraining 是否处于排空状态，排空中不再接受新的连接
+func (s *Server) isDraining() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.status.Draining
+}
+
+// StartDrain 进入排空状态：在redis中标记本容器，向实例的所有连接下发带随机延迟的重连建议，宽限期后强制关闭剩余连接
+func (s *Server) StartDrain(ctx context.Context, grace time.Duration, targetEndpoint string) DrainStatus {
+	sugar := logger.Sugar()
+	containerID := identity.ContainerID()
+
+	s.drain.mu.Lock()
+	if s.drain.status.Draining {
+		status := s.drain.status
+		s.drain.mu.Unlock()
+		return status
+	}
+	now := time.Now()
+	s.drain.status = DrainStatus{
+		Draining:       true,
+		StartedAt:      now,
+		Deadline:       now.Add(grace),
+		TargetEndpoint: targetEndpoint,
+	}
+	s.drain.timer = time.AfterFunc(grace, s.forceCloseStragglers)
+	status := s.drain.status
+	s.drain.mu.Unlock()
+
+	if err := redisClient.SetContainerDraining(ctx, containerID, true); err != nil {
+		sugar.Warnf("标记容器排空失败: %v", err)
+	}
+
+	targets := s.clients.All()
+
+	// 延迟在宽限期的前半段内随机分布，避免所有客户端同时重连；没有宽限期时使用通用的退避建议
+	maxDelay := int64(grace / 2 / time.Millisecond)
+	for _, client := range targets {
+		delay := retryAfter().Milliseconds()
+		if maxDelay > 0 {
+			delay = rand.Int63n(maxDelay)
+		}
+		err := client.Enqueue(&pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_Reconnect{
+				Reconnect: &pb.Reconnect{
+					DelayMs:        delay,
+					TargetEndpoint: targetEndpoint,
+					Reason:         "server_drain",
+					Message:        systemText("reconnect.server_drain", nil),
+				},
+			},
+		})
+		if err != nil {
+			sugar.Warnf("发送重连建议失败: %v", err)
+		}
+	}
+
+	sugar.Infof("容器 %s 开始排空，连接数: %d，宽限期: %v", containerID, len(targets), grace)
+	status.Remaining = len(targets)
+	return status
+}
+
+// CancelDrain 取消排空，恢复接受新连接
+func (s *Server) CancelDrain(ctx context.Context) DrainStatus {
+	containerID := identity.ContainerID()
+
+	s.drain.mu.Lock()
+	if s.drain.timer != nil {
+		s.drain.timer.Stop()
+		s.drain.timer = nil
+	}
+	s.drain.status = DrainStatus{}
+	s.drain.mu.Unlock()
+
+	if err := redisClient.SetContainerDraining(ctx, containerID, false); err != nil {
+		logger.Sugar().Warnf("取消容器排空标记失败: %v", err)
+	}
+	logger.Sugar().Infof("容器 %s 取消排空", containerID)
+	return s.GetDrainStatus()
+}
+
+// GetDrainStatus 查询排空状态
+func (s *Server) GetDrainStatus() DrainStatus {
+	s.drain.mu.Lock()
+	status := s.drain.status
+	s.drain.mu.Unlock()
+
+	status.Remaining = s.clients.Len()
+	return status
+}
+
+// StartDrain 默认实例进入排空状态。
+//
+// Deprecated: 使用 Default().StartDrain
+func StartDrain(ctx context.Context, grace time.Duration, targetEndpoint string) DrainStatus {
+	return defaultServer.StartDrain(ctx, grace, targetEndpoint)
+}
+
+// CancelDrain 取消默认实例的排空。
+//
+// Deprecated: 使用 Default().CancelDrain
+func CancelDrain(ctx context.Context) DrainStatus {
+	return defaultServer.CancelDrain(ctx)
+}
+
+// GetDrainStatus 查询默认实例的排空状态。
+//
+// Deprecated: 使用 Default().GetDrainStatus
+func GetDrainStatus() DrainStatus {
+	return defaultServer.GetDrainStatus()
+}
+
+// forceCloseStragglers 宽限期结束后关闭仍未迁移的连接，由读协程完成正常的清理流程
+func (s *Server) forceCloseStragglers() {
+	s.drain.mu.Lock()
+	draining := s.drain.status.Draining
+	s.drain.mu.Unlock()
+	if !draining {
+		return
+	}
+
+	targets := s.clients.All()
+
+	logger.Sugar().Infof("排空宽限期结束，强制关闭剩余 %d 个连接", len(targets))
+	for _, client := range targets {
+		client.Close(CloseServerDrain)
+	}
+}
+
+type drainRequest struct {
+	GraceSeconds   int    `json:"grace_seconds"`
+	TargetEndpoint string `json:"target_endpoint"`
+}
+
+// handleAdminDrain GET 查询排空状态，POST 开始排空，DELETE 取消排空
+func (s *Server) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.GetDrainStatus())
+	case http.MethodPost:
+		req := drainRequest{GraceSeconds: 60}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.GraceSeconds <= 0 {
+			http.Error(w, "grace_seconds must be positive", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.StartDrain(r.Context(), time.Duration(req.GraceSeconds)*time.Second, req.TargetEndpoint))
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, s.CancelDrain(r.Context()))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
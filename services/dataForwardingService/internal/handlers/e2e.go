@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	redisClient "data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/utils"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+)
+
+// handleEncryptedMessage 转发端到端加密载荷，服务端只读取路由字段，不解析、不审核密文
+func handleEncryptedMessage(ctx context.Context, client *Client, fromID int64, message *pb.RequestMessage) error {
+	jwt := message.GetJwt()
+	if jwt == "" {
+		return errors.New("用户未携带有效JWT，无法转发消息")
+	}
+	if err := utils.ValidateAndParseJWT(ctx, fromID, jwt); err != nil {
+		return err
+	}
+
+	payload := message.GetEncrypted()
+	userID := strconv.FormatInt(payload.GetToId(), 10)
+	rootID, err := normalizeThread(payload.GetMessageId(), payload.GetParentMessageId(), payload.GetThreadRootId())
+	if err != nil {
+		return err
+	}
+
+	// 按设备拆分，每个设备只收到属于自己的密文，所有设备共享同一个消息序号
+	seq := AllocateSequence(ctx, userID)
+	conv := conversation{ToID: payload.GetToId()}
+	convSeq := AllocateConversationSequence(ctx, conv.key(fromID))
+	payload.FromId = fromID
+	payload.FromDeviceId = client.deviceID
+	payload.ThreadRootId = rootID
+	client.server.persistMessage(ctx, conv.key(fromID), convSeq, message.GetServerTs(), &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Encrypted{
+			Encrypted: payload,
+		},
+	})
+	delivered := 0
+	for _, ciphertext := range payload.GetCiphertexts() {
+		result, err := client.server.DeliverToUser(ctx, userID, &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_Encrypted{
+				Encrypted: &pb.EncryptedPayload{
+					FromId:             fromID,
+					FromDeviceId:       client.deviceID,
+					ToId:               payload.GetToId(),
+					Ciphertexts:        []*pb.DeviceCiphertext{ciphertext},
+					Timestamp:          payload.GetTimestamp(),
+					MessageId:          payload.GetMessageId(),
+					ParentMessageId:    payload.GetParentMessageId(),
+					ThreadRootId:       rootID,
+					ThreadRootAuthorId: payload.GetThreadRootAuthorId(),
+				},
+			},
+		}, DeliveryOptions{
+			DeviceID:     ciphertext.GetDeviceId(),
+			Priority:     PriorityInteractive,
+			ServerTs:     message.GetServerTs(),
+			Seq:          seq,
+			Sender:       strconv.FormatInt(fromID, 10),
+			Conversation: conv.key(fromID),
+			ConvSeq:      convSeq,
+		})
+		if err != nil {
+			return err
+		}
+		if result != DeliveryDropped {
+			delivered++
+		}
+	}
+
+	ctxLogger(ctx).Infof("%d 向 %d 的 %d 个设备发送加密消息", fromID, payload.GetToId(), delivered)
+	if rootID != "" {
+		client.server.recordThreadReply(ctx, conv, fromID, rootID, payload.GetThreadRootAuthorId(), message.GetServerTs())
+	}
+	return nil
+}
+
+// handleKeyBundleUpload 保存当前设备的公钥包，设备ID以连接登录时的设备为准
+func handleKeyBundleUpload(ctx context.Context, client *Client, fromID int64, message *pb.RequestMessage) error {
+	bundle := message.GetKeyBundleUpload().GetBundle()
+	rsp := &pb.KeyBundleUploadRsp{
+		Version: bundle.GetVersion(),
+	}
+	reply := func() error {
+		return client.Enqueue(&pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_KeyBundleUpload{
+				KeyBundleUpload: rsp,
+			},
+		})
+	}
+
+	if bundle == nil {
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_SVR_ERROR
+		return reply()
+	}
+	bundle.DeviceId = client.deviceID
+	if proto.Size(bundle) > config.Handler.MaxKeyBundleBytes {
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_TOO_LARGE
+		return reply()
+	}
+	// 一次性预密钥单独保存，每次获取只分发其中一个
+	prekeys := bundle.GetOneTimePrekeys()
+	bundle.OneTimePrekeys = nil
+	bundleBytes, err := proto.Marshal(bundle)
+	if err != nil {
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_SVR_ERROR
+		_ = reply()
+		return err
+	}
+
+	res, err := redisClient.StoreKeyBundle(ctx, strconv.FormatInt(fromID, 10), client.deviceID, bundle.GetVersion(), bundleBytes, prekeys, config.Handler.MaxDevicesPerUser)
+	if err != nil {
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_SVR_ERROR
+		_ = reply()
+		return err
+	}
+	switch res {
+	case redisClient.KeyBundleStored:
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_OK
+	case redisClient.KeyBundleStale:
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_STALE_VERSION
+	case redisClient.KeyBundleTooManyDevs:
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_TOO_MANY_DEVICES
+	default:
+		rsp.Result = pb.KeyBundleResult_KEY_BUNDLE_SVR_ERROR
+	}
+	return reply()
+}
+
+// handleKeyBundleFetch 返回目标用户所有设备的公钥包，每个设备附带一个尚未分发过的一次性预密钥，已用完时不附带
+func handleKeyBundleFetch(ctx context.Context, client *Client, message *pb.RequestMessage) error {
+	targetID := message.GetKeyBundleFetch().GetUserId()
+	stored, err := redisClient.GetKeyBundles(ctx, strconv.FormatInt(targetID, 10))
+	if err != nil {
+		return err
+	}
+
+	bundles := make([]*pb.KeyBundle, 0, len(stored))
+	for deviceID, entry := range stored {
+		bundle := &pb.KeyBundle{}
+		if err := proto.Unmarshal([]byte(entry.Bundle), bundle); err != nil {
+			client.log().Warnf("公钥包损坏: %d/%s: %v", targetID, deviceID, err)
+			continue
+		}
+		// 旧格式内嵌在公钥包中的预密钥无法保证只分发一次，不再下发，设备重新上传后恢复
+		bundle.OneTimePrekeys = nil
+		if entry.OneTimePrekey != "" {
+			bundle.OneTimePrekeys = [][]byte{[]byte(entry.OneTimePrekey)}
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	return client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_KeyBundles{
+			KeyBundles: &pb.KeyBundles{
+				UserId:  targetID,
+				Bundles: bundles,
+			},
+		},
+	})
+}
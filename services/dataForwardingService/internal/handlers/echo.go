@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/topics"
+	"strconv"
+	"time"
+)
+
+// capEchoBody 截断回显内容，避免被用作放大流量
+func capEchoBody(body []byte) []byte {
+	if len(body) > config.Handler.MaxEchoBytes {
+		return body[:config.Handler.MaxEchoBytes]
+	}
+	return body
+}
+
+// handleEcho 立即回显请求内容，附带服务端收发时刻与容器ID。自检耗时计入 echo_latency_ms，与业务报文的 handler_latency_ms 分开
+func handleEcho(ctx context.Context, client *Client, message *pb.RequestMessage) error {
+	containerID := identity.ContainerID()
+
+	recvTs := message.GetServerTs()
+	sendTs := time.Now().UnixMilli()
+	err := client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Echo{
+			Echo: &pb.EchoRsp{
+				Body:         capEchoBody(message.GetEcho().GetBody()),
+				ServerRecvTs: recvTs,
+				ServerSendTs: sendTs,
+				ContainerId:  containerID,
+			},
+		},
+		ServerTs: sendTs,
+	})
+	metrics.Observe("echo_latency_ms", float64(sendTs-recvTs), "kind", "echo")
+	return err
+}
+
+// handleLoopbackProbe 将自检请求发布到本容器的消息队列，由消费者走完整转发链路后返回
+func handleLoopbackProbe(ctx context.Context, client *Client, fromID int64, message *pb.RequestMessage) error {
+	containerID := identity.ContainerID()
+
+	probe := message.GetLoopbackProbe()
+	probe.Body = capEchoBody(probe.GetBody())
+	probe.UserId = fromID
+	probe.DeviceId = client.deviceID
+	probe.ServerRecvTs = message.GetServerTs()
+
+	return publishRequest(ctx, nil, message, topics.BuildContainerTopic(containerID))
+}
+
+// InplaceHandleLoopbackProbe 消费者收到自检报文后经默认实例回显给发起的设备，并记录链路耗时
+func InplaceHandleLoopbackProbe(message *pb.RequestMessage) error {
+	containerID := identity.ContainerID()
+
+	probe := message.GetLoopbackProbe()
+	sendTs := time.Now().UnixMilli()
+	metrics.Observe("echo_latency_ms", float64(sendTs-probe.GetServerRecvTs()), "kind", "loopback")
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	_, err := defaultServer.DeliverToUser(ctx, strconv.FormatInt(probe.GetUserId(), 10), &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Echo{
+			Echo: &pb.EchoRsp{
+				Body:         probe.GetBody(),
+				ServerRecvTs: probe.GetServerRecvTs(),
+				ServerSendTs: sendTs,
+				ContainerId:  containerID,
+				Loopback:     true,
+			},
+		},
+	}, DeliveryOptions{
+		DeviceID: probe.GetDeviceId(),
+		Priority: PriorityControl,
+		ServerTs: sendTs,
+	})
+	return err
+}
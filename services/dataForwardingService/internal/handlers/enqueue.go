@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// ErrSendQueueFull 发送队列在 SendQueueMaxWait 内一直没有空间，报文已丢弃
+var ErrSendQueueFull = errors.New("发送队列已满")
+
+type enqueueOptions struct {
+	priority    Priority
+	hasPriority bool
+	ttl         time.Duration
+	wait        time.Duration
+	encoded     []byte
+	timing      frameTiming
+}
+
+// EnqueueOption Enqueue 的可选参数
+type EnqueueOption func(*enqueueOptions)
+
+// WithPriority 指定发送队列的优先级，未指定时按响应类型确定
+func WithPriority(p Priority) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.priority, o.hasPriority = p, true
+	}
+}
+
+// WithTTL 报文在队列中等待超过 ttl 后不再发送
+func WithTTL(ttl time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithMaxWait 覆盖队列已满时的最长等待时间，为0时一直等待
+func WithMaxWait(wait time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.wait = wait
+	}
+}
+
+// withEncoded 使用已为该连接序列化好的帧，不再序列化 payload。
+// 同一消息发给多个连接时共享一份序列化结果，流量已在 prepareOutbound 中统计
+func withEncoded(data []byte) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.encoded = data
+	}
+}
+
+// withTiming 附带投递延迟统计信息，报文写入连接后记录
+func withTiming(t frameTiming) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.timing = t
+	}
+}
+
+// Enqueue 连接唯一的出站入口：按连接语言序列化响应、选择优先级队列后入队。
+// 与直接写队列的旧实现不同，队列已满时最多等待 SendQueueMaxWait，超时丢弃并返回 ErrSendQueueFull，
+// 不会无限期阻塞投递协程；连接已关闭时返回 ErrClientClosed。控制报文不等待，积压超过 ControlBufferMax 时
+// 以 slow_consumer 断开连接并返回 ErrSendQueueFull。
+// 丢弃计入 enqueue_dropped_total，调用方只需决定是否记录日志
+func (c *Client) Enqueue(payload *pb.ResponseMessage, opts ...EnqueueOption) error {
+	o := enqueueOptions{wait: config.Handler.SendQueueMaxWait}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.hasPriority {
+		o.priority = priorityOf(payload)
+	}
+	data := o.encoded
+	if data == nil {
+		if payload == nil {
+			return errors.New("响应为空")
+		}
+		if systemOriginated(payload) {
+			payload = withSenderType(payload, pb.SenderType_SENDER_SYSTEM)
+		}
+		var err error
+		data, err = proto.Marshal(localize(payload, c.declared().locale))
+		if err != nil {
+			return fmt.Errorf("响应序列化失败: %w", err)
+		}
+		if len(data) == 0 {
+			// 空响应序列化后为空字节，客户端无法解析
+			return errors.New("响应序列化结果为空")
+		}
+		userID, _ := c.identity()
+		recordOutbound(userID, payload, len(data))
+	}
+
+	switch c.buffer.push(o.priority, data, o.ttl, o.timing, o.wait) {
+	case pushClosed:
+		metrics.Inc("enqueue_dropped_total", "reason", "closed", "priority", o.priority.String())
+		return ErrClientClosed
+	case pushFull:
+		metrics.Inc("enqueue_dropped_total", "reason", "full", "priority", o.priority.String())
+		return ErrSendQueueFull
+	case pushOverflow:
+		metrics.Inc("enqueue_dropped_total", "reason", "overflow", "priority", o.priority.String())
+		c.log().Warnf("控制报文积压超过 %d 条，客户端不再读取，断开连接", config.Handler.ControlBufferMax)
+		// 断开时需注销redis，不阻塞入队的调用方
+		go c.Close(CloseSlowConsumer)
+		return ErrSendQueueFull
+	}
+	if o.priority != PriorityControl {
+		remaining, capacity := c.buffer.remaining()
+		c.checkLimit(limitSendBuffer, remaining, capacity)
+		c.observeBacklog(remaining, capacity)
+	}
+	return nil
+}
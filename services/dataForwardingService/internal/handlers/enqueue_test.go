@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stalledClient 发送队列容量为 size、没有写协程取出报文的连接
+func stalledClient(size int) *Client {
+	return &Client{server: NewServer(), buffer: newSendBuffer(size, func() {})}
+}
+
+func echoResponse() *pb.ResponseMessage {
+	return &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte("x")}}}
+}
+
+// enqueueAsync 在协程中入队，结果写入返回的通道
+func enqueueAsync(c *Client, opts ...EnqueueOption) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- c.Enqueue(echoResponse(), opts...) }()
+	return done
+}
+
+// 队列已满时 Enqueue 最多等待 SendQueueMaxWait，超时丢弃并返回 ErrSendQueueFull，而不是像直接写队列那样一直阻塞
+func TestEnqueueBoundedWait(t *testing.T) {
+	const wait = 100 * time.Millisecond
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.SendQueueMaxWait = wait
+		cfg.LimitWarningPercent = 0 // 不推送队列占用告警，队列中只有测试入队的报文
+		cfg.LimitWarningClasses = nil
+	})
+	c := stalledClient(2)
+	for i := 0; i < 2; i++ {
+		if err := c.Enqueue(echoResponse()); err != nil {
+			t.Fatalf("第 %d 条未入队: %v", i, err)
+		}
+	}
+
+	start := time.Now()
+	err := c.Enqueue(echoResponse())
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("队列已满时返回 %v，期望 ErrSendQueueFull", err)
+	}
+	if elapsed < wait || elapsed > 10*wait {
+		t.Fatalf("等待了 %v，期望约 %v", elapsed, wait)
+	}
+
+	// WithMaxWait 覆盖配置
+	start = time.Now()
+	if err := c.Enqueue(echoResponse(), WithMaxWait(10*time.Millisecond)); !errors.Is(err, ErrSendQueueFull) || time.Since(start) >= wait {
+		t.Fatalf("WithMaxWait(10ms) 返回 %v，耗时 %v", err, time.Since(start))
+	}
+
+	// 等待期间队列腾出空间则入队成功
+	done := enqueueAsync(c)
+	time.Sleep(wait / 4)
+	if _, closed, _ := c.buffer.pop(); closed {
+		t.Fatal("队列被意外关闭")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("等待期间腾出空间后仍失败: %v", err)
+	}
+}
+
+// WithMaxWait(0) 一直等待，直到连接关闭时返回 ErrClientClosed；已关闭的连接立即返回
+func TestEnqueueUnboundedWaitEndsOnClose(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.LimitWarningPercent = 0
+		cfg.LimitWarningClasses = nil
+	})
+	c := stalledClient(1)
+	if err := c.Enqueue(echoResponse()); err != nil {
+		t.Fatal(err)
+	}
+	done := enqueueAsync(c, WithMaxWait(0))
+	select {
+	case err := <-done:
+		t.Fatalf("不限时等待提前返回: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.buffer.close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("关闭后返回 %v，期望 ErrClientClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭连接没有唤醒等待中的 Enqueue")
+	}
+
+	start := time.Now()
+	if err := c.Enqueue(echoResponse()); !errors.Is(err, ErrClientClosed) || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("已关闭的连接返回 %v，耗时 %v", err, time.Since(start))
+	}
+}
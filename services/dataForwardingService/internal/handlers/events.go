@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"data_forwarding_service/internal/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event 连接生命周期事件，具体类型为 ClientConnected、ClientLoggedIn、ClientDisconnected、AccountDeleted
+type Event interface {
+	isEvent()
+}
+
+// ClientConnected 建立WebSocket连接(尚未登录)
+type ClientConnected struct {
+	RemoteAddr string
+	At         time.Time
+}
+
+// ClientLoggedIn 连接登录成功
+type ClientLoggedIn struct {
+	ConnID     string
+	RemoteAddr string
+	UserID     string
+	DeviceID   string
+	Platform   string // 登录时声明的客户端类别
+	At         time.Time
+}
+
+// ClientDisconnected 连接断开，未登录的连接 UserID 为空
+type ClientDisconnected struct {
+	ConnID     string
+	RemoteAddr string
+	UserID     string
+	DeviceID   string
+	Reason     CloseReason
+	At         time.Time
+}
+
+// AccountDeleted 账号注销处理完成，连接已断开、状态已清理
+type AccountDeleted struct {
+	UserID string
+	At     time.Time
+}
+
+func (ClientConnected) isEvent()    {}
+func (ClientLoggedIn) isEvent()     {}
+func (ClientDisconnected) isEvent() {}
+func (AccountDeleted) isEvent()     {}
+
+// Subscription 事件订阅，订阅方从 C 中读取事件
+type Subscription struct {
+	Name    string
+	C       <-chan Event
+	ch      chan Event
+	dropped atomic.Int64
+}
+
+// Dropped 因订阅方处理不及时而丢弃的事件数
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// eventBus 实例的事件订阅方
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []*Subscription
+}
+
+// Subscribe 注册事件订阅，buffer 为缓冲区大小，应在服务启动之前调用。
+// 投递是尽力而为的，缓冲区满时丢弃事件，不会阻塞连接协程
+func (s *Server) Subscribe(name string, buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{
+		Name: name,
+		C:    ch,
+		ch:   ch,
+	}
+	s.events.mu.Lock()
+	s.events.subscribers = append(s.events.subscribers, sub)
+	s.events.mu.Unlock()
+	return sub
+}
+
+// Subscribe 订阅默认实例的事件。
+//
+// Deprecated: 使用 Default().Subscribe
+func Subscribe(name string, buffer int) *Subscription {
+	return defaultServer.Subscribe(name, buffer)
+}
+
+// publishEvent 向实例的所有订阅方投递事件
+func (s *Server) publishEvent(event Event) {
+	bus := &s.events
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for _, sub := range bus.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+			metrics.Inc("event_dropped_total", "subscriber", sub.Name)
+		}
+	}
+}
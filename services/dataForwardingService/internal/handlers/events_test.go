@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+// 不读取或处理很慢的订阅方不影响连接断开，事件被丢弃并计数
+func TestSlowSubscriberDoesNotDelayDisconnect(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	stuck := s.Subscribe("stuck", 1) // 从不读取
+	slow := s.Subscribe("slow", 1)   // 每个事件处理很久
+	fast := s.Subscribe("fast", 64)
+	go func() {
+		for range slow.C {
+			time.Sleep(time.Second)
+		}
+	}()
+
+	const conns = 8
+	for i := 0; i < conns; i++ {
+		dialServer(t, s).Close()
+	}
+
+	deadline := time.After(2 * time.Second)
+	for disconnected := 0; disconnected < conns; {
+		select {
+		case event := <-fast.C:
+			if _, ok := event.(ClientDisconnected); ok {
+				disconnected++
+			}
+		case <-deadline:
+			t.Fatalf("2秒内只收到 %d/%d 个断开事件", disconnected, conns)
+		}
+	}
+	waitFor(t, "连接表清空", func() bool { return s.clients.Len() == 0 })
+	// 每个连接产生 ClientConnected 与 ClientDisconnected 两个事件
+	if n := stuck.Dropped(); n != 2*conns-1 {
+		t.Errorf("不读取的订阅方丢弃了 %d 个事件，期望 %d", n, 2*conns-1)
+	}
+	if slow.Dropped() == 0 {
+		t.Error("处理慢的订阅方没有丢弃事件")
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Errorf("及时读取的订阅方丢弃了 %d 个事件", n)
+	}
+}
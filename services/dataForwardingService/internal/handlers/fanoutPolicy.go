@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 大群事件扇出策略，按事件类别配置在 LargeGroupPolicies 中
+const (
+	fanoutDeliver = "deliver" // 照常逐条投递
+	fanoutDrop    = "drop"    // 丢弃，如正在输入
+	fanoutDigest  = "digest"  // 一段时间内的事件合并为一条摘要，如在线状态
+	fanoutRollup  = "rollup"  // 按消息合并，如表情回应
+)
+
+// groupSize 缓存的群成员数
+type groupSize struct {
+	count int
+	at    time.Time
+}
+
+// groupSizes {群ID: groupSize}，查询成员列表时顺带更新，用于在查询成员列表之前判断是否为大群
+var groupSizes sync.Map
+
+// recordGroupSize 记录群成员数
+func recordGroupSize(groupID int64, count int) {
+	if config.Handler.LargeGroupThreshold <= 0 {
+		return
+	}
+	groupSizes.Store(groupID, groupSize{count: count, at: time.Now()})
+}
+
+// cachedGroupSize 取缓存的群成员数，没有缓存或已超过 GroupSizeCacheTTL 时 ok 为false
+func cachedGroupSize(groupID int64) (count int, ok bool) {
+	v, found := groupSizes.Load(groupID)
+	if !found {
+		return 0, false
+	}
+	size := v.(groupSize)
+	if time.Since(size.at) > config.Handler.GroupSizeCacheTTL {
+		groupSizes.Delete(groupID)
+		return 0, false
+	}
+	return size.count, true
+}
+
+// categoryKey 事件类别在配置中的名称，如 EVENT_TYPING 对应 typing
+func categoryKey(category pb.EventCategory) string {
+	return strings.ToLower(strings.TrimPrefix(category.String(), "EVENT_"))
+}
+
+// largeGroupPolicy 会话中该类别事件的扇出策略。只使用缓存的成员数，不查询成员列表；
+// 非群聊、未超过 LargeGroupThreshold 或成员数未缓存时照常投递
+func largeGroupPolicy(conv conversation, category pb.EventCategory) string {
+	threshold := config.Handler.LargeGroupThreshold
+	if !conv.IsGroup || threshold <= 0 {
+		return fanoutDeliver
+	}
+	count, ok := cachedGroupSize(conv.ToID)
+	if !ok || count <= threshold {
+		return fanoutDeliver
+	}
+	switch policy := config.Handler.LargeGroupPolicies[categoryKey(category)]; policy {
+	case fanoutDrop, fanoutDigest, fanoutRollup:
+		return policy
+	default:
+		return fanoutDeliver
+	}
+}
+
+// recordSuppressed 记录被策略拦下的事件及因此少投递的连接数
+func recordSuppressed(category pb.EventCategory, policy string, audience int) {
+	metrics.Inc("fanout_suppressed_events_total", "category", categoryKey(category), "policy", policy)
+	metrics.Add("fanout_suppressed_deliveries_total", float64(audience), "category", categoryKey(category))
+}
+
+// pendingRollup 等待合并发送的一组事件
+type pendingRollup struct {
+	category pb.EventCategory
+	flush    func(ctx context.Context)
+}
+
+var (
+	rollupsMu sync.Mutex
+	rollups   = make(map[string]*pendingRollup) // {合并键: 待发送的合并}
+)
+
+// scheduleRollup 合并同一 key 在 ReactionRollupInterval 内的事件，到期后以最后一次传入的 flush 发送一次。
+// 合并只在本容器内进行，不同容器各自发送
+func scheduleRollup(key string, category pb.EventCategory, policy string, audience int, flush func(ctx context.Context)) {
+	rollupsMu.Lock()
+	defer rollupsMu.Unlock()
+	if pending, ok := rollups[key]; ok {
+		pending.flush = flush
+		recordSuppressed(category, policy, audience)
+		return
+	}
+	rollups[key] = &pendingRollup{category: category, flush: flush}
+	metrics.SetGauge("fanout_rollups_pending", float64(len(rollups)))
+	time.AfterFunc(config.Handler.ReactionRollupInterval, func() { flushRollup(key) })
+}
+
+// flushRollup 取出并发送合并后的事件
+func flushRollup(key string) {
+	rollupsMu.Lock()
+	pending, ok := rollups[key]
+	delete(rollups, key)
+	metrics.SetGauge("fanout_rollups_pending", float64(len(rollups)))
+	rollupsMu.Unlock()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	metrics.Inc("fanout_rollups_flushed_total", "category", categoryKey(pending.category))
+	pending.flush(ctx)
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// faultKind 故障注入的类型
+type faultKind string
+
+const (
+	faultDrop        faultKind = "drop"         // 丢弃出站报文
+	faultDelay       faultKind = "delay"        // 写入前延迟 DelayMs 毫秒
+	faultClose       faultKind = "close"        // 写入时直接断开连接，不发送关闭帧
+	faultCorrupt     faultKind = "corrupt"      // 篡改出站报文中的一个字节
+	faultFailRedis   faultKind = "fail_redis"   // redis命令返回错误
+	faultFailPublish faultKind = "fail_publish" // 发布到消息队列返回错误
+)
+
+// errFaultInjected 注入的故障返回的错误
+var errFaultInjected = errors.New("故障注入")
+
+// faultRule 一条故障注入规则，UserID 为空时对所有连接生效；redis与发布故障与用户无关，忽略 UserID
+type faultRule struct {
+	Kind        faultKind `json:"kind"`
+	Probability float64   `json:"probability"`
+	UserID      string    `json:"user_id,omitempty"`
+	DelayMs     int       `json:"delay_ms,omitempty"`
+}
+
+func (r faultRule) validate() error {
+	switch r.Kind {
+	case faultDrop, faultClose, faultCorrupt, faultFailRedis, faultFailPublish:
+	case faultDelay:
+		if r.DelayMs <= 0 {
+			return fmt.Errorf("delay 规则需要正的 delay_ms")
+		}
+	default:
+		return fmt.Errorf("未知的故障类型 %q", r.Kind)
+	}
+	if r.Probability <= 0 || r.Probability > 1 {
+		return fmt.Errorf("probability 需在 (0, 1] 之内")
+	}
+	return nil
+}
+
+// faultRules 当前生效的规则，为nil时所有注入点直接跳过
+var faultRules atomic.Pointer[[]faultRule]
+
+// triggerFault 按规则概率判定某类故障是否在本次触发，返回命中的规则
+func triggerFault(kind faultKind, userID string) (faultRule, bool) {
+	rules := faultRules.Load()
+	if rules == nil {
+		return faultRule{}, false
+	}
+	for _, rule := range *rules {
+		if rule.Kind != kind || (rule.UserID != "" && rule.UserID != userID) {
+			continue
+		}
+		if rand.Float64() < rule.Probability {
+			metrics.Inc("fault_injected_total", "kind", string(kind))
+			return rule, true
+		}
+	}
+	return faultRule{}, false
+}
+
+// injectWriteFault 写协程发送前调用，返回nil表示报文不再发送。
+// 同一份报文可能发往多个连接，篡改时先复制
+func injectWriteFault(client *Client, msg []byte) []byte {
+	if faultRules.Load() == nil {
+		return msg
+	}
+	userID, _ := client.identity()
+	if rule, ok := triggerFault(faultDelay, userID); ok {
+		time.Sleep(time.Duration(rule.DelayMs) * time.Millisecond)
+	}
+	if _, ok := triggerFault(faultClose, userID); ok {
+		client.log().Warnf("故障注入: 断开连接")
+		client.Close(CloseFaultInjected)
+		return nil
+	}
+	if _, ok := triggerFault(faultDrop, userID); ok {
+		return nil
+	}
+	if _, ok := triggerFault(faultCorrupt, userID); ok && len(msg) > 0 {
+		corrupted := append([]byte(nil), msg...)
+		corrupted[rand.Intn(len(corrupted))] ^= 0xff
+		return corrupted
+	}
+	return msg
+}
+
+// faultRedisHook 按 fail_redis 规则让redis命令直接返回错误
+type faultRedisHook struct{}
+
+func (faultRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (faultRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if _, ok := triggerFault(faultFailRedis, ""); ok {
+			cmd.SetErr(errFaultInjected)
+			return errFaultInjected
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (faultRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if _, ok := triggerFault(faultFailRedis, ""); ok {
+			for _, cmd := range cmds {
+				cmd.SetErr(errFaultInjected)
+			}
+			return errFaultInjected
+		}
+		return next(ctx, cmds)
+	}
+}
+
+var _ redis.Hook = faultRedisHook{}
+
+// enableFaultInjection 配置开启故障注入时安装redis钩子。默认关闭，规则只能通过管理接口下发
+func enableFaultInjection() {
+	if !config.Handler.FaultInjection {
+		return
+	}
+	redisClient.Rdb.AddHook(faultRedisHook{})
+	logger.Sugar().Warnf("故障注入已开启，可通过 /admin/faults 下发规则，不应在生产环境使用")
+}
+
+// handleAdminFaults GET 查看当前规则，PUT 以请求体中的规则列表整体替换，DELETE 清空规则
+func handleAdminFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules := []faultRule{}
+		if current := faultRules.Load(); current != nil {
+			rules = *current
+		}
+		writeJSON(w, http.StatusOK, rules)
+	case http.MethodPut:
+		var rules []faultRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(rules) == 0 {
+			faultRules.Store(nil)
+		} else {
+			faultRules.Store(&rules)
+		}
+		writeJSON(w, http.StatusOK, rules)
+	case http.MethodDelete:
+		faultRules.Store(nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis"
+	"hash/fnv"
+	"sort"
+)
+
+// FeatureFlagProvider 登录时查询用户开启的功能开关，开关变更在用户下次登录时生效
+type FeatureFlagProvider interface {
+	Flags(ctx context.Context, userID string) (map[string]bool, error)
+}
+
+// SetFeatureFlagProvider 替换功能开关来源，默认读取redis中的放量配置，需在服务启动之前调用
+func (s *Server) SetFeatureFlagProvider(p FeatureFlagProvider) {
+	s.flags = p
+}
+
+// SetFeatureFlagProvider 替换默认实例的功能开关来源。
+//
+// Deprecated: 使用 Default().SetFeatureFlagProvider
+func SetFeatureFlagProvider(p FeatureFlagProvider) {
+	defaultServer.SetFeatureFlagProvider(p)
+}
+
+// redisFeatureFlags 白名单中的用户总是开启，其余用户按 开关名+用户ID 的哈希落入放量百分比内时开启
+type redisFeatureFlags struct{}
+
+func (redisFeatureFlags) Flags(ctx context.Context, userID string) (map[string]bool, error) {
+	rollouts, err := redisClient.GetFeatureRollouts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return flagsFromRollouts(userID, rollouts), nil
+}
+
+// flagsFromRollouts 按放量配置计算用户开启的开关
+func flagsFromRollouts(userID string, rollouts map[string]redisClient.FeatureRollout) map[string]bool {
+	flags := make(map[string]bool)
+	for name, rollout := range rollouts {
+		if rollout.Allowed || rolloutBucket(name, userID) < rollout.Percent {
+			flags[name] = true
+		}
+	}
+	return flags
+}
+
+// rolloutBucket 用户在某个开关下的放量分桶(0-99)。
+// 哈希中带上开关名，使不同开关的首批用户互不相同；同一开关提高百分比时已开启的用户保持开启
+func rolloutBucket(name string, userID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	_, _ = h.Write([]byte{':'})
+	_, _ = h.Write([]byte(userID))
+	return int(h.Sum32() % 100)
+}
+
+// loadFeatureFlags 查询用户开启的功能开关，查询失败时视为全部关闭
+func (s *Server) loadFeatureFlags(ctx context.Context, userID string) map[string]bool {
+	flags, err := s.flags.Flags(ctx, userID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询功能开关失败，按全部关闭处理: %v", err)
+		return nil
+	}
+	return flags
+}
+
+// enabledFlags 已开启的开关名，按字母排序，用于登录响应
+func enabledFlags(flags map[string]bool) []string {
+	names := make([]string, 0, len(flags))
+	for name, on := range flags {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/topics"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// forwardDelivery 将投递信封转发到目标容器。目标在本区域(或未启用多区域)时直接发布到容器topic；
+// 在其他区域时发布到该区域的联邦topic，由该区域重新查询接收者所在容器后投递。
+// 发往本区域容器的信封要求接收容器确认，超时未确认时改为离线保存，见 expireForward
+func (s *Server) forwardDelivery(ctx context.Context, delivery *pb.Delivery, target string) error {
+	return s.forwardWire(ctx, nil, delivery, target)
+}
+
+// forwardWire 同 forwardDelivery，base 为转发时收到的信封，复用以保留不认识的字段
+func (s *Server) forwardWire(ctx context.Context, base *pb.WireEnvelope, delivery *pb.Delivery, target string) error {
+	scope := "local"
+	topic := topics.BuildContainerTopic(target)
+	if identity.Region() != "" {
+		region, err := identity.RegionOf(ctx, target)
+		if err != nil {
+			ctxLogger(ctx).Warnf("查询容器 %s 所在区域失败，按本区域转发: %v", target, err)
+		} else if region != identity.Region() {
+			if int(delivery.GetHops()) >= config.Handler.MaxFederationHops {
+				metrics.Inc("federation_dropped_total", "reason", "hops")
+				return fmt.Errorf("投递信封已跨区域转发 %d 次，不再转发到区域 %s", delivery.GetHops(), region)
+			}
+			delivery = proto.Clone(delivery).(*pb.Delivery)
+			delivery.Hops++
+			scope = "cross_region"
+			topic = topics.BuildFederationTopic(region)
+		}
+	}
+
+	// 跨区域与联邦重新转发的信封不要求确认：确认无法送回其他区域的容器
+	forwardID := ""
+	if base == nil && scope == "local" {
+		forwardID = s.trackForward(delivery, target)
+	}
+	message := &pb.RequestMessage{}
+	if base != nil {
+		message = proto.Clone(base.GetPayload()).(*pb.RequestMessage)
+	}
+	message.Payload = &pb.RequestMessage_Delivery{Delivery: delivery}
+	data, err := EncodeWire(base, message)
+	if err != nil {
+		cancelForward(forwardID)
+		return fmt.Errorf("投递信封序列化失败: %w", err)
+	}
+	start := time.Now()
+	err = publishMessage(ctx, data, topic)
+	metrics.Observe("delivery_forward_ms", float64(time.Since(start).Milliseconds()), "scope", scope)
+	if err != nil {
+		metrics.Inc("delivery_forward_total", "scope", scope, "result", "error")
+		cancelForward(forwardID)
+		return fmt.Errorf("转发到容器 %s 失败: %w", target, err)
+	}
+	metrics.Inc("delivery_forward_total", "scope", scope, "result", "ok")
+	return nil
+}
+
+// InplaceHandleFederatedDelivery 联邦消费者收到其他区域转来的投递信封，在本区域重新查询接收者所在容器后投递；
+// 接收者已不在本区域时按跳数限制继续转发，不在线时离线保存。联邦topic按区域订阅，由默认实例处理
+func InplaceHandleFederatedDelivery(wire *pb.WireEnvelope) error {
+	return defaultServer.handleFederatedDelivery(wire)
+}
+
+func (s *Server) handleFederatedDelivery(wire *pb.WireEnvelope) error {
+	delivery := wire.GetPayload().GetDelivery()
+	if delivery.GetMessage() == nil {
+		return errors.New("投递信封中没有消息")
+	}
+	if delivery.GetAllLocal() {
+		return errors.New("全员广播不经过联邦转发")
+	}
+	if delivery.GetServerTs() > 0 {
+		metrics.Observe("federation_latency_ms", float64(time.Now().UnixMilli()-delivery.GetServerTs()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+
+	recipients := delivery.GetRecipients()
+	if len(recipients) == 0 {
+		recipients = []*pb.DeliveryRecipient{{UserId: delivery.GetUserId(), Seq: delivery.GetSeq()}}
+	}
+	var errs []error
+	for _, recipient := range recipients {
+		single := proto.Clone(delivery).(*pb.Delivery)
+		single.Recipients = nil
+		single.UserId = recipient.GetUserId()
+		single.Seq = recipient.GetSeq()
+		if err := s.redeliverFederated(ctx, wire, single); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redeliverFederated 按本区域的登记重新投递单个接收者
+func (s *Server) redeliverFederated(ctx context.Context, wire *pb.WireEnvelope, delivery *pb.Delivery) error {
+	userID := delivery.GetUserId()
+	targets, err := remoteContainers(ctx, userID, delivery.GetDeviceId(), "")
+	if err != nil {
+		return err
+	}
+	env := &Envelope{
+		Message:      delivery.GetMessage(),
+		Priority:     Priority(delivery.GetPriority()),
+		ServerTs:     delivery.GetServerTs(),
+		Seq:          delivery.GetSeq(),
+		Conversation: delivery.GetConversation(),
+		ConvSeq:      delivery.GetConvSeq(),
+	}
+	if env.Priority < 0 || env.Priority >= priorityCount {
+		env.Priority = PriorityInteractive
+	}
+	if len(targets) == 0 {
+		result, err := s.storeOffline(ctx, userID, delivery.GetDeviceId(), env)
+		metrics.Inc("delivery_total", "result", result.String())
+		return err
+	}
+	var errs []error
+	for _, target := range targets {
+		if target == identity.ContainerID() {
+			errs = append(errs, s.receiveDelivery(ctx, userID, delivery.GetDeviceId(), env))
+			continue
+		}
+		errs = append(errs, s.forwardWire(ctx, wire, delivery, target))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/topics"
+	"sync"
+	"time"
+)
+
+// pendingForward 已转发到其他容器、尚未收到确认的投递信封
+type pendingForward struct {
+	server   *Server // 发起转发的实例，超时后由它离线保存
+	delivery *pb.Delivery
+	target   string
+	timer    *time.Timer
+}
+
+var (
+	pendingForwardsMu sync.Mutex
+	pendingForwards   = make(map[string]*pendingForward) // {转发ID: 待确认的转发}
+)
+
+// trackForward 为发往本区域容器的投递信封分配转发ID并登记待确认，未启用确认时返回空。
+// 信封中的消息在确认或超时前不能再被修改
+func (s *Server) trackForward(delivery *pb.Delivery, target string) string {
+	timeout := config.Handler.ForwardConfirmTimeout
+	if timeout <= 0 {
+		return ""
+	}
+	id := newConnID()
+	delivery.ForwardId = id
+	delivery.ReplyTo = identity.ContainerID()
+	pendingForwardsMu.Lock()
+	pendingForwards[id] = &pendingForward{
+		server:   s,
+		delivery: delivery,
+		target:   target,
+		timer:    time.AfterFunc(timeout, func() { expireForward(id) }),
+	}
+	metrics.SetGauge("delivery_forward_pending", float64(len(pendingForwards)))
+	pendingForwardsMu.Unlock()
+	return id
+}
+
+// takeForward 取出并删除待确认的转发，已确认或已超时时返回nil
+func takeForward(id string) *pendingForward {
+	pendingForwardsMu.Lock()
+	defer pendingForwardsMu.Unlock()
+	f, ok := pendingForwards[id]
+	if !ok {
+		return nil
+	}
+	delete(pendingForwards, id)
+	metrics.SetGauge("delivery_forward_pending", float64(len(pendingForwards)))
+	f.timer.Stop()
+	return f
+}
+
+// cancelForward 发布失败时撤销登记，由调用方按发布失败处理
+func cancelForward(id string) {
+	takeForward(id)
+}
+
+// ConfirmForward 消费者收到接收容器发回的确认
+func ConfirmForward(ack *pb.ForwardAck) {
+	f := takeForward(ack.GetForwardId())
+	if f == nil {
+		// 超时后才到达的确认：消息已离线保存，客户端可能收到重复消息，按序号去重
+		metrics.Inc("delivery_forward_late_ack_total")
+		return
+	}
+	metrics.Inc("delivery_forward_confirmed_total", "target", f.target)
+}
+
+// AckForward 本容器处理完其他容器转来的投递信封后向转发方发回确认，信封不需要确认时什么也不做
+func AckForward(delivery *pb.Delivery) {
+	if delivery.GetForwardId() == "" || delivery.GetReplyTo() == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	message := &pb.RequestMessage{
+		Payload: &pb.RequestMessage_ForwardAck{ForwardAck: &pb.ForwardAck{ForwardId: delivery.GetForwardId()}},
+	}
+	if err := publishRequest(ctx, nil, message, topics.BuildContainerTopic(delivery.GetReplyTo())); err != nil {
+		logger.Sugar().Warnf("向容器 %s 发送转发确认失败: %v", delivery.GetReplyTo(), err)
+	}
+}
+
+// expireForward 转发超时未确认：目标容器可能已崩溃或消费停滞，为避免消息丢失改为离线保存，
+// 并检查目标容器上的登记是否仍然有效
+func expireForward(id string) {
+	f := takeForward(id)
+	if f == nil {
+		return
+	}
+	metrics.Inc("delivery_forward_unconfirmed_total", "target", f.target)
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	sugar := logger.Sugar().With("target", f.target, "forward_id", id)
+
+	delivery := f.delivery
+	priority := Priority(delivery.GetPriority())
+	if priority < 0 || priority >= priorityCount {
+		priority = PriorityInteractive
+	}
+	recipients := delivery.GetRecipients()
+	if len(recipients) == 0 {
+		recipients = []*pb.DeliveryRecipient{{UserId: delivery.GetUserId(), Seq: delivery.GetSeq()}}
+	}
+	users := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		users = append(users, recipient.GetUserId())
+		_, err := f.server.storeOffline(ctx, recipient.GetUserId(), delivery.GetDeviceId(), &Envelope{
+			Message:      delivery.GetMessage(),
+			Priority:     priority,
+			ServerTs:     delivery.GetServerTs(),
+			Seq:          recipient.GetSeq(),
+			Conversation: delivery.GetConversation(),
+			ConvSeq:      delivery.GetConvSeq(),
+		})
+		if err != nil {
+			sugar.Warnf("转发未确认，离线保存给用户 %s 失败: %v", recipient.GetUserId(), err)
+		}
+	}
+	sugar.Warnf("转发到容器 %s 的投递在 %v 内未确认，已改为离线保存", f.target, config.Handler.ForwardConfirmTimeout)
+	checkSuspectRegistrations(ctx, f.target, users)
+}
+
+// checkSuspectRegistrations 转发未确认后检查目标容器：已不存活时删除用户登记在该容器上的设备，
+// 之后的消息不再转发过去；仍存活时保留登记，多半是消费积压，由指标告警
+func checkSuspectRegistrations(ctx context.Context, target string, users []string) {
+	sugar := logger.Sugar().With("target", target)
+	alive, err := identity.IsAlive(ctx, target)
+	if err != nil {
+		sugar.Warnf("检查容器是否存活失败: %v", err)
+		return
+	}
+	if alive {
+		metrics.Inc("registration_suspect_total", "result", "alive")
+		return
+	}
+	for _, userID := range users {
+		devices, err := redisClient.GetDeliveryDevices(ctx, userID)
+		if err != nil {
+			sugar.Warnf("查询用户 %s 的设备登记失败: %v", userID, err)
+			continue
+		}
+		for deviceID, containerID := range devices {
+			if containerID != target {
+				continue
+			}
+			if err := redisClient.RemoveRegistration(ctx, userID, deviceID, target); err != nil {
+				sugar.Warnf("删除失效登记 %s 失败: %v", redisClient.DeviceKey(userID, deviceID), err)
+				continue
+			}
+			metrics.Inc("registration_suspect_total", "result", "removed")
+			sugar.Infof("容器已不存活，删除失效登记 %s", redisClient.DeviceKey(userID, deviceID))
+		}
+	}
+}
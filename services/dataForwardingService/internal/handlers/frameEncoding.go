@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// 握手时通过 Sec-WebSocket-Protocol 协商报文编码，未声明子协议的客户端按 protobuf 二进制处理
+const (
+	subprotocolProto = "betterfly.proto"
+	subprotocolJSON  = "betterfly.json"
+)
+
+// frameEncoding 连接协商的报文编码
+type frameEncoding int
+
+const (
+	encodingProto frameEncoding = iota // protobuf，只收发二进制帧
+	encodingJSON                       // protobuf 的JSON映射，只收发文本帧
+)
+
+func (e frameEncoding) String() string {
+	if e == encodingJSON {
+		return "json"
+	}
+	return "proto"
+}
+
+// frameType 该编码使用的WebSocket帧类型
+func (e frameEncoding) frameType() int {
+	if e == encodingJSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// negotiatedEncoding 握手完成后按选定的子协议确定编码
+func negotiatedEncoding(conn *websocket.Conn) frameEncoding {
+	if conn.Subprotocol() == subprotocolJSON {
+		return encodingJSON
+	}
+	return encodingProto
+}
+
+// ErrUnexpectedFrame 帧类型与协商的编码不符
+var ErrUnexpectedFrame = errors.New("帧类型与协商的编码不符")
+
+// decodeFrame 按连接协商的编码解析一帧。帧类型不符时第一次只告警，之后返回 ErrCloseConnection 要求断开
+func decodeFrame(client *Client, messageType int, data []byte) (*pb.RequestMessage, error) {
+	if messageType != client.encoding.frameType() {
+		metrics.Inc("unexpected_frame_total", "encoding", client.encoding.String())
+		if client.frameViolations.Add(1) > 1 {
+			return nil, fmt.Errorf("%w: %w", ErrUnexpectedFrame, ErrCloseConnection)
+		}
+		client.log().Warnf("%s 连接收到类型为 %d 的帧，已丢弃，再次出现将断开连接", client.encoding, messageType)
+		return nil, ErrUnexpectedFrame
+	}
+	if client.encoding == encodingJSON {
+		return decodeJSONRequest(data)
+	}
+	return HandleRequestData(data)
+}
+
+// decodeJSONRequest 解析JSON编码的请求，大小与嵌套深度限制与二进制报文一致
+func decodeJSONRequest(data []byte) (*pb.RequestMessage, error) {
+	if len(data) > maxRequestBytes() {
+		metrics.Inc("decode_rejected_total", "reason", "too_large")
+		return nil, fmt.Errorf("%w: %d > %d 字节", ErrPayloadTooLarge, len(data), maxRequestBytes())
+	}
+	req := &pb.RequestMessage{}
+	opts := protojson.UnmarshalOptions{RecursionLimit: config.Handler.DecodeMaxDepth}
+	if err := opts.Unmarshal(data, req); err != nil {
+		metrics.Inc("decode_rejected_total", "reason", "unmarshal")
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return req, nil
+}
+
+// encodeFrame 将已序列化的响应转换为连接协商的编码，返回帧类型与内容
+func encodeFrame(client *Client, data []byte) (int, []byte, error) {
+	if client.encoding != encodingJSON {
+		return websocket.BinaryMessage, data, nil
+	}
+	rsp := &pb.ResponseMessage{}
+	if err := proto.Unmarshal(data, rsp); err != nil {
+		return 0, nil, err
+	}
+	text, err := protojson.Marshal(rsp)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, text, nil
+}
+
+// installControlHandlers 显式处理控制帧：ping 回复 pong，pong(包括未经请求的)只视为活动，
+// close 回送相同的关闭码后由读协程按对端关闭处理。控制帧都不进入报文处理流程
+func installControlHandlers(client *Client) {
+	conn := client.conn
+	conn.SetPingHandler(func(appData string) error {
+		client.touch()
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		client.touch()
+		return nil
+	})
+	conn.SetCloseHandler(func(code int, text string) error {
+		if code == websocket.CloseNoStatusReceived {
+			code = websocket.CloseNormalClosure
+		}
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		return nil
+	})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawConn 不经过websocket库、直接按RFC 6455收发帧的客户端，可以发出任意类型的帧
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// rawDial 建立连接并完成握手，subprotocol 为空时不声明子协议
+func rawDial(t *testing.T, s *Server, subprotocol string) *rawConn {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(s.handleConnection))
+	t.Cleanup(ts.Close)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		waitFor(t, "连接表清空", func() bool { return s.clients.Len() == 0 })
+	})
+	handshake := "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")) + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	if subprotocol != "" {
+		handshake += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(handshake + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil || rsp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("握手失败: %v %v", rsp, err)
+	}
+	if got := rsp.Header.Get("Sec-WebSocket-Protocol"); got != subprotocol {
+		t.Fatalf("协商的子协议为 %q，期望 %q", got, subprotocol)
+	}
+	return &rawConn{t: t, conn: conn, r: r}
+}
+
+// write 发送一个带掩码的完整帧
+func (c *rawConn) write(opcode int, payload []byte) {
+	c.t.Helper()
+	frame := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("发送帧失败: %v", err)
+	}
+}
+
+// read 读取一帧，服务端发出的帧不带掩码
+func (c *rawConn) read() (int, []byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return int(head[0] & 0x0f), payload, nil
+}
+
+// readUntil 读取帧直到 match 返回true
+func (c *rawConn) readUntil(what string, match func(opcode int, payload []byte) bool) []byte {
+	c.t.Helper()
+	for {
+		opcode, payload, err := c.read()
+		if err != nil {
+			c.t.Fatalf("等待%s时读取失败: %v", what, err)
+		}
+		if match(opcode, payload) {
+			return payload
+		}
+	}
+}
+
+// echo 按 encoding 发送一条回显请求，等待以同一编码返回的回显响应
+func (c *rawConn) echo(encoding frameEncoding, body string) {
+	c.t.Helper()
+	req := &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte(body)}}}
+	marshal, unmarshal := proto.Marshal, proto.Unmarshal
+	if encoding == encodingJSON {
+		marshal, unmarshal = protojson.Marshal, protojson.Unmarshal
+	}
+	data, err := marshal(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(encoding.frameType(), data)
+	c.readUntil("回显", func(opcode int, payload []byte) bool {
+		rsp := &pb.ResponseMessage{}
+		if opcode != encoding.frameType() || unmarshal(payload, rsp) != nil {
+			return false
+		}
+		return string(rsp.GetEcho().GetBody()) == body
+	})
+}
+
+// expectClose 读取直到收到关闭帧，检查关闭码
+func (c *rawConn) expectClose(code int) {
+	c.t.Helper()
+	payload := c.readUntil("关闭帧", func(opcode int, _ []byte) bool { return opcode == websocket.CloseMessage })
+	if len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		c.t.Fatalf("关闭帧为 %v，期望关闭码 %d", payload, code)
+	}
+}
+
+func TestUnexpectedFrameType(t *testing.T) {
+	withRedis(t)
+	for _, c := range []struct {
+		subprotocol string
+		encoding    frameEncoding
+	}{
+		{"", encodingProto},
+		{subprotocolProto, encodingProto},
+		{subprotocolJSON, encodingJSON},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", c.subprotocol, c.encoding), func(t *testing.T) {
+			s := NewServer()
+			conn := rawDial(t, s, c.subprotocol)
+			conn.echo(c.encoding, "first")
+
+			// 第一次帧类型不符只丢弃，连接照常工作
+			wrong := websocket.TextMessage
+			if c.encoding == encodingJSON {
+				wrong = websocket.BinaryMessage
+			}
+			conn.write(wrong, []byte("garbage"))
+			conn.echo(c.encoding, "second")
+
+			// 再次出现以协议错误关闭
+			conn.write(wrong, []byte("garbage"))
+			conn.expectClose(websocket.CloseProtocolError)
+			waitFor(t, "连接被关闭", func() bool { return s.clients.Len() == 0 })
+		})
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	conn := rawDial(t, s, "")
+
+	// 未经请求的pong直接丢弃
+	conn.write(websocket.PongMessage, []byte("unsolicited"))
+	conn.echo(encodingProto, "after pong")
+
+	// ping原样回复pong，不进入报文处理，也不计入帧类型违规
+	for i := 0; i < 3; i++ {
+		appData := fmt.Sprintf("ping-%d", i)
+		conn.write(websocket.PingMessage, []byte(appData))
+		conn.readUntil("pong", func(opcode int, payload []byte) bool {
+			return opcode == websocket.PongMessage && string(payload) == appData
+		})
+	}
+	conn.echo(encodingProto, "after ping")
+	if n := s.clients.All()[0].frameViolations.Load(); n != 0 {
+		t.Fatalf("控制帧被计为 %d 次帧类型违规", n)
+	}
+
+	// close帧回送相同的关闭码，服务端随后断开
+	conn.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	conn.expectClose(websocket.CloseNormalClosure)
+	waitFor(t, "连接被关闭", func() bool { return s.clients.Len() == 0 })
+	if _, _, err := conn.read(); err == nil {
+		t.Fatal("回送关闭帧后连接仍在发送数据")
+	}
+}
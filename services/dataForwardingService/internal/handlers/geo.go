@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/geoip"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// GeoLocation IP对应的粗略位置，未知的字段为空
+type GeoLocation struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+}
+
+// GeoResolver 由IP解析粗略位置，不应访问外部服务，未能解析时返回零值
+type GeoResolver interface {
+	Resolve(ip netip.Addr) (GeoLocation, error)
+}
+
+// noGeo 默认实现，不解析位置
+type noGeo struct{}
+
+func (noGeo) Resolve(netip.Addr) (GeoLocation, error) {
+	return GeoLocation{}, nil
+}
+
+// defaultGeoResolver 配置了 GeoIPDatabases 时使用 .mmdb 文件解析，由 GeoIP 组件加载，否则不解析
+func defaultGeoResolver() GeoResolver {
+	var paths []string
+	for _, path := range strings.Split(config.Handler.GeoIPDatabases, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return noGeo{}
+	}
+	return &mmdbResolver{paths: paths}
+}
+
+// SetGeoResolver 设置IP位置解析，默认按 GeoIPDatabases 解析或不解析，需在服务启动之前调用
+func (s *Server) SetGeoResolver(r GeoResolver) {
+	s.geo = r
+}
+
+// SetGeoResolver 设置默认实例的IP位置解析。
+//
+// Deprecated: 使用 Default().SetGeoResolver
+func SetGeoResolver(r GeoResolver) {
+	defaultServer.SetGeoResolver(r)
+}
+
+// geoEnabled 是否需要解析位置，未启用或使用默认的 noGeo 时不解析
+func (s *Server) geoEnabled() bool {
+	if !config.Handler.GeoIPEnabled {
+		return false
+	}
+	_, none := s.geo.(noGeo)
+	return !none
+}
+
+// mmdbFile 已加载的数据库文件，文件的修改时刻与大小变化时重新加载
+type mmdbFile struct {
+	path    string
+	reader  *geoip.Reader
+	modTime time.Time
+	size    int64
+}
+
+// mmdbResolver 按 .mmdb 文件解析，多个文件的结果按顺序合并，先出现的非空字段优先。
+// 加载完成前解析结果为零值
+type mmdbResolver struct {
+	paths []string
+	files atomic.Pointer[[]mmdbFile]
+}
+
+func (m *mmdbResolver) Resolve(ip netip.Addr) (GeoLocation, error) {
+	files := m.files.Load()
+	if files == nil {
+		return GeoLocation{}, nil
+	}
+	var location GeoLocation
+	for _, file := range *files {
+		found, ok, err := file.reader.Location(ip, "en")
+		if err != nil {
+			return location, err
+		}
+		if !ok {
+			continue
+		}
+		if location.Country == "" {
+			location.Country = found.Country
+		}
+		if location.Region == "" {
+			location.Region = found.Region
+		}
+		if location.City == "" {
+			location.City = found.City
+		}
+		if location.ASN == 0 {
+			location.ASN = found.ASN
+		}
+	}
+	return location, nil
+}
+
+// reload 重新读取修改时刻或大小有变化的文件，读取失败的文件保留上一次加载的版本(如有)，
+// 返回重新加载的文件数与遇到的错误
+func (m *mmdbResolver) reload() (int, error) {
+	var old []mmdbFile
+	if files := m.files.Load(); files != nil {
+		old = *files
+	}
+	previous := func(path string) (mmdbFile, bool) {
+		for _, file := range old {
+			if file.path == path {
+				return file, true
+			}
+		}
+		return mmdbFile{}, false
+	}
+
+	files := make([]mmdbFile, 0, len(m.paths))
+	loaded := 0
+	var errs []error
+	for _, path := range m.paths {
+		prev, hasPrev := previous(path)
+		info, err := os.Stat(path)
+		if err == nil && hasPrev && info.ModTime().Equal(prev.modTime) && info.Size() == prev.size {
+			files = append(files, prev)
+			continue
+		}
+		var reader *geoip.Reader
+		if err == nil {
+			reader, err = geoip.Open(path)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if hasPrev {
+				files = append(files, prev)
+			}
+			continue
+		}
+		files = append(files, mmdbFile{path: path, reader: reader, modTime: info.ModTime(), size: info.Size()})
+		loaded++
+		logger.Sugar().Infof("已加载GeoIP数据库 %s(%s，生成于 %s)", path, reader.DatabaseType,
+			time.Unix(int64(reader.BuildEpoch), 0).Format(time.DateOnly))
+	}
+	if loaded > 0 {
+		m.files.Store(&files)
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// GeoIP 位置数据库组件：启动时加载 GeoIPDatabases，之后每隔 GeoIPReloadInterval 检查文件，
+// 变化后重新加载并原子替换，正在进行的解析不受影响。加载失败只记录日志，连接照常建立、不带位置。
+// GeoIPEnabled 为false或使用自定义 GeoResolver 时不加载
+func (s *Server) GeoIP() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name: "geoip",
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			resolver, ok := s.geo.(*mmdbResolver)
+			if !ok || !config.Handler.GeoIPEnabled {
+				return nil
+			}
+			if _, err := resolver.reload(); err != nil {
+				metrics.Inc("geoip_reload_total", "result", "error")
+				logger.Sugar().Warnf("加载GeoIP数据库失败，连接将不带位置信息: %v", err)
+			}
+			if config.Handler.GeoIPReloadInterval > 0 {
+				go watchGeoDatabases(ctx, resolver)
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
+
+func watchGeoDatabases(ctx context.Context, resolver *mmdbResolver) {
+	ticker := time.NewTicker(config.Handler.GeoIPReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		loaded, err := resolver.reload()
+		if err != nil {
+			metrics.Inc("geoip_reload_total", "result", "error")
+			logger.Sugar().Warnf("重新加载GeoIP数据库失败，继续使用旧版本: %v", err)
+		}
+		if loaded > 0 {
+			metrics.Inc("geoip_reload_total", "result", "ok")
+		}
+	}
+}
+
+// resolveLocation 解析连接来源IP的位置，失败时返回零值
+func (c *Client) resolveLocation() GeoLocation {
+	ip, err := netip.ParseAddr(c.remoteIP())
+	if err != nil {
+		return GeoLocation{}
+	}
+	location, err := c.server.geo.Resolve(ip.Unmap())
+	if err != nil {
+		metrics.Inc("geoip_lookups_total", "result", "error")
+		c.log().Debugf("解析IP位置失败: %v", err)
+		return GeoLocation{}
+	}
+	if location == (GeoLocation{}) {
+		metrics.Inc("geoip_lookups_total", "result", "miss")
+	} else {
+		metrics.Inc("geoip_lookups_total", "result", "hit")
+	}
+	return location
+}
+
+// startLocate 建立连接时在后台解析位置并缓存在连接上，不阻塞握手
+func (c *Client) startLocate() {
+	if c.synthetic || !c.server.geoEnabled() {
+		return
+	}
+	go func() {
+		location := c.resolveLocation()
+		c.location.Store(&location)
+	}()
+}
+
+// locate 连接来源IP的位置，后台解析尚未完成时就地解析，只应在后台流程中调用。未启用时返回零值
+func (c *Client) locate() GeoLocation {
+	if location := c.location.Load(); location != nil {
+		return *location
+	}
+	if c.synthetic || !c.server.geoEnabled() {
+		return GeoLocation{}
+	}
+	return c.resolveLocation()
+}
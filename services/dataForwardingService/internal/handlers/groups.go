@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrNoGroupDirectory 未配置群组成员查询，无法处理群聊中的报文
+var ErrNoGroupDirectory = errors.New("未配置群组成员查询")
+
+// ErrNotGroupMember 用户不是该群成员
+var ErrNotGroupMember = errors.New("不是群成员")
+
+// GroupDirectory 查询群成员的后端
+type GroupDirectory interface {
+	Members(ctx context.Context, groupID int64) ([]int64, error)
+}
+
+// SetGroupDirectory 设置群成员后端，未设置时群聊相关的报文会被拒绝，需在服务启动之前调用
+func (s *Server) SetGroupDirectory(d GroupDirectory) {
+	s.groups = d
+}
+
+// SetGroupDirectory 设置默认实例的群成员后端。
+//
+// Deprecated: 使用 Default().SetGroupDirectory
+func SetGroupDirectory(d GroupDirectory) {
+	defaultServer.SetGroupDirectory(d)
+}
+
+// conversation 单聊或群聊会话
+type conversation struct {
+	IsGroup bool
+	ToID    int64 // 群聊为群ID，单聊为对方用户ID
+}
+
+// key 会话在redis中的标识。单聊双方看到的to_id不同，按两人ID排序后得到同一个标识
+func (c conversation) key(fromID int64) string {
+	if c.IsGroup {
+		return "g:" + strconv.FormatInt(c.ToID, 10)
+	}
+	a, b := min(fromID, c.ToID), max(fromID, c.ToID)
+	return "p:" + strconv.FormatInt(a, 10) + ":" + strconv.FormatInt(b, 10)
+}
+
+// parseConversationKey 从会话标识还原 userID 看到的会话，单聊标识中不包含 userID 时返回false
+func parseConversationKey(key string, userID int64) (conversation, bool) {
+	if rest, ok := strings.CutPrefix(key, "g:"); ok {
+		id, err := strconv.ParseInt(rest, 10, 64)
+		return conversation{IsGroup: true, ToID: id}, err == nil
+	}
+	rest, ok := strings.CutPrefix(key, "p:")
+	if !ok {
+		return conversation{}, false
+	}
+	first, second, ok := strings.Cut(rest, ":")
+	a, errA := strconv.ParseInt(first, 10, 64)
+	b, errB := strconv.ParseInt(second, 10, 64)
+	switch {
+	case !ok || errA != nil || errB != nil:
+		return conversation{}, false
+	case a == userID:
+		return conversation{ToID: b}, true
+	case b == userID:
+		return conversation{ToID: a}, true
+	}
+	return conversation{}, false
+}
+
+// participants 会话的所有参与者(含 fromID 自己)，群聊时经实例的群组目录校验 fromID 是否为群成员
+func (s *Server) participants(ctx context.Context, c conversation, fromID int64) ([]string, error) {
+	if !c.IsGroup {
+		ids := []string{strconv.FormatInt(fromID, 10)}
+		if c.ToID != fromID {
+			ids = append(ids, strconv.FormatInt(c.ToID, 10))
+		}
+		return ids, nil
+	}
+	if s.groups == nil {
+		return nil, ErrNoGroupDirectory
+	}
+	members, err := s.groups.Members(ctx, c.ToID)
+	if err != nil {
+		return nil, err
+	}
+	recordGroupSize(c.ToID, len(members))
+	if !slices.Contains(members, fromID) {
+		return nil, ErrNotGroupMember
+	}
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, strconv.FormatInt(member, 10))
+	}
+	return ids, nil
+}
@@ -3,61 +3,139 @@ package handlers
 import (
 	pb "Betterfly2/proto/data_forwarding"
 	"Betterfly2/shared/logger"
+	"context"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/i18n"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/logsample"
+	"data_forwarding_service/internal/metrics"
 	"data_forwarding_service/internal/publisher"
 	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/topics"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
-	"google.golang.org/protobuf/proto"
+	"go.uber.org/zap"
 	"net/http"
-	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client 连接管理
 type Client struct {
+	server     *Server         // 接受该连接的实例，建立连接后不变
+	ctx        context.Context // 连接上下文，连接关闭时取消
+	cancel     context.CancelFunc
 	conn       *websocket.Conn
-	sendChan   chan []byte
-	shouldStop bool // 当shouldStop为true时，读、写协程立刻退出工作
-	loggedIn   bool // 是否已登录
+	encoding   frameEncoding                 // 握手时协商的报文编码，建立连接后不变
+	buffer     *sendBuffer                   // 按优先级划分的发送队列
+	profile    atomic.Pointer[clientProfile] // 客户端登录时的声明，登录前为nil
+	loginAt    atomic.Int64                  // 登录时刻(毫秒)，未登录时为0
+	loggedIn   bool                          // 是否已登录，只在读协程中读写
+	flags      map[string]bool               // 登录时查询的功能开关，登录后只读
+	transfers  *chunkAssembler
+	limiters   map[string]*tokenBucket // {限流类别: 令牌桶}
+	inFlight   chan struct{}           // 并发名额，容量为 MaxInFlight
+	connID     string                  // 连接ID，建立连接时随机生成
+	synthetic  bool                    // 本进程金丝雀建立的连接，不计入业务指标与事件，不受限流约束
+	sugar      atomic.Pointer[zap.SugaredLogger]
+	tap        atomic.Pointer[userTap] // 管理员旁路监听，为nil时无额外开销
+	writerDone chan struct{}           // 写协程退出时关闭
+	warnings   limitWarnings           // 已推送的软限制告警
+	quality    connQuality             // 连接质量判定
+	session    sessionExpiry           // 会话有效期，访问令牌登录或管理员要求重新认证时设置
+
+	heartbeat         atomic.Int64  // 协商后的心跳间隔(纳秒)，登录前为0表示使用默认值
+	adaptiveHeartbeat atomic.Bool   // 自适应心跳，只在空闲满一个间隔后发送ping
+	lastActivity      atomic.Int64  // 最后一次收到报文的时刻(纳秒)
+	spoke             atomic.Bool   // 收到过可解析的报文，未登录时据此区分匿名连接与游客会话
+	frameViolations   atomic.Int32  // 收到与编码不符的帧的次数
+	subscriptions     atomic.Uint32 // 订阅的事件类别，见 subscriptionSet
+	pipeline          atomic.Uint32 // 登录时确定的投递流水线，见 Pipeline
+
+	nonce    atomic.Pointer[loginNonce]  // 当前有效的登录挑战，使用后置空
+	location atomic.Pointer[GeoLocation] // 来源IP的粗略位置，建立连接后在后台解析，完成前或未启用时为nil
+
+	registrationPending atomic.Bool         // 降级登录，redis登记仍在后台重试
+	pending             sync.WaitGroup      // 异步处理中的请求，关闭发送队列前需等待其结束
+	loginInProgress     atomic.Bool         // 登录处理中，内存压力淘汰时跳过
+	loginRsp            *pb.ResponseMessage // 登录成功的响应，重复登录时直接重发
+	loginFingerprint    [sha256.Size]byte   // 登录成功时的登录报文摘要
+
+	closeOnce   sync.Once
+	closeReason CloseReason // 断开原因，Close 中写入
+	// 以下字段由 ClientManager 在其锁内修改
+	key      string // 在连接表中的键，登录后会改变
+	userID   string // 登录后填充
+	deviceID string // 登录后填充
+	removed  bool   // 已从连接表删除
 }
 
-// 用于存储 WebSocket 连接的map
-var (
-	clients      = make(map[string]*Client) // {(用户ID: 客户端)
-	clientsMutex sync.Mutex                 // 互斥锁
-)
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// clientProfile 客户端登录时声明、之后不变的信息。投递、广播与管理接口会在其他协程中读取，整体原子替换
+type clientProfile struct {
+	class    string // 客户端类别，决定发送队列容量
+	chunking bool   // 支持分片传输
+	locale   string // 语言，决定系统文本的语言，为空时使用默认语言
 }
 
-// StartWebSocketServer 启动WebSocket服务器
-func StartWebSocketServer() error {
-	http.HandleFunc("/ws", handleConnection)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "54342"
+// declared 客户端登录时的声明，未登录时为零值
+func (c *Client) declared() clientProfile {
+	if p := c.profile.Load(); p != nil {
+		return *p
 	}
+	return clientProfile{}
+}
 
-	certFile := os.Getenv("CERT_PATH")
-	if certFile == "" {
-		certFile = "./certs/cert.pem"
-	}
+// defaultDeviceID 未声明设备ID的旧客户端统一视为同一设备
+const defaultDeviceID = "default"
 
-	keyFile := os.Getenv("KEY_PATH")
-	if keyFile == "" {
-		keyFile = "./certs/key.pem"
+// normalizeDeviceID 校验设备ID，只允许字母、数字、下划线与连字符
+func normalizeDeviceID(deviceID string) (string, bool) {
+	if deviceID == "" {
+		return defaultDeviceID, true
+	}
+	if len(deviceID) > 64 {
+		return "", false
+	}
+	for _, c := range deviceID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", false
+		}
 	}
+	return deviceID, true
+}
 
-	return http.ListenAndServeTLS(":"+port, certFile, keyFile, nil)
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	ReadBufferSize:  config.Handler.WSReadBufferSize,
+	WriteBufferSize: config.Handler.WSWriteBufferSize,
+	// 写缓冲区只在写入期间从池中借用，空闲连接不常驻写缓冲区
+	WriteBufferPool: &sync.Pool{},
+	Subprotocols:    []string{subprotocolProto, subprotocolJSON},
 }
 
-// 请求处理
-func handleConnection(w http.ResponseWriter, r *http.Request) {
+// handleConnection 升级为WebSocket连接并登记到实例的连接表
+func (s *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 	sugar := logger.Sugar()
+	if s.isDraining() {
+		// 排空中不再接受新连接
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	if !admit(w, r) {
+		return
+	}
+	// 携带连接授权令牌或访问令牌时升级前校验，失败返回401
+	auth, ok := authorizeConnect(w, r)
+	if !ok {
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		sugar.Errorf("连接错误: %s", err)
@@ -65,60 +143,90 @@ func handleConnection(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 连接时用ip:port临时作为键
-	userID := conn.RemoteAddr().String()
+	key := conn.RemoteAddr().String()
 
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &Client{
+		server:     s,
+		ctx:        ctx,
+		cancel:     cancel,
 		conn:       conn,
-		sendChan:   make(chan []byte, 256),
-		shouldStop: false,
+		encoding:   negotiatedEncoding(conn),
+		key:        key,
 		loggedIn:   false,
+		transfers:  newChunkAssembler(),
+		limiters:   newClientLimiters(),
+		inFlight:   make(chan struct{}, config.Handler.MaxInFlight),
+		connID:     newConnID(),
+		writerDone: make(chan struct{}),
+		synthetic:  isCanaryRequest(r),
 	}
+	client.buffer = newSendBuffer(config.Handler.SendBufferSize, func() { writeToClient(client) })
+	containerID := identity.ContainerID()
+	client.sugar.Store(logger.Sugar().With("conn_id", client.connID, "remote_addr", key, "container", containerID))
+	tuneSocket(conn, client.log())
+	conn.SetReadLimit(config.Handler.MaxFrameBytes)
+	client.startLocate()
 
 	// 未登录时直接保存
-	clientsMutex.Lock()
-	clients[userID] = client
-	clientsMutex.Unlock()
+	s.clients.Add(key, client)
+
+	client.log().Infof("已与 %v 建立连接", conn.RemoteAddr())
+	if !client.synthetic {
+		s.publishEvent(ClientConnected{
+			RemoteAddr: key,
+			At:         time.Now(),
+		})
+	}
+	if logsample.Allow(logsample.Connection, nil) {
+		client.log().Infof("收到的Request内容为: %v", *r)
+	}
 
-	sugar.Infof("已与 %v 建立连接", conn.RemoteAddr())
-	sugar.Infof("收到的Request内容为: %v", *r)
+	client.touch()
+	installControlHandlers(client)
+	if auth != nil {
+		// 在读协程启动前完成登录，避免与带内登录并发；登录失败时连接保留，客户端仍可带内登录
+		loginPreauthorized(client, auth, r.URL.Query())
+	}
 
-	// 启动两个 goroutine
-	go readProcess(client, userID)
-	go writeToClient(client, userID)
+	go readProcess(client)
+	go writeToClient(client)
+	go keepalive(client)
+	if s.loginChallengeEnabled() {
+		issueLoginChallenge(client)
+	}
 }
 
 // 读取处理协程
-func readProcess(client *Client, userID string) {
-	sugar := logger.Sugar()
+func readProcess(client *Client) {
+	sugar := client.log()
+	reason := ClosePeerClosed
 	defer func() {
-		clientsMutex.Lock()
-		delete(clients, userID)
-		clientsMutex.Unlock()
-		client.conn.Close()
-
-		// 如果已登录才会在redis中注册
-		if client.loggedIn {
-			containerID := os.Getenv("HOSTNAME")
-			if containerID == "" {
-				containerID = "message-topic"
-			}
-			redisClient.UnregisterConnection(userID, containerID)
+		if reason == ClosePeerLogout {
+			flushAndClose(client, reason)
+			return
 		}
-
-		sugar.Infof("(%v, %v)连接已关闭", userID, client.conn.RemoteAddr())
+		// 若连接已被其他路径关闭，这里不会覆盖原因
+		client.Close(reason)
+		client.transfers.Close()
+		// 等待异步处理结束后再关闭发送队列，写协程随之退出
+		client.pending.Wait()
+		client.closeLanes()
 	}()
 
+	undecodable := 0 // 连续无法解析的帧数，收到可解析的帧时清零
 	for {
 		// 处理消息接收与转发
-		_, p, err := client.conn.ReadMessage()
+		messageType, p, err := client.conn.ReadMessage()
+		client.touch()
 
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				sugar.Infof("连接关闭，读协程退出")
 			} else {
 				sugar.Errorln("获取信息异常: ", err)
+				reason = CloseReadError
 			}
-			close(client.sendChan)
 			break
 		}
 
@@ -126,172 +234,514 @@ func readProcess(client *Client, userID string) {
 			continue
 		}
 
-		requestMsg, err := HandleRequestData(p)
+		requestMsg, err := decodeFrame(client, messageType, p)
+		if errors.Is(err, ErrCloseConnection) {
+			sugar.Warnf("帧类型多次与协商的编码不符，断开连接")
+			reason = CloseProtocolError
+			break
+		}
+		if errors.Is(err, ErrUnexpectedFrame) {
+			continue
+		}
 		if err != nil {
-			sugar.Warnf("收到非标准化数据: %v", err)
+			undecodable++
+			metrics.Inc("undecodable_frames_total", "reason", decodeErrorReason(err))
+			sugar.Warnf("收到非标准化数据(连续第 %d 帧): %v", undecodable, err)
+			if limit := config.Handler.MaxUndecodableFrames; limit > 0 && undecodable >= limit {
+				reason = CloseProtocolError
+				break
+			}
+			if err := client.Enqueue(undecodableResponse(p, err)); err != nil {
+				sugar.Warnf("发送拒绝响应失败: %v", err)
+			}
 			continue
 		}
+		undecodable = 0
+		client.spoke.Store(true)
+		recordInbound(client, requestMsg, len(p))
+		if t := client.tap.Load(); t != nil {
+			t.record(client, "in", requestMsg)
+		}
 
-		// 如果未登录，只处理三种报文
-		if !client.loggedIn {
-			switch requestMsg.Payload.(type) {
-			case *pb.RequestMessage_Login:
-				rsp, realUserID, err := HandleLoginMessage(requestMsg)
-				logger.Sugar().Infof("rsp: %s", rsp.String())
-				if err != nil {
-					logger.Sugar().Errorf("登录出现错误: %v", err)
-					rspBytes, _ := proto.Marshal(rsp)
-					client.sendChan <- rspBytes
-					continue
+		if info, ok := lookupHandler(requestMsg); ok && !info.OrderSensitive && !info.Lightweight {
+			// 与顺序无关的报文异步处理，不阻塞后续报文。启动协程前先占用并发名额，名额已满时读协程短暂等待，
+			// 仍无名额则直接拒绝，每个连接的处理协程数不超过 MaxInFlight；轻量报文直接在读协程中处理
+			if !client.acquireInFlight(client.ctx) {
+				if client.ctx.Err() != nil {
+					break
 				}
-				oldUserID := userID
-				userID = strconv.FormatInt(realUserID, 10)
-				err = checkAndResolveConflict(userID, client)
-				if err != nil {
-					logger.Sugar().Errorf("登录解决冲突失败: %v", err)
-				} else {
-					// 删除旧键值对
-					clientsMutex.Lock()
-					delete(clients, oldUserID)
-					clientsMutex.Unlock()
-					client.loggedIn = true
+				if err := client.Enqueue(refused(pb.RefusedReason_TOO_MANY_IN_FLIGHT)); err != nil {
+					sugar.Warnf("发送拒绝响应失败: %v", err)
 				}
-				// 返回登录结果
-				rspBytes, _ := proto.Marshal(rsp)
-				client.sendChan <- rspBytes
-			case *pb.RequestMessage_Signup:
-				rsp, err := HandleSignupMessage(requestMsg)
-				logger.Sugar().Infof("rsp: %s", rsp.String())
-				if err != nil {
-					logger.Sugar().Errorf("注册出现错误：: %v", err)
-				}
-				rspBytes, _ := proto.Marshal(rsp)
-				client.sendChan <- rspBytes
-			case *pb.RequestMessage_Logout:
-				// 终止掉当前连接
-				break
-			default:
-				logger.Sugar().Errorln("未登录时不处理其他类型信息")
-				rsp := &pb.ResponseMessage{
-					Payload: &pb.ResponseMessage_Refused{},
-				}
-				rspBytes, _ := proto.Marshal(rsp)
-				client.sendChan <- rspBytes
-			}
-		} else {
-			intUserID, err := strconv.ParseInt(userID, 10, 64)
-			if err != nil {
-				logger.Sugar().Errorf("无法将 %s 转为int64: %v", userID, err)
 				continue
 			}
-			res, err := RequestMessageHandler(intUserID, requestMsg)
-			if err != nil {
-				logger.Sugar().Errorf("消息处理错误: %v", err)
+			client.pending.Add(1)
+			go func() {
+				defer client.pending.Done()
+				defer client.releaseInFlight()
+				processMessage(context.WithValue(client.ctx, inFlightHeldKey{}, true), client, requestMsg)
+			}()
+			continue
+		}
+		if batch := requestMsg.GetBatch(); batch != nil {
+			err = processBatch(client, batch, len(p))
+		} else {
+			err = processMessage(client.ctx, client, requestMsg)
+		}
+		if errors.Is(err, ErrCloseConnection) {
+			if errors.Is(err, ErrLogout) {
+				reason = ClosePeerLogout
 			}
-			if res == 1 {
-				// res为1代表后续收到logout报文，需要断开连接
-				break
+			break
+		}
+	}
+}
+
+// flushAndClose 不再接收新报文，等待发送队列中剩余的报文发完(有时限)后再关闭连接
+func flushAndClose(client *Client, reason CloseReason) {
+	client.transfers.Close()
+	client.pending.Wait()
+	client.closeLanes()
+	select {
+	case <-client.writerDone:
+	case <-time.After(config.Handler.LogoutFlushTimeout):
+		client.log().Warnf("等待发送队列清空超时")
+		metrics.Inc("logout_flush_timeout_total")
+	}
+	client.Close(reason)
+}
+
+// processMessage 经中间件链处理一条消息并发送响应，返回处理函数的错误
+func processMessage(ctx context.Context, client *Client, requestMsg *pb.RequestMessage) error {
+	ctx = withLogger(ctx, client.log())
+	rsp, err := client.server.chain(ctx, client, requestMsg)
+	if rsp != nil {
+		if sendErr := client.Enqueue(rsp); sendErr != nil {
+			client.log().Errorf("发送响应失败: %v", sendErr)
+		}
+	}
+	if err != nil && !errors.Is(err, ErrCloseConnection) {
+		client.log().Errorf("消息处理错误: %v", err)
+	}
+	return err
+}
+
+// handleLogin 处理账号密码登录或恢复令牌登录，成功时更新连接键
+func handleLogin(ctx context.Context, client *Client, requestMsg *pb.RequestMessage) bool {
+	start := time.Now()
+	sugar := client.log()
+	login := requestMsg.GetLogin()
+	deviceID, ok := normalizeDeviceID(login.GetDeviceId())
+	if !ok {
+		sugar.Errorf("设备ID非法: %q", login.GetDeviceId())
+		replyLogin(client, refused(pb.RefusedReason_REFUSED_UNSPECIFIED))
+		return false
+	}
+
+	var rsp *pb.ResponseMessage
+	var realUserID int64 = -1
+	resumeContainer := ""
+	if login.GetResumeToken() != "" {
+		var claims *resumeClaims
+		rsp, claims = HandleResumeMessage(ctx, requestMsg)
+		if claims != nil {
+			realUserID, _ = strconv.ParseInt(claims.UserID, 10, 64)
+			deviceID = claims.DeviceID
+			resumeContainer = claims.ContainerID
+		}
+	} else {
+		var err error
+		rsp, realUserID, err = authenticate(ctx, client, requestMsg)
+		if errors.Is(err, ErrTwoFactorRequired) {
+			beginTwoFactor(ctx, client, requestMsg, rsp.GetLogin(), deviceID)
+			return false
+		}
+		if err != nil {
+			sugar.Errorf("登录出现错误: %v", err)
+			if rsp.GetLogin() == nil {
+				rsp = loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR)
 			}
+			replyLogin(client, rsp)
+			return false
 		}
-		// TODO: DEBUG模式
-		sugar.Infoln("收到WebSocket消息:", string(p))
 	}
+	if rsp.GetRefused() != nil {
+		replyLogin(client, rsp)
+		return false
+	}
+	if rsp.GetLogin() == nil {
+		sugar.Errorf("登录处理未返回结果")
+		replyLogin(client, loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR))
+		return false
+	}
+	logLoginResult(sugar, rsp, nil)
+	if realUserID < 0 {
+		// 账号不存在、密码错误、令牌无效等
+		replyLogin(client, rsp)
+		return false
+	}
+	ok = completeLogin(ctx, client, rsp, realUserID, deviceID, resumeContainer, clientCaps{
+		Chunking:          login.GetSupportChunking(),
+		Class:             login.GetClientClass(),
+		HeartbeatMs:       login.GetHeartbeatIntervalMs(),
+		AdaptiveHeartbeat: login.GetAdaptiveHeartbeat(),
+		Locale:            login.GetLocale(),
+	})
+	if ok && login.GetResumeToken() != "" {
+		if resumeContainer != "" && resumeContainer != identity.ContainerID() {
+			// 断线期间的消息由旧容器投递，本容器的缓存不完整
+			replay.invalidate(strconv.FormatInt(realUserID, 10))
+		}
+		if login.GetLastSeq() > 0 {
+			replayMissed(ctx, client, login.GetLastSeq())
+		}
+	}
+	// 重连风暴时以该指标的p99观察登录延迟
+	metrics.Observe("login_latency_ms", float64(time.Since(start).Milliseconds()), "resume", strconv.FormatBool(login.GetResumeToken() != ""))
+	return ok
 }
 
-// 监听 channel 发送消息协程
-func writeToClient(client *Client, userID string) {
-	sugar := logger.Sugar()
-	defer func() {
-		sugar.Infof("连接关闭，写协程退出")
-	}()
-	for msg := range client.sendChan {
-		err := client.conn.WriteMessage(websocket.BinaryMessage, msg)
+// clientCaps 客户端登录时声明的能力
+type clientCaps struct {
+	Chunking          bool   // 支持分片传输
+	Class             string // 客户端类别，如 iot、mobile、desktop
+	HeartbeatMs       int64  // 请求的心跳间隔，为0时使用服务端默认值
+	AdaptiveHeartbeat bool   // 请求自适应心跳
+	Locale            string // 客户端语言
+}
+
+// completeLogin 认证通过后的登录流程：解决设备冲突、登记连接、签发恢复令牌并返回登录结果
+func completeLogin(ctx context.Context, client *Client, rsp *pb.ResponseMessage, realUserID int64, deviceID string, resumeContainer string, caps clientCaps) bool {
+	sugar := client.log()
+	userID := strconv.FormatInt(realUserID, 10)
+	if reservedUserID(realUserID) {
+		sugar.Warnf("用户ID %d 为系统保留，拒绝登录", realUserID)
+		metrics.Inc("forbidden_sender_total", "type", "login")
+		replyLogin(client, loginErrorResponse(pb.LoginResult_ACCOUNT_NOT_EXIST))
+		return false
+	}
+	if wait, damped := dampLogin(ctx, client, userID, deviceID); damped {
+		// 不触碰已有的登记，旧连接保持在线
+		replyLogin(client, tooManyReconnects(wait))
+		return false
+	}
+	// 连接登记到设备键后即可被投递找到，登录状态需在此之前写好
+	containerID := identity.ContainerID()
+	hydrated := client.server.hydrateLogin(ctx, userID, deviceID, containerID)
+	client.flags = hydrated.flags
+	client.profile.Store(&clientProfile{class: caps.Class, chunking: caps.Chunking, locale: i18n.Normalize(caps.Locale)})
+	client.heartbeat.Store(int64(negotiateHeartbeat(caps.HeartbeatMs)))
+	client.adaptiveHeartbeat.Store(caps.AdaptiveHeartbeat)
+	client.buffer.resize(sendBufferSize(caps.Class))
+	client.subscriptions.Store(uint32(loginSubscriptions(hydrated.subscriptions, hydrated.hasSubscriptions, caps.Class)))
+	client.pipeline.Store(uint32(resolvePipeline(userID, hydrated.pipelinePin)))
+
+	err := checkAndResolveConflict(ctx, userID, deviceID, client, resumeContainer)
+	degraded := errors.Is(err, ErrRegistrationPending)
+	if err != nil && !degraded {
+		sugar.Errorf("登录解决冲突失败: %v", err)
+		// 登录校验虽已通过，但连接未能登记，按服务端错误返回
+		replyLogin(client, loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR))
+		return false
+	}
+	client.loggedIn = true
+	client.loginAt.Store(time.Now().UnixMilli())
+	client.bindUserLogger(userID, deviceID)
+	if t := lookupTap(userID); t != nil {
+		client.tap.Store(t)
+	}
+	sugar = client.log()
+	ctx = withLogger(ctx, sugar)
+
+	if degraded {
+		// redis暂不可用，先允许登录，后台继续登记
+		sugar.Warnf("%v", err)
+		metrics.Inc("login_degraded_total")
+		client.registrationPending.Store(true)
+		rsp.GetLogin().Degraded = true
+		go retryRegistration(client, userID, deviceID, containerID)
+	}
+	if loginRsp := rsp.GetLogin(); loginRsp != nil && hydrated.resumeToken != "" {
+		loginRsp.ResumeToken = hydrated.resumeToken
+	}
+
+	if !client.synthetic {
+		client.server.publishEvent(ClientLoggedIn{
+			ConnID:     client.connID,
+			RemoteAddr: client.conn.RemoteAddr().String(),
+			UserID:     userID,
+			DeviceID:   deviceID,
+			Platform:   client.declared().class,
+			At:         time.Now(),
+		})
+	}
+
+	if loginRsp := rsp.GetLogin(); loginRsp != nil {
+		loginRsp.Capabilities = serverCapabilities()
+		loginRsp.Capabilities.HeartbeatIntervalMs = client.heartbeatInterval().Milliseconds()
+		loginRsp.Capabilities.AdaptiveHeartbeat = client.adaptiveHeartbeat.Load()
+		loginRsp.FeatureFlags = enabledFlags(client.flags)
+		loginRsp.Subscriptions = subscriptionSet(client.subscriptions.Load()).categories()
+	}
+
+	// 返回登录结果
+	client.loginRsp = rsp
+	replyLogin(client, rsp)
+	runLoginHooks(client)
+	return true
+}
+
+// loginErrorResponse 构造只带结果码的登录响应
+func loginErrorResponse(result pb.LoginResult) *pb.ResponseMessage {
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Login{
+			Login: &pb.LoginRsp{
+				Result: result,
+			},
+		},
+	}
+}
+
+// replyLogin 发送登录结果，失败时只记录日志
+func replyLogin(client *Client, rsp *pb.ResponseMessage) {
+	if err := client.Enqueue(rsp); err != nil {
+		client.log().Errorf("发送登录结果失败: %v", err)
+	}
+}
+
+// writeToClient 写协程，按优先级从发送队列取出报文发送。连接空闲时退出，下一次入队时由发送队列重新启动
+func writeToClient(client *Client) {
+	sugar := client.log()
+	var residual [][]byte
+	for {
+		queued, closed, parked := client.buffer.pop()
+		msg := queued.data
+		if parked {
+			return
+		}
+		if closed {
+			persistResidual(client, residual)
+			close(client.writerDone)
+			sugar.Infof("连接关闭，写协程退出")
+			return
+		}
+		if client.ctx.Err() != nil {
+			// 连接已关闭，继续消费队列直到读协程关闭发送队列，避免发送方阻塞；未发出的报文在退出前转存
+			residual = append(residual, msg)
+			residual = append(residual, client.buffer.drain()...)
+			continue
+		}
+		if queued.expired(time.Now()) {
+			metrics.Inc("outbound_expired_total")
+			continue
+		}
+		if msg = injectWriteFault(client, msg); msg == nil {
+			continue
+		}
+		if t := client.tap.Load(); t != nil {
+			t.tapOutbound(client, msg)
+		}
+		messageType, frame, err := encodeFrame(client, msg)
+		if err != nil {
+			sugar.Errorf("转换报文编码失败: %v", err)
+			continue
+		}
+		start := time.Now()
+		if timeout := config.Handler.WriteTimeout; timeout > 0 {
+			// 连接卡住时写入按期失败，随即断开并清理
+			_ = client.conn.SetWriteDeadline(start.Add(timeout))
+		}
+		err = client.writeFrame(messageType, frame)
+		client.observeWrite(time.Since(start))
 		if err != nil {
 			sugar.Errorln("发送消息错误: ", err)
+			client.Close(CloseWriteError)
+			residual = append(residual, msg)
+			continue
 		}
+		queued.timing.observe(time.Now())
 	}
 }
 
 // 调用消息队列发布接口完成消息发布
-func publishMessage(message []byte, targetTopic string) error {
-	return publisher.PublishMessage(string(message), targetTopic)
+func publishMessage(ctx context.Context, message []byte, targetTopic string) error {
+	if _, ok := triggerFault(faultFailPublish, ""); ok {
+		return errFaultInjected
+	}
+	return publisher.PublishMessage(ctx, string(message), targetTopic)
 }
 
-// SendMessage 外部发送消息接口
-func SendMessage(userID string, message []byte) error {
-	clientsMutex.Lock()
-	client, ok := clients[userID]
-	clientsMutex.Unlock()
-	if !ok {
+// SendMessage 向默认实例中的用户发送消息。
+//
+// Deprecated: 使用 Default().SendMessage
+func SendMessage(userID string, env *Envelope) error {
+	return defaultServer.SendMessage(userID, env)
+}
+
+// SendToDevice 向默认实例中用户的指定设备发送消息。
+//
+// Deprecated: 使用 Default().SendToDevice
+func SendToDevice(userID string, deviceID string, env *Envelope) error {
+	return defaultServer.SendToDevice(userID, deviceID, env)
+}
+
+// StopClient 关闭默认实例中的连接。
+//
+// Deprecated: 使用 Default().StopClient
+func StopClient(key string, reason CloseReason) {
+	defaultServer.StopClient(key, reason)
+}
+
+// SendMessage 外部发送消息接口，经出站拦截器处理后发送到用户在本容器的所有设备
+func (s *Server) SendMessage(userID string, env *Envelope) error {
+	userClients := s.clients.UserClients(userID)
+	if len(userClients) == 0 {
 		return fmt.Errorf("客户端%v不存在", userID)
 	}
+	frame, err := s.prepareOutbound(userID, env)
+	if err != nil || frame == nil {
+		return err
+	}
 
 	// 通过 channel 发送消息
-	client.sendChan <- message
+	for _, client := range userClients {
+		if client.subscribedTo(frame.message) {
+			// 失败已计入指标，不影响其他设备
+			_ = client.Enqueue(frame.message, withEncoded(frame.bytesFor(client)), WithPriority(env.Priority), WithTTL(frame.ttl), withTiming(frame.timing))
+		}
+	}
 	return nil
 }
 
-// StopClient 外部关闭特定连接
-func StopClient(userID string) {
-	clientsMutex.Lock()
-	client, ok := clients[userID]
-	clientsMutex.Unlock()
+// SendToDevice 外部发送消息接口，只发送到用户的指定设备
+func (s *Server) SendToDevice(userID string, deviceID string, env *Envelope) error {
+	client, ok := s.clients.DeviceClient(userID, deviceID)
 	if !ok {
-		return
+		return fmt.Errorf("客户端%v不存在", redisClient.DeviceKey(userID, deviceID))
+	}
+	frame, err := s.prepareOutbound(userID, env)
+	if err != nil || frame == nil {
+		return err
+	}
+	if client.subscribedTo(frame.message) {
+		return client.Enqueue(frame.message, withEncoded(frame.bytesFor(client)), WithPriority(env.Priority), WithTTL(frame.ttl), withTiming(frame.timing))
 	}
-	client.conn.Close()
-	client.shouldStop = true
+	return nil
 }
 
-// checkAndResolveConflict 检验并解决连接冲突
-func checkAndResolveConflict(userID string, client *Client) error {
-	sugar := logger.Sugar()
-
-	containerID := os.Getenv("HOSTNAME")
-	if containerID == "" {
-		containerID = "message-topic"
+// StopClient 外部关闭特定连接，key 为 用户ID#设备ID 时只关闭该设备，仅为用户ID时关闭该用户所有设备
+func (s *Server) StopClient(key string, reason CloseReason) {
+	var targets []*Client
+	if userID, deviceID, ok := redisClient.SplitDeviceKey(key); ok {
+		if client, ok := s.clients.DeviceClient(userID, deviceID); ok {
+			targets = append(targets, client)
+		}
+	} else {
+		targets = s.clients.UserClients(key)
+	}
+	for _, client := range targets {
+		client.Close(reason)
 	}
+	if reason == CloseEvictedConflict {
+		// 连接已转移到其他容器，之后的消息不再经过本容器
+		userID, _, _ := redisClient.SplitDeviceKey(key)
+		replay.invalidate(userID)
+	}
+}
+
+// checkAndResolveConflict 检验并解决同一设备的连接冲突，同一用户的不同设备可以同时在线。
+// resumeContainer 为恢复令牌中记录的旧容器，非空时直接定向处理该容器，无需再查询redis
+func checkAndResolveConflict(ctx context.Context, userID string, deviceID string, client *Client, resumeContainer string) (err error) {
+	sugar := client.log()
+
+	s := client.server
+	// 切换期间发给该设备的投递先暂存，结束后发给新连接，避免在旧连接断开与新连接登记之间丢失
+	t := s.beginTransition(ctx, userID, deviceID)
+	defer func() {
+		s.endTransition(ctx, userID, t, err == nil || errors.Is(err, ErrRegistrationPending))
+	}()
+
+	containerID := identity.ContainerID()
+
+	deviceKey := redisClient.DeviceKey(userID, deviceID)
 
 	// 第一步：清理本地已有连接
-	clientsMutex.Lock()
-	if oldClient, ok := clients[userID]; ok {
-		sugar.Infof("已有本地连接，关闭旧连接: %v", userID)
-		oldClient.conn.Close()
-		delete(clients, userID)
-		if err := redisClient.UnregisterConnection(userID, containerID); err != nil {
-			sugar.Warnf("本地Redis注销失败（忽略继续）: %v", err)
-		}
+	var registerErr error
+	if oldClient, ok := s.clients.DeviceClient(userID, deviceID); ok && oldClient != client {
+		sugar.Infof("已有本地连接，关闭旧连接: %v", deviceKey)
+		oldClient.Close(CloseEvictedConflict)
 	}
-	clientsMutex.Unlock()
 
-	// 第二步：检测是否远程已注册
-	remoteContainer := redisClient.GetContainerByConnection(userID)
-	sugar.Infof("远程容器: %v", remoteContainer)
+	switch {
+	case resumeContainer == containerID:
+		// 恢复到原容器，旧连接已在第一步清理，跳过远程检查
+		metrics.Inc("resume_total", "same_container", "true")
+		if err := redisClient.RegisterConnection(ctx, userID, deviceID, containerID); err != nil {
+			registerErr = fmt.Errorf("注册 Redis 失败: %w", err)
+		}
+	case resumeContainer != "":
+		// 恢复到其他容器，原子接管登记后只通知令牌中记录的旧容器
+		metrics.Inc("resume_total", "same_container", "false")
+		oldContainer, err := redisClient.ClaimConnection(ctx, userID, deviceID, containerID)
+		if err != nil {
+			registerErr = fmt.Errorf("接管 Redis 登记失败: %w", err)
+		}
+		evictTargets := []string{resumeContainer}
+		if oldContainer != "" && oldContainer != containerID && oldContainer != resumeContainer {
+			evictTargets = append(evictTargets, oldContainer)
+		}
+		for _, target := range evictTargets {
+			if err := publishMessage(ctx, signControl(target, "DELETE USER "+deviceKey), topics.BuildContainerTopic(target)); err != nil {
+				sugar.Warnf("通知旧容器 %s 断开连接失败: %v", target, err)
+			}
+		}
+	default:
+		// 第二步：检测是否远程已注册
+		remoteContainer := redisClient.GetContainerByConnection(ctx, userID, deviceID)
+		sugar.Infof("远程容器: %v", remoteContainer)
+
+		if remoteContainer != "" && remoteContainer != containerID {
+			sugar.Infof("设备 %s 存在于其他容器 %s", deviceKey, remoteContainer)
 
-	if remoteContainer != "" && remoteContainer != containerID {
-		sugar.Infof("用户 %s 存在于其他容器 %s", userID, remoteContainer)
+			// 注销旧连接
+			if err := redisClient.UnregisterConnection(ctx, userID, deviceID, remoteContainer); err != nil {
+				return fmt.Errorf("注销 Redis 失败: %w", err)
+			}
 
-		// 注销旧连接
-		if err := redisClient.UnregisterConnection(userID, remoteContainer); err != nil {
-			return fmt.Errorf("注销 Redis 失败: %w", err)
+			// 通知旧容器断开连接
+			if err := publishMessage(ctx, signControl(remoteContainer, "DELETE USER "+deviceKey), topics.BuildContainerTopic(remoteContainer)); err != nil {
+				return fmt.Errorf("通知远程容器失败: %w", err)
+			}
 		}
 
-		// 通知旧容器断开连接
-		if err := publishMessage([]byte(fmt.Sprintf("DELETE USER %s", userID)), remoteContainer); err != nil {
-			return fmt.Errorf("通知远程容器失败: %w", err)
+		// 第三步：注册本连接
+		if err := redisClient.RegisterConnection(ctx, userID, deviceID, containerID); err != nil {
+			registerErr = fmt.Errorf("注册 Redis 失败: %w", err)
 		}
 	}
 
-	// 第三步：注册本连接
-	if err := redisClient.RegisterConnection(userID, containerID); err != nil {
-		return fmt.Errorf("注册 Redis 失败: %w", err)
+	// 第四步：保存本地连接，临时键原子地换为设备键。期间同一设备若有新连接抢先登记，将其踢下线后重试
+	for {
+		conflict, err := s.clients.Rename(client.key, deviceKey, client)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrKeyOccupied) {
+			sugar.Infof("保存连接时发现冲突，关闭旧连接: %v", deviceKey)
+			conflict.Close(CloseEvictedConflict)
+			continue
+		}
+		// 连接在登录过程中已关闭，撤销刚写入的登记
+		if unregErr := redisClient.UnregisterConnection(ctx, userID, deviceID, containerID); unregErr != nil {
+			sugar.Warnf("注销 Redis 失败: %v", unregErr)
+		}
+		return err
 	}
 
-	// 第四步：保存本地连接
-	clientsMutex.Lock()
-	clients[userID] = client
-	clientsMutex.Unlock()
-
-	sugar.Infof("连接 %s 注册并保存成功", userID)
+	if registerErr != nil {
+		// 本地已保存，由调用方决定降级登录
+		return fmt.Errorf("%w: %v", ErrRegistrationPending, registerErr)
+	}
+	sugar.Infof("连接 %s 注册并保存成功", deviceKey)
 	return nil
 }
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 登录过程中持续向该用户投递：一旦连接可被投递找到，登录时声明的状态必须已经写好
+func TestLoginStateSetBeforeRegistration(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	s.SetAccountService(NewMemoryAccountService(NewAccount{Account: "alice", Password: "pw"}))
+	conn := dialServer(t, s)
+	userID := strconv.Itoa(memoryUserIDBase)
+
+	var (
+		stop     atomic.Bool
+		wg       sync.WaitGroup
+		observed atomic.Int32
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echo := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte("x")}}}
+			for !stop.Load() {
+				client, ok := s.clients.DeviceClient(userID, "phone")
+				if !ok {
+					continue
+				}
+				if profile := client.declared(); profile.class != "mobile" || profile.locale != "en" || !profile.chunking {
+					t.Errorf("连接可被投递找到时登录状态尚未写好: %+v", profile)
+				}
+				_, _ = s.DeliverToUser(context.Background(), userID, echo, DeliveryOptions{})
+				observed.Add(1)
+			}
+		}()
+	}
+
+	sendRequest(t, conn, &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{
+		Account: "alice", Password: "pw", DeviceId: "phone", ClientClass: "mobile", Locale: "en", SupportChunking: true,
+	}}})
+	rsp := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetLogin() != nil })
+	if rsp.GetLogin().GetResult() != pb.LoginResult_LOGIN_OK {
+		t.Fatalf("登录失败: %v", rsp)
+	}
+	waitFor(t, "登录后的投递", func() bool { return observed.Load() > 0 })
+	stop.Store(true)
+	wg.Wait()
+}
+
+// 客户端重发相同的登录报文时只重发登录结果，不能把自己当作冲突的旧连接踢下线
+func TestDuplicateLoginDoesNotEvictSelf(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	s.SetAccountService(NewMemoryAccountService(NewAccount{Account: "alice", Password: "pw"}))
+	conn := dialServer(t, s)
+	userID := strconv.Itoa(memoryUserIDBase)
+
+	login := &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: "alice", Password: "pw", DeviceId: "phone"}}}
+	isLogin := func(rsp *pb.ResponseMessage) bool { return rsp.GetLogin() != nil }
+	sendRequest(t, conn, login)
+	first := readUntil(t, conn, isLogin).GetLogin()
+	if first.GetResult() != pb.LoginResult_LOGIN_OK {
+		t.Fatalf("登录失败: %v", first)
+	}
+	client, ok := s.clients.DeviceClient(userID, "phone")
+	if !ok {
+		t.Fatal("登录后连接未登记")
+	}
+
+	sendRequest(t, conn, login)
+	second := readUntil(t, conn, isLogin).GetLogin()
+	if second.GetResult() != pb.LoginResult_LOGIN_OK || second.GetResumeToken() != first.GetResumeToken() {
+		t.Fatalf("重复登录没有重发原登录结果: %v", second)
+	}
+
+	// 连接仍然在线且登记未变
+	sendRequest(t, conn, &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte("still here")}}})
+	echo := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetEcho() != nil })
+	if string(echo.GetEcho().GetBody()) != "still here" {
+		t.Fatalf("回显内容不符: %v", echo)
+	}
+	if current, ok := s.clients.DeviceClient(userID, "phone"); !ok || current != client {
+		t.Fatal("重复登录后连接表中的连接被替换")
+	}
+	if client.ctx.Err() != nil {
+		t.Fatal("重复登录把自己踢下线")
+	}
+}
+
+// registrations 连接在连接表中登记的次数：未登录键、设备键与用户设备表分别计数
+func registrations(m *ClientManager, client *Client) (pending int, clients int, devices int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.pending {
+		if c == client {
+			pending++
+		}
+	}
+	for _, c := range m.clients {
+		if c == client {
+			clients++
+		}
+	}
+	for _, byDevice := range m.userDevices {
+		for _, c := range byDevice {
+			if c == client {
+				devices++
+			}
+		}
+	}
+	return pending, clients, devices
+}
+
+// 连接从临时键切换到设备键时，重复的 Rename、投递与读取连接身份同时进行：
+// 连接始终只以一个键可达，读到的键、用户与设备彼此一致。需在 -race 下运行
+func TestRenameRacesDeliveryAndIdentity(t *testing.T) {
+	// 投递的是控制报文，测试中没有写协程读取，放宽积压上限以免触发 slow_consumer 断开
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ControlBufferMax = 1 << 30 })
+	s := NewServer()
+	const rounds = 200
+	for i := 0; i < rounds; i++ {
+		userID := strconv.Itoa(i)
+		tempKey := "10.0.0.1:" + userID
+		deviceKey := userID + "#phone"
+		client := &Client{server: s, buffer: newSendBuffer(rounds, func() {})}
+		s.clients.Add(tempKey, client)
+
+		var (
+			start   sync.WaitGroup
+			renames sync.WaitGroup
+			wg      sync.WaitGroup
+			done    atomic.Bool
+		)
+		start.Add(1)
+		for r := 0; r < 2; r++ {
+			renames.Add(1)
+			go func() {
+				defer renames.Done()
+				start.Wait()
+				if _, err := s.clients.Rename(tempKey, deviceKey, client); err != nil {
+					t.Errorf("切换到设备键失败: %v", err)
+				}
+			}()
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			start.Wait()
+			echo := &Envelope{Message: &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{}}}}
+			for first := true; first || !done.Load(); first = false {
+				_ = s.SendMessage(userID, echo)
+				runtime.Gosched()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			start.Wait()
+			for first := true; first || !done.Load(); first = false {
+				key, uid, deviceID := s.clients.Identity(client)
+				if uid == "" && key != tempKey || uid != "" && (key != deviceKey || uid != userID || deviceID != "phone") {
+					t.Errorf("读到不一致的连接身份: key=%q user=%q device=%q", key, uid, deviceID)
+				}
+				pending, clients, devices := registrations(s.clients, client)
+				if pending+clients != 1 || clients != devices {
+					t.Errorf("连接登记了 %d 个临时键、%d 个设备键、%d 个设备表条目", pending, clients, devices)
+				}
+				runtime.Gosched()
+			}
+		}()
+		start.Done()
+		renames.Wait()
+		done.Store(true)
+		wg.Wait()
+		if got, ok := s.clients.DeviceClient(userID, "phone"); !ok || got != client {
+			t.Fatalf("第 %d 轮切换后按设备找不到连接", i)
+		}
+		s.clients.Remove(client)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/redis"
+	"fmt"
+	"strconv"
+)
+
+// StoredMessage 消息存储中的一条会话消息
+type StoredMessage struct {
+	ConvSeq  int64
+	ServerTs int64
+	Message  *pb.ResponseMessage
+	Position int64 // 存储内的位置，作为下一页的 beforeSeq，通常等于 ConvSeq
+}
+
+// MessageStore 会话历史存储，转发路径在接收可持久化的消息时追加，FetchHistory 按会话序号从新到旧分页读取
+type MessageStore interface {
+	Append(ctx context.Context, conv string, msg StoredMessage) error
+	FetchConversation(ctx context.Context, conv string, beforeSeq int64, limit int) ([]StoredMessage, error)
+}
+
+// SetMessageStore 替换会话历史存储，默认使用redis stream，传入nil关闭历史，需在服务启动之前调用
+func (s *Server) SetMessageStore(store MessageStore) {
+	s.messages = store
+}
+
+// SetMessageStore 替换默认实例的会话历史存储。
+//
+// Deprecated: 使用 Default().SetMessageStore
+func SetMessageStore(s MessageStore) {
+	defaultServer.SetMessageStore(s)
+}
+
+// redisMessageStore 每个会话一个stream，只保留最近 HistoryMaxEntries 条，HistoryTTL 内无新消息时整体过期
+type redisMessageStore struct{}
+
+func (redisMessageStore) Append(ctx context.Context, conv string, msg StoredMessage) error {
+	data, err := EncodeStored(msg.Message)
+	if err != nil {
+		return fmt.Errorf("历史消息序列化失败: %w", err)
+	}
+	return redisClient.AppendHistory(ctx, conv, redisClient.HistoryEntry{
+		Seq:      msg.ConvSeq,
+		ServerTs: msg.ServerTs,
+		Data:     data,
+	}, config.Handler.HistoryMaxEntries, config.Handler.HistoryTTL)
+}
+
+func (redisMessageStore) FetchConversation(ctx context.Context, conv string, beforeSeq int64, limit int) ([]StoredMessage, error) {
+	entries, err := redisClient.ReadHistory(ctx, conv, beforeSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]StoredMessage, 0, len(entries))
+	for _, entry := range entries {
+		message, err := DecodeStored(entry.Data)
+		if err != nil {
+			ctxLogger(ctx).Warnf("会话 %s 中序号 %d 的历史消息无法解析，已跳过: %v", conv, entry.Seq, err)
+			continue
+		}
+		messages = append(messages, StoredMessage{
+			ConvSeq:  entry.Seq,
+			ServerTs: entry.ServerTs,
+			Message:  message,
+			Position: entry.Position,
+		})
+	}
+	return messages, nil
+}
+
+// persistable 需要保存到会话历史的消息类型
+func persistable(message *pb.ResponseMessage) bool {
+	switch message.GetPayload().(type) {
+	case *pb.ResponseMessage_Post, *pb.ResponseMessage_Encrypted:
+		return true
+	default:
+		return false
+	}
+}
+
+// persistMessage 将接收到的消息追加到会话历史，没有会话序号的消息无法分页，不保存。保存失败不影响投递
+func (s *Server) persistMessage(ctx context.Context, conv string, convSeq int64, serverTs int64, message *pb.ResponseMessage) {
+	if s.messages == nil || convSeq == 0 || !persistable(message) {
+		return
+	}
+	err := s.messages.Append(ctx, conv, StoredMessage{
+		ConvSeq:  convSeq,
+		ServerTs: serverTs,
+		Message:  message,
+	})
+	if err != nil {
+		ctxLogger(ctx).Warnf("保存会话 %s 的历史消息失败: %v", conv, err)
+	}
+}
+
+// handleFetchHistory 返回一页会话历史。先确认请求者是会话参与者；
+// 端到端加密消息按保存时的密文返回，且只保留发给请求设备的那一份
+func handleFetchHistory(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	req := message.GetFetchHistory()
+	conv := conversation{IsGroup: req.GetIsGroup(), ToID: req.GetToId()}
+	if _, err := client.server.participants(ctx, conv, fromID); err != nil {
+		return nil, fmt.Errorf("查询会话参与者失败: %w", err)
+	}
+	if client.server.messages == nil {
+		return refused(pb.RefusedReason_TEMPORARILY_UNAVAILABLE), nil
+	}
+
+	limit := int(req.GetLimit())
+	if limit <= 0 || limit > config.Handler.MaxHistoryPage {
+		limit = config.Handler.MaxHistoryPage
+	}
+	// 多取一条用于判断是否还有更早的消息
+	stored, err := client.server.messages.FetchConversation(ctx, conv.key(fromID), req.GetBeforeSeq(), limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("读取会话历史失败: %w", err)
+	}
+	page := &pb.HistoryPage{
+		IsGroup: req.GetIsGroup(),
+		ToId:    req.GetToId(),
+	}
+	if len(stored) > limit {
+		stored = stored[:limit]
+		page.HasMore = true
+	}
+	for _, msg := range stored {
+		rsp := msg.Message
+		rsp.ServerTs = msg.ServerTs
+		rsp.ConvSeq = msg.ConvSeq
+		if encrypted := rsp.GetEncrypted(); encrypted != nil {
+			encrypted.Ciphertexts = deviceCiphertexts(encrypted.GetCiphertexts(), client.deviceID)
+		}
+		page.Messages = append(page.Messages, rsp)
+		page.NextBeforeSeq = msg.Position
+		if page.NextBeforeSeq == 0 {
+			page.NextBeforeSeq = msg.ConvSeq
+		}
+	}
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_History{
+			History: page,
+		},
+	}, nil
+}
+
+// deviceCiphertexts 只保留发给指定设备的密文
+func deviceCiphertexts(ciphertexts []*pb.DeviceCiphertext, deviceID string) []*pb.DeviceCiphertext {
+	var kept []*pb.DeviceCiphertext
+	for _, ciphertext := range ciphertexts {
+		if ciphertext.GetDeviceId() == deviceID {
+			kept = append(kept, ciphertext)
+		}
+	}
+	return kept
+}
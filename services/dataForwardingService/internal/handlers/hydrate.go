@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"time"
+)
+
+// LoginHook 登录结果发出后在连接的后台协程中执行，用于离线消息回放、在线状态订阅等较重的初始化，不阻塞登录响应
+type LoginHook func(ctx context.Context, client *Client)
+
+// OnLogin 追加登录后钩子，需在服务启动之前调用
+func (s *Server) OnLogin(hooks ...LoginHook) {
+	s.loginHooks = append(s.loginHooks, hooks...)
+}
+
+// OnLogin 为默认实例追加登录后钩子。
+//
+// Deprecated: 使用 Default().OnLogin
+func OnLogin(hooks ...LoginHook) {
+	defaultServer.OnLogin(hooks...)
+}
+
+// runLoginHooks 在后台协程中依次执行登录后钩子，关闭发送队列前读协程会等待其结束
+func runLoginHooks(client *Client) {
+	if len(client.server.loginHooks) == 0 {
+		return
+	}
+	client.pending.Add(1)
+	go func() {
+		defer client.pending.Done()
+		ctx := withLogger(client.ctx, client.log())
+		for _, hook := range client.server.loginHooks {
+			hook(ctx, client)
+		}
+	}()
+}
+
+// loginHydration 登录后读取的连接状态
+type loginHydration struct {
+	flags            map[string]bool
+	resumeToken      string // 为空表示未能签发
+	subscriptions    string // 设备保存的事件订阅
+	hasSubscriptions bool   // 为false时按客户端类别取默认订阅
+	pipelinePin      string // 管理员指定的投递流水线，为空时按规则分配
+}
+
+// hydrateLogin 读取功能开关并签发恢复令牌。使用默认的redis功能开关时与令牌登记合并为一次redis往返，
+// 避免容器重启后大量客户端同时重连时每个登录都串行访问redis多次
+func (s *Server) hydrateLogin(ctx context.Context, userID string, deviceID string, containerID string) loginHydration {
+	sugar := ctxLogger(ctx)
+	start := time.Now()
+	defer func() {
+		metrics.Observe("login_hydrate_ms", float64(time.Since(start).Milliseconds()))
+	}()
+
+	ttl := config.Handler.ResumeTokenTTL
+	token, tokenID, err := newResumeToken(userID, deviceID, containerID, ttl)
+	if err != nil {
+		sugar.Warnf("签发恢复令牌失败: %v", err)
+		result := loginHydration{flags: s.loadFeatureFlags(ctx, userID), pipelinePin: loadPipelinePin(ctx, userID)}
+		result.loadSubscriptions(ctx, userID, deviceID)
+		return result
+	}
+	if _, ok := s.flags.(redisFeatureFlags); !ok {
+		// 自定义的功能开关来源无法合并进同一次往返
+		result := loginHydration{flags: s.loadFeatureFlags(ctx, userID), pipelinePin: loadPipelinePin(ctx, userID)}
+		result.loadSubscriptions(ctx, userID, deviceID)
+		if err := redisClient.StoreResumeToken(ctx, userID, deviceID, tokenID, ttl); err != nil {
+			sugar.Warnf("签发恢复令牌失败: %v", err)
+		} else {
+			result.resumeToken = token
+		}
+		return result
+	}
+	state, err := redisClient.HydrateLogin(ctx, userID, deviceID, tokenID, ttl)
+	if err != nil {
+		sugar.Warnf("读取登录状态失败，功能开关按全部关闭处理，不签发恢复令牌: %v", err)
+		return loginHydration{}
+	}
+	return loginHydration{
+		flags:            flagsFromRollouts(userID, state.Rollouts),
+		resumeToken:      token,
+		subscriptions:    state.Subscriptions,
+		hasSubscriptions: state.HasSubscriptions,
+		pipelinePin:      state.PipelinePin,
+	}
+}
+
+// loadSubscriptions 单独读取设备保存的事件订阅，失败时按默认订阅处理
+func (h *loginHydration) loadSubscriptions(ctx context.Context, userID string, deviceID string) {
+	saved, ok, err := redisClient.GetSubscriptions(ctx, userID, deviceID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("读取事件订阅失败，使用默认订阅: %v", err)
+		return
+	}
+	h.subscriptions, h.hasSubscriptions = saved, ok
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksMinRefetch 遇到未知 kid 时两次拉取 JWKS 的最小间隔，避免伪造 kid 的请求打满身份提供方
+const jwksMinRefetch = 30 * time.Second
+
+var errJWKSUnavailable = errors.New("JWKS 不可用")
+
+// jwksCache 身份提供方公钥的缓存。到期后重新拉取，拉取失败时继续使用已缓存的公钥；
+// 从未拉取成功时拒绝所有令牌。拉取在锁外进行且同一时刻只有一次，身份提供方响应慢时不会阻塞已缓存 kid 的校验
+type jwksCache struct {
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // {kid: 公钥}，拉取成功后整体替换
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	refreshing  chan struct{} // 进行中的拉取，完成时关闭，没有拉取时为nil
+	client      *http.Client
+}
+
+var jwks = &jwksCache{client: &http.Client{Timeout: 5 * time.Second}}
+
+// key 取 kid 对应的公钥。缓存过期时在后台刷新并继续使用缓存；找不到 kid 时等待刷新结果
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	if !ok || time.Since(c.fetchedAt) > config.Handler.JWKSRefresh {
+		if done := c.refreshLocked(); done != nil && !ok {
+			c.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			c.mu.Lock()
+			key, ok = c.keys[kid]
+		}
+	}
+	empty := len(c.keys) == 0
+	c.mu.Unlock()
+	if empty {
+		return nil, errJWKSUnavailable
+	}
+	if !ok {
+		return nil, fmt.Errorf("未知的 kid: %q", kid)
+	}
+	return key, nil
+}
+
+// refreshLocked 返回进行中的拉取；没有拉取且距上次尝试已满 jwksMinRefetch 时在后台开始一次，
+// 否则返回nil。需持有 c.mu。拉取不随某个请求取消，由 http.Client 的超时限制
+func (c *jwksCache) refreshLocked() <-chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+	if time.Since(c.lastAttempt) < jwksMinRefetch {
+		return nil
+	}
+	c.lastAttempt = time.Now()
+	done := make(chan struct{})
+	c.refreshing = done
+	go func() {
+		keys, err := c.fetch(context.Background())
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			metrics.Inc("jwks_fetch_total", "result", "error")
+			logger.Sugar().Warnf("拉取 JWKS 失败，继续使用缓存的 %d 个公钥: %v", len(c.keys), err)
+		} else {
+			metrics.Inc("jwks_fetch_total", "result", "ok")
+			c.keys, c.fetchedAt = keys, time.Now()
+		}
+		c.refreshing = nil
+		close(done)
+	}()
+	return done
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch 拉取并解析 JWKS，只保留 RSA 与 P-256 公钥
+func (c *jwksCache) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	url := config.Handler.JWKSURL
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS 返回状态码 %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("JWKS 解析失败: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Sugar().Warnf("跳过无法解析的公钥 %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS 中没有可用的公钥")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA 指数非法")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("不支持的曲线 %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC 公钥不在曲线上")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("不支持的密钥类型 %s", k.Kty)
+	}
+}
+
+// verifyJWT 校验 RS256/ES256 签名、有效期、受众与签发者，返回用户ID与令牌过期时刻。
+// 有效期检查容忍 JWTClockSkew 的时钟偏差
+func verifyJWT(ctx context.Context, token string) (userID string, expiresAt time.Time, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errors.New("JWT 格式错误")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", time.Time{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", time.Time{}, errors.New("JWT 签名编码错误")
+	}
+	key, err := jwks.key(ctx, header.Kid)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return "", time.Time{}, errors.New("JWT 签名错误")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return "", time.Time{}, errors.New("JWT 签名错误")
+		}
+	default:
+		return "", time.Time{}, errors.New("JWT 签名算法不受支持")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", time.Time{}, err
+	}
+	cfg := config.Handler
+	now := time.Now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return "", time.Time{}, errors.New("JWT 缺少 exp")
+	}
+	expiresAt = time.Unix(exp, 0)
+	if now.After(expiresAt.Add(cfg.JWTClockSkew)) {
+		return "", time.Time{}, errors.New("JWT 已过期")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(cfg.JWTClockSkew).Before(time.Unix(nbf, 0)) {
+		return "", time.Time{}, errors.New("JWT 尚未生效")
+	}
+	if cfg.JWTAudience != "" && !audienceContains(claims["aud"], cfg.JWTAudience) {
+		return "", time.Time{}, errors.New("JWT 受众不匹配")
+	}
+	if cfg.JWTIssuer != "" && claims["iss"] != cfg.JWTIssuer {
+		return "", time.Time{}, errors.New("JWT 签发者不匹配")
+	}
+	switch v := claims[cfg.JWTUserClaim].(type) {
+	case string:
+		userID = v
+	case json.Number:
+		userID = v.String()
+	}
+	if _, err := strconv.ParseInt(userID, 10, 64); err != nil {
+		return "", time.Time{}, fmt.Errorf("JWT 的 %s 不是合法的用户ID", cfg.JWTUserClaim)
+	}
+	// 允许偏差内的过期令牌登录后立即进入会话过期流程
+	return userID, expiresAt.Add(cfg.JWTClockSkew), nil
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("JWT 编码错误")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("JWT 解析失败: %w", err)
+	}
+	return nil
+}
+
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if v, err := n.Int64(); err == nil {
+		return v, true
+	}
+	f, err := n.Float64()
+	return int64(f), err == nil
+}
+
+// audienceContains aud 可以是字符串或字符串数组
+func audienceContains(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, item := range v {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken 取 Authorization: Bearer 头中的令牌
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// watchSessionExpiry 令牌到期前 ReauthLeadTime 要求客户端提交新令牌，到期仍未刷新时以 CloseSessionExpired 关闭连接
+func watchSessionExpiry(client *Client, expiresAt time.Time) {
+	client.setSessionExpiry(expiresAt, config.Handler.ReauthLeadTime)
+}
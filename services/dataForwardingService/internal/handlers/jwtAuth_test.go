@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer 测试用的身份提供方，JWKS 中只有一个 ES256 公钥
+type testIssuer struct {
+	key     *ecdsa.PrivateKey
+	kid     string
+	fetches atomic.Int32
+	release chan struct{} // 非nil时拉取请求阻塞到其关闭
+	fail    atomic.Bool   // 拉取返回500
+}
+
+// withIssuer 启动身份提供方并让 verifyJWT 使用全新的 JWKS 缓存，测试结束后恢复
+func withIssuer(t *testing.T, issuer *testIssuer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.key = key
+	if issuer.kid == "" {
+		issuer.kid = "k1"
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+		if issuer.release != nil {
+			<-issuer.release
+		}
+		if issuer.fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "crv": "P-256", "kid": issuer.kid,
+			"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	}))
+	t.Cleanup(ts.Close)
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.JWKSURL = ts.URL
+		cfg.JWTAudience, cfg.JWTIssuer, cfg.JWTUserClaim = "", "", "sub"
+		cfg.JWTClockSkew = 30 * time.Second
+	})
+	saved := jwks
+	jwks = &jwksCache{client: ts.Client()}
+	t.Cleanup(func() { jwks = saved })
+}
+
+// sign 按 ES256 签发令牌
+func (i *testIssuer) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyJWTClockSkew(t *testing.T) {
+	issuer := &testIssuer{}
+	withIssuer(t, issuer)
+	now := time.Now()
+	cases := []struct {
+		name   string
+		claims map[string]any
+		ok     bool
+	}{
+		{"有效期内", map[string]any{"sub": "7", "exp": now.Add(time.Hour).Unix()}, true},
+		{"过期但在偏差内", map[string]any{"sub": "7", "exp": now.Add(-10 * time.Second).Unix()}, true},
+		{"过期超过偏差", map[string]any{"sub": "7", "exp": now.Add(-time.Minute).Unix()}, false},
+		{"生效时间在偏差内", map[string]any{"sub": "7", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(10 * time.Second).Unix()}, true},
+		{"生效时间超过偏差", map[string]any{"sub": "7", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Minute).Unix()}, false},
+		{"缺少exp", map[string]any{"sub": "7"}, false},
+	}
+	for _, c := range cases {
+		userID, expiresAt, err := verifyJWT(context.Background(), issuer.sign(t, issuer.kid, c.claims))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: 期望通过=%v，实际错误 %v", c.name, c.ok, err)
+			continue
+		}
+		if c.ok {
+			exp := time.Unix(c.claims["exp"].(int64), 0)
+			if userID != "7" || !expiresAt.Equal(exp.Add(config.Handler.JWTClockSkew)) {
+				t.Errorf("%s: 用户 %q 过期时刻 %v", c.name, userID, expiresAt)
+			}
+		}
+	}
+}
+
+func TestVerifyJWTFailsClosedWithoutJWKS(t *testing.T) {
+	issuer := &testIssuer{}
+	withIssuer(t, issuer)
+	issuer.fail.Store(true)
+	token := issuer.sign(t, issuer.kid, map[string]any{"sub": "7", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, _, err := verifyJWT(context.Background(), token); !errors.Is(err, errJWKSUnavailable) {
+		t.Fatalf("从未拉取到 JWKS 时期望 errJWKSUnavailable，实际为 %v", err)
+	}
+
+	// 拉取失败后在 jwksMinRefetch 内不再重试，仍然拒绝
+	issuer.fail.Store(false)
+	if _, _, err := verifyJWT(context.Background(), token); !errors.Is(err, errJWKSUnavailable) {
+		t.Fatalf("最小拉取间隔内期望继续拒绝，实际为 %v", err)
+	}
+	if n := issuer.fetches.Load(); n != 1 {
+		t.Fatalf("最小拉取间隔内拉取了 %d 次", n)
+	}
+}
+
+func TestJWKSFetchDoesNotBlockCachedKeys(t *testing.T) {
+	issuer := &testIssuer{release: make(chan struct{})}
+	withIssuer(t, issuer)
+	cached, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks.keys = map[string]crypto.PublicKey{"cached": &cached.PublicKey}
+	jwks.fetchedAt = time.Now()
+
+	// 多个未知 kid 的请求同时到达，只触发一次拉取，且都等待拉取结果
+	var wg sync.WaitGroup
+	results := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.key(context.Background(), issuer.kid)
+			results <- err
+		}()
+	}
+	waitFor(t, "开始拉取", func() bool { return issuer.fetches.Load() == 1 })
+
+	// 拉取阻塞期间，已缓存的 kid 立即可用
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := jwks.key(ctx, "cached"); err != nil {
+		t.Fatalf("拉取进行中时已缓存的公钥不可用: %v", err)
+	}
+	// 调用方的期限到达时不再等待拉取
+	short, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	if _, err := jwks.key(short, "other"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("期望等待拉取时按期限返回，实际为 %v", err)
+	}
+
+	close(issuer.release)
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Fatalf("拉取完成后仍找不到公钥: %v", err)
+		}
+	}
+	if n := issuer.fetches.Load(); n != 1 {
+		t.Fatalf("并发的未知 kid 触发了 %d 次拉取", n)
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// negotiateHeartbeat 将客户端请求的心跳间隔限制在 [HeartbeatMin, HeartbeatMax] 内，未请求时使用 HeartbeatInterval
+func negotiateHeartbeat(requestedMs int64) time.Duration {
+	if requestedMs <= 0 {
+		return config.Handler.HeartbeatInterval
+	}
+	requested := time.Duration(requestedMs) * time.Millisecond
+	return min(max(requested, config.Handler.HeartbeatMin), config.Handler.HeartbeatMax)
+}
+
+// heartbeatInterval 连接当前生效的心跳间隔，登录前为默认值
+func (c *Client) heartbeatInterval() time.Duration {
+	if d := time.Duration(c.heartbeat.Load()); d > 0 {
+		return d
+	}
+	return config.Handler.HeartbeatInterval
+}
+
+// touch 收到任何报文(包括pong)时刷新最后活动时间
+func (c *Client) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// keepalive 服务端心跳协程：按连接协商的间隔发送ping，连续 HeartbeatMissed 个间隔没有收到任何报文时断开。
+// 自适应模式下只在空闲满一个间隔后才发送ping，有业务报文往来时不额外唤醒客户端的无线模块
+func keepalive(client *Client) {
+	timer := time.NewTimer(client.heartbeatInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-client.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		interval := client.heartbeatInterval()
+		idle := time.Since(time.Unix(0, client.lastActivity.Load()))
+		if idle >= interval*time.Duration(config.Handler.HeartbeatMissed) {
+			client.log().Infof("%v 内未收到任何报文(心跳间隔 %v)，断开", idle.Truncate(time.Second), interval)
+			metrics.Inc("heartbeat_timeout_total")
+			client.Close(CloseIdleTimeout)
+			return
+		}
+		if missed := config.Handler.HeartbeatMissed; missed > 1 && idle >= interval*time.Duration(missed-1) {
+			client.reportSymptom(symptomHeartbeatMissed)
+		} else {
+			client.assessQuality()
+		}
+		if idleAfter := config.Handler.IdleAfter; idleAfter > 0 && idle >= idleAfter {
+			client.buffer.park()
+		}
+		if client.adaptiveHeartbeat.Load() && idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		deadline := time.Now().Add(config.Handler.MessageTimeout)
+		if err := client.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			client.log().Warnf("发送心跳失败: %v", err)
+			client.Close(CloseWriteError)
+			return
+		}
+		metrics.Inc("heartbeat_ping_total")
+		timer.Reset(interval)
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"strconv"
+	"sync"
+)
+
+// limitSendBuffer 发送队列在软限制告警中的名称，限流类别直接使用类别名
+const limitSendBuffer = "send_buffer"
+
+// limitWarnings 每个连接已发出告警的限制，使用率回落到阈值以下后重新布防，避免重复推送
+type limitWarnings struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// warningPercent 限制的告警阈值(占容量的百分比)，未配置的限制使用 LimitWarningPercent，为0时不告警
+func warningPercent(limit string) int {
+	if percent, ok := config.Handler.LimitWarningClasses[limit]; ok {
+		return percent
+	}
+	return config.Handler.LimitWarningPercent
+}
+
+// checkLimit 使用量越过阈值时向客户端推送一次 LimitWarning，remaining 为剩余额度，capacity 为总额度
+func (c *Client) checkLimit(limit string, remaining int, capacity int) {
+	percent := warningPercent(limit)
+	if percent <= 0 || capacity <= 0 || c.synthetic {
+		return
+	}
+	over := (capacity-remaining)*100 >= capacity*percent
+
+	c.warnings.mu.Lock()
+	if over == c.warnings.warned[limit] {
+		c.warnings.mu.Unlock()
+		return
+	}
+	if c.warnings.warned == nil {
+		c.warnings.warned = make(map[string]bool)
+	}
+	c.warnings.warned[limit] = over
+	c.warnings.mu.Unlock()
+	if !over {
+		return
+	}
+
+	metrics.Inc("limit_warning_total", "limit", limit)
+	c.log().Infof("%s 使用量超过 %d%%，剩余 %d/%d", limit, percent, remaining, capacity)
+	used := (capacity - remaining) * 100 / capacity
+	err := c.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_LimitWarning{
+			LimitWarning: &pb.LimitWarning{
+				Limit:       limit,
+				Remaining:   int64(remaining),
+				Capacity:    int64(capacity),
+				PercentUsed: int32(used),
+				Message: systemText("limit_warning."+limit, map[string]string{
+					"limit":     limit,
+					"percent":   strconv.Itoa(used),
+					"remaining": strconv.Itoa(remaining),
+					"capacity":  strconv.Itoa(capacity),
+				}),
+			},
+		},
+	})
+	if err != nil {
+		c.log().Warnf("发送限制告警失败: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/internal/i18n"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// systemText 构造待本地化的系统文本，发送前由 localize 按连接语言填写 text
+func systemText(key string, params map[string]string) *pb.LocalizedText {
+	return &pb.LocalizedText{Key: key, Params: params}
+}
+
+// localizable 报文是否含需要按语言解析的系统文本
+func localizable(rsp *pb.ResponseMessage) bool {
+	if notice := rsp.GetSystemNotice(); notice != nil {
+		return notice.GetMessage() != nil || len(notice.GetLocalized()) > 0
+	}
+	return localizedTextOf(rsp) != nil
+}
+
+// localizedTextOf 取出报文中的系统文本，新增携带系统文本的报文类型时在此登记
+func localizedTextOf(rsp *pb.ResponseMessage) *pb.LocalizedText {
+	switch payload := rsp.GetPayload().(type) {
+	case *pb.ResponseMessage_SystemNotice:
+		return payload.SystemNotice.GetMessage()
+	case *pb.ResponseMessage_Reconnect:
+		return payload.Reconnect.GetMessage()
+	case *pb.ResponseMessage_SessionTerminated:
+		return payload.SessionTerminated.GetMessage()
+	case *pb.ResponseMessage_LimitWarning:
+		return payload.LimitWarning.GetMessage()
+	case *pb.ResponseMessage_ConnectionQuality:
+		return payload.ConnectionQuality.GetMessage()
+	case *pb.ResponseMessage_ReauthenticateRequired:
+		return payload.ReauthenticateRequired.GetMessage()
+	default:
+		return nil
+	}
+}
+
+// localize 按连接语言填写系统文本，locale 为空时使用默认语言。
+// 原报文可能由多个连接共用，需要本地化时返回副本，否则原样返回
+func localize(rsp *pb.ResponseMessage, locale string) *pb.ResponseMessage {
+	if !localizable(rsp) {
+		return rsp
+	}
+	rsp = proto.Clone(rsp).(*pb.ResponseMessage)
+	if text := localizedTextOf(rsp); text != nil {
+		text.Text, text.Locale = i18n.Resolve(locale, text.GetKey(), text.GetParams())
+	}
+	if notice := rsp.GetSystemNotice(); notice != nil {
+		// 管理员广播的逐语言文本优先于翻译表
+		if _, text, ok := i18n.Match(notice.GetLocalized(), locale); ok {
+			notice.Text = text
+		} else if _, text, ok := i18n.Match(notice.GetLocalized(), i18n.DefaultLocale()); ok && notice.GetText() == "" {
+			notice.Text = text
+		} else if notice.GetMessage() != nil && notice.GetText() == "" {
+			notice.Text = notice.GetMessage().GetText()
+		}
+	}
+	return rsp
+}
+
+// outboundFrame 经出站拦截器处理并序列化的报文。含系统文本时按接收连接的语言分别序列化，同一语言的连接共用一份
+type outboundFrame struct {
+	message   *pb.ResponseMessage
+	data      []byte // 默认语言的序列化结果
+	localized map[string][]byte
+	ttl       time.Duration // 在发送队列中的有效期，见 Envelope.TTL
+	timing    frameTiming
+}
+
+// bytesFor 取发往某连接的序列化结果
+func (f *outboundFrame) bytesFor(client *Client) []byte {
+	locale := client.declared().locale
+	if locale == "" || !localizable(f.message) {
+		return f.data
+	}
+	if data, ok := f.localized[locale]; ok {
+		return data
+	}
+	data, err := proto.Marshal(localize(f.message, locale))
+	if err != nil || len(data) == 0 {
+		client.log().Warnf("按语言 %s 序列化系统文本失败，使用默认语言: %v", locale, err)
+		return f.data
+	}
+	if f.localized == nil {
+		f.localized = make(map[string][]byte)
+	}
+	f.localized[locale] = data
+	return data
+}
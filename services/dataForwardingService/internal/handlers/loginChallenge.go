@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"time"
+)
+
+// nonceSize 登录挑战随机数的字节数
+const nonceSize = 32
+
+// LoginProofVerifier 校验挑战应答式登录的认证后端。proof 是客户端用由凭据派生的密钥对 nonce 计算的HMAC或签名，
+// 返回值的含义与 HandleLoginMessage 相同：登录响应、用户ID(失败时为-1)与错误，需要二次验证时返回 ErrTwoFactorRequired
+type LoginProofVerifier interface {
+	VerifyLoginProof(ctx context.Context, account string, nonce []byte, proof []byte) (*pb.ResponseMessage, int64, error)
+}
+
+// SetLoginProofVerifier 设置挑战应答式登录的认证后端，未设置时不下发登录挑战，需在服务启动之前调用
+func (s *Server) SetLoginProofVerifier(v LoginProofVerifier) {
+	s.loginProof = v
+}
+
+// SetLoginProofVerifier 设置默认实例的挑战应答式登录后端。
+//
+// Deprecated: 使用 Default().SetLoginProofVerifier
+func SetLoginProofVerifier(v LoginProofVerifier) {
+	defaultServer.SetLoginProofVerifier(v)
+}
+
+// loginNonce 下发给连接的登录挑战，只能使用一次
+type loginNonce struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+var (
+	errNonceMismatch = errors.New("登录挑战不存在或已被使用")
+	errNonceExpired  = errors.New("登录挑战已过期")
+)
+
+// loginChallengeEnabled 是否下发登录挑战
+func (s *Server) loginChallengeEnabled() bool {
+	return config.Handler.LoginChallenge && s.loginProof != nil
+}
+
+// issueLoginChallenge 生成新的随机数保存在连接上并下发给客户端，旧的随机数随之失效
+func issueLoginChallenge(client *Client) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		client.log().Errorf("生成登录挑战失败: %v", err)
+		return
+	}
+	ttl := config.Handler.LoginNonceTTL
+	client.nonce.Store(&loginNonce{value: nonce, expiresAt: time.Now().Add(ttl)})
+	err := client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_LoginChallenge{
+			LoginChallenge: &pb.LoginChallenge{
+				Nonce:     nonce,
+				ExpiresMs: ttl.Milliseconds(),
+			},
+		},
+	})
+	if err != nil {
+		client.log().Warnf("发送登录挑战失败: %v", err)
+	}
+}
+
+// consumeNonce 取出并作废连接上的随机数，与客户端回传的不一致或已过期时返回错误
+func (c *Client) consumeNonce(given []byte) error {
+	current := c.nonce.Swap(nil)
+	if current == nil || subtle.ConstantTimeCompare(current.value, given) != 1 {
+		return errNonceMismatch
+	}
+	if time.Now().After(current.expiresAt) {
+		return errNonceExpired
+	}
+	return nil
+}
+
+// authenticate 校验登录凭据：携带应答时交给 LoginProofVerifier，否则走账号密码或jwt登录。
+// 关闭 LegacyPasswordLogin 后，下发了挑战的连接不能再只凭密码登录
+func authenticate(ctx context.Context, client *Client, requestMsg *pb.RequestMessage) (*pb.ResponseMessage, int64, error) {
+	s := client.server
+	login := requestMsg.GetLogin()
+	if len(login.GetProof()) == 0 {
+		if s.loginChallengeEnabled() && !config.Handler.LegacyPasswordLogin && requestMsg.GetJwt() == "" {
+			metrics.Inc("login_challenge_total", "result", "missing_proof")
+			return loginErrorResponse(pb.LoginResult_LOGIN_PROOF_REQUIRED), -1, nil
+		}
+		return s.HandleLoginMessage(ctx, requestMsg)
+	}
+	if !s.loginChallengeEnabled() {
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), -1, errors.New("未启用挑战应答式登录")
+	}
+
+	// 随机数在校验前即作废，登录失败时下发新的挑战供客户端重试
+	switch err := client.consumeNonce(login.GetNonce()); {
+	case errors.Is(err, errNonceExpired):
+		metrics.Inc("login_challenge_total", "result", "expired")
+		issueLoginChallenge(client)
+		return loginErrorResponse(pb.LoginResult_LOGIN_NONCE_EXPIRED), -1, nil
+	case err != nil:
+		metrics.Inc("login_challenge_total", "result", "reused")
+		issueLoginChallenge(client)
+		return loginErrorResponse(pb.LoginResult_LOGIN_NONCE_REUSED), -1, nil
+	}
+	rsp, userID, err := s.loginProof.VerifyLoginProof(ctx, login.GetAccount(), login.GetNonce(), login.GetProof())
+	if err == nil && rsp.GetLogin().GetResult() == pb.LoginResult_LOGIN_OK {
+		metrics.Inc("login_challenge_total", "result", "verified")
+	} else if !errors.Is(err, ErrTwoFactorRequired) {
+		metrics.Inc("login_challenge_total", "result", "rejected")
+		issueLoginChallenge(client)
+	}
+	return rsp, userID, err
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"time"
+)
+
+// dampLogin 集群范围的登录抑制：同一设备在 LoginDampWindow 内登录超过 LoginDampMax 次时拒绝，
+// 避免异常客户端反复重连登录导致多个容器争抢登记、互相踢线。只按设备计数，同一用户多设备登录不受影响。
+// redis不可用时放行
+func dampLogin(ctx context.Context, client *Client, userID string, deviceID string) (time.Duration, bool) {
+	cfg := config.Handler
+	if cfg.LoginDampMax <= 0 || client.synthetic {
+		return 0, false
+	}
+	wait, err := redisClient.RecordLogin(ctx, userID, deviceID, cfg.LoginDampWindow, cfg.LoginDampMax)
+	if err != nil {
+		client.log().Warnf("登录频率检查失败，放行: %v", err)
+		return 0, false
+	}
+	if wait <= 0 {
+		return 0, false
+	}
+	// 持续增长说明有客户端在反复重连，可据此告警
+	metrics.Inc("login_damped_total")
+	client.log().Warnf("设备登录过于频繁，拒绝登录，%v 后可重试", wait)
+	return wait, true
+}
+
+// tooManyReconnects 登录抑制时的拒绝响应
+func tooManyReconnects(wait time.Duration) *pb.ResponseMessage {
+	rsp := refused(pb.RefusedReason_TOO_MANY_RECONNECTS)
+	rsp.GetRefused().RetryAfterMs = wait.Milliseconds()
+	return rsp
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"time"
+)
+
+// terminateGrace 下发 SessionTerminated 后等待写协程发出再关闭连接
+const terminateGrace = 500 * time.Millisecond
+
+// terminateSession 通知客户端会话已被终止，稍后关闭连接
+func terminateSession(client *Client, reason CloseReason) {
+	err := client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_SessionTerminated{
+			SessionTerminated: &pb.SessionTerminated{
+				Reason:  string(reason),
+				Message: systemText("session_terminated."+string(reason), nil),
+			},
+		},
+	})
+	if err != nil {
+		client.log().Warnf("发送会话终止通知失败: %v", err)
+	}
+	time.AfterFunc(terminateGrace, func() {
+		client.Close(reason)
+	})
+}
+
+// TerminateSession 终止默认实例中的连接。
+//
+// Deprecated: 使用 Default().TerminateSession
+func TerminateSession(key string, reason CloseReason) {
+	defaultServer.TerminateSession(key, reason)
+}
+
+// TerminateSession 外部终止特定连接，key 的含义与 StopClient 相同，关闭前会先通知客户端
+func (s *Server) TerminateSession(key string, reason CloseReason) {
+	var targets []*Client
+	if userID, deviceID, ok := redisClient.SplitDeviceKey(key); ok {
+		if client, ok := s.clients.DeviceClient(userID, deviceID); ok {
+			targets = append(targets, client)
+		}
+	} else {
+		targets = s.clients.UserClients(key)
+	}
+	for _, client := range targets {
+		terminateSession(client, reason)
+	}
+}
+
+// handleLogoutAllDevices 退出用户的其他设备。keep_current 时(修改密码)保留当前连接并重新签发恢复令牌，
+// 否则当前连接也会在返回结果后被终止
+func handleLogoutAllDevices(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	keepCurrent := message.GetLogoutAll().GetKeepCurrent()
+	terminated, err := client.server.kickEverywhere(ctx, client.userID, CloseLoggedOutEverywhere, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisClient.RevokeResumeTokens(ctx, client.userID); err != nil {
+		return nil, err
+	}
+	metrics.Add("sessions_terminated_total", float64(terminated), "reason", string(CloseLoggedOutEverywhere))
+
+	rsp := &pb.LogoutAllDevicesRsp{
+		Terminated: int32(terminated),
+	}
+	if keepCurrent {
+		token, err := IssueResumeToken(ctx, client.userID, client.deviceID, identity.ContainerID())
+		if err != nil {
+			client.log().Warnf("重新签发恢复令牌失败: %v", err)
+		}
+		rsp.ResumeToken = token
+		return &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_LogoutAll{
+				LogoutAll: rsp,
+			},
+		}, nil
+	}
+
+	rsp.Terminated++
+	if err := client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_LogoutAll{
+			LogoutAll: rsp,
+		},
+	}); err != nil {
+		return nil, err
+	}
+	terminateSession(client, CloseLoggedOutEverywhere)
+	return nil, nil
+}
+
+// HandleLogoutAll 处理账号服务发布的退出所有设备控制消息(如在其他渠道修改了密码)，控制消息按容器订阅，由默认实例处理
+func HandleLogoutAll(userID string) {
+	defaultServer.handleLogoutAll(userID)
+}
+
+func (s *Server) handleLogoutAll(userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+	defer cancel()
+	terminated, err := s.kickEverywhere(ctx, userID, CloseLoggedOutEverywhere, nil)
+	if err != nil {
+		logger.Sugar().Errorf("用户 %s 退出所有设备失败: %v", userID, err)
+		return
+	}
+	if err := redisClient.RevokeResumeTokens(ctx, userID); err != nil {
+		logger.Sugar().Errorf("用户 %s 清除恢复令牌失败: %v", userID, err)
+	}
+	metrics.Add("sessions_terminated_total", float64(terminated), "reason", string(CloseLoggedOutEverywhere))
+	logger.Sugar().Infof("用户 %s 已退出所有设备，断开 %d 个会话", userID, terminated)
+}
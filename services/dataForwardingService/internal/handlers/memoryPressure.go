@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/metrics"
+	"math"
+	"os"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 内存压力下依次断开的连接类别
+const (
+	pressureAnonymous     = "anonymous"     // 未发送过任何可解析报文的未登录连接
+	pressureGuest         = "guest"         // 空闲超过 MemoryGuestIdle 的未登录会话
+	pressureAuthenticated = "authenticated" // 已登录连接，空闲最久的先断开
+)
+
+// cgroup 中内存上限与当前用量的文件，依次尝试 v2 与 v1
+var cgroupMemoryFiles = []struct{ limit, usage string }{
+	{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory.current"},
+	{"/sys/fs/cgroup/memory/memory.limit_in_bytes", "/sys/fs/cgroup/memory/memory.usage_in_bytes"},
+}
+
+// cgroupUnlimited v1 未设置上限时 memory.limit_in_bytes 为接近 int64 最大值的数，超过该值视为不限制
+const cgroupUnlimited = 1 << 62
+
+// memoryGauge 内存上限与用量的来源
+type memoryGauge struct {
+	limit     uint64
+	source    string // config、cgroup 或 gomemlimit
+	usageFile string // 为空时以Go运行时的内存占用作为用量
+}
+
+// newMemoryGauge 确定内存上限：MemoryLimitBytes、cgroup限制、GOMEMLIMIT，都没有时返回false
+func newMemoryGauge() (memoryGauge, bool) {
+	var cgroup memoryGauge
+	for _, files := range cgroupMemoryFiles {
+		if limit, ok := readMemoryFile(files.limit); ok && limit < cgroupUnlimited {
+			cgroup = memoryGauge{limit: limit, source: "cgroup", usageFile: files.usage}
+			break
+		}
+	}
+	switch {
+	case config.Handler.MemoryLimitBytes > 0:
+		// 配置的上限与cgroup同时存在时，用量仍以cgroup统计为准
+		return memoryGauge{limit: uint64(config.Handler.MemoryLimitBytes), source: "config", usageFile: cgroup.usageFile}, true
+	case cgroup.limit > 0:
+		return cgroup, true
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return memoryGauge{limit: uint64(limit), source: "gomemlimit"}, true
+	}
+	return memoryGauge{}, false
+}
+
+// readMemoryFile 读取cgroup内存文件中的字节数，v2 的 max 表示不限制
+func readMemoryFile(path string) (uint64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n, err == nil
+}
+
+// runtimeMemorySample 不触发停顿地读取Go运行时向操作系统申请且未归还的内存
+var runtimeMemorySample = []runtimemetrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// usage 当前内存用量
+func (g memoryGauge) usage() uint64 {
+	if g.usageFile != "" {
+		if n, ok := readMemoryFile(g.usageFile); ok {
+			return n
+		}
+	}
+	runtimemetrics.Read(runtimeMemorySample)
+	return runtimeMemorySample[0].Value.Uint64() - runtimeMemorySample[1].Value.Uint64()
+}
+
+// MemoryPressure 内存压力组件：每隔 MemoryPressureInterval 检查内存用量，超过各类别的阈值时依次断开
+// 匿名连接、空闲游客与空闲最久的已登录连接，每次最多 MemoryPressureBatch 个，直到用量回落到阈值以下。
+// 被断开的连接收到 1013 memory_pressure 与重连等待建议。MemoryPressureEnabled 为false或无法确定内存上限时不启用
+func (s *Server) MemoryPressure() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name: "memory_pressure",
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			if !config.Handler.MemoryPressureEnabled || config.Handler.MemoryPressureInterval <= 0 {
+				return nil
+			}
+			gauge, ok := newMemoryGauge()
+			if !ok {
+				logger.Sugar().Infof("未配置内存上限且不在受限的cgroup中，不启用内存压力保护")
+				return nil
+			}
+			logger.Sugar().Infof("内存压力保护已启用，上限 %d 字节(来源 %s)", gauge.limit, gauge.source)
+			go s.watchMemory(ctx, gauge)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
+
+func (s *Server) watchMemory(ctx context.Context, gauge memoryGauge) {
+	ticker := time.NewTicker(config.Handler.MemoryPressureInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pct := float64(gauge.usage()) * 100 / float64(gauge.limit)
+		metrics.SetGauge("memory_usage_percent", pct)
+		if counts := s.relieveMemoryPressure(pct); len(counts) > 0 {
+			logger.Sugar().Warnf("内存用量达到上限的 %.1f%%，本轮断开连接 %v", pct, counts)
+		}
+	}
+}
+
+// pressureCandidate 可在内存压力下断开的连接
+type pressureCandidate struct {
+	client *Client
+	idle   time.Duration
+}
+
+// relieveMemoryPressure 按用量百分比决定可断开的类别，依类别顺序、同类中空闲最久的优先，
+// 最多断开 MemoryPressureBatch 个连接，返回各类别断开的数量
+func (s *Server) relieveMemoryPressure(pct float64) map[string]int {
+	cfg := config.Handler
+	var classes []string
+	for _, threshold := range []struct {
+		class string
+		pct   int
+	}{
+		{pressureAnonymous, cfg.MemoryAnonymousPct},
+		{pressureGuest, cfg.MemoryGuestPct},
+		{pressureAuthenticated, cfg.MemoryAuthenticatedPct},
+	} {
+		if threshold.pct > 0 && pct >= float64(threshold.pct) {
+			classes = append(classes, threshold.class)
+		}
+	}
+	if len(classes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	candidates := make(map[string][]pressureCandidate, len(classes))
+	for _, client := range s.clients.All() {
+		if client.synthetic || client.loginInProgress.Load() {
+			continue
+		}
+		idle := now.Sub(time.Unix(0, client.lastActivity.Load()))
+		class := pressureAuthenticated
+		switch {
+		case client.loginAt.Load() != 0:
+		case !client.spoke.Load():
+			class = pressureAnonymous
+		case idle >= cfg.MemoryGuestIdle:
+			class = pressureGuest
+		default:
+			// 活跃的游客会话多半正在注册或登录，不断开
+			continue
+		}
+		candidates[class] = append(candidates[class], pressureCandidate{client: client, idle: idle})
+	}
+
+	budget := cfg.MemoryPressureBatch
+	counts := make(map[string]int)
+	for _, class := range classes {
+		list := candidates[class]
+		slices.SortFunc(list, func(a, b pressureCandidate) int {
+			return int(b.idle - a.idle)
+		})
+		for _, candidate := range list {
+			if budget <= 0 {
+				return counts
+			}
+			candidate.client.Close(CloseMemoryPressure)
+			metrics.Inc("memory_pressure_evictions_total", "class", class)
+			counts[class]++
+			budget--
+		}
+	}
+	return counts
+}
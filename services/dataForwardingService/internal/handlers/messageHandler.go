@@ -2,20 +2,24 @@ package handlers
 
 import (
 	pb "Betterfly2/proto/data_forwarding"
-	auth "Betterfly2/proto/server_rpc/auth"
 	"Betterfly2/shared/logger"
 	"context"
-	"data_forwarding_service/internal/grpcClient"
-	redisClient "data_forwarding_service/internal/redis"
 	"data_forwarding_service/internal/utils"
 	"errors"
-	"google.golang.org/protobuf/proto"
 	"strconv"
+	"time"
 )
 
+// HandleRequestData 解析客户端请求，超出解码限制或格式错误时返回错误。
+// 载荷为 Opaque 类型时返回的请求引用 data，调用方之后不能复用 data
 func HandleRequestData(data []byte) (*pb.RequestMessage, error) {
 	req := &pb.RequestMessage{}
-	err := proto.Unmarshal(data, req)
+	var err error
+	if opaquePayload(data) {
+		err = decodeAliased(data, req, maxRequestBytes())
+	} else {
+		err = decodeMessage(data, req, maxRequestBytes())
+	}
 	if err != nil {
 		// 反序列化失败了，说明数据不是有效的pb数据
 		logger.Sugar().Errorf("反序列化失败: %v", err)
@@ -25,84 +29,62 @@ func HandleRequestData(data []byte) (*pb.RequestMessage, error) {
 	return req, nil
 }
 
-func RequestMessageHandler(fromID int64, message *pb.RequestMessage) (int, error) {
-	sugar := logger.Sugar()
-	var err error
-	res := 0
-	switch payload := message.Payload.(type) {
-	case *pb.RequestMessage_Post:
-		sugar.Infof("收到 Post 消息: %+v", payload.Post)
-		err = handlePostMessage(fromID, message)
-	case *pb.RequestMessage_QueryUser:
-		sugar.Infof("收到 QueryUser 消息: %+v", payload.QueryUser)
-	case *pb.RequestMessage_InsertContact:
-		sugar.Infof("收到 InsertContact 消息: %+v", payload.InsertContact)
-	case *pb.RequestMessage_QueryGroup:
-		sugar.Infof("收到 QueryGroup 消息: %+v", payload.QueryGroup)
-	case *pb.RequestMessage_InsertGroup:
-		sugar.Infof("收到 InsertGroup 消息: %+v", payload.InsertGroup)
-	case *pb.RequestMessage_InsertGroupUser:
-		sugar.Infof("收到 InsertGroupUser 消息: %+v", payload.InsertGroupUser)
-	case *pb.RequestMessage_FileRequest:
-		sugar.Infof("收到 FileRequest 消息: %+v", payload.FileRequest)
-	case *pb.RequestMessage_UpdateAvatar:
-		sugar.Infof("收到 UpdateAvatar 消息: %+v", payload.UpdateAvatar)
-	case *pb.RequestMessage_Logout:
-		res = 1
-		sugar.Infof("收到登出报文: %+v", payload.Logout)
-	case *pb.RequestMessage_Login, *pb.RequestMessage_Signup:
-		sugar.Warnf("收到认证服务请求，不处理：%+v", payload)
-	default:
-		sugar.Warnf("收到不可处理Payload: %+v", payload)
-	}
-	return res, err
+// RequestMessageHandler 中间件链最内层，按报文类型从注册表中查找处理函数并分发
+func RequestMessageHandler(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	// 以服务端时间为准，覆盖客户端可能填写的任意值
+	message.ServerTs = time.Now().UnixMilli()
+	info, ok := lookupHandler(message)
+	if !ok {
+		client.log().Warnf("收到不可处理Payload: %+v", message.GetPayload())
+		return refused(pb.RefusedReason_UNKNOWN_TYPE), nil
+	}
+	return info.Handler(ctx, client, message)
+}
+
+// HandleLoginMessage 经默认实例的账号后端校验登录凭据。
+//
+// Deprecated: 使用 Default().HandleLoginMessage
+func HandleLoginMessage(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, int64, error) {
+	return defaultServer.HandleLoginMessage(ctx, message)
 }
 
-func HandleLoginMessage(message *pb.RequestMessage) (*pb.ResponseMessage, int64, error) {
+// HandleLoginMessage 通过账号后端校验登录凭据，账号后端不可用且开启 AuthFallback 时凭缓存的校验结果降级登录
+func (s *Server) HandleLoginMessage(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, int64, error) {
 	jwt := message.GetJwt()
-	errRsp := &pb.ResponseMessage{
-		Payload: &pb.ResponseMessage_Login{
-			Login: &pb.LoginRsp{
-				Result: pb.LoginResult_LOGIN_SVR_ERROR,
-			},
-		},
-	}
-	rpcClient, err := grpcClient.GetAuthClient()
-	if err != nil {
-		return errRsp, -1, err
-	}
 	clientLoginReq := message.GetLogin()
-	authLoginReq := &auth.LoginReq{}
-	if jwt == "" {
-		// 没有jwt代表账户密码登录
-		authLoginReq.Account = clientLoginReq.GetAccount()
-		authLoginReq.Password = clientLoginReq.GetPassword()
-	} else {
-		// 有jwt，不需要密码
-		authLoginReq.Account = clientLoginReq.GetAccount()
-		authLoginReq.Jwt = jwt
+	creds := Credentials{
+		Account:  clientLoginReq.GetAccount(),
+		Password: clientLoginReq.GetPassword(),
+		JWT:      jwt,
+	}
+	account, err := s.accounts.VerifyCredentials(ctx, creds)
+	if errors.Is(err, ErrAccountServiceUnavailable) && authFallbackEnabled() {
+		rsp, userID := fallbackLogin(ctx, message)
+		return rsp, userID, nil
 	}
-	authServiceRsp, err := rpcClient.Login(context.Background(), authLoginReq)
-	logger.Sugar().Infof("authServiceRsp: %s", authServiceRsp.String())
 	if err != nil {
-		return errRsp, -1, err
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), -1, err
+	}
+	if account.TwoFactorRequired {
+		// 令牌暂不下发，待二次验证通过后再返回给客户端
+		return &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_Login{
+				Login: &pb.LoginRsp{
+					UserId: account.UserID,
+					Jwt:    account.JWT,
+				},
+			},
+		}, account.UserID, ErrTwoFactorRequired
 	}
-	loginRsp := &pb.LoginRsp{}
+	loginRsp := &pb.LoginRsp{Result: account.Result}
 	var userID int64 = -1
-	switch authServiceRsp.Result {
-	case auth.AuthResult_OK:
-		loginRsp.Result = pb.LoginResult_LOGIN_OK
-		loginRsp.Jwt = authServiceRsp.GetJwt()
-		loginRsp.UserId = authServiceRsp.GetUserId()
-		userID = authServiceRsp.GetUserId()
-	case auth.AuthResult_ACCOUNT_NOT_EXIST:
-		loginRsp.Result = pb.LoginResult_ACCOUNT_NOT_EXIST
-	case auth.AuthResult_PASSWORD_ERROR:
-		loginRsp.Result = pb.LoginResult_PASSWORD_ERROR
-	case auth.AuthResult_JWT_ERROR:
-		loginRsp.Result = pb.LoginResult_JWT_ERROR
-	default:
-		loginRsp.Result = pb.LoginResult_LOGIN_SVR_ERROR
+	if account.Result == pb.LoginResult_LOGIN_OK {
+		loginRsp.Jwt = account.JWT
+		loginRsp.UserId = account.UserID
+		userID = account.UserID
+		if jwt == "" {
+			cacheVerifiedCredential(ctx, creds.Account, creds.Password, userID)
+		}
 	}
 	return &pb.ResponseMessage{
 		Payload: &pb.ResponseMessage_Login{
@@ -111,93 +93,91 @@ func HandleLoginMessage(message *pb.RequestMessage) (*pb.ResponseMessage, int64,
 	}, userID, nil
 }
 
-func HandleSignupMessage(message *pb.RequestMessage) (*pb.ResponseMessage, error) {
-	rpcClient, err := grpcClient.GetAuthClient()
-	errRsp := &pb.ResponseMessage{
-		Payload: &pb.ResponseMessage_Signup{
-			Signup: &pb.SignupRsp{
-				Result: pb.SignupResult_SIGNUP_SVR_ERROR,
-			},
-		},
-	}
-	if err != nil {
-		return errRsp, err
-	}
+// HandleSignupMessage 经默认实例的账号后端注册。
+//
+// Deprecated: 使用 Default().HandleSignupMessage
+func HandleSignupMessage(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	return defaultServer.HandleSignupMessage(ctx, message)
+}
+
+// HandleSignupMessage 通过账号后端注册，账号后端不可用时(包括降级登录期间)不接受新注册
+func (s *Server) HandleSignupMessage(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
 	clientSignupReq := message.GetSignup()
-	authSignupReq := &auth.SignupReq{
+	result, err := s.accounts.CreateAccount(ctx, NewAccount{
 		Account:  clientSignupReq.GetAccount(),
 		Password: clientSignupReq.GetPassword(),
 		UserName: clientSignupReq.GetUserName(),
+	})
+	if errors.Is(err, ErrAccountServiceUnavailable) {
+		return refused(pb.RefusedReason_TEMPORARILY_UNAVAILABLE), nil
 	}
-	authServiceRsp, err := rpcClient.Signup(context.Background(), authSignupReq)
-	logger.Sugar().Infof("authServiceRsp: %s", authServiceRsp.String())
 	if err != nil {
-		return errRsp, err
-	}
-	signupRsp := &pb.SignupRsp{}
-	switch authServiceRsp.Result {
-	case auth.AuthResult_OK:
-		signupRsp.Result = pb.SignupResult_SIGNUP_OK
-	case auth.AuthResult_ACCOUNT_EXIST:
-		signupRsp.Result = pb.SignupResult_ACCOUNT_EXIST
-	case auth.AuthResult_ACCOUNT_EMPTY:
-		signupRsp.Result = pb.SignupResult_ACCOUNT_EMPTY
-	case auth.AuthResult_PASSWORD_EMPTY:
-		signupRsp.Result = pb.SignupResult_PASSWORD_EMPTY
-	case auth.AuthResult_ACCOUNT_TOO_LONG:
-		signupRsp.Result = pb.SignupResult_ACCOUNT_TOO_LONG
-	default:
-		signupRsp.Result = pb.SignupResult_SIGNUP_SVR_ERROR
+		result = pb.SignupResult_SIGNUP_SVR_ERROR
 	}
 	return &pb.ResponseMessage{
 		Payload: &pb.ResponseMessage_Signup{
-			Signup: signupRsp,
+			Signup: &pb.SignupRsp{
+				Result: result,
+			},
 		},
-	}, nil
+	}, err
 }
 
-func handlePostMessage(fromID int64, message *pb.RequestMessage) error {
+func (s *Server) handlePostMessage(ctx context.Context, fromID int64, message *pb.RequestMessage) error {
 	jwt := message.GetJwt()
 	if jwt == "" {
 		return errors.New("用户未携带有效JWT，无法转发消息")
 	}
 
-	err := utils.ValidateAndParseJWT(fromID, jwt)
+	err := utils.ValidateAndParseJWT(ctx, fromID, jwt)
 	if err != nil {
 		return err
 	}
 	payload := message.GetPost()
 	payload.FromId = fromID
-
-	targetTopic := redisClient.GetContainerByConnection(strconv.FormatInt(payload.GetToId(), 10))
-	if targetTopic == "" {
-		// TODO: 消息保存
-		logger.Sugar().Warnf("%s 用户不在线", strconv.FormatInt(payload.GetToId(), 10))
-	}
-	rspBytes, _ := proto.Marshal(message)
-	err = publishMessage(rspBytes, targetTopic) // 将消息转发到消息队列
+	rootID, err := normalizeThread(payload.GetMessageId(), payload.GetParentMessageId(), payload.GetThreadRootId())
 	if err != nil {
-		logger.Sugar().Warnf("消息转发失败: %v", err)
 		return err
 	}
+	payload.ThreadRootId = rootID
+	conv := conversation{IsGroup: payload.GetIsGroup(), ToID: payload.GetToId()}
 
-	return nil
-}
-
-func InplaceHandlePostMessage(message *pb.RequestMessage) error {
-	payload := message.GetPost()
-	logger.Sugar().Infof("InplaceHandlePostMessage-payload: %s", payload.String())
 	rsp := &pb.ResponseMessage{
 		Payload: &pb.ResponseMessage_Post{
 			Post: payload,
 		},
 	}
-	rspBytes, _ := proto.Marshal(rsp)
-	err := SendMessage(strconv.FormatInt(payload.GetToId(), 10), rspBytes)
+	convSeq := AllocateConversationSequence(ctx, conv.key(fromID))
+	s.persistMessage(ctx, conv.key(fromID), convSeq, message.GetServerTs(), rsp)
+	result, err := s.DeliverToUser(ctx, strconv.FormatInt(payload.GetToId(), 10), rsp, DeliveryOptions{
+		Priority:     PriorityInteractive,
+		ServerTs:     message.GetServerTs(),
+		Sequenced:    true,
+		Sender:       strconv.FormatInt(fromID, 10),
+		Conversation: conv.key(fromID),
+		ConvSeq:      convSeq,
+	})
 	if err != nil {
+		ctxLogger(ctx).Warnf("消息转发失败: %v", err)
 		return err
 	}
-
-	logger.Sugar().Infof("%d 成功向 %d 发送消息", payload.GetFromId(), payload.GetToId())
+	ctxLogger(ctx).Infof("%d 向 %d 发送消息: %s", fromID, payload.GetToId(), result)
+	if rootID != "" {
+		s.recordThreadReply(ctx, conv, fromID, rootID, payload.GetThreadRootAuthorId(), message.GetServerTs())
+	}
 	return nil
 }
+
+// handleTimeSync 返回客户端时刻与服务端时刻，供客户端计算时钟偏差
+func handleTimeSync(ctx context.Context, client *Client, message *pb.RequestMessage) error {
+	now := time.Now().UnixMilli()
+	return client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_TimeSync{
+			TimeSync: &pb.TimeSyncRsp{
+				ClientTs: message.GetTimeSync().GetClientTs(),
+				ServerTs: now,
+			},
+		},
+		ServerTs: now,
+	})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"math"
+	"testing"
+	"time"
+)
+
+// 客户端时钟可能任意偏差，TimeSync 原样返回客户端时刻，服务端时刻只取自本机时钟
+func TestTimeSyncWithAbsurdClientTimestamps(t *testing.T) {
+	withRedis(t)
+	s := NewServer()
+	// 与启动时一样组装完整的中间件链，负数时刻由 ValidationMiddleware 拒绝
+	s.chain = buildChain(RequestMessageHandler, s.middlewares)
+	conn := dialServer(t, s)
+	for _, clientTs := range []int64{0, 1, math.MaxInt64, time.Now().Add(100 * 365 * 24 * time.Hour).UnixMilli()} {
+		before := time.Now().UnixMilli()
+		sendRequest(t, conn, &pb.RequestMessage{
+			Payload:  &pb.RequestMessage_TimeSync{TimeSync: &pb.TimeSyncReq{ClientTs: clientTs}},
+			ServerTs: clientTs, // 客户端填写的服务端时刻会被覆盖
+		})
+		rsp := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetTimeSync() != nil })
+		after := time.Now().UnixMilli()
+		sync := rsp.GetTimeSync()
+		if sync.GetClientTs() != clientTs {
+			t.Errorf("客户端时刻 %d 返回为 %d", clientTs, sync.GetClientTs())
+		}
+		if sync.GetServerTs() < before || sync.GetServerTs() > after || rsp.GetServerTs() != sync.GetServerTs() {
+			t.Errorf("客户端时刻 %d: 服务端时刻 %d/%d 不在 [%d, %d] 内", clientTs, sync.GetServerTs(), rsp.GetServerTs(), before, after)
+		}
+	}
+
+	// 负数时刻不合法
+	sendRequest(t, conn, &pb.RequestMessage{Payload: &pb.RequestMessage_TimeSync{TimeSync: &pb.TimeSyncReq{ClientTs: -1}}})
+	rsp := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetRefused() != nil })
+	if r := rsp.GetRefused(); r.GetReason() != pb.RefusedReason_INVALID_PAYLOAD || r.GetField() != "client_ts" {
+		t.Fatalf("负数客户端时刻期望被拒绝，实际为 %v", r)
+	}
+}
+
+// 请求中客户端填写的 server_ts 不影响服务端的接收时刻
+func TestServerTsOverridesClientValue(t *testing.T) {
+	withRedis(t)
+	conn := dialServer(t, NewServer())
+	for _, forged := range []int64{-1, 0, math.MaxInt64, math.MinInt64} {
+		before := time.Now().UnixMilli()
+		sendRequest(t, conn, &pb.RequestMessage{
+			Payload:  &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte("ts")}},
+			ServerTs: forged,
+		})
+		echo := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetEcho() != nil }).GetEcho()
+		after := time.Now().UnixMilli()
+		if echo.GetServerRecvTs() < before || echo.GetServerRecvTs() > after {
+			t.Errorf("伪造的 server_ts %d: 接收时刻 %d 不在 [%d, %d] 内", forged, echo.GetServerRecvTs(), before, after)
+		}
+		if echo.GetServerSendTs() < echo.GetServerRecvTs() {
+			t.Errorf("伪造的 server_ts %d: 发送时刻 %d 早于接收时刻 %d", forged, echo.GetServerSendTs(), echo.GetServerRecvTs())
+		}
+	}
+}
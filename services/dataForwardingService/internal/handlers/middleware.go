@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/logsample"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCloseConnection 处理器返回该错误时读协程会结束并关闭连接
+var ErrCloseConnection = errors.New("连接需要关闭")
+
+// ErrLogout 客户端登出，读协程不再接收报文，等待发送队列发完后以正常关闭码关闭连接
+var ErrLogout = fmt.Errorf("%w: 客户端登出", ErrCloseConnection)
+
+// MessageHandler 消息处理函数，返回非nil响应时由读协程发送给客户端
+type MessageHandler func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error)
+
+// Middleware 包装 MessageHandler，可以在调用 next 前后插入逻辑，也可以不调用 next 直接返回响应
+type Middleware func(next MessageHandler) MessageHandler
+
+// defaultMiddlewares 内置中间件，按顺序排列，先注册的位于外层、先执行
+func defaultMiddlewares() []Middleware {
+	return []Middleware{
+		LoggingMiddleware,
+		TimeoutMiddleware,
+		LoginGateMiddleware,
+		FeatureGateMiddleware,
+		RateLimitMiddleware,
+		ValidationMiddleware,
+		SenderGateMiddleware,
+		ConcurrencyMiddleware,
+	}
+}
+
+// Use 在内置中间件之后追加中间件，必须在服务启动之前调用
+func (s *Server) Use(mw ...Middleware) {
+	s.middlewares = append(s.middlewares, mw...)
+}
+
+// Use 为默认实例追加中间件。
+//
+// Deprecated: 使用 Default().Use
+func Use(mw ...Middleware) {
+	defaultServer.Use(mw...)
+}
+
+// buildChain 按注册顺序组装中间件链，final 位于最内层
+func buildChain(final MessageHandler, mws []Middleware) MessageHandler {
+	h := final
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// LoggingMiddleware 记录每条消息的类型与处理耗时，耗时按报文类型计入 handler_latency_ms
+func LoggingMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		start := time.Now()
+		rsp, err := next(ctx, client, message)
+		metrics.Observe("handler_latency_ms", float64(time.Since(start).Milliseconds()), "type", payloadType(message))
+		if logsample.Allow(logsample.Message, err) {
+			client.log().Infof("收到WebSocket消息: %T (耗时 %v)", message.GetPayload(), time.Since(start))
+		}
+		return rsp, err
+	}
+}
+
+// TimeoutMiddleware 为每条消息设置处理超时，超时后取消下游调用并返回 TEMPORARILY_UNAVAILABLE
+func TimeoutMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		ctx, cancel := context.WithTimeout(ctx, config.Handler.MessageTimeout)
+		defer cancel()
+		rsp, err := next(ctx, client, message)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			metrics.Inc("handler_timeout_total", "kind", fmt.Sprintf("%T", message.GetPayload()))
+			client.log().Warnf("消息处理超时: %T, %v", message.GetPayload(), err)
+			return refused(pb.RefusedReason_TEMPORARILY_UNAVAILABLE), nil
+		}
+		return rsp, err
+	}
+}
+
+// LoginGateMiddleware 未登录时拒绝需要登录的报文
+func LoginGateMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		if client.loggedIn {
+			return next(ctx, client, message)
+		}
+		if info, ok := lookupHandler(message); ok && info.RequiresLogin {
+			client.log().Errorln("未登录时不处理其他类型信息")
+			return refused(pb.RefusedReason_NOT_LOGGED_IN), nil
+		}
+		return next(ctx, client, message)
+	}
+}
+
+// FeatureGateMiddleware 拒绝用户未开启的功能开关下的报文
+func FeatureGateMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		if info, ok := lookupHandler(message); ok && info.FeatureFlag != "" && !client.flags[info.FeatureFlag] {
+			metrics.Inc("feature_disabled_total", "flag", info.FeatureFlag)
+			return refused(pb.RefusedReason_FEATURE_DISABLED), nil
+		}
+		return next(ctx, client, message)
+	}
+}
+
+// RateLimitMiddleware 按处理函数声明的限流类别进行限流
+func RateLimitMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		info, ok := lookupHandler(message)
+		if !ok || info.RateLimitClass == "" || client.synthetic {
+			return next(ctx, client, message)
+		}
+		if limiter, ok := client.limiters[info.RateLimitClass]; ok {
+			allowed := limiter.Allow()
+			remaining, capacity := limiter.Remaining()
+			client.checkLimit(info.RateLimitClass, remaining, capacity)
+			if !allowed {
+				metrics.Inc("rate_limited_total", "class", info.RateLimitClass)
+				return refused(pb.RefusedReason_RATE_LIMITED), nil
+			}
+		}
+		if limiter, ok := ipLimiters[info.RateLimitClass]; ok && !limiter.Allow(client.remoteIP()) {
+			metrics.Inc("rate_limited_total", "class", info.RateLimitClass)
+			return refused(pb.RefusedReason_RATE_LIMITED), nil
+		}
+		return next(ctx, client, message)
+	}
+}
+
+// inFlightHeldKey 报文在分发时已占用并发名额(异步处理的报文在启动协程前占用)，ConcurrencyMiddleware 不再重复占用
+type inFlightHeldKey struct{}
+
+// ConcurrencyMiddleware 限制每个连接同时处理中的请求数，名额已满时短暂等待，仍无名额则拒绝。
+// 覆盖在读协程中同步处理的报文以及批量与分片中的报文
+func ConcurrencyMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		if info, ok := lookupHandler(message); !ok || info.Lightweight || ctx.Value(inFlightHeldKey{}) != nil {
+			return next(ctx, client, message)
+		}
+		if !client.acquireInFlight(ctx) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return refused(pb.RefusedReason_TOO_MANY_IN_FLIGHT), nil
+		}
+		defer client.releaseInFlight()
+		return next(ctx, client, message)
+	}
+}
+
+// acquireInFlight 占用一个并发名额，已满时最多等待 InFlightWait，仍无名额或 ctx 结束时返回false
+func (c *Client) acquireInFlight(ctx context.Context) bool {
+	select {
+	case c.inFlight <- struct{}{}:
+	default:
+		timer := time.NewTimer(config.Handler.InFlightWait)
+		defer timer.Stop()
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-timer.C:
+			metrics.Inc("in_flight_refused_total")
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	metrics.AddGauge("handler_in_flight", 1)
+	return true
+}
+
+// releaseInFlight 归还 acquireInFlight 占用的名额
+func (c *Client) releaseInFlight() {
+	<-c.inFlight
+	metrics.AddGauge("handler_in_flight", -1)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withConfig 在测试期间修改配置，结束后恢复
+func withConfig(t *testing.T, modify func(cfg *config.HandlerConfig)) {
+	t.Helper()
+	saved := *config.Handler
+	modify(config.Handler)
+	t.Cleanup(func() { *config.Handler = saved })
+}
+
+// slowAccounts 直到调用方取消才返回的账号后端
+type slowAccounts struct {
+	authRPCAccounts
+	cancelled chan struct{}
+}
+
+func (s *slowAccounts) VerifyCredentials(ctx context.Context, creds Credentials) (*VerifiedAccount, error) {
+	<-ctx.Done()
+	close(s.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestTimeoutMiddlewareCancelsSlowDependency(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.MessageTimeout = 50 * time.Millisecond })
+	accounts := &slowAccounts{cancelled: make(chan struct{})}
+	saved := defaultServer.accounts
+	defaultServer.SetAccountService(accounts)
+	t.Cleanup(func() { defaultServer.SetAccountService(saved) })
+
+	chain := buildChain(func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		rsp, _, err := HandleLoginMessage(ctx, message)
+		return rsp, err
+	}, []Middleware{TimeoutMiddleware})
+
+	start := time.Now()
+	rsp, err := chain(context.Background(), &Client{}, &pb.RequestMessage{
+		Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: "a", Password: "p"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rsp.GetRefused().GetReason(); got != pb.RefusedReason_TEMPORARILY_UNAVAILABLE {
+		t.Fatalf("期望 TEMPORARILY_UNAVAILABLE，实际为 %v", rsp)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("超时之后 %v 才返回", elapsed)
+	}
+	select {
+	case <-accounts.cancelled:
+	default:
+		t.Fatal("账号后端没有收到取消")
+	}
+}
+
+// recordingMiddleware 记录进入与返回的顺序，short 为true时不调用 next 直接返回响应
+func recordingMiddleware(name string, trace *[]string, short bool) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+			*trace = append(*trace, name+">")
+			if short {
+				return refused(pb.RefusedReason_FEATURE_DISABLED), nil
+			}
+			rsp, err := next(ctx, client, message)
+			*trace = append(*trace, "<"+name)
+			return rsp, err
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var trace []string
+	final := func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		trace = append(trace, "handler")
+		return &pb.ResponseMessage{}, nil
+	}
+	chain := buildChain(final, []Middleware{
+		recordingMiddleware("a", &trace, false),
+		recordingMiddleware("b", &trace, false),
+		recordingMiddleware("c", &trace, false),
+	})
+	if _, err := chain(context.Background(), &Client{}, &pb.RequestMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "a> b> c> handler <c <b <a"
+	if got := strings.Join(trace, " "); got != want {
+		t.Fatalf("执行顺序为 %q，期望 %q", got, want)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	var trace []string
+	final := func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		trace = append(trace, "handler")
+		return &pb.ResponseMessage{}, nil
+	}
+	chain := buildChain(final, []Middleware{
+		recordingMiddleware("a", &trace, false),
+		recordingMiddleware("b", &trace, true),
+		recordingMiddleware("c", &trace, false),
+	})
+	rsp, err := chain(context.Background(), &Client{}, &pb.RequestMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.GetRefused().GetReason() != pb.RefusedReason_FEATURE_DISABLED {
+		t.Fatalf("外层没有收到短路返回的响应: %v", rsp)
+	}
+	want := "a> b> <a"
+	if got := strings.Join(trace, " "); got != want {
+		t.Fatalf("执行顺序为 %q，期望 %q", got, want)
+	}
+}
+
+// Use 追加的中间件位于内置中间件之后，内置的登录检查拒绝时不会执行
+func TestUseRunsAfterBuiltinMiddlewares(t *testing.T) {
+	s := NewServer()
+	var trace []string
+	s.Use(recordingMiddleware("custom", &trace, false))
+	if n := len(s.middlewares); n != len(defaultMiddlewares())+1 {
+		t.Fatalf("中间件数量为 %d", n)
+	}
+	chain := buildChain(func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		trace = append(trace, "handler")
+		return &pb.ResponseMessage{}, nil
+	}, s.middlewares)
+
+	post := &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{}}}
+	rsp, err := chain(context.Background(), &Client{server: s}, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.GetRefused().GetReason() != pb.RefusedReason_NOT_LOGGED_IN {
+		t.Fatalf("未登录时期望 NOT_LOGGED_IN，实际为 %v", rsp)
+	}
+	if len(trace) != 0 {
+		t.Fatalf("登录检查拒绝后仍执行了内层: %v", trace)
+	}
+}
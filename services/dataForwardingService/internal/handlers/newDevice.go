@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"time"
+)
+
+// notifyNewDevice 登录后钩子：在用户从未登录过的设备上登录时，通知其他登录过的设备。
+// 在线的设备立即收到 NewDeviceLogin，不在线的设备离线保存并交给推送。用户的第一台设备不通知
+func notifyNewDevice(ctx context.Context, client *Client) {
+	cfg := config.Handler
+	if client.synthetic || !cfg.NewDeviceNotify {
+		return
+	}
+	at := time.UnixMilli(client.loginAt.Load())
+	known, err := redisClient.TouchKnownDevice(ctx, client.userID, client.deviceID, at, cfg.KnownDevicesMax)
+	if err != nil {
+		client.log().Warnf("登记已知设备失败: %v", err)
+		return
+	}
+	if known != redisClient.DeviceNew {
+		return
+	}
+	devices, err := redisClient.KnownDevices(ctx, client.userID)
+	if err != nil {
+		client.log().Warnf("查询已知设备失败，无法通知新设备登录: %v", err)
+		return
+	}
+
+	location := client.locate()
+	event := &pb.NewDeviceLogin{
+		DeviceId: client.deviceID,
+		Platform: client.declared().class,
+		Country:  location.Country,
+		Region:   location.Region,
+		City:     location.City,
+		AtMs:     at.UnixMilli(),
+	}
+	notified := 0
+	for _, deviceID := range devices {
+		if deviceID == client.deviceID {
+			continue
+		}
+		result, err := client.server.DeliverToUser(ctx, client.userID, &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_NewDeviceLogin{
+				NewDeviceLogin: event,
+			},
+		}, DeliveryOptions{
+			DeviceID: deviceID,
+			Priority: PriorityControl,
+		})
+		if err != nil {
+			client.log().Warnf("向设备 %s 通知新设备登录失败: %v", deviceID, err)
+			continue
+		}
+		if result != DeliveryDropped {
+			notified++
+		}
+	}
+	metrics.Inc("new_device_login_total")
+	client.log().Infof("新设备登录，已通知 %d 台其他设备", notified)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/redis"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// RedisOfflineStore 每个用户一个只追加的redis stream，撤回与账号注销以删除标记追加，
+// 回放时应用，压缩时物理删除。条目保留 OfflineRetention。
+// 消息被删除标记作废、补发、压缩或淘汰后移出用户的保存用量，每条只扣减一次
+type RedisOfflineStore struct{}
+
+var (
+	_ OfflineReplayer   = (*RedisOfflineStore)(nil)
+	_ OfflineReleaser   = (*RedisOfflineStore)(nil)
+	_ OfflineTombstoner = (*RedisOfflineStore)(nil)
+	_ OfflineCompactor  = (*RedisOfflineStore)(nil)
+	_ OfflineEvictor    = (*RedisOfflineStore)(nil)
+)
+
+// NewRedisOfflineStore 返回redis离线存储，通过 SetOfflineStore 启用
+func NewRedisOfflineStore() *RedisOfflineStore {
+	return &RedisOfflineStore{}
+}
+
+func (*RedisOfflineStore) Store(ctx context.Context, userID string, deviceID string, env *Envelope) error {
+	data, err := EncodeStored(env.Message)
+	if err != nil {
+		return fmt.Errorf("离线消息序列化失败: %w", err)
+	}
+	return redisClient.AppendOffline(ctx, userID, redisClient.OfflineEntry{
+		Kind:      redisClient.OfflineMessage,
+		MessageID: storedMessageID(env.Message),
+		DeviceID:  deviceID,
+		At:        time.Now().UnixMilli(),
+		Seq:       env.Seq,
+		Size:      int64(proto.Size(env.Message)),
+		Data:      data,
+	})
+}
+
+func (*RedisOfflineStore) Tombstone(ctx context.Context, userID string, t Tombstone) error {
+	kind := redisClient.OfflineRecall
+	if t.Kind == TombstonePurgeUser {
+		kind = redisClient.OfflinePurge
+	}
+	err := redisClient.AppendOffline(ctx, userID, redisClient.OfflineEntry{
+		Kind:      kind,
+		MessageID: t.MessageID,
+		At:        t.At.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	released, err := redisClient.ReleaseDeadOffline(ctx, userID, config.Handler.OfflineRetention)
+	if err != nil {
+		return fmt.Errorf("扣减作废消息的保存用量失败: %w", err)
+	}
+	return adjustStorage(ctx, released)
+}
+
+func (*RedisOfflineStore) Compact(ctx context.Context) error {
+	removed, err := redisClient.CompactOffline(ctx, config.Handler.OfflineRetention, func(freed redisClient.StorageUsage) {
+		if err := adjustStorage(ctx, freed); err != nil {
+			ctxLogger(ctx).Warnf("扣减用户 %s 的离线保存用量失败: %v", freed.UserID, err)
+		}
+	})
+	if removed > 0 {
+		ctxLogger(ctx).Infof("离线存储压缩删除 %d 条", removed)
+	}
+	return err
+}
+
+// Replay 按写入顺序返回发给该设备(及发给用户所有设备)、序号大于 afterSeq 的离线消息，被撤回或账号注销作废的消息不会返回
+func (*RedisOfflineStore) Replay(ctx context.Context, userID string, deviceID string, afterSeq int64) ([]*Envelope, error) {
+	entries, err := redisClient.ReadOffline(ctx, userID, config.Handler.OfflineRetention)
+	if err != nil {
+		return nil, err
+	}
+	envs := make([]*Envelope, 0, len(entries))
+	for _, entry := range entries {
+		if entry.DeviceID != "" && entry.DeviceID != deviceID || entry.Seq <= afterSeq {
+			continue
+		}
+		message, err := DecodeStored(entry.Data)
+		if err != nil {
+			ctxLogger(ctx).Warnf("用户 %s 的离线消息 %s 无法解析，已跳过: %v", userID, entry.ID, err)
+			continue
+		}
+		envs = append(envs, &Envelope{Message: message, Priority: PriorityInteractive, Seq: entry.Seq})
+	}
+	return envs, nil
+}
+
+// Release 补发成功后把该设备序号在 (afterSeq, throughSeq] 内的离线消息移出保存用量。
+// 消息仍留在stream中直到过期，发给所有设备的消息还要供其他设备补发
+func (*RedisOfflineStore) Release(ctx context.Context, userID string, deviceID string, afterSeq int64, throughSeq int64) error {
+	entries, err := redisClient.ReadOffline(ctx, userID, config.Handler.OfflineRetention)
+	if err != nil {
+		return err
+	}
+	replayed := entries[:0]
+	for _, entry := range entries {
+		if (entry.DeviceID == "" || entry.DeviceID == deviceID) && entry.Seq > afterSeq && entry.Seq <= throughSeq {
+			replayed = append(replayed, entry)
+		}
+	}
+	released, err := redisClient.ReleaseOffline(ctx, userID, replayed)
+	if err != nil {
+		return err
+	}
+	return adjustStorage(ctx, released)
+}
+
+// EvictOldest 从最早的消息开始删除，直到移出的用量不少于 entries 条且 bytes 字节，并扣减用户的保存用量
+func (*RedisOfflineStore) EvictOldest(ctx context.Context, userID string, entries int64, bytes int64) (redisClient.StorageEviction, error) {
+	eviction, err := redisClient.EvictOffline(ctx, userID, entries, bytes)
+	if err != nil {
+		return eviction, err
+	}
+	return eviction, adjustStorage(ctx, redisClient.StorageUsage{UserID: userID, Entries: eviction.Entries, Bytes: eviction.Bytes})
+}
+
+// adjustStorage 扣减移出的保存用量，没有移出时什么也不做
+func adjustStorage(ctx context.Context, released redisClient.StorageUsage) error {
+	if released.Entries == 0 && released.Bytes == 0 {
+		return nil
+	}
+	return AdjustStorageUsage(ctx, released.UserID, released.Entries, released.Bytes)
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	redisClient "data_forwarding_service/internal/redis"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 回放不返回被撤回或账号注销作废的消息，发给其他设备的消息与客户端已收到序号的消息也不返回
+func TestRedisOfflineStoreReplay(t *testing.T) {
+	withRedis(t)
+	ctx := context.Background()
+	store := NewRedisOfflineStore()
+	var seq int64
+	post := func(id string) *Envelope {
+		seq++
+		return &Envelope{Message: &pb.ResponseMessage{Payload: &pb.ResponseMessage_Post{Post: &pb.Post{MessageId: id}}}, Seq: seq}
+	}
+	replayAfter := func(afterSeq int64) []string {
+		t.Helper()
+		envs, err := store.Replay(ctx, "7", "phone", afterSeq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, env := range envs {
+			ids = append(ids, storedMessageID(env.Message))
+		}
+		return ids
+	}
+	replay := func() []string {
+		t.Helper()
+		return replayAfter(0)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if err := store.Store(ctx, "7", "", post(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Store(ctx, "7", "tablet", post("other-device")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replayAfter(1), []string{"m2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("last_seq=1 时回放 %v，期望 %v", got, want)
+	}
+	if got := replayAfter(2); len(got) != 0 {
+		t.Fatalf("last_seq=2 时回放 %v，期望为空", got)
+	}
+	if err := store.Tombstone(ctx, "7", Tombstone{Kind: TombstoneRecall, MessageID: "m1", At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(), []string{"m2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("撤回后回放 %v，期望 %v", got, want)
+	}
+
+	if err := store.Tombstone(ctx, "7", Tombstone{Kind: TombstonePurgeUser, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond) // 注销之后写入的消息时刻晚于标记
+	if err := store.Store(ctx, "7", "phone", post("m3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(), []string{"m3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("账号注销后回放 %v，期望 %v", got, want)
+	}
+	if err := store.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replay(), []string{"m3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("压缩后回放 %v，期望 %v", got, want)
+	}
+}
+
+// 超出上限时淘汰最早的消息并登记淘汰；撤回、补发与压缩后用量随之回落，不会重复扣减
+func TestRedisOfflineStoreStorageAccounting(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.StorageMaxEntries = 2
+		cfg.StorageMaxBytes = 0
+	})
+	ctx := context.Background()
+	s := NewServer()
+	store := NewRedisOfflineStore()
+	s.SetOfflineStore(store)
+	usage := func() int64 {
+		t.Helper()
+		total, err := redisClient.TotalStorageUsage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total.Entries
+	}
+	for i, id := range []string{"m1", "m2", "m3"} {
+		env := &Envelope{Message: &pb.ResponseMessage{Payload: &pb.ResponseMessage_Post{Post: &pb.Post{MessageId: id}}}, Seq: int64(i + 1)}
+		if _, err := s.storeOffline(ctx, "7", "", env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := usage(); n != 2 {
+		t.Fatalf("超额淘汰后用量 %d 条，期望 2", n)
+	}
+	envs, err := store.Replay(ctx, "7", "phone", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2 || storedMessageID(envs[0].Message) != "m2" {
+		t.Fatalf("淘汰后回放 %d 条，期望从 m2 开始的 2 条", len(envs))
+	}
+	eviction, err := redisClient.TakeStorageEviction(ctx, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eviction.Entries != 1 {
+		t.Fatalf("登记的淘汰为 %+v，期望 1 条", eviction)
+	}
+
+	if err := store.Tombstone(ctx, "7", Tombstone{Kind: TombstoneRecall, MessageID: "m2", At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if n := usage(); n != 1 {
+		t.Fatalf("撤回后用量 %d 条，期望 1", n)
+	}
+	if err := store.Release(ctx, "7", "phone", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if n := usage(); n != 0 {
+		t.Fatalf("补发后用量 %d 条，期望 0", n)
+	}
+	if err := store.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := usage(); n != 0 {
+		t.Fatalf("压缩后用量 %d 条，期望 0", n)
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"time"
+)
+
+// TombstoneKind 离线消息删除标记的类型
+type TombstoneKind int
+
+const (
+	TombstoneRecall    TombstoneKind = iota // 撤回单条消息，MessageID 为被撤回的消息
+	TombstonePurgeUser                      // 账号注销，标记时刻之前的全部离线消息作废
+)
+
+func (k TombstoneKind) String() string {
+	if k == TombstonePurgeUser {
+		return "purge_user"
+	}
+	return "recall"
+}
+
+// Tombstone 追加到用户离线队列中的删除标记。在其他容器可能同时追加消息时直接删除队列中的条目会产生竞争，
+// 被撤回或已注销账号的消息仍可能被回放，因此离线存储应当只追加：回放时按顺序应用删除标记，
+// 绝不输出被标记的消息，之后由 OfflineCompactor 物理删除
+type Tombstone struct {
+	Kind      TombstoneKind
+	MessageID string
+	At        time.Time
+}
+
+// OfflineTombstoner 支持软删除的离线存储实现此接口
+type OfflineTombstoner interface {
+	Tombstone(ctx context.Context, userID string, t Tombstone) error
+}
+
+// OfflineCompactor 离线存储的压缩：物理删除已被标记和已过期的条目。
+// 同一时刻集群中只有一个容器运行压缩，但追加会同时进行，实现需保证不会删除压缩开始后追加的条目
+type OfflineCompactor interface {
+	Compact(ctx context.Context) error
+}
+
+// tombstoneOffline 向用户的离线队列追加删除标记，离线存储不支持软删除时什么也不做
+func (s *Server) tombstoneOffline(ctx context.Context, userID string, t Tombstone) error {
+	store, ok := s.offline.(OfflineTombstoner)
+	if !ok {
+		return nil
+	}
+	if err := store.Tombstone(ctx, userID, t); err != nil {
+		return err
+	}
+	metrics.Inc("offline_tombstone_total", "kind", t.Kind.String())
+	return nil
+}
+
+// OfflineCompaction 离线存储压缩组件：离线存储实现了 OfflineCompactor 且 OfflineCompactInterval 大于0时，
+// 在分布式锁下定期运行压缩
+func (s *Server) OfflineCompaction() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name:      "offline_compaction",
+		DependsOn: []string{"redis"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			compactor, ok := s.offline.(OfflineCompactor)
+			interval := config.Handler.OfflineCompactInterval
+			if !ok || interval <= 0 {
+				return nil
+			}
+			go redisClient.RunExclusive(ctx, "offline_compaction", func(ctx context.Context) error {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-ticker.C:
+					}
+					start := time.Now()
+					if err := compactor.Compact(ctx); err != nil {
+						metrics.Inc("offline_compaction_total", "result", "error")
+						ctxLogger(ctx).Warnf("离线存储压缩失败: %v", err)
+						continue
+					}
+					metrics.Inc("offline_compaction_total", "result", "ok")
+					metrics.Observe("offline_compaction_ms", float64(time.Since(start).Milliseconds()))
+				}
+			})
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
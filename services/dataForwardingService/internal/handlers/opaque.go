@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/internal/metrics"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+)
+
+// opaqueFields 注册为 Opaque 的报文在 RequestMessage 中的字段编号。
+// 这类载荷(端到端密文等)服务端只读取路由字段，内容原样转发
+var opaqueFields = make(map[protowire.Number]bool)
+
+// registerOpaque 登记 oneof 包装类型对应的字段编号，读取时据此选择不复制的解码方式
+func registerOpaque(t reflect.Type) {
+	msg := &pb.RequestMessage{}
+	reflect.ValueOf(msg).Elem().FieldByName("Payload").Set(reflect.New(t.Elem()))
+	m := msg.ProtoReflect()
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("payload"))
+	if fd == nil {
+		panic(fmt.Sprintf("RegisterHandler: 无法取得 %v 的字段编号", t))
+	}
+	opaqueFields[fd.Number()] = true
+}
+
+// opaquePayload 只读取外层标签判断报文的载荷是否为 Opaque 类型，oneof 字段出现多次时以最后一个为准。
+// 格式错误时返回false，交给完整解码报告错误
+func opaquePayload(data []byte) bool {
+	if len(opaqueFields) == 0 {
+		return false
+	}
+	payload := (&pb.RequestMessage{}).ProtoReflect().Descriptor().Oneofs().ByName("payload").Fields()
+	opaque := false
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+		if payload.ByNumber(num) != nil {
+			opaque = opaqueFields[num]
+		}
+	}
+	return opaque
+}
+
+// decodeAliased 与 decodeMessage 的检查相同，但 bytes 字段直接引用 data 而不复制，
+// 调用方在返回后不能再修改或复用 data。100KB 的密文因此只在写入接收连接的帧时复制一次
+func decodeAliased(data []byte, msg proto.Message, maxBytes int) error {
+	if err := checkDecodeLimits(data, msg.ProtoReflect().Descriptor(), maxBytes); err != nil {
+		metrics.Inc("decode_rejected_total", "reason", decodeErrorReason(err))
+		return err
+	}
+	aliased, err := unmarshalAliased(data, msg.ProtoReflect())
+	if err != nil {
+		metrics.Inc("decode_rejected_total", "reason", "unmarshal")
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	metrics.Add("decode_aliased_bytes_total", float64(aliased))
+	return nil
+}
+
+// unmarshalAliased 逐字段解析：bytes 字段以原始字节的切片填入，消息字段递归解析，
+// 其余字段(标量、字符串、map与不认识的字段)连续的一段收集后合并解析。每段在下一个 bytes 或消息字段之前合并，
+// 所有字段按线上顺序生效，oneof 的成员先后出现时与 proto.Unmarshal 一样以最后一个为准。
+// 返回以引用方式填入的字节数
+func unmarshalAliased(data []byte, m protoreflect.Message) (int, error) {
+	fields := m.Descriptor().Fields()
+	aliased := 0
+	var rest []byte
+	flush := func() error {
+		if len(rest) == 0 {
+			return nil
+		}
+		opts := decodeOptions()
+		opts.Merge = true
+		err := opts.Unmarshal(rest, m.Interface())
+		rest = rest[:0]
+		return err
+	}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		fd := fields.ByNumber(num)
+		if typ != protowire.BytesType || fd == nil || fd.IsMap() || (fd.Kind() != protoreflect.BytesKind && fd.Kind() != protoreflect.MessageKind) {
+			l := protowire.ConsumeFieldValue(num, typ, data[n:])
+			if l < 0 {
+				return 0, protowire.ParseError(l)
+			}
+			rest = append(rest, data[:n+l]...)
+			data = data[n+l:]
+			continue
+		}
+		value, l := protowire.ConsumeBytes(data[n:])
+		if l < 0 {
+			return 0, protowire.ParseError(l)
+		}
+		data = data[n+l:]
+		if err := flush(); err != nil {
+			return 0, err
+		}
+
+		switch {
+		case fd.Kind() == protoreflect.BytesKind && fd.IsList():
+			m.Mutable(fd).List().Append(protoreflect.ValueOfBytes(value))
+			aliased += len(value)
+		case fd.Kind() == protoreflect.BytesKind:
+			m.Set(fd, protoreflect.ValueOfBytes(value))
+			aliased += len(value)
+		case fd.IsList():
+			list := m.Mutable(fd).List()
+			elem := list.NewElement()
+			n, err := unmarshalAliased(value, elem.Message())
+			if err != nil {
+				return 0, err
+			}
+			list.Append(elem)
+			aliased += n
+		default:
+			// 同一消息字段出现多次时按 proto 语义合并
+			n, err := unmarshalAliased(value, m.Mutable(fd).Message())
+			if err != nil {
+				return 0, err
+			}
+			aliased += n
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return aliased, nil
+}
+
+// sharedPayload 投递过程中只读、可以被多份响应共用的载荷类型，复制响应时不必深拷贝载荷。
+// 新增 Opaque 报文对应的响应类型时在此登记
+func sharedPayload(rsp *pb.ResponseMessage) bool {
+	switch rsp.GetPayload().(type) {
+	case *pb.ResponseMessage_Encrypted:
+		return true
+	default:
+		return false
+	}
+}
+
+// copyEnvelope 复制响应的外层字段，载荷与原响应共用
+func copyEnvelope(rsp *pb.ResponseMessage) *pb.ResponseMessage {
+	out := &pb.ResponseMessage{}
+	dst := out.ProtoReflect()
+	src := rsp.ProtoReflect()
+	src.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		dst.Set(fd, v)
+		return true
+	})
+	dst.SetUnknown(src.GetUnknown())
+	return out
+}
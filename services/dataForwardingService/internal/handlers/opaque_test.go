@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"unsafe"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// encryptedFrame 发给 devices 个设备、每份密文 size 字节的端到端加密报文
+func encryptedFrame(t testing.TB, devices int, size int) []byte {
+	t.Helper()
+	payload := &pb.EncryptedPayload{ToId: 42, Timestamp: "1700000000000", MessageId: "m1", ParentMessageId: "p1"}
+	for i := 0; i < devices; i++ {
+		ciphertext := make([]byte, size)
+		_, _ = rand.Read(ciphertext)
+		payload.Ciphertexts = append(payload.Ciphertexts, &pb.DeviceCiphertext{DeviceId: "d" + string(rune('0'+i)), Ciphertext: ciphertext})
+	}
+	return mustMarshal(t, &pb.RequestMessage{Jwt: "jwt", Payload: &pb.RequestMessage_Encrypted{Encrypted: payload}})
+}
+
+// decodeFull 不走 Opaque 快速路径的完整解码，作为比较的基准
+func decodeFull(t testing.TB, data []byte) *pb.RequestMessage {
+	t.Helper()
+	req := &pb.RequestMessage{}
+	if err := decodeMessage(data, req, maxRequestBytes()); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// forwardEncrypted 按 handleEncryptedMessage 的方式为每个设备构造响应，填写发送方类型后序列化，即投递时写入各连接的帧
+func forwardEncrypted(t testing.TB, req *pb.RequestMessage, clone bool) [][]byte {
+	payload := req.GetEncrypted()
+	frames := make([][]byte, 0, len(payload.GetCiphertexts()))
+	for _, ciphertext := range payload.GetCiphertexts() {
+		rsp := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Encrypted{Encrypted: &pb.EncryptedPayload{
+			FromId:      7,
+			ToId:        payload.GetToId(),
+			Ciphertexts: []*pb.DeviceCiphertext{ciphertext},
+			Timestamp:   payload.GetTimestamp(),
+			MessageId:   payload.GetMessageId(),
+		}}}
+		if clone {
+			rsp = proto.Clone(rsp).(*pb.ResponseMessage)
+			rsp.SenderType = pb.SenderType_SENDER_USER
+		} else {
+			rsp = withSenderType(rsp, pb.SenderType_SENDER_USER)
+		}
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(rsp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, data)
+	}
+	return frames
+}
+
+// within 判断 b 是否引用 frame 中的字节
+func within(b []byte, frame []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(frame)))
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return p >= start && p+uintptr(len(b)) <= start+uintptr(len(frame))
+}
+
+// Opaque 报文的解码结果与完整解码相同，密文引用原始帧而不复制；重复出现的载荷按 proto 语义合并，不认识的字段原样保留
+func TestAliasedDecodeMatchesFullDecode(t *testing.T) {
+	base := encryptedFrame(t, 3, 1024)
+	// 载荷字段再出现一次，追加一份密文并覆盖 message_id
+	extra := mustMarshal(t, &pb.RequestMessage{Payload: &pb.RequestMessage_Encrypted{Encrypted: &pb.EncryptedPayload{
+		MessageId:   "m2",
+		Ciphertexts: []*pb.DeviceCiphertext{{DeviceId: "d9", Ciphertext: []byte("tail")}},
+	}}})
+	unknown := protowire.AppendBytes(protowire.AppendTag(nil, 9999, protowire.BytesType), []byte("future"))
+	cases := []struct {
+		name  string
+		frame []byte
+	}{
+		{"单个载荷", base},
+		{"重复的载荷字段", append(append([]byte(nil), base...), extra...)},
+		{"不认识的字段", append(append([]byte(nil), base...), unknown...)},
+		{"不认识的字段在载荷之前", append(append([]byte(nil), unknown...), base...)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if !opaquePayload(c.frame) {
+				t.Fatal("加密报文没有选择 Opaque 解码")
+			}
+			want := decodeFull(t, c.frame)
+			got, err := HandleRequestData(c.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Fatalf("解码结果与完整解码不同:\n%v\n%v", got, want)
+			}
+			deterministic := proto.MarshalOptions{Deterministic: true}
+			gotBytes, _ := deterministic.Marshal(got)
+			wantBytes, _ := deterministic.Marshal(want)
+			if !bytes.Equal(gotBytes, wantBytes) {
+				t.Fatal("重新序列化的结果与完整解码不同")
+			}
+			for _, ciphertext := range got.GetEncrypted().GetCiphertexts() {
+				if !within(ciphertext.GetCiphertext(), c.frame) {
+					t.Fatalf("设备 %s 的密文被复制", ciphertext.GetDeviceId())
+				}
+			}
+			for _, ciphertext := range want.GetEncrypted().GetCiphertexts() {
+				if within(ciphertext.GetCiphertext(), c.frame) {
+					t.Fatal("完整解码的密文引用了原始帧")
+				}
+			}
+
+			// 转发给各设备的帧与完整解码再深拷贝的结果逐字节相同
+			gotFrames, wantFrames := forwardEncrypted(t, got, false), forwardEncrypted(t, want, true)
+			if len(gotFrames) != len(wantFrames) {
+				t.Fatalf("转发了 %d 帧，期望 %d", len(gotFrames), len(wantFrames))
+			}
+			for i := range gotFrames {
+				if !bytes.Equal(gotFrames[i], wantFrames[i]) {
+					t.Fatalf("第 %d 个设备的帧与完整解码转发的不同", i)
+				}
+			}
+		})
+	}
+}
+
+// oneof 的标量成员与消息、bytes 成员先后出现时，与 proto.Unmarshal 一样以线上最后一个为准
+func TestAliasedDecodeOneofLastWins(t *testing.T) {
+	number := mustMarshal(t, structpb.NewNumberValue(1))
+	str := mustMarshal(t, structpb.NewStringValue("s"))
+	list := mustMarshal(t, structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewBoolValue(true)}}))
+	cases := []struct {
+		name  string
+		parts [][]byte
+	}{
+		{"标量在消息之前", [][]byte{number, list}},
+		{"消息在标量之前", [][]byte{list, number}},
+		{"消息、标量、消息", [][]byte{list, str, list}},
+		{"标量、消息、标量", [][]byte{str, list, number}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame := bytes.Join(c.parts, nil)
+			want := &structpb.Value{}
+			if err := proto.Unmarshal(frame, want); err != nil {
+				t.Fatal(err)
+			}
+			got := &structpb.Value{}
+			if _, err := unmarshalAliased(frame, got.ProtoReflect()); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Fatalf("解码为 %v，proto.Unmarshal 为 %v", got, want)
+			}
+		})
+	}
+}
+
+// 只有最后一次出现的载荷为 Opaque 类型时才走快速路径，其余报文与格式错误的报文仍完整解码
+func TestOpaquePayloadDetection(t *testing.T) {
+	encrypted := encryptedFrame(t, 1, 16)
+	echo := mustMarshal(t, &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte("x")}}})
+	cases := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{"加密消息", encrypted, true},
+		{"回显", echo, false},
+		{"加密消息之后是回显", append(append([]byte(nil), encrypted...), echo...), false},
+		{"回显之后是加密消息", append(append([]byte(nil), echo...), encrypted...), true},
+		{"截断", encrypted[:len(encrypted)-1], false},
+		{"空报文", nil, false},
+	}
+	for _, c := range cases {
+		if got := opaquePayload(c.frame); got != c.want {
+			t.Errorf("%s: Opaque=%v，期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 共用载荷的响应填写发送方类型时只复制外层字段，原响应不被修改
+func TestWithSenderTypeSharesOpaquePayload(t *testing.T) {
+	payload := &pb.EncryptedPayload{ToId: 1, Ciphertexts: []*pb.DeviceCiphertext{{DeviceId: "d", Ciphertext: []byte("c")}}}
+	rsp := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Encrypted{Encrypted: payload}}
+	out := withSenderType(rsp, pb.SenderType_SENDER_USER)
+	if out == rsp || rsp.GetSenderType() != pb.SenderType_SENDER_UNSPECIFIED {
+		t.Fatal("填写发送方类型修改了原响应")
+	}
+	if out.GetEncrypted() != payload {
+		t.Fatal("只读载荷被深拷贝")
+	}
+	if out.GetSenderType() != pb.SenderType_SENDER_USER {
+		t.Fatalf("发送方类型为 %v", out.GetSenderType())
+	}
+}
+
+// 任意输入上 Opaque 解码与完整解码同时成功或失败，成功时结果相同
+func FuzzAliasedDecode(f *testing.F) {
+	f.Add(encryptedFrame(f, 2, 64))
+	f.Add(append(encryptedFrame(f, 1, 8), protowire.AppendTag(nil, 9999, protowire.VarintType)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want := &pb.RequestMessage{}
+		wantErr := decodeMessage(data, want, maxRequestBytes())
+		got := &pb.RequestMessage{}
+		gotErr := decodeAliased(data, got, maxRequestBytes())
+		if (gotErr == nil) != (wantErr == nil) {
+			t.Fatalf("Opaque 解码错误 %v，完整解码错误 %v", gotErr, wantErr)
+		}
+		if gotErr == nil && !proto.Equal(got, want) {
+			t.Fatalf("解码结果不同:\n%v\n%v", got, want)
+		}
+	})
+}
+
+// 一帧发给3个设备、每份100KB密文：解码并为每个设备序列化转发帧。
+// full 为完整解码并在填写发送方类型时深拷贝，opaque 为引用原始帧的解码并共用载荷
+func BenchmarkOpaqueForward(b *testing.B) {
+	frame := encryptedFrame(b, 3, 100*1024)
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(frame)))
+		for i := 0; i < b.N; i++ {
+			forwardEncrypted(b, decodeFull(b, frame), true)
+		}
+	})
+	b.Run("opaque", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(frame)))
+		for i := 0; i < b.N; i++ {
+			req, err := HandleRequestData(frame)
+			if err != nil {
+				b.Fatal(err)
+			}
+			forwardEncrypted(b, req, false)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Envelope 待投递给某个接收者的出站消息，序列化前会依次经过所有出站拦截器
+type Envelope struct {
+	Message  *pb.ResponseMessage
+	Priority Priority
+	ServerTs int64 // 服务端收到原始请求的时刻，为0时取投递时刻
+	Seq      int64 // 接收者维度的消息序号，为0表示不带序号
+
+	Conversation string // 消息所属会话，为空表示不属于任何会话
+	ConvSeq      int64  // 会话维度的消息序号，为0表示不带序号
+	Muted        bool   // 接收者对该会话免打扰：不推送，离线存储不应计入未读
+
+	TTL time.Duration // 在接收连接发送队列中的最长等待时间，为0时不过期；未指定时由 ttlInterceptor 按事件类别填写
+
+	Path       DeliveryPath // 投递路径，用于延迟指标分类，为空时视为本地投递
+	ReceivedAt time.Time    // 信封到达本容器的时刻，用于统计本跳耗时；为零值时与 ServerTs 相同
+}
+
+// OutboundInterceptor 出站拦截器，在消息序列化前对每个接收者调用一次。
+// 返回 nil Envelope 表示否决投递；返回错误时记录日志并跳过该拦截器，消息照常投递
+type OutboundInterceptor interface {
+	Process(recipientID string, env *Envelope) (*Envelope, error)
+}
+
+// OutboundInterceptorFunc 函数形式的出站拦截器
+type OutboundInterceptorFunc func(recipientID string, env *Envelope) (*Envelope, error)
+
+func (f OutboundInterceptorFunc) Process(recipientID string, env *Envelope) (*Envelope, error) {
+	return f(recipientID, env)
+}
+
+// defaultInterceptors 内置出站拦截器，时间戳与序号填充总是第一个
+func defaultInterceptors() []OutboundInterceptor {
+	return []OutboundInterceptor{
+		OutboundInterceptorFunc(stampInterceptor),
+		OutboundInterceptorFunc(senderInterceptor),
+		OutboundInterceptorFunc(ttlInterceptor),
+	}
+}
+
+// RegisterOutboundInterceptor 追加出站拦截器，按注册顺序执行，必须在服务启动之前调用
+func (s *Server) RegisterOutboundInterceptor(interceptor OutboundInterceptor) {
+	s.interceptors = append(s.interceptors, interceptor)
+}
+
+// RegisterOutboundInterceptor 为默认实例追加出站拦截器。
+//
+// Deprecated: 使用 Default().RegisterOutboundInterceptor
+func RegisterOutboundInterceptor(interceptor OutboundInterceptor) {
+	defaultServer.RegisterOutboundInterceptor(interceptor)
+}
+
+// stampInterceptor 填充服务端时间戳与消息序号
+func stampInterceptor(recipientID string, env *Envelope) (*Envelope, error) {
+	if env.ServerTs == 0 {
+		env.ServerTs = time.Now().UnixMilli()
+	}
+	env.Message.ServerTs = env.ServerTs
+	env.Message.Seq = env.Seq
+	env.Message.ConvSeq = env.ConvSeq
+	return env, nil
+}
+
+// ttlInterceptor 按事件类别填写队列有效期：正在输入、在线状态等临时事件过时即无意义，积压时宁可丢弃；
+// 需要可靠送达的消息不过期
+func ttlInterceptor(recipientID string, env *Envelope) (*Envelope, error) {
+	if env.TTL != 0 {
+		return env, nil
+	}
+	switch eventCategoryOf(env.Message) {
+	case pb.EventCategory_EVENT_TYPING, pb.EventCategory_EVENT_PRESENCE:
+		env.TTL = config.Handler.EphemeralTTL
+	}
+	return env, nil
+}
+
+// prepareOutbound 依次执行实例的出站拦截器后序列化，被否决时返回nil
+func (s *Server) prepareOutbound(recipientID string, env *Envelope) (*outboundFrame, error) {
+	if env == nil || env.Message == nil {
+		return nil, errors.New("出站消息为空")
+	}
+	// stampInterceptor 会为没有接收时刻的消息补填，此类消息不计入投递延迟
+	accepted := env.ServerTs
+	for _, interceptor := range s.interceptors {
+		name := fmt.Sprintf("%T", interceptor)
+		next, err := interceptor.Process(recipientID, env)
+		if err != nil {
+			metrics.Inc("outbound_interceptor_errors_total", "interceptor", name)
+			logger.Sugar().Warnf("出站拦截器 %s 处理发往 %s 的消息失败: %v", name, recipientID, err)
+			continue
+		}
+		if next == nil {
+			metrics.Inc("outbound_vetoed_total", "interceptor", name)
+			return nil, nil
+		}
+		env = next
+	}
+	data, err := s.serializeFor(recipientID, localize(env.Message, ""))
+	if err != nil {
+		return nil, fmt.Errorf("响应序列化失败: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("响应序列化结果为空")
+	}
+	recordOutbound(recipientID, env.Message, len(data))
+	return &outboundFrame{message: env.Message, data: data, ttl: env.TTL, timing: newFrameTiming(accepted, env)}, nil
+}
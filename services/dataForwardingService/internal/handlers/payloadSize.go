@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// sizeSampleCounter 入站与出站共用的帧计数，每 SizeSampleEvery 帧采样1帧
+var sizeSampleCounter atomic.Uint64
+
+// sizeHistogram 某方向、某报文类型的采样大小分布，counts[i] 为落在第i个分桶(不含之前分桶)的帧数，
+// 最后一项为超出最大分桶的帧数
+type sizeHistogram struct {
+	counts []uint64
+	sum    uint64
+	max    int
+}
+
+// sizeSamples 采样结果，供 /admin/size-report 计算分位数；Prometheus 中的 payload_size_bytes 与之同步记录
+var sizeSamples = struct {
+	sync.Mutex
+	series map[[2]string]*sizeHistogram // {[方向, 报文类型]: 分布}
+}{series: make(map[[2]string]*sizeHistogram)}
+
+// sampleSize 按采样率记录一帧的大小，未被采样时只有一次原子加法
+func sampleSize(direction, kind string, size int) {
+	every := uint64(max(config.Handler.SizeSampleEvery, 0))
+	if every == 0 || sizeSampleCounter.Add(1)%every != 0 {
+		return
+	}
+	metrics.ObserveBuckets("payload_size_bytes", metrics.SizeBuckets, float64(size), "direction", direction, "type", kind)
+
+	bucket := sort.SearchFloat64s(metrics.SizeBuckets, float64(size))
+	sizeSamples.Lock()
+	defer sizeSamples.Unlock()
+	h, ok := sizeSamples.series[[2]string{direction, kind}]
+	if !ok {
+		h = &sizeHistogram{counts: make([]uint64, len(metrics.SizeBuckets)+1)}
+		sizeSamples.series[[2]string{direction, kind}] = h
+	}
+	h.counts[bucket]++
+	h.sum += uint64(size)
+	h.max = max(h.max, size)
+}
+
+// percentile 按分桶内线性插值估计分位数，最后一个分桶以观测到的最大值为上界
+func (h *sizeHistogram) percentile(q float64, total uint64) float64 {
+	rank := q * float64(total)
+	var seen uint64
+	for i, n := range h.counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = metrics.SizeBuckets[i-1]
+		}
+		upper := float64(h.max)
+		if i < len(metrics.SizeBuckets) {
+			upper = min(metrics.SizeBuckets[i], upper)
+		}
+		return math.Round(lower + (upper-lower)*(rank-float64(seen))/float64(n))
+	}
+	return float64(h.max)
+}
+
+// sizeReportEntry 大小报告中的一项，字节数为估计值
+type sizeReportEntry struct {
+	Direction string  `json:"direction"`
+	Type      string  `json:"type"`
+	Samples   uint64  `json:"samples"`
+	Mean      float64 `json:"mean"`
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+	Max       int     `json:"max"`
+}
+
+// handleAdminSizeReport GET /admin/size-report 按方向与报文类型返回本容器自启动以来采样到的帧大小分位数，
+// 按采样数从多到少排列，sample_every 为采样率
+func handleAdminSizeReport(w http.ResponseWriter, r *http.Request) {
+	sizeSamples.Lock()
+	report := make([]sizeReportEntry, 0, len(sizeSamples.series))
+	for key, h := range sizeSamples.series {
+		var total uint64
+		for _, n := range h.counts {
+			total += n
+		}
+		report = append(report, sizeReportEntry{
+			Direction: key[0],
+			Type:      key[1],
+			Samples:   total,
+			Mean:      math.Round(float64(h.sum) / float64(total)),
+			P50:       h.percentile(0.5, total),
+			P90:       h.percentile(0.9, total),
+			P99:       h.percentile(0.99, total),
+			Max:       h.max,
+		})
+	}
+	sizeSamples.Unlock()
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Samples != report[j].Samples {
+			return report[i].Samples > report[j].Samples
+		}
+		return report[i].Direction+report[i].Type < report[j].Direction+report[j].Type
+	})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sample_every": config.Handler.SizeSampleEvery,
+		"buckets":      metrics.SizeBuckets,
+		"sizes":        report,
+	})
+}
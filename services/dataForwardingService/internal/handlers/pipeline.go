@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"time"
+)
+
+// Pipeline 投递流水线变体，用于在一部分用户上对比验证新的投递实现
+type Pipeline uint32
+
+const (
+	PipelineLegacy       Pipeline = iota // 现有实现
+	PipelineExperimental                 // 通过 SetExperimentalPipeline 注册的实现
+)
+
+var pipelineNames = [...]string{
+	PipelineLegacy:       "legacy",
+	PipelineExperimental: "experimental",
+}
+
+func (p Pipeline) String() string {
+	if int(p) < len(pipelineNames) {
+		return pipelineNames[p]
+	}
+	return "unknown"
+}
+
+// parsePipeline 解析流水线变体名，不认识的返回false
+func parsePipeline(name string) (Pipeline, bool) {
+	for p, n := range pipelineNames {
+		if n == name {
+			return Pipeline(p), true
+		}
+	}
+	return PipelineLegacy, false
+}
+
+// PipelineImpl 流水线在各个接缝处的实现，字段为nil时使用现有实现
+type PipelineImpl struct {
+	// Serialize 出站消息序列化
+	Serialize func(message *pb.ResponseMessage) ([]byte, error)
+	// Dispatch 消费者把投递交给工作协程，同一key的任务需保持顺序
+	Dispatch func(key string, task func())
+	// Write 写协程写出一帧，可在此合并写入
+	Write func(conn *websocket.Conn, messageType int, data []byte) error
+}
+
+// SetExperimentalPipeline 注册实验流水线的实现，未注册的接缝与现有实现相同，需在服务启动之前调用
+func (s *Server) SetExperimentalPipeline(impl PipelineImpl) {
+	s.experimental = impl
+}
+
+// SetExperimentalPipeline 注册默认实例的实验流水线。
+//
+// Deprecated: 使用 Default().SetExperimentalPipeline
+func SetExperimentalPipeline(impl PipelineImpl) {
+	defaultServer.SetExperimentalPipeline(impl)
+}
+
+// pipelineImpl 变体在实例中对应的实现
+func (s *Server) pipelineImpl(p Pipeline) PipelineImpl {
+	if p == PipelineExperimental {
+		return s.experimental
+	}
+	return PipelineImpl{}
+}
+
+// resolvePipeline 登录时确定用户使用的流水线：管理员指定的优先，其次是配置的黑白名单，
+// 其余用户按用户ID哈希落入 PipelineExperimentPct 内时使用实验流水线。
+// 同一用户的所有设备得到相同结果，放量比例提高时已分到实验流水线的用户保持不变
+func resolvePipeline(userID string, pin string) Pipeline {
+	if p, ok := parsePipeline(pin); ok {
+		return p
+	}
+	cfg := config.Handler
+	switch {
+	case cfg.PipelineDeny[userID]:
+		return PipelineLegacy
+	case cfg.PipelineAllow[userID]:
+		return PipelineExperimental
+	case rolloutBucket("pipeline", userID) < cfg.PipelineExperimentPct:
+		return PipelineExperimental
+	}
+	return PipelineLegacy
+}
+
+// PipelineOf 用户在实例中的连接所用的流水线，不在本实例时为现有流水线
+func (s *Server) PipelineOf(userID string) Pipeline {
+	if clients := s.clients.UserClients(userID); len(clients) > 0 {
+		return clients[0].pipelineVariant()
+	}
+	return PipelineLegacy
+}
+
+// PipelineOf 用户在默认实例中的连接所用的流水线。
+//
+// Deprecated: 使用 Default().PipelineOf
+func PipelineOf(userID string) Pipeline {
+	return defaultServer.PipelineOf(userID)
+}
+
+// PipelineDispatch 用户的投递应交给的工作协程池，为nil时使用消费者自己的协程池。消费者转来的投递由默认实例处理。
+// 用户重新登录后变体改变时，切换前后的两条消息可能在不同协程池中乱序，实验期间可以接受
+func PipelineDispatch(userID string) func(key string, task func()) {
+	return defaultServer.pipelineImpl(defaultServer.PipelineOf(userID)).Dispatch
+}
+
+// serializeFor 按接收者所用的流水线序列化出站消息
+func (s *Server) serializeFor(recipientID string, message *pb.ResponseMessage) ([]byte, error) {
+	p := s.PipelineOf(recipientID)
+	start := time.Now()
+	var data []byte
+	var err error
+	if serialize := s.pipelineImpl(p).Serialize; serialize != nil {
+		data, err = serialize(message)
+	} else {
+		data, err = proto.Marshal(message)
+	}
+	metrics.Observe("pipeline_serialize_us", float64(time.Since(start).Microseconds()), "pipeline", p.String())
+	return data, err
+}
+
+// writeFrame 按连接所用的流水线写出一帧
+func (c *Client) writeFrame(messageType int, data []byte) error {
+	p := c.pipelineVariant()
+	start := time.Now()
+	var err error
+	if write := c.server.pipelineImpl(p).Write; write != nil {
+		err = write(c.conn, messageType, data)
+	} else {
+		err = c.conn.WriteMessage(messageType, data)
+	}
+	metrics.Observe("pipeline_write_ms", float64(time.Since(start).Milliseconds()), "pipeline", p.String())
+	return err
+}
+
+// pipelineVariant 连接所用的流水线，登录前为现有流水线
+func (c *Client) pipelineVariant() Pipeline {
+	return Pipeline(c.pipeline.Load())
+}
+
+// loadPipelinePin 单独读取管理员指定的流水线，失败时按规则分配
+func loadPipelinePin(ctx context.Context, userID string) string {
+	pin, err := redisClient.GetPipelinePin(ctx, userID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("读取指定的投递流水线失败，按规则分配: %v", err)
+		return ""
+	}
+	return pin
+}
+
+// pipelinePinRequest PUT /admin/pipeline/{userID} 的请求体
+type pipelinePinRequest struct {
+	Pipeline string `json:"pipeline"`
+}
+
+// handleAdminPipeline /admin/pipeline/{userID}：GET 查询用户的流水线，PUT 指定变体，DELETE 取消指定。
+// 指定与取消在用户下次登录时生效
+func (s *Server) handleAdminPipeline(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	switch r.Method {
+	case http.MethodGet:
+		pin, err := redisClient.GetPipelinePin(r.Context(), userID)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"user_id":  userID,
+			"pin":      pin,
+			"resolved": resolvePipeline(userID, pin).String(),
+			"local":    s.PipelineOf(userID).String(),
+		})
+	case http.MethodPut:
+		var req pipelinePinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		p, ok := parsePipeline(req.Pipeline)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "pipeline must be legacy or experimental"})
+			return
+		}
+		if err := redisClient.SetPipelinePin(r.Context(), userID, p.String()); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"user_id": userID, "pin": p.String()})
+	case http.MethodDelete:
+		if err := redisClient.ClearPipelinePin(r.Context(), userID); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"user_id": userID, "resolved": resolvePipeline(userID, "").String()})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
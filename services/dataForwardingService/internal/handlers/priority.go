@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+)
+
+// Priority 出站报文优先级，写协程总是先发送高优先级队列中的报文
+type Priority int
+
+const (
+	PriorityControl     Priority = iota // 登录结果、踢下线、心跳等控制报文
+	PriorityInteractive                 // 单聊等交互消息
+	PriorityBulk                        // 群聊刷屏、大消息分片等批量报文
+	priorityCount
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "bulk"
+	}
+}
+
+// priorityOf 按响应类型确定优先级。只有登录、会话与连接状态类报文走控制队列，
+// 未列出的类型(包括新增类型)默认为交互报文，受发送队列容量限制
+func priorityOf(rsp *pb.ResponseMessage) Priority {
+	switch rsp.GetPayload().(type) {
+	case *pb.ResponseMessage_Login, *pb.ResponseMessage_Signup, *pb.ResponseMessage_LoginChallenge, *pb.ResponseMessage_TwoFactorRequired,
+		*pb.ResponseMessage_Server, *pb.ResponseMessage_Warn, *pb.ResponseMessage_Reconnect, *pb.ResponseMessage_SessionTerminated,
+		*pb.ResponseMessage_LogoutAck, *pb.ResponseMessage_LogoutAll, *pb.ResponseMessage_ReauthenticateRequired, *pb.ResponseMessage_TokenRefresh,
+		*pb.ResponseMessage_LimitWarning, *pb.ResponseMessage_ConnectionQuality, *pb.ResponseMessage_StorageEvicted, *pb.ResponseMessage_NewDeviceLogin:
+		return PriorityControl
+	case *pb.ResponseMessage_Chunk:
+		return PriorityBulk
+	default:
+		return PriorityInteractive
+	}
+}
+
+// closeLanes 关闭发送队列，写协程发送完剩余报文后退出
+func (c *Client) closeLanes() {
+	c.buffer.close()
+}
+
+// laneDepths 各优先级队列中待发送的报文数
+func (c *Client) laneDepths() map[string]int {
+	return c.buffer.depths()
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"sync"
+	"time"
+)
+
+// 连接劣化的症状
+const (
+	symptomSlowWrite       = "slow_write"       // 连续多次写入耗时超过 SlowWriteThreshold
+	symptomSendBacklog     = "send_backlog"     // 发送队列持续高于阈值
+	symptomHeartbeatMissed = "heartbeat_missed" // 距离心跳超时断开只差一个间隔
+)
+
+// connQuality 连接质量判定。出现任一症状即判为劣化，症状消失满 QualityRecoverAfter 才恢复，避免来回切换；
+// 判定结果与已通知客户端的状态不同、且距上次通知已过 QualityCooldown 时才下发 ConnectionQuality
+type connQuality struct {
+	mu           sync.Mutex
+	degraded     bool
+	reason       string
+	lastSymptom  time.Time
+	reported     bool // 已通知客户端的状态是否为劣化
+	reportedAt   time.Time
+	slowWrites   int       // 连续慢写次数
+	backlogSince time.Time // 发送队列开始高于阈值的时刻，为零表示当前低于阈值
+}
+
+// state 当前判定，供管理接口展示
+func (q *connQuality) state() (string, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.degraded {
+		return "degraded", q.reason
+	}
+	return "ok", ""
+}
+
+// observeWrite 写协程每次写入后调用
+func (c *Client) observeWrite(elapsed time.Duration) {
+	q := &c.quality
+	q.mu.Lock()
+	if elapsed < config.Handler.SlowWriteThreshold {
+		q.slowWrites = 0
+		q.mu.Unlock()
+		return
+	}
+	q.slowWrites++
+	repeated := q.slowWrites >= config.Handler.QualitySlowWrites
+	q.mu.Unlock()
+	if repeated {
+		c.reportSymptom(symptomSlowWrite)
+	}
+}
+
+// observeBacklog 入队后调用，发送队列使用率持续 QualityBacklogFor 不低于 QualityBacklogPercent 时视为劣化
+func (c *Client) observeBacklog(remaining int, capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	q := &c.quality
+	now := time.Now()
+	q.mu.Lock()
+	if (capacity-remaining)*100 < capacity*config.Handler.QualityBacklogPercent {
+		q.backlogSince = time.Time{}
+		q.mu.Unlock()
+		return
+	}
+	if q.backlogSince.IsZero() {
+		q.backlogSince = now
+	}
+	persistent := now.Sub(q.backlogSince) >= config.Handler.QualityBacklogFor
+	q.mu.Unlock()
+	if persistent {
+		c.reportSymptom(symptomSendBacklog)
+	}
+}
+
+// reportSymptom 记录一次症状并按需通知客户端
+func (c *Client) reportSymptom(reason string) {
+	q := &c.quality
+	q.mu.Lock()
+	if !q.degraded {
+		metrics.Inc("connection_degraded_total", "reason", reason)
+	}
+	q.degraded = true
+	q.reason = reason
+	q.lastSymptom = time.Now()
+	q.mu.Unlock()
+	c.adviseQuality()
+}
+
+// assessQuality 由心跳协程定期调用：症状消失足够久后恢复，并补发冷却期内被压下的通知
+func (c *Client) assessQuality() {
+	q := &c.quality
+	q.mu.Lock()
+	if q.degraded && time.Since(q.lastSymptom) >= config.Handler.QualityRecoverAfter {
+		q.degraded = false
+		q.reason = ""
+	}
+	q.mu.Unlock()
+	c.adviseQuality()
+}
+
+// adviseQuality 判定与已通知的状态不一致且不在冷却期内时下发 ConnectionQuality
+func (c *Client) adviseQuality() {
+	if c.loginAt.Load() == 0 || c.synthetic {
+		return
+	}
+	q := &c.quality
+	q.mu.Lock()
+	if q.degraded == q.reported || time.Since(q.reportedAt) < config.Handler.QualityCooldown {
+		q.mu.Unlock()
+		return
+	}
+	q.reported = q.degraded
+	q.reportedAt = time.Now()
+	advisory := &pb.ConnectionQuality{State: pb.QualityState_QUALITY_OK}
+	if q.degraded {
+		advisory.State = pb.QualityState_QUALITY_DEGRADED
+		advisory.Reason = q.reason
+		advisory.Action = pb.QualityAction_QUALITY_ACTION_REDUCE_TRAFFIC
+		if q.reason == symptomHeartbeatMissed {
+			advisory.Action = pb.QualityAction_QUALITY_ACTION_CHECK_NETWORK
+		}
+		advisory.Message = systemText("connection_quality.degraded."+q.reason, nil)
+	} else {
+		advisory.Message = systemText("connection_quality.ok", nil)
+	}
+	q.mu.Unlock()
+
+	metrics.Inc("connection_quality_advisory_total", "state", advisory.GetState().String())
+	err := c.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_ConnectionQuality{
+			ConnectionQuality: advisory,
+		},
+	})
+	if err != nil {
+		c.log().Warnf("发送连接质量通知失败: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"net"
+	"sync"
+	"time"
+)
+
+// 限流类别
+const (
+	rateClassDiagnostic   = "diagnostic"   // 连通性自检
+	rateClassAvailability = "availability" // 注册前的可用性检查，按IP限流防止枚举账号
+)
+
+// ipLimiters 按来源IP限流的类别，同一IP的所有连接共享令牌桶
+var ipLimiters = map[string]*ipLimiter{
+	rateClassAvailability: newIPLimiter(float64(config.Handler.AvailabilityPerMinute)/60, config.Handler.AvailabilityBurst),
+}
+
+// newClientLimiters 为每个连接创建各限流类别的令牌桶
+func newClientLimiters() map[string]*tokenBucket {
+	return map[string]*tokenBucket{
+		rateClassDiagnostic: newTokenBucket(config.Handler.EchoRate, config.Handler.EchoBurst),
+	}
+}
+
+// ipPruneThreshold 记录的IP数超过该值时清理已回满的令牌桶
+const ipPruneThreshold = 4096
+
+// ipLimiter 为每个来源IP维护一个令牌桶
+type ipLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+	return &ipLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow 尝试从该IP的令牌桶取出一个令牌
+func (l *ipLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= ipPruneThreshold {
+			l.prune()
+		}
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[ip] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.Allow()
+}
+
+// prune 删除已回满的令牌桶，回满的桶与新建的桶等价，需持有 l.mu
+func (l *ipLimiter) prune() {
+	for ip, bucket := range l.buckets {
+		if bucket.Full() {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// remoteIP 连接的来源IP
+func (c *Client) remoteIP() string {
+	addr := c.conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// tokenBucket 令牌桶限流器，rate 为每秒补充的令牌数，burst 为桶容量
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Full 令牌桶是否已回满
+func (b *tokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Remaining 当前剩余的令牌数(向下取整)与桶容量
+func (b *tokenBucket) Remaining() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens := min(b.tokens+time.Since(b.last).Seconds()*b.rate, b.burst)
+	return int(tokens), int(b.burst)
+}
+
+// Allow 尝试取出一个令牌，取不到时返回false
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve 预订一个令牌并返回需要等待的时间，令牌可以透支，但等待时间超过 maxWait 时不预订并返回false
+func (b *tokenBucket) Reserve(maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// featureReactions 表情回应的功能开关
+const featureReactions = "reactions"
+
+const (
+	maxMessageIDLen = 128
+	maxEmojiBytes   = 32
+)
+
+// validReaction 校验消息ID与表情：不能为空、不能过长、表情中不能有空白
+func validReaction(messageID string, emoji string) bool {
+	if messageID == "" || len(messageID) > maxMessageIDLen || !utf8.ValidString(messageID) {
+		return false
+	}
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleReact 添加或撤销表情回应：更新redis中的计数，只有计数真正变化时才转发给会话参与者
+func handleReact(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	event := &pb.ReactionEvent{FromId: fromID}
+	if react := message.GetReact(); react != nil {
+		event.MessageId, event.IsGroup, event.ToId, event.Emoji = react.GetMessageId(), react.GetIsGroup(), react.GetToId(), react.GetEmoji()
+	} else {
+		unreact := message.GetUnreact()
+		event.MessageId, event.IsGroup, event.ToId, event.Emoji = unreact.GetMessageId(), unreact.GetIsGroup(), unreact.GetToId(), unreact.GetEmoji()
+		event.Removed = true
+	}
+	if !validReaction(event.GetMessageId(), event.GetEmoji()) {
+		return nil, errors.New("表情回应的消息ID或表情不合法")
+	}
+
+	conv := conversation{IsGroup: event.GetIsGroup(), ToID: event.GetToId()}
+	recipients, err := client.server.participants(ctx, conv, fromID)
+	if err != nil {
+		return nil, fmt.Errorf("查询会话参与者失败: %w", err)
+	}
+
+	cfg := config.Handler
+	var applied int64
+	if event.GetRemoved() {
+		applied, err = redisClient.RemoveReaction(ctx, conv.key(fromID), event.GetMessageId(), event.GetEmoji(), client.userID, cfg.ReactionTTL)
+	} else {
+		applied, err = redisClient.AddReaction(ctx, conv.key(fromID), event.GetMessageId(), event.GetEmoji(), client.userID, redisClient.ReactionLimits{
+			MaxReactions: cfg.MaxReactionsPerMessage,
+			MaxEmojis:    cfg.MaxReactionEmojis,
+			TTL:          cfg.ReactionTTL,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("更新表情回应失败: %w", err)
+	}
+	switch applied {
+	case -1:
+		metrics.Inc("reaction_total", "result", "limited")
+		return refused(pb.RefusedReason_LIMIT_EXCEEDED), nil
+	case 0:
+		// 重复回应或撤销不存在的回应，计数未变化，无需通知
+		metrics.Inc("reaction_total", "result", "noop")
+		return nil, nil
+	}
+	metrics.Inc("reaction_total", "result", "applied")
+
+	// 大群中的表情回应不逐条转发：丢弃，或按消息合并后发送最新计数
+	switch policy := largeGroupPolicy(conv, pb.EventCategory_EVENT_REACTIONS); policy {
+	case fanoutDrop:
+		recordSuppressed(pb.EventCategory_EVENT_REACTIONS, policy, len(recipients))
+		return nil, nil
+	case fanoutRollup, fanoutDigest:
+		key, messageID := conv.key(fromID), event.GetMessageId()
+		scheduleRollup("reactions:"+key+":"+messageID, pb.EventCategory_EVENT_REACTIONS, policy, len(recipients), func(ctx context.Context) {
+			client.server.flushReactions(ctx, conv, key, messageID, recipients)
+		})
+		return nil, nil
+	}
+
+	client.server.DeliverToUsers(ctx, recipients, &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Reaction{
+			Reaction: event,
+		},
+	}, DeliveryOptions{
+		Priority: PriorityInteractive,
+		ServerTs: message.GetServerTs(),
+		Sender:   client.userID,
+	})
+	return nil, nil
+}
+
+// handleGetReactions 返回同一会话中若干消息当前的表情回应计数，供重连或新加入的客户端同步
+func handleGetReactions(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fromID, err := strconv.ParseInt(client.userID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+	}
+	req := message.GetGetReactions()
+	if len(req.GetMessageIds()) > config.Handler.MaxReactionQuery {
+		return refused(pb.RefusedReason_LIMIT_EXCEEDED), nil
+	}
+	conv := conversation{IsGroup: req.GetIsGroup(), ToID: req.GetToId()}
+	if _, err := client.server.participants(ctx, conv, fromID); err != nil {
+		return nil, fmt.Errorf("查询会话参与者失败: %w", err)
+	}
+
+	counts, err := redisClient.GetReactionCounts(ctx, conv.key(fromID), req.GetMessageIds())
+	if err != nil {
+		return nil, fmt.Errorf("读取表情回应失败: %w", err)
+	}
+	rsp := &pb.ReactionsRsp{IsGroup: req.GetIsGroup(), ToId: req.GetToId()}
+	for _, messageID := range req.GetMessageIds() {
+		rsp.Messages = append(rsp.Messages, messageReactions(messageID, counts[messageID]))
+	}
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Reactions{
+			Reactions: rsp,
+		},
+	}, nil
+}
+
+// messageReactions 将redis中的 {表情: 计数} 转为按计数从高到低排列的回应列表
+func messageReactions(messageID string, counts map[string]string) *pb.MessageReactions {
+	reactions := &pb.MessageReactions{MessageId: messageID}
+	for emoji, v := range counts {
+		count, _ := strconv.ParseInt(v, 10, 64)
+		if count > 0 {
+			reactions.Counts = append(reactions.Counts, &pb.ReactionCount{Emoji: emoji, Count: count})
+		}
+	}
+	sort.Slice(reactions.Counts, func(i, j int) bool {
+		return reactions.Counts[i].GetCount() > reactions.Counts[j].GetCount()
+	})
+	return reactions
+}
+
+// flushReactions 合并期结束后向会话参与者发送该消息最新的表情回应计数
+func (s *Server) flushReactions(ctx context.Context, conv conversation, key string, messageID string, recipients []string) {
+	counts, err := redisClient.GetReactionCounts(ctx, key, []string{messageID})
+	if err != nil {
+		ctxLogger(ctx).Warnf("读取表情回应失败，本轮合并未发送: %v", err)
+		return
+	}
+	s.DeliverToUsers(ctx, recipients, &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Reactions{
+			Reactions: &pb.ReactionsRsp{
+				IsGroup:  conv.IsGroup,
+				ToId:     conv.ToID,
+				Messages: []*pb.MessageReactions{messageReactions(messageID, counts[messageID])},
+			},
+		},
+	}, DeliveryOptions{
+		Priority: PriorityBulk,
+		ServerTs: time.Now().UnixMilli(),
+	})
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 要求重新认证的原因
+const (
+	reauthTokenExpiring    = "token_expiring"    // 访问令牌即将过期
+	reauthKeyRotation      = "key_rotation"      // 身份提供方轮换了签名密钥
+	reauthSessionShortened = "session_shortened" // 管理员缩短了会话有效期
+)
+
+// sessionExpiry 连接的会话有效期。到期前 ReauthLeadTime 推送 ReauthenticateRequired，
+// 到期时以 CloseSessionExpired 关闭连接；客户端在到期前提交新令牌即可原地延长。
+// generation 每次调整有效期时递增，已失效的定时器触发时发现代数不符即放弃，避免刷新与到期竞争时误断开
+type sessionExpiry struct {
+	mu         sync.Mutex
+	expiresAt  time.Time // 为零值时不过期
+	generation uint64
+	expired    bool // 已判定过期，之后的刷新一律拒绝
+	timers     []*time.Timer
+	watching   bool // 已注册连接关闭时停止定时器
+}
+
+// stopLocked 停止当前代的定时器并进入下一代
+func (s *sessionExpiry) stopLocked() uint64 {
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.timers = s.timers[:0]
+	s.generation++
+	return s.generation
+}
+
+// setSessionExpiry 设置会话到期时刻，lead 大于0时在到期前 lead 推送重新认证请求。会话已过期时返回false
+func (c *Client) setSessionExpiry(expiresAt time.Time, lead time.Duration) bool {
+	s := &c.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expired {
+		return false
+	}
+	c.armSessionLocked(expiresAt, lead)
+	return true
+}
+
+// armSessionLocked 重新设置到期与提醒定时器，返回新的代数，调用方需持有锁且会话未过期
+func (c *Client) armSessionLocked(expiresAt time.Time, lead time.Duration) uint64 {
+	s := &c.session
+	if !s.watching {
+		s.watching = true
+		context.AfterFunc(c.ctx, func() {
+			s.mu.Lock()
+			s.stopLocked()
+			s.mu.Unlock()
+		})
+	}
+	gen := s.stopLocked()
+	s.expiresAt = expiresAt
+	s.timers = append(s.timers, time.AfterFunc(time.Until(expiresAt), func() { c.expireSession(gen) }))
+	if lead > 0 {
+		s.timers = append(s.timers, time.AfterFunc(time.Until(expiresAt.Add(-lead)), func() {
+			c.requireReauth(gen, reauthTokenExpiring)
+		}))
+	}
+	return gen
+}
+
+// expireSession 到期定时器触发，会话在此期间已被刷新时不做处理
+func (c *Client) expireSession(gen uint64) {
+	s := &c.session
+	s.mu.Lock()
+	if s.generation != gen || s.expired {
+		s.mu.Unlock()
+		return
+	}
+	s.expired = true
+	s.mu.Unlock()
+	c.log().Infof("会话已过期，关闭连接")
+	metrics.Inc("session_expired_total")
+	c.Close(CloseSessionExpired)
+}
+
+// requireReauth 推送重新认证请求，截止时刻为当前的会话到期时刻
+func (c *Client) requireReauth(gen uint64, reason string) {
+	s := &c.session
+	s.mu.Lock()
+	if s.generation != gen || s.expired {
+		s.mu.Unlock()
+		return
+	}
+	deadline := s.expiresAt
+	s.mu.Unlock()
+	metrics.Inc("reauth_required_total", "reason", reason)
+	err := c.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_ReauthenticateRequired{
+			ReauthenticateRequired: &pb.ReauthenticateRequired{
+				DeadlineMs: deadline.UnixMilli(),
+				Reason:     reason,
+				Message:    systemText("reauthenticate_required."+reason, nil),
+			},
+		},
+	}, WithPriority(PriorityControl))
+	if err != nil {
+		c.log().Warnf("推送重新认证请求失败: %v", err)
+	}
+}
+
+// RequireReauthentication 要求连接在 deadline 之前提交新令牌，否则断开。
+// 会话原有到期时刻早于 deadline 时保持不变，只推送请求
+func (c *Client) RequireReauthentication(deadline time.Time, reason string) {
+	s := &c.session
+	s.mu.Lock()
+	if s.expired {
+		s.mu.Unlock()
+		return
+	}
+	gen := s.generation
+	if s.expiresAt.IsZero() || deadline.Before(s.expiresAt) {
+		gen = c.armSessionLocked(deadline, 0)
+	}
+	s.mu.Unlock()
+	c.requireReauth(gen, reason)
+}
+
+func tokenRefreshResponse(result pb.TokenRefreshResult, expiresAt time.Time, resumeToken string) *pb.ResponseMessage {
+	rsp := &pb.TokenRefreshRsp{Result: result, ResumeToken: resumeToken}
+	if !expiresAt.IsZero() {
+		rsp.ExpiresAtMs = expiresAt.UnixMilli()
+	}
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_TokenRefresh{
+			TokenRefresh: rsp,
+		},
+	}
+}
+
+// handleTokenRefresh 校验客户端提交的新访问令牌，属于同一用户时原地延长会话并签发新的恢复令牌。
+// 令牌无效时会话保持原有到期时刻，客户端可在到期前重试
+func handleTokenRefresh(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	if config.Handler.JWKSURL == "" {
+		return tokenRefreshResponse(pb.TokenRefreshResult_TOKEN_REFRESH_UNAVAILABLE, time.Time{}, ""), nil
+	}
+	userID, expiresAt, err := verifyJWT(ctx, message.GetTokenRefresh().GetToken())
+	if err != nil {
+		metrics.Inc("token_refresh_total", "result", "invalid")
+		client.log().Warnf("刷新令牌校验失败: %v", err)
+		return tokenRefreshResponse(pb.TokenRefreshResult_TOKEN_REFRESH_INVALID, time.Time{}, ""), nil
+	}
+	if userID != client.userID {
+		metrics.Inc("token_refresh_total", "result", "user_mismatch")
+		client.log().Warnf("刷新令牌属于用户 %s，与连接不符", userID)
+		return tokenRefreshResponse(pb.TokenRefreshResult_TOKEN_REFRESH_USER_MISMATCH, time.Time{}, ""), nil
+	}
+	if !client.setSessionExpiry(expiresAt, config.Handler.ReauthLeadTime) {
+		metrics.Inc("token_refresh_total", "result", "expired")
+		return tokenRefreshResponse(pb.TokenRefreshResult_TOKEN_REFRESH_SESSION_EXPIRED, time.Time{}, ""), nil
+	}
+	metrics.Inc("token_refresh_total", "result", "ok")
+	resumeToken, err := IssueResumeToken(ctx, client.userID, client.deviceID, identity.ContainerID())
+	if err != nil {
+		// 会话已延长，恢复令牌签发失败时客户端继续使用原来的令牌
+		client.log().Warnf("刷新会话时签发恢复令牌失败: %v", err)
+		resumeToken = ""
+	}
+	return tokenRefreshResponse(pb.TokenRefreshResult_TOKEN_REFRESH_OK, expiresAt, resumeToken), nil
+}
+
+type reauthRequest struct {
+	UserIDs      []string `json:"user_ids"` // 为空时针对本容器所有已登录连接
+	Reason       string   `json:"reason"`
+	GraceSeconds int      `json:"grace_seconds"`
+}
+
+// handleAdminReauth 要求本容器上的连接在宽限期内重新认证，用于密钥轮换或缩短会话有效期
+func (s *Server) handleAdminReauth(w http.ResponseWriter, r *http.Request) {
+	var req reauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	switch req.Reason {
+	case "":
+		req.Reason = reauthSessionShortened
+	case reauthKeyRotation, reauthSessionShortened:
+	default:
+		http.Error(w, "invalid reason", http.StatusBadRequest)
+		return
+	}
+	grace := time.Duration(req.GraceSeconds) * time.Second
+	if grace <= 0 {
+		grace = config.Handler.ReauthLeadTime
+	}
+	userIDs := req.UserIDs
+	if len(userIDs) == 0 {
+		userIDs = s.clients.Users()
+	} else {
+		auditUsers(r, userIDs...)
+	}
+	deadline := time.Now().Add(grace)
+	targeted := 0
+	for _, userID := range userIDs {
+		for _, client := range s.clients.UserClients(userID) {
+			if client.synthetic {
+				continue
+			}
+			client.RequireReauthentication(deadline, req.Reason)
+			targeted++
+		}
+	}
+	annotateAudit(r, "targeted", targeted)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"targeted":    targeted,
+		"deadline_ms": deadline.UnixMilli(),
+	})
+}
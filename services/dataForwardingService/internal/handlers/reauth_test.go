@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"data_forwarding_service/config"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// loggedInClient 通过真实连接以内存账号登录，返回服务端的连接对象与客户端的连接
+func loggedInClient(t *testing.T) (*Client, *websocket.Conn) {
+	t.Helper()
+	s := NewServer()
+	s.SetAccountService(NewMemoryAccountService(NewAccount{Account: "alice", Password: "pw"}))
+	conn := dialServer(t, s)
+	sendRequest(t, conn, &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: "alice", Password: "pw", DeviceId: "phone"}}})
+	if rsp := readUntil(t, conn, func(rsp *pb.ResponseMessage) bool { return rsp.GetLogin() != nil }).GetLogin(); rsp.GetResult() != pb.LoginResult_LOGIN_OK {
+		t.Fatalf("登录失败: %v", rsp)
+	}
+	client, ok := s.clients.DeviceClient(strconv.Itoa(memoryUserIDBase), "phone")
+	if !ok {
+		t.Fatal("登录后连接未登记")
+	}
+	return client, conn
+}
+
+func refreshToken(client *Client, token string) pb.TokenRefreshResult {
+	rsp, _ := handleTokenRefresh(context.Background(), client, &pb.RequestMessage{
+		Payload: &pb.RequestMessage_TokenRefresh{TokenRefresh: &pb.TokenRefresh{Token: token}},
+	})
+	return rsp.GetTokenRefresh().GetResult()
+}
+
+func sessionState(client *Client) (time.Time, uint64, bool) {
+	s := &client.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAt, s.generation, s.expired
+}
+
+func closed(client *Client) bool {
+	return client.ctx.Err() != nil
+}
+
+// 刷新与到期同时发生：刷新成功时连接不会被原来的到期定时器断开，
+// 到期先发生时刷新返回 SESSION_EXPIRED 且连接以 CloseSessionExpired 关闭，两者必居其一。需在 -race 下运行
+func TestTokenRefreshRacingExpiry(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.LoginDampMax = 0
+		cfg.ReauthLeadTime = 0
+	})
+	issuer := &testIssuer{}
+	withIssuer(t, issuer)
+	token := issuer.sign(t, issuer.kid, map[string]any{"sub": strconv.Itoa(memoryUserIDBase), "exp": time.Now().Add(time.Hour).Unix()})
+
+	const window = 20 * time.Millisecond
+	outcomes := make(map[pb.TokenRefreshResult]int)
+	for round := 0; round < 20; round++ {
+		client, _ := loggedInClient(t)
+		deadline := time.Now().Add(window)
+		if !client.setSessionExpiry(deadline, 0) {
+			t.Fatal("新登录的会话被判定为已过期")
+		}
+		// 刷新落在到期时刻前后 2ms 之内
+		time.Sleep(time.Until(deadline) + time.Duration(round%5-2)*time.Millisecond)
+		result := refreshToken(client, token)
+		outcomes[result]++
+
+		switch result {
+		case pb.TokenRefreshResult_TOKEN_REFRESH_OK:
+			time.Sleep(time.Until(deadline) + 5*window)
+			if closed(client) {
+				t.Fatalf("第 %d 轮刷新成功后连接仍被断开，原因: %s", round, client.closeReason)
+			}
+			if expiresAt, _, expired := sessionState(client); expired || !expiresAt.After(deadline.Add(time.Minute)) {
+				t.Fatalf("第 %d 轮刷新成功后会话到期时刻为 %v，已过期=%v", round, expiresAt, expired)
+			}
+		case pb.TokenRefreshResult_TOKEN_REFRESH_SESSION_EXPIRED:
+			waitFor(t, "过期的连接关闭", func() bool { return closed(client) })
+			if client.closeReason != CloseSessionExpired {
+				t.Fatalf("第 %d 轮断开原因为 %s，期望 %s", round, client.closeReason, CloseSessionExpired)
+			}
+		default:
+			t.Fatalf("第 %d 轮刷新返回 %v", round, result)
+		}
+		client.Close(CloseReadError)
+	}
+	t.Logf("刷新结果: %v", outcomes)
+}
+
+// 刷新之前已经触发、但晚于刷新拿到锁的到期定时器属于上一代，不会断开连接
+func TestStaleExpiryTimerIgnored(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ReauthLeadTime = 0 })
+	issuer := &testIssuer{}
+	withIssuer(t, issuer)
+	client, conn := loggedInClient(t)
+
+	client.setSessionExpiry(time.Now().Add(time.Hour), 0)
+	_, stale, _ := sessionState(client)
+	token := issuer.sign(t, issuer.kid, map[string]any{"sub": strconv.Itoa(memoryUserIDBase), "exp": time.Now().Add(2 * time.Hour).Unix()})
+	if result := refreshToken(client, token); result != pb.TokenRefreshResult_TOKEN_REFRESH_OK {
+		t.Fatalf("刷新返回 %v", result)
+	}
+	client.expireSession(stale)
+	client.requireReauth(stale, reauthTokenExpiring)
+	if _, _, expired := sessionState(client); expired || closed(client) {
+		t.Fatal("上一代的到期定时器断开了已刷新的会话")
+	}
+	// 回显请求之前没有收到重新认证请求
+	sendRequest(t, conn, &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte("x")}}})
+	readUntil(t, conn, func(rsp *pb.ResponseMessage) bool {
+		if rsp.GetReauthenticateRequired() != nil {
+			t.Fatal("上一代的提醒定时器推送了重新认证请求")
+		}
+		return rsp.GetEcho() != nil
+	})
+}
+
+// 无效的刷新令牌与属于其他用户的令牌都不改变会话：
+// 到期时刻与定时器保持原样，会话按原定时刻过期，过期后的有效令牌也不能恢复会话
+func TestInvalidTokenRefreshKeepsSession(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ReauthLeadTime = 0 })
+	issuer := &testIssuer{}
+	withIssuer(t, issuer)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger := &testIssuer{key: otherKey, kid: issuer.kid}
+
+	userID := strconv.Itoa(memoryUserIDBase)
+	valid := map[string]any{"sub": userID, "exp": time.Now().Add(time.Hour).Unix()}
+	cases := []struct {
+		name  string
+		token string
+		want  pb.TokenRefreshResult
+	}{
+		{"格式错误", "not.a.jwt", pb.TokenRefreshResult_TOKEN_REFRESH_INVALID},
+		{"空令牌", "", pb.TokenRefreshResult_TOKEN_REFRESH_INVALID},
+		{"签名密钥不符", forger.sign(t, issuer.kid, valid), pb.TokenRefreshResult_TOKEN_REFRESH_INVALID},
+		{"未知的kid", issuer.sign(t, "unknown", valid), pb.TokenRefreshResult_TOKEN_REFRESH_INVALID},
+		{"已过期", issuer.sign(t, issuer.kid, map[string]any{"sub": userID, "exp": time.Now().Add(-time.Hour).Unix()}), pb.TokenRefreshResult_TOKEN_REFRESH_INVALID},
+		{"其他用户", issuer.sign(t, issuer.kid, map[string]any{"sub": "999", "exp": time.Now().Add(time.Hour).Unix()}), pb.TokenRefreshResult_TOKEN_REFRESH_USER_MISMATCH},
+	}
+
+	client, _ := loggedInClient(t)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	client.setSessionExpiry(deadline, 0)
+	expiresAt, gen, _ := sessionState(client)
+	for _, c := range cases {
+		if result := refreshToken(client, c.token); result != c.want {
+			t.Fatalf("%s: 刷新返回 %v，期望 %v", c.name, result, c.want)
+		}
+		if gotExpiresAt, gotGen, expired := sessionState(client); !gotExpiresAt.Equal(expiresAt) || gotGen != gen || expired {
+			t.Fatalf("%s: 刷新失败后会话被改变: 到期时刻 %v→%v，代数 %d→%d，已过期=%v", c.name, expiresAt, gotExpiresAt, gen, gotGen, expired)
+		}
+	}
+	if closed(client) {
+		t.Fatalf("到期之前连接被断开，原因: %s", client.closeReason)
+	}
+
+	waitFor(t, "会话按原定时刻过期", func() bool { return closed(client) })
+	if client.closeReason != CloseSessionExpired {
+		t.Fatalf("断开原因为 %s，期望 %s", client.closeReason, CloseSessionExpired)
+	}
+	if early := deadline.Sub(time.Now()); early > 0 {
+		t.Fatalf("会话提前 %v 过期", early)
+	}
+	if result := refreshToken(client, issuer.sign(t, issuer.kid, valid)); result != pb.TokenRefreshResult_TOKEN_REFRESH_SESSION_EXPIRED {
+		t.Fatalf("过期后刷新返回 %v，期望 SESSION_EXPIRED", result)
+	}
+}
+
+// 未配置 JWKS 时刷新返回 UNAVAILABLE，不校验令牌，会话保持原有到期时刻
+func TestTokenRefreshUnavailableWithoutJWKS(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.JWKSURL = "" })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &Client{ctx: ctx, userID: "7"}
+	client.setSessionExpiry(time.Now().Add(time.Hour), 0)
+	expiresAt, gen, _ := sessionState(client)
+
+	if result := refreshToken(client, "not.a.jwt"); result != pb.TokenRefreshResult_TOKEN_REFRESH_UNAVAILABLE {
+		t.Fatalf("刷新返回 %v，期望 UNAVAILABLE", result)
+	}
+	if gotExpiresAt, gotGen, _ := sessionState(client); !gotExpiresAt.Equal(expiresAt) || gotGen != gen {
+		t.Fatal("未配置 JWKS 时刷新改变了会话")
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/lifecycle"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"encoding/json"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"time"
+)
+
+// receiptSweepBatch 每轮过期清理最多处理的回执数
+const receiptSweepBatch = 500
+
+// ReceiptRequest 投递回执请求：接收者的设备确认收到该消息的序号，或超过 ReceiptTTL 仍未确认时，
+// 向 Topic 发布 DeliveryReceipt。回执依赖消息序号，设置后投递总会分配序号
+type ReceiptRequest struct {
+	Topic         string `json:"topic"`
+	CorrelationID string `json:"correlation_id"`
+}
+
+// trackReceipts 登记待确认的回执，seqs 为 {用户ID: 消息序号}，没有序号的接收者无法确认，不登记。
+// 登记失败只记录日志，不影响投递
+func trackReceipts(ctx context.Context, seqs map[string]int64, req *ReceiptRequest) {
+	tracked := make(map[string]int64, len(seqs))
+	for userID, seq := range seqs {
+		if seq != 0 {
+			tracked[userID] = seq
+		}
+	}
+	if len(tracked) == 0 {
+		return
+	}
+	value, err := json.Marshal(req)
+	if err != nil {
+		ctxLogger(ctx).Warnf("回执请求序列化失败: %v", err)
+		return
+	}
+	deadline := time.Now().Add(config.Handler.ReceiptTTL)
+	if err := redisClient.TrackReceipts(ctx, tracked, string(value), deadline); err != nil {
+		metrics.Inc("receipts_tracked_total", "result", "error")
+		ctxLogger(ctx).Warnf("登记投递回执失败: %v", err)
+		return
+	}
+	metrics.Add("receipts_tracked_total", float64(len(tracked)), "result", "ok")
+}
+
+// publishReceipt 向回执请求中的topic发布回执
+func publishReceipt(ctx context.Context, value string, userID string, deviceID string, seq int64, status pb.ReceiptStatus) {
+	var req ReceiptRequest
+	if err := json.Unmarshal([]byte(value), &req); err != nil || req.Topic == "" {
+		ctxLogger(ctx).Warnf("用户 %s 序号 %d 的回执请求无效: %s", userID, seq, value)
+		return
+	}
+	// 回执的消费方是外部系统，按 DeliveryReceipt 的契约发布，不包装 WireEnvelope
+	data, err := proto.Marshal(&pb.DeliveryReceipt{
+		CorrelationId: req.CorrelationID,
+		UserId:        userID,
+		DeviceId:      deviceID,
+		Seq:           seq,
+		Status:        status,
+		Ts:            time.Now().UnixMilli(),
+	})
+	if err != nil {
+		ctxLogger(ctx).Warnf("回执序列化失败: %v", err)
+		return
+	}
+	if err := publishMessage(ctx, data, req.Topic); err != nil {
+		metrics.Inc("receipts_published_total", "status", status.String(), "result", "error")
+		ctxLogger(ctx).Warnf("发布回执到 %s 失败: %v", req.Topic, err)
+		return
+	}
+	metrics.Inc("receipts_published_total", "status", status.String(), "result", "ok")
+}
+
+// handleAckSeq 客户端确认收到序号不大于 seq 的消息，为其中登记了回执的消息发布已送达回执。
+// 回执从redis中删除后才发布，重复确认不会产生重复回执
+func handleAckSeq(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	taken, err := redisClient.TakeReceiptsUpTo(ctx, client.userID, message.GetAckSeq().GetSeq())
+	if err != nil {
+		return nil, err
+	}
+	for seq, value := range taken {
+		publishReceipt(ctx, value, client.userID, client.deviceID, seq, pb.ReceiptStatus_RECEIPT_DELIVERED)
+	}
+	return nil, nil
+}
+
+// sweepReceipts 为已过保留期仍未确认的消息发布过期回执，返回处理的条数
+func sweepReceipts(ctx context.Context) (int, error) {
+	due, err := redisClient.DueReceipts(ctx, time.Now(), receiptSweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	for _, member := range due {
+		userID, field, ok := redisClient.SplitDeviceKey(member)
+		seq, err := strconv.ParseInt(field, 10, 64)
+		if !ok || err != nil {
+			ctxLogger(ctx).Warnf("回执过期索引格式错误: %s", member)
+			continue
+		}
+		value, taken, err := redisClient.TakeReceipt(ctx, userID, seq)
+		if err != nil {
+			return 0, err
+		}
+		if taken {
+			publishReceipt(ctx, value, userID, "", seq, pb.ReceiptStatus_RECEIPT_EXPIRED)
+		}
+	}
+	return len(due), nil
+}
+
+// ReceiptExpiry 回执过期清理组件，集群内同一时刻只有一个容器执行；ReceiptSweepInterval 为0时不启动
+func (s *Server) ReceiptExpiry() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name:      "receipt_expiry",
+		DependsOn: []string{"redis"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			interval := config.Handler.ReceiptSweepInterval
+			if interval <= 0 {
+				return nil
+			}
+			go redisClient.RunExclusive(ctx, "receipt_expiry", func(ctx context.Context) error {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-ticker.C:
+					}
+					// 积压时连续处理，直到一轮取不满
+					for {
+						n, err := sweepReceipts(ctx)
+						if err != nil {
+							ctxLogger(ctx).Warnf("回执过期清理失败: %v", err)
+							break
+						}
+						if n < receiptSweepBatch || ctx.Err() != nil {
+							break
+						}
+					}
+				}
+			})
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
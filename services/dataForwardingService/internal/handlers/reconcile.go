@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/audit"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"net/http"
+	"slices"
+)
+
+// 连接审计记录的 Action
+const (
+	connectionLoggedIn     = "logged_in"
+	connectionDisconnected = "disconnected"
+)
+
+// auditConnections 将登录与断开事件写入审计记录，未登录连接的断开不记录。
+// 事件订阅是尽力而为的，丢弃的事件只会让对账工具多报告可疑项，不会导致误删
+func auditConnections(sub *Subscription) {
+	containerID := identity.ContainerID()
+	for event := range sub.C {
+		var record *audit.Event
+		switch e := event.(type) {
+		case ClientLoggedIn:
+			record = &audit.Event{
+				Action: connectionLoggedIn,
+				At:     e.At,
+				Users:  []string{e.UserID},
+				Params: map[string]string{"device_id": e.DeviceID},
+			}
+		case ClientDisconnected:
+			if e.UserID == "" {
+				continue
+			}
+			record = &audit.Event{
+				Action: connectionDisconnected,
+				At:     e.At,
+				Users:  []string{e.UserID},
+				Params: map[string]string{"device_id": e.DeviceID, "reason": string(e.Reason)},
+			}
+		default:
+			continue
+		}
+		record.Type = audit.TypeConnection
+		record.Caller = containerID
+		record.Outcome = "ok"
+		record.Params["container"] = containerID
+		ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+		if err := audit.Record(ctx, record); err != nil {
+			metrics.Inc("audit_write_errors_total", "action", record.Action)
+		}
+		cancel()
+	}
+}
+
+// handleAdminRemoveRegistration 删除一条没有对应存活连接的设备登记，供对账工具修复redis使用。
+// container 参数默认为本容器；指定其他容器时，该容器必须已不存活。设备在本容器仍有连接时拒绝删除
+func (s *Server) handleAdminRemoveRegistration(w http.ResponseWriter, r *http.Request) {
+	userID, deviceID := r.PathValue("userID"), r.PathValue("deviceID")
+	containerID := r.URL.Query().Get("container")
+	if containerID == "" {
+		containerID = identity.ContainerID()
+	}
+	annotateAudit(r, "container", containerID)
+
+	if containerID == identity.ContainerID() {
+		if _, ok := s.clients.DeviceClient(userID, deviceID); ok {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "device is connected to this container"})
+			return
+		}
+	} else {
+		alive, err := identity.ListContainers(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		if slices.Contains(alive, containerID) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "container is alive, ask it directly"})
+			return
+		}
+	}
+
+	if err := redisClient.RemoveRegistration(r.Context(), userID, deviceID, containerID); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"user_id":   userID,
+		"device_id": deviceID,
+		"container": containerID,
+	})
+}
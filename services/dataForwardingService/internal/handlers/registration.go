@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"time"
+)
+
+// ErrRegistrationPending 连接已在本地保存，但redis登记失败，转入后台重试
+var ErrRegistrationPending = errors.New("redis登记失败，转入后台重试")
+
+// retryRegistration 降级登录后在后台重试redis登记，超过 RegistrationRetryWindow 仍失败则通知客户端并断开。
+// 登记完成前跨容器发往该设备的消息可能投递不到
+func retryRegistration(client *Client, userID string, deviceID string, containerID string) {
+	sugar := client.log()
+	start := time.Now()
+	deadline := start.Add(config.Handler.RegistrationRetryWindow)
+	backoff := 100 * time.Millisecond
+	metrics.AddGauge("registration_pending", 1)
+	defer metrics.AddGauge("registration_pending", -1)
+
+	for {
+		select {
+		case <-client.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(client.ctx, config.Handler.MessageTimeout)
+		err := redisClient.RegisterConnection(ctx, userID, deviceID, containerID)
+		cancel()
+		if err == nil {
+			client.registrationPending.Store(false)
+			metrics.Observe("registration_pending_ms", float64(time.Since(start).Milliseconds()))
+			sugar.Infof("降级连接补登记成功，耗时 %v", time.Since(start))
+			if client.ctx.Err() != nil {
+				// 登记成功时连接恰好关闭，撤销登记
+				ctx, cancel := context.WithTimeout(context.Background(), config.Handler.MessageTimeout)
+				_ = redisClient.UnregisterConnection(ctx, userID, deviceID, containerID)
+				cancel()
+			}
+			return
+		}
+
+		if time.Now().After(deadline) {
+			sugar.Errorf("降级连接在 %v 内未能完成登记，断开: %v", config.Handler.RegistrationRetryWindow, err)
+			metrics.Inc("registration_failed_total")
+			if sendErr := client.Enqueue(loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR)); sendErr != nil {
+				sugar.Warnf("发送登记失败通知失败: %v", sendErr)
+			}
+			client.Close(CloseRegistrationFailed)
+			return
+		}
+		sugar.Warnf("降级连接补登记失败，%v 后重试: %v", backoff, err)
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
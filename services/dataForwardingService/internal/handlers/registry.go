@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/sha256"
+	"data_forwarding_service/internal/metrics"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"strconv"
+)
+
+// HandlerInfo 某种报文类型的处理函数及其元数据
+type HandlerInfo struct {
+	Handler        MessageHandler
+	RequiresLogin  bool        // 是否需要登录后才能处理
+	AllowGuest     bool        // 是否允许游客会话使用
+	RateLimitClass string      // 限流类别，为空表示不限流
+	OrderSensitive bool        // 是否要求与同一连接的其他报文保持顺序，否则在独立协程中处理
+	Lightweight    bool        // 心跳、确认、登出等轻量报文，不占用连接的并发名额
+	FeatureFlag    string      // 非空时只有开启了该功能开关的用户可用，其余用户被拒绝
+	Validate       []FieldRule // 字段校验规则，在处理函数之前执行
+	Opaque         bool        // 服务端不解析内容的载荷(如端到端密文)，读取时 bytes 字段引用原始帧而不复制
+}
+
+// registry 以 oneof 包装类型(如 *pb.RequestMessage_Post)为键
+var registry = make(map[reflect.Type]*HandlerInfo)
+
+// RegisterHandler 注册报文处理函数，payload 为 oneof 包装类型的零值，如 (*pb.RequestMessage_Post)(nil)。
+// 同一类型重复注册会直接panic，应在服务启动前完成注册
+func RegisterHandler(payload any, info HandlerInfo) {
+	t := reflect.TypeOf(payload)
+	if t == nil || info.Handler == nil {
+		panic("RegisterHandler: payload 与 Handler 不能为空")
+	}
+	if _, ok := registry[t]; ok {
+		panic(fmt.Sprintf("RegisterHandler: %v 重复注册", t))
+	}
+	checkRules(t, info.Validate)
+	if info.Opaque {
+		registerOpaque(t)
+	}
+	registry[t] = &info
+}
+
+// lookupHandler 查找报文对应的处理函数
+func lookupHandler(message *pb.RequestMessage) (*HandlerInfo, bool) {
+	t := reflect.TypeOf(message.GetPayload())
+	if t == nil {
+		return nil, false
+	}
+	info, ok := registry[t]
+	return info, ok
+}
+
+// refused 构造带原因的拒绝响应
+func refused(reason pb.RefusedReason) *pb.ResponseMessage {
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Refused{
+			Refused: &pb.Refused{
+				Reason: reason,
+			},
+		},
+	}
+}
+
+// withUser 适配需要发送者用户ID的处理函数
+func withUser(fn func(ctx context.Context, client *Client, fromID int64, message *pb.RequestMessage) error) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		fromID, err := strconv.ParseInt(client.userID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无法将 %s 转为int64: %w", client.userID, err)
+		}
+		return nil, fn(ctx, client, fromID, message)
+	}
+}
+
+// withClient 适配只需要连接的处理函数
+func withClient(fn func(ctx context.Context, client *Client, message *pb.RequestMessage) error) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		return nil, fn(ctx, client, message)
+	}
+}
+
+// logOnly 尚未实现的报文只记录日志
+func logOnly(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	client.log().Infof("收到 %T 消息: %+v", message.GetPayload(), message.GetPayload())
+	return nil, nil
+}
+
+func init() {
+	RegisterHandler((*pb.RequestMessage_Login)(nil), HandlerInfo{
+		Handler:        loginHandler,
+		AllowGuest:     true,
+		OrderSensitive: true,
+		Validate: []FieldRule{
+			{Field: "account", MaxLen: maxNameLen},
+			{Field: "password", MaxLen: maxSecretLen},
+			{Field: "device_id", MaxLen: maxDeviceLen},
+			{Field: "resume_token", MaxLen: maxSecretLen},
+			{Field: "client_class", MaxLen: maxSmallField},
+			{Field: "heartbeat_interval_ms", NonNegative: true},
+			{Field: "locale", MaxLen: maxSmallField},
+			{Field: "nonce", MaxLen: maxSecretLen},
+			{Field: "proof", MaxLen: maxSecretLen},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_TwoFactorSubmit)(nil), HandlerInfo{
+		Handler:        twoFactorHandler,
+		AllowGuest:     true,
+		OrderSensitive: true,
+		Validate: []FieldRule{
+			{Field: "challenge_id", Required: true, MaxLen: maxIDLen},
+			{Field: "code", Required: true, MaxLen: maxSmallField},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_CheckAvailability)(nil), HandlerInfo{
+		Handler:        handleCheckAvailability,
+		AllowGuest:     true,
+		RateLimitClass: rateClassAvailability,
+		Validate: []FieldRule{
+			{Field: "username", MaxLen: maxNameLen},
+			{Field: "email", MaxLen: 254},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_Signup)(nil), HandlerInfo{
+		Handler:        signupHandler,
+		AllowGuest:     true,
+		OrderSensitive: true,
+		// 账号密码为空由认证服务返回具体的结果码，这里只限制长度
+		Validate: []FieldRule{
+			{Field: "account", MaxLen: maxNameLen},
+			{Field: "password", MaxLen: maxSecretLen},
+			{Field: "user_name", MaxLen: maxNameLen},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_Logout)(nil), HandlerInfo{
+		Handler:        logoutHandler,
+		AllowGuest:     true,
+		OrderSensitive: true,
+		Lightweight:    true,
+	})
+	RegisterHandler((*pb.RequestMessage_TimeSync)(nil), HandlerInfo{
+		Handler:     withClient(handleTimeSync),
+		AllowGuest:  true,
+		Lightweight: true,
+		Validate:    []FieldRule{{Field: "client_ts", NonNegative: true}},
+	})
+	RegisterHandler((*pb.RequestMessage_LogoutAll)(nil), HandlerInfo{
+		Handler:        handleLogoutAllDevices,
+		RequiresLogin:  true,
+		OrderSensitive: true,
+	})
+	RegisterHandler((*pb.RequestMessage_Post)(nil), HandlerInfo{
+		Handler: withUser(func(ctx context.Context, client *Client, fromID int64, message *pb.RequestMessage) error {
+			return client.server.handlePostMessage(ctx, fromID, message)
+		}),
+		RequiresLogin:  true,
+		OrderSensitive: true,
+		Validate: []FieldRule{
+			{Field: "to_id", Required: true, NonNegative: true},
+			{Field: "msg_type", MaxLen: maxSmallField},
+			{Field: "timestamp", MaxLen: maxSmallField},
+			{Field: "real_file_name", MaxLen: 255},
+			{Field: "message_id", MaxLen: maxMessageIDLen},
+			{Field: "parent_message_id", MaxLen: maxMessageIDLen},
+			{Field: "thread_root_id", MaxLen: maxMessageIDLen},
+			{Field: "thread_root_author_id", NonNegative: true},
+			{Field: "msg"}, // 只校验UTF-8
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_Chunk)(nil), HandlerInfo{
+		Handler:        handleChunk,
+		RequiresLogin:  true,
+		OrderSensitive: true,
+		Validate: []FieldRule{
+			{Field: "transfer_id", Required: true, MaxLen: maxIDLen},
+			{Field: "index", NonNegative: true},
+			{Field: "total", Required: true, NonNegative: true},
+			{Field: "data", Required: true},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_Encrypted)(nil), HandlerInfo{
+		Handler:        withUser(handleEncryptedMessage),
+		RequiresLogin:  true,
+		OrderSensitive: true,
+		Opaque:         true,
+		Validate: []FieldRule{
+			{Field: "to_id", Required: true, NonNegative: true},
+			{Field: "from_device_id", MaxLen: maxDeviceLen},
+			{Field: "ciphertexts", Required: true},
+			{Field: "ciphertexts.device_id", Required: true, MaxLen: maxDeviceLen},
+			{Field: "ciphertexts.ciphertext", Required: true},
+			{Field: "timestamp", MaxLen: maxSmallField},
+			{Field: "message_id", MaxLen: maxMessageIDLen},
+			{Field: "parent_message_id", MaxLen: maxMessageIDLen},
+			{Field: "thread_root_id", MaxLen: maxMessageIDLen},
+			{Field: "thread_root_author_id", NonNegative: true},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_KeyBundleUpload)(nil), HandlerInfo{
+		Handler:       withUser(handleKeyBundleUpload),
+		RequiresLogin: true,
+		Validate: []FieldRule{
+			{Field: "bundle", Required: true},
+			{Field: "bundle.device_id", Required: true, MaxLen: maxDeviceLen},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_KeyBundleFetch)(nil), HandlerInfo{
+		Handler:       withClient(handleKeyBundleFetch),
+		RequiresLogin: true,
+		Validate:      []FieldRule{{Field: "user_id", Required: true, NonNegative: true}},
+	})
+	RegisterHandler((*pb.RequestMessage_Echo)(nil), HandlerInfo{
+		Handler:        withClient(handleEcho),
+		RequiresLogin:  true,
+		RateLimitClass: rateClassDiagnostic,
+	})
+	RegisterHandler((*pb.RequestMessage_LoopbackProbe)(nil), HandlerInfo{
+		Handler:        withUser(handleLoopbackProbe),
+		RequiresLogin:  true,
+		RateLimitClass: rateClassDiagnostic,
+	})
+	for _, payload := range []any{
+		(*pb.RequestMessage_React)(nil),
+		(*pb.RequestMessage_Unreact)(nil),
+	} {
+		RegisterHandler(payload, HandlerInfo{
+			Handler:        handleReact,
+			RequiresLogin:  true,
+			OrderSensitive: true,
+			FeatureFlag:    featureReactions,
+			Validate: []FieldRule{
+				{Field: "message_id", Required: true, MaxLen: maxMessageIDLen},
+				{Field: "to_id", Required: true, NonNegative: true},
+				{Field: "emoji", Required: true, MaxLen: maxEmojiBytes},
+			},
+		})
+	}
+	RegisterHandler((*pb.RequestMessage_FetchHistory)(nil), HandlerInfo{
+		Handler:       handleFetchHistory,
+		RequiresLogin: true,
+		Validate: []FieldRule{
+			{Field: "to_id", Required: true, NonNegative: true},
+			{Field: "before_seq", NonNegative: true},
+			{Field: "limit", NonNegative: true},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_GetReactions)(nil), HandlerInfo{
+		Handler:       handleGetReactions,
+		RequiresLogin: true,
+		FeatureFlag:   featureReactions,
+		Validate: []FieldRule{
+			{Field: "to_id", Required: true, NonNegative: true},
+			{Field: "message_ids", Required: true},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_SetSubscriptions)(nil), HandlerInfo{
+		Handler:       handleSetSubscriptions,
+		RequiresLogin: true,
+		Lightweight:   true,
+		Validate: []FieldRule{
+			{Field: "subscribe", MaxLen: len(allEventCategories)},
+			{Field: "unsubscribe", MaxLen: len(allEventCategories)},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_SetBlock)(nil), HandlerInfo{
+		Handler:       handleSetBlock,
+		RequiresLogin: true,
+		Validate:      []FieldRule{{Field: "user_id", Required: true, NonNegative: true}},
+	})
+	RegisterHandler((*pb.RequestMessage_SetMute)(nil), HandlerInfo{
+		Handler:       handleSetMute,
+		RequiresLogin: true,
+		Validate: []FieldRule{
+			{Field: "to_id", Required: true, NonNegative: true},
+			{Field: "until_ms", NonNegative: true},
+		},
+	})
+	RegisterHandler((*pb.RequestMessage_GetBlocks)(nil), HandlerInfo{
+		Handler:       handleGetBlocks,
+		RequiresLogin: true,
+	})
+	RegisterHandler((*pb.RequestMessage_GetMutes)(nil), HandlerInfo{
+		Handler:       handleGetMutes,
+		RequiresLogin: true,
+	})
+	RegisterHandler((*pb.RequestMessage_AckSeq)(nil), HandlerInfo{
+		Handler:       handleAckSeq,
+		RequiresLogin: true,
+		Lightweight:   true,
+		Validate:      []FieldRule{{Field: "seq", NonNegative: true}},
+	})
+	RegisterHandler((*pb.RequestMessage_TokenRefresh)(nil), HandlerInfo{
+		Handler:       handleTokenRefresh,
+		RequiresLogin: true,
+		Validate:      []FieldRule{{Field: "token", Required: true, MaxLen: maxSecretLen * 8}},
+	})
+	RegisterHandler((*pb.RequestMessage_ReportAbuse)(nil), HandlerInfo{
+		Handler:       handleReportAbuse,
+		RequiresLogin: true,
+		Validate: []FieldRule{
+			{Field: "target_user_id", Required: true, NonNegative: true},
+			{Field: "to_id", NonNegative: true},
+			{Field: "message_ids", MaxLen: maxAbuseMessages},
+			{Field: "category", Required: true, MaxLen: maxSmallField},
+			{Field: "text", MaxLen: maxAbuseText},
+			{Field: "plaintext_claims", MaxLen: maxAbuseMessages},
+			{Field: "plaintext_claims.message_id", Required: true, MaxLen: maxMessageIDLen},
+			{Field: "plaintext_claims.plaintext", MaxLen: maxAbuseText},
+		},
+	})
+	for _, payload := range []any{
+		(*pb.RequestMessage_QueryUser)(nil),
+		(*pb.RequestMessage_InsertContact)(nil),
+		(*pb.RequestMessage_QueryGroup)(nil),
+		(*pb.RequestMessage_InsertGroup)(nil),
+		(*pb.RequestMessage_InsertGroupUser)(nil),
+		(*pb.RequestMessage_FileRequest)(nil),
+		(*pb.RequestMessage_UpdateAvatar)(nil),
+	} {
+		RegisterHandler(payload, HandlerInfo{
+			Handler:       logOnly,
+			RequiresLogin: true,
+		})
+	}
+}
+
+// loginHandler 登录在同一连接上是幂等的：登录报文在读协程中按序处理，同一连接上的登录不会重叠；
+// 登录成功后收到相同的登录报文直接重发缓存的登录结果，不会重新解决冲突而把自己踢下线
+func loginHandler(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	fingerprint := loginFingerprint(message)
+	if client.loggedIn {
+		if client.loginRsp != nil && fingerprint == client.loginFingerprint {
+			metrics.Inc("login_duplicate_total")
+			return client.loginRsp, nil
+		}
+		client.log().Warnf("收到认证服务请求，不处理：%+v", redact(message))
+		return nil, nil
+	}
+	client.loginInProgress.Store(true)
+	defer client.loginInProgress.Store(false)
+	if handleLogin(ctx, client, message) {
+		client.loginFingerprint = fingerprint
+	}
+	return nil, nil
+}
+
+// loginFingerprint 登录报文的摘要，用于识别重复登录
+func loginFingerprint(message *pb.RequestMessage) [sha256.Size]byte {
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(message.GetLogin())
+	return sha256.Sum256(append(data, message.GetJwt()...))
+}
+
+func signupHandler(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	if client.loggedIn {
+		client.log().Warnf("收到认证服务请求，不处理：%+v", message.GetPayload())
+		return nil, nil
+	}
+	rsp, err := client.server.HandleSignupMessage(ctx, message)
+	logLoginResult(client.log(), rsp, err)
+	if err != nil {
+		client.log().Errorf("注册出现错误：: %v", err)
+	}
+	return rsp, nil
+}
+
+func logoutHandler(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	client.log().Infof("收到登出报文: %+v", message.GetLogout())
+	// 先注销登记再确认登出，客户端随即在其他设备登录时不会与旧登记竞争
+	detachClient(client)
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_LogoutAck{
+			LogoutAck: &pb.LogoutAck{},
+		},
+	}, ErrLogout
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"container/list"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// OfflineReplayer 可由 OfflineStore 实现，断线重连时补发序号大于 afterSeq 的离线消息。
+// 本容器的重放缓存不能覆盖缺失的消息时调用；未实现时不补发，客户端按序号缺口拉取历史
+type OfflineReplayer interface {
+	Replay(ctx context.Context, userID string, deviceID string, afterSeq int64) ([]*Envelope, error)
+}
+
+// OfflineReleaser 可由 OfflineReplayer 实现，Replay 返回的消息全部补发成功后调用，
+// 序号在 (afterSeq, throughSeq] 内的消息不再计入用户的保存用量
+type OfflineReleaser interface {
+	Release(ctx context.Context, userID string, deviceID string, afterSeq int64, throughSeq int64) error
+}
+
+// replayEntry 重放缓存中的一条消息
+type replayEntry struct {
+	userID   string
+	deviceID string // 只发给该设备的消息，为空时发给用户的所有设备
+	env      Envelope
+	at       time.Time
+	size     int
+	elem     *list.Element // 在 replayCache.order 中的位置
+}
+
+// replayCache 本容器最近投递或离线保存的带序号消息，按用户保存最近 ReplayCacheEntries 条、ReplayCacheAge 内的消息，
+// 总大小不超过 ReplayCacheBytes，超出时从最早写入的消息开始淘汰。
+// 重连风暴时，断线期间的消息多半由本容器刚刚投递过，直接从内存补发，不必逐个读取离线存储
+type replayCache struct {
+	mu    sync.Mutex
+	users map[string][]*replayEntry // {用户ID: 按序号升序排列的消息}
+	order *list.List                // *replayEntry，按写入顺序
+	bytes int
+}
+
+var replay = &replayCache{users: make(map[string][]*replayEntry), order: list.New()}
+
+// record 缓存一条带序号的消息，消息被复制，之后对原消息的修改不影响缓存
+func (c *replayCache) record(userID string, deviceID string, env *Envelope) {
+	cfg := config.Handler
+	if cfg.ReplayCacheBytes <= 0 || env.Seq == 0 {
+		return
+	}
+	entry := &replayEntry{userID: userID, deviceID: deviceID, env: *env, at: time.Now()}
+	entry.env.Message = proto.Clone(env.Message).(*pb.ResponseMessage)
+	entry.size = proto.Size(entry.env.Message) + len(userID) + len(deviceID) + len(env.Conversation)
+	if entry.size > cfg.ReplayCacheBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ring := c.users[userID]
+	// 跨容器转发的消息可能乱序到达，按序号插入
+	i := len(ring)
+	for i > 0 && ring[i-1].env.Seq > env.Seq {
+		i--
+	}
+	ring = append(ring, nil)
+	copy(ring[i+1:], ring[i:])
+	ring[i] = entry
+	c.users[userID] = ring
+	entry.elem = c.order.PushBack(entry)
+	c.bytes += entry.size
+
+	for len(c.users[userID]) > cfg.ReplayCacheEntries {
+		c.removeLocked(c.users[userID][0])
+	}
+	c.pruneLocked(time.Now())
+	for c.bytes > cfg.ReplayCacheBytes && c.order.Len() > 0 {
+		metrics.Inc("replay_cache_evictions_total", "reason", "bytes")
+		c.removeLocked(c.order.Front().Value.(*replayEntry))
+	}
+	c.reportLocked()
+}
+
+// removeLocked 从用户的消息列表与写入顺序中删除一条消息
+func (c *replayCache) removeLocked(entry *replayEntry) {
+	ring := c.users[entry.userID]
+	for i, e := range ring {
+		if e == entry {
+			ring = append(ring[:i], ring[i+1:]...)
+			break
+		}
+	}
+	if len(ring) == 0 {
+		delete(c.users, entry.userID)
+	} else {
+		c.users[entry.userID] = ring
+	}
+	c.order.Remove(entry.elem)
+	c.bytes -= entry.size
+}
+
+// pruneLocked 淘汰超过 ReplayCacheAge 的消息，写入顺序即时间顺序，从头部开始检查即可
+func (c *replayCache) pruneLocked(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*replayEntry)
+		if now.Sub(entry.at) <= config.Handler.ReplayCacheAge {
+			return
+		}
+		c.removeLocked(entry)
+	}
+}
+
+func (c *replayCache) reportLocked() {
+	metrics.SetGauge("replay_cache_bytes", float64(c.bytes))
+	metrics.SetGauge("replay_cache_users", float64(len(c.users)))
+}
+
+// invalidate 丢弃用户的全部缓存，用户的连接转移到其他容器后本容器不再能看到其完整的消息序列
+func (c *replayCache) invalidate(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.users[userID] {
+		c.order.Remove(entry.elem)
+		c.bytes -= entry.size
+	}
+	delete(c.users, userID)
+	c.reportLocked()
+}
+
+// since 取发给该设备、序号在 (afterSeq, current] 内的消息。只有缓存包含该区间内的每一个序号时才命中，
+// 否则可能漏发只经过其他容器的消息，返回false由调用方回退到离线存储。
+// 区间比缓存中该用户的消息还多时一定不命中，直接返回，不按客户端给出的序号分配内存
+func (c *replayCache) since(userID string, deviceID string, afterSeq int64, current int64) ([]Envelope, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(time.Now())
+	if current-afterSeq > int64(len(c.users[userID])) {
+		return nil, false
+	}
+	seen := make(map[int64]bool)
+	var envs []Envelope
+	for _, entry := range c.users[userID] {
+		seq := entry.env.Seq
+		if seq <= afterSeq || seq > current {
+			continue
+		}
+		seen[seq] = true
+		if entry.deviceID == "" || entry.deviceID == deviceID {
+			env := entry.env
+			env.Message = proto.Clone(entry.env.Message).(*pb.ResponseMessage)
+			envs = append(envs, env)
+		}
+	}
+	return envs, int64(len(seen)) == current-afterSeq
+}
+
+// replayMissed 断线重连后补发客户端尚未收到的消息：先查本容器的重放缓存，不能完整覆盖时回退到离线存储
+func replayMissed(ctx context.Context, client *Client, afterSeq int64) {
+	userID, deviceID := client.userID, client.deviceID
+	current, err := redisClient.CurrentSequence(ctx, userID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询用户 %s 的消息序号失败，不补发消息: %v", userID, err)
+		return
+	}
+	if current <= afterSeq {
+		metrics.Inc("replay_cache_lookups_total", "result", "up_to_date")
+		return
+	}
+	if envs, hit := replay.since(userID, deviceID, afterSeq, current); hit {
+		metrics.Inc("replay_cache_lookups_total", "result", "hit")
+		for i := range envs {
+			envs[i].Path, envs[i].ReceivedAt = DeliveryPathReplayCache, time.Now()
+			if err := client.server.SendToDevice(userID, deviceID, &envs[i]); err != nil {
+				ctxLogger(ctx).Warnf("从重放缓存补发消息失败: %v", err)
+				return
+			}
+		}
+		return
+	}
+	metrics.Inc("replay_cache_lookups_total", "result", "miss")
+	replayer, ok := client.server.offline.(OfflineReplayer)
+	if !ok {
+		return
+	}
+	envs, err := replayer.Replay(ctx, userID, deviceID, afterSeq)
+	if err != nil {
+		ctxLogger(ctx).Warnf("读取离线消息失败: %v", err)
+		return
+	}
+	var throughSeq int64
+	for _, env := range envs {
+		env.Path, env.ReceivedAt = DeliveryPathOfflineReplay, time.Now()
+		if err := client.server.SendToDevice(userID, deviceID, env); err != nil {
+			ctxLogger(ctx).Warnf("补发离线消息失败: %v", err)
+			return
+		}
+		throughSeq = max(throughSeq, env.Seq)
+	}
+	if releaser, ok := replayer.(OfflineReleaser); ok && throughSeq > 0 {
+		if err := releaser.Release(ctx, userID, deviceID, afterSeq, throughSeq); err != nil {
+			ctxLogger(ctx).Warnf("扣减用户 %s 已补发消息的保存用量失败: %v", userID, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"container/list"
+	"data_forwarding_service/config"
+	"testing"
+)
+
+// 缓存覆盖完整区间时命中；客户端的 last_seq 远落后于当前序号时直接不命中，不按区间长度分配内存
+func TestReplayCacheSince(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) {
+		cfg.ReplayCacheBytes = 1 << 20
+		cfg.ReplayCacheEntries = 16
+	})
+	c := &replayCache{users: make(map[string][]*replayEntry), order: list.New()}
+	for seq := int64(1); seq <= 3; seq++ {
+		c.record("7", "", &Envelope{Message: &pb.ResponseMessage{}, Seq: seq})
+	}
+	if envs, hit := c.since("7", "phone", 1, 3); !hit || len(envs) != 2 {
+		t.Fatalf("区间 (1, 3] 命中=%v 返回 %d 条，期望命中 2 条", hit, len(envs))
+	}
+	if _, hit := c.since("7", "phone", 0, 4); hit {
+		t.Fatal("缺少序号 4 时不应命中")
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, hit := c.since("7", "phone", 1, 1<<40); hit {
+			t.Fatal("区间远大于缓存时不应命中")
+		}
+	})
+	if allocs > 0 {
+		t.Fatalf("不命中的长区间分配了 %.0f 次", allocs)
+	}
+}
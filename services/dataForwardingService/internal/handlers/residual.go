@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+// persistResidual 连接关闭时发送队列中未发出的报文，带消息序号的转存到离线存储，
+// 客户端在其他容器恢复会话后可由离线回放补齐。没有序号的报文(响应、控制报文、分片)无法去重，直接丢弃。
+// 转存最多等待 ResidualPersistTimeout，redis等依赖变慢时不会无限阻塞连接清理，未能转存的计入指标
+func persistResidual(client *Client, residual [][]byte) {
+	userID, deviceID := client.identity()
+	if len(residual) == 0 || userID == "" || client.synthetic {
+		return
+	}
+	var envs []*Envelope
+	for _, data := range residual {
+		rsp := &pb.ResponseMessage{}
+		if err := proto.Unmarshal(data, rsp); err != nil || rsp.GetSeq() == 0 {
+			continue
+		}
+		envs = append(envs, &Envelope{
+			Message:  rsp,
+			Priority: priorityOf(rsp),
+			ServerTs: rsp.GetServerTs(),
+			Seq:      rsp.GetSeq(),
+			ConvSeq:  rsp.GetConvSeq(),
+		})
+	}
+	if len(envs) == 0 {
+		return
+	}
+	if client.server.offline == nil {
+		metrics.Add("residual_lost_total", float64(len(envs)), "reason", "no_store")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Handler.ResidualPersistTimeout)
+	defer cancel()
+	saved := 0
+	for _, env := range envs {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := client.server.offline.Store(ctx, userID, deviceID, env); err != nil {
+			client.log().Warnf("转存未发出的消息失败: %v", err)
+			continue
+		}
+		client.server.accountStorage(ctx, userID, env)
+		saved++
+	}
+	metrics.Add("residual_persisted_total", float64(saved))
+	if lost := len(envs) - saved; lost > 0 {
+		metrics.Add("residual_lost_total", float64(lost), "reason", "store_failed")
+		client.log().Warnf("连接关闭时有 %d 条未发出的消息未能转存", lost)
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"Betterfly2/shared/logger"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	redisClient "data_forwarding_service/internal/redis"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resumeClaims 恢复令牌内容，ContainerID 记录签发令牌时连接所在的容器
+type resumeClaims struct {
+	UserID      string `json:"u"`
+	DeviceID    string `json:"d"`
+	ContainerID string `json:"c"`
+	TokenID     string `json:"t"`
+	ExpiresAt   int64  `json:"e"`
+}
+
+var resumeSecret = loadResumeSecret()
+
+// loadResumeSecret 读取集群共享的令牌签名密钥，未配置时随机生成(令牌只能在本容器恢复)
+func loadResumeSecret() []byte {
+	if secret := os.Getenv("RESUME_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	logger.Sugar().Warnf("未配置 RESUME_TOKEN_SECRET，恢复令牌无法跨容器使用")
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}
+
+func signResumePayload(payload string) string {
+	mac := hmac.New(sha256.New, resumeSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueResumeToken 为设备签发新的恢复令牌，同时使该设备之前的令牌失效
+func IssueResumeToken(ctx context.Context, userID string, deviceID string, containerID string) (string, error) {
+	ttl := config.Handler.ResumeTokenTTL
+	token, tokenID, err := newResumeToken(userID, deviceID, containerID, ttl)
+	if err != nil {
+		return "", err
+	}
+	if err := redisClient.StoreResumeToken(ctx, userID, deviceID, tokenID, ttl); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newResumeToken 生成并签名恢复令牌，返回令牌及其ID。令牌ID登记到redis之后令牌才生效
+func newResumeToken(userID string, deviceID string, containerID string, ttl time.Duration) (string, string, error) {
+	idBytes := make([]byte, 12)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	claims := resumeClaims{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		ContainerID: containerID,
+		TokenID:     hex.EncodeToString(idBytes),
+		ExpiresAt:   time.Now().Add(ttl).Unix(),
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + signResumePayload(payload), claims.TokenID, nil
+}
+
+// ParseResumeToken 校验签名、有效期以及令牌是否仍是该设备最新签发的令牌
+func ParseResumeToken(ctx context.Context, token string) (*resumeClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("恢复令牌格式错误")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signResumePayload(payload))) {
+		return nil, errors.New("恢复令牌签名错误")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	claims := &resumeClaims{}
+	if err := json.Unmarshal(raw, claims); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, errors.New("恢复令牌已过期")
+	}
+	current, err := redisClient.GetResumeToken(ctx, claims.UserID, claims.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	if current != claims.TokenID {
+		return nil, errors.New("恢复令牌已失效")
+	}
+	return claims, nil
+}
+
+// HandleResumeMessage 使用恢复令牌登录，令牌无效时返回的claims为nil
+func HandleResumeMessage(ctx context.Context, message *pb.RequestMessage) (*pb.ResponseMessage, *resumeClaims) {
+	claims, err := ParseResumeToken(ctx, message.GetLogin().GetResumeToken())
+	if err != nil {
+		ctxLogger(ctx).Warnf("恢复令牌校验失败: %v", err)
+		return &pb.ResponseMessage{
+			Payload: &pb.ResponseMessage_Login{
+				Login: &pb.LoginRsp{
+					Result: pb.LoginResult_RESUME_TOKEN_INVALID,
+				},
+			},
+		}, nil
+	}
+	userID, _ := strconv.ParseInt(claims.UserID, 10, 64)
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Login{
+			Login: &pb.LoginRsp{
+				Result: pb.LoginResult_LOGIN_OK,
+				UserId: userID,
+			},
+		},
+	}, claims
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"sync"
+	"time"
+)
+
+// sendBuffer 按优先级划分的发送队列。逻辑容量在登录时按客户端类别调整：批量报文最多占用 BulkBufferPercent 的容量，
+// 交互报文可以使用全部容量，因此批量同步不会挤占交互消息的空间；控制报文不占用该容量、入队从不等待，
+// 但积压超过 ControlBufferMax 时视为客户端不再读取，入队失败并由调用方断开连接。
+// 队列使用按需增长的切片，排空后释放底层数组，空闲连接不占用发送队列的内存。
+// 连接进入空闲模式后写协程退出，下一次入队时在同一把锁内重新启动，不会与并发的发送者竞争
+type sendBuffer struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	size      int
+	queues    [priorityCount][]queuedFrame
+	total     int
+	used      int // 占用逻辑容量的报文数，即不含控制报文的 total
+	highWater [priorityCount]int
+	totalHigh int
+	credit    int // 连续发送的非批量报文数
+	closed    bool
+
+	parkRequested bool   // 空闲检测要求写协程在队列为空时退出
+	parked        bool   // 写协程已退出，等待下一次入队
+	wake          func() // 重新启动写协程
+}
+
+// queuedFrame 发送队列中的一帧报文
+type queuedFrame struct {
+	data    []byte
+	expires time.Time // 过期时刻，为零值时不过期
+	timing  frameTiming
+}
+
+// expired 报文在发送前是否已过期
+func (f queuedFrame) expired(now time.Time) bool {
+	return !f.expires.IsZero() && now.After(f.expires)
+}
+
+func newSendBuffer(size int, wake func()) *sendBuffer {
+	b := &sendBuffer{size: size, wake: wake}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// sendBufferSize 按客户端声明的类别确定发送队列容量，未配置的类别使用默认容量
+func sendBufferSize(clientClass string) int {
+	if size, ok := config.Handler.SendBufferClasses[clientClass]; ok {
+		return size
+	}
+	return config.Handler.SendBufferSize
+}
+
+// hasRoom 该优先级是否还有空间，需持有 b.mu
+func (b *sendBuffer) hasRoom(p Priority) bool {
+	switch p {
+	case PriorityControl:
+		return true
+	case PriorityBulk:
+		return b.used < b.size && len(b.queues[PriorityBulk]) < b.size*config.Handler.BulkBufferPercent/100
+	default:
+		return b.used < b.size
+	}
+}
+
+// pushResult 入队结果
+type pushResult int
+
+const (
+	pushQueued   pushResult = iota
+	pushClosed              // 连接已关闭
+	pushFull                // 等待时限内一直没有空间
+	pushOverflow            // 控制报文积压超过上限
+)
+
+// push 报文入队，没有空间时最多等待 wait(为0时一直等待)。写协程已因空闲退出时重新启动。
+// ttl 大于0时报文在入队 ttl 后过期，写协程发送前丢弃
+func (b *sendBuffer) push(p Priority, data []byte, ttl time.Duration, timing frameTiming, wait time.Duration) pushResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p == PriorityControl && !b.closed && len(b.queues[PriorityControl]) >= max(config.Handler.ControlBufferMax, 1) {
+		return pushOverflow
+	}
+	if !b.closed && !b.hasRoom(p) && wait > 0 {
+		// sync.Cond 不支持超时，到期时唤醒一次等待者重新检查
+		deadline := time.Now().Add(wait)
+		timer := time.AfterFunc(wait, func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+		defer timer.Stop()
+		for !b.closed && !b.hasRoom(p) {
+			if !time.Now().Before(deadline) {
+				return pushFull
+			}
+			b.cond.Wait()
+		}
+	}
+	for !b.closed && !b.hasRoom(p) {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return pushClosed
+	}
+	frame := queuedFrame{data: data, timing: timing}
+	if ttl > 0 {
+		frame.expires = time.Now().Add(ttl)
+	}
+	b.queues[p] = append(b.queues[p], frame)
+	b.total++
+	if p != PriorityControl {
+		b.used++
+	}
+	b.highWater[p] = max(b.highWater[p], len(b.queues[p]))
+	b.totalHigh = max(b.totalHigh, b.total)
+	b.parkRequested = false
+	b.unparkLocked()
+	b.cond.Broadcast()
+	return pushQueued
+}
+
+// pop 写协程取出下一个要发送的报文，队列为空时等待。
+// 连续发送 BulkCredit 个高优先级报文后，若批量队列非空则必定发送一个批量报文，避免其被饿死。
+// 队列关闭且为空时返回 closed；要求空闲退出且队列为空时返回 parked，写协程随即退出
+func (b *sendBuffer) pop() (frame queuedFrame, closed bool, parked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if b.total > 0 {
+			p := b.nextPriority()
+			frame = b.queues[p][0]
+			b.queues[p][0] = queuedFrame{}
+			b.queues[p] = b.queues[p][1:]
+			if len(b.queues[p]) == 0 {
+				b.queues[p] = nil
+			}
+			b.total--
+			if p != PriorityControl {
+				b.used--
+			}
+			if p == PriorityBulk {
+				b.credit = 0
+			} else {
+				b.credit++
+			}
+			b.cond.Broadcast()
+			return frame, false, false
+		}
+		if b.closed {
+			return queuedFrame{}, true, false
+		}
+		if b.parkRequested {
+			b.parkRequested = false
+			b.parked = true
+			metrics.AddGauge("connections_idle", 1)
+			return queuedFrame{}, false, true
+		}
+		b.cond.Wait()
+	}
+}
+
+// nextPriority 下一个要发送的优先级，需持有 b.mu 且队列非空
+func (b *sendBuffer) nextPriority() Priority {
+	if b.credit >= config.Handler.BulkCredit && len(b.queues[PriorityBulk]) > 0 {
+		return PriorityBulk
+	}
+	for p := range b.queues {
+		if len(b.queues[p]) > 0 {
+			return Priority(p)
+		}
+	}
+	return PriorityBulk
+}
+
+// park 要求写协程在队列为空时退出，由空闲检测调用
+func (b *sendBuffer) park() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.parked || b.closed {
+		return
+	}
+	b.parkRequested = true
+	b.cond.Broadcast()
+}
+
+// unparkLocked 写协程已退出时重新启动，需持有 b.mu
+func (b *sendBuffer) unparkLocked() {
+	if !b.parked {
+		return
+	}
+	b.parked = false
+	metrics.AddGauge("connections_idle", -1)
+	go b.wake()
+}
+
+// remaining 剩余的逻辑容量与总容量
+func (b *sendBuffer) remaining() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.size-b.used, 0), b.size
+}
+
+// resize 调整逻辑容量，已入队的报文不受影响
+func (b *sendBuffer) resize(size int) {
+	b.mu.Lock()
+	b.size = size
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// close 不再接受新报文并唤醒所有等待者，写协程发送完剩余报文后退出；写协程已因空闲退出时重新启动它以完成收尾
+func (b *sendBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.unparkLocked()
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// drain 取出所有待发送的报文(按优先级顺序)并清空队列，连接关闭后写协程用它收集未发出的报文
+func (b *sendBuffer) drain() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	residual := make([][]byte, 0, b.total)
+	for p := range b.queues {
+		for _, frame := range b.queues[p] {
+			residual = append(residual, frame.data)
+		}
+		b.queues[p] = nil
+	}
+	b.total = 0
+	b.used = 0
+	b.cond.Broadcast()
+	return residual
+}
+
+// depths 各优先级队列中待发送的报文数
+func (b *sendBuffer) depths() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	depths := make(map[string]int, priorityCount)
+	for p, queue := range b.queues {
+		depths[Priority(p).String()] = len(queue)
+	}
+	return depths
+}
+
+// stats 当前逻辑容量与各优先级的历史最高占用
+func (b *sendBuffer) stats() (int, map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	highWater := make(map[string]int, priorityCount+1)
+	for p, n := range b.highWater {
+		highWater[Priority(p).String()] = n
+	}
+	highWater["total"] = b.totalHigh
+	return b.size, highWater
+}
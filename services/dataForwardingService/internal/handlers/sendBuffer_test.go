@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPriorityDefaultsToInteractive(t *testing.T) {
+	cases := []struct {
+		rsp  *pb.ResponseMessage
+		want Priority
+	}{
+		{&pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{}}}, PriorityInteractive},
+		{&pb.ResponseMessage{Payload: &pb.ResponseMessage_Post{}}, PriorityInteractive},
+		{&pb.ResponseMessage{}, PriorityInteractive},
+		{&pb.ResponseMessage{Payload: &pb.ResponseMessage_Login{}}, PriorityControl},
+		{&pb.ResponseMessage{Payload: &pb.ResponseMessage_Warn{}}, PriorityControl},
+		{&pb.ResponseMessage{Payload: &pb.ResponseMessage_Chunk{}}, PriorityBulk},
+	}
+	for _, c := range cases {
+		if got := priorityOf(c.rsp); got != c.want {
+			t.Errorf("%T 的优先级为 %v，期望 %v", c.rsp.GetPayload(), got, c.want)
+		}
+	}
+}
+
+func TestSendBufferCapsControlLane(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ControlBufferMax = 3 })
+	b := newSendBuffer(8, func() {})
+	for i := 0; i < 3; i++ {
+		if got := b.push(PriorityControl, []byte{1}, 0, frameTiming{}, 0); got != pushQueued {
+			t.Fatalf("第 %d 条控制报文未入队: %v", i, got)
+		}
+	}
+	if got := b.push(PriorityControl, []byte{1}, 0, frameTiming{}, 0); got != pushOverflow {
+		t.Fatalf("控制报文超过上限仍然入队: %v", got)
+	}
+	// 控制队列的上限不影响交互报文
+	if got := b.push(PriorityInteractive, []byte{1}, 0, frameTiming{}, 0); got != pushQueued {
+		t.Fatalf("交互报文被控制队列上限拒绝: %v", got)
+	}
+}
+
+// 控制报文不占用逻辑容量：控制队列积压超过逻辑容量时交互报文仍能入队，剩余容量不计控制报文
+func TestControlLaneDoesNotConsumeCapacity(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ControlBufferMax = 4 })
+	b := newSendBuffer(2, func() {})
+	for i := 0; i < 4; i++ {
+		if got := b.push(PriorityControl, []byte{1}, 0, frameTiming{}, 0); got != pushQueued {
+			t.Fatalf("第 %d 条控制报文未入队: %v", i, got)
+		}
+	}
+	if left, size := b.remaining(); left != size {
+		t.Fatalf("只有控制报文时剩余容量为 %d/%d", left, size)
+	}
+	if got := b.push(PriorityInteractive, []byte{1}, 0, frameTiming{}, 10*time.Millisecond); got != pushQueued {
+		t.Fatalf("控制队列积压时交互报文未入队: %v", got)
+	}
+	if left, _ := b.remaining(); left != 1 {
+		t.Fatalf("入队一条交互报文后剩余容量为 %d，期望 1", left)
+	}
+}
+
+func TestControlBacklogClosesSlowConsumer(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.ControlBufferMax = 4 })
+	// 写协程每发一条报文前停顿，模拟不再读取的客户端
+	faultRules.Store(&[]faultRule{{Kind: faultDelay, Probability: 1, DelayMs: 200}})
+	t.Cleanup(func() { faultRules.Store(nil) })
+
+	s := NewServer()
+	sub := s.Subscribe("test", 8)
+	dialServer(t, s)
+	waitFor(t, "登记连接", func() bool { return s.clients.Len() == 1 })
+	client := s.clients.All()[0]
+
+	warn := &pb.ResponseMessage{Payload: &pb.ResponseMessage_Warn{Warn: &pb.Warn{WarningMessage: "w"}}}
+	var err error
+	for i := 0; i < 16 && err == nil; i++ {
+		err = client.Enqueue(warn)
+	}
+	if !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("控制报文积压超过上限后期望 ErrSendQueueFull，实际为 %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-sub.C:
+			if d, ok := event.(ClientDisconnected); ok {
+				if d.Reason != CloseSlowConsumer {
+					t.Fatalf("断开原因为 %v，期望 %v", d.Reason, CloseSlowConsumer)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("控制报文积压后连接没有断开")
+		}
+	}
+}
+
+// startWriter 模拟连接的写协程：循环取出报文，空闲退出后由下一次入队重新启动
+func startWriter(size int, delivered *atomic.Int64, exited *sync.WaitGroup) *sendBuffer {
+	var b *sendBuffer
+	var run func()
+	run = func() {
+		defer exited.Done()
+		for {
+			_, closed, parked := b.pop()
+			if closed || parked {
+				return
+			}
+			delivered.Add(1)
+		}
+	}
+	b = newSendBuffer(size, func() {
+		exited.Add(1)
+		run()
+	})
+	exited.Add(1)
+	go run()
+	return b
+}
+
+// 空闲退出与并发入队交替发生，每条报文都被写协程取出，不会因唤醒丢失而滞留在队列中
+func TestParkedWriterWakesOnConcurrentPush(t *testing.T) {
+	const pushers, perPusher = 8, 500
+	var delivered atomic.Int64
+	var exited sync.WaitGroup
+	b := startWriter(64, &delivered, &exited)
+
+	stop := make(chan struct{})
+	parkerDone := make(chan struct{})
+	go func() {
+		defer close(parkerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				b.park()
+				runtime.Gosched()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perPusher; j++ {
+				if got := b.push(PriorityInteractive, []byte{1}, 0, frameTiming{}, 0); got != pushQueued {
+					t.Errorf("入队失败: %v", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-parkerDone
+	waitFor(t, "所有报文被取出", func() bool { return delivered.Load() == pushers*perPusher })
+
+	b.close()
+	exited.Wait()
+}
+
+// idleFootprint 创建 n 个空闲连接的发送端，返回平均每个连接占用的堆字节数与常驻协程数(每个协程至少占用 8KB 栈)
+func idleFootprint(n int, create func() (release func())) (heapPerConn float64, goroutinesPerConn float64) {
+	releases := make([]func(), 0, n)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < n; i++ {
+		releases = append(releases, create())
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	goroutines = runtime.NumGoroutine() - goroutines
+	for _, release := range releases {
+		release()
+	}
+	heap := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	return float64(heap) / float64(n), float64(goroutines) / float64(n)
+}
+
+// 空闲连接的发送端内存：原先每个连接一个256格的channel和一个常驻写协程，现在队列按需分配、写协程空闲时退出
+func BenchmarkIdleConnectionMemory(b *testing.B) {
+	const conns = 10000
+	b.Run("channel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			heap, goroutines := idleFootprint(conns, func() func() {
+				ch := make(chan queuedFrame, 256)
+				done := make(chan struct{})
+				go func() {
+					for range ch {
+					}
+					close(done)
+				}()
+				return func() {
+					close(ch)
+					<-done
+				}
+			})
+			b.ReportMetric(heap, "heap-bytes/conn")
+			b.ReportMetric(goroutines, "goroutines/conn")
+		}
+	})
+	b.Run("parked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			heap, goroutines := idleFootprint(conns, func() func() {
+				var delivered atomic.Int64
+				var exited sync.WaitGroup
+				buf := startWriter(256, &delivered, &exited)
+				buf.park()
+				exited.Wait()
+				return func() {
+					buf.close()
+					exited.Wait()
+				}
+			})
+			b.ReportMetric(heap, "heap-bytes/conn")
+			b.ReportMetric(goroutines, "goroutines/conn")
+		}
+	})
+}
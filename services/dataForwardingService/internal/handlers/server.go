@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/lifecycle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// Server 数据转发服务实例，持有连接表、可替换的后端、中间件、出站拦截器、登录钩子、事件订阅、
+// 排空状态与登录切换，新功能应挂在 Server 上而不是新增包级变量。连接记录接受它的实例，
+// 连接、登录与投递的内部路径都经由该实例，同一进程中的多个实例互不可见。
+// 包级的 SetXxx、Use、OnLogin、SendMessage 等函数委托给 Default() 返回的默认实例，保留用于兼容。
+// 配置(config.Handler)、redis与消息队列仍是进程级的：按容器订阅的投递信封与控制消息只交给默认实例，
+// 同一进程中的其他实例只能投递给自己的连接或离线保存，适用于测试与单机嵌入
+type Server struct {
+	clients     *ClientManager
+	drain       drainState
+	transitions transitionTable
+
+	accounts     AccountService
+	directory    AccountDirectory
+	offline      OfflineStore
+	push         PushNotifier
+	tiers        TierProvider
+	geo          GeoResolver
+	groups       GroupDirectory
+	messages     MessageStore
+	flags        FeatureFlagProvider
+	twoFactor    TwoFactorVerifier
+	loginProof   LoginProofVerifier
+	experimental PipelineImpl
+
+	middlewares  []Middleware // 按注册顺序排列，先注册的位于外层、先执行
+	chain        MessageHandler
+	interceptors []OutboundInterceptor // 按注册顺序执行
+	loginHooks   []LoginHook
+	events       eventBus
+
+	publicAddr net.Addr // 公共端口实际监听的地址，WebSocket 服务启动后填充，供金丝雀连接
+}
+
+// NewServer 创建使用默认后端与内置中间件的实例
+func NewServer() *Server {
+	return &Server{
+		clients:      NewClientManager(),
+		accounts:     authRPCAccounts{},
+		directory:    authDirectory{},
+		messages:     redisMessageStore{},
+		flags:        redisFeatureFlags{},
+		twoFactor:    totpVerifier{},
+		tiers:        staticTier{},
+		geo:          defaultGeoResolver(),
+		middlewares:  defaultMiddlewares(),
+		chain:        RequestMessageHandler,
+		interceptors: defaultInterceptors(),
+		loginHooks:   []LoginHook{notifyStorageEvicted, notifyNewDevice},
+	}
+}
+
+// defaultServer 进程的默认实例
+var defaultServer = NewServer()
+
+// Default 返回进程的默认实例
+func Default() *Server {
+	return defaultServer
+}
+
+// Clients 实例的连接表
+func (s *Server) Clients() *ClientManager {
+	return s.clients
+}
+
+// InternalServer 内部管理服务器组件。
+//
+// Deprecated: 使用 Default().InternalServer
+func InternalServer() lifecycle.Component {
+	return defaultServer.InternalServer()
+}
+
+// WebSocketServer 公共WebSocket服务器组件。
+//
+// Deprecated: 使用 Default().WebSocketServer
+func WebSocketServer() lifecycle.Component {
+	return defaultServer.WebSocketServer()
+}
+
+// Canary 金丝雀自检组件。
+//
+// Deprecated: 使用 Default().Canary
+func Canary() lifecycle.Component {
+	return defaultServer.Canary()
+}
+
+// InternalServer 内部管理服务器组件：管理、指标与调试接口，只监听在内部地址上
+func (s *Server) InternalServer() lifecycle.Component {
+	var server *http.Server
+	return lifecycle.Component{
+		Name: "internal_server",
+		Start: func(ctx context.Context, fail func(error)) error {
+			addr := os.Getenv("INTERNAL_ADDR")
+			if addr == "" {
+				addr = "127.0.0.1:54343"
+			}
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("内部管理地址 %s 监听失败: %w", addr, err)
+			}
+			server = &http.Server{Handler: s.newInternalMux()}
+			logger.Sugar().Infof("内部管理接口监听 %s", listener.Addr())
+			go serve(fail, func() error { return server.Serve(listener) })
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return server.Shutdown(ctx)
+		},
+	}
+}
+
+// WebSocketServer 公共WebSocket服务器组件，提供 /ws 与 /connect-info。中间件、出站拦截器与事件订阅需在其启动之前注册
+func (s *Server) WebSocketServer() lifecycle.Component {
+	var server *http.Server
+	return lifecycle.Component{
+		Name:      "websocket_server",
+		DependsOn: []string{"internal_server"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			s.chain = buildChain(RequestMessageHandler, s.middlewares)
+			enableFaultInjection()
+			if config.Handler.AuditConnections {
+				go auditConnections(s.Subscribe("connection_audit", 1024))
+			}
+			if config.Handler.ConnectionHistory {
+				go recordConnections(s.Subscribe("connection_history", 1024))
+			}
+
+			port := os.Getenv("PORT")
+			if port == "" {
+				port = "54342"
+			}
+			certFile, keyFile := config.CertFiles()
+
+			listener, err := net.Listen("tcp", ":"+port)
+			if err != nil {
+				return fmt.Errorf("公共端口 %s 监听失败: %w", port, err)
+			}
+			s.publicAddr = listener.Addr()
+			mux := http.NewServeMux()
+			mux.HandleFunc("/ws", s.handleConnection)
+			mux.HandleFunc("GET /connect-info", handleConnectInfo)
+			server = &http.Server{Handler: mux}
+			logger.Sugar().Infof("WebSocket 服务监听 %s", listener.Addr())
+			logSocketSettings(logger.Sugar())
+			go serve(fail, func() error { return server.ServeTLS(listener, certFile, keyFile) })
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			// 只停止接受新连接，已升级的WebSocket连接不受 Shutdown 影响
+			return server.Shutdown(ctx)
+		},
+	}
+}
+
+// Canary 金丝雀自检组件，CanaryInterval 为0时不启动
+func (s *Server) Canary() lifecycle.Component {
+	var cancel context.CancelFunc
+	return lifecycle.Component{
+		Name:      "canary",
+		DependsOn: []string{"websocket_server"},
+		Start: func(ctx context.Context, fail func(error)) error {
+			ctx, cancel = context.WithCancel(ctx)
+			if config.Handler.CanaryInterval > 0 {
+				go s.runCanary(ctx, s.publicAddr)
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
+
+// serve 运行HTTP服务器，非主动关闭导致的退出视为致命错误
+func serve(fail func(error), run func() error) {
+	if err := run(); !errors.Is(err, http.ErrServerClosed) {
+		fail(err)
+	}
+}
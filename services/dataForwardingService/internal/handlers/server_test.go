@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	redisClient "data_forwarding_service/internal/redis"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRedis 将全局redis客户端换成内存实现，测试结束后恢复
+func withRedis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := redisClient.Rdb
+	redisClient.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		redisClient.Rdb.Close()
+		redisClient.Rdb = saved
+	})
+	return mr
+}
+
+// dialServer 通过实例的 /ws 建立一条真实的WebSocket连接。测试结束时断开，并等待服务端的写协程退出，
+// 避免连接清理在 withRedis/withConfig 恢复全局状态之后才发生
+func dialServer(t *testing.T, s *Server) *websocket.Conn {
+	t.Helper()
+	accepted := make(chan *Client, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleConnection(w, r)
+		for _, c := range s.clients.All() {
+			if c.conn.RemoteAddr().String() == r.RemoteAddr {
+				accepted <- c
+				return
+			}
+		}
+		close(accepted)
+	}))
+	t.Cleanup(ts.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("建立连接失败: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		if c := <-accepted; c != nil {
+			<-c.writerDone
+		}
+	})
+	return conn
+}
+
+// sendRequest 以默认的protobuf编码发送一条请求
+func sendRequest(t *testing.T, conn *websocket.Conn, req *pb.RequestMessage) {
+	t.Helper()
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("发送请求失败: %v", err)
+	}
+}
+
+// readUntil 读取响应直到 match 返回true，跳过其他响应
+func readUntil(t *testing.T, conn *websocket.Conn, match func(*pb.ResponseMessage) bool) *pb.ResponseMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("读取响应失败: %v", err)
+		}
+		rsp := &pb.ResponseMessage{}
+		if err := proto.Unmarshal(data, rsp); err != nil {
+			t.Fatalf("响应无法解析: %v", err)
+		}
+		if match(rsp) {
+			return rsp
+		}
+	}
+}
+
+// waitFor 轮询直到条件成立，超时则失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServersKeepSeparateConnections(t *testing.T) {
+	withRedis(t)
+	a, b := NewServer(), NewServer()
+	dialServer(t, a)
+	connB := dialServer(t, b)
+	waitFor(t, "两个实例各登记一条连接", func() bool { return a.clients.Len() == 1 && b.clients.Len() == 1 })
+
+	clientB := b.clients.All()[0]
+	if clientB.server != b {
+		t.Fatal("连接没有记录接受它的实例")
+	}
+	if _, err := b.clients.Rename(clientB.key, redisClient.DeviceKey("7", "phone"), clientB); err != nil {
+		t.Fatalf("登记设备键失败: %v", err)
+	}
+
+	// 用户只连接在 b 上，a 看不到该连接，也没有离线存储
+	ctx := context.Background()
+	message := func() *pb.ResponseMessage {
+		return &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte("hi")}}}
+	}
+	if result, _ := a.DeliverToUser(ctx, "7", message(), DeliveryOptions{}); result != DeliveryDropped {
+		t.Fatalf("实例 a 投递给其他实例的连接: %v", result)
+	}
+	if result, err := b.DeliverToUser(ctx, "7", message(), DeliveryOptions{}); result != DeliveredLocal {
+		t.Fatalf("实例 b 未能投递给自己的连接: %v %v", result, err)
+	}
+	_ = connB.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := connB.ReadMessage()
+	if err != nil {
+		t.Fatalf("读取投递失败: %v", err)
+	}
+	rsp := &pb.ResponseMessage{}
+	if err := proto.Unmarshal(data, rsp); err != nil || string(rsp.GetEcho().GetBody()) != "hi" {
+		t.Fatalf("收到的不是投递的消息: %v %v", rsp, err)
+	}
+
+	// 排空 a 只关闭 a 的连接
+	a.StartDrain(ctx, 10*time.Millisecond, "")
+	waitFor(t, "实例 a 的连接被排空", func() bool { return a.clients.Len() == 0 })
+	if b.isDraining() || b.clients.Len() != 1 {
+		t.Fatalf("排空 a 影响了 b: draining=%v len=%d", b.isDraining(), b.clients.Len())
+	}
+	if Default().clients.Len() != 0 {
+		t.Fatal("连接被登记到默认实例")
+	}
+}
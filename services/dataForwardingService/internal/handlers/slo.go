@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DeliveryPath 消息到达接收连接所经过的路径，用于投递延迟指标分类
+type DeliveryPath string
+
+const (
+	DeliveryPathLocal         DeliveryPath = "local"          // 发送者与接收者在同一容器
+	DeliveryPathForwarded     DeliveryPath = "forwarded"      // 经消息队列从其他容器转发而来
+	DeliveryPathOfflineReplay DeliveryPath = "offline_replay" // 接收者上线后由离线存储重放，需由 OfflineStore 实现设置
+	DeliveryPathReplayCache   DeliveryPath = "replay_cache"   // 断线重连后由本容器的重放缓存补发
+)
+
+// sloMaxSamples 每条路径保留的最多样本数，超出时覆盖最早的样本
+const sloMaxSamples = 8192
+
+// frameTiming 报文的投递延迟统计信息，随报文进入发送队列，写入连接后记录
+type frameTiming struct {
+	accepted int64     // 服务端收到原始请求的时刻(毫秒)，为0时不记录
+	hopStart time.Time // 报文到达本容器的时刻
+	path     DeliveryPath
+	class    string // 负载类型
+}
+
+// newFrameTiming 根据信封生成统计信息，accepted 为出站拦截器执行前的 ServerTs
+func newFrameTiming(accepted int64, env *Envelope) frameTiming {
+	if accepted == 0 {
+		return frameTiming{}
+	}
+	t := frameTiming{accepted: accepted, hopStart: env.ReceivedAt, path: env.Path, class: payloadType(env.Message)}
+	if t.path == "" {
+		t.path = DeliveryPathLocal
+	}
+	if t.hopStart.IsZero() {
+		t.hopStart = time.UnixMilli(accepted)
+	}
+	return t
+}
+
+// observe 报文写入连接成功后记录端到端延迟与本跳耗时。
+// 端到端延迟跨容器计算，受时钟偏差影响；本跳耗时只使用本容器时钟，两者对照可判断延迟是否来自时钟偏差
+func (t frameTiming) observe(now time.Time) {
+	if t.accepted == 0 {
+		return
+	}
+	latency := max(float64(now.UnixMilli()-t.accepted), 0)
+	hop := float64(now.Sub(t.hopStart).Milliseconds())
+	metrics.Observe("delivery_latency_ms", latency, "path", string(t.path), "class", t.class)
+	metrics.Observe("delivery_hop_ms", hop, "path", string(t.path), "class", t.class)
+	slo.record(t.path, now, latency, hop)
+}
+
+type sloSample struct {
+	at      time.Time
+	latency float64
+	hop     float64
+}
+
+// sloRing 单条路径的样本环形缓冲
+type sloRing struct {
+	samples []sloSample
+	next    int
+}
+
+// sloWindow 最近一段时间内的投递延迟样本，供 /admin/slo 计算分位数
+type sloWindow struct {
+	mu    sync.Mutex
+	paths map[DeliveryPath]*sloRing
+}
+
+var slo = &sloWindow{paths: make(map[DeliveryPath]*sloRing)}
+
+func (w *sloWindow) record(path DeliveryPath, at time.Time, latency float64, hop float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ring, ok := w.paths[path]
+	if !ok {
+		ring = &sloRing{}
+		w.paths[path] = ring
+	}
+	sample := sloSample{at: at, latency: latency, hop: hop}
+	if len(ring.samples) < sloMaxSamples {
+		ring.samples = append(ring.samples, sample)
+		return
+	}
+	ring.samples[ring.next] = sample
+	ring.next = (ring.next + 1) % sloMaxSamples
+}
+
+// sloSummary 一条路径在统计窗口内的延迟汇总，单位毫秒
+type sloSummary struct {
+	Count      int     `json:"count"`
+	P50        float64 `json:"p50_ms"`
+	P99        float64 `json:"p99_ms"`
+	Max        float64 `json:"max_ms"`
+	OverTarget float64 `json:"over_target_ratio"`
+	HopP50     float64 `json:"hop_p50_ms"`
+	HopP99     float64 `json:"hop_p99_ms"`
+}
+
+// summary 汇总 since 之后的样本，没有样本的路径不出现在结果中
+func (w *sloWindow) summary(since time.Time, target float64) map[DeliveryPath]sloSummary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	result := make(map[DeliveryPath]sloSummary, len(w.paths))
+	for path, ring := range w.paths {
+		var latencies, hops []float64
+		over := 0
+		for _, s := range ring.samples {
+			if s.at.Before(since) {
+				continue
+			}
+			latencies = append(latencies, s.latency)
+			hops = append(hops, s.hop)
+			if s.latency > target {
+				over++
+			}
+		}
+		if len(latencies) == 0 {
+			continue
+		}
+		slices.Sort(latencies)
+		slices.Sort(hops)
+		result[path] = sloSummary{
+			Count:      len(latencies),
+			P50:        percentile(latencies, 0.50),
+			P99:        percentile(latencies, 0.99),
+			Max:        latencies[len(latencies)-1],
+			OverTarget: float64(over) / float64(len(latencies)),
+			HopP50:     percentile(hops, 0.50),
+			HopP99:     percentile(hops, 0.99),
+		}
+	}
+	return result
+}
+
+// percentile 取已排序样本的分位数
+func percentile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// handleAdminSLO 汇总当前统计窗口内各投递路径的延迟，用于故障期间快速查看
+func handleAdminSLO(w http.ResponseWriter, r *http.Request) {
+	window, target := config.Handler.SLOWindow, config.Handler.SLOTarget
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window":    window.String(),
+		"target_ms": target.Milliseconds(),
+		"paths":     slo.summary(time.Now().Add(-window), float64(target.Milliseconds())),
+	})
+}
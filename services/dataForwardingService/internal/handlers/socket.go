@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"data_forwarding_service/config"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"net"
+)
+
+// tcpConn 取出WebSocket连接底层的TCP连接，经过TLS时先解开TLS层
+func tcpConn(conn *websocket.Conn) (*net.TCPConn, bool) {
+	c := conn.NetConn()
+	if t, ok := c.(*tls.Conn); ok {
+		c = t.NetConn()
+	}
+	tcp, ok := c.(*net.TCPConn)
+	return tcp, ok
+}
+
+// tuneSocket 按配置调整TCP参数：保活周期、TCP_NODELAY 与收发缓冲区大小，值为0的项保持系统默认。
+// 设置失败只记录警告，不影响连接
+func tuneSocket(conn *websocket.Conn, sugar *zap.SugaredLogger) {
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		sugar.Warnf("底层连接不是TCP连接(%T)，跳过socket调优", conn.NetConn())
+		return
+	}
+	cfg := config.Handler
+	if cfg.TCPKeepAlive > 0 {
+		if err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: cfg.TCPKeepAlive, Interval: cfg.TCPKeepAlive}); err != nil {
+			sugar.Warnf("设置TCP保活失败: %v", err)
+		}
+	}
+	if err := tcp.SetNoDelay(cfg.TCPNoDelay); err != nil {
+		sugar.Warnf("设置TCP_NODELAY失败: %v", err)
+	}
+	if cfg.SocketSendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(cfg.SocketSendBuffer); err != nil {
+			sugar.Warnf("设置SO_SNDBUF失败: %v", err)
+		}
+	}
+	if cfg.SocketRecvBuffer > 0 {
+		if err := tcp.SetReadBuffer(cfg.SocketRecvBuffer); err != nil {
+			sugar.Warnf("设置SO_RCVBUF失败: %v", err)
+		}
+	}
+}
+
+// logSocketSettings 启动时记录一次生效的socket参数
+func logSocketSettings(sugar *zap.SugaredLogger) {
+	cfg := config.Handler
+	sugar.Infof("socket参数: TCP保活 %v, TCP_NODELAY %v, SO_SNDBUF %d, SO_RCVBUF %d, WebSocket读缓冲 %d, 写缓冲 %d (0表示默认值)",
+		cfg.TCPKeepAlive, cfg.TCPNoDelay, cfg.SocketSendBuffer, cfg.SocketRecvBuffer, cfg.WSReadBufferSize, cfg.WSWriteBufferSize)
+}
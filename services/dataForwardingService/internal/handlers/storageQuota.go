@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	redisClient "data_forwarding_service/internal/redis"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"strconv"
+)
+
+// TierProvider 查询用户的账号等级，决定离线保存上限(StorageTierMaxEntries、StorageTierMaxBytes)
+type TierProvider interface {
+	Tier(ctx context.Context, userID string) (string, error)
+}
+
+// defaultTier 未设置 TierProvider 时所有用户的等级
+const defaultTier = "default"
+
+type staticTier struct{}
+
+func (staticTier) Tier(context.Context, string) (string, error) {
+	return defaultTier, nil
+}
+
+// SetTierProvider 设置账号等级来源，默认所有用户均为 default 等级，需在服务启动之前调用
+func (s *Server) SetTierProvider(p TierProvider) {
+	s.tiers = p
+}
+
+// SetTierProvider 设置默认实例的账号等级来源。
+//
+// Deprecated: 使用 Default().SetTierProvider
+func SetTierProvider(p TierProvider) {
+	defaultServer.SetTierProvider(p)
+}
+
+// OfflineEvictor 支持超额淘汰的离线存储实现此接口：从最早的条目开始删除，直到至少删除了 entries 条且 bytes 字节，
+// 通过 AdjustStorageUsage 扣减用量并返回实际删除的量。未实现时超出上限只记录指标，不删除
+type OfflineEvictor interface {
+	EvictOldest(ctx context.Context, userID string, entries int64, bytes int64) (redisClient.StorageEviction, error)
+}
+
+// AdjustStorageUsage 扣减用户的离线保存用量。离线存储在回放、压缩或删除条目后调用，entries 与 bytes 为删除的量
+func AdjustStorageUsage(ctx context.Context, userID string, entries int64, bytes int64) error {
+	_, err := redisClient.AddStorageUsage(ctx, userID, -entries, -bytes)
+	return err
+}
+
+// storageCaps 账号等级的离线保存上限，为0表示不限制
+func storageCaps(tier string) (entries int64, bytes int64) {
+	cfg := config.Handler
+	entries, bytes = int64(cfg.StorageMaxEntries), int64(cfg.StorageMaxBytes)
+	if n, ok := cfg.StorageTierMaxEntries[tier]; ok {
+		entries = int64(n)
+	}
+	if n, ok := cfg.StorageTierMaxBytes[tier]; ok {
+		bytes = int64(n)
+	}
+	return entries, bytes
+}
+
+// accountStorage 离线保存成功后记入用户的用量，超出账号等级的上限时淘汰最早的条目，并登记淘汰以便客户端下次登录时得知历史存在缺口。
+// 用量记录失败不影响本次保存
+func (s *Server) accountStorage(ctx context.Context, userID string, env *Envelope) {
+	usage, err := redisClient.AddStorageUsage(ctx, userID, 1, int64(proto.Size(env.Message)))
+	if err != nil {
+		ctxLogger(ctx).Warnf("记录用户 %s 的离线保存用量失败: %v", userID, err)
+		return
+	}
+	tier, err := s.tiers.Tier(ctx, userID)
+	if err != nil {
+		ctxLogger(ctx).Warnf("查询用户 %s 的账号等级失败，按默认等级处理: %v", userID, err)
+		tier = defaultTier
+	}
+	maxEntries, maxBytes := storageCaps(tier)
+	var overEntries, overBytes int64
+	if maxEntries > 0 && usage.Entries > maxEntries {
+		overEntries = usage.Entries - maxEntries
+	}
+	if maxBytes > 0 && usage.Bytes > maxBytes {
+		overBytes = usage.Bytes - maxBytes
+	}
+	if overEntries == 0 && overBytes == 0 {
+		return
+	}
+	reason := "entries"
+	if overBytes > 0 {
+		reason = "bytes"
+	}
+	evictor, ok := s.offline.(OfflineEvictor)
+	if !ok {
+		metrics.Inc("storage_over_quota_total", "tier", tier, "reason", reason)
+		return
+	}
+	eviction, err := evictor.EvictOldest(ctx, userID, overEntries, overBytes)
+	if err != nil {
+		ctxLogger(ctx).Warnf("淘汰用户 %s 的离线消息失败: %v", userID, err)
+		metrics.Inc("storage_evictions_total", "tier", tier, "reason", reason, "result", "error")
+		return
+	}
+	if eviction.Entries == 0 {
+		return
+	}
+	metrics.Inc("storage_evictions_total", "tier", tier, "reason", reason, "result", "ok")
+	metrics.Add("storage_evicted_entries_total", float64(eviction.Entries), "tier", tier)
+	metrics.Add("storage_evicted_bytes_total", float64(eviction.Bytes), "tier", tier)
+	if err := redisClient.RecordStorageEviction(ctx, userID, eviction); err != nil {
+		ctxLogger(ctx).Warnf("登记用户 %s 的离线消息淘汰失败: %v", userID, err)
+	}
+}
+
+// notifyStorageEvicted 登录后钩子：用户的离线消息曾被超额淘汰时推送 StorageEvicted，提醒客户端历史存在缺口。
+// 淘汰记录取出后即清除，只告知最先登录的设备
+func notifyStorageEvicted(ctx context.Context, client *Client) {
+	if client.synthetic {
+		return
+	}
+	eviction, err := redisClient.TakeStorageEviction(ctx, client.userID)
+	if err != nil {
+		client.log().Warnf("读取离线消息淘汰记录失败: %v", err)
+		return
+	}
+	if eviction.Entries == 0 {
+		return
+	}
+	err = client.Enqueue(&pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_StorageEvicted{
+			StorageEvicted: &pb.StorageEvicted{
+				EvictedEntries: eviction.Entries,
+				EvictedBytes:   eviction.Bytes,
+				BeforeMs:       eviction.Before.UnixMilli(),
+			},
+		},
+	}, WithPriority(PriorityControl))
+	if err != nil {
+		client.log().Warnf("推送离线消息淘汰通知失败: %v", err)
+		// 放回记录，下次登录时再告知
+		if err := redisClient.RecordStorageEviction(ctx, client.userID, eviction); err != nil {
+			client.log().Warnf("恢复离线消息淘汰记录失败: %v", err)
+		}
+	}
+}
+
+// handleAdminStorage 列出离线保存字节数最多的用户与集群总量
+func handleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	users, err := redisClient.TopStorageUsers(r.Context(), n)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	total, err := redisClient.TotalStorageUsage(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"users": users,
+		"total": total,
+	})
+}
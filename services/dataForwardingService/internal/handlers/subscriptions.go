@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"strings"
+)
+
+// subscriptionSet 连接订阅的事件类别，按 EventCategory 编号占位
+type subscriptionSet uint32
+
+// allEventCategories 可订阅的事件类别
+var allEventCategories = []pb.EventCategory{
+	pb.EventCategory_EVENT_PRESENCE,
+	pb.EventCategory_EVENT_TYPING,
+	pb.EventCategory_EVENT_REACTIONS,
+	pb.EventCategory_EVENT_READ_RECEIPTS,
+	pb.EventCategory_EVENT_THREAD_ACTIVITY,
+}
+
+// classSubscriptions 各客户端类别默认订阅的事件类别，未列出的类别默认订阅全部。
+// 手表与物联网设备电量、带宽有限，默认不接收任何事件
+var classSubscriptions = map[string][]pb.EventCategory{
+	"watch": nil,
+	"iot":   nil,
+}
+
+func newSubscriptionSet(categories []pb.EventCategory) subscriptionSet {
+	var s subscriptionSet
+	for _, c := range categories {
+		s = s.with(c)
+	}
+	return s
+}
+
+func (s subscriptionSet) has(c pb.EventCategory) bool {
+	return s&(1<<uint32(c)) != 0
+}
+
+func (s subscriptionSet) with(c pb.EventCategory) subscriptionSet {
+	if c <= pb.EventCategory_EVENT_CATEGORY_UNSPECIFIED || c > 31 {
+		return s
+	}
+	return s | 1<<uint32(c)
+}
+
+func (s subscriptionSet) without(c pb.EventCategory) subscriptionSet {
+	if c <= pb.EventCategory_EVENT_CATEGORY_UNSPECIFIED || c > 31 {
+		return s
+	}
+	return s &^ (1 << uint32(c))
+}
+
+// categories 按编号顺序列出订阅的类别
+func (s subscriptionSet) categories() []pb.EventCategory {
+	var result []pb.EventCategory
+	for _, c := range allEventCategories {
+		if s.has(c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// String 保存到redis的格式，逗号分隔的类别名
+func (s subscriptionSet) String() string {
+	categories := s.categories()
+	names := make([]string, len(categories))
+	for i, c := range categories {
+		names[i] = c.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// parseSubscriptions 解析保存的订阅，不认识的类别名忽略
+func parseSubscriptions(text string) subscriptionSet {
+	var s subscriptionSet
+	for _, name := range strings.Split(text, ",") {
+		if v, ok := pb.EventCategory_value[name]; ok {
+			s = s.with(pb.EventCategory(v))
+		}
+	}
+	return s
+}
+
+// defaultSubscriptions 客户端类别的默认订阅
+func defaultSubscriptions(clientClass string) subscriptionSet {
+	if categories, ok := classSubscriptions[clientClass]; ok {
+		return newSubscriptionSet(categories)
+	}
+	return newSubscriptionSet(allEventCategories)
+}
+
+// loginSubscriptions 登录时确定连接的订阅：设备设置过时沿用，否则按客户端类别取默认值
+func loginSubscriptions(saved string, hasSaved bool, clientClass string) subscriptionSet {
+	if hasSaved {
+		return parseSubscriptions(saved)
+	}
+	return defaultSubscriptions(clientClass)
+}
+
+// eventCategoryOf 响应所属的事件类别，不属于任何可订阅类别的响应总是下发
+func eventCategoryOf(rsp *pb.ResponseMessage) pb.EventCategory {
+	switch rsp.GetPayload().(type) {
+	case *pb.ResponseMessage_Reaction, *pb.ResponseMessage_Reactions:
+		return pb.EventCategory_EVENT_REACTIONS
+	case *pb.ResponseMessage_ThreadActivity:
+		return pb.EventCategory_EVENT_THREAD_ACTIVITY
+	default:
+		return pb.EventCategory_EVENT_CATEGORY_UNSPECIFIED
+	}
+}
+
+// subscribedTo 连接是否订阅了该消息所属的事件类别。在出站拦截器之后、入队之前按连接判断，未订阅的不入队
+func (c *Client) subscribedTo(message *pb.ResponseMessage) bool {
+	category := eventCategoryOf(message)
+	if category == pb.EventCategory_EVENT_CATEGORY_UNSPECIFIED {
+		return true
+	}
+	if subscriptionSet(c.subscriptions.Load()).has(category) {
+		return true
+	}
+	metrics.Inc("event_suppressed_total", "category", category.String())
+	return false
+}
+
+// handleSetSubscriptions 调整本连接订阅的事件类别并按设备保存，返回调整后的订阅
+func handleSetSubscriptions(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	req := message.GetSetSubscriptions()
+	var s subscriptionSet
+	for {
+		old := client.subscriptions.Load()
+		s = subscriptionSet(old)
+		for _, c := range req.GetSubscribe() {
+			s = s.with(c)
+		}
+		for _, c := range req.GetUnsubscribe() {
+			s = s.without(c)
+		}
+		if client.subscriptions.CompareAndSwap(old, uint32(s)) {
+			break
+		}
+	}
+	if err := redisClient.SetSubscriptions(ctx, client.userID, client.deviceID, s.String()); err != nil {
+		// 本连接已生效，下次登录可能恢复为之前的设置
+		ctxLogger(ctx).Warnf("保存事件订阅失败: %v", err)
+	}
+	return &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Subscriptions{
+			Subscriptions: &pb.Subscriptions{Categories: s.categories()},
+		},
+	}, nil
+}
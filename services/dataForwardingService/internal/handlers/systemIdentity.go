@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+)
+
+// reservedUserID 用户ID是否为系统保留：负数，以及 1 到 ReservedUserIDMax 之间的ID。
+// 保留ID不能登录，也不能作为报文中声明的发送者
+func reservedUserID(id int64) bool {
+	return id < 0 || (id > 0 && id <= config.Handler.ReservedUserIDMax)
+}
+
+// claimedSender 入站报文中客户端填写的发送者，未填写时为0
+func claimedSender(message *pb.RequestMessage) int64 {
+	switch payload := message.GetPayload().(type) {
+	case *pb.RequestMessage_Post:
+		return payload.Post.GetFromId()
+	case *pb.RequestMessage_Encrypted:
+		return payload.Encrypted.GetFromId()
+	default:
+		return 0
+	}
+}
+
+// SenderGateMiddleware 拒绝声明系统保留发送者的报文，返回 Refused{FORBIDDEN_SENDER}。
+// 发送者随后总会被覆盖为登录用户，此处拒绝是为了让冒充行为可见
+func SenderGateMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		if from := claimedSender(message); reservedUserID(from) {
+			metrics.Inc("forbidden_sender_total", "type", payloadType(message))
+			client.log().Warnf("报文声明了系统保留的发送者 %d，已拒绝", from)
+			return refused(pb.RefusedReason_FORBIDDEN_SENDER), nil
+		}
+		return next(ctx, client, message)
+	}
+}
+
+// systemOriginated 由服务端生成、没有用户发送者的报文类型，与携带系统文本的类型一致
+func systemOriginated(rsp *pb.ResponseMessage) bool {
+	return rsp.GetSystemNotice() != nil || localizedTextOf(rsp) != nil
+}
+
+// withSenderType 返回填写了发送方类型的报文。已填写时原样返回；原报文可能由多个连接共用，需要填写时返回副本，
+// 只读载荷(见 sharedPayload)与原报文共用
+func withSenderType(rsp *pb.ResponseMessage, senderType pb.SenderType) *pb.ResponseMessage {
+	if rsp.GetSenderType() != pb.SenderType_SENDER_UNSPECIFIED {
+		return rsp
+	}
+	if sharedPayload(rsp) {
+		rsp = copyEnvelope(rsp)
+	} else {
+		rsp = proto.Clone(rsp).(*pb.ResponseMessage)
+	}
+	rsp.SenderType = senderType
+	return rsp
+}
+
+// senderTypeOf 投递时的发送方类型：有发起用户且不是保留ID时为用户消息，否则为系统消息
+func senderTypeOf(sender string) pb.SenderType {
+	if sender == "" {
+		return pb.SenderType_SENDER_SYSTEM
+	}
+	id, err := strconv.ParseInt(sender, 10, 64)
+	if err != nil || reservedUserID(id) {
+		return pb.SenderType_SENDER_SYSTEM
+	}
+	return pb.SenderType_SENDER_USER
+}
+
+// senderInterceptor 为发送方上未填写类型的投递补填系统身份，如全员广播与其他容器转发来的系统事件
+func senderInterceptor(recipientID string, env *Envelope) (*Envelope, error) {
+	env.Message = withSenderType(env.Message, pb.SenderType_SENDER_SYSTEM)
+	return env, nil
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// payloadType 取报文 oneof payload 中实际设置的字段名，作为指标标签。
+// 字段名由proto定义决定，取值有限，不会造成标签基数膨胀
+func payloadType(msg proto.Message) string {
+	m := msg.ProtoReflect()
+	oneof := m.Descriptor().Oneofs().ByName("payload")
+	if oneof == nil {
+		return "unknown"
+	}
+	field := m.WhichOneof(oneof)
+	if field == nil {
+		return "none"
+	}
+	return string(field.Name())
+}
+
+// recordInbound 记录一条入站报文的类型计数、字节数，并计入用户流量统计
+func recordInbound(client *Client, msg proto.Message, size int) {
+	kind := payloadType(msg)
+	metrics.Inc("messages_in_total", "type", kind)
+	metrics.Add("message_bytes_in_total", float64(size), "type", kind)
+	sampleSize("in", kind, size)
+	talkers.record(client.userID, size, 0)
+}
+
+// recordOutbound 记录一条出站报文，recipientID 为接收用户，按接收用户计入流量统计
+func recordOutbound(recipientID string, msg proto.Message, size int) {
+	kind := payloadType(msg)
+	metrics.Inc("messages_out_total", "type", kind)
+	metrics.Add("message_bytes_out_total", float64(size), "type", kind)
+	sampleSize("out", kind, size)
+	talkers.record(recipientID, 0, size)
+}
+
+// talkerStat 某用户在一个统计桶内的报文数与字节数
+type talkerStat struct {
+	In       int64 `json:"in"`
+	Out      int64 `json:"out"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+func (s *talkerStat) add(o *talkerStat) {
+	s.In += o.In
+	s.Out += o.Out
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+}
+
+// talkerBucket 一分钟内各用户的流量，minute 为桶对应的Unix分钟数
+type talkerBucket struct {
+	minute int64
+	users  map[string]*talkerStat
+}
+
+// talkerRing 按分钟分桶的环形统计窗口，用户ID只出现在按需生成的报告中，不作为指标标签
+type talkerRing struct {
+	mu      sync.Mutex
+	buckets []talkerBucket
+}
+
+var talkers = newTalkerRing(config.Handler.TopTalkersWindow)
+
+func newTalkerRing(window time.Duration) *talkerRing {
+	n := int(window / time.Minute)
+	if n < 1 {
+		n = 1
+	}
+	return &talkerRing{buckets: make([]talkerBucket, n)}
+}
+
+// record 累加当前分钟桶，桶过期时先清空
+func (r *talkerRing) record(userID string, bytesIn, bytesOut int) {
+	if userID == "" {
+		return
+	}
+	minute := time.Now().Unix() / 60
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := &r.buckets[minute%int64(len(r.buckets))]
+	if b.minute != minute || b.users == nil {
+		b.minute = minute
+		b.users = make(map[string]*talkerStat)
+	}
+	s, ok := b.users[userID]
+	if !ok {
+		s = &talkerStat{}
+		b.users[userID] = s
+	}
+	if bytesIn > 0 {
+		s.In++
+		s.BytesIn += int64(bytesIn)
+	}
+	if bytesOut > 0 {
+		s.Out++
+		s.BytesOut += int64(bytesOut)
+	}
+}
+
+// talkerEntry top-talkers 报告中的一项
+type talkerEntry struct {
+	UserID string `json:"user_id"`
+	talkerStat
+}
+
+// top 汇总窗口内仍有效的桶，按 by 指定的维度(messages 或 bytes)降序返回前 n 个用户
+func (r *talkerRing) top(n int, by string) []talkerEntry {
+	oldest := time.Now().Unix()/60 - int64(len(r.buckets)) + 1
+	total := make(map[string]*talkerStat)
+	r.mu.Lock()
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if b.users == nil || b.minute < oldest {
+			continue
+		}
+		for userID, s := range b.users {
+			t, ok := total[userID]
+			if !ok {
+				t = &talkerStat{}
+				total[userID] = t
+			}
+			t.add(s)
+		}
+	}
+	r.mu.Unlock()
+
+	list := make([]talkerEntry, 0, len(total))
+	for userID, s := range total {
+		list = append(list, talkerEntry{UserID: userID, talkerStat: *s})
+	}
+	key := func(e talkerEntry) int64 {
+		if by == "bytes" {
+			return e.BytesIn + e.BytesOut
+		}
+		return e.In + e.Out
+	}
+	sort.Slice(list, func(i, j int) bool { return key(list[i]) > key(list[j]) })
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// handleAdminTopTalkers GET /admin/top-talkers?n=20&by=messages|bytes 返回统计窗口内流量最大的用户
+func handleAdminTopTalkers(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	by := r.URL.Query().Get("by")
+	switch by {
+	case "":
+		by = "messages"
+	case "messages", "bytes":
+	default:
+		http.Error(w, "invalid by", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window": config.Handler.TopTalkersWindow.String(),
+		"by":     by,
+		"users":  talkers.top(n, by),
+	})
+}
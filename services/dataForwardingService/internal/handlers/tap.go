@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"data_forwarding_service/config"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errTapBusy 同一用户同时只允许一个旁路监听
+var errTapBusy = errors.New("该用户已有旁路监听")
+
+// userTap 对某个用户的旁路监听，复制该用户所有连接的收发报文
+type userTap struct {
+	userID  string
+	frames  chan tapFrame
+	dropped atomic.Int64
+}
+
+// tapFrame 旁路监听输出的一帧
+type tapFrame struct {
+	Direction string          `json:"direction"` // in: 客户端发来，out: 发往客户端
+	ConnID    string          `json:"conn_id"`
+	DeviceID  string          `json:"device_id"`
+	At        int64           `json:"at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+var (
+	taps       = make(map[string]*userTap) // {用户ID: 旁路监听}
+	tapsMutex  sync.Mutex
+	tapUpgrade = websocket.Upgrader{}
+)
+
+// attachTap 为用户挂载旁路监听，并挂到该用户在实例中的所有连接上
+func (s *Server) attachTap(userID string) (*userTap, error) {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	if _, ok := taps[userID]; ok {
+		return nil, errTapBusy
+	}
+	t := &userTap{
+		userID: userID,
+		frames: make(chan tapFrame, 256),
+	}
+	taps[userID] = t
+	for _, client := range s.clients.UserClients(userID) {
+		client.tap.Store(t)
+	}
+	return t, nil
+}
+
+// detachTap 卸载旁路监听，之后连接上不再有任何额外开销
+func (s *Server) detachTap(t *userTap) {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	if cur, ok := taps[t.userID]; ok && cur == t {
+		delete(taps, t.userID)
+	}
+	for _, client := range s.clients.UserClients(t.userID) {
+		client.tap.CompareAndSwap(t, nil)
+	}
+}
+
+// lookupTap 查询用户当前的旁路监听，登录时用于挂到新连接上
+func lookupTap(userID string) *userTap {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	return taps[userID]
+}
+
+// record 复制一帧报文，监听端处理不及时时丢弃，不阻塞连接
+func (t *userTap) record(client *Client, direction string, message proto.Message) {
+	payload, err := protojson.Marshal(redact(message))
+	if err != nil {
+		return
+	}
+	_, deviceID := client.identity()
+	frame := tapFrame{
+		Direction: direction,
+		ConnID:    client.connID,
+		DeviceID:  deviceID,
+		At:        time.Now().UnixMilli(),
+		Payload:   payload,
+	}
+	select {
+	case t.frames <- frame:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// tapOutbound 解析发往客户端的字节流后记录，只在挂载了旁路监听时调用
+func (t *userTap) tapOutbound(client *Client, data []byte) {
+	rsp := &pb.ResponseMessage{}
+	if err := proto.Unmarshal(data, rsp); err != nil {
+		return
+	}
+	t.record(client, "out", rsp)
+}
+
+// redact 复制报文并清除其中的口令、JWT与恢复令牌
+func redact(message proto.Message) proto.Message {
+	message = proto.Clone(message)
+	switch m := message.(type) {
+	case *pb.RequestMessage:
+		m.Jwt = ""
+		if login := m.GetLogin(); login != nil {
+			login.Password = ""
+			login.ResumeToken = ""
+		}
+		if signup := m.GetSignup(); signup != nil {
+			signup.Password = ""
+		}
+		if submit := m.GetTwoFactorSubmit(); submit != nil {
+			submit.Code = ""
+		}
+	case *pb.ResponseMessage:
+		if login := m.GetLogin(); login != nil {
+			login.Jwt = ""
+			login.ResumeToken = ""
+		}
+	}
+	return message
+}
+
+// handleAdminTap 以WebSocket实时输出指定用户的收发报文(JSON)，超过 TapMaxDuration 自动断开
+func (s *Server) handleAdminTap(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	if userID == "" {
+		http.Error(w, "missing user id", http.StatusBadRequest)
+		return
+	}
+	t, err := s.attachTap(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer s.detachTap(t)
+
+	conn, err := tapUpgrade.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// 监听端断开时结束
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	expire := time.NewTimer(config.Handler.TapMaxDuration)
+	defer expire.Stop()
+	for {
+		select {
+		case frame := <-t.frames:
+			data, _ := json.Marshal(frame)
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-expire.C:
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tap expired"), time.Now().Add(time.Second))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"errors"
+	"slices"
+	"strconv"
+)
+
+// normalizeThread 校验消息的话题字段，首条消息ID为空时取直接回复的消息，返回话题首条消息ID(不是回复时为空)
+func normalizeThread(messageID string, parentID string, rootID string) (string, error) {
+	for _, id := range []string{messageID, parentID, rootID} {
+		if len(id) > maxMessageIDLen {
+			return "", errors.New("消息ID过长")
+		}
+	}
+	if rootID == "" {
+		rootID = parentID
+	}
+	if rootID != "" && rootID == messageID {
+		return "", errors.New("消息不能回复自己")
+	}
+	return rootID, nil
+}
+
+// recordThreadReply 累加话题回复数。话题首条消息的发送者不在线时，在第一条和此后每 ThreadActivityBatch 条新回复时
+// 向其投递话题活动摘要，经离线存储与推送送达；服务端不保存话题内容，只保存计数
+func (s *Server) recordThreadReply(ctx context.Context, conv conversation, fromID int64, rootID string, rootAuthorID int64, serverTs int64) {
+	author := ""
+	if rootAuthorID != 0 {
+		// 只接受会话参与者作为首条消息的发送者，避免借回复向任意用户发送通知
+		participants, err := s.participants(ctx, conv, fromID)
+		if err == nil && slices.Contains(participants, strconv.FormatInt(rootAuthorID, 10)) {
+			author = strconv.FormatInt(rootAuthorID, 10)
+		}
+	}
+	offline := false
+	if author != "" && author != strconv.FormatInt(fromID, 10) {
+		offline = !s.hasLocalRecipient(author, "") && len(redisClient.GetUserContainers(ctx, author)) == 0
+	}
+
+	counters, err := redisClient.IncrThreadReplies(ctx, conv.key(fromID), rootID, author, offline, config.Handler.ThreadTTL)
+	if err != nil {
+		ctxLogger(ctx).Warnf("更新话题 %s 的回复数失败: %v", rootID, err)
+		return
+	}
+	metrics.Inc("thread_reply_total")
+	if !offline || counters.Author != author {
+		return
+	}
+	batch := int64(max(config.Handler.ThreadActivityBatch, 1))
+	if counters.Unseen != 1 && counters.Unseen%batch != 0 {
+		return
+	}
+
+	toID := conv.ToID
+	if !conv.IsGroup {
+		// 单聊中从首条消息发送者的角度看，对方是回复者
+		toID = fromID
+	}
+	_, err = s.DeliverToUser(ctx, author, &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_ThreadActivity{
+			ThreadActivity: &pb.ThreadActivity{
+				IsGroup:       conv.IsGroup,
+				ToId:          toID,
+				ThreadRootId:  rootID,
+				ReplyCount:    counters.Replies,
+				UnseenReplies: counters.Unseen,
+				LastReplyFrom: fromID,
+				LastReplyTs:   serverTs,
+			},
+		},
+	}, DeliveryOptions{
+		Priority:  PriorityInteractive,
+		ServerTs:  serverTs,
+		Sequenced: true,
+		Sender:    strconv.FormatInt(fromID, 10),
+		DedupKey:  "thread:" + conv.key(fromID) + ":" + rootID + ":" + strconv.FormatInt(counters.Unseen, 10),
+	})
+	if err != nil {
+		ctxLogger(ctx).Warnf("投递话题活动摘要失败: %v", err)
+	}
+}
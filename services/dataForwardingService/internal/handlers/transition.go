@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"sync"
+)
+
+// heldDelivery 登录切换期间暂存的一条投递
+type heldDelivery struct {
+	deviceID string // 为空时投递给用户在本容器的所有设备
+	env      *Envelope
+}
+
+// transition 设备的一次登录切换：旧连接正在断开、新连接尚未登记，期间发给该设备的投递暂存于此
+type transition struct {
+	deviceID string
+	held     []heldDelivery
+}
+
+// transitionTable 实例中正在登录切换的设备
+type transitionTable struct {
+	mu     sync.Mutex
+	byUser map[string][]*transition // {用户ID: 切换中的设备}
+}
+
+// beginTransition 登录解决冲突之前调用：本地暂存发给该设备的投递，并在redis中标记，
+// 使其他容器在旧登记注销、新登记写入之前也把消息转到本容器
+func (s *Server) beginTransition(ctx context.Context, userID string, deviceID string) *transition {
+	t := &transition{deviceID: deviceID}
+	s.transitions.mu.Lock()
+	if s.transitions.byUser == nil {
+		s.transitions.byUser = make(map[string][]*transition)
+	}
+	s.transitions.byUser[userID] = append(s.transitions.byUser[userID], t)
+	s.transitions.mu.Unlock()
+	if err := redisClient.BeginTransition(ctx, userID, deviceID, identity.ContainerID(), config.Handler.TransitionTTL); err != nil {
+		ctxLogger(ctx).Warnf("标记登录切换失败: %v", err)
+	}
+	return t
+}
+
+// endTransition 冲突解决结束后调用。registered 为true时按到达顺序把暂存的投递发给新连接，否则离线保存。
+// 发送在持锁期间完成，之后到达的投递才能直接入队，保证顺序
+func (s *Server) endTransition(ctx context.Context, userID string, t *transition, registered bool) {
+	if err := redisClient.EndTransition(ctx, userID, t.deviceID); err != nil {
+		ctxLogger(ctx).Warnf("清除登录切换标记失败: %v", err)
+	}
+	s.transitions.mu.Lock()
+	defer s.transitions.mu.Unlock()
+	list := s.transitions.byUser[userID]
+	for i, cur := range list {
+		if cur == t {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(s.transitions.byUser, userID)
+	} else {
+		s.transitions.byUser[userID] = list
+	}
+	if len(t.held) > 0 {
+		metrics.Observe("transition_held", float64(len(t.held)))
+	}
+	for _, h := range t.held {
+		if registered && s.deliverLocal(userID, h.deviceID, h.env) {
+			continue
+		}
+		if _, err := s.storeOffline(ctx, userID, h.deviceID, h.env); err != nil {
+			ctxLogger(ctx).Warnf("登录切换暂存的消息离线保存失败: %v", err)
+		}
+	}
+	t.held = nil
+}
+
+// inTransition 用户(deviceID 非空时为该设备)是否有设备正在实例中登录切换
+func (s *Server) inTransition(userID string, deviceID string) bool {
+	s.transitions.mu.Lock()
+	defer s.transitions.mu.Unlock()
+	for _, t := range s.transitions.byUser[userID] {
+		if deviceID == "" || t.deviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// holdForTransition 接收设备正在本容器登录切换时暂存投递，返回是否已暂存。
+// deviceID 为空时暂存整条投递，切换结束后发给该用户在本容器的所有设备；暂存已满或切换已结束时返回false
+func (s *Server) holdForTransition(userID string, deviceID string, env *Envelope) bool {
+	s.transitions.mu.Lock()
+	defer s.transitions.mu.Unlock()
+	for _, t := range s.transitions.byUser[userID] {
+		if deviceID != "" && t.deviceID != deviceID {
+			continue
+		}
+		if len(t.held) >= config.Handler.TransitionHoldMax {
+			metrics.Inc("transition_hold_overflow_total")
+			return false
+		}
+		t.held = append(t.held, heldDelivery{deviceID: deviceID, env: env})
+		return true
+	}
+	return false
+}
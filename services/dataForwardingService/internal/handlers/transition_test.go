@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// recordingOffline 记录离线保存的消息
+type recordingOffline struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (r *recordingOffline) Store(ctx context.Context, userID string, deviceID string, env *Envelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, string(env.Message.GetEcho().GetBody()))
+	return nil
+}
+
+// 同一设备反复重新登录期间持续投递，每条消息都送达某条连接或被离线保存，不会丢失。需在 -race 下运行
+func TestDeliveryDuringReloginLosesNothing(t *testing.T) {
+	withRedis(t)
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.LoginDampMax = 0 })
+	s := NewServer()
+	s.SetAccountService(NewMemoryAccountService(NewAccount{Account: "alice", Password: "pw"}))
+	offline := &recordingOffline{}
+	s.SetOfflineStore(offline)
+	userID := strconv.Itoa(memoryUserIDBase)
+	login := &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: "alice", Password: "pw", DeviceId: "phone"}}}
+	echo := func(body string) *pb.ResponseMessage {
+		return &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte(body)}}}
+	}
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string]bool)
+		readers  sync.WaitGroup
+	)
+	// connect 建立连接并登录，读协程记录收到的所有投递直到连接断开
+	connect := func() *websocket.Conn {
+		conn := dialServer(t, s)
+		loggedIn := make(chan pb.LoginResult, 1)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				rsp := &pb.ResponseMessage{}
+				if proto.Unmarshal(data, rsp) != nil {
+					continue
+				}
+				if l := rsp.GetLogin(); l != nil {
+					loggedIn <- l.GetResult()
+				}
+				if e := rsp.GetEcho(); e != nil {
+					mu.Lock()
+					received[string(e.GetBody())] = true
+					mu.Unlock()
+				}
+			}
+		}()
+		sendRequest(t, conn, login)
+		if result := <-loggedIn; result != pb.LoginResult_LOGIN_OK {
+			t.Fatalf("登录失败: %v", result)
+		}
+		return conn
+	}
+
+	var (
+		stop    atomic.Bool
+		sent    atomic.Int64
+		dropped []int64
+		sender  sync.WaitGroup
+	)
+	sender.Add(1)
+	go func() {
+		defer sender.Done()
+		for i := int64(0); !stop.Load(); i++ {
+			result, err := s.DeliverToUser(context.Background(), userID, echo(strconv.FormatInt(i, 10)), DeliveryOptions{})
+			if result == DeliveryDropped || err != nil {
+				dropped = append(dropped, i)
+			}
+			sent.Store(i + 1)
+		}
+	}()
+
+	var last *websocket.Conn
+	for round := 0; round < 20; round++ {
+		last = connect()
+	}
+	stop.Store(true)
+	sender.Wait()
+
+	// 发送队列按顺序发出，收到结束标记时之前投递到最后一条连接的消息都已收到
+	if result, _ := s.DeliverToUser(context.Background(), userID, echo("end"), DeliveryOptions{}); result != DeliveredLocal {
+		t.Fatalf("结束标记投递结果为 %v", result)
+	}
+	waitFor(t, "收到结束标记", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["end"]
+	})
+	last.Close()
+	readers.Wait()
+
+	if len(dropped) > 0 {
+		t.Fatalf("%d 条投递被丢弃，前几条: %v", len(dropped), dropped[:min(len(dropped), 5)])
+	}
+	offline.mu.Lock()
+	for _, body := range offline.bodies {
+		received[body] = true
+	}
+	offline.mu.Unlock()
+	var lost []int64
+	for i := int64(0); i < sent.Load(); i++ {
+		if !received[strconv.FormatInt(i, 10)] {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) > 0 {
+		t.Fatalf("共投递 %d 条，丢失 %d 条，前几条: %v", sent.Load(), len(lost), lost[:min(len(lost), 5)])
+	}
+	t.Logf("共投递 %d 条，离线保存 %d 条", sent.Load(), len(offline.bodies))
+}
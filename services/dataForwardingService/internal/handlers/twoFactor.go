@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
+	"data_forwarding_service/internal/redis"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTwoFactorRequired 账号密码校验通过，但还需要完成二次验证
+var ErrTwoFactorRequired = errors.New("需要二次验证")
+
+// TwoFactorVerifier 校验用户提交的二次验证码
+type TwoFactorVerifier interface {
+	Verify(ctx context.Context, userID string, code string) (bool, error)
+}
+
+// SetTwoFactorVerifier 替换二次验证码校验器，默认按 RFC 6238 校验TOTP，需在服务启动之前调用
+func (s *Server) SetTwoFactorVerifier(v TwoFactorVerifier) {
+	s.twoFactor = v
+}
+
+// SetTwoFactorVerifier 替换默认实例的二次验证码校验器。
+//
+// Deprecated: 使用 Default().SetTwoFactorVerifier
+func SetTwoFactorVerifier(v TwoFactorVerifier) {
+	defaultServer.SetTwoFactorVerifier(v)
+}
+
+// beginTwoFactor 创建二次验证挑战并通知客户端提交验证码，连接保持未登录状态
+func beginTwoFactor(ctx context.Context, client *Client, requestMsg *pb.RequestMessage, loginRsp *pb.LoginRsp, deviceID string) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		client.log().Errorf("生成二次验证挑战ID失败: %v", err)
+		replyLogin(client, loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR))
+		return
+	}
+	challengeID := hex.EncodeToString(idBytes)
+	fingerprint := loginFingerprint(requestMsg)
+	ttl := config.Handler.TwoFactorTTL
+	err := redisClient.StoreTwoFactorChallenge(ctx, challengeID, map[string]string{
+		"user_id":     strconv.FormatInt(loginRsp.GetUserId(), 10),
+		"device_id":   deviceID,
+		"jwt":         loginRsp.GetJwt(),
+		"chunking":    strconv.FormatBool(requestMsg.GetLogin().GetSupportChunking()),
+		"class":       requestMsg.GetLogin().GetClientClass(),
+		"heartbeat":   strconv.FormatInt(requestMsg.GetLogin().GetHeartbeatIntervalMs(), 10),
+		"adaptive":    strconv.FormatBool(requestMsg.GetLogin().GetAdaptiveHeartbeat()),
+		"locale":      requestMsg.GetLogin().GetLocale(),
+		"conn_id":     client.connID,
+		"fingerprint": hex.EncodeToString(fingerprint[:]),
+	}, ttl)
+	if err != nil {
+		client.log().Errorf("保存二次验证挑战失败: %v", err)
+		replyLogin(client, loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR))
+		return
+	}
+	metrics.Inc("two_factor_total", "result", "challenged")
+	replyLogin(client, &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_TwoFactorRequired{
+			TwoFactorRequired: &pb.TwoFactorRequired{
+				ChallengeId: challengeID,
+				ExpiresInMs: ttl.Milliseconds(),
+			},
+		},
+	})
+}
+
+// twoFactorHandler 校验二次验证码，通过后按普通登录完成冲突处理与连接登记。
+// 挑战只能在发起登录的连接上提交，错误次数达到上限后挑战作废，需重新登录
+func twoFactorHandler(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+	if client.loggedIn {
+		client.log().Warnf("已登录连接提交二次验证码，不处理")
+		return nil, nil
+	}
+	client.loginInProgress.Store(true)
+	defer client.loginInProgress.Store(false)
+
+	submit := message.GetTwoFactorSubmit()
+	challengeID := submit.GetChallengeId()
+	challenge, err := redisClient.GetTwoFactorChallenge(ctx, challengeID)
+	if err != nil {
+		client.log().Errorf("读取二次验证挑战失败: %v", err)
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), nil
+	}
+	if challenge == nil || challenge["conn_id"] != client.connID {
+		metrics.Inc("two_factor_total", "result", "expired")
+		return loginErrorResponse(pb.LoginResult_TWO_FACTOR_EXPIRED), nil
+	}
+	attempts, err := redisClient.IncrTwoFactorAttempts(ctx, challengeID)
+	if err != nil {
+		client.log().Errorf("记录二次验证次数失败: %v", err)
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), nil
+	}
+	if attempts < 0 {
+		metrics.Inc("two_factor_total", "result", "expired")
+		return loginErrorResponse(pb.LoginResult_TWO_FACTOR_EXPIRED), nil
+	}
+	maxAttempts := int64(config.Handler.TwoFactorMaxAttempts)
+	if attempts > maxAttempts {
+		_ = redisClient.DeleteTwoFactorChallenge(ctx, challengeID)
+		metrics.Inc("two_factor_total", "result", "locked")
+		return loginErrorResponse(pb.LoginResult_TWO_FACTOR_LOCKED), nil
+	}
+
+	ok, err := client.server.twoFactor.Verify(ctx, challenge["user_id"], submit.GetCode())
+	if err != nil {
+		client.log().Errorf("校验二次验证码失败: %v", err)
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), nil
+	}
+	if !ok {
+		if attempts >= maxAttempts {
+			_ = redisClient.DeleteTwoFactorChallenge(ctx, challengeID)
+			metrics.Inc("two_factor_total", "result", "locked")
+			return loginErrorResponse(pb.LoginResult_TWO_FACTOR_LOCKED), nil
+		}
+		metrics.Inc("two_factor_total", "result", "invalid")
+		return loginErrorResponse(pb.LoginResult_TWO_FACTOR_INVALID), nil
+	}
+	// 挑战只能使用一次
+	if err := redisClient.DeleteTwoFactorChallenge(ctx, challengeID); err != nil {
+		client.log().Warnf("删除二次验证挑战失败: %v", err)
+	}
+	metrics.Inc("two_factor_total", "result", "passed")
+
+	realUserID, err := strconv.ParseInt(challenge["user_id"], 10, 64)
+	if err != nil {
+		client.log().Errorf("二次验证挑战中的用户ID非法: %q", challenge["user_id"])
+		return loginErrorResponse(pb.LoginResult_LOGIN_SVR_ERROR), nil
+	}
+	rsp := &pb.ResponseMessage{
+		Payload: &pb.ResponseMessage_Login{
+			Login: &pb.LoginRsp{
+				Result: pb.LoginResult_LOGIN_OK,
+				UserId: realUserID,
+				Jwt:    challenge["jwt"],
+			},
+		},
+	}
+	chunking, _ := strconv.ParseBool(challenge["chunking"])
+	heartbeatMs, _ := strconv.ParseInt(challenge["heartbeat"], 10, 64)
+	adaptive, _ := strconv.ParseBool(challenge["adaptive"])
+	caps := clientCaps{
+		Chunking:          chunking,
+		Class:             challenge["class"],
+		HeartbeatMs:       heartbeatMs,
+		AdaptiveHeartbeat: adaptive,
+		Locale:            challenge["locale"],
+	}
+	if completeLogin(ctx, client, rsp, realUserID, challenge["device_id"], "", caps) {
+		// 记录原始登录报文的摘要，之后重发同一登录报文时直接返回登录结果
+		var fingerprint [sha256.Size]byte
+		if b, err := hex.DecodeString(challenge["fingerprint"]); err == nil && len(b) == sha256.Size {
+			copy(fingerprint[:], b)
+			client.loginFingerprint = fingerprint
+		}
+	}
+	return nil, nil
+}
+
+// totpVerifier 使用保存在redis中的用户密钥校验TOTP(30秒步长、6位数字、允许前后各一个步长的时钟偏差)
+type totpVerifier struct{}
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+func (totpVerifier) Verify(ctx context.Context, userID string, code string) (bool, error) {
+	encoded, err := redisClient.GetTOTPSecret(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if encoded == "" {
+		return false, fmt.Errorf("用户 %s 未配置TOTP密钥", userID)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(encoded, "=")))
+	if err != nil {
+		return false, fmt.Errorf("用户 %s 的TOTP密钥格式错误: %w", userID, err)
+	}
+	if len(code) != totpDigits {
+		return false, nil
+	}
+	counter := time.Now().Unix() / int64(totpStep/time.Second)
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		expected := hotp(secret, uint64(counter+int64(skew)))
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hotp 按 RFC 4226 计算一次性密码
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/internal/metrics"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldRule 报文字段的声明式校验规则，在处理函数之前由 ValidationMiddleware 执行。
+// 规则中出现的字符串字段总是校验UTF-8
+type FieldRule struct {
+	Field       string // proto字段名，嵌套字段用 . 分隔，如 bundle.device_id；经过repeated字段时对每个元素校验
+	Required    bool   // 不能为零值、空串或空列表
+	MaxLen      int    // 字符串与bytes的字节数、repeated的元素数上限，0表示不限
+	NonNegative bool   // 数值不能为负
+	Max         int64  // 数值上限(含)，0表示不限
+}
+
+// 常用长度上限
+const (
+	maxIDLen      = 128 // 传输ID、挑战ID等标识
+	maxDeviceLen  = 64
+	maxNameLen    = 128 // 账号、用户名
+	maxSecretLen  = 1024
+	maxSmallField = 32 // 类别、类型等枚举性质的字符串
+)
+
+// payloadDescriptor 由 oneof 包装类型(如 *pb.RequestMessage_Post)取得其内部消息的描述符
+func payloadDescriptor(t reflect.Type) (protoreflect.MessageDescriptor, bool) {
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct || t.Elem().NumField() != 1 {
+		return nil, false
+	}
+	inner := t.Elem().Field(0).Type
+	if inner.Kind() != reflect.Pointer {
+		return nil, false
+	}
+	msg, ok := reflect.New(inner.Elem()).Interface().(proto.Message)
+	if !ok {
+		return nil, false
+	}
+	return msg.ProtoReflect().Descriptor(), true
+}
+
+// checkRules 注册时检查规则中的字段都存在，避免字段改名后规则静默失效
+func checkRules(t reflect.Type, rules []FieldRule) {
+	if len(rules) == 0 {
+		return
+	}
+	desc, ok := payloadDescriptor(t)
+	if !ok {
+		panic(fmt.Sprintf("RegisterHandler: 无法取得 %v 的消息描述符", t))
+	}
+	for _, rule := range rules {
+		d := desc
+		parts := strings.Split(rule.Field, ".")
+		for i, name := range parts {
+			fd := d.Fields().ByName(protoreflect.Name(name))
+			if fd == nil {
+				panic(fmt.Sprintf("RegisterHandler: %v 没有字段 %s", t, rule.Field))
+			}
+			if i < len(parts)-1 {
+				if fd.Message() == nil {
+					panic(fmt.Sprintf("RegisterHandler: %v 的字段 %s 不是消息类型", t, name))
+				}
+				d = fd.Message()
+			}
+		}
+	}
+}
+
+// validatePayload 按规则校验报文，返回第一个不合法的字段，全部合法时返回空串
+func validatePayload(message *pb.RequestMessage, rules []FieldRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	m := message.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("payload"))
+	if field == nil {
+		return ""
+	}
+	payload := m.Get(field).Message()
+	for _, rule := range rules {
+		if !checkField(payload, strings.Split(rule.Field, "."), rule) {
+			return rule.Field
+		}
+	}
+	return ""
+}
+
+// checkField 沿字段路径取值并校验，路径中的repeated消息字段逐个元素校验
+func checkField(m protoreflect.Message, path []string, rule FieldRule) bool {
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if len(path) > 1 {
+		if fd.IsList() {
+			list := m.Get(fd).List()
+			for i := 0; i < list.Len(); i++ {
+				if !checkField(list.Get(i).Message(), path[1:], rule) {
+					return false
+				}
+			}
+			return true
+		}
+		if !m.Has(fd) {
+			// 外层消息缺失时由外层字段自己的规则决定是否必填
+			return !rule.Required
+		}
+		return checkField(m.Get(fd).Message(), path[1:], rule)
+	}
+
+	if fd.IsList() {
+		n := m.Get(fd).List().Len()
+		return !(rule.Required && n == 0) && !(rule.MaxLen > 0 && n > rule.MaxLen)
+	}
+	if fd.Kind() == protoreflect.MessageKind {
+		return !rule.Required || m.Has(fd)
+	}
+	v := m.Get(fd)
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		s := v.String()
+		return utf8.ValidString(s) && !(rule.Required && s == "") && !(rule.MaxLen > 0 && len(s) > rule.MaxLen)
+	case protoreflect.BytesKind:
+		n := len(v.Bytes())
+		return !(rule.Required && n == 0) && !(rule.MaxLen > 0 && n > rule.MaxLen)
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		n := v.Int()
+		return !(rule.Required && n == 0) && !(rule.NonNegative && n < 0) && !(rule.Max > 0 && n > rule.Max)
+	default:
+		return !rule.Required || m.Has(fd)
+	}
+}
+
+// ValidationMiddleware 按处理函数声明的字段规则校验报文，不合法时返回 Refused{INVALID_PAYLOAD, field}
+func ValidationMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		info, ok := lookupHandler(message)
+		if !ok {
+			return next(ctx, client, message)
+		}
+		if field := validatePayload(message, info.Validate); field != "" {
+			metrics.Inc("invalid_payload_total", "type", payloadType(message), "field", field)
+			client.log().Warnf("报文字段不合法: %s.%s", payloadType(message), field)
+			rsp := refused(pb.RefusedReason_INVALID_PAYLOAD)
+			rsp.GetRefused().Field = field
+			return rsp, nil
+		}
+		return next(ctx, client, message)
+	}
+}
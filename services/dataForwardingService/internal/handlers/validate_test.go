@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestValidatePayload(t *testing.T) {
+	cases := []struct {
+		name  string
+		req   *pb.RequestMessage
+		field string // 期望不合法的字段，为空时期望通过
+	}{
+		{"合法消息", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "你好"}}}, ""},
+		{"缺少接收者", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{Msg: "hi"}}}, "to_id"},
+		{"接收者为负", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: -1}}}, "to_id"},
+		{"消息ID过长", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, MessageId: strings.Repeat("x", maxMessageIDLen+1)}}}, "message_id"},
+		{"消息ID长度恰好", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, MessageId: strings.Repeat("x", maxMessageIDLen)}}}, ""},
+		{"正文不是UTF-8", &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "\xff\xfe"}}}, "msg"},
+		{"分片缺少传输ID", &pb.RequestMessage{Payload: &pb.RequestMessage_Chunk{Chunk: &pb.Chunk{Total: 1, Data: []byte{1}}}}, "transfer_id"},
+		{"分片序号为负", &pb.RequestMessage{Payload: &pb.RequestMessage_Chunk{Chunk: &pb.Chunk{TransferId: "t", Index: -1, Total: 1, Data: []byte{1}}}}, "index"},
+		{"分片数据为空", &pb.RequestMessage{Payload: &pb.RequestMessage_Chunk{Chunk: &pb.Chunk{TransferId: "t", Total: 1}}}, "data"},
+		{"密文列表为空", &pb.RequestMessage{Payload: &pb.RequestMessage_Encrypted{Encrypted: &pb.EncryptedPayload{ToId: 7}}}, "ciphertexts"},
+		{"某份密文缺少设备", &pb.RequestMessage{Payload: &pb.RequestMessage_Encrypted{Encrypted: &pb.EncryptedPayload{ToId: 7, Ciphertexts: []*pb.DeviceCiphertext{
+			{DeviceId: "phone", Ciphertext: []byte{1}},
+			{Ciphertext: []byte{1}},
+		}}}}, "ciphertexts.device_id"},
+		{"某份密文为空", &pb.RequestMessage{Payload: &pb.RequestMessage_Encrypted{Encrypted: &pb.EncryptedPayload{ToId: 7, Ciphertexts: []*pb.DeviceCiphertext{
+			{DeviceId: "phone"},
+		}}}}, "ciphertexts.ciphertext"},
+		{"缺少密钥包", &pb.RequestMessage{Payload: &pb.RequestMessage_KeyBundleUpload{KeyBundleUpload: &pb.KeyBundleUpload{}}}, "bundle"},
+		{"密钥包缺少设备", &pb.RequestMessage{Payload: &pb.RequestMessage_KeyBundleUpload{KeyBundleUpload: &pb.KeyBundleUpload{Bundle: &pb.KeyBundle{}}}}, "bundle.device_id"},
+		{"屏蔽用户ID为0", &pb.RequestMessage{Payload: &pb.RequestMessage_SetBlock{SetBlock: &pb.SetBlock{}}}, "user_id"},
+		{"历史分页为负", &pb.RequestMessage{Payload: &pb.RequestMessage_FetchHistory{FetchHistory: &pb.FetchHistory{ToId: 7, Limit: -5}}}, "limit"},
+		{"二次验证缺少挑战", &pb.RequestMessage{Payload: &pb.RequestMessage_TwoFactorSubmit{TwoFactorSubmit: &pb.TwoFactorSubmit{Code: "123456"}}}, "challenge_id"},
+		{"账号过长", &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{Account: strings.Repeat("a", maxNameLen+1)}}}, "account"},
+		{"账号为空时由认证服务处理", &pb.RequestMessage{Payload: &pb.RequestMessage_Login{Login: &pb.LoginReq{}}}, ""},
+	}
+	for _, c := range cases {
+		info, ok := lookupHandler(c.req)
+		if !ok {
+			t.Fatalf("%s: 没有注册处理函数", c.name)
+		}
+		if got := validatePayload(c.req, info.Validate); got != c.field {
+			t.Errorf("%s: 不合法字段为 %q，期望 %q", c.name, got, c.field)
+		}
+	}
+}
+
+func TestValidationMiddlewareRefusesWithField(t *testing.T) {
+	called := false
+	chain := buildChain(func(ctx context.Context, client *Client, message *pb.RequestMessage) (*pb.ResponseMessage, error) {
+		called = true
+		return nil, nil
+	}, []Middleware{ValidationMiddleware})
+	rsp, err := chain(context.Background(), &Client{}, &pb.RequestMessage{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: -1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rsp.GetRefused(); r.GetReason() != pb.RefusedReason_INVALID_PAYLOAD || r.GetField() != "to_id" {
+		t.Fatalf("期望 Refused{INVALID_PAYLOAD, to_id}，实际为 %v", rsp)
+	}
+	if called {
+		t.Fatal("校验失败后仍调用了处理函数")
+	}
+}
+
+// 任意字节经 HandleRequestData 解析成功后，校验不能崩溃；通过校验的报文中受规则约束的字符串都是合法UTF-8
+func FuzzValidateRequest(f *testing.F) {
+	seeds := []*pb.RequestMessage{
+		{Payload: &pb.RequestMessage_Post{Post: &pb.Post{ToId: 7, Msg: "hi"}}},
+		{Payload: &pb.RequestMessage_Encrypted{Encrypted: &pb.EncryptedPayload{ToId: 7, Ciphertexts: []*pb.DeviceCiphertext{{DeviceId: "d", Ciphertext: []byte{1}}}}}},
+		{Payload: &pb.RequestMessage_KeyBundleUpload{KeyBundleUpload: &pb.KeyBundleUpload{Bundle: &pb.KeyBundle{DeviceId: "d"}}}},
+		{Payload: &pb.RequestMessage_Chunk{Chunk: &pb.Chunk{TransferId: "t", Total: 2, Data: []byte{1}}}},
+		{Payload: &pb.RequestMessage_FetchHistory{FetchHistory: &pb.FetchHistory{ToId: 7, Limit: 20}}},
+	}
+	for _, seed := range seeds {
+		data, err := proto.Marshal(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := HandleRequestData(data)
+		if err != nil {
+			return
+		}
+		info, ok := lookupHandler(req)
+		if !ok {
+			return
+		}
+		if validatePayload(req, info.Validate) != "" {
+			return
+		}
+		if post := req.GetPost(); post != nil && !utf8.ValidString(post.GetMsg()) {
+			t.Fatalf("非UTF-8 正文通过了校验: %q", post.GetMsg())
+		}
+		if post := req.GetPost(); post != nil && post.GetToId() <= 0 {
+			t.Fatalf("接收者 %d 通过了校验", post.GetToId())
+		}
+	})
+}
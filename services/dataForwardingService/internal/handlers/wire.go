@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"context"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/metrics"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"time"
+)
+
+// wireVersion 本版本发布的 WireEnvelope 格式版本
+const wireVersion = 1
+
+// WireEnvelope 覆盖本服务容器之间经消息队列传输的报文与写入会话历史的报文，两者都会被其他版本的容器读取。
+// 发布给外部系统的投递回执(DeliveryReceipt)与举报(AbuseReport)有各自的proto契约，消费方不是本服务，不包装；
+// 离线存储接口接收结构化的 Envelope，序列化格式由存储实现决定
+
+// EncodeWire 将经消息队列传输的报文编码为字节。WireEnvelopeEmit 关闭时输出旧的裸 RequestMessage，
+// 待所有容器都能解析 WireEnvelope 后再开启。base 为转发时收到的信封，非空时复用以保留不认识的字段
+func EncodeWire(base *pb.WireEnvelope, message *pb.RequestMessage) ([]byte, error) {
+	if !config.Handler.WireEnvelopeEmit {
+		return proto.Marshal(message)
+	}
+	wire := &pb.WireEnvelope{}
+	if base != nil {
+		wire = proto.Clone(base).(*pb.WireEnvelope)
+	}
+	wire.Version = wireVersion
+	wire.Payload = message
+	wire.SentTs = time.Now().UnixMilli()
+	wire.Origin = identity.ContainerID()
+	return proto.Marshal(wire)
+}
+
+// DecodeWire 解析经消息队列收到的报文，兼容旧的裸 RequestMessage：旧格式被包装为 version 为0的信封。
+// 比本版本新的信封照常解析，不认识的字段保留在返回值中
+func DecodeWire(data []byte) (*pb.WireEnvelope, error) {
+	wire := &pb.WireEnvelope{}
+	if err := decodeMessage(data, wire, config.Handler.MaxWireBytes); err != nil {
+		return nil, fmt.Errorf("反序列化失败: %w", err)
+	}
+	if wire.GetVersion() == 0 {
+		message := &pb.RequestMessage{}
+		if err := decodeMessage(data, message, config.Handler.MaxWireBytes); err != nil {
+			return nil, fmt.Errorf("反序列化失败: %w", err)
+		}
+		wire = &pb.WireEnvelope{Payload: message}
+	}
+	if wire.GetPayload() == nil {
+		return nil, fmt.Errorf("版本 %d 的信封没有内容", wire.GetVersion())
+	}
+	metrics.Inc("wire_envelope_total", "kind", "mq", "version", strconv.FormatUint(uint64(wire.GetVersion()), 10))
+	return wire, nil
+}
+
+// EncodeStored 将写入会话历史的报文编码为字节，与 EncodeWire 一样在 WireEnvelopeEmit 关闭时输出旧的裸 ResponseMessage
+func EncodeStored(message *pb.ResponseMessage) ([]byte, error) {
+	if !config.Handler.WireEnvelopeEmit {
+		return proto.Marshal(message)
+	}
+	return proto.Marshal(&pb.WireEnvelope{
+		Version: wireVersion,
+		Stored:  message,
+		SentTs:  time.Now().UnixMilli(),
+		Origin:  identity.ContainerID(),
+	})
+}
+
+// DecodeStored 解析会话历史中的报文，兼容旧的裸 ResponseMessage。历史保留期内新旧格式会同时存在
+func DecodeStored(data []byte) (*pb.ResponseMessage, error) {
+	wire := &pb.WireEnvelope{}
+	if err := decodeMessage(data, wire, config.Handler.MaxWireBytes); err != nil {
+		return nil, fmt.Errorf("反序列化失败: %w", err)
+	}
+	metrics.Inc("wire_envelope_total", "kind", "stored", "version", strconv.FormatUint(uint64(wire.GetVersion()), 10))
+	if wire.GetVersion() == 0 {
+		message := &pb.ResponseMessage{}
+		if err := decodeMessage(data, message, config.Handler.MaxWireBytes); err != nil {
+			return nil, fmt.Errorf("反序列化失败: %w", err)
+		}
+		return message, nil
+	}
+	if wire.GetStored() == nil {
+		return nil, fmt.Errorf("版本 %d 的信封没有内容", wire.GetVersion())
+	}
+	return wire.GetStored(), nil
+}
+
+// publishRequest 编码后发布到目标topic
+func publishRequest(ctx context.Context, base *pb.WireEnvelope, message *pb.RequestMessage, topic string) error {
+	data, err := EncodeWire(base, message)
+	if err != nil {
+		return fmt.Errorf("报文序列化失败: %w", err)
+	}
+	return publishMessage(ctx, data, topic)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	pb "Betterfly2/proto/data_forwarding"
+	"bytes"
+	"data_forwarding_service/config"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func sampleRequest() *pb.RequestMessage {
+	return &pb.RequestMessage{Payload: &pb.RequestMessage_Echo{Echo: &pb.EchoReq{Body: []byte("hi")}}}
+}
+
+func sampleStored() *pb.ResponseMessage {
+	return &pb.ResponseMessage{Payload: &pb.ResponseMessage_Echo{Echo: &pb.EchoRsp{Body: []byte("hi")}}, Seq: 3}
+}
+
+// 旧版本生产者只会输出裸报文，旧版本消费者只会按裸报文解析
+func TestWireCompatMatrix(t *testing.T) {
+	oldProducer := func() []byte {
+		data, _ := proto.Marshal(sampleRequest())
+		return data
+	}
+	newProducer := func(emit bool) []byte {
+		withConfig(t, func(cfg *config.HandlerConfig) { cfg.WireEnvelopeEmit = emit })
+		data, err := EncodeWire(nil, sampleRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	oldConsumer := func(data []byte) *pb.RequestMessage {
+		message := &pb.RequestMessage{}
+		if err := proto.Unmarshal(data, message); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	newConsumer := func(data []byte) (*pb.RequestMessage, uint32) {
+		wire, err := DecodeWire(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wire.GetPayload(), wire.GetVersion()
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"旧生产者", oldProducer()},
+		{"新生产者(未开启信封)", newProducer(false)},
+	}
+	for _, c := range cases {
+		if got := oldConsumer(c.data); !proto.Equal(got, sampleRequest()) {
+			t.Errorf("%s -> 旧消费者: %v", c.name, got)
+		}
+		if got, version := newConsumer(c.data); !proto.Equal(got, sampleRequest()) || version != 0 {
+			t.Errorf("%s -> 新消费者: %v 版本 %d", c.name, got, version)
+		}
+	}
+
+	enveloped := newProducer(true)
+	if got, version := newConsumer(enveloped); !proto.Equal(got, sampleRequest()) || version != wireVersion {
+		t.Errorf("新生产者(开启信封) -> 新消费者: %v 版本 %d", got, version)
+	}
+	// 旧消费者读不到信封中的内容，因此所有容器升级之前不能开启 WireEnvelopeEmit
+	if got := oldConsumer(enveloped); got.GetPayload() != nil {
+		t.Errorf("新生产者(开启信封) -> 旧消费者 意外解析出内容: %v", got)
+	}
+}
+
+// 更新版本的信封带有本版本不认识的字段，转发时应原样保留
+func TestWireForwardPreservesUnknownFields(t *testing.T) {
+	withConfig(t, func(cfg *config.HandlerConfig) { cfg.WireEnvelopeEmit = true })
+	future, err := proto.Marshal(&pb.WireEnvelope{Version: wireVersion + 1, Payload: sampleRequest()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := protowire.AppendTag(nil, 3000, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 42)
+	future = append(future, unknown...)
+
+	wire, err := DecodeWire(future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(wire.GetPayload(), sampleRequest()) {
+		t.Fatalf("更新版本的信封内容不符: %v", wire.GetPayload())
+	}
+	forwarded, err := EncodeWire(wire, wire.GetPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DecodeWire(forwarded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(again.ProtoReflect().GetUnknown(), unknown) {
+		t.Fatal("转发后丢失了不认识的字段")
+	}
+}
+
+func TestStoredCompat(t *testing.T) {
+	legacy, _ := proto.Marshal(sampleStored())
+	for _, emit := range []bool{false, true} {
+		withConfig(t, func(cfg *config.HandlerConfig) { cfg.WireEnvelopeEmit = emit })
+		data, err := EncodeStored(sampleStored())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, input := range map[string][]byte{"旧格式": legacy, "新格式": data} {
+			got, err := DecodeStored(input)
+			if err != nil || !proto.Equal(got, sampleStored()) {
+				t.Errorf("开启信封=%v %s: %v %v", emit, name, got, err)
+			}
+		}
+		// 未开启信封时旧版本仍能读取新版本写入的历史
+		if !emit {
+			old := &pb.ResponseMessage{}
+			if err := proto.Unmarshal(data, old); err != nil || !proto.Equal(old, sampleStored()) {
+				t.Errorf("旧版本无法读取未开启信封时写入的历史: %v %v", old, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package i18n 系统文本的翻译表。表格以 locales/<语言>.json 嵌入，新增语言只需添加表格文件
+package i18n
+
+import (
+	"Betterfly2/shared/logger"
+	"data_forwarding_service/config"
+	"embed"
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+//go:embed locales/*.json
+var tableFS embed.FS
+
+// tables {语言: {key: 文本}}
+var tables = loadTables()
+
+func loadTables() map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	entries, err := tableFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := tableFS.ReadFile("locales/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		table := make(map[string]string)
+		if err := json.Unmarshal(data, &table); err != nil {
+			panic("翻译表 " + entry.Name() + " 格式错误: " + err.Error())
+		}
+		result[Normalize(strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())))] = table
+	}
+	return result
+}
+
+// Normalize 统一语言标签的写法，如 zh_CN 转为 zh-cn
+func Normalize(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// DefaultLocale 翻译缺失时回退的语言
+func DefaultLocale() string {
+	return Normalize(config.Handler.DefaultLocale)
+}
+
+// Match 在候选语言中查找与 locale 最匹配的一个：先完全匹配，再按主语言(如 zh-cn 取 zh)匹配
+func Match[V any](candidates map[string]V, locale string) (string, V, bool) {
+	locale = Normalize(locale)
+	if v, ok := candidates[locale]; ok {
+		return locale, v, true
+	}
+	if base, _, ok := strings.Cut(locale, "-"); ok {
+		if v, ok := candidates[base]; ok {
+			return base, v, true
+		}
+	}
+	var zero V
+	return "", zero, false
+}
+
+// Supported 客户端声明的语言是否有对应的翻译表
+func Supported(locale string) bool {
+	_, _, ok := Match(tables, locale)
+	return ok
+}
+
+// Resolve 按 locale 解析 key 并替换 {参数}，返回文本与实际使用的语言。
+// 依次尝试客户端语言与默认语言；key 形如 a.b 且找不到时退回 a；都找不到时返回 key 本身，不会返回空文本
+func Resolve(locale string, key string, params map[string]string) (string, string) {
+	for _, candidate := range []string{locale, DefaultLocale()} {
+		name, table, ok := Match(tables, candidate)
+		if !ok {
+			continue
+		}
+		for k := key; k != ""; {
+			if text, ok := table[k]; ok && text != "" {
+				return format(text, params), name
+			}
+			i := strings.LastIndex(k, ".")
+			if i < 0 {
+				break
+			}
+			k = k[:i]
+		}
+	}
+	logger.Sugar().Warnf("翻译表中没有 %s，使用原始key", key)
+	return key, ""
+}
+
+// format 将文本中的 {name} 替换为参数值，未提供的参数保持原样
+func format(text string, params map[string]string) string {
+	if len(params) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, len(params)*2)
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
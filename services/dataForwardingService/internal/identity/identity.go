@@ -0,0 +1,229 @@
+package identity
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"crypto/rand"
+	redisClient "data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/redis/keys"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 容器ID同时用作消息队列的topic名，只允许topic合法的字符
+var validID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,200}$`)
+
+const (
+	claimTTL          = 30 * time.Second
+	heartbeatInterval = 10 * time.Second
+)
+
+var (
+	containerID string
+	region      string // 本容器所在区域，为空表示未启用多区域
+	instanceID  string // 本进程的随机标识，用于区分同名容器
+	stopChan    chan struct{}
+
+	regionCache sync.Map // {容器ID: 区域}，容器的区域在其生命周期内不变
+)
+
+// ContainerID 返回启动时解析并校验过的容器ID，必须在 Init 之后调用
+func ContainerID() string {
+	return containerID
+}
+
+// Region 返回本容器所在区域(环境变量 REGION)，未配置时为空
+func Region() string {
+	return region
+}
+
+// RegionOf 查询容器所在区域，未登记区域的容器视为与本容器同一区域
+func RegionOf(ctx context.Context, id string) (string, error) {
+	if id == containerID {
+		return region, nil
+	}
+	if r, ok := regionCache.Load(id); ok {
+		return r.(string), nil
+	}
+	r, err := redisClient.Rdb.Get(ctx, keys.ContainerRegionKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		// 可能是尚未登记区域的旧容器，不缓存以便其登记后生效
+		return region, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	regionCache.Store(id, r)
+	return r, nil
+}
+
+// Init 解析容器ID(环境变量 HOSTNAME -> 系统主机名 -> 本地文件中持久化的随机ID)，
+// 并在redis中登记以保证唯一，已有存活的同名容器时返回错误
+func Init() error {
+	id, err := resolve()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	instanceID = hex.EncodeToString(buf)
+
+	ok, err := redisClient.Rdb.SetNX(context.Background(), keys.ContainerIdentityKey(id), instanceID, claimTTL).Result()
+	if err != nil {
+		return fmt.Errorf("登记容器ID失败: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("容器ID %s 已被其他存活容器使用", id)
+	}
+	containerID = id
+	if r := os.Getenv("REGION"); r != "" {
+		if region, err = checkID(r); err != nil {
+			return fmt.Errorf("区域名非法: %w", err)
+		}
+		if err := redisClient.Rdb.Set(context.Background(), keys.ContainerRegionKey(id), region, claimTTL).Err(); err != nil {
+			return fmt.Errorf("登记容器区域失败: %w", err)
+		}
+	}
+	stopChan = make(chan struct{})
+	go heartbeat(stopChan)
+	logger.Sugar().Infof("容器ID: %s，区域: %s", id, region)
+	return nil
+}
+
+// Release 停止心跳并释放容器ID的登记
+func Release() {
+	if stopChan == nil {
+		return
+	}
+	close(stopChan)
+	releaseScript.Run(context.Background(), redisClient.Rdb, []string{keys.ContainerIdentityKey(containerID)}, instanceID)
+}
+
+// ListContainers 列出当前所有存活容器的ID(包括本容器)
+func ListContainers(ctx context.Context) ([]string, error) {
+	iter := redisClient.Rdb.Scan(ctx, 0, keys.ContainerIdentityKey("*"), 100).Iterator()
+	var ids []string
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), keys.ContainerIdentityKey("")))
+	}
+	return ids, iter.Err()
+}
+
+// IsAlive 容器是否存活(其容器ID登记尚未过期)
+func IsAlive(ctx context.Context, id string) (bool, error) {
+	n, err := redisClient.Rdb.Exists(ctx, keys.ContainerIdentityKey(id)).Result()
+	return n == 1, err
+}
+
+// Check 检查容器ID的唯一性：已 Init 的进程确认登记仍属于本进程；
+// 尚未启动时解析容器ID并确认没有存活的同名容器，不写入登记
+func Check(ctx context.Context) (string, error) {
+	if containerID != "" {
+		owner, err := redisClient.Rdb.Get(ctx, keys.ContainerIdentityKey(containerID)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return containerID, err
+		}
+		if owner != instanceID {
+			return containerID, fmt.Errorf("容器ID %s 的登记已不属于本进程", containerID)
+		}
+		return containerID, nil
+	}
+	id, err := resolve()
+	if err != nil {
+		return "", err
+	}
+	alive, err := IsAlive(ctx, id)
+	if err != nil {
+		return id, err
+	}
+	if alive {
+		return id, fmt.Errorf("容器ID %s 已被其他存活容器使用", id)
+	}
+	return id, nil
+}
+
+// resolve 按优先级解析容器ID
+func resolve() (string, error) {
+	if id := os.Getenv("HOSTNAME"); id != "" {
+		return checkID(id)
+	}
+	if id, err := os.Hostname(); err == nil && id != "" {
+		return checkID(id)
+	}
+
+	path := os.Getenv("IDENTITY_FILE")
+	if path == "" {
+		path = "./container_id"
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		return checkID(strings.TrimSpace(string(data)))
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := "df-" + hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("保存容器ID失败: %w", err)
+	}
+	return id, nil
+}
+
+func checkID(id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", fmt.Errorf("容器ID非法: %q", id)
+	}
+	return id, nil
+}
+
+// 只有登记仍属于本进程时才续期/释放
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// heartbeat 定期续期容器ID的登记，stop 关闭后退出
+func heartbeat(stop <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			res, err := renewScript.Run(context.Background(), redisClient.Rdb, []string{keys.ContainerIdentityKey(containerID)}, instanceID, claimTTL.Milliseconds()).Int()
+			if err != nil {
+				logger.Sugar().Warnf("容器ID心跳失败: %v", err)
+				continue
+			}
+			if region != "" {
+				redisClient.Rdb.Set(context.Background(), keys.ContainerRegionKey(containerID), region, claimTTL)
+			}
+			if res == 0 {
+				// 登记已过期或被他人占用，尝试重新登记
+				ok, err := redisClient.Rdb.SetNX(context.Background(), keys.ContainerIdentityKey(containerID), instanceID, claimTTL).Result()
+				if err != nil {
+					logger.Sugar().Errorf("容器ID %s 的登记已丢失，重新登记失败: %v", containerID, err)
+				} else if !ok {
+					logger.Sugar().Errorf("容器ID %s 已被其他容器占用", containerID)
+				}
+			}
+		}
+	}
+}
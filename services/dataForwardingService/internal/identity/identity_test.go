@@ -0,0 +1,80 @@
+package identity
+
+import (
+	redisClient "data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+// withContainer 将redis替换为miniredis并以 id 作为容器ID，测试结束时释放登记、恢复全局状态
+func withContainer(t *testing.T, id string) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := redisClient.Rdb
+	redisClient.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		redisClient.Rdb.Close()
+		redisClient.Rdb = saved
+	})
+	t.Setenv("HOSTNAME", id)
+	t.Setenv("REGION", "")
+	t.Cleanup(func() {
+		Release()
+		containerID, region, instanceID, stopChan = "", "", "", nil
+	})
+	return mr
+}
+
+func TestInitClaimsContainerID(t *testing.T) {
+	mr := withContainer(t, "df-1")
+	if err := Init(); err != nil {
+		t.Fatalf("登记容器ID失败: %v", err)
+	}
+	if got := ContainerID(); got != "df-1" {
+		t.Fatalf("容器ID为 %q，期望 df-1", got)
+	}
+	owner, err := mr.Get(keys.ContainerIdentityKey("df-1"))
+	if err != nil || owner != instanceID {
+		t.Fatalf("登记的所有者为 %q(%v)，期望本进程 %q", owner, err, instanceID)
+	}
+	if ttl := mr.TTL(keys.ContainerIdentityKey("df-1")); ttl <= 0 || ttl > claimTTL {
+		t.Fatalf("登记的TTL为 %v，期望 (0, %v]", ttl, claimTTL)
+	}
+}
+
+// 同名容器的登记仍然存活时拒绝启动，不覆盖其登记
+func TestInitRefusesLiveDuplicate(t *testing.T) {
+	mr := withContainer(t, "df-1")
+	key := keys.ContainerIdentityKey("df-1")
+	mr.Set(key, "other")
+	mr.SetTTL(key, claimTTL)
+
+	if err := Init(); err == nil {
+		t.Fatal("同名容器存活时期望登记失败")
+	}
+	if got := ContainerID(); got != "" {
+		t.Fatalf("登记失败后容器ID为 %q，期望为空", got)
+	}
+	if owner, _ := mr.Get(key); owner != "other" {
+		t.Fatalf("存活容器的登记被改为 %q", owner)
+	}
+}
+
+// 同名容器停止续期、登记过期后可以接管
+func TestInitTakesOverExpiredClaim(t *testing.T) {
+	mr := withContainer(t, "df-1")
+	key := keys.ContainerIdentityKey("df-1")
+	mr.Set(key, "other")
+	mr.SetTTL(key, claimTTL)
+	mr.FastForward(claimTTL + time.Second)
+
+	if err := Init(); err != nil {
+		t.Fatalf("登记过期后期望接管，实际为 %v", err)
+	}
+	if owner, _ := mr.Get(key); owner != instanceID {
+		t.Fatalf("登记的所有者为 %q，期望本进程 %q", owner, instanceID)
+	}
+}
@@ -0,0 +1,158 @@
+package lifecycle
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultStopTimeout 组件未指定停止时限时使用的默认值
+const defaultStopTimeout = 10 * time.Second
+
+// Component 由生命周期管理器启动与停止的组件
+type Component struct {
+	Name      string
+	DependsOn []string // 依赖的组件，依赖全部启动后才启动本组件，本组件停止后才停止依赖
+	// Start 完成初始化后返回，后台协程应在 ctx 取消或 Stop 被调用时退出。
+	// 组件运行中出现无法恢复的错误时调用 fail，管理器随之关闭所有组件
+	Start func(ctx context.Context, fail func(error)) error
+	// Stop 停止组件，可以为空；ctx 在 StopTimeout 后取消
+	Stop        func(ctx context.Context) error
+	StopTimeout time.Duration
+}
+
+var (
+	components []Component
+	mu         sync.Mutex
+)
+
+// Register 注册组件，需在 Run 之前调用
+func Register(c ...Component) {
+	mu.Lock()
+	defer mu.Unlock()
+	components = append(components, c...)
+}
+
+// Run 按依赖顺序启动所有组件，收到 SIGINT/SIGTERM 或任一组件报告致命错误后按相反顺序停止，
+// 返回启动失败或导致退出的错误，正常收到信号退出时返回nil
+func Run() error {
+	sugar := logger.Sugar()
+	mu.Lock()
+	ordered, err := sortByDependency(components)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	fail := func(name string) func(error) {
+		return func(err error) {
+			cancel(fmt.Errorf("组件 %s 异常退出: %w", name, err))
+		}
+	}
+
+	started := make([]Component, 0, len(ordered))
+	for _, c := range ordered {
+		sugar.Infof("启动组件 %s", c.Name)
+		if err := c.Start(ctx, fail(c.Name)); err != nil {
+			cancel(nil)
+			stopAll(started)
+			return fmt.Errorf("组件 %s 启动失败: %w", c.Name, err)
+		}
+		started = append(started, c)
+	}
+	sugar.Infof("全部 %d 个组件已启动", len(started))
+
+	<-ctx.Done()
+	cause := context.Cause(ctx)
+	if errors.Is(cause, context.Canceled) {
+		sugar.Infoln("收到退出信号，开始关闭")
+		cause = nil
+	} else {
+		sugar.Errorf("开始关闭: %v", cause)
+	}
+	stopAll(started)
+	return cause
+}
+
+// stopAll 按启动的相反顺序停止组件，每个组件有独立的时限，超时的组件记录后继续停止下一个
+func stopAll(started []Component) {
+	sugar := logger.Sugar()
+	for i := len(started) - 1; i >= 0; i-- {
+		c := started[i]
+		if c.Stop == nil {
+			continue
+		}
+		timeout := c.StopTimeout
+		if timeout <= 0 {
+			timeout = defaultStopTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			done <- c.Stop(ctx)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				sugar.Warnf("组件 %s 停止出错(耗时 %v): %v", c.Name, time.Since(start), err)
+			} else {
+				sugar.Infof("组件 %s 已停止(耗时 %v)", c.Name, time.Since(start))
+			}
+		case <-ctx.Done():
+			sugar.Errorf("组件 %s 在 %v 内未停止，跳过", c.Name, timeout)
+		}
+		cancel()
+	}
+}
+
+// sortByDependency 拓扑排序，依赖关系之外保持注册顺序
+func sortByDependency(list []Component) ([]Component, error) {
+	byName := make(map[string]bool, len(list))
+	for _, c := range list {
+		if byName[c.Name] {
+			return nil, fmt.Errorf("组件 %s 重复注册", c.Name)
+		}
+		byName[c.Name] = true
+	}
+	for _, c := range list {
+		for _, dep := range c.DependsOn {
+			if !byName[dep] {
+				return nil, fmt.Errorf("组件 %s 依赖的 %s 未注册", c.Name, dep)
+			}
+		}
+	}
+
+	ordered := make([]Component, 0, len(list))
+	placed := make(map[string]bool, len(list))
+	for len(ordered) < len(list) {
+		progress := false
+		for _, c := range list {
+			if placed[c.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range c.DependsOn {
+				ready = ready && placed[dep]
+			}
+			if ready {
+				ordered = append(ordered, c)
+				placed[c.Name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, errors.New("组件之间存在循环依赖")
+		}
+	}
+	return ordered, nil
+}
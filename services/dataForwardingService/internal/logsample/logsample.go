@@ -0,0 +1,43 @@
+// Package logsample 高频日志(每条消息、每次登录)的采样。调用方先询问 Allow，
+// 只在需要输出时才格式化参数，避免被丢弃的日志也要把 protobuf 消息转成字符串
+package logsample
+
+import (
+	"data_forwarding_service/config"
+	"sync"
+	"sync/atomic"
+)
+
+// 日志类别，LOG_SAMPLE_RATES 中按类别配置采样率
+const (
+	Message    = "message"    // 每条客户端报文
+	Login      = "login"      // 登录、注册的处理结果
+	Connection = "connection" // 连接建立时的握手详情
+	Consume    = "consume"    // 消费者收到的每条报文
+)
+
+var counters sync.Map // {类别: *atomic.Uint64}
+
+// every 类别的采样率：每 every 条输出1条，未配置时使用 LogSampleEvery
+func every(kind string) uint64 {
+	if n, ok := config.Handler.LogSampleRates[kind]; ok {
+		return uint64(n)
+	}
+	return uint64(max(config.Handler.LogSampleEvery, 1))
+}
+
+// Allow 这条日志是否应输出：err 非nil时总是输出，否则按类别的采样率每N条输出1条
+func Allow(kind string, err error) bool {
+	if err != nil {
+		return true
+	}
+	n := every(kind)
+	if n <= 1 {
+		return true
+	}
+	counter, ok := counters.Load(kind)
+	if !ok {
+		counter, _ = counters.LoadOrStore(kind, new(atomic.Uint64))
+	}
+	return counter.(*atomic.Uint64).Add(1)%n == 1
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets 默认直方图分桶(毫秒)
+var DefaultBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// SizeBuckets 字节数直方图分桶，64B 到 4MB 按2的幂划分
+var SizeBuckets = []float64{64, 128, 256, 512, 1 << 10, 2 << 10, 4 << 10, 8 << 10, 16 << 10, 32 << 10, 64 << 10, 128 << 10, 256 << 10, 512 << 10, 1 << 20, 4 << 20}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+var (
+	mu         sync.Mutex
+	counters   = make(map[string]map[string]float64) // {指标名: {标签串: 值}}
+	gauges     = make(map[string]map[string]float64)
+	histograms = make(map[string]map[string]*histogram)
+)
+
+// labelString 将 k1, v1, k2, v2 形式的标签拼接为 Prometheus 标签串
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add 计数器增加 delta
+func Add(name string, delta float64, labels ...string) {
+	key := labelString(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	series, ok := counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		counters[name] = series
+	}
+	series[key] += delta
+}
+
+// Inc 计数器加一
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// SetGauge 设置仪表盘的值
+func SetGauge(name string, value float64, labels ...string) {
+	key := labelString(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	series, ok := gauges[name]
+	if !ok {
+		series = make(map[string]float64)
+		gauges[name] = series
+	}
+	series[key] = value
+}
+
+// AddGauge 仪表盘的值增加 delta，可为负数
+func AddGauge(name string, delta float64, labels ...string) {
+	key := labelString(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	series, ok := gauges[name]
+	if !ok {
+		series = make(map[string]float64)
+		gauges[name] = series
+	}
+	series[key] += delta
+}
+
+// Observe 向直方图记录一个观测值，使用 DefaultBuckets 分桶
+func Observe(name string, value float64, labels ...string) {
+	ObserveBuckets(name, DefaultBuckets, value, labels...)
+}
+
+// ObserveBuckets 向直方图记录一个观测值，分桶在该序列首次记录时确定，同名指标应使用相同的分桶
+func ObserveBuckets(name string, buckets []float64, value float64, labels ...string) {
+	key := labelString(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	series, ok := histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		histograms[name] = series
+	}
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+		series[key] = h
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// withLabel 在已有标签串中追加一个标签
+func withLabel(key string, name string, value string) string {
+	pair := fmt.Sprintf("%s=%q", name, value)
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出所有指标
+func WritePrometheus(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range sortedKeys(counters) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, key := range sortedKeys(counters[name]) {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, counters[name][key])
+		}
+	}
+	for _, name := range sortedKeys(gauges) {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, key := range sortedKeys(gauges[name]) {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, gauges[name][key])
+		}
+	}
+	for _, name := range sortedKeys(histograms) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, key := range sortedKeys(histograms[name]) {
+			h := histograms[name][key]
+			for i, bound := range h.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", fmt.Sprintf("%g", bound)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, key, h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+}
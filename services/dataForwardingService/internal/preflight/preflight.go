@@ -0,0 +1,182 @@
+// Package preflight 启动自检：配置、TLS证书、redis、消息队列与容器ID。
+// 部署时以 --check 运行，在首次登录之前发现证书不匹配、redis认证错误等配置问题；
+// 运行中的 /readyz?detail 复用同一组检查报告依赖状态
+package preflight
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"data_forwarding_service/config"
+	"data_forwarding_service/internal/identity"
+	"data_forwarding_service/internal/redis"
+	"data_forwarding_service/internal/topics"
+	"data_forwarding_service/internal/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/IBM/sarama"
+	"time"
+)
+
+// checkTimeout 单项检查的超时
+const checkTimeout = 10 * time.Second
+
+// Mode 自检的场景
+type Mode int
+
+const (
+	Startup Mode = iota // 启动前：自行连接redis，确认容器ID没有被存活容器占用
+	Live                // 运行中：使用已建立的redis连接，确认容器ID的登记仍属于本进程
+)
+
+// Check 单项检查的结果
+type Check struct {
+	Name      string         `json:"name"`
+	OK        bool           `json:"ok"`
+	Error     string         `json:"error,omitempty"`
+	Detail    map[string]any `json:"detail,omitempty"`
+	ElapsedMs int64          `json:"elapsed_ms"`
+}
+
+// Report 自检报告，任一检查失败时 OK 为false
+type Report struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks"`
+}
+
+// Run 依次执行所有检查。redis不可用时容器ID检查直接判定失败
+func Run(ctx context.Context, mode Mode) Report {
+	report := Report{OK: true}
+	run := func(name string, fn func(ctx context.Context) (map[string]any, error)) bool {
+		ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		defer cancel()
+		start := time.Now()
+		detail, err := fn(ctx)
+		check := Check{Name: name, OK: err == nil, Detail: detail, ElapsedMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			check.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, check)
+		return err == nil
+	}
+
+	run("config", checkConfig)
+	run("tls", checkTLS)
+	redisOK := run("redis", func(ctx context.Context) (map[string]any, error) {
+		return checkRedis(ctx, mode)
+	})
+	run("broker", checkBroker)
+	run("identity", func(ctx context.Context) (map[string]any, error) {
+		if !redisOK {
+			return nil, errors.New("redis 检查未通过，无法确认容器ID")
+		}
+		id, err := identity.Check(ctx)
+		return map[string]any{"container_id": id}, err
+	})
+	return report
+}
+
+func checkConfig(ctx context.Context) (map[string]any, error) {
+	errs := config.Handler.Validate()
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	problems := make([]string, len(errs))
+	for i, err := range errs {
+		problems[i] = err.Error()
+	}
+	return map[string]any{"problems": problems}, fmt.Errorf("配置有 %d 处错误", len(errs))
+}
+
+// checkTLS 加载证书与私钥(同时校验两者是否匹配)，报告证书剩余有效天数
+func checkTLS(ctx context.Context) (map[string]any, error) {
+	certFile, keyFile := config.CertFiles()
+	detail := map[string]any{"cert_path": certFile, "key_path": keyFile}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return detail, fmt.Errorf("加载证书失败: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return detail, fmt.Errorf("解析证书失败: %w", err)
+	}
+	remaining := time.Until(leaf.NotAfter)
+	detail["subject"] = leaf.Subject.String()
+	detail["not_after"] = leaf.NotAfter.Format(time.RFC3339)
+	detail["days_to_expiry"] = int(remaining.Hours() / 24)
+	if remaining <= 0 {
+		return detail, errors.New("证书已过期")
+	}
+	if time.Now().Before(leaf.NotBefore) {
+		return detail, errors.New("证书尚未生效")
+	}
+	return detail, nil
+}
+
+// checkRedis 确认redis可达且允许加载脚本，登录、分布式锁等依赖 Lua 脚本
+func checkRedis(ctx context.Context, mode Mode) (map[string]any, error) {
+	if mode == Startup {
+		if err := redisClient.InitRedis(); err != nil {
+			return nil, err
+		}
+	}
+	if err := redisClient.Rdb.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("连接 Redis 失败: %w", err)
+	}
+	sha, err := redisClient.Rdb.ScriptLoad(ctx, "return 1").Result()
+	if err != nil {
+		return nil, fmt.Errorf("加载脚本失败: %w", err)
+	}
+	return map[string]any{"addr": redisClient.Rdb.Options().Addr, "script_sha": sha}, nil
+}
+
+// checkBroker 连接消息队列并以 validateOnly 方式声明一个临时topic，确认有创建topic的权限且不留下任何topic
+func checkBroker(ctx context.Context) (map[string]any, error) {
+	brokers := utils.SplitBrokers(config.KafkaBrokers())
+	detail := map[string]any{"brokers": brokers}
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = sarama.V2_1_0_0
+	saramaConfig.Net.DialTimeout = checkTimeout
+	saramaConfig.Admin.Timeout = checkTimeout
+
+	type result struct {
+		detail map[string]any
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		admin, err := sarama.NewClusterAdmin(brokers, saramaConfig)
+		if err != nil {
+			done <- result{err: fmt.Errorf("连接消息队列失败: %w", err)}
+			return
+		}
+		defer admin.Close()
+		suffix := make([]byte, 6)
+		_, _ = rand.Read(suffix)
+		topic := topics.BuildContainerTopic("preflight-" + hex.EncodeToString(suffix))
+		err = admin.CreateTopic(topic, &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, true)
+		if err != nil {
+			done <- result{err: fmt.Errorf("声明临时topic %s 失败: %w", topic, err)}
+			return
+		}
+		members, _, err := admin.DescribeCluster()
+		if err != nil {
+			done <- result{err: fmt.Errorf("查询集群信息失败: %w", err)}
+			return
+		}
+		done <- result{detail: map[string]any{"topic": topic, "cluster_brokers": len(members)}}
+	}()
+	// sarama 的调用不接受 ctx，超时后放弃等待
+	select {
+	case r := <-done:
+		for k, v := range r.detail {
+			detail[k] = v
+		}
+		return detail, r.err
+	case <-ctx.Done():
+		return detail, fmt.Errorf("连接消息队列超时: %w", ctx.Err())
+	}
+}
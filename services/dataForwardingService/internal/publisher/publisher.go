@@ -2,12 +2,13 @@ package publisher
 
 import (
 	"Betterfly2/shared/logger"
+	"context"
 	"data_forwarding_service/config"
+	"data_forwarding_service/internal/metrics"
 	"data_forwarding_service/internal/utils"
 	"fmt"
 	"github.com/IBM/sarama"
 	"net"
-	"os"
 	"sync"
 	"time"
 )
@@ -42,17 +43,9 @@ func InitKafkaProducer() error {
 	initOnce.Do(func() {
 		sugar := logger.Sugar()
 
-		topic := os.Getenv("HOSTNAME")
-		broker := os.Getenv("KAFKA_BROKER")
-		if topic == "" {
-			topic = "message-topic"
-		}
-
-		if broker == "" {
-			broker = config.DefaultNsServer
-		}
+		broker := config.KafkaBrokers()
 
-		sugar.Infof("当前 Kafka Broker: %s, topic: %s", broker, topic)
+		sugar.Infof("当前 Kafka Broker: %s", broker)
 
 		saramaConfig := sarama.NewConfig()
 		saramaConfig.Producer.Return.Successes = true
@@ -80,8 +73,12 @@ func InitKafkaProducer() error {
 	return initErr
 }
 
-// PublishMessage 发布消息到 Kafka
-func PublishMessage(message string, targetTopic string) error {
+// PublishMessage 发布消息到 Kafka。
+// SyncProducer 无法中途取消：ctx 结束时只是放弃等待并返回错误，已提交给 sarama 的发送仍在后台继续，
+// 直到成功或用尽 sarama 自身的超时与重试(Producer.Timeout、Net.WriteTimeout、Producer.Retry)，
+// 因此返回超时错误时消息仍可能被成功发布，调用方重试会产生重复，接收方需按消息ID去重。
+// 放弃等待的次数计入 publish_abandoned_total
+func PublishMessage(ctx context.Context, message string, targetTopic string) error {
 	sugar := logger.Sugar()
 
 	if KafkaProducer == nil {
@@ -93,10 +90,30 @@ func PublishMessage(message string, targetTopic string) error {
 		Value: sarama.ByteEncoder(message),
 	}
 
-	partition, offset, err := KafkaProducer.SendMessage(msg)
-	if err != nil {
-		return fmt.Errorf("向 Kafka 发布消息失败: %v", err)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("向 Kafka 发布消息前已取消: %w", err)
+	}
+
+	type sendResult struct {
+		partition int32
+		offset    int64
+		err       error
+	}
+	done := make(chan sendResult, 1)
+	go func() {
+		partition, offset, err := KafkaProducer.SendMessage(msg)
+		done <- sendResult{partition, offset, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		metrics.Inc("publish_abandoned_total")
+		return fmt.Errorf("向 Kafka 发布消息超时: %w", ctx.Err())
+	case res := <-done:
+		if res.err != nil {
+			return fmt.Errorf("向 Kafka 发布消息失败: %v", res.err)
+		}
+		sugar.Infof("Kafka 消息发布成功 - Partition: %d, Offset: %d", res.partition, res.offset)
+		return nil
 	}
-	sugar.Infof("Kafka 消息发布成功 - Partition: %d, Offset: %d", partition, offset)
-	return nil
 }
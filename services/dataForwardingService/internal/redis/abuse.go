@@ -0,0 +1,60 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// RecordAbuseReport 在集群范围内记录用户的一次举报，window 内已举报 max 次时不记录，返回建议等待的时间
+func RecordAbuseReport(ctx context.Context, userID string, window time.Duration, max int) (time.Duration, error) {
+	now := time.Now()
+	member := strconv.FormatInt(now.UnixNano(), 36)
+	wait, err := loginRateScript.Run(ctx, Rdb, []string{keys.AbuseReportRateKey(userID)},
+		now.UnixMilli(), window.Milliseconds(), max, member).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// ClaimAbuseSubjects 将用户尚未举报过的对象登记为 reportID，ttl 内重复举报同一对象不再登记。
+// 返回新登记的对象，以及已登记对象中任意一个之前的举报ID
+func ClaimAbuseSubjects(ctx context.Context, userID string, subjects []string, reportID string, ttl time.Duration) (claimed []string, previous string, err error) {
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(subjects))
+	for i, subject := range subjects {
+		cmds[i] = pipe.SetNX(ctx, keys.AbuseReportDedupKey(userID, subject), reportID, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, "", err
+	}
+	for i, cmd := range cmds {
+		if cmd.Val() {
+			claimed = append(claimed, subjects[i])
+		} else if previous == "" {
+			previous, err = Rdb.Get(ctx, keys.AbuseReportDedupKey(userID, subjects[i])).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return nil, "", err
+			}
+		}
+	}
+	return claimed, previous, nil
+}
+
+// ReleaseAbuseSubjects 撤销举报对象的登记，举报写入失败时调用
+func ReleaseAbuseSubjects(ctx context.Context, userID string, subjects []string) error {
+	names := make([]string, len(subjects))
+	for i, subject := range subjects {
+		names[i] = keys.AbuseReportDedupKey(userID, subject)
+	}
+	return Rdb.Del(ctx, names...).Err()
+}
+
+// AppendAbuseReport 追加一份举报证据包，只保留最近约 maxLen 份，返回条目ID
+func AppendAbuseReport(ctx context.Context, report []byte, maxLen int64) (string, error) {
+	return AppendAuditEvent(ctx, keys.AbuseReportsKey(), report, maxLen)
+}
@@ -0,0 +1,25 @@
+package redisClient
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+)
+
+// AppendAuditEvent 追加一条审计记录到有界stream中，超过 maxLen 的旧记录会被裁剪
+func AppendAuditEvent(ctx context.Context, stream string, event []byte, maxLen int64) (string, error) {
+	return Rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: map[string]any{"event": event},
+	}).Result()
+}
+
+// ReadAuditEvents 从新到旧读取审计记录，before 为空时从最新一条开始，否则读取早于 before 的记录
+func ReadAuditEvents(ctx context.Context, stream string, before string, count int64) ([]redis.XMessage, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+	return Rdb.XRevRangeN(ctx, stream, end, "-", count).Result()
+}
@@ -0,0 +1,30 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// GetAvailability 读取缓存的可用性检查结果，kind 为 username 或 email，未缓存时ok为false
+func GetAvailability(ctx context.Context, kind string, value string) (taken bool, ok bool, err error) {
+	v, err := Rdb.Get(ctx, keys.AvailabilityKey(kind, value)).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return v == "1", true, nil
+}
+
+// CacheAvailability 缓存可用性检查结果
+func CacheAvailability(ctx context.Context, kind string, value string, taken bool, ttl time.Duration) error {
+	v := "0"
+	if taken {
+		v = "1"
+	}
+	return Rdb.Set(ctx, keys.AvailabilityKey(kind, value), v, ttl).Err()
+}
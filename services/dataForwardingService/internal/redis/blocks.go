@@ -0,0 +1,104 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+)
+
+// AddBlock 屏蔽用户，返回屏蔽后的屏蔽人数
+func AddBlock(ctx context.Context, id string, target string) (int64, error) {
+	pipe := Rdb.TxPipeline()
+	pipe.SAdd(ctx, keys.BlocksKey(id), target)
+	count := pipe.SCard(ctx, keys.BlocksKey(id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// RemoveBlock 取消屏蔽用户
+func RemoveBlock(ctx context.Context, id string, target string) error {
+	return Rdb.SRem(ctx, keys.BlocksKey(id), target).Err()
+}
+
+// CountBlocks 用户屏蔽的人数
+func CountBlocks(ctx context.Context, id string) (int64, error) {
+	return Rdb.SCard(ctx, keys.BlocksKey(id)).Result()
+}
+
+// GetBlocks 用户屏蔽的所有用户ID
+func GetBlocks(ctx context.Context, id string) ([]string, error) {
+	return Rdb.SMembers(ctx, keys.BlocksKey(id)).Result()
+}
+
+// IsBlocked 接收者是否屏蔽了发送者
+func IsBlocked(ctx context.Context, recipient string, sender string) (bool, error) {
+	return Rdb.SIsMember(ctx, keys.BlocksKey(recipient), sender).Result()
+}
+
+// BlockedBy 通过管道批量查询接收者是否屏蔽了发送者，只返回屏蔽了发送者的接收者
+func BlockedBy(ctx context.Context, recipients []string, sender string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	if len(recipients) == 0 {
+		return result, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(recipients))
+	for i, recipient := range recipients {
+		cmds[i] = pipe.SIsMember(ctx, keys.BlocksKey(recipient), sender)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if cmd.Val() {
+			result[recipients[i]] = true
+		}
+	}
+	return result, nil
+}
+
+// SetMute 为会话设置免打扰，until 为截止时刻(毫秒)，0表示一直免打扰
+func SetMute(ctx context.Context, id string, conv string, until int64) error {
+	return Rdb.HSet(ctx, keys.MutesKey(id), conv, until).Err()
+}
+
+// GetMute 读取会话的免打扰截止时刻，未设置时ok为false
+func GetMute(ctx context.Context, id string, conv string) (until int64, ok bool, err error) {
+	v, err := Rdb.HGet(ctx, keys.MutesKey(id), conv).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// GetMutes 用户所有设置过免打扰的会话 {会话: 截止时刻}，包括已到期的
+func GetMutes(ctx context.Context, id string) (map[string]int64, error) {
+	values, err := Rdb.HGetAll(ctx, keys.MutesKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	mutes := make(map[string]int64, len(values))
+	for conv, v := range values {
+		until, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		mutes[conv] = until
+	}
+	return mutes, nil
+}
+
+// ClearMutes 取消会话的免打扰，也用于清理已到期的设置
+func ClearMutes(ctx context.Context, id string, convs ...string) error {
+	if len(convs) == 0 {
+		return nil
+	}
+	return Rdb.HDel(ctx, keys.MutesKey(id), convs...).Err()
+}
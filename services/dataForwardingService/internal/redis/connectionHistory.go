@@ -0,0 +1,99 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// ConnectionRecord 一次连接的记录，登录时写入，断开时补填断开时刻与原因
+type ConnectionRecord struct {
+	ConnID         string `json:"conn_id"`
+	DeviceID       string `json:"device_id"`
+	Container      string `json:"container"`
+	RemoteIP       string `json:"remote_ip,omitempty"` // ConnectionHistoryIP 关闭时为空
+	Platform       string `json:"platform,omitempty"`  // 登录时声明的客户端类别
+	ConnectedAt    int64  `json:"connected_at_ms,omitempty"`
+	DisconnectedAt int64  `json:"disconnected_at_ms,omitempty"` // 为0表示连接仍存活或断开未能记录
+	CloseReason    string `json:"close_reason,omitempty"`
+}
+
+// 新记录插入列表头部后按条数裁剪，再从尾部删除早于 ARGV[3] 的记录，最后刷新整个列表的过期时间
+var appendConnectionScript = redis.NewScript(`
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+local cutoff = tonumber(ARGV[3])
+while true do
+	local last = redis.call('LINDEX', KEYS[1], -1)
+	if not last then
+		break
+	end
+	local ok, record = pcall(cjson.decode, last)
+	local at = 0
+	if ok and type(record) == 'table' then
+		at = tonumber(record.connected_at_ms or record.disconnected_at_ms) or 0
+	end
+	if at >= cutoff then
+		break
+	end
+	redis.call('RPOP', KEYS[1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// 找到 conn_id 相同的记录，补填断开时刻与原因，没有找到时返回0
+var closeConnectionScript = redis.NewScript(`
+local records = redis.call('LRANGE', KEYS[1], 0, -1)
+for i, raw in ipairs(records) do
+	local ok, record = pcall(cjson.decode, raw)
+	if ok and type(record) == 'table' and record.conn_id == ARGV[1] then
+		record.disconnected_at_ms = tonumber(ARGV[2])
+		record.close_reason = ARGV[3]
+		redis.call('LSET', KEYS[1], i - 1, cjson.encode(record))
+		return 1
+	end
+end
+return 0
+`)
+
+// AppendConnection 追加一条连接记录，只保留最近 maxLen 条且不早于 maxAge 的记录，最后一次写入 maxAge 后整个列表过期
+func AppendConnection(ctx context.Context, userID string, record ConnectionRecord, maxLen int, maxAge time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge).UnixMilli()
+	return appendConnectionScript.Run(ctx, Rdb, []string{keys.ConnectionHistoryKey(userID)},
+		data, maxLen, cutoff, maxAge.Milliseconds()).Err()
+}
+
+// CloseConnection 为连接记录补填断开时刻与原因，记录已被裁剪或登录时未能写入时返回false
+func CloseConnection(ctx context.Context, userID string, connID string, at time.Time, reason string) (bool, error) {
+	n, err := closeConnectionScript.Run(ctx, Rdb, []string{keys.ConnectionHistoryKey(userID)},
+		connID, at.UnixMilli(), reason).Int()
+	return n == 1, err
+}
+
+// ConnectionHistory 从新到旧读取从 offset 开始的 limit 条连接记录，无法解析的记录被跳过。
+// next 为下一页的 offset，没有更多记录时为0
+func ConnectionHistory(ctx context.Context, userID string, offset int, limit int) (records []ConnectionRecord, next int, err error) {
+	raw, err := Rdb.LRange(ctx, keys.ConnectionHistoryKey(userID), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	records = make([]ConnectionRecord, 0, len(raw))
+	for _, item := range raw {
+		var record ConnectionRecord
+		if err := json.Unmarshal([]byte(item), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(raw) == limit {
+		next = offset + limit
+	}
+	return records, next, nil
+}
@@ -0,0 +1,28 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// StoreVerifiedCredential 保存一次成功登录的校验结果
+func StoreVerifiedCredential(ctx context.Context, accountDigest string, fields map[string]string, ttl time.Duration) error {
+	pipe := Rdb.TxPipeline()
+	pipe.Del(ctx, keys.CredentialCacheKey(accountDigest))
+	pipe.HSet(ctx, keys.CredentialCacheKey(accountDigest), fields)
+	pipe.PExpire(ctx, keys.CredentialCacheKey(accountDigest), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetVerifiedCredential 读取校验结果，不存在时返回nil
+func GetVerifiedCredential(ctx context.Context, accountDigest string) (map[string]string, error) {
+	fields, err := Rdb.HGetAll(ctx, keys.CredentialCacheKey(accountDigest)).Result()
+	if errors.Is(err, redis.Nil) || len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, err
+}
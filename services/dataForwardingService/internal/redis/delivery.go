@@ -0,0 +1,35 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// ClaimDeliveryKey 占用接收者维度的投递去重键，已被占用(重复投递)时返回false
+func ClaimDeliveryKey(ctx context.Context, id string, dedupKey string, ttl time.Duration) (bool, error) {
+	return Rdb.SetNX(ctx, keys.DeliveryDedupKey(id, dedupKey), 1, ttl).Result()
+}
+
+// ReleaseDeliveryKey 释放 ClaimDeliveryKey 占用的去重键，投递失败后同一key的重试可以再次投递
+func ReleaseDeliveryKey(ctx context.Context, id string, dedupKey string) error {
+	return Rdb.Del(ctx, keys.DeliveryDedupKey(id, dedupKey)).Err()
+}
+
+// ClaimDeliveryKeys 批量为多个接收者占用同一个投递去重键，返回每个接收者是否首次投递
+func ClaimDeliveryKeys(ctx context.Context, ids []string, dedupKey string, ttl time.Duration) (map[string]bool, error) {
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.SetNX(ctx, keys.DeliveryDedupKey(id, dedupKey), 1, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(ids))
+	for i, cmd := range cmds {
+		result[ids[i]] = cmd.Val()
+	}
+	return result, nil
+}
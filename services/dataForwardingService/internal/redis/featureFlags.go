@@ -0,0 +1,43 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+)
+
+// FeatureRollout 功能开关的放量配置
+type FeatureRollout struct {
+	Percent int  // 按用户放量的百分比，0-100
+	Allowed bool // 用户是否在该开关的白名单中
+}
+
+// GetFeatureRollouts 读取所有功能开关的放量配置及用户是否在白名单中。
+// 开关保存在 hash feature_flags {开关名: 百分比}，白名单保存在 set feature_flag_allow:<开关名>
+func GetFeatureRollouts(ctx context.Context, userID string) (map[string]FeatureRollout, error) {
+	percents, err := Rdb.HGetAll(ctx, keys.FeatureFlagsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(percents) == 0 {
+		return nil, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make(map[string]*redis.BoolCmd, len(percents))
+	for name := range percents {
+		cmds[name] = pipe.SIsMember(ctx, keys.FeatureFlagAllowKey(name), userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result := make(map[string]FeatureRollout, len(percents))
+	for name, v := range percents {
+		percent, _ := strconv.Atoi(v)
+		result[name] = FeatureRollout{
+			Percent: percent,
+			Allowed: cmds[name].Val(),
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 会话历史保存在 history:{<会话>} stream 中，条目ID为 <会话序号>-0，便于按序号分页。
+// 跨容器并发时序号较小的消息可能晚到，此时无法再插入到前面，改为紧跟当前最后一条，序号仍记录在 seq 字段中
+var appendHistoryScript = redis.NewScript(`
+local ok = redis.pcall('XADD', KEYS[1], 'MAXLEN', '~', ARGV[4], ARGV[1] .. '-0', 'seq', ARGV[1], 'ts', ARGV[2], 'data', ARGV[3])
+if type(ok) == 'table' and ok.err then
+	local top = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+	if #top == 0 then
+		return redis.error_reply(ok.err)
+	end
+	local ms, n = string.match(top[1][1], '^(%d+)-(%d+)$')
+	redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[4], ms .. '-' .. (tonumber(n) + 1), 'seq', ARGV[1], 'ts', ARGV[2], 'data', ARGV[3])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// HistoryEntry 会话历史中的一条消息
+type HistoryEntry struct {
+	Seq      int64
+	ServerTs int64
+	Data     []byte
+	Position int64 // 在stream中的位置(条目ID的前半部分)，作为下一页的 beforeSeq，通常等于 Seq
+}
+
+// AppendHistory 追加一条会话历史，只保留最近约 maxLen 条，最后一次写入 ttl 后整个会话历史过期
+func AppendHistory(ctx context.Context, conversation string, entry HistoryEntry, maxLen int, ttl time.Duration) error {
+	return appendHistoryScript.Run(ctx, Rdb, []string{keys.HistoryKey(conversation)},
+		entry.Seq, entry.ServerTs, entry.Data, maxLen, ttl.Milliseconds()).Err()
+}
+
+// ReadHistory 按序号从新到旧读取会话历史，beforeSeq 为0时从最新一条开始，否则只返回序号小于它的消息
+func ReadHistory(ctx context.Context, conversation string, beforeSeq int64, limit int) ([]HistoryEntry, error) {
+	end := "+"
+	if beforeSeq > 0 {
+		if beforeSeq == 1 {
+			return nil, nil
+		}
+		end = strconv.FormatInt(beforeSeq-1, 10)
+	}
+	messages, err := Rdb.XRevRangeN(ctx, keys.HistoryKey(conversation), end, "-", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(messages))
+	for _, message := range messages {
+		entry := HistoryEntry{}
+		position, _, _ := strings.Cut(message.ID, "-")
+		entry.Position, _ = strconv.ParseInt(position, 10, 64)
+		entry.Seq, _ = strconv.ParseInt(toString(message.Values["seq"]), 10, 64)
+		entry.ServerTs, _ = strconv.ParseInt(toString(message.Values["ts"]), 10, 64)
+		entry.Data = []byte(toString(message.Values["data"]))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func toString(v any) string {
+	s, _ := v.(string)
+	return s
+}
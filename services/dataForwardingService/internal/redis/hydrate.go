@@ -0,0 +1,70 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// hydrateLoginScript 登录后一次往返完成：保存恢复令牌ID、读取设备订阅的事件类别、用户指定的投递流水线、
+// 功能开关放量配置及用户是否在各开关白名单中。
+// KEYS[1] 恢复令牌键，KEYS[2] 功能开关键，KEYS[3] 事件订阅键，KEYS[4] 流水线指定键；ARGV[1] 令牌ID，ARGV[2] 令牌有效期(毫秒)，
+// ARGV[3] 用户ID，ARGV[4] 白名单键前缀，ARGV[5] 设备ID。
+// 返回 [是否设置过订阅, 订阅, 指定的流水线, 开关名, 百分比, 是否在白名单, ...]
+var hydrateLoginScript = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+local subscriptions = redis.call('HGET', KEYS[3], ARGV[5])
+local pipeline = redis.call('HGET', KEYS[4], ARGV[3])
+local flags = redis.call('HGETALL', KEYS[2])
+local result = {subscriptions and 1 or 0, subscriptions or '', pipeline or ''}
+for i = 1, #flags, 2 do
+	result[#result + 1] = flags[i]
+	result[#result + 1] = flags[i + 1]
+	result[#result + 1] = redis.call('SISMEMBER', ARGV[4] .. flags[i], ARGV[3])
+end
+return result
+`)
+
+// LoginState 登录后一次性读取的用户状态
+type LoginState struct {
+	Rollouts         map[string]FeatureRollout
+	Subscriptions    string // 设备订阅的事件类别，见 GetSubscriptions
+	HasSubscriptions bool
+	PipelinePin      string // 管理员指定的投递流水线变体，为空表示未指定
+}
+
+// HydrateLogin 保存设备的恢复令牌ID并读取登录后所需的用户状态，redis只往返一次
+func HydrateLogin(ctx context.Context, id string, deviceID string, tokenID string, ttl time.Duration) (*LoginState, error) {
+	values, err := hydrateLoginScript.Run(ctx, Rdb,
+		[]string{keys.ResumeTokenKey(DeviceKey(id, deviceID)), keys.FeatureFlagsKey(), keys.SubscriptionsKey(id), keys.PipelinePinsKey()},
+		tokenID, ttl.Milliseconds(), id, keys.FeatureFlagAllowPrefix(), deviceID).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 3 || (len(values)-3)%3 != 0 {
+		return nil, fmt.Errorf("登录状态返回值个数异常: %d", len(values))
+	}
+	state := &LoginState{}
+	hasSubscriptions, _ := values[0].(int64)
+	state.HasSubscriptions = hasSubscriptions == 1
+	state.Subscriptions, _ = values[1].(string)
+	state.PipelinePin, _ = values[2].(string)
+	values = values[3:]
+	if len(values) > 0 {
+		state.Rollouts = make(map[string]FeatureRollout, len(values)/3)
+	}
+	for i := 0; i < len(values); i += 3 {
+		name, _ := values[i].(string)
+		percentText, _ := values[i+1].(string)
+		allowed, _ := values[i+2].(int64)
+		percent, _ := strconv.Atoi(percentText)
+		state.Rollouts[name] = FeatureRollout{
+			Percent: percent,
+			Allowed: allowed == 1,
+		}
+	}
+	return state, nil
+}
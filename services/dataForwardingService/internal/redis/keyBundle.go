@@ -0,0 +1,82 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+)
+
+// 上传结果
+const (
+	KeyBundleStored      = 1
+	KeyBundleStale       = 0
+	KeyBundleTooManyDevs = -1
+)
+
+// 版本号比较与写入需原子完成，否则并发上传可能用旧版本覆盖新版本。
+// 新版本的一次性预密钥整体替换旧版本剩余的预密钥，ARGV[5] 起为预密钥
+var storeKeyBundleScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if cur and tonumber(cur) >= tonumber(ARGV[2]) then
+	return 0
+end
+if not cur and redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[4]) then
+	return -1
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('DEL', KEYS[3])
+if #ARGV > 4 then
+	redis.call('RPUSH', KEYS[3], unpack(ARGV, 5))
+end
+return 1
+`)
+
+// StoreKeyBundle 保存设备公钥包，version 必须大于已保存的版本。bundle 不含一次性预密钥，预密钥单独保存，获取时逐个取出
+func StoreKeyBundle(ctx context.Context, id string, deviceID string, version int64, bundle []byte, prekeys [][]byte, maxDevices int) (int, error) {
+	keys := []string{keys.KeyBundleVersionsKey(id), keys.KeyBundlesKey(id), keys.KeyBundlePrekeysKey(DeviceKey(id, deviceID))}
+	args := make([]any, 0, 4+len(prekeys))
+	args = append(args, deviceID, version, bundle, maxDevices)
+	for _, prekey := range prekeys {
+		args = append(args, prekey)
+	}
+	res, err := storeKeyBundleScript.Run(ctx, Rdb, keys, args...).Int()
+	if err != nil {
+		return 0, fmt.Errorf("保存公钥包失败: %w", err)
+	}
+	return res, nil
+}
+
+// 读取所有设备的公钥包并为每个设备取出一个一次性预密钥，返回 [设备ID, 公钥包, 预密钥(已用完时为空), ...]。
+// 预密钥列表键由 ARGV[1] 前缀与设备ID拼接
+var fetchKeyBundlesScript = redis.NewScript(`
+local stored = redis.call('HGETALL', KEYS[1])
+local result = {}
+for i = 1, #stored, 2 do
+	result[#result + 1] = stored[i]
+	result[#result + 1] = stored[i + 1]
+	result[#result + 1] = redis.call('LPOP', ARGV[1] .. stored[i]) or ''
+end
+return result
+`)
+
+// StoredKeyBundle 设备的公钥包与本次取出的一次性预密钥
+type StoredKeyBundle struct {
+	Bundle        string // 序列化后的公钥包，不含一次性预密钥
+	OneTimePrekey string // 已用完时为空
+}
+
+// GetKeyBundles 获取用户所有设备的公钥包，返回 {设备ID: 公钥包}。每个设备的一次性预密钥在同一脚本中取出，
+// 并发的获取方不会拿到同一个预密钥
+func GetKeyBundles(ctx context.Context, id string) (map[string]StoredKeyBundle, error) {
+	res, err := fetchKeyBundlesScript.Run(ctx, Rdb, []string{keys.KeyBundlesKey(id)}, keys.KeyBundlePrekeysKey(DeviceKey(id, ""))).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	bundles := make(map[string]StoredKeyBundle, len(res)/3)
+	for i := 0; i+2 < len(res); i += 3 {
+		bundles[res[i]] = StoredKeyBundle{Bundle: res[i+1], OneTimePrekey: res[i+2]}
+	}
+	return bundles, nil
+}
@@ -0,0 +1,63 @@
+package redisClient
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestGetKeyBundlesHandsOutEachPrekeyOnce(t *testing.T) {
+	withMiniredis(t)
+	ctx := context.Background()
+	prekeys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if res, err := StoreKeyBundle(ctx, "1", "phone", 1, []byte("bundle"), prekeys, 4); err != nil || res != KeyBundleStored {
+		t.Fatalf("保存公钥包失败: %v %v", res, err)
+	}
+
+	var (
+		mu     sync.Mutex
+		handed []string
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bundles, err := GetKeyBundles(ctx, "1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			entry := bundles["phone"]
+			if entry.Bundle != "bundle" {
+				t.Errorf("公钥包内容不符: %q", entry.Bundle)
+			}
+			if entry.OneTimePrekey != "" {
+				mu.Lock()
+				handed = append(handed, entry.OneTimePrekey)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(handed)
+	if len(handed) != 3 || handed[0] != "a" || handed[1] != "b" || handed[2] != "c" {
+		t.Fatalf("每个一次性预密钥应恰好分发一次，实际为 %q", handed)
+	}
+
+	// 新版本整体替换剩余的预密钥，旧版本不能覆盖
+	if res, _ := StoreKeyBundle(ctx, "1", "phone", 2, []byte("bundle2"), [][]byte{[]byte("d")}, 4); res != KeyBundleStored {
+		t.Fatalf("新版本未保存: %v", res)
+	}
+	if res, _ := StoreKeyBundle(ctx, "1", "phone", 1, []byte("old"), [][]byte{[]byte("x")}, 4); res != KeyBundleStale {
+		t.Fatalf("旧版本应被拒绝: %v", res)
+	}
+	bundles, err := GetKeyBundles(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := bundles["phone"]; entry.Bundle != "bundle2" || entry.OneTimePrekey != "d" {
+		t.Fatalf("期望新版本与其预密钥，实际为 %+v", entry)
+	}
+}
@@ -0,0 +1,357 @@
+// Package keys redis键的命名。所有键都加上按环境/集群配置的前缀 <RedisKeyPrefix>:，
+// 共用同一个redis的不同部署互不串扰；调用方不应自行拼接键名。
+//
+// 键的结构(省略前缀)：
+//
+//	user_devices:<用户ID>                      hash {设备ID: 容器ID}，设备登记
+//	ws_connection_mapping                      hash {用户ID: 容器ID}，旧版本不区分设备的登记，滚动升级期间双写双读
+//	container_connections:<容器ID>             set  {<用户ID>#<设备ID>}，容器上登记的连接
+//	transition:<用户ID>                        hash {设备ID: 新容器ID}，登录切换中的设备，带过期时间
+//	container_identity:<容器ID>                string 持有该容器ID的实例，带过期时间
+//	container_region:<容器ID>                  string 容器所在区域
+//	draining_containers                        set  正在排空的容器
+//	container_load:<容器ID>                    hash 容器的连接数与对外地址，带过期时间
+//	resume_token:<用户ID>#<设备ID>             string 设备当前有效的恢复令牌ID
+//	connect_token:<令牌ID>                     string 已使用的连接授权令牌，保留到令牌过期
+//	login_rate:<用户ID>#<设备ID>               zset 滑动窗口内的登录时间，用于登录抑制
+//	user_seq:<用户ID>                          string 用户消息序号
+//	conv_seq:{<会话>}                          string 会话消息序号
+//	history:{<会话>}                           stream 会话历史
+//	thread:<会话>:<根消息ID>                   hash 话题回复摘要
+//	reactions:<会话>:<消息ID>:users|counts     set/hash 表情回应
+//	delivery_dedup:<用户ID>:<去重键>           string 投递去重标记
+//	subscriptions:<用户ID>                     hash {设备ID: 订阅的事件类别，逗号分隔}
+//	key_bundles:<用户ID>                       hash {设备ID: 公钥包}
+//	key_bundle_versions:<用户ID>               hash {设备ID: 版本}
+//	key_bundle_prekeys:<用户ID>#<设备ID>       list 设备尚未分发的一次性预密钥，每次获取取出一个
+//	known_devices:<用户ID>                     hash {设备ID: <首次登录时刻>:<最近登录时刻>(毫秒)}，按最近登录淘汰
+//	credential_cache:<账号摘要>                string 降级登录使用的凭据缓存
+//	two_factor:<挑战ID>                        hash 二次验证挑战
+//	totp_secret:<用户ID>                       string TOTP密钥
+//	feature_flags                              hash {开关名: 百分比}
+//	feature_flag_allow:<开关名>                set  开关白名单
+//	pipeline_pins                              hash {用户ID: 流水线变体}，管理员指定的投递流水线
+//	blocks:<用户ID>                            set  屏蔽的用户ID
+//	mutes:<用户ID>                             hash {会话: 免打扰截止时刻(毫秒)，0为一直}
+//	receipts:<用户ID>                          hash {消息序号: 待确认的回执请求}
+//	receipt_deadlines                          zset {<用户ID>#<消息序号>: 回执过期时刻(毫秒)}
+//	abuse_report_rate:<用户ID>                 zset 滑动窗口内的举报时间
+//	abuse_report_dedup:<用户ID>:<举报对象>     string 已举报过的消息或用户，值为举报ID
+//	abuse_reports                              stream 举报证据包
+//	offline:<用户ID>                           stream 离线消息与删除标记，只追加
+//	offline_released:<用户ID>                  set  已移出保存用量但仍在离线stream中的条目ID
+//	offline_users                              set  有离线消息的用户，压缩时遍历
+//	storage_usage:<用户ID>                     hash {entries, bytes}，离线保存的条数与字节数
+//	storage_usage_rank                         zset {用户ID: 离线保存的字节数}
+//	storage_usage_total                        hash {entries, bytes}，集群离线保存总量
+//	storage_evicted:<用户ID>                   hash {entries, bytes, before_ms}，客户端尚未得知的超额淘汰
+//	connection_history:<用户ID>                list 最近的连接记录(JSON)，新的在前
+//	availability:<类型>:<值>                   string 用户名等的可用性缓存
+//	lock:<名称>                                string 分布式锁
+//	audit_log                                  stream 审计记录
+//
+// 花括号内为集群哈希标签，前缀加在标签之外，不影响键所在的槽。
+// 在线状态目前不保存在redis中，新增时应在此处定义
+package keys
+
+import (
+	"data_forwarding_service/config"
+)
+
+// Prefix 当前部署的键前缀(包括分隔符)，未配置时为空
+func Prefix() string {
+	if prefix := config.Handler.RedisKeyPrefix; prefix != "" {
+		return prefix + ":"
+	}
+	return ""
+}
+
+func key(name string) string {
+	return Prefix() + name
+}
+
+// LegacyPatterns 未加前缀的旧键的 SCAN 匹配模式，用于迁移
+var LegacyPatterns = []string{
+	"user_devices:*",
+	"ws_connection_mapping",
+	"container_connections:*",
+	"transition:*",
+	"container_identity:*",
+	"container_region:*",
+	"draining_containers",
+	"container_load:*",
+	"resume_token:*",
+	"connect_token:*",
+	"login_rate:*",
+	"user_seq:*",
+	"conv_seq:*",
+	"history:*",
+	"thread:*",
+	"reactions:*",
+	"delivery_dedup:*",
+	"subscriptions:*",
+	"key_bundles:*",
+	"key_bundle_versions:*",
+	"key_bundle_prekeys:*",
+	"known_devices:*",
+	"credential_cache:*",
+	"two_factor:*",
+	"totp_secret:*",
+	"feature_flags",
+	"feature_flag_allow:*",
+	"pipeline_pins",
+	"blocks:*",
+	"mutes:*",
+	"receipts:*",
+	"receipt_deadlines",
+	"abuse_report_rate:*",
+	"abuse_report_dedup:*",
+	"abuse_reports",
+	"storage_usage:*",
+	"offline:*",
+	"offline_released:*",
+	"offline_users",
+	"storage_usage_rank",
+	"storage_usage_total",
+	"storage_evicted:*",
+	"connection_history:*",
+	"availability:*",
+	"lock:*",
+	"audit_log",
+}
+
+// ConnectionKey 用户的设备登记
+func ConnectionKey(userID string) string {
+	return key("user_devices:" + userID)
+}
+
+// LegacyConnectionKey 旧版本按用户登记连接所在容器的hash
+func LegacyConnectionKey() string {
+	return key("ws_connection_mapping")
+}
+
+// ContainerMembersKey 容器上登记的连接集合
+func ContainerMembersKey(containerID string) string {
+	return key("container_connections:" + containerID)
+}
+
+// TransitionKey 用户登录切换中的设备
+func TransitionKey(userID string) string {
+	return key("transition:" + userID)
+}
+
+// ContainerIdentityKey 容器ID的持有者
+func ContainerIdentityKey(containerID string) string {
+	return key("container_identity:" + containerID)
+}
+
+// ContainerRegionKey 容器所在区域
+func ContainerRegionKey(containerID string) string {
+	return key("container_region:" + containerID)
+}
+
+// DrainingContainersKey 正在排空的容器集合
+func DrainingContainersKey() string {
+	return key("draining_containers")
+}
+
+// ContainerLoadKey 容器上报的负载，SCAN 时可传入通配符
+func ContainerLoadKey(containerID string) string {
+	return key("container_load:" + containerID)
+}
+
+// ConnectTokenKey 已使用的连接授权令牌
+func ConnectTokenKey(tokenID string) string {
+	return key("connect_token:" + tokenID)
+}
+
+// ResumeTokenKey 设备的恢复令牌，deviceKey 为 <用户ID>#<设备ID>，SCAN 时可传入通配符
+func ResumeTokenKey(deviceKey string) string {
+	return key("resume_token:" + deviceKey)
+}
+
+// LoginRateKey 设备最近的登录时间
+func LoginRateKey(deviceKey string) string {
+	return key("login_rate:" + deviceKey)
+}
+
+// UserSeqKey 用户消息序号
+func UserSeqKey(userID string) string {
+	return key("user_seq:" + userID)
+}
+
+// ConvSeqKey 会话消息序号
+func ConvSeqKey(conversation string) string {
+	return key("conv_seq:{" + conversation + "}")
+}
+
+// HistoryKey 会话历史
+func HistoryKey(conversation string) string {
+	return key("history:{" + conversation + "}")
+}
+
+// ThreadKey 话题回复摘要
+func ThreadKey(conversation string, rootID string) string {
+	return key("thread:" + conversation + ":" + rootID)
+}
+
+// ReactionKeys 消息的表情回应，依次为去重集合与计数
+func ReactionKeys(conversation string, messageID string) []string {
+	base := key("reactions:" + conversation + ":" + messageID)
+	return []string{base + ":users", base + ":counts"}
+}
+
+// DeliveryDedupKey 投递去重标记
+func DeliveryDedupKey(userID string, dedupKey string) string {
+	return key("delivery_dedup:" + userID + ":" + dedupKey)
+}
+
+// SubscriptionsKey 用户各设备订阅的事件类别
+func SubscriptionsKey(userID string) string {
+	return key("subscriptions:" + userID)
+}
+
+// KeyBundlesKey 用户各设备的公钥包
+func KeyBundlesKey(userID string) string {
+	return key("key_bundles:" + userID)
+}
+
+// KeyBundleVersionsKey 用户各设备公钥包的版本
+func KeyBundleVersionsKey(userID string) string {
+	return key("key_bundle_versions:" + userID)
+}
+
+// KeyBundlePrekeysKey 设备尚未分发的一次性预密钥，deviceKey 为 <用户ID>#<设备ID>
+func KeyBundlePrekeysKey(deviceKey string) string {
+	return key("key_bundle_prekeys:" + deviceKey)
+}
+
+// KnownDevicesKey 用户登录过的设备
+func KnownDevicesKey(userID string) string {
+	return key("known_devices:" + userID)
+}
+
+// CredentialCacheKey 降级登录使用的凭据缓存
+func CredentialCacheKey(accountDigest string) string {
+	return key("credential_cache:" + accountDigest)
+}
+
+// TwoFactorKey 二次验证挑战
+func TwoFactorKey(challengeID string) string {
+	return key("two_factor:" + challengeID)
+}
+
+// TOTPSecretKey 用户的TOTP密钥
+func TOTPSecretKey(userID string) string {
+	return key("totp_secret:" + userID)
+}
+
+// FeatureFlagsKey 功能开关放量配置
+func FeatureFlagsKey() string {
+	return key("feature_flags")
+}
+
+// FeatureFlagAllowPrefix 开关白名单键的前缀，供lua脚本拼接
+func FeatureFlagAllowPrefix() string {
+	return key("feature_flag_allow:")
+}
+
+// PipelinePinsKey 管理员为用户指定的投递流水线变体
+func PipelinePinsKey() string {
+	return key("pipeline_pins")
+}
+
+// BlocksKey 用户屏蔽的用户集合
+func BlocksKey(userID string) string {
+	return key("blocks:" + userID)
+}
+
+// MutesKey 用户设置了免打扰的会话
+func MutesKey(userID string) string {
+	return key("mutes:" + userID)
+}
+
+// ReceiptsKey 用户待确认的投递回执
+func ReceiptsKey(userID string) string {
+	return key("receipts:" + userID)
+}
+
+// ReceiptDeadlinesKey 所有待确认回执的过期时刻
+func ReceiptDeadlinesKey() string {
+	return key("receipt_deadlines")
+}
+
+// FeatureFlagAllowKey 开关白名单
+func FeatureFlagAllowKey(name string) string {
+	return FeatureFlagAllowPrefix() + name
+}
+
+// AvailabilityKey 可用性缓存
+func AvailabilityKey(kind string, value string) string {
+	return key("availability:" + kind + ":" + value)
+}
+
+// LockKey 分布式锁
+func LockKey(name string) string {
+	return key("lock:" + name)
+}
+
+// AbuseReportRateKey 用户最近的举报时间
+func AbuseReportRateKey(userID string) string {
+	return key("abuse_report_rate:" + userID)
+}
+
+// AbuseReportDedupKey 用户已举报过的对象
+func AbuseReportDedupKey(userID string, subject string) string {
+	return key("abuse_report_dedup:" + userID + ":" + subject)
+}
+
+// AbuseReportsKey 举报证据包stream
+func AbuseReportsKey() string {
+	return key("abuse_reports")
+}
+
+// OfflineKey 用户的离线消息stream，只追加
+func OfflineKey(userID string) string {
+	return key("offline:" + userID)
+}
+
+// OfflineReleasedKey 用户离线stream中已移出保存用量的条目
+func OfflineReleasedKey(userID string) string {
+	return key("offline_released:" + userID)
+}
+
+// OfflineUsersKey 有离线消息的用户，压缩时遍历
+func OfflineUsersKey() string {
+	return key("offline_users")
+}
+
+// StorageUsageKey 用户离线保存的用量
+func StorageUsageKey(userID string) string {
+	return key("storage_usage:" + userID)
+}
+
+// StorageUsageRankKey 按离线保存字节数排列的用户
+func StorageUsageRankKey() string {
+	return key("storage_usage_rank")
+}
+
+// StorageUsageTotalKey 集群离线保存总量
+func StorageUsageTotalKey() string {
+	return key("storage_usage_total")
+}
+
+// StorageEvictedKey 用户尚未告知客户端的超额淘汰
+func StorageEvictedKey(userID string) string {
+	return key("storage_evicted:" + userID)
+}
+
+// ConnectionHistoryKey 用户最近的连接记录
+func ConnectionHistoryKey(userID string) string {
+	return key("connection_history:" + userID)
+}
+
+// AuditLogKey 审计记录stream
+func AuditLogKey() string {
+	return key("audit_log")
+}
@@ -0,0 +1,60 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// KnownDevice 登记设备的结果
+type KnownDevice int
+
+const (
+	DeviceKnown       KnownDevice = iota // 设备登录过
+	DeviceNew                            // 新设备，用户还有其他登录过的设备
+	DeviceFirstDevice                    // 用户的第一台设备
+)
+
+// 登记设备并刷新最近登录时刻，超过上限时淘汰最近登录最早的设备。返回值见 KnownDevice
+var touchKnownDeviceScript = redis.NewScript(`
+local now = ARGV[2]
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+local count = redis.call('HLEN', KEYS[1])
+if current then
+	local first = string.match(current, '^(%d+):') or now
+	redis.call('HSET', KEYS[1], ARGV[1], first .. ':' .. now)
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], now .. ':' .. now)
+local limit = tonumber(ARGV[3])
+if limit > 0 and count + 1 > limit then
+	local all = redis.call('HGETALL', KEYS[1])
+	local devices = {}
+	for i = 1, #all, 2 do
+		if all[i] ~= ARGV[1] then
+			table.insert(devices, {all[i], tonumber(string.match(all[i + 1], ':(%d+)$')) or 0})
+		end
+	end
+	table.sort(devices, function(a, b) return a[2] < b[2] end)
+	for i = 1, count + 1 - limit do
+		redis.call('HDEL', KEYS[1], devices[i][1])
+	end
+end
+if count == 0 then
+	return 2
+end
+return 1
+`)
+
+// TouchKnownDevice 记录用户在设备上登录，最多保留 limit 台设备(为0时不限制)，超出时淘汰最近登录最早的设备
+func TouchKnownDevice(ctx context.Context, userID string, deviceID string, at time.Time, limit int) (KnownDevice, error) {
+	n, err := touchKnownDeviceScript.Run(ctx, Rdb, []string{keys.KnownDevicesKey(userID)},
+		deviceID, at.UnixMilli(), limit).Int()
+	return KnownDevice(n), err
+}
+
+// KnownDevices 用户登录过的设备ID
+func KnownDevices(ctx context.Context, userID string) ([]string, error) {
+	return Rdb.HKeys(ctx, keys.KnownDevicesKey(userID)).Result()
+}
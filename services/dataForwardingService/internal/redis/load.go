@@ -0,0 +1,72 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerLoad 容器上报的负载
+type ContainerLoad struct {
+	ContainerID string
+	URL         string // 客户端直连该容器的地址
+	Connections int
+	Draining    bool
+}
+
+// ReportContainerLoad 上报本容器的连接数与对外地址，ttl 内未再次上报的容器视为已下线
+func ReportContainerLoad(ctx context.Context, containerID string, url string, connections int, ttl time.Duration) error {
+	key := keys.ContainerLoadKey(containerID)
+	pipe := Rdb.TxPipeline()
+	pipe.HSet(ctx, key, "url", url, "connections", connections)
+	pipe.PExpire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ListContainerLoads 读取所有容器上报的负载，并标记其中正在排空的容器
+func ListContainerLoads(ctx context.Context) ([]ContainerLoad, error) {
+	var ids []string
+	iter := Rdb.Scan(ctx, 0, keys.ContainerLoadKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), keys.ContainerLoadKey("")))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, keys.ContainerLoadKey(id))
+	}
+	draining := pipe.SMembers(ctx, keys.DrainingContainersKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	drainingSet := make(map[string]bool)
+	for _, id := range draining.Val() {
+		drainingSet[id] = true
+	}
+	loads := make([]ContainerLoad, 0, len(ids))
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			// 扫描后已过期
+			continue
+		}
+		connections, _ := strconv.Atoi(fields["connections"])
+		loads = append(loads, ContainerLoad{
+			ContainerID: id,
+			URL:         fields["url"],
+			Connections: connections,
+			Draining:    drainingSet[id],
+		})
+	}
+	return loads, nil
+}
@@ -0,0 +1,126 @@
+package redisClient
+
+import (
+	"Betterfly2/shared/logger"
+	"context"
+	"crypto/rand"
+	"data_forwarding_service/internal/redis/keys"
+	"encoding/hex"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// 测试中缩短以加快竞选与迁移
+var (
+	lockTTL      = 15 * time.Second
+	lockRenew    = lockTTL / 3 // 续期间隔，留出两次续期失败的余量
+	lockCampaign = 5 * time.Second
+)
+
+// 只有锁仍属于owner时才续期/释放，避免误删他人在过期后重新获得的锁
+var renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock 尝试获得锁，已被他人持有时返回false
+func AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	return Rdb.SetNX(ctx, keys.LockKey(name), owner, ttl).Result()
+}
+
+// RenewLock 续期锁，锁已不属于owner时返回false
+func RenewLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	n, err := renewLockScript.Run(ctx, Rdb, []string{keys.LockKey(name)}, owner, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// ReleaseLock 释放锁，锁已不属于owner时什么都不做
+func ReleaseLock(ctx context.Context, name string, owner string) error {
+	return releaseLockScript.Run(ctx, Rdb, []string{keys.LockKey(name)}, owner).Err()
+}
+
+// RunExclusive 在集群内以单例方式运行任务：竞选名为name的锁，获得后运行fn并定期续期；
+// 续期失败(锁丢失)时取消fn的上下文，fn返回后释放锁并重新竞选。持有者崩溃时锁在 lockTTL 后过期，任务自动迁移到其他容器。
+// ctx 取消(服务关闭)时主动释放锁后返回。
+//
+// 目前的单例任务是回执过期清理(receipt_expiry)与离线墓碑压缩(offline_compaction)。
+// 本服务没有定时消息投递、过期登记清扫或在线状态防抖刷新任务：过期登记由对账工具通过
+// 管理接口逐条删除，不在服务内定时执行；新增此类任务时同样通过 RunExclusive 运行
+func RunExclusive(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	sugar := logger.Sugar().With("lock", name)
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	owner := hex.EncodeToString(buf)
+
+	ticker := time.NewTicker(lockCampaign)
+	defer ticker.Stop()
+	for {
+		ok, err := AcquireLock(ctx, name, owner, lockTTL)
+		if err != nil {
+			sugar.Warnf("竞选锁失败: %v", err)
+		} else if ok {
+			sugar.Infof("获得锁，开始运行单例任务")
+			if err := holdAndRun(ctx, name, owner, fn); err != nil {
+				sugar.Warnf("单例任务退出: %v", err)
+			}
+			// 服务关闭时上下文已取消，使用独立的超时释放
+			releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if err := ReleaseLock(releaseCtx, name, owner); err != nil {
+				sugar.Warnf("释放锁失败，等待其自动过期: %v", err)
+			}
+			cancel()
+			sugar.Infof("已让出锁")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// holdAndRun 持有锁期间运行fn。锁被他人持有，或续期持续失败直到锁可能已过期时，取消fn的上下文并等待其返回
+func holdAndRun(ctx context.Context, name string, owner string, fn func(ctx context.Context) error) error {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(jobCtx)
+	}()
+
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			ok, err := RenewLock(jobCtx, name, owner, lockTTL)
+			switch {
+			case err == nil && ok:
+				renewed = time.Now()
+				continue
+			case err == nil:
+				logger.Sugar().Warnf("锁 %s 已被他人持有，停止单例任务", name)
+			case time.Since(renewed)+lockRenew < lockTTL:
+				logger.Sugar().Warnf("锁 %s 续期失败，稍后重试: %v", name, err)
+				continue
+			default:
+				logger.Sugar().Warnf("锁 %s 持续续期失败，可能已过期，停止单例任务: %v", name, err)
+			}
+			cancel()
+			return <-done
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withFastLock 缩短竞选与续期间隔，测试结束后恢复
+func withFastLock(t *testing.T) {
+	t.Helper()
+	savedRenew, savedCampaign := lockRenew, lockCampaign
+	lockRenew, lockCampaign = 20*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() { lockRenew, lockCampaign = savedRenew, savedCampaign })
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// exclusiveJob 记录哪个实例正在运行任务，同时运行的实例数超过1时记为违规
+type exclusiveJob struct {
+	running    atomic.Int32
+	violations atomic.Int32
+	leader     atomic.Int32 // 当前运行任务的实例编号，0 表示没有
+}
+
+func (j *exclusiveJob) fn(instance int32) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if j.running.Add(1) > 1 {
+			j.violations.Add(1)
+		}
+		j.leader.Store(instance)
+		<-ctx.Done()
+		j.leader.CompareAndSwap(instance, 0)
+		j.running.Add(-1)
+		return nil
+	}
+}
+
+// 多个实例竞选同一把锁，任一时刻只有一个实例运行任务；持有者关闭后任务迁移到其他实例
+func TestRunExclusiveFailover(t *testing.T) {
+	withMiniredis(t)
+	withFastLock(t)
+	job := &exclusiveJob{}
+
+	cancels := make(map[int32]context.CancelFunc)
+	var wg sync.WaitGroup
+	for i := int32(1); i <= 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunExclusive(ctx, "job", job.fn(i))
+		}()
+	}
+	t.Cleanup(func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		wg.Wait()
+	})
+
+	seen := map[int32]bool{}
+	for round := 0; round < 2; round++ {
+		eventually(t, "选出持有者", func() bool { return job.leader.Load() != 0 })
+		leader := job.leader.Load()
+		if seen[leader] {
+			t.Fatalf("已关闭的实例 %d 再次获得锁", leader)
+		}
+		seen[leader] = true
+		// 持有期间多次续期，其他实例不能同时运行
+		time.Sleep(5 * lockRenew)
+		if job.leader.Load() != leader {
+			t.Fatalf("持有者在续期期间发生变化: %d -> %d", leader, job.leader.Load())
+		}
+		cancels[leader]()
+		eventually(t, "任务迁移", func() bool {
+			next := job.leader.Load()
+			return next != 0 && next != leader
+		})
+	}
+	if n := job.violations.Load(); n != 0 {
+		t.Fatalf("有 %d 次多个实例同时运行任务", n)
+	}
+}
+
+// 持有者崩溃时不会释放锁，其他实例在锁过期后接管
+func TestRunExclusiveTakesOverAfterHolderCrash(t *testing.T) {
+	mr := withMiniredis(t)
+	withFastLock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// 另一个容器获得锁后崩溃，之后不再续期
+	if ok, err := AcquireLock(ctx, "job", "crashed", lockTTL); err != nil || !ok {
+		t.Fatalf("获得锁失败: %v %v", ok, err)
+	}
+	job := &exclusiveJob{}
+	go func() {
+		defer close(done)
+		RunExclusive(ctx, "job", job.fn(1))
+	}()
+
+	time.Sleep(5 * lockCampaign)
+	if job.leader.Load() != 0 {
+		t.Fatal("锁未过期时就运行了任务")
+	}
+	mr.FastForward(lockTTL)
+	eventually(t, "锁过期后接管", func() bool { return job.leader.Load() == 1 })
+}
+
+// 锁被他人夺走时停止任务，并在锁重新空闲后继续竞选
+func TestRunExclusiveStepsDownOnLostLock(t *testing.T) {
+	mr := withMiniredis(t)
+	withFastLock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	job := &exclusiveJob{}
+	go func() {
+		defer close(done)
+		RunExclusive(ctx, "job", job.fn(1))
+	}()
+	eventually(t, "获得锁", func() bool { return job.leader.Load() == 1 })
+
+	// 模拟锁过期后被其他容器获得
+	mr.Set(keys.LockKey("job"), "other")
+	eventually(t, "停止任务", func() bool { return job.leader.Load() == 0 })
+
+	// 他人持有期间不会抢回，也不会误删他人的锁
+	time.Sleep(5 * lockCampaign)
+	if job.leader.Load() != 0 {
+		t.Fatal("他人持有锁期间重新运行了任务")
+	}
+	if owner, _ := mr.Get(keys.LockKey("job")); owner != "other" {
+		t.Fatalf("他人的锁被改为 %q", owner)
+	}
+	mr.Del(keys.LockKey("job"))
+	eventually(t, "重新获得锁", func() bool { return job.leader.Load() == 1 })
+}
@@ -0,0 +1,41 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// 滑动窗口内的登录计数：窗口内已有 ARGV[3] 次登录时拒绝，返回最早一次登录移出窗口前还需等待的毫秒数；
+// 否则记录本次登录并返回0。被拒绝的登录不计入，客户端按返回的时间等待后即可登录。
+// KEYS[1] 登录记录；ARGV[1] 当前时间(毫秒)，ARGV[2] 窗口(毫秒)，ARGV[3] 上限，ARGV[4] 本次登录的唯一成员
+var loginRateScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	local wait = tonumber(oldest[2]) + window - now
+	if wait < 1 then
+		wait = 1
+	end
+	return wait
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return 0
+`)
+
+// RecordLogin 在集群范围内记录设备的一次登录，window 内已登录 max 次时不记录，返回建议等待的时间
+func RecordLogin(ctx context.Context, id string, deviceID string, window time.Duration, max int) (time.Duration, error) {
+	now := time.Now()
+	member := strconv.FormatInt(now.UnixNano(), 36)
+	wait, err := loginRateScript.Run(ctx, Rdb, []string{keys.LoginRateKey(DeviceKey(id, deviceID))},
+		now.UnixMilli(), window.Milliseconds(), max, member).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
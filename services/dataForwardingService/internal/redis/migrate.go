@@ -0,0 +1,82 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// 批量将旧键改名为加前缀的新键，返回 [改名数, 新键已存在数, 旧键已不存在数]。
+// KEYS 依次为 旧键1, 新键1, 旧键2, 新键2, ...；新键已存在时保留两者，由调用方报告
+var renameKeysScript = redis.NewScript(`
+local renamed, conflicts, missing = 0, 0, 0
+for i = 1, #KEYS, 2 do
+	if redis.call('EXISTS', KEYS[i]) == 0 then
+		missing = missing + 1
+	elseif redis.call('RENAMENX', KEYS[i], KEYS[i + 1]) == 1 then
+		renamed = renamed + 1
+	else
+		conflicts = conflicts + 1
+	end
+end
+return {renamed, conflicts, missing}
+`)
+
+// MigrationStats 键迁移的统计
+type MigrationStats struct {
+	Scanned   int64 // 匹配到的旧键数
+	Renamed   int64 // 已改名的键数
+	Conflicts int64 // 新键已存在而保留旧键的数量，通常是迁移前服务已按新键写入
+	Missing   int64 // 扫描后、改名前已过期或被删除的键数
+}
+
+// MigrateKeys 在线将未加前缀的旧键改名为 keys.Prefix() 下的新键，按 batch 个一批SCAN并在一个脚本中改名，
+// 不阻塞redis过久。改名保留过期时间；重复执行是安全的。一批中的键可能不在同一槽，仅支持非集群模式。未配置前缀时返回错误。
+// progress 不为空时每批完成后调用一次
+func MigrateKeys(ctx context.Context, batch int, dryRun bool, progress func(MigrationStats)) (MigrationStats, error) {
+	var stats MigrationStats
+	prefix := keys.Prefix()
+	if prefix == "" {
+		return stats, errors.New("未配置 REDIS_KEY_PREFIX，无需迁移")
+	}
+	for _, pattern := range keys.LegacyPatterns {
+		iter := Rdb.Scan(ctx, 0, pattern, int64(batch)).Iterator()
+		pending := make([]string, 0, batch*2)
+		flush := func() error {
+			if len(pending) == 0 {
+				return nil
+			}
+			if !dryRun {
+				counts, err := renameKeysScript.Run(ctx, Rdb, pending).Int64Slice()
+				if err != nil {
+					return err
+				}
+				stats.Renamed += counts[0]
+				stats.Conflicts += counts[1]
+				stats.Missing += counts[2]
+			}
+			pending = pending[:0]
+			if progress != nil {
+				progress(stats)
+			}
+			return nil
+		}
+		for iter.Next(ctx) {
+			stats.Scanned++
+			pending = append(pending, iter.Val(), prefix+iter.Val())
+			if len(pending) >= batch*2 {
+				if err := flush(); err != nil {
+					return stats, err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return stats, err
+		}
+		if err := flush(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
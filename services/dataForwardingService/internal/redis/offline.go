@@ -0,0 +1,257 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// 离线消息保存在 offline:<用户ID> stream 中，只追加：撤回与账号注销作为删除标记追加在同一stream，
+// 读取时应用，再由压缩按读到的条目ID物理删除。XDEL 只删除指定ID，压缩期间其他容器追加的条目不受影响。
+//
+// 消息条目追加时计入用户的保存用量，被删除标记作废、回放或物理删除时移出。已移出用量但仍在stream中的条目ID
+// 记在 offline_released:<用户ID>，同一条目只移出一次，物理删除时不再重复扣减
+
+// 离线stream中条目的类型
+const (
+	OfflineMessage = "msg"    // 一条离线消息
+	OfflineRecall  = "recall" // 撤回 MessageID 对应的消息，不论消息先于还是晚于标记写入
+	OfflinePurge   = "purge"  // 作废写入时刻不晚于 At 的全部消息
+)
+
+// OfflineEntry 离线stream中的一条记录
+type OfflineEntry struct {
+	ID        string // stream条目ID，读取时填写
+	Kind      string
+	MessageID string
+	DeviceID  string // 为空时属于用户的所有设备
+	At        int64  // 写入时刻(毫秒)，删除标记为其生效时刻
+	Seq       int64
+	Size      int64 // 计入保存用量的字节数，旧条目没有时取 Data 的长度
+	Data      []byte
+}
+
+// 追加条目并登记用户，两者原子完成，压缩不会漏掉有条目的用户
+var appendOfflineScript = redis.NewScript(`
+redis.call('XADD', KEYS[1], '*', 'kind', ARGV[2], 'mid', ARGV[3], 'dev', ARGV[4], 'at', ARGV[5], 'seq', ARGV[6], 'size', ARGV[8], 'data', ARGV[7])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`)
+
+// 删除指定条目，返回其中仍计入用量的消息条数与字节数；stream为空时一并注销用户。
+// 与追加互斥，注销之后的追加会重新登记。ARGV[1] 为用户ID，之后每三个为条目ID、是否为消息、字节数
+var deleteOfflineScript = redis.NewScript(`
+local entries, bytes = 0, 0
+for i = 2, #ARGV, 3 do
+	if redis.call('XDEL', KEYS[1], ARGV[i]) == 1 and redis.call('SREM', KEYS[3], ARGV[i]) == 0 and ARGV[i+1] == '1' then
+		entries = entries + 1
+		bytes = bytes + tonumber(ARGV[i+2])
+	end
+end
+if redis.call('XLEN', KEYS[1]) == 0 then
+	redis.call('DEL', KEYS[1], KEYS[3])
+	redis.call('SREM', KEYS[2], ARGV[1])
+end
+return {entries, bytes}
+`)
+
+// 把仍在stream中、尚未移出的消息条目移出用量，返回移出的条数与字节数。ARGV 每两个为条目ID、字节数
+var releaseOfflineScript = redis.NewScript(`
+local entries, bytes = 0, 0
+for i = 1, #ARGV, 2 do
+	if #redis.call('XRANGE', KEYS[1], ARGV[i], ARGV[i]) > 0 and redis.call('SADD', KEYS[2], ARGV[i]) == 1 then
+		entries = entries + 1
+		bytes = bytes + tonumber(ARGV[i+1])
+	end
+end
+return {entries, bytes}
+`)
+
+// 从最早的条目开始删除消息，直到移出用量的条数不少于 ARGV[1] 且字节数不少于 ARGV[2]。
+// 已移出用量的消息一并删除但不计入；返回移出的条数、字节数与其中最新一条的写入时刻
+var evictOfflineScript = redis.NewScript(`
+local want_entries, want_bytes = tonumber(ARGV[1]), tonumber(ARGV[2])
+local entries, bytes, before = 0, 0, 0
+local start = '-'
+while entries < want_entries or bytes < want_bytes do
+	local batch = redis.call('XRANGE', KEYS[1], start, '+', 'COUNT', 64)
+	if #batch == 0 then
+		break
+	end
+	for _, item in ipairs(batch) do
+		local id, fields = item[1], {}
+		for i = 1, #item[2], 2 do
+			fields[item[2][i]] = item[2][i+1]
+		end
+		start = '(' .. id
+		if fields['kind'] == 'msg' then
+			redis.call('XDEL', KEYS[1], id)
+			if redis.call('SREM', KEYS[2], id) == 0 then
+				entries = entries + 1
+				bytes = bytes + (tonumber(fields['size']) or #(fields['data'] or ''))
+				before = math.max(before, tonumber(fields['at']) or 0)
+			end
+			if entries >= want_entries and bytes >= want_bytes then
+				break
+			end
+		end
+	end
+end
+return {entries, bytes, before}
+`)
+
+// AppendOffline 向用户的离线stream追加一条消息或删除标记
+func AppendOffline(ctx context.Context, userID string, entry OfflineEntry) error {
+	return appendOfflineScript.Run(ctx, Rdb, []string{keys.OfflineKey(userID), keys.OfflineUsersKey()},
+		userID, entry.Kind, entry.MessageID, entry.DeviceID, entry.At, entry.Seq, entry.Data, entry.Size).Err()
+}
+
+// ReadOffline 按写入顺序返回用户仍然有效的离线消息：已应用全部删除标记，不含超过 retention 的条目
+func ReadOffline(ctx context.Context, userID string, retention time.Duration) ([]OfflineEntry, error) {
+	entries, err := readOfflineStream(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	live, _ := splitOffline(entries, time.Now().Add(-retention).UnixMilli())
+	return live, nil
+}
+
+// ReleaseOffline 把用户stream中的消息条目移出保存用量，返回本次移出的量。已移出、已删除的条目与删除标记不计
+func ReleaseOffline(ctx context.Context, userID string, entries []OfflineEntry) (StorageUsage, error) {
+	var args []any
+	for _, entry := range entries {
+		if entry.Kind == OfflineMessage {
+			args = append(args, entry.ID, entry.Size)
+		}
+	}
+	if len(args) == 0 {
+		return StorageUsage{UserID: userID}, nil
+	}
+	counts, err := releaseOfflineScript.Run(ctx, Rdb, []string{keys.OfflineKey(userID), keys.OfflineReleasedKey(userID)}, args...).Int64Slice()
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	return StorageUsage{UserID: userID, Entries: counts[0], Bytes: counts[1]}, nil
+}
+
+// ReleaseDeadOffline 把用户stream中已被删除标记作废或超过 retention 的消息移出保存用量，追加删除标记后调用
+func ReleaseDeadOffline(ctx context.Context, userID string, retention time.Duration) (StorageUsage, error) {
+	entries, err := readOfflineStream(ctx, userID)
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	_, dead := splitOffline(entries, time.Now().Add(-retention).UnixMilli())
+	return ReleaseOffline(ctx, userID, pickOffline(entries, dead))
+}
+
+// EvictOffline 从最早的条目开始删除用户的离线消息，直到移出保存用量的条数不少于 entries 且字节数不少于 bytes，
+// 或已没有消息可删。返回移出的量，Before 为其中最新一条消息的写入时刻
+func EvictOffline(ctx context.Context, userID string, entries int64, bytes int64) (StorageEviction, error) {
+	counts, err := evictOfflineScript.Run(ctx, Rdb, []string{keys.OfflineKey(userID), keys.OfflineReleasedKey(userID)}, entries, bytes).Int64Slice()
+	if err != nil {
+		return StorageEviction{}, err
+	}
+	return StorageEviction{Entries: counts[0], Bytes: counts[1], Before: time.UnixMilli(counts[2])}, nil
+}
+
+// CompactOffline 物理删除所有用户离线stream中被标记删除与超过 retention 的条目，返回删除的条数。
+// freed 不为nil时，对每个有消息移出保存用量的用户调用一次。
+// 应在分布式锁下运行；与追加同时进行是安全的，只删除本次读到的条目
+func CompactOffline(ctx context.Context, retention time.Duration, freed func(StorageUsage)) (int, error) {
+	cutoff := time.Now().Add(-retention).UnixMilli()
+	removed := 0
+	iter := Rdb.SScan(ctx, keys.OfflineUsersKey(), 0, "", 256).Iterator()
+	for iter.Next(ctx) {
+		userID := iter.Val()
+		entries, err := readOfflineStream(ctx, userID)
+		if err != nil {
+			return removed, err
+		}
+		_, dead := splitOffline(entries, cutoff)
+		if len(dead) == 0 && len(entries) > 0 {
+			continue
+		}
+		args := []any{userID}
+		for _, entry := range pickOffline(entries, dead) {
+			args = append(args, entry.ID, entry.Kind == OfflineMessage, entry.Size)
+		}
+		counts, err := deleteOfflineScript.Run(ctx, Rdb,
+			[]string{keys.OfflineKey(userID), keys.OfflineUsersKey(), keys.OfflineReleasedKey(userID)}, args...).Int64Slice()
+		if err != nil {
+			return removed, err
+		}
+		removed += len(dead)
+		if freed != nil && counts[0] > 0 {
+			freed(StorageUsage{UserID: userID, Entries: counts[0], Bytes: counts[1]})
+		}
+	}
+	return removed, iter.Err()
+}
+
+func readOfflineStream(ctx context.Context, userID string) ([]OfflineEntry, error) {
+	messages, err := Rdb.XRange(ctx, keys.OfflineKey(userID), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]OfflineEntry, 0, len(messages))
+	for _, message := range messages {
+		entry := OfflineEntry{
+			ID:        message.ID,
+			Kind:      toString(message.Values["kind"]),
+			MessageID: toString(message.Values["mid"]),
+			DeviceID:  toString(message.Values["dev"]),
+			Data:      []byte(toString(message.Values["data"])),
+		}
+		entry.At, _ = strconv.ParseInt(toString(message.Values["at"]), 10, 64)
+		entry.Seq, _ = strconv.ParseInt(toString(message.Values["seq"]), 10, 64)
+		entry.Size, _ = strconv.ParseInt(toString(message.Values["size"]), 10, 64)
+		if entry.Size == 0 {
+			entry.Size = int64(len(entry.Data))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// splitOffline 应用删除标记：live 为仍然有效的消息，dead 为可以物理删除的条目ID。
+// 删除标记在过期之前一直保留，以便作用于晚到的消息；标记过期时，它作废的消息也已在同一批删除
+func splitOffline(entries []OfflineEntry, cutoff int64) (live []OfflineEntry, dead []string) {
+	recalled := make(map[string]bool)
+	var purgedUntil int64
+	for _, entry := range entries {
+		switch entry.Kind {
+		case OfflineRecall:
+			recalled[entry.MessageID] = true
+		case OfflinePurge:
+			purgedUntil = max(purgedUntil, entry.At)
+		}
+	}
+	for _, entry := range entries {
+		switch {
+		case entry.Kind == OfflineMessage && (recalled[entry.MessageID] && entry.MessageID != "" || entry.At <= purgedUntil):
+			dead = append(dead, entry.ID)
+		case entry.At < cutoff:
+			dead = append(dead, entry.ID)
+		case entry.Kind == OfflineMessage:
+			live = append(live, entry)
+		}
+	}
+	return live, dead
+}
+
+// pickOffline 按条目ID从 entries 中取出对应的条目，保持 entries 中的顺序
+func pickOffline(entries []OfflineEntry, ids []string) []OfflineEntry {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	picked := make([]OfflineEntry, 0, len(ids))
+	for _, entry := range entries {
+		if wanted[entry.ID] {
+			picked = append(picked, entry)
+		}
+	}
+	return picked
+}
@@ -0,0 +1,256 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitOffline(t *testing.T) {
+	msg := func(id, mid string, at int64) OfflineEntry {
+		return OfflineEntry{ID: id, Kind: OfflineMessage, MessageID: mid, At: at}
+	}
+	entries := []OfflineEntry{
+		{ID: "0", Kind: OfflineRecall, MessageID: "late", At: 100}, // 先于消息写入的撤回
+		msg("1", "a", 100),
+		msg("2", "late", 110),
+		msg("3", "b", 120),
+		{ID: "4", Kind: OfflineRecall, MessageID: "b", At: 130},
+		{ID: "5", Kind: OfflinePurge, At: 100},
+		msg("6", "c", 140),
+		msg("7", "", 150),
+		msg("8", "old", 10), // 已过期
+	}
+	live, dead := splitOffline(entries, 50)
+	var liveIDs []string
+	for _, e := range live {
+		liveIDs = append(liveIDs, e.ID)
+	}
+	if want := []string{"6", "7"}; !reflect.DeepEqual(liveIDs, want) {
+		t.Errorf("有效消息为 %v，期望 %v", liveIDs, want)
+	}
+	// 未过期的删除标记保留，作用于之后晚到的消息
+	if want := []string{"1", "2", "3", "8"}; !reflect.DeepEqual(dead, want) {
+		t.Errorf("可删除的条目为 %v，期望 %v", dead, want)
+	}
+
+	// 删除标记过期后与其作废的消息一起删除
+	_, dead = splitOffline(entries, 200)
+	if len(dead) != len(entries) {
+		t.Errorf("全部过期时只删除 %v", dead)
+	}
+}
+
+// 多个实例同时追加消息与撤回标记、读取，另有多个实例在分布式锁下反复压缩：
+// 读取从不返回读取前已撤回的消息，压缩不删除任何有效消息，最终stream中不剩被撤回的消息
+func TestCompactOfflineWhileAppending(t *testing.T) {
+	withMiniredis(t)
+	withFastLock(t)
+	ctx := context.Background()
+	const (
+		writers  = 3
+		users    = 4
+		perUser  = 30
+		retained = time.Hour
+	)
+
+	var recalled sync.Map // {消息ID: 撤回标记已写入}
+	var violations atomic.Int32
+	stop := make(chan struct{})
+
+	// 压缩在两个实例间竞选，同一时刻只有一个运行
+	compactCtx, cancelCompact := context.WithCancel(ctx)
+	var compactions atomic.Int32
+	var compactors sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		compactors.Add(1)
+		go func() {
+			defer compactors.Done()
+			RunExclusive(compactCtx, "offline_compaction", func(ctx context.Context) error {
+				for ctx.Err() == nil {
+					if _, err := CompactOffline(ctx, retained, nil); err != nil && ctx.Err() == nil {
+						t.Errorf("压缩失败: %v", err)
+					}
+					compactions.Add(1)
+				}
+				return nil
+			})
+		}()
+	}
+
+	// 读取者：读取之前已写入撤回标记的消息不能出现
+	var readers sync.WaitGroup
+	for u := 0; u < users; u++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			userID := fmt.Sprint(u)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				before := make(map[string]bool)
+				recalled.Range(func(k, v any) bool {
+					before[k.(string)] = true
+					return true
+				})
+				live, err := ReadOffline(ctx, userID, retained)
+				if err != nil {
+					t.Errorf("读取失败: %v", err)
+					return
+				}
+				for _, e := range live {
+					if before[e.MessageID] {
+						violations.Add(1)
+					}
+				}
+			}
+		}()
+	}
+
+	// 每个写入者为每个用户追加消息，每3条撤回1条，撤回标记有时先于消息写入
+	var writersWG sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWG.Add(1)
+		go func() {
+			defer writersWG.Done()
+			for i := 0; i < perUser; i++ {
+				for u := 0; u < users; u++ {
+					userID := fmt.Sprint(u)
+					mid := fmt.Sprintf("%d-%d-%d", w, u, i)
+					message := OfflineEntry{Kind: OfflineMessage, MessageID: mid, At: time.Now().UnixMilli(), Data: []byte(mid)}
+					recall := OfflineEntry{Kind: OfflineRecall, MessageID: mid, At: time.Now().UnixMilli()}
+					first, second := message, recall
+					if i%6 == 0 {
+						first, second = recall, message
+					}
+					if err := AppendOffline(ctx, userID, first); err != nil {
+						t.Errorf("追加失败: %v", err)
+						return
+					}
+					if i%3 != 0 {
+						continue
+					}
+					if err := AppendOffline(ctx, userID, second); err != nil {
+						t.Errorf("追加失败: %v", err)
+						return
+					}
+					recalled.Store(mid, true)
+				}
+			}
+		}()
+	}
+	writersWG.Wait()
+	eventually(t, "压缩运行", func() bool { return compactions.Load() > 0 })
+	close(stop)
+	readers.Wait()
+	cancelCompact()
+	compactors.Wait()
+	if _, err := CompactOffline(ctx, retained, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := violations.Load(); n > 0 {
+		t.Fatalf("读取返回了 %d 条已撤回的消息", n)
+	}
+	for u := 0; u < users; u++ {
+		userID := fmt.Sprint(u)
+		live, err := ReadOffline(ctx, userID, retained)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, e := range live {
+			got[e.MessageID] = true
+		}
+		for w := 0; w < writers; w++ {
+			for i := 0; i < perUser; i++ {
+				mid := fmt.Sprintf("%d-%d-%d", w, u, i)
+				// i%3==0 的消息都被撤回，不论撤回标记先于还是晚于消息写入
+				if want := i%3 != 0; got[mid] != want {
+					t.Fatalf("用户 %s 的消息 %s 有效=%v，期望 %v", userID, mid, got[mid], want)
+				}
+			}
+		}
+
+		// 被撤回的消息已被物理删除
+		stream, err := Rdb.XRange(ctx, keys.OfflineKey(userID), "-", "+").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range stream {
+			mid := toString(m.Values["mid"])
+			if _, ok := recalled.Load(mid); ok && toString(m.Values["kind"]) == OfflineMessage {
+				t.Fatalf("用户 %s 已撤回的消息 %s 压缩后仍在stream中", userID, mid)
+			}
+		}
+	}
+	t.Logf("压缩运行 %d 次", compactions.Load())
+}
+
+// 同一条消息先被删除标记作废、再被压缩删除，只移出一次用量；淘汰从最早的消息开始，跳过删除标记，已移出用量的消息不计入
+func TestOfflineReleaseAndEvictCountEachEntryOnce(t *testing.T) {
+	withMiniredis(t)
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+	for i, mid := range []string{"a", "b", "c", "d"} {
+		entry := OfflineEntry{Kind: OfflineMessage, MessageID: mid, At: now + int64(i), Size: 10, Data: []byte(mid)}
+		if err := AppendOffline(ctx, "u", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AppendOffline(ctx, "u", OfflineEntry{Kind: OfflineRecall, MessageID: "b", At: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := ReleaseDeadOffline(ctx, "u", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released.Entries != 1 || released.Bytes != 10 {
+		t.Fatalf("撤回后移出 %+v，期望 1 条 10 字节", released)
+	}
+	if released, _ = ReleaseDeadOffline(ctx, "u", time.Hour); released.Entries != 0 {
+		t.Fatalf("重复移出 %+v", released)
+	}
+	var freed StorageUsage
+	if _, err := CompactOffline(ctx, time.Hour, func(u StorageUsage) { freed = u }); err != nil {
+		t.Fatal(err)
+	}
+	if freed.Entries != 0 {
+		t.Fatalf("压缩重复扣减已移出的消息: %+v", freed)
+	}
+
+	// 回放过的 a 已移出用量，淘汰时删除但不计入，需要继续删到 c
+	live, err := ReadOffline(ctx, "u", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released, _ = ReleaseOffline(ctx, "u", live[:1]); released.Entries != 1 {
+		t.Fatalf("回放后移出 %+v，期望 1 条", released)
+	}
+	eviction, err := EvictOffline(ctx, "u", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eviction.Entries != 1 || eviction.Bytes != 10 || eviction.Before.UnixMilli() != now+2 {
+		t.Fatalf("淘汰 %+v，期望删除 c", eviction)
+	}
+	live, err = ReadOffline(ctx, "u", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].MessageID != "d" {
+		t.Fatalf("淘汰后剩余 %+v，期望只剩 d", live)
+	}
+	if n, _ := Rdb.SCard(ctx, keys.OfflineReleasedKey("u")).Result(); n != 0 {
+		t.Fatalf("删除后仍有 %d 条已移出记录", n)
+	}
+}
@@ -0,0 +1,27 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetPipelinePin 读取管理员为用户指定的投递流水线变体，未指定时返回空
+func GetPipelinePin(ctx context.Context, id string) (string, error) {
+	v, err := Rdb.HGet(ctx, keys.PipelinePinsKey(), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+// SetPipelinePin 为用户指定投递流水线变体，用户下次登录时生效
+func SetPipelinePin(ctx context.Context, id string, pipeline string) error {
+	return Rdb.HSet(ctx, keys.PipelinePinsKey(), id, pipeline).Err()
+}
+
+// ClearPipelinePin 取消为用户指定的投递流水线，恢复按规则分配
+func ClearPipelinePin(ctx context.Context, id string) error {
+	return Rdb.HDel(ctx, keys.PipelinePinsKey(), id).Err()
+}
@@ -0,0 +1,74 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// 表情回应的存储：reactions:<会话>:<消息ID>:users 为 {表情 用户ID} 集合，用于去重；
+// reactions:<会话>:<消息ID>:counts 为 {表情: 计数}。两者同时续期，并都有数量上限
+// 返回1表示已生效，0表示重复添加或撤销不存在的回应，-1表示超出上限
+var reactScript = redis.NewScript(`
+local member = ARGV[2] .. ' ' .. ARGV[3]
+if ARGV[1] == 'add' then
+	if redis.call('SISMEMBER', KEYS[1], member) == 1 then
+		return 0
+	end
+	if redis.call('SCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+		return -1
+	end
+	if redis.call('HEXISTS', KEYS[2], ARGV[2]) == 0 and redis.call('HLEN', KEYS[2]) >= tonumber(ARGV[5]) then
+		return -1
+	end
+	redis.call('SADD', KEYS[1], member)
+	redis.call('HINCRBY', KEYS[2], ARGV[2], 1)
+else
+	if redis.call('SREM', KEYS[1], member) == 0 then
+		return 0
+	end
+	if redis.call('HINCRBY', KEYS[2], ARGV[2], -1) <= 0 then
+		redis.call('HDEL', KEYS[2], ARGV[2])
+	end
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+redis.call('PEXPIRE', KEYS[2], ARGV[6])
+return 1
+`)
+
+// ReactionLimits 单条消息的表情回应上限
+type ReactionLimits struct {
+	MaxReactions int           // 回应总数(用户×表情)上限
+	MaxEmojis    int           // 不同表情数上限
+	TTL          time.Duration // 最后一次变化后的保留时间
+}
+
+// AddReaction 添加表情回应，返回1表示已生效，0表示重复添加，-1表示超出上限
+func AddReaction(ctx context.Context, conversation string, messageID string, emoji string, id string, limits ReactionLimits) (int64, error) {
+	return reactScript.Run(ctx, Rdb, keys.ReactionKeys(conversation, messageID),
+		"add", emoji, id, limits.MaxReactions, limits.MaxEmojis, limits.TTL.Milliseconds()).Int64()
+}
+
+// RemoveReaction 撤销表情回应，返回1表示已生效，0表示未回应过
+func RemoveReaction(ctx context.Context, conversation string, messageID string, emoji string, id string, ttl time.Duration) (int64, error) {
+	return reactScript.Run(ctx, Rdb, keys.ReactionKeys(conversation, messageID),
+		"remove", emoji, id, 0, 0, ttl.Milliseconds()).Int64()
+}
+
+// GetReactionCounts 批量读取多条消息的表情回应计数，返回 {消息ID: {表情: 计数}}
+func GetReactionCounts(ctx context.Context, conversation string, messageIDs []string) (map[string]map[string]string, error) {
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(messageIDs))
+	for i, messageID := range messageIDs {
+		cmds[i] = pipe.HGetAll(ctx, keys.ReactionKeys(conversation, messageID)[1])
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]string, len(messageIDs))
+	for i, cmd := range cmds {
+		result[messageIDs[i]] = cmd.Val()
+	}
+	return result, nil
+}
@@ -0,0 +1,93 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// TrackReceipts 登记待确认的回执，seqs 为 {用户ID: 消息序号}，value 为回执请求。
+// 登记保留到 deadline，之后由 DueReceipts 取出判定为过期
+func TrackReceipts(ctx context.Context, seqs map[string]int64, value string, deadline time.Time) error {
+	pipe := Rdb.Pipeline()
+	for id, seq := range seqs {
+		field := strconv.FormatInt(seq, 10)
+		pipe.HSet(ctx, keys.ReceiptsKey(id), field, value)
+		// 过期清理失败时兜底，不依赖它判定过期
+		pipe.ExpireAt(ctx, keys.ReceiptsKey(id), deadline.Add(time.Hour))
+		pipe.ZAdd(ctx, keys.ReceiptDeadlinesKey(), redis.Z{Score: float64(deadline.UnixMilli()), Member: DeviceKey(id, field)})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TakeReceiptsUpTo 取出用户序号不大于 seq 的待确认回执，返回 {消息序号: 回执请求}。
+// 每条回执只会被一次调用取出，重复确认或与过期清理并发时不会重复返回
+func TakeReceiptsUpTo(ctx context.Context, id string, seq int64) (map[int64]string, error) {
+	pending, err := Rdb.HGetAll(ctx, keys.ReceiptsKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for field := range pending {
+		if n, err := strconv.ParseInt(field, 10, 64); err == nil && n <= seq {
+			fields = append(fields, field)
+		}
+	}
+	return takeReceipts(ctx, id, fields, pending)
+}
+
+// TakeReceipt 取出单条待确认回执，已被取出时返回false
+func TakeReceipt(ctx context.Context, id string, seq int64) (string, bool, error) {
+	field := strconv.FormatInt(seq, 10)
+	value, err := Rdb.HGet(ctx, keys.ReceiptsKey(id), field).Result()
+	if errors.Is(err, redis.Nil) {
+		// 已被确认，只清理过期索引
+		return "", false, Rdb.ZRem(ctx, keys.ReceiptDeadlinesKey(), DeviceKey(id, field)).Err()
+	}
+	if err != nil {
+		return "", false, err
+	}
+	taken, err := takeReceipts(ctx, id, []string{field}, map[string]string{field: value})
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := taken[seq]
+	return value, ok, nil
+}
+
+// takeReceipts 逐条 HDEL，只返回由本次调用删除的回执
+func takeReceipts(ctx context.Context, id string, fields []string, values map[string]string) (map[int64]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.IntCmd, len(fields))
+	for i, field := range fields {
+		cmds[i] = pipe.HDel(ctx, keys.ReceiptsKey(id), field)
+		pipe.ZRem(ctx, keys.ReceiptDeadlinesKey(), DeviceKey(id, field))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	taken := make(map[int64]string, len(fields))
+	for i, field := range fields {
+		if cmds[i].Val() == 1 {
+			seq, _ := strconv.ParseInt(field, 10, 64)
+			taken[seq] = values[field]
+		}
+	}
+	return taken, nil
+}
+
+// DueReceipts 最多返回 limit 条已到过期时刻的回执，元素为 <用户ID>#<消息序号>
+func DueReceipts(ctx context.Context, now time.Time, limit int64) ([]string, error) {
+	return Rdb.ZRangeByScore(ctx, keys.ReceiptDeadlinesKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+}
@@ -0,0 +1,58 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"github.com/redis/go-redis/v9"
+	"strings"
+)
+
+// ScanRegistrations 遍历所有设备登记，返回 {DeviceKey: 容器ID}，用于离线对账
+func ScanRegistrations(ctx context.Context) (map[string]string, error) {
+	result := make(map[string]string)
+	iter := Rdb.Scan(ctx, 0, keys.ConnectionKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		id := strings.TrimPrefix(iter.Val(), keys.ConnectionKey(""))
+		// 只对账设备登记，旧版本登记由旧版本实例维护
+		devices, err := Rdb.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		for deviceID, containerID := range devices {
+			result[DeviceKey(id, deviceID)] = containerID
+		}
+	}
+	return result, iter.Err()
+}
+
+// ScanContainerMembers 遍历所有容器的连接集合，返回 {容器ID: DeviceKey 列表}
+func ScanContainerMembers(ctx context.Context) (map[string][]string, error) {
+	result := make(map[string][]string)
+	iter := Rdb.Scan(ctx, 0, keys.ContainerMembersKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		containerID := strings.TrimPrefix(iter.Val(), keys.ContainerMembersKey(""))
+		members, err := Rdb.SMembers(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		result[containerID] = members
+	}
+	return result, iter.Err()
+}
+
+// 登记仍指向该容器时才删除登记并修正旧版本登记，容器集合中的成员总是删除
+var removeRegistrationScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+` + releaseLegacyLua + `
+end
+return redis.call('SREM', KEYS[2], ARGV[3])
+`)
+
+// RemoveRegistration 删除指向 containerID 的设备登记与其在容器集合中的成员。
+// 与 UnregisterConnection 不同，设备已登记到其他容器时仍会清理 containerID 集合中的残留成员
+func RemoveRegistration(ctx context.Context, id string, deviceID string, containerID string) error {
+	return removeRegistrationScript.Run(ctx, Rdb,
+		[]string{keys.ConnectionKey(id), keys.ContainerMembersKey(containerID), keys.LegacyConnectionKey()},
+		deviceID, containerID, DeviceKey(id, deviceID), id).Err()
+}
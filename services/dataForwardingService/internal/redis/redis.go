@@ -3,14 +3,16 @@ package redisClient
 import (
 	"Betterfly2/shared/logger"
 	"context"
+	"data_forwarding_service/internal/redis/keys"
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
 	"os"
+	"strings"
+	"time"
 )
 
 var Rdb *redis.Client
-var ctx = context.Background()
 
 // InitRedis 初始化 Redis
 func InitRedis() error {
@@ -19,55 +21,341 @@ func InitRedis() error {
 		addr = "localhost:6379"
 	}
 
-	Rdb = redis.NewClient(&redis.Options{
-		Addr: addr,
-		DB:   0,
-	})
+	Rdb = newClient(addr)
 
 	sugar := logger.Sugar()
 	sugar.Infof("当前 Redis: %s", addr)
 
-	_, err := Rdb.Ping(ctx).Result()
+	_, err := Rdb.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("连接 Redis 失败: %v", err)
 	}
 	return nil
 }
 
-func RegisterConnection(id string, containerID string) error {
+// newClient 创建客户端，读写超时按调用方 ctx 的截止时刻设置，消息处理超时后正在进行的命令随之中止
+func newClient(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:                  addr,
+		DB:                    0,
+		ContextTimeoutEnabled: true,
+	})
+}
+
+// DeviceKey 组合用户ID与设备ID，作为单个设备连接的唯一标识
+func DeviceKey(id string, deviceID string) string {
+	return id + "#" + deviceID
+}
+
+// SplitDeviceKey 将 DeviceKey 拆分为用户ID与设备ID
+func SplitDeviceKey(key string) (string, string, bool) {
+	return strings.Cut(key, "#")
+}
+
+// legacyDeviceID 旧版本的登记不区分设备，双读时视为该设备，与未声明设备ID的客户端一致
+const legacyDeviceID = "default"
+
+// withLegacy 将旧版本实例写入的用户登记并入设备登记。新版本同时双写旧登记，旧登记指向的容器已出现在设备登记中时
+// 是新版本写入的，不重复计入；否则视为旧版本实例上的默认设备
+func withLegacy(devices map[string]string, legacy string) map[string]string {
+	if legacy == "" {
+		return devices
+	}
+	for _, containerID := range devices {
+		if containerID == legacy {
+			return devices
+		}
+	}
+	if _, ok := devices[legacyDeviceID]; ok {
+		return devices
+	}
+	if devices == nil {
+		devices = make(map[string]string, 1)
+	}
+	devices[legacyDeviceID] = legacy
+	return devices
+}
+
+// releaseLegacyLua 删除设备登记后修正旧版本登记：仍指向该容器时改为用户其余设备之一所在的容器，没有其余设备则删除。
+// KEYS[1] 为设备登记，KEYS[3] 为旧版本登记，ARGV[2] 为容器ID，ARGV[4] 为用户ID
+const releaseLegacyLua = `
+if redis.call('HGET', KEYS[3], ARGV[4]) == ARGV[2] then
+	local others = redis.call('HVALS', KEYS[1])
+	if #others > 0 then
+		redis.call('HSET', KEYS[3], ARGV[4], others[1])
+	else
+		redis.call('HDEL', KEYS[3], ARGV[4])
+	end
+end
+`
+
+// RegisterConnection 登记某用户某设备的连接所在容器。滚动升级期间同时写入旧版本登记，旧版本实例据此找到该用户
+func RegisterConnection(ctx context.Context, id string, deviceID string, containerID string) error {
 	pipe := Rdb.TxPipeline()
-	pipe.HSet(ctx, "ws_connection_mapping", id, containerID)
-	pipe.SAdd(ctx, "container_connections:"+containerID, id)
+	pipe.HSet(ctx, keys.ConnectionKey(id), deviceID, containerID)
+	pipe.SAdd(ctx, keys.ContainerMembersKey(containerID), DeviceKey(id, deviceID))
+	pipe.HSet(ctx, keys.LegacyConnectionKey(), id, containerID)
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func UnregisterConnection(id string, containerID string) error {
-	// 检查当前记录是否匹配当前容器
-	current, err := Rdb.HGet(ctx, "ws_connection_mapping", id).Result()
+// 登记仍指向该容器时删除设备登记与容器集合成员并修正旧版本登记，返回删除前登记的容器(不存在时为空)
+var unregisterConnectionScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if current ~= ARGV[2] then
+	return current or ''
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('SREM', KEYS[2], ARGV[3])
+` + releaseLegacyLua + `
+return current
+`)
+
+// UnregisterConnection 注销某用户某设备的连接，只有登记的容器与containerID一致时才会删除
+func UnregisterConnection(ctx context.Context, id string, deviceID string, containerID string) error {
+	current, err := unregisterConnectionScript.Run(ctx, Rdb,
+		[]string{keys.ConnectionKey(id), keys.ContainerMembersKey(containerID), keys.LegacyConnectionKey()},
+		deviceID, containerID, DeviceKey(id, deviceID), id).Text()
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil // 本来就没有
-		}
 		return err
 	}
-	if current != containerID {
-		logger.Sugar().Warnf("尝试删除非本容器的连接: %s 属于 %s, 当前容器: %s", id, current, containerID)
-		return nil // 不匹配则不删除
+	if current != "" && current != containerID {
+		logger.Sugar().Warnf("尝试删除非本容器的连接: %s 属于 %s, 当前容器: %s", DeviceKey(id, deviceID), current, containerID)
+	}
+	return nil
+}
+
+// GetContainerByConnection 查询某用户某设备所在容器，不在线时返回空字符串
+func GetContainerByConnection(ctx context.Context, id string, deviceID string) string {
+	devices, err := GetUserDevices(ctx, id)
+	if err != nil {
+		logger.Sugar().Warnf("GetContainerByConnection 错误: %v", err)
+		return ""
+	}
+	return devices[deviceID]
+}
+
+// GetUserDevices 查询用户所有在线设备，返回 {设备ID: 容器ID}，包括旧版本实例登记的默认设备
+func GetUserDevices(ctx context.Context, id string) (map[string]string, error) {
+	pipe := Rdb.Pipeline()
+	devices := pipe.HGetAll(ctx, keys.ConnectionKey(id))
+	legacy := pipe.HGet(ctx, keys.LegacyConnectionKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
 	}
+	return withLegacy(devices.Val(), legacy.Val()), nil
+}
 
+// GetDeliveryDevices 查询投递时应送达的设备及其容器：设备登记加上登录切换中的设备，切换中的以新容器为准。
+// 切换期间旧登记可能已注销而新登记尚未写入，据此仍能把消息转到新容器暂存
+func GetDeliveryDevices(ctx context.Context, id string) (map[string]string, error) {
+	pipe := Rdb.Pipeline()
+	devices := pipe.HGetAll(ctx, keys.ConnectionKey(id))
+	legacy := pipe.HGet(ctx, keys.LegacyConnectionKey(), id)
+	transitions := pipe.HGetAll(ctx, keys.TransitionKey(id))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	result := withLegacy(devices.Val(), legacy.Val())
+	if result == nil {
+		result = make(map[string]string)
+	}
+	for deviceID, containerID := range transitions.Val() {
+		result[deviceID] = containerID
+	}
+	return result, nil
+}
+
+// BeginTransition 标记设备正在登录到 containerID，ttl 后自动清除
+func BeginTransition(ctx context.Context, id string, deviceID string, containerID string, ttl time.Duration) error {
 	pipe := Rdb.TxPipeline()
-	pipe.HDel(ctx, "ws_connection_mapping", id)
-	pipe.SRem(ctx, fmt.Sprintf("container_connections:%s", containerID), id)
-	_, err = pipe.Exec(ctx)
+	pipe.HSet(ctx, keys.TransitionKey(id), deviceID, containerID)
+	pipe.PExpire(ctx, keys.TransitionKey(id), ttl)
+	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func GetContainerByConnection(id string) string {
-	result, err := Rdb.HGet(ctx, "ws_connection_mapping", id).Result()
+// EndTransition 清除设备的登录切换标记
+func EndTransition(ctx context.Context, id string, deviceID string) error {
+	return Rdb.HDel(ctx, keys.TransitionKey(id), deviceID).Err()
+}
+
+// GetUserContainers 查询用户所有在线设备所在的容器(去重)
+func GetUserContainers(ctx context.Context, id string) []string {
+	devices, err := GetUserDevices(ctx, id)
 	if err != nil {
-		logger.Sugar().Warnf("GetContainerByConnection 错误: %v", err)
-		return ""
+		logger.Sugar().Warnf("GetUserContainers 错误: %v", err)
+		return nil
+	}
+	return uniqueContainers(devices)
+}
+
+// GetUsersContainers 批量查询多个用户在线设备所在的容器，所有查询通过管道在一次往返中完成
+func GetUsersContainers(ctx context.Context, ids []string) (map[string][]string, error) {
+	if len(ids) == 0 {
+		return map[string][]string{}, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, keys.ConnectionKey(id))
+	}
+	legacy := pipe.HMGet(ctx, keys.LegacyConnectionKey(), ids...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string, len(ids))
+	for i, cmd := range cmds {
+		legacyContainer, _ := legacy.Val()[i].(string)
+		if containers := uniqueContainers(withLegacy(cmd.Val(), legacyContainer)); len(containers) > 0 {
+			result[ids[i]] = containers
+		}
+	}
+	return result, nil
+}
+
+// uniqueContainers 设备登记表中出现的容器(去重)
+func uniqueContainers(devices map[string]string) []string {
+	seen := make(map[string]bool, len(devices))
+	containers := make([]string, 0, len(devices))
+	for _, containerID := range devices {
+		if !seen[containerID] {
+			seen[containerID] = true
+			containers = append(containers, containerID)
+		}
+	}
+	return containers
+}
+
+// NextSequence 为用户分配下一个消息序号，序号在用户维度单调递增
+func NextSequence(ctx context.Context, id string) (int64, error) {
+	return Rdb.Incr(ctx, keys.UserSeqKey(id)).Result()
+}
+
+// CurrentSequence 用户最近分配的消息序号，尚未分配过时为0
+func CurrentSequence(ctx context.Context, id string) (int64, error) {
+	seq, err := Rdb.Get(ctx, keys.UserSeqKey(id)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// NextConversationSequence 为会话分配下一个消息序号。键带哈希标签，集群模式下同一会话的键落在同一个槽
+func NextConversationSequence(ctx context.Context, conversation string) (int64, error) {
+	return Rdb.Incr(ctx, keys.ConvSeqKey(conversation)).Result()
+}
+
+// NextSequences 批量为多个用户分配下一个消息序号，一次往返完成
+func NextSequences(ctx context.Context, ids []string) (map[string]int64, error) {
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.Incr(ctx, keys.UserSeqKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(ids))
+	for i, cmd := range cmds {
+		result[ids[i]] = cmd.Val()
+	}
+	return result, nil
+}
+
+// SetContainerDraining 标记容器是否处于排空状态，排空中的容器不应再被分配新连接
+func SetContainerDraining(ctx context.Context, containerID string, draining bool) error {
+	if draining {
+		return Rdb.SAdd(ctx, keys.DrainingContainersKey(), containerID).Err()
+	}
+	return Rdb.SRem(ctx, keys.DrainingContainersKey(), containerID).Err()
+}
+
+// IsContainerDraining 查询容器是否处于排空状态
+func IsContainerDraining(ctx context.Context, containerID string) bool {
+	draining, err := Rdb.SIsMember(ctx, keys.DrainingContainersKey(), containerID).Result()
+	if err != nil {
+		logger.Sugar().Warnf("IsContainerDraining 错误: %v", err)
+		return false
+	}
+	return draining
+}
+
+// 原子地将设备登记改为新容器并双写旧版本登记，返回之前登记的容器(不存在时为空字符串)。
+// 之前的容器在脚本中才能得知，其集合键由 ARGV[4] 容器集合键前缀拼接
+var claimConnectionScript = redis.NewScript(`
+local old = redis.call('HGET', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if old and old ~= ARGV[2] then
+	redis.call('SREM', ARGV[4] .. old, ARGV[3])
+end
+redis.call('SADD', ARGV[4] .. ARGV[2], ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[5], ARGV[2])
+return old or ''
+`)
+
+// ClaimConnection 原子地接管设备连接的登记，返回之前所在的容器
+func ClaimConnection(ctx context.Context, id string, deviceID string, containerID string) (string, error) {
+	return claimConnectionScript.Run(ctx, Rdb, []string{keys.ConnectionKey(id), keys.LegacyConnectionKey()},
+		deviceID, containerID, DeviceKey(id, deviceID), keys.ContainerMembersKey(""), id).Text()
+}
+
+// RevokeResumeTokens 删除用户所有设备(包括离线设备)的恢复令牌
+func RevokeResumeTokens(ctx context.Context, id string) error {
+	iter := Rdb.Scan(ctx, 0, keys.ResumeTokenKey(DeviceKey(id, "*")), 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return Rdb.Del(ctx, keys...).Err()
+}
+
+// PurgeUserState 删除用户在redis中保存的所有状态：设备登记、消息序号、公钥包、事件订阅、连接记录、已知设备与恢复令牌
+func PurgeUserState(ctx context.Context, id string) error {
+	devices, err := GetUserDevices(ctx, id)
+	if err != nil {
+		return err
+	}
+	bundleDevices, err := Rdb.HKeys(ctx, keys.KeyBundleVersionsKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	pipe := Rdb.TxPipeline()
+	for deviceID, containerID := range devices {
+		pipe.SRem(ctx, keys.ContainerMembersKey(containerID), DeviceKey(id, deviceID))
+	}
+	for _, deviceID := range bundleDevices {
+		pipe.Del(ctx, keys.KeyBundlePrekeysKey(DeviceKey(id, deviceID)))
+	}
+	pipe.HDel(ctx, keys.LegacyConnectionKey(), id)
+	pipe.Del(ctx, keys.ConnectionKey(id), keys.UserSeqKey(id), keys.KeyBundlesKey(id), keys.KeyBundleVersionsKey(id), keys.SubscriptionsKey(id), keys.ConnectionHistoryKey(id), keys.KnownDevicesKey(id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return RevokeResumeTokens(ctx, id)
+}
+
+// StoreResumeToken 保存设备当前有效的恢复令牌ID，新令牌会使旧令牌失效
+func StoreResumeToken(ctx context.Context, id string, deviceID string, tokenID string, ttl time.Duration) error {
+	return Rdb.Set(ctx, keys.ResumeTokenKey(DeviceKey(id, deviceID)), tokenID, ttl).Err()
+}
+
+// ClaimConnectToken 标记连接授权令牌已使用，令牌已被使用过时返回false
+func ClaimConnectToken(ctx context.Context, tokenID string, ttl time.Duration) (bool, error) {
+	return Rdb.SetNX(ctx, keys.ConnectTokenKey(tokenID), 1, ttl).Result()
+}
+
+// GetResumeToken 获取设备当前有效的恢复令牌ID
+func GetResumeToken(ctx context.Context, id string, deviceID string) (string, error) {
+	tokenID, err := Rdb.Get(ctx, keys.ResumeTokenKey(DeviceKey(id, deviceID))).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
 	}
-	return result
+	return tokenID, err
 }
@@ -0,0 +1,213 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/config"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withMiniredis 将 Rdb 换成内存实现，测试结束后恢复
+func withMiniredis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := Rdb
+	Rdb = newClient(mr.Addr())
+	t.Cleanup(func() {
+		Rdb.Close()
+		Rdb = saved
+	})
+	return mr
+}
+
+// stalledServer 接受连接、读取命令但从不回复，模拟卡住的redis
+func stalledServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDeadlineAbortsStalledCommand(t *testing.T) {
+	saved := Rdb
+	Rdb = newClient(stalledServer(t))
+	t.Cleanup(func() {
+		Rdb.Close()
+		Rdb = saved
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NextSequence(ctx, "1")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("命令在截止时刻之后 %v 才返回", elapsed)
+	}
+	var netErr net.Error
+	if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("期望超时错误，实际为 %v", err)
+	}
+}
+
+// 滚动升级期间旧版本实例只读写 ws_connection_mapping，新版本双写并将旧登记读作默认设备
+func TestLegacyConnectionMapping(t *testing.T) {
+	mr := withMiniredis(t)
+	ctx := context.Background()
+
+	// 旧版本实例登记的用户
+	mr.HSet("ws_connection_mapping", "5", "old")
+	devices, err := GetUserDevices(ctx, "5")
+	if err != nil || len(devices) != 1 || devices[legacyDeviceID] != "old" {
+		t.Fatalf("旧登记应读作默认设备: %v %v", devices, err)
+	}
+	if got := GetContainerByConnection(ctx, "5", legacyDeviceID); got != "old" {
+		t.Fatalf("默认设备所在容器为 %q", got)
+	}
+	if got, _ := GetUsersContainers(ctx, []string{"5", "9"}); len(got) != 1 || len(got["5"]) != 1 || got["5"][0] != "old" {
+		t.Fatalf("批量查询未读到旧登记: %v", got)
+	}
+
+	// 新版本登记同时写入旧登记，读取时不重复计入
+	if err := RegisterConnection(ctx, "6", "phone", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet("ws_connection_mapping", "6"); got != "new" {
+		t.Fatalf("旧登记未双写: %q", got)
+	}
+	if devices, _ := GetUserDevices(ctx, "6"); len(devices) != 1 || devices["phone"] != "new" {
+		t.Fatalf("双写的旧登记被重复计入: %v", devices)
+	}
+	if old, err := ClaimConnection(ctx, "6", "tablet", "other"); err != nil || old != "" {
+		t.Fatalf("接管登记失败: %q %v", old, err)
+	}
+	if got := mr.HGet("ws_connection_mapping", "6"); got != "other" {
+		t.Fatalf("接管登记未双写旧登记: %q", got)
+	}
+
+	// 注销时旧登记改为其余设备所在的容器，最后一个设备注销后删除
+	if err := UnregisterConnection(ctx, "6", "tablet", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet("ws_connection_mapping", "6"); got != "new" {
+		t.Fatalf("旧登记未指向其余设备: %q", got)
+	}
+	if err := UnregisterConnection(ctx, "6", "phone", "elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet("ws_connection_mapping", "6"); got != "new" {
+		t.Fatalf("注销其他容器的连接改动了旧登记: %q", got)
+	}
+	if err := UnregisterConnection(ctx, "6", "phone", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.HGet("ws_connection_mapping", "6") != "" {
+		t.Fatal("最后一个设备注销后旧登记仍然存在")
+	}
+}
+
+func TestMigrateKeysMovesLegacyMapping(t *testing.T) {
+	mr := withMiniredis(t)
+	saved := config.Handler.RedisKeyPrefix
+	config.Handler.RedisKeyPrefix = "prod"
+	t.Cleanup(func() { config.Handler.RedisKeyPrefix = saved })
+
+	mr.HSet("ws_connection_mapping", "5", "old")
+	if _, err := MigrateKeys(context.Background(), 10, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet("prod:ws_connection_mapping", "5"); got != "old" {
+		t.Fatalf("旧登记未迁移到加前缀的键: %q", got)
+	}
+	if devices, _ := GetUserDevices(context.Background(), "5"); devices[legacyDeviceID] != "old" {
+		t.Fatalf("迁移后未读到旧登记: %v", devices)
+	}
+}
+
+// 同一会话并发分配的序号不重复、不跳号
+func TestConversationSequenceConcurrent(t *testing.T) {
+	withMiniredis(t)
+	const workers, perWorker = 16, 50
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				seq, err := NextConversationSequence(context.Background(), "g:1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[seq] {
+					t.Errorf("序号 %d 被重复分配", seq)
+				}
+				seen[seq] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for seq := int64(1); seq <= workers*perWorker; seq++ {
+		if !seen[seq] {
+			t.Fatalf("序号 %d 缺失", seq)
+		}
+	}
+}
+
+// 热门群聊所有发送者争用同一个键，与分散在多个会话上的分配对比。
+// miniredis 串行执行所有命令，这里只反映客户端与单键往返的开销，服务端争用需对真实redis观察 conv_seq_alloc_ms
+func BenchmarkConversationSequence(b *testing.B) {
+	b.Run("hot", func(b *testing.B) {
+		withMiniredis(b)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := NextConversationSequence(context.Background(), "g:hot"); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("spread", func(b *testing.B) {
+		withMiniredis(b)
+		var next atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			conv := "g:" + strconv.FormatInt(next.Add(1), 10)
+			for pb.Next() {
+				if _, err := NextConversationSequence(context.Background(), conv); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
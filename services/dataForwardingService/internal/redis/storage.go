@@ -0,0 +1,108 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// StorageUsage 离线保存的条数与字节数
+type StorageUsage struct {
+	UserID  string `json:"user_id,omitempty"`
+	Entries int64  `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// StorageEviction 一次或累计的超额淘汰，Before 为被淘汰的最新一条消息的保存时刻
+type StorageEviction struct {
+	Entries int64
+	Bytes   int64
+	Before  time.Time
+}
+
+// AddStorageUsage 调整用户的离线保存用量并同步排行与集群总量，返回调整后的用户用量。
+// 三个键可能位于不同的槽，不保证原子性；用量降到0时删除用户的记录
+func AddStorageUsage(ctx context.Context, userID string, entries int64, bytes int64) (StorageUsage, error) {
+	pipe := Rdb.Pipeline()
+	entriesCmd := pipe.HIncrBy(ctx, keys.StorageUsageKey(userID), "entries", entries)
+	bytesCmd := pipe.HIncrBy(ctx, keys.StorageUsageKey(userID), "bytes", bytes)
+	pipe.ZIncrBy(ctx, keys.StorageUsageRankKey(), float64(bytes), userID)
+	pipe.HIncrBy(ctx, keys.StorageUsageTotalKey(), "entries", entries)
+	pipe.HIncrBy(ctx, keys.StorageUsageTotalKey(), "bytes", bytes)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return StorageUsage{}, err
+	}
+	usage := StorageUsage{UserID: userID, Entries: entriesCmd.Val(), Bytes: bytesCmd.Val()}
+	if usage.Entries <= 0 {
+		pipe := Rdb.Pipeline()
+		pipe.Del(ctx, keys.StorageUsageKey(userID))
+		pipe.ZRem(ctx, keys.StorageUsageRankKey(), userID)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+// TopStorageUsers 离线保存字节数最多的 n 个用户
+func TopStorageUsers(ctx context.Context, n int) ([]StorageUsage, error) {
+	ranked, err := Rdb.ZRevRangeWithScores(ctx, keys.StorageUsageRankKey(), 0, int64(n)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(ranked))
+	for i, z := range ranked {
+		cmds[i] = pipe.HGet(ctx, keys.StorageUsageKey(z.Member.(string)), "entries")
+	}
+	if len(ranked) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+	users := make([]StorageUsage, len(ranked))
+	for i, z := range ranked {
+		entries, _ := cmds[i].Int64()
+		users[i] = StorageUsage{UserID: z.Member.(string), Entries: entries, Bytes: int64(z.Score)}
+	}
+	return users, nil
+}
+
+// TotalStorageUsage 集群离线保存总量
+func TotalStorageUsage(ctx context.Context) (StorageUsage, error) {
+	fields, err := Rdb.HGetAll(ctx, keys.StorageUsageTotalKey()).Result()
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	entries, _ := strconv.ParseInt(fields["entries"], 10, 64)
+	bytes, _ := strconv.ParseInt(fields["bytes"], 10, 64)
+	return StorageUsage{Entries: entries, Bytes: bytes}, nil
+}
+
+// RecordStorageEviction 累计用户尚未告知客户端的超额淘汰
+func RecordStorageEviction(ctx context.Context, userID string, eviction StorageEviction) error {
+	pipe := Rdb.TxPipeline()
+	pipe.HIncrBy(ctx, keys.StorageEvictedKey(userID), "entries", eviction.Entries)
+	pipe.HIncrBy(ctx, keys.StorageEvictedKey(userID), "bytes", eviction.Bytes)
+	pipe.HSet(ctx, keys.StorageEvictedKey(userID), "before_ms", eviction.Before.UnixMilli())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TakeStorageEviction 取出并清除用户累计的超额淘汰，没有时 Entries 为0
+func TakeStorageEviction(ctx context.Context, userID string) (StorageEviction, error) {
+	pipe := Rdb.TxPipeline()
+	fieldsCmd := pipe.HGetAll(ctx, keys.StorageEvictedKey(userID))
+	pipe.Del(ctx, keys.StorageEvictedKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return StorageEviction{}, err
+	}
+	fields := fieldsCmd.Val()
+	entries, _ := strconv.ParseInt(fields["entries"], 10, 64)
+	bytes, _ := strconv.ParseInt(fields["bytes"], 10, 64)
+	beforeMs, _ := strconv.ParseInt(fields["before_ms"], 10, 64)
+	return StorageEviction{Entries: entries, Bytes: bytes, Before: time.UnixMilli(beforeMs)}, nil
+}
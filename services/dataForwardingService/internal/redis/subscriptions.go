@@ -0,0 +1,25 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetSubscriptions 读取设备订阅的事件类别(逗号分隔的类别名)，从未设置过时ok为false，此时按客户端类别的默认值处理
+func GetSubscriptions(ctx context.Context, id string, deviceID string) (subscriptions string, ok bool, err error) {
+	v, err := Rdb.HGet(ctx, keys.SubscriptionsKey(id), deviceID).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// SetSubscriptions 保存设备订阅的事件类别，其他容器与之后的登录据此得知
+func SetSubscriptions(ctx context.Context, id string, deviceID string, subscriptions string) error {
+	return Rdb.HSet(ctx, keys.SubscriptionsKey(id), deviceID, subscriptions).Err()
+}
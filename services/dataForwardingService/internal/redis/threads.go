@@ -0,0 +1,54 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// 话题计数保存在 thread:<会话>:<话题ID> hash 中：author 为首条消息的发送者(首次写入后不再改变)，
+// replies 为累计回复数，unseen 为发送者离线期间的新回复数
+var threadReplyScript = redis.NewScript(`
+if ARGV[1] ~= '' then
+	redis.call('HSETNX', KEYS[1], 'author', ARGV[1])
+end
+local replies = redis.call('HINCRBY', KEYS[1], 'replies', 1)
+local unseen = 0
+if ARGV[2] == '1' then
+	unseen = redis.call('HINCRBY', KEYS[1], 'unseen', 1)
+else
+	redis.call('HSET', KEYS[1], 'unseen', 0)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {redis.call('HGET', KEYS[1], 'author') or '', replies, unseen}
+`)
+
+// ThreadCounters 一次回复后的话题计数
+type ThreadCounters struct {
+	Author  string // 话题首条消息的发送者，未知时为空
+	Replies int64
+	Unseen  int64
+}
+
+// IncrThreadReplies 记录一条回复。author 非空且尚未记录发送者时写入；
+// authorOffline 为true时累加离线期间的新回复数，否则清零
+func IncrThreadReplies(ctx context.Context, conversation string, rootID string, author string, authorOffline bool, ttl time.Duration) (ThreadCounters, error) {
+	offline := "0"
+	if authorOffline {
+		offline = "1"
+	}
+	values, err := threadReplyScript.Run(ctx, Rdb, []string{keys.ThreadKey(conversation, rootID)}, author, offline, ttl.Milliseconds()).Slice()
+	if err != nil {
+		return ThreadCounters{}, err
+	}
+	if len(values) != 3 {
+		return ThreadCounters{}, fmt.Errorf("话题计数返回值异常: %v", values)
+	}
+	counters := ThreadCounters{}
+	counters.Author, _ = values[0].(string)
+	counters.Replies, _ = values[1].(int64)
+	counters.Unseen, _ = values[2].(int64)
+	return counters, nil
+}
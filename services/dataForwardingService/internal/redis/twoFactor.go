@@ -0,0 +1,58 @@
+package redisClient
+
+import (
+	"context"
+	"data_forwarding_service/internal/redis/keys"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// StoreTwoFactorChallenge 保存二次验证挑战，过期后自动删除
+func StoreTwoFactorChallenge(ctx context.Context, challengeID string, fields map[string]string, ttl time.Duration) error {
+	key := keys.TwoFactorKey(challengeID)
+	pipe := Rdb.TxPipeline()
+	pipe.HSet(ctx, key, fields)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetTwoFactorChallenge 获取二次验证挑战，不存在或已过期时返回nil
+func GetTwoFactorChallenge(ctx context.Context, challengeID string) (map[string]string, error) {
+	fields, err := Rdb.HGetAll(ctx, keys.TwoFactorKey(challengeID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// 挑战过期后不能再计数，否则会留下没有过期时间的残缺挑战
+var incrAttemptsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+return redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+`)
+
+// IncrTwoFactorAttempts 记录一次提交并返回累计提交次数，挑战已过期时返回-1
+func IncrTwoFactorAttempts(ctx context.Context, challengeID string) (int64, error) {
+	return incrAttemptsScript.Run(ctx, Rdb, []string{keys.TwoFactorKey(challengeID)}).Int64()
+}
+
+// DeleteTwoFactorChallenge 删除二次验证挑战
+func DeleteTwoFactorChallenge(ctx context.Context, challengeID string) error {
+	return Rdb.Del(ctx, keys.TwoFactorKey(challengeID)).Err()
+}
+
+// GetTOTPSecret 获取用户的TOTP密钥(base32编码)，未开启时返回空
+func GetTOTPSecret(ctx context.Context, id string) (string, error) {
+	secret, err := Rdb.Get(ctx, keys.TOTPSecretKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return secret, err
+}
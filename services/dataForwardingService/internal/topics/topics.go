@@ -0,0 +1,79 @@
+// Package topics 消息队列topic与消费组的命名。所有topic都加上按环境/集群配置的前缀，
+// 共用同一个broker的不同环境互不串扰；调用方不应自行拼接topic名
+package topics
+
+import (
+	"data_forwarding_service/config"
+	"fmt"
+	"regexp"
+)
+
+// validTopic broker允许的topic字符与长度
+var validTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// Validate 检查topic名是否只包含broker允许的字符
+func Validate(topic string) error {
+	if !validTopic.MatchString(topic) {
+		return fmt.Errorf("topic名非法: %q", topic)
+	}
+	return nil
+}
+
+// withPrefix 加上 TopicPrefix，未配置前缀时原样返回
+func withPrefix(name string) string {
+	if prefix := config.Handler.TopicPrefix; prefix != "" {
+		return prefix + "." + name
+	}
+	return name
+}
+
+// publishName 迁移期间仍向旧名称发布，保证尚未升级、只订阅旧名称的容器能收到
+func publishName(name string) string {
+	if config.Handler.TopicMigration {
+		return name
+	}
+	return withPrefix(name)
+}
+
+// subscribeNames 迁移期间同时订阅新旧名称
+func subscribeNames(name string) []string {
+	names := []string{withPrefix(name)}
+	if config.Handler.TopicMigration && names[0] != name {
+		names = append(names, name)
+	}
+	return names
+}
+
+func federationName(region string) string {
+	return "federation-" + region
+}
+
+// BuildContainerTopic 发往某容器的topic
+func BuildContainerTopic(containerID string) string {
+	return publishName(containerID)
+}
+
+// BuildFederationTopic 区域的联邦topic，其他区域发往该区域用户的消息经此转入
+func BuildFederationTopic(region string) string {
+	return publishName(federationName(region))
+}
+
+// BuildDeadLetterTopic 无法处理的报文转存的topic
+func BuildDeadLetterTopic() string {
+	return publishName("dead-letter")
+}
+
+// ContainerSubscriptions 容器需要消费的topic，迁移期间包含旧名称
+func ContainerSubscriptions(containerID string) []string {
+	return subscribeNames(containerID)
+}
+
+// FederationSubscriptions 区域联邦topic的订阅列表，迁移期间包含旧名称
+func FederationSubscriptions(region string) []string {
+	return subscribeNames(federationName(region))
+}
+
+// BuildConsumerGroup 消费组ID，同样加前缀，避免不同环境的消费者被分进同一个组
+func BuildConsumerGroup(name string) string {
+	return withPrefix(name)
+}
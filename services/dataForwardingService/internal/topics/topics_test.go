@@ -0,0 +1,146 @@
+package topics
+
+import (
+	"data_forwarding_service/config"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func withTopicConfig(t *testing.T, prefix string, migration bool) {
+	t.Helper()
+	saved := *config.Handler
+	config.Handler.TopicPrefix = prefix
+	config.Handler.TopicMigration = migration
+	t.Cleanup(func() { *config.Handler = saved })
+}
+
+func TestBuilders(t *testing.T) {
+	cases := []struct {
+		prefix    string
+		migration bool
+		publish   string
+		subscribe []string
+	}{
+		{"", false, "c1", []string{"c1"}},
+		{"staging", false, "staging.c1", []string{"staging.c1"}},
+		{"staging", true, "c1", []string{"staging.c1", "c1"}},
+		{"", true, "c1", []string{"c1"}},
+	}
+	for _, c := range cases {
+		withTopicConfig(t, c.prefix, c.migration)
+		if got := BuildContainerTopic("c1"); got != c.publish {
+			t.Errorf("前缀 %q 迁移 %v: 发布到 %q，期望 %q", c.prefix, c.migration, got, c.publish)
+		}
+		if got := ContainerSubscriptions("c1"); !reflect.DeepEqual(got, c.subscribe) {
+			t.Errorf("前缀 %q 迁移 %v: 订阅 %v，期望 %v", c.prefix, c.migration, got, c.subscribe)
+		}
+		for _, topic := range append(c.subscribe, BuildFederationTopic("eu"), BuildDeadLetterTopic(), BuildConsumerGroup("g")) {
+			if err := Validate(topic); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err := Validate("a/b"); err == nil {
+		t.Error("包含 / 的topic名通过了校验")
+	}
+}
+
+// topicArgs 发布与订阅函数中topic参数的位置
+var topicArgs = map[string][]int{
+	"publishMessage":     {2},
+	"publishRequest":     {3},
+	"PublishMessage":     {2},
+	"startConsumerGroup": {3, 4},
+}
+
+// 所有发布与订阅的调用点都经由本包的函数得到topic名，不自行拼接或写死字符串；
+// 以topic命名的变量同样不能由字符串拼接得到
+func TestNoRawTopicConcatenation(t *testing.T) {
+	root := filepath.Join("..", "..")
+	fset := token.NewFileSet()
+	checked := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				for _, i := range topicArgs[calleeName(n.Fun)] {
+					if i < len(n.Args) {
+						checked++
+						if raw(n.Args[i]) {
+							t.Errorf("%s: topic参数没有经由 topics 包构造", fset.Position(n.Args[i].Pos()))
+						}
+					}
+				}
+			case *ast.AssignStmt:
+				for i, lhs := range n.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok && isTopicName(id.Name) && i < len(n.Rhs) && raw(n.Rhs[i]) {
+						t.Errorf("%s: 变量 %s 由字符串拼接得到", fset.Position(n.Pos()), id.Name)
+					}
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked == 0 {
+		t.Fatal("没有找到任何发布或订阅的调用点")
+	}
+}
+
+func calleeName(fun ast.Expr) string {
+	switch f := fun.(type) {
+	case *ast.Ident:
+		return f.Name
+	case *ast.SelectorExpr:
+		return f.Sel.Name
+	}
+	return ""
+}
+
+func isTopicName(name string) bool {
+	return strings.Contains(strings.ToLower(name), "topic")
+}
+
+// raw 表达式是写死的字符串、字符串拼接或格式化得到的名称
+func raw(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		return e.Kind == token.STRING
+	case *ast.BinaryExpr:
+		return e.Op == token.ADD
+	case *ast.CompositeLit:
+		for _, elt := range e.Elts {
+			if raw(elt) {
+				return true
+			}
+		}
+	case *ast.CallExpr:
+		if sel, ok := e.Fun.(*ast.SelectorExpr); ok {
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "fmt" {
+				return true
+			}
+		}
+	case *ast.ParenExpr:
+		return raw(e.X)
+	}
+	return false
+}
@@ -14,8 +14,8 @@ func SplitBrokers(broker string) []string {
 	return strings.Split(broker, ",")
 }
 
-// ValidateAndParseJWT 通过rpc验证并解析JWT
-func ValidateAndParseJWT(fromID int64, jwt string) error {
+// ValidateAndParseJWT 通过rpc验证并解析JWT，ctx 结束时中止rpc调用
+func ValidateAndParseJWT(ctx context.Context, fromID int64, jwt string) error {
 	rpcClient, err := grpcClient.GetAuthClient()
 	if err != nil {
 		return err
@@ -25,7 +25,7 @@ func ValidateAndParseJWT(fromID int64, jwt string) error {
 	checkJWTReq.Jwt = jwt
 	checkJWTReq.UserId = fromID
 
-	checkJWTRsp, err := rpcClient.CheckJwt(context.Background(), checkJWTReq)
+	checkJWTRsp, err := rpcClient.CheckJwt(ctx, checkJWTReq)
 	if err != nil {
 		return err
 	}
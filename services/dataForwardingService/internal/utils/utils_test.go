@@ -0,0 +1,58 @@
+package utils
+
+import (
+	pb "Betterfly2/proto/server_rpc/auth"
+	"context"
+	"data_forwarding_service/internal/grpcClient"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// slowAuth 直到调用方取消才返回的认证服务
+type slowAuth struct {
+	pb.UnimplementedAuthServiceServer
+	cancelled chan struct{}
+}
+
+func (s *slowAuth) CheckJwt(ctx context.Context, req *pb.CheckJwtReq) (*pb.CheckJwtRsp, error) {
+	<-ctx.Done()
+	close(s.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestValidateAndParseJWTHonoursDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	auth := &slowAuth{cancelled: make(chan struct{})}
+	pb.RegisterAuthServiceServer(server, auth)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	// 认证客户端是进程内单例，换成指向本测试服务的新连接，结束后丢弃
+	t.Setenv("AUTH_RPC_ADDR", l.Addr().String())
+	grpcClient.Reset()
+	t.Cleanup(grpcClient.Reset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = ValidateAndParseJWT(ctx, 1, "token")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("期望 DeadlineExceeded，实际为 %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("校验在截止时刻之后 %v 才返回", elapsed)
+	}
+	select {
+	case <-auth.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("认证服务没有收到取消")
+	}
+}
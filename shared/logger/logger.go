@@ -19,10 +19,9 @@ func initSugar() {
 	})
 }
 
+// Sugar 首次调用时初始化，可并发调用
 func Sugar() *zap.SugaredLogger {
-	if sugar == nil {
-		initSugar()
-	}
+	initSugar()
 	return sugar
 }
 